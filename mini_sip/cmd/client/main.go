@@ -4,34 +4,93 @@
 //  1. 发送 OPTIONS 请求 → 探测服务器能力
 //  2. 发送 REGISTER 请求 → 注册到服务器
 //  3. 发送 INVITE 请求  → 发起呼叫
-//  4. 等待 200 OK
+//  4. 等待 200 OK（-cancel 指定时间内未接听则发送 CANCEL，INVITE 以 487 结束）
 //  5. 发送 ACK          → 确认会话建立
-//  6. 等待 3 秒（模拟通话）
+//  6. 通话 -duration（默认 3 秒）：按协商结果向对端发送 RTP 音频（-tone 正弦波或 -wav 文件）
 //  7. 发送 BYE          → 挂断
 //
 // 运行方式（先启动 server）：
 //
 //	go run ./cmd/server
 //	go run ./cmd/client -server 127.0.0.1:5060
+//
+// 经由代理互通（server 以 -proxy 启动，bob 注册后等待来电，alice 呼叫 bob）：
+//
+//	go run ./cmd/server -proxy
+//	go run ./cmd/client -answer -addr 127.0.0.1:5071 -from sip:bob@127.0.0.1
+//	go run ./cmd/client -addr 127.0.0.1:5070 -from sip:alice@127.0.0.1 -to sip:bob@127.0.0.1
+//
+// 即时消息（RFC 3428）：bob 不在线时消息由服务器暂存，bob 以 -answer 注册后收到：
+//
+//	go run ./cmd/client -message "hi bob" -addr 127.0.0.1:5072 -from sip:carol@127.0.0.1 -to sip:bob@127.0.0.1
+//
+// 订阅 bob 的在线状态（RFC 6665，server 以 UAS 模式启动），bob 注册 / 注销时收到 NOTIFY：
+//
+//	go run ./cmd/client -subscribe presence -addr 127.0.0.1:5072 -from sip:carol@127.0.0.1 -to sip:bob@127.0.0.1
+//
+// 呼叫转移（RFC 3515 / RFC 3891）：alice 与 bob 通话后把 bob 转给 carol，bob 与 carol 以 -answer 运行，
+// bob 收到 REFER 后呼叫 carol，alice 由 NOTIFY 得知转移结果后挂断；-attended 时 alice 先与 carol
+// 通话（咨询），bob 的 INVITE 以 Replaces 替换该通话，carol 随即挂断与 alice 的通话：
+//
+//	go run ./cmd/client -answer -addr 127.0.0.1:5071 -from sip:bob@127.0.0.1:5071
+//	go run ./cmd/client -answer -addr 127.0.0.1:5072 -from sip:carol@127.0.0.1:5072 -rtp-port 30004
+//	go run ./cmd/client -server 127.0.0.1:5071 -to sip:bob@127.0.0.1:5071 -rtp-port 30008 \
+//		-transfer sip:carol@127.0.0.1:5072 [-attended]
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
 	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/event"
+	"github.com/lccxxo/go_/mini_sip/internal/im"
 	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/rtp"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
 	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
 	"go.uber.org/zap"
 )
 
 var (
-	serverAddr = flag.String("server", "127.0.0.1:5060", "SIP server address")
+	serverAddr = flag.String("server", "127.0.0.1:5060", "SIP server address or domain, located via NAPTR/SRV/A when no port is given (RFC 3263)")
 	listenAddr = flag.String("addr", "0.0.0.0:5070", "local SIP listen address (client uses 5070)")
 	fromURI    = flag.String("from", "sip:alice@127.0.0.1:5070", "caller URI (From)")
-	toURI      = flag.String("to", "sip:bob@127.0.0.1:5060", "callee URI (To)")
+	toURI      = flag.String("to", "sip:bob@127.0.0.1:5060", "callee URI (To), sips: URIs are sent over TLS")
+	tlsAddr    = flag.String("tls-addr", "", "local SIP TLS listen address (e.g. 0.0.0.0:5071), required for sips:")
+	tlsServer  = flag.String("tls-server", "127.0.0.1:5061", "SIP server TLS address used for sips: requests")
+	tlsCert    = flag.String("tls-cert", "", "TLS certificate file (PEM)")
+	tlsKey     = flag.String("tls-key", "", "TLS private key file (PEM)")
+	tlsCA      = flag.String("tls-ca", "", "TLS CA bundle used to verify the server (PEM)")
+	authUser   = flag.String("user", "", "digest username, defaults to the user part of -from")
+	authPass   = flag.String("password", "", "digest password; when set 401/407 challenges are answered automatically")
+	answer     = flag.Bool("answer", false, "callee mode: register -from with the server and answer incoming calls")
+	ringTime   = flag.Duration("ring", time.Second, "callee mode: how long to ring before answering")
+	regQ       = flag.String("q", "", "callee mode: q-value of the registered contact (e.g. 0.5), empty for default")
+	rtpPort    = flag.Int("rtp-port", 30000, "local RTP port advertised in SDP, 0 to send INVITE without SDP")
+	codecList  = flag.String("codecs", "PCMU,PCMA,telephone-event", "comma separated codecs in order of preference")
+	toneFreq   = flag.Float64("tone", 440, "frequency in Hz of the tone streamed during the call")
+	wavFile    = flag.String("wav", "", "16-bit PCM WAV file (8000 Hz) streamed during the call instead of the tone")
+	sessionExp = flag.Int("session-expires", stack.DefaultSessionExpires, "session interval in seconds requested in INVITE (RFC 4028), 0 to disable session timers")
+	minSE      = flag.Int("min-se", stack.MinSessionExpires, "smallest accepted session interval in seconds")
+	callTime   = flag.Duration("duration", 3*time.Second, "how long the call lasts before hanging up")
+	cancelIn   = flag.Duration("cancel", 0, "cancel the INVITE if it is not answered within this time (e.g. 500ms), 0 to wait")
+	subscribe  = flag.String("subscribe", "", "subscriber mode: subscribe to this event package of -to (presence, message-summary) and print NOTIFYs")
+	imText     = flag.String("message", "", "send this text to -to as a SIP MESSAGE and exit; callee mode (-answer) prints received messages")
+	imCPIM     = flag.Bool("cpim", false, "wrap -message in message/cpim (RFC 3862) instead of text/plain")
+	subExpires = flag.Int("sub-expires", stack.DefaultSubscriptionExpires, "subscriber mode: requested subscription duration in seconds")
+	transferTo = flag.String("transfer", "", "transfer the call to this URI with REFER after -duration instead of just hanging up")
+	attended   = flag.Bool("attended", false, "with -transfer: call the transfer target first and refer with Replaces (attended transfer)")
+	keepalive  = flag.Duration("keepalive", 0, "callee mode: send CRLF keepalives to the server at this interval to keep NAT bindings open (RFC 5626), 0 to disable")
 )
 
 func main() {
@@ -40,23 +99,75 @@ func main() {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 
+	var opts []stack.Option
+	if *tlsAddr != "" {
+		cfg, err := transport.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			logger.Fatal("load TLS config", zap.Error(err))
+		}
+		opts = append(opts, stack.WithTLS(*tlsAddr, cfg))
+	}
+
+	if *authPass != "" {
+		user := *authUser
+		if user == "" {
+			if u, err := message.ParseURI(*fromURI); err == nil {
+				user = u.User
+			}
+		}
+		store := auth.NewMemoryStore()
+		store.Set("", user, *authPass)
+		opts = append(opts, stack.WithCredentials(user, store))
+	}
+	if *rtpPort != 0 {
+		codecs, err := sdp.ParseCodecList(*codecList)
+		if err != nil {
+			logger.Fatal("parse -codecs", zap.Error(err))
+		}
+		opts = append(opts, stack.WithMedia(sdp.Config{Username: "mini_sip", Port: *rtpPort, Codecs: codecs}))
+	}
+
+	if *sessionExp != 0 {
+		opts = append(opts, stack.WithSessionTimer(*sessionExp, *minSE))
+	}
+
 	uac := &UAC{
 		logger:     logger,
 		serverAddr: *serverAddr,
 		responseCh: make(chan *message.Response, 10),
+		errCh:      make(chan error, 10),
+		answer:     *answer,
+		calls:      make(map[string]*rtp.Session),
+		referCh:    make(chan int, 10),
 	}
-	s, err := stack.NewStack(*listenAddr, uac, logger)
+	s, err := stack.NewStack(*listenAddr, uac, logger, opts...)
 	if err != nil {
 		logger.Fatal("start SIP stack", zap.Error(err))
 	}
 	uac.stack = s
 	defer s.Stop()
+	if err := uac.locateServer(); err != nil {
+		logger.Fatal("locate server", zap.Error(err))
+	}
 
 	logger.Info("SIP UAC started",
 		zap.String("local", *listenAddr),
 		zap.String("server", *serverAddr),
 	)
 
+	if *answer {
+		runCallee(uac)
+		return
+	}
+	if *subscribe != "" {
+		runSubscriber(uac)
+		return
+	}
+	if *imText != "" {
+		runMessage(uac)
+		return
+	}
+
 	// ── 步骤 1：OPTIONS ────────────────────────────────────────────
 	fmt.Println("\n[Step 1] Sending OPTIONS to probe server capabilities...")
 	if err := uac.sendOptions(); err != nil {
@@ -92,47 +203,127 @@ func main() {
 	if err != nil {
 		logger.Fatal("build INVITE", zap.Error(err))
 	}
-	if err := uac.stack.SendRequest(inviteReq, *serverAddr); err != nil {
+	// sips: 呼叫必须经由 TLS 发往服务器的 TLS 端口
+	if inviteReq.RequestURI.Scheme == "sips" {
+		err = uac.stack.SendRequest(inviteReq, *tlsServer)
+	} else {
+		err = uac.send(inviteReq)
+	}
+	if err != nil {
 		logger.Fatal("send INVITE", zap.Error(err))
 	}
 	fmt.Println("  -> INVITE sent")
 
-	// 等待最终响应（2xx 或 4xx+）
+	// -cancel：超时未接听则取消呼叫
+	var cancelled atomic.Bool
+	if *cancelIn > 0 {
+		timer := time.AfterFunc(*cancelIn, func() {
+			if uac.cancelInvite(inviteReq) {
+				cancelled.Store(true)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	// 等待最终响应（2xx 或 4xx+）；带 SDP answer 的 183（可靠临时响应，PRACK 由协议栈发送）开始早期媒体
 	var finalResp *message.Response
+	var media *rtp.Session
 	for {
-		resp = uac.waitResponse(10 * time.Second)
+		// 事务层负责重传，Timer B（64*T1）超时会通过 OnError 返回
+		resp = uac.waitResponse(40 * time.Second)
 		if resp == nil {
 			fmt.Println("  [timeout] no response")
 			os.Exit(1)
 		}
-		fmt.Printf("  <- %d %s\n", resp.StatusCode, resp.Reason)
-		if resp.StatusCode >= 200 {
+		method := responseMethod(resp)
+		fmt.Printf("  <- %d %s (%s)\n", resp.StatusCode, resp.Reason, method)
+		if resp.StatusCode >= 200 && method == message.MethodINVITE {
 			finalResp = resp
 			break
 		}
+		if media == nil && method == message.MethodINVITE && len(resp.Body) > 0 {
+			if streams, err := uac.stack.ProcessAnswer(inviteReq, resp); err == nil && len(streams) > 0 {
+				fmt.Println("  early media:")
+				printStreams(streams)
+				media = uac.startMedia(streams)
+			}
+		}
+	}
+	// 认证重试后实际得到应答的是重发的 INVITE
+	if req := uac.lastRequest(); req != nil && req.Method == message.MethodINVITE {
+		inviteReq = req
 	}
 
+	if media != nil && finalResp.StatusCode >= 300 {
+		media.Close()
+	}
+	if finalResp.StatusCode == message.StatusRequestTerminated && cancelled.Load() {
+		fmt.Println("  Call cancelled.")
+		os.Exit(0)
+	}
 	if finalResp.StatusCode != message.StatusOK {
 		fmt.Printf("  Call rejected: %d %s\n", finalResp.StatusCode, finalResp.Reason)
 		os.Exit(0)
 	}
+	if cancelled.Load() {
+		// CANCEL 与 200 交叉：协议栈已对 2xx 回 ACK 并发送 BYE（RFC 3261 §9.1）
+		fmt.Println("  Answered before CANCEL took effect, stack sent ACK + BYE")
+		for resp := uac.waitResponse(5 * time.Second); resp != nil; resp = uac.waitResponse(5 * time.Second) {
+			if responseMethod(resp) == message.MethodBYE {
+				fmt.Printf("  <- %d %s (BYE)\n", resp.StatusCode, resp.Reason)
+				break
+			}
+		}
+		os.Exit(0)
+	}
+	var streams []sdp.Stream
+	if media == nil {
+		streams, err = uac.stack.ProcessAnswer(inviteReq, finalResp)
+		if err != nil {
+			logger.Warn("SDP negotiation failed", zap.Error(err))
+		}
+		printStreams(streams)
+	}
+
+	// 2xx 由协议栈建立对话，ACK / BYE 由对话构造：
+	// Request-URI 为对端 Contact，经由 Record-Route 得到的路由集发送
+	dlg := uac.stack.ResponseDialog(finalResp)
+	if dlg == nil {
+		logger.Fatal("no dialog for 200 OK")
+	}
 
 	// ── 步骤 4：ACK ────────────────────────────────────────────────
+	// 对 2xx 的 ACK 由 TU 直接发送，CSeq 序号与 INVITE 相同（RFC 3261 §13.2.2.4）
 	fmt.Println("\n[Step 4] Sending ACK (confirming dialog)...")
-	ack := uac.buildACK(inviteReq, finalResp)
-	if err := uac.stack.SendRequest(ack, *serverAddr); err != nil {
+	if err := uac.stack.SendInDialog(dlg.NewRequest(message.MethodACK)); err != nil {
 		logger.Error("send ACK", zap.Error(err))
 	}
 	fmt.Println("  -> ACK sent, dialog established!")
 
-	// ── 步骤 5：模拟通话 ───────────────────────────────────────────
-	fmt.Println("\n[Step 5] Call in progress (3 seconds)...")
-	time.Sleep(3 * time.Second)
+	// ── 步骤 5：通话（RTP 媒体流）─────────────────────────────────
+	fmt.Printf("\n[Step 5] Call in progress (%v)...\n", *callTime)
+	if media == nil {
+		media = uac.startMedia(streams)
+	}
+	time.Sleep(*callTime)
+	if media != nil {
+		media.Close()
+		printRTPStats(media.Stats())
+	}
+
+	// ── 步骤 6：转移（REFER）──────────────────────────────────────
+	if *transferTo != "" {
+		fmt.Printf("\n[Step 6] Transferring call to %s...\n", *transferTo)
+		if uac.transfer(dlg) {
+			fmt.Println("  transfer succeeded")
+		} else {
+			fmt.Println("  transfer failed")
+		}
+	}
 
-	// ── 步骤 6：BYE ────────────────────────────────────────────────
-	fmt.Println("\n[Step 6] Sending BYE (hanging up)...")
-	bye := uac.buildBYE(inviteReq, finalResp)
-	if err := uac.stack.SendRequest(bye, *serverAddr); err != nil {
+	// ── 步骤 7：BYE ────────────────────────────────────────────────
+	fmt.Println("\n[Step 7] Sending BYE (hanging up)...")
+	if err := uac.stack.SendInDialog(dlg.NewRequest(message.MethodBYE)); err != nil {
 		logger.Error("send BYE", zap.Error(err))
 	}
 	resp = uac.waitResponse(5 * time.Second)
@@ -147,15 +338,540 @@ type UAC struct {
 	stack      *stack.Stack
 	logger     *zap.Logger
 	serverAddr string
+	proxy      *message.URI // 服务器作为出站代理的 URI，请求经 RFC 3263 定位后发送
+	serverHop  string       // 服务器定位到的第一个地址，订阅与保活直接发往该地址
 	responseCh chan *message.Response
+	errCh      chan error // 事务超时 / 传输错误
+	answer     bool       // 被叫模式：应答来电
+	referCh    chan int   // 转移进度：REFER 的 NOTIFY 中 sipfrag 的状态码
+	regNetwork string     // 最近一次 REGISTER 使用的传输，保活沿同一条流发送
+
+	mu      sync.Mutex
+	lastReq *message.Request        // 最近一个响应对应的请求
+	calls   map[string]*rtp.Session // 被叫模式下已接通呼叫的媒体会话（Call-ID -> 会话）
+}
+
+// transfer 把对话 dlg 中的对端转移到 -transfer，返回转移目标是否已接听。
+// -attended 时先呼叫转移目标（咨询通话），再以 Replaces 让对端替换该通话。
+func (u *UAC) transfer(dlg *dialog.Dialog) bool {
+	referTo := *transferTo
+	if *attended {
+		fmt.Println("  -> INVITE (consultation call)")
+		invite, err := u.stack.BuildInviteRequest(*fromURI, *transferTo)
+		if err != nil {
+			u.logger.Warn("build INVITE", zap.Error(err))
+			return false
+		}
+		consult, err := u.placeCall(invite)
+		if err != nil {
+			fmt.Printf("  consultation failed: %v\n", err)
+			return false
+		}
+		referTo = stack.AttendedReferTo(consult.RemoteTarget, consult)
+	}
+	if _, err := u.stack.Refer(dlg.ID, referTo); err != nil {
+		u.logger.Warn("send REFER", zap.Error(err))
+		return false
+	}
+	fmt.Printf("  -> REFER (Refer-To: %s)\n", referTo)
+	for {
+		resp := u.waitResponse(5 * time.Second)
+		if resp == nil {
+			fmt.Println("  [timeout] no response to REFER")
+			return false
+		}
+		if responseMethod(resp) != message.MethodREFER {
+			continue
+		}
+		fmt.Printf("  <- %d %s (REFER)\n", resp.StatusCode, resp.Reason)
+		if resp.StatusCode >= 300 {
+			return false
+		}
+		break
+	}
+	// 进度由 NOTIFY 报告，最终状态码即转移 INVITE 的最终响应
+	for {
+		select {
+		case code := <-u.referCh:
+			if code >= 200 {
+				return code < 300
+			}
+		case <-time.After(40 * time.Second):
+			fmt.Println("  [timeout] no final transfer status")
+			return false
+		}
+	}
+}
+
+// placeCall 发送 INVITE（目标地址取 Request-URI）并等待最终响应，2xx 时发送 ACK、开始媒体并返回对话。
+func (u *UAC) placeCall(invite *message.Request) (*dialog.Dialog, error) {
+	if err := u.stack.SendRequest(invite, stack.TargetAddr(invite.RequestURI)); err != nil {
+		return nil, err
+	}
+	callID := invite.Headers.Get(message.HeaderCallID)
+	for {
+		resp := u.waitResponse(40 * time.Second)
+		if resp == nil {
+			return nil, fmt.Errorf("no response to INVITE")
+		}
+		if responseMethod(resp) != message.MethodINVITE || resp.Headers.Get(message.HeaderCallID) != callID {
+			continue
+		}
+		fmt.Printf("  <- %d %s (INVITE)\n", resp.StatusCode, resp.Reason)
+		if resp.StatusCode < 200 {
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("%d %s", resp.StatusCode, resp.Reason)
+		}
+		dlg := u.stack.ResponseDialog(resp)
+		if dlg == nil {
+			return nil, fmt.Errorf("no dialog for 200 OK")
+		}
+		// 认证重试后实际得到应答的是重发的 INVITE
+		if req := u.lastRequest(); req != nil && req.Method == message.MethodINVITE &&
+			req.Headers.Get(message.HeaderCallID) == callID {
+			invite = req
+		}
+		if err := u.stack.SendInDialog(dlg.NewRequest(message.MethodACK)); err != nil {
+			u.logger.Warn("send ACK", zap.Error(err))
+		}
+		fmt.Println("  -> ACK, call established")
+		streams, err := u.stack.ProcessAnswer(invite, resp)
+		if err != nil {
+			u.logger.Warn("SDP negotiation failed", zap.Error(err))
+		}
+		printStreams(streams)
+		u.addCall(callID, u.startMedia(streams))
+		return dlg, nil
+	}
+}
+
+// followRefer 被叫模式下接受 REFER 并呼叫 Refer-To，进度由协议栈以 NOTIFY 报告给转移方。
+func (u *UAC) followRefer(req *message.Request, tx *dialog.Transaction) {
+	fmt.Printf("\n  <- REFER to %s\n", req.Headers.Get(message.HeaderReferTo))
+	if err := u.stack.AcceptRefer(req, tx); err != nil {
+		fmt.Printf("  REFER rejected: %v\n", err)
+		return
+	}
+	fmt.Println("  -> 202 Accepted")
+	// 转移期间原通话已无人收听，先释放其媒体（转移方随后挂断）
+	u.stopMedia(req.Headers.Get(message.HeaderCallID))
+	invite, err := u.stack.BuildReferredInvite(req)
+	if err != nil {
+		u.logger.Warn("build referred INVITE", zap.Error(err))
+		return
+	}
+	if invite.Headers.Exists(message.HeaderReplaces) {
+		fmt.Printf("  -> INVITE %s (Replaces: %s)\n", invite.RequestURI, invite.Headers.Get(message.HeaderReplaces))
+	} else {
+		fmt.Printf("  -> INVITE %s\n", invite.RequestURI)
+	}
+	if _, err := u.placeCall(invite); err != nil {
+		fmt.Printf("  referred call failed: %v\n", err)
+	}
+}
+
+// runCallee 被叫模式：向服务器注册后等待来电，直到 Ctrl+C。
+func runCallee(u *UAC) {
+	fmt.Printf("\n[Callee] Registering %s...\n", *fromURI)
+	if err := u.sendRegister(*fromURI, "sip:"+*serverAddr, 3600); err != nil {
+		u.logger.Fatal("REGISTER failed", zap.Error(err))
+	}
+	if resp := u.waitResponse(5 * time.Second); resp != nil {
+		fmt.Printf("  <- %d %s\n", resp.StatusCode, resp.Reason)
+	}
+	if *keepalive > 0 {
+		u.startKeepalive()
+	}
+	fmt.Println("  waiting for calls... (Ctrl+C to stop)")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	// 注销：expires=0 删除绑定
+	if err := u.sendRegister(*fromURI, "sip:"+*serverAddr, 0); err == nil {
+		u.waitResponse(2 * time.Second)
+	}
+}
+
+// startKeepalive 在注册所用的流上发送 CRLF 保活；流失效（等不到 pong）时重新注册并重新开始保活。
+func (u *UAC) startKeepalive() {
+	onFail := func() {
+		fmt.Println("  keepalive failed, registering again...")
+		if err := u.sendRegister(*fromURI, "sip:"+*serverAddr, 3600); err != nil {
+			u.logger.Warn("re-REGISTER failed", zap.Error(err))
+			return
+		}
+		u.startKeepalive()
+	}
+	if err := u.stack.StartKeepalive(u.regNetwork, u.serverHop, *keepalive, onFail); err != nil {
+		u.logger.Warn("start keepalive", zap.Error(err))
+		return
+	}
+	fmt.Printf("  keepalive every %v over %s\n", *keepalive, u.regNetwork)
+}
+
+// runMessage 发送一条 MESSAGE 给 -to（经由服务器中继），打印最终响应后退出。
+func runMessage(u *UAC) {
+	contentType, body := im.ContentTypeText+";charset=UTF-8", []byte(*imText)
+	if *imCPIM {
+		c := &im.CPIM{
+			From:        fmt.Sprintf("<%s>", *fromURI),
+			To:          fmt.Sprintf("<%s>", *toURI),
+			DateTime:    time.Now(),
+			ContentType: contentType,
+			Body:        body,
+		}
+		contentType, body = im.ContentTypeCPIM, c.Marshal()
+	}
+	req, err := u.stack.BuildMessageRequest(*fromURI, *toURI, contentType, body)
+	if err != nil {
+		u.logger.Fatal("build MESSAGE", zap.Error(err))
+	}
+	fmt.Printf("\n[Message] Sending to %s: %q\n", *toURI, *imText)
+	if err := u.send(req); err != nil {
+		u.logger.Fatal("send MESSAGE", zap.Error(err))
+	}
+	resp := u.waitResponse(40 * time.Second)
+	if resp == nil {
+		fmt.Println("  [timeout] no response")
+		os.Exit(1)
+	}
+	fmt.Printf("  <- %d %s\n", resp.StatusCode, resp.Reason)
+}
+
+// printMessage 打印收到的 MESSAGE，延迟投递的离线消息带上服务器收到它的时间（Date）。
+func printMessage(req *message.Request) {
+	from := req.Headers.Get(message.HeaderFrom)
+	if addr, err := message.ParseAddress(from); err == nil && addr.URI != nil {
+		from = addr.URI.String()
+	}
+	fmt.Printf("\n  <- MESSAGE from %s: %s\n", from, im.Text(req.Headers.Get(message.HeaderContentType), req.Body))
+	if date := req.Headers.Get(message.HeaderDate); date != "" {
+		fmt.Printf("     (sent while offline, %s)\n", date)
+	}
+}
+
+// runSubscriber 订阅模式：订阅 -to 的 -subscribe 事件包，打印收到的 NOTIFY，Ctrl+C 时退订。
+func runSubscriber(u *UAC) {
+	fmt.Printf("\n[Subscriber] Subscribing to %s of %s...\n", *subscribe, *toURI)
+	req, err := u.stack.BuildSubscribeRequest(*fromURI, *toURI, *subscribe, *subExpires)
+	if err != nil {
+		u.logger.Fatal("build SUBSCRIBE", zap.Error(err))
+	}
+	if err := u.stack.Subscribe(req, u.serverHop); err != nil {
+		u.logger.Fatal("send SUBSCRIBE", zap.Error(err))
+	}
+	resp := u.waitResponse(5 * time.Second)
+	if resp == nil {
+		fmt.Println("  [timeout] no response")
+		os.Exit(1)
+	}
+	fmt.Printf("  <- %d %s\n", resp.StatusCode, resp.Reason)
+	if resp.StatusCode >= 300 {
+		if allow := resp.Headers.Get(message.HeaderAllowEvents); allow != "" {
+			fmt.Printf("     Allow-Events: %s\n", allow)
+		}
+		os.Exit(0)
+	}
+	dlg := u.stack.ResponseDialog(resp)
+	if dlg == nil {
+		u.logger.Fatal("no dialog for SUBSCRIBE 2xx")
+	}
+	fmt.Println("  waiting for NOTIFY... (Ctrl+C to unsubscribe)")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	fmt.Println("\n  -> SUBSCRIBE (Expires: 0)")
+	if err := u.stack.Unsubscribe(dlg.ID, *subscribe); err != nil {
+		u.logger.Warn("unsubscribe", zap.Error(err))
+		return
+	}
+	time.Sleep(time.Second) // 等待 terminated 的 NOTIFY
+}
+
+// printNotify 打印 NOTIFY 的订阅状态与按事件包解析后的消息体。
+func printNotify(req *message.Request) {
+	fmt.Printf("\n  <- NOTIFY %s (%s)\n", req.Headers.Get(message.HeaderEvent), req.Headers.Get(message.HeaderSubscriptionState))
+	switch event.Name(req.Headers.Get(message.HeaderEvent)) {
+	case "presence":
+		doc, err := event.ParsePIDF(req.Body)
+		if err != nil {
+			fmt.Printf("     invalid PIDF: %v\n", err)
+			return
+		}
+		status := "closed"
+		if doc.Open() {
+			status = "open"
+		}
+		fmt.Printf("     %s is %s\n", doc.Entity, status)
+		for _, t := range doc.Tuples {
+			if t.Contact != "" {
+				fmt.Printf("       contact %s (%s)\n", t.Contact, t.Basic)
+			}
+		}
+	case "message-summary":
+		m, err := event.ParseMessageSummary(req.Body)
+		if err != nil {
+			fmt.Printf("     invalid message-summary: %v\n", err)
+			return
+		}
+		fmt.Printf("     %s: %d new / %d old voice messages (waiting: %v)\n", m.Account, m.New, m.Old, m.Waiting())
+	case "refer":
+		if code, ok := stack.ReferStatus(req); ok {
+			fmt.Printf("     transfer progress: %d\n", code)
+			return
+		}
+		fmt.Printf("%s\n", req.Body)
+	default:
+		fmt.Printf("%s\n", req.Body)
+	}
 }
 
 func (u *UAC) OnRequest(req *message.Request, tx *dialog.Transaction) {
-	// UAC 通常不处理来自服务器的请求（除非是 re-INVITE 等）
-	u.logger.Info("unexpected request from server", zap.String("method", string(req.Method)))
+	// NOTIFY 已由协议栈匹配订阅并回 200，这里只打印
+	if req.Method == message.MethodNOTIFY {
+		printNotify(req)
+		if code, ok := stack.ReferStatus(req); ok {
+			select {
+			case u.referCh <- code:
+			default:
+			}
+		}
+		return
+	}
+	if req.Method == message.MethodMESSAGE {
+		if !im.Acceptable(req.Headers.Get(message.HeaderContentType)) {
+			resp := stack.BuildResponse(req, message.StatusUnsupportedMediaType, "")
+			resp.Headers.Set(message.HeaderAccept, im.Accept)
+			u.respond(tx, resp)
+			return
+		}
+		printMessage(req)
+		u.respond(tx, stack.BuildResponse(req, message.StatusOK, ""))
+		return
+	}
+	// 对话内 re-INVITE（如对端刷新会话）主叫与被叫都要应答
+	if req.Method == message.MethodINVITE && u.stack.RequestDialog(req) != nil {
+		u.answerReInvite(req, tx)
+		return
+	}
+	// 对端（或被 Replaces 替换通话的一方）挂断，主叫与被叫都要应答
+	if req.Method == message.MethodBYE {
+		fmt.Println("  <- BYE, call ended")
+		u.respond(tx, stack.BuildResponse(req, message.StatusOK, ""))
+		u.stopMedia(req.Headers.Get(message.HeaderCallID))
+		return
+	}
+	if !u.answer {
+		// UAC 通常不处理来自服务器的请求（除非是 re-INVITE 等）
+		u.logger.Info("unexpected request from server", zap.String("method", string(req.Method)))
+		return
+	}
+	switch req.Method {
+	case message.MethodINVITE:
+		u.answerInvite(req, tx)
+	case message.MethodACK:
+		fmt.Println("  <- ACK, call established")
+	case message.MethodREFER:
+		go u.followRefer(req, tx)
+	case message.MethodOPTIONS:
+		u.respond(tx, stack.BuildResponse(req, message.StatusOK, ""))
+	default:
+		u.respond(tx, stack.BuildResponse(req, message.StatusMethodNotAllowed, ""))
+	}
+}
+
+// answerInvite 被叫应答：180 Ringing，振铃 -ring 时长后 200 OK（携带 SDP answer）；
+// 主叫支持 100rel 时以可靠 183 携带 SDP answer 代替 180，提前开始媒体。
+// 振铃期间收到 CANCEL（如分叉时另一分支已接听）时协议栈回 487，这里停止振铃。
+// 带 Replaces 的 INVITE（呼叫转移）替换已有通话，不振铃直接接听，原通话由协议栈挂断。
+func (u *UAC) answerInvite(req *message.Request, tx *dialog.Transaction) {
+	fmt.Printf("\n  <- INVITE from %s\n", req.Headers.Get(message.HeaderFrom))
+	ring := *ringTime
+	if replaced := u.stack.ReplacedDialog(req); replaced != nil {
+		fmt.Printf("     replaces call %s\n", replaced.ID.CallID)
+		u.stopMedia(replaced.ID.CallID)
+		ring = 0
+	}
+	localTag := stack.NewTag()
+	contact := fmt.Sprintf("<%s>", u.stack.ContactURI(req.RequestURI.Scheme))
+
+	// 先协商 SDP：offer 中没有可接受的媒体时不振铃，直接 488
+	ok := stack.BuildResponse(req, message.StatusOK, localTag)
+	streams, err := u.stack.AnswerInvite(req, ok)
+	if err != nil {
+		u.respond(tx, stack.BuildResponse(req, message.StatusNotAcceptableHere, localTag))
+		fmt.Printf("  -> 488 Not Acceptable Here (%v)\n", err)
+		return
+	}
+
+	callID := req.Headers.Get(message.HeaderCallID)
+	if stack.SupportsReliable(req) && len(streams) > 0 {
+		progress := stack.BuildResponse(req, message.StatusSessionProgress, localTag)
+		progress.Headers.Set(message.HeaderContact, contact)
+		progress.Headers.Set(message.HeaderContentType, ok.Headers.Get(message.HeaderContentType))
+		progress.Body = ok.Body
+		u.respond(tx, progress)
+		fmt.Println("  -> 183 Session Progress (early media)")
+		printStreams(streams)
+		u.addCall(callID, u.startMedia(streams))
+		streams = nil
+	} else {
+		ringing := stack.BuildResponse(req, message.StatusRinging, localTag)
+		ringing.Headers.Set(message.HeaderContact, contact)
+		u.respond(tx, ringing)
+		fmt.Println("  -> 180 Ringing")
+	}
+
+	select {
+	case <-time.After(ring):
+	case <-tx.Cancelled():
+		fmt.Println("  <- CANCEL, -> 487 Request Terminated")
+		u.stopMedia(callID)
+		return
+	}
+
+	ok.Headers.Set(message.HeaderContact, contact)
+	ok.Headers.Set(message.HeaderAllow, stack.AllowedMethods)
+	u.respond(tx, ok)
+	fmt.Println("  -> 200 OK")
+	if streams != nil {
+		printStreams(streams)
+		u.addCall(callID, u.startMedia(streams))
+	}
+}
+
+// addCall 记录已接通（或早期媒体）呼叫的媒体会话，media 为 nil 时忽略。
+func (u *UAC) addCall(callID string, media *rtp.Session) {
+	if media == nil {
+		return
+	}
+	u.mu.Lock()
+	u.calls[callID] = media
+	u.mu.Unlock()
+}
+
+// answerReInvite 应答对话内的 re-INVITE：立即回 200，媒体沿用原会话。
+func (u *UAC) answerReInvite(req *message.Request, tx *dialog.Transaction) {
+	ok := stack.BuildResponse(req, message.StatusOK, "")
+	if _, err := u.stack.AnswerInvite(req, ok); err != nil {
+		u.respond(tx, stack.BuildResponse(req, message.StatusNotAcceptableHere, ""))
+		return
+	}
+	ok.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", u.stack.ContactURI(req.RequestURI.Scheme)))
+	ok.Headers.Set(message.HeaderAllow, stack.AllowedMethods)
+	u.respond(tx, ok)
+	fmt.Println("  <- re-INVITE, -> 200 OK")
+}
+
+// startMedia 为第一个协商成功的媒体流建立 RTP 会话并开始发送音频，失败时返回 nil。
+func (u *UAC) startMedia(streams []sdp.Stream) *rtp.Session {
+	if len(streams) == 0 {
+		return nil
+	}
+	cfg, err := rtp.ConfigFromStream(streams[0])
+	if err != nil {
+		u.logger.Warn("no media", zap.Error(err))
+		return nil
+	}
+	var src rtp.Source = rtp.NewTone(*toneFreq)
+	if *wavFile != "" {
+		wav, err := rtp.OpenWAV(*wavFile)
+		if err != nil {
+			u.logger.Warn("open WAV, falling back to tone", zap.Error(err))
+		} else if wav.SampleRate != cfg.Codec.ClockRate {
+			u.logger.Warn("WAV sample rate mismatch, falling back to tone", zap.Int("rate", wav.SampleRate))
+		} else {
+			src = wav
+		}
+	}
+	session, err := rtp.NewSession(cfg, u.logger)
+	if err != nil {
+		u.logger.Warn("start RTP session", zap.Error(err))
+		return nil
+	}
+	session.Send(src)
+	fmt.Printf("     RTP: streaming %s to %s:%d\n", cfg.Codec.Name, cfg.RemoteAddr, cfg.RemotePort)
+	return session
+}
+
+// stopMedia 结束呼叫的媒体会话并打印统计。
+func (u *UAC) stopMedia(callID string) {
+	u.mu.Lock()
+	media := u.calls[callID]
+	delete(u.calls, callID)
+	u.mu.Unlock()
+	if media != nil {
+		media.Close()
+		printRTPStats(media.Stats())
+	}
+}
+
+// printRTPStats 打印 RTP 收发统计。
+func printRTPStats(st rtp.Stats) {
+	fmt.Printf("     RTP sent %d packets (%d bytes), received %d packets, lost %d, jitter %v\n",
+		st.PacketsSent, st.OctetsSent, st.PacketsReceived, st.PacketsLost, st.Jitter)
+	if st.HaveRemoteReport {
+		fmt.Printf("     RTCP from peer: fraction lost %.1f%%, total lost %d, jitter %v\n",
+			st.RemoteFractionLost*100, st.RemoteTotalLost, st.RemoteJitter)
+	}
+}
+
+// printStreams 打印协商得到的媒体流。
+func printStreams(streams []sdp.Stream) {
+	for _, st := range streams {
+		fmt.Printf("     media: %s remote %s:%d, local port %d, %s, %s\n",
+			st.Type, st.RemoteAddr, st.RemotePort, st.LocalPort, st.Codecs[0], st.Direction)
+	}
+}
+
+// responseMethod 返回响应 CSeq 中的方法。
+func responseMethod(resp *message.Response) message.Method {
+	cseq, err := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return ""
+	}
+	return message.Method(cseq.Method)
+}
+
+// cancelInvite 取消仍在等待最终响应的 INVITE，返回是否已发起 CANCEL。
+// 认证重试后应取消的是重发的 INVITE。
+func (u *UAC) cancelInvite(invite *message.Request) bool {
+	if req := u.lastRequest(); req != nil && req.Method == message.MethodINVITE {
+		invite = req
+	}
+	if err := u.stack.Cancel(u.stack.ClientTransaction(invite)); err != nil {
+		fmt.Printf("  CANCEL not sent: %v\n", err)
+		return false
+	}
+	fmt.Println("  -> CANCEL")
+	return true
+}
+
+func (u *UAC) respond(tx *dialog.Transaction, resp *message.Response) {
+	if tx == nil {
+		return
+	}
+	if err := tx.Respond(resp); err != nil {
+		u.logger.Warn("send response", zap.Int("code", resp.StatusCode), zap.Error(err))
+	}
 }
 
 func (u *UAC) OnResponse(resp *message.Response, req *message.Request) {
+	if req != nil {
+		u.mu.Lock()
+		u.lastReq = req
+		u.mu.Unlock()
+		// 被叫模式下会话到期时协议栈发送的 BYE：结束媒体
+		if req.Method == message.MethodBYE && resp.StatusCode >= 200 {
+			u.stopMedia(req.Headers.Get(message.HeaderCallID))
+		}
+	}
 	select {
 	case u.responseCh <- resp:
 	default:
@@ -163,15 +879,59 @@ func (u *UAC) OnResponse(resp *message.Response, req *message.Request) {
 	}
 }
 
+// OnError 事务层在 Timer B/F 超时后回调（期间已按 T1/T2 自动重传）。
+func (u *UAC) OnError(req *message.Request, err error) {
+	// 被叫的 183 等不到 PRACK：协议栈已以 500 拒绝 INVITE，结束早期媒体
+	if errors.Is(err, dialog.ErrNoPRACK) {
+		u.stopMedia(req.Headers.Get(message.HeaderCallID))
+		return
+	}
+	select {
+	case u.errCh <- fmt.Errorf("%s: %w", req.Method, err):
+	default:
+		u.logger.Warn("error channel full, dropping error", zap.Error(err))
+	}
+}
+
+func (u *UAC) lastRequest() *message.Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lastReq
+}
+
 func (u *UAC) waitResponse(timeout time.Duration) *message.Response {
 	select {
 	case resp := <-u.responseCh:
 		return resp
+	case err := <-u.errCh:
+		fmt.Printf("  [error] %v\n", err)
+		return nil
 	case <-time.After(timeout):
 		return nil
 	}
 }
 
+// locateServer 按 RFC 3263 定位 -server：-server 可以是带端口的地址，也可以是只配置了
+// NAPTR / SRV 记录的域名。
+func (u *UAC) locateServer() error {
+	proxy, err := message.ParseURI("sip:" + u.serverAddr + ";lr")
+	if err != nil {
+		return err
+	}
+	targets, err := u.stack.Locate(proxy)
+	if err != nil {
+		return err
+	}
+	u.proxy, u.serverHop = proxy, targets[0].Addr
+	u.logger.Info("located server", zap.String("server", u.serverAddr), zap.Stringers("targets", targets))
+	return nil
+}
+
+// send 把请求发往服务器：定位到多个目标时，事务失败后由协议栈改发下一个目标。
+func (u *UAC) send(req *message.Request) error {
+	return u.stack.SendRequestURI(req, u.proxy)
+}
+
 func (u *UAC) sendOptions() error {
 	toURI, err := message.ParseURI("sip:" + u.serverAddr)
 	if err != nil {
@@ -187,7 +947,7 @@ func (u *UAC) sendOptions() error {
 	req.Headers.Set(message.HeaderCSeq, "1 OPTIONS")
 	req.Headers.Set(message.HeaderAccept, "application/sdp")
 	req.Headers.Set(message.HeaderContentLen, "0")
-	return u.stack.SendRequest(req, u.serverAddr)
+	return u.send(req)
 }
 
 func (u *UAC) sendRegister(aor, registrar string, expires int) error {
@@ -195,68 +955,14 @@ func (u *UAC) sendRegister(aor, registrar string, expires int) error {
 	if err != nil {
 		return err
 	}
-	return u.stack.SendRequest(req, u.serverAddr)
-}
-
-// buildACK 根据 INVITE 请求和 200 OK 响应构造 ACK。
-//
-// ACK 在 INVITE 事务中的特殊性（RFC 3261 §17.1.1.3）：
-//   - ACK 只用于对 INVITE 的最终响应进行确认
-//   - 对 2xx 的 ACK：由 TU（Transaction User）直接生成，不经过事务层，
-//     使用 To tag（dialog 的 tag），CSeq 方法改为 ACK，序号与 INVITE 相同
-func (u *UAC) buildACK(invite *message.Request, resp *message.Response) *message.Request {
-	toURI := invite.RequestURI
-	ack := message.NewRequest(message.MethodACK, toURI)
-
-	// 复用 INVITE 的 branch（对 2xx 的 ACK 需要新 branch）
-	ack.Headers.Set(message.HeaderVia, fmt.Sprintf("SIP/2.0/UDP %s;branch=%s",
-		u.stack.LocalAddr(), stack.NewBranch()))
-	ack.Headers.Set(message.HeaderMaxForwards, "70")
-	ack.Headers.Set(message.HeaderFrom, invite.Headers.Get(message.HeaderFrom))
-	// To 使用响应中带 tag 的 To 头域
-	ack.Headers.Set(message.HeaderTo, resp.Headers.Get(message.HeaderTo))
-	ack.Headers.Set(message.HeaderCallID, invite.Headers.Get(message.HeaderCallID))
-
-	// CSeq：序号与 INVITE 相同，方法改为 ACK
-	cseq, _ := message.ParseCSeq(invite.Headers.Get(message.HeaderCSeq))
-	if cseq != nil {
-		ack.Headers.Set(message.HeaderCSeq, fmt.Sprintf("%d ACK", cseq.Seq))
-	}
-	ack.Headers.Set(message.HeaderContentLen, "0")
-	return ack
-}
-
-// buildBYE 构造 BYE 请求终止会话。
-//
-// BYE 特点：
-//   - 使用 dialog 内的 Route set（如果有）
-//   - CSeq 序号需要递增（不是从 INVITE 的序号继续，而是 dialog 内的序号）
-//   - Request-URI 使用对端的 Contact URI（Remote Target）
-func (u *UAC) buildBYE(invite *message.Request, resp *message.Response) *message.Request {
-	// 使用对端 Contact 作为 Request-URI（如果有）
-	reqURI := invite.RequestURI
-	if contact := resp.Headers.Get(message.HeaderContact); contact != "" {
-		addr, err := message.ParseAddress(contact)
-		if err == nil && addr.URI != nil {
-			reqURI = addr.URI
-		}
-	}
-
-	bye := message.NewRequest(message.MethodBYE, reqURI)
-	bye.Headers.Set(message.HeaderVia, fmt.Sprintf("SIP/2.0/UDP %s;branch=%s",
-		u.stack.LocalAddr(), stack.NewBranch()))
-	bye.Headers.Set(message.HeaderMaxForwards, "70")
-	bye.Headers.Set(message.HeaderFrom, invite.Headers.Get(message.HeaderFrom))
-	bye.Headers.Set(message.HeaderTo, resp.Headers.Get(message.HeaderTo))
-	bye.Headers.Set(message.HeaderCallID, invite.Headers.Get(message.HeaderCallID))
-
-	// CSeq 递增
-	cseq, _ := message.ParseCSeq(invite.Headers.Get(message.HeaderCSeq))
-	seq := uint32(2)
-	if cseq != nil {
-		seq = cseq.Seq + 1
-	}
-	bye.Headers.Set(message.HeaderCSeq, fmt.Sprintf("%d BYE", seq))
-	bye.Headers.Set(message.HeaderContentLen, "0")
-	return bye
+	if *regQ != "" {
+		req.Headers.Set(message.HeaderContact, req.Headers.Get(message.HeaderContact)+";q="+*regQ)
+	}
+	if err := u.send(req); err != nil {
+		return err
+	}
+	if via, err := message.ParseVia(req.Headers.Get(message.HeaderVia)); err == nil {
+		u.regNetwork = via.Transport
+	}
+	return nil
 }
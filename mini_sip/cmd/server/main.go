@@ -1,64 +1,292 @@
 // cmd/server 实现一个简单的 SIP UAS（用户代理服务器）。
 //
 // 功能：
-//   - 监听 UDP:5060
+//   - 监听 UDP/TCP:5060，可选 TLS:5061（-tls-addr，承载 sips:）
+//   - 可选 WS / WSS（-ws-addr / -wss-addr，RFC 7118，供浏览器软电话接入）
 //   - 响应 OPTIONS 请求（返回 200 OK + 支持的方法列表）
-//   - 响应 REGISTER 请求（返回 200 OK，模拟注册成功）
+//   - 注册服务器：维护 AOR -> Contact 绑定，过期自动清理（RFC 3261 §10）
+//   - 摘要认证（-auth-realm / -auth-users）：REGISTER 回 401 挑战，代理模式下 INVITE 回 407
+//   - 代理模式（-proxy）：按位置服务把请求转发给已注册的用户，两个 client 可经由服务器互通
+//   - B2BUA 模式（-b2bua）：终结呼入的对话，再向被叫已注册的 Contact 发起独立的对话并桥接两路，
+//     两个 client 看不到对方的 Call-ID、tag 与地址
 //   - 响应 INVITE 请求（依次返回 100 Trying -> 180 Ringing -> 200 OK）
+//   - 接听前收到 CANCEL 时停止振铃，INVITE 以 487 结束（RFC 3261 §9.2）
+//   - 会话计时器（-session-expires / -min-se，RFC 4028）：对话内 re-INVITE / UPDATE 刷新会话，
+//     间隔过小回 422，会话到期未刷新时协议栈自动发送 BYE
+//   - SDP offer/answer（-rtp-port / -codecs）：200 OK 携带 answer，没有共同编码时回 488
+//   - RTP/RTCP：接听后接收主叫的媒体流并回送 RTCP 接收报告，BYE 时输出丢包与抖动统计
 //   - 响应 BYE 请求（返回 200 OK，终止会话）
+//   - 即时消息（RFC 3428）：中继 text/plain 与 message/cpim 的 MESSAGE 到接收方已注册的 Contact，
+//     接收方不在线时存入离线队列，下次 REGISTER 时投递（UAS 与代理模式均提供）
+//   - 事件订阅（RFC 6665）：presence 由注册绑定驱动（有绑定为 open），
+//     message-summary 的信箱状态由 -mwi 配置；代理模式下 SUBSCRIBE 照常转发
+//   - 抓包（-capture-pcap / -capture-hep）：收发的 SIP 消息写入 pcap 文件或以 HEPv3 发往 Homer 采集端，
+//     可按方法与 Call-ID 过滤（-capture-methods / -capture-callid），运行中 kill -USR1 开关抓包
+//   - 呼叫详细记录（-cdr-json / -cdr-csv）：每个 INVITE 对话结束时追加一条 CDR，
+//     B2BUA 模式下每路各一条；代理模式不生成
 //
 // 运行方式：
 //
 //	go run ./cmd/server
+//	go run ./cmd/server -proxy   # 代理模式
+//	go run ./cmd/server -b2bua   # B2BUA 模式
 //
-// 用 sngrep 或 Wireshark 抓包观察 SIP 消息格式。
+// 用 -capture-pcap 抓包后以 Wireshark 打开（或在旁边运行 sngrep）观察 SIP 消息格式：
+//
+//	go run ./cmd/server -capture-pcap sip.pcap -capture-methods INVITE,ACK,BYE,CANCEL
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/b2bua"
+	"github.com/lccxxo/go_/mini_sip/internal/capture"
+	"github.com/lccxxo/go_/mini_sip/internal/cdr"
 	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/event"
+	"github.com/lccxxo/go_/mini_sip/internal/im"
 	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/proxy"
+	"github.com/lccxxo/go_/mini_sip/internal/registrar"
+	"github.com/lccxxo/go_/mini_sip/internal/rtp"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
 	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
 	"go.uber.org/zap"
 )
 
-var listenAddr = flag.String("addr", "0.0.0.0:5060", "SIP UDP listen address")
+var (
+	listenAddr = flag.String("addr", "0.0.0.0:5060", "SIP UDP/TCP listen address")
+	tlsAddr    = flag.String("tls-addr", "", "SIP TLS listen address for sips: (e.g. 0.0.0.0:5061), empty to disable")
+	tlsCert    = flag.String("tls-cert", "", "TLS certificate file (PEM)")
+	tlsKey     = flag.String("tls-key", "", "TLS private key file (PEM)")
+	tlsCA      = flag.String("tls-ca", "", "TLS CA bundle used to verify peers (PEM)")
+	wsAddr     = flag.String("ws-addr", "", "SIP over WebSocket listen address (e.g. 0.0.0.0:8080), empty to disable")
+	wssAddr    = flag.String("wss-addr", "", "SIP over secure WebSocket listen address, uses the -tls-* files")
+	proxyMode  = flag.Bool("proxy", false, "act as a stateful proxy: route requests to registered contacts instead of answering them")
+	authRealm  = flag.String("auth-realm", "", "digest realm; when set REGISTER (and INVITE in proxy mode) must authenticate")
+	authUsers  = flag.String("auth-users", "", "comma separated user:password list for digest authentication")
+	b2buaMode  = flag.Bool("b2bua", false, "act as a back-to-back user agent: bridge calls to registered contacts through a separate outgoing dialog")
+	forkWait   = flag.Duration("fork-timeout", 20*time.Second, "proxy mode: ring time of each q-value group before trying the next one")
+	rtpPort    = flag.Int("rtp-port", 40000, "local RTP port advertised in SDP answers, 0 to disable SDP")
+	codecList  = flag.String("codecs", "PCMU,PCMA,telephone-event", "comma separated codecs in order of preference")
+	sessionExp = flag.Int("session-expires", stack.DefaultSessionExpires, "largest accepted session interval in seconds (RFC 4028), 0 to disable session timers")
+	minSE      = flag.Int("min-se", stack.MinSessionExpires, "smallest accepted session interval in seconds, shorter requests get 422")
+	cdrJSON    = flag.String("cdr-json", "", "append call detail records to this JSON Lines file")
+	cdrCSV     = flag.String("cdr-csv", "", "append call detail records to this CSV file")
+	capPcap    = flag.String("capture-pcap", "", "write every sent and received SIP message to this pcap file")
+	capHEP     = flag.String("capture-hep", "", "send every SIP message as HEPv3 to this collector (host:port)")
+	capHEPID   = flag.Uint("capture-hep-id", 2001, "HEPv3 capture agent ID")
+	capHEPPass = flag.String("capture-hep-pass", "", "HEPv3 auth key, empty to omit")
+	capMethods = flag.String("capture-methods", "", "comma separated methods to capture (responses match their CSeq method), empty for all")
+	capCallID  = flag.String("capture-callid", "", "capture only messages with this Call-ID")
+	capOff     = flag.Bool("capture-off", false, "start with capture disabled; send SIGUSR1 to toggle")
+	mwi        = flag.String("mwi", "", "voicemail state served by message-summary, e.g. sip:alice@example.com=2/8,sip:bob@example.com=0/1 (new/old)")
+)
 
 func main() {
 	flag.Parse()
+	if *proxyMode && *b2buaMode {
+		fmt.Fprintln(os.Stderr, "-proxy and -b2bua are mutually exclusive")
+		os.Exit(2)
+	}
 
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 
-	uas := &UAS{logger: logger}
-	srv, err := stack.NewStack(*listenAddr, uas, logger)
+	var opts []stack.Option
+	if *tlsAddr != "" || *wssAddr != "" {
+		cfg, err := transport.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			logger.Fatal("load TLS config", zap.Error(err))
+		}
+		if *tlsAddr != "" {
+			opts = append(opts, stack.WithTLS(*tlsAddr, cfg))
+		}
+		if *wssAddr != "" {
+			opts = append(opts, stack.WithWebSocket(*wssAddr, cfg))
+		}
+	}
+	if *wsAddr != "" {
+		opts = append(opts, stack.WithWebSocket(*wsAddr, nil))
+	}
+	if *rtpPort != 0 {
+		codecs, err := sdp.ParseCodecList(*codecList)
+		if err != nil {
+			logger.Fatal("parse -codecs", zap.Error(err))
+		}
+		opts = append(opts, stack.WithMedia(sdp.Config{Username: "mini_sip", Port: *rtpPort, Codecs: codecs}))
+	}
+
+	if *sessionExp != 0 {
+		opts = append(opts, stack.WithSessionTimer(*sessionExp, *minSE))
+	}
+	if *cdrJSON != "" {
+		sink, err := cdr.OpenJSONL(*cdrJSON)
+		if err != nil {
+			logger.Fatal("open -cdr-json", zap.Error(err))
+		}
+		defer sink.Close()
+		opts = append(opts, stack.WithCDRSink(sink))
+	}
+	if *cdrCSV != "" {
+		sink, err := cdr.OpenCSV(*cdrCSV)
+		if err != nil {
+			logger.Fatal("open -cdr-csv", zap.Error(err))
+		}
+		defer sink.Close()
+		opts = append(opts, stack.WithCDRSink(sink))
+	}
+
+	capturer, closeCapture := setupCapture(logger)
+	defer closeCapture()
+	if capturer != nil {
+		opts = append(opts, stack.WithCapture(capturer))
+	}
+
+	// 事件包：presence 跟随注册绑定，message-summary 取 -mwi 的初始信箱状态
+	presence := event.NewPresence()
+	summary := event.NewMessageSummary()
+	if err := loadMailboxes(summary, *mwi); err != nil {
+		logger.Fatal("parse -mwi", zap.Error(err))
+	}
+	opts = append(opts, stack.WithEventPackage(presence), stack.WithEventPackage(summary))
+
+	reg := registrar.New(registrar.NewMemoryStore(), logger)
+	reg.Start()
+	defer reg.Stop()
+
+	uas := &UAS{logger: logger, registrar: reg, calls: make(map[string]*rtp.Session)}
+	if *authRealm != "" {
+		store := auth.NewMemoryStore()
+		for _, entry := range strings.Split(*authUsers, ",") {
+			user, password, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok {
+				continue
+			}
+			store.Set(*authRealm, user, password)
+		}
+		uas.auth = auth.NewAuthenticator(*authRealm, store)
+	}
+	srv, err := stack.NewStack(*listenAddr, uas, logger, opts...)
 	if err != nil {
 		logger.Fatal("start SIP stack", zap.Error(err))
 	}
 	uas.stack = srv
+	uas.relay = im.NewRelay(srv, reg, im.NewMemoryStore(), logger)
+	uas.relay.Auth = uas.auth
+	// 绑定变化：更新 presence；接收方注册后投递排队的离线消息（回调持有注册服务器的锁，投递放到新协程）
+	reg.OnChange = func(aor string, bindings []*registrar.Binding) {
+		st := event.PresenceStatus{Open: len(bindings) > 0}
+		for _, b := range bindings {
+			st.Contacts = append(st.Contacts, b.Contact)
+		}
+		presence.Set(aor, st)
+		if len(bindings) > 0 {
+			go uas.relay.Flush(aor, st.Contacts)
+		}
+	}
+	if *proxyMode {
+		uas.proxy = proxy.New(srv, reg, logger)
+		uas.proxy.SerialTimeout = *forkWait
+		uas.proxy.Auth = uas.auth
+	}
+	if *b2buaMode {
+		uas.b2bua = b2bua.New(srv, uas.routeCall, logger)
+		uas.b2bua.OnEnd = func(c *b2bua.Call) {
+			var talk time.Duration
+			if answered := c.Answered(); !answered.IsZero() {
+				talk = c.Ended().Sub(answered)
+			}
+			logger.Info("bridged call ended", zap.String("callID", c.A.CallID), zap.Duration("talk", talk))
+		}
+	}
 
-	logger.Info("SIP UAS started", zap.String("addr", *listenAddr))
+	logger.Info("SIP UAS started", zap.String("addr", *listenAddr),
+		zap.Bool("proxy", *proxyMode), zap.Bool("b2bua", *b2buaMode))
 	logger.Info("waiting for SIP messages... (Ctrl+C to stop)")
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	if captureToggle != nil {
+		signal.Notify(sig, captureToggle)
+	}
+	for s := range sig {
+		if s != captureToggle {
+			break
+		}
+		if capturer != nil {
+			capturer.SetEnabled(!capturer.Enabled())
+		}
+	}
 
 	srv.Stop()
 	logger.Info("SIP UAS stopped")
 }
 
+// setupCapture 按 -capture-* 参数创建抓包器，没有配置输出时返回 nil；
+// 返回的函数关闭 pcap 文件与 HEP 套接字。
+func setupCapture(logger *zap.Logger) (*capture.Capture, func()) {
+	var (
+		sinks   []capture.Sink
+		closers []func() error
+	)
+	if *capPcap != "" {
+		pw, err := capture.CreatePcap(*capPcap)
+		if err != nil {
+			logger.Fatal("open -capture-pcap", zap.Error(err))
+		}
+		sinks = append(sinks, pw)
+		closers = append(closers, pw.Close)
+	}
+	if *capHEP != "" {
+		hep, err := capture.NewHEPSender(*capHEP)
+		if err != nil {
+			logger.Fatal("open -capture-hep", zap.Error(err))
+		}
+		hep.AgentID = uint32(*capHEPID)
+		hep.Password = *capHEPPass
+		sinks = append(sinks, hep)
+		closers = append(closers, hep.Close)
+	}
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, closeAll
+	}
+	c := capture.New(logger, sinks...)
+	c.SetFilter(capture.Filter{Methods: capture.ParseMethods(*capMethods), CallID: *capCallID})
+	if *capOff {
+		c.SetEnabled(false)
+	}
+	return c, closeAll
+}
+
 // UAS 实现 stack.Handler 接口，处理各类请求。
 type UAS struct {
-	stack  *stack.Stack
-	logger *zap.Logger
+	stack     *stack.Stack
+	registrar *registrar.Registrar
+	proxy     *proxy.Proxy        // 非 nil 时为代理模式
+	b2bua     *b2bua.B2BUA        // 非 nil 时为 B2BUA 模式
+	relay     *im.Relay           // MESSAGE 中继与离线存储
+	auth      *auth.Authenticator // 非 nil 时 REGISTER 需要摘要认证
+	logger    *zap.Logger
+
+	mu    sync.Mutex
+	calls map[string]*rtp.Session // 已接通呼叫的媒体会话（Call-ID -> 会话）
 }
 
 func (u *UAS) OnRequest(req *message.Request, tx *dialog.Transaction) {
@@ -67,67 +295,187 @@ func (u *UAS) OnRequest(req *message.Request, tx *dialog.Transaction) {
 		zap.String("from", req.Headers.Get(message.HeaderFrom)),
 	)
 
-	// 从 Via 解析来源地址，用于发送响应
-	src := u.extractResponseDst(req)
-	if src == nil {
-		u.logger.Error("cannot determine response destination")
+	// 对话外的 MESSAGE 由中继存储转发（两种模式相同）
+	if req.Method == message.MethodMESSAGE && !inDialog(req) {
+		u.relay.HandleRequest(req, tx)
+		return
+	}
+
+	// B2BUA 模式：对话外的 INVITE 与桥接呼叫中的请求由 B2BUA 处理
+	if u.b2bua != nil && u.b2bua.HandleRequest(req, tx) {
+		return
+	}
+
+	// 代理模式：REGISTER 与发给服务器自身的 OPTIONS 本地处理，其余请求按位置服务转发
+	if u.proxy != nil && req.Method != message.MethodREGISTER &&
+		!(req.Method == message.MethodOPTIONS && req.RequestURI.User == "") {
+		u.proxy.HandleRequest(req, tx)
 		return
 	}
 
 	switch req.Method {
 	case message.MethodOPTIONS:
-		u.handleOptions(req, src)
+		u.handleOptions(req, tx)
 	case message.MethodREGISTER:
-		u.handleRegister(req, src)
+		u.handleRegister(req, tx)
 	case message.MethodINVITE:
-		u.handleInvite(req, src)
+		u.handleInvite(req, tx)
 	case message.MethodBYE:
-		u.handleBye(req, src)
+		u.handleBye(req, tx)
 	case message.MethodACK:
 		// ACK 不需要响应，记录日志即可
 		u.logger.Info("ACK received, dialog confirmed")
-	case message.MethodCANCEL:
-		u.handleCancel(req, src)
 	default:
-		u.send(stack.BuildResponse(req, message.StatusMethodNotAllowed, ""), src)
+		u.respond(tx, stack.BuildResponse(req, message.StatusMethodNotAllowed, ""))
 	}
 }
 
 func (u *UAS) OnResponse(resp *message.Response, req *message.Request) {
-	// UAS 一般不发起请求，此处忽略
+	// UAS 一般不发起请求，收到的响应属于中继投递的 MESSAGE 或代理转发的请求
+	if u.relay.HandleResponse(resp, req) {
+		return
+	}
+	if u.b2bua != nil && u.b2bua.HandleResponse(resp, req) {
+		return
+	}
+	if u.proxy != nil {
+		u.proxy.HandleResponse(resp, req)
+		return
+	}
+	// 会话到期时协议栈发送的 BYE：结束媒体
+	if req != nil && req.Method == message.MethodBYE && resp.StatusCode >= 200 {
+		u.logger.Info("call ended by session timer", zap.Int("code", resp.StatusCode))
+		u.stopMedia(req.Headers.Get(message.HeaderCallID))
+	}
+}
+
+func (u *UAS) OnError(req *message.Request, err error) {
+	if u.relay.HandleError(req, err) {
+		return
+	}
+	if u.b2bua != nil && u.b2bua.HandleError(req, err) {
+		return
+	}
+	if u.proxy != nil && u.proxy.HandleError(req, err) {
+		return
+	}
+	u.logger.Warn("request failed", zap.String("method", string(req.Method)), zap.Error(err))
+	// 183 等不到 PRACK：协议栈已以 500 拒绝 INVITE，结束早期媒体
+	if errors.Is(err, dialog.ErrNoPRACK) {
+		u.stopMedia(req.Headers.Get(message.HeaderCallID))
+	}
+}
+
+// routeCall 是 B2BUA 模式的路由：呼叫 Request-URI 的 AOR 的第一个（q 值最高的）注册绑定，
+// 没有绑定时回 404。
+func (u *UAS) routeCall(req *message.Request) (*message.URI, int) {
+	bindings, err := u.registrar.Lookup(registrar.AOR(req.RequestURI))
+	if err != nil {
+		u.logger.Warn("location lookup failed", zap.Error(err))
+		return nil, message.StatusServerError
+	}
+	if len(bindings) == 0 {
+		return nil, message.StatusNotFound
+	}
+	uri, err := message.ParseURI(bindings[0].Contact)
+	if err != nil {
+		u.logger.Warn("invalid contact", zap.String("contact", bindings[0].Contact), zap.Error(err))
+		return nil, message.StatusServerError
+	}
+	return uri, 0
 }
 
 // handleOptions 响应 OPTIONS：返回 200 OK 和支持的方法列表。
 //
 // OPTIONS 用于探测对端能力，SIP 代理服务器也常用它做心跳检测。
-func (u *UAS) handleOptions(req *message.Request, src *net.UDPAddr) {
+func (u *UAS) handleOptions(req *message.Request, tx *dialog.Transaction) {
 	resp := stack.BuildResponse(req, message.StatusOK, "server")
-	resp.Headers.Set(message.HeaderAllow, "INVITE, ACK, BYE, CANCEL, OPTIONS, REGISTER")
+	resp.Headers.Set(message.HeaderAllow, stack.AllowedMethods+", REGISTER")
+	resp.Headers.Set(message.HeaderAllowEvents, u.stack.AllowEvents())
 	resp.Headers.Set("Accept", "application/sdp")
 	resp.Headers.Set("Accept-Encoding", "identity")
 	resp.Headers.Set("Accept-Language", "en")
-	u.send(resp, src)
+	u.respond(tx, resp)
 	u.logger.Info("OPTIONS handled: 200 OK")
 }
 
-// handleRegister 响应 REGISTER：模拟注册成功。
+// inDialog 判断请求是否属于已有对话（To 带 tag）。
+func inDialog(req *message.Request) bool {
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	return err == nil && to.Tag != ""
+}
+
+// loadMailboxes 解析 -mwi：逗号分隔的 aor=new/old，写入 message-summary 事件包。
+func loadMailboxes(summary *event.MessageSummary, spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid mailbox %q, want aor=new/old", entry)
+		}
+		uri, err := message.ParseURI(entry[:i])
+		if err != nil {
+			return fmt.Errorf("invalid mailbox %q: %w", entry, err)
+		}
+		var m event.Mailbox
+		if _, err := fmt.Sscanf(entry[i+1:], "%d/%d", &m.New, &m.Old); err != nil {
+			return fmt.Errorf("invalid mailbox %q, want aor=new/old", entry)
+		}
+		aor := registrar.AOR(uri)
+		m.Account = aor
+		summary.Set(aor, m)
+	}
+	return nil
+}
+
+// handleRegister 交由注册服务器处理 REGISTER（RFC 3261 §10.3）。
 //
-// 真实场景中，注册服务器需要维护一个位置数据库（Location Database），
-// 将 AOR（sip:alice@example.com）映射到联系地址（sip:alice@192.168.1.5:5060）。
-func (u *UAS) handleRegister(req *message.Request, src *net.UDPAddr) {
-	expires := req.Headers.Get(message.HeaderExpires)
-	if expires == "" {
-		expires = "3600"
+// 成功返回 200 OK 并列出 AOR 当前全部绑定；expires 过短返回 423 并携带 Min-Expires。
+func (u *UAS) handleRegister(req *message.Request, tx *dialog.Transaction) {
+	if u.auth != nil {
+		user, err := u.auth.Verify(req, false)
+		if err != nil {
+			resp := stack.BuildResponse(req, message.StatusUnauthorized, "server")
+			u.auth.Challenge(resp, false, errors.Is(err, auth.ErrStaleNonce))
+			u.respond(tx, resp)
+			u.logger.Info("REGISTER challenged: 401", zap.Error(err))
+			return
+		}
+		// 认证用户只能注册自己的 AOR（RFC 3261 §10.3 步骤 3）
+		if to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo)); err != nil || to.URI.User != user {
+			u.respond(tx, stack.BuildResponse(req, message.StatusForbidden, "server"))
+			u.logger.Info("REGISTER rejected: user not authorized for AOR", zap.String("user", user))
+			return
+		}
 	}
+
+	bindings, err := u.registrar.Register(req)
+	if err != nil {
+		rerr, ok := registrar.IsError(err)
+		if !ok {
+			rerr = &registrar.Error{Code: message.StatusServerError, Reason: message.ReasonPhrase(message.StatusServerError)}
+		}
+		resp := stack.BuildResponse(req, rerr.Code, "server")
+		resp.Reason = rerr.Reason
+		if rerr.MinExpires > 0 {
+			resp.Headers.Set(message.HeaderMinExpires, strconv.Itoa(rerr.MinExpires))
+		}
+		u.respond(tx, resp)
+		u.logger.Info("REGISTER rejected", zap.Int("code", rerr.Code), zap.String("reason", rerr.Reason))
+		return
+	}
+
+	now := time.Now()
 	resp := stack.BuildResponse(req, message.StatusOK, "server")
-	resp.Headers.Set(message.HeaderContact, req.Headers.Get(message.HeaderContact))
-	resp.Headers.Set(message.HeaderExpires, expires)
-	resp.Headers.Set("Date", time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
-	u.send(resp, src)
-	u.logger.Info("REGISTER handled: 200 OK",
-		zap.String("contact", req.Headers.Get(message.HeaderContact)),
-		zap.String("expires", expires),
-	)
+	for _, b := range bindings {
+		resp.Headers.Add(message.HeaderContact, registrar.ContactValue(b, now))
+	}
+	resp.Headers.Set("Date", now.UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+	u.respond(tx, resp)
+	u.logger.Info("REGISTER handled: 200 OK", zap.Int("bindings", len(bindings)))
 }
 
 // handleInvite 处理 INVITE：模拟振铃后接听。
@@ -135,97 +483,154 @@ func (u *UAS) handleRegister(req *message.Request, src *net.UDPAddr) {
 // 三步响应流程：
 //  1. 100 Trying   - 已收到请求，正在处理（抑制 UAC 重传）
 //  2. 180 Ringing  - 被叫正在振铃（UI 可播放回铃音）
-//  3. 200 OK       - 接听（应含 SDP answer，此处省略）
-func (u *UAS) handleInvite(req *message.Request, src *net.UDPAddr) {
+//     主叫支持 100rel 时改为可靠的 183 Session Progress，携带 SDP answer 提前建立媒体（早期媒体）
+//  3. 200 OK       - 接听，携带 SDP answer
+//
+// offer 中没有可接受的媒体时直接回复 488 Not Acceptable Here。
+// 接听前收到 CANCEL 时协议栈已回 487，这里停止振铃即可。
+func (u *UAS) handleInvite(req *message.Request, tx *dialog.Transaction) {
+	if u.stack.RequestDialog(req) != nil {
+		u.handleReInvite(req, tx)
+		return
+	}
 	localTag := stack.NewTag()
 
+	ok := stack.BuildResponse(req, message.StatusOK, localTag)
+	streams, err := u.stack.AnswerInvite(req, ok)
+	if err != nil {
+		u.respond(tx, stack.BuildResponse(req, message.StatusNotAcceptableHere, localTag))
+		u.logger.Info("INVITE -> 488 Not Acceptable Here", zap.Error(err))
+		return
+	}
+	for _, st := range streams {
+		u.logger.Info("media negotiated",
+			zap.String("remote", fmt.Sprintf("%s:%d", st.RemoteAddr, st.RemotePort)),
+			zap.Stringer("codec", st.Codecs[0]),
+			zap.String("direction", string(st.Direction)),
+		)
+	}
+
 	// 1. 100 Trying（不含 To tag，因为 dialog 尚未建立）
 	trying := stack.BuildResponse(req, message.StatusTrying, "")
-	u.send(trying, src)
+	u.respond(tx, trying)
 	u.logger.Info("INVITE -> 100 Trying")
 
 	// 模拟处理延迟
-	time.Sleep(200 * time.Millisecond)
+	if !u.wait(tx, 200*time.Millisecond) {
+		return
+	}
 
-	// 2. 180 Ringing（Early Dialog：含 To tag）
-	ringing := stack.BuildResponse(req, message.StatusRinging, localTag)
-	ringing.Headers.Set(message.HeaderContact, fmt.Sprintf("<sip:%s>", u.stack.LocalAddr()))
-	u.send(ringing, src)
-	u.logger.Info("INVITE -> 180 Ringing")
+	// 2. 180 Ringing / 183 Session Progress（Early Dialog：含 To tag）
+	callID := req.Headers.Get(message.HeaderCallID)
+	earlyMedia := stack.SupportsReliable(req) && len(streams) > 0
+	if earlyMedia {
+		// 协议栈补上 Require: 100rel，事务重传 183 直到 PRACK，200 在 PRACK 之后发出
+		progress := stack.BuildResponse(req, message.StatusSessionProgress, localTag)
+		progress.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", u.stack.ContactURI(req.RequestURI.Scheme)))
+		progress.Headers.Set(message.HeaderContentType, ok.Headers.Get(message.HeaderContentType))
+		progress.Body = ok.Body
+		u.respond(tx, progress)
+		u.logger.Info("INVITE -> 183 Session Progress (early media)")
+		u.startMedia(callID, streams)
+	} else {
+		ringing := stack.BuildResponse(req, message.StatusRinging, localTag)
+		ringing.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", u.stack.ContactURI(req.RequestURI.Scheme)))
+		u.respond(tx, ringing)
+		u.logger.Info("INVITE -> 180 Ringing")
+	}
 
 	// 模拟振铃 1s
-	time.Sleep(1 * time.Second)
+	if !u.wait(tx, 1*time.Second) {
+		u.stopMedia(callID)
+		return
+	}
 
-	// 3. 200 OK（含 To tag，Dialog 建立；应含 SDP，此处演示信令只回空 body）
-	ok := stack.BuildResponse(req, message.StatusOK, localTag)
-	ok.Headers.Set(message.HeaderContact, fmt.Sprintf("<sip:%s>", u.stack.LocalAddr()))
-	ok.Headers.Set(message.HeaderAllow, "INVITE, ACK, BYE, CANCEL, OPTIONS")
-	// 在真实场景中这里需要填写 SDP（Session Description Protocol）body：
-	// ok.Headers.Set(message.HeaderContentType, "application/sdp")
-	// ok.Body = []byte("v=0\r\no=...\r\n...")
-	u.send(ok, src)
+	// 3. 200 OK（含 To tag 与 SDP answer，Dialog 建立）
+	ok.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", u.stack.ContactURI(req.RequestURI.Scheme)))
+	ok.Headers.Set(message.HeaderAllow, stack.AllowedMethods)
+	u.respond(tx, ok)
 	u.logger.Info("INVITE -> 200 OK (dialog established)", zap.String("tag", localTag))
+	if !earlyMedia {
+		u.startMedia(callID, streams)
+	}
 }
 
-// handleBye 响应 BYE：终止会话。
-func (u *UAS) handleBye(req *message.Request, src *net.UDPAddr) {
-	resp := stack.BuildResponse(req, message.StatusOK, "")
-	u.send(resp, src)
-	u.logger.Info("BYE handled: 200 OK (session terminated)")
+// handleReInvite 应答对话内的 re-INVITE（如会话刷新）：立即回 200，媒体沿用原会话。
+func (u *UAS) handleReInvite(req *message.Request, tx *dialog.Transaction) {
+	ok := stack.BuildResponse(req, message.StatusOK, "")
+	if _, err := u.stack.AnswerInvite(req, ok); err != nil {
+		u.respond(tx, stack.BuildResponse(req, message.StatusNotAcceptableHere, ""))
+		u.logger.Info("re-INVITE -> 488 Not Acceptable Here", zap.Error(err))
+		return
+	}
+	ok.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", u.stack.ContactURI(req.RequestURI.Scheme)))
+	ok.Headers.Set(message.HeaderAllow, stack.AllowedMethods)
+	u.respond(tx, ok)
+	u.logger.Info("re-INVITE -> 200 OK")
 }
 
-// handleCancel 响应 CANCEL：取消未完成的 INVITE。
-func (u *UAS) handleCancel(req *message.Request, src *net.UDPAddr) {
-	resp := stack.BuildResponse(req, message.StatusOK, "")
-	u.send(resp, src)
-	u.logger.Info("CANCEL handled: 200 OK")
+// wait 等待 d，期间 INVITE 被 CANCEL 时返回 false。
+func (u *UAS) wait(tx *dialog.Transaction, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-tx.Cancelled():
+		u.logger.Info("INVITE cancelled, stop ringing")
+		return false
+	}
 }
 
-// extractResponseDst 从 Via 头域提取响应目标地址。
-//
-// RFC 3261 §18.2.2: 响应发送规则：
-//   - 若 Via 含 maddr 参数，发往 maddr
-//   - 若 Via 含 received 参数，发往 received（NAT 穿透）
-//   - 否则发往 sent-by（Via 中的 host:port）
-func (u *UAS) extractResponseDst(req *message.Request) *net.UDPAddr {
-	via := req.Headers.Get(message.HeaderVia)
-	if via == "" {
-		return nil
-	}
-	parsed, err := message.ParseVia(via)
-	if err != nil {
-		u.logger.Error("parse Via", zap.Error(err))
-		return nil
-	}
-	target := parsed.SentBy
-	if received, ok := parsed.Params["received"]; ok && received != "" {
-		// 使用 received 参数覆盖 host 部分
-		host, _, _ := net.SplitHostPort(target)
-		if host == "" {
-			target = received
-		} else {
-			_, port, _ := net.SplitHostPort(target)
-			if port != "" {
-				target = received + ":" + port
-			} else {
-				target = received
-			}
-		}
+// startMedia 为呼叫的第一个媒体流建立 RTP 会话（只接收，RTCP 回送接收报告）。
+func (u *UAS) startMedia(callID string, streams []sdp.Stream) {
+	if len(streams) == 0 {
+		return
 	}
-	// 如果没有端口，默认 5060
-	if _, _, err := net.SplitHostPort(target); err != nil {
-		target = target + ":5060"
+	cfg, err := rtp.ConfigFromStream(streams[0])
+	if err != nil {
+		u.logger.Warn("no media", zap.Error(err))
+		return
 	}
-	addr, err := net.ResolveUDPAddr("udp", target)
+	session, err := rtp.NewSession(cfg, u.logger)
 	if err != nil {
-		u.logger.Error("resolve response dst", zap.Error(err))
-		return nil
+		u.logger.Warn("start RTP session", zap.Error(err))
+		return
 	}
-	return addr
+	u.mu.Lock()
+	u.calls[callID] = session
+	u.mu.Unlock()
+}
+
+// stopMedia 结束呼叫的媒体会话并记录统计。
+func (u *UAS) stopMedia(callID string) {
+	u.mu.Lock()
+	session := u.calls[callID]
+	delete(u.calls, callID)
+	u.mu.Unlock()
+	if session == nil {
+		return
+	}
+	session.Close()
+	st := session.Stats()
+	u.logger.Info("RTP stats",
+		zap.Uint32("packets_received", st.PacketsReceived),
+		zap.Uint64("octets_received", st.OctetsReceived),
+		zap.Int32("packets_lost", st.PacketsLost),
+		zap.Duration("jitter", st.Jitter),
+		zap.Int("rtcp_received", st.RTCPReceived),
+	)
+}
+
+// handleBye 响应 BYE：终止会话。
+func (u *UAS) handleBye(req *message.Request, tx *dialog.Transaction) {
+	resp := stack.BuildResponse(req, message.StatusOK, "")
+	u.respond(tx, resp)
+	u.logger.Info("BYE handled: 200 OK (session terminated)")
+	u.stopMedia(req.Headers.Get(message.HeaderCallID))
 }
 
-func (u *UAS) send(resp *message.Response, dst *net.UDPAddr) {
-	if err := u.stack.SendResponse(resp, dst); err != nil {
+// respond 通过服务端事务发送响应，重传与重传吸收由事务负责。
+func (u *UAS) respond(tx *dialog.Transaction, resp *message.Response) {
+	if err := tx.Respond(resp); err != nil {
 		u.logger.Error("send response", zap.Error(err))
 	}
 }
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// captureToggle 在没有 SIGUSR1 的平台上为 nil，抓包只能由 -capture-off 决定初始状态。
+var captureToggle os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// captureToggle 是运行中开关抓包的信号（kill -USR1 <pid>）。
+var captureToggle os.Signal = syscall.SIGUSR1
@@ -2,6 +2,10 @@ module github.com/lccxxo/go_/mini_sip
 
 go 1.22.5
 
-require go.uber.org/zap v1.27.1
+require (
+	github.com/gorilla/websocket v1.5.1
+	go.uber.org/zap v1.27.1
+	golang.org/x/net v0.17.0
+)
 
 require go.uber.org/multierr v1.10.0 // indirect
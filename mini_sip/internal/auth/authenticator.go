@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+)
+
+// DefaultNonceTTL 是 nonce 的有效期，过期后应答被判为 stale，客户端用新 nonce 重试即可。
+const DefaultNonceTTL = 5 * time.Minute
+
+// Authenticator 是服务端摘要认证器（注册服务器用 401，代理用 407）。
+//
+// 每个 nonce 记录签发时间与已见过的最大 nc：
+//   - nonce 未知或已过期：ErrStaleNonce，重新挑战时带 stale=true
+//   - nc 不大于已见过的值：ErrReplay（重放）
+type Authenticator struct {
+	Realm      string
+	Algorithms []string // 挑战中提供的算法，按优先顺序（RFC 8760 §2.4）
+	NonceTTL   time.Duration
+	Now        func() time.Time
+
+	store CredentialStore
+
+	mu     sync.Mutex
+	nonces map[string]*nonceState
+}
+
+type nonceState struct {
+	issued time.Time
+	nc     uint32 // 已见过的最大 nonce count
+}
+
+// NewAuthenticator 创建认证器，默认同时提供 SHA-256 与 MD5 挑战。
+func NewAuthenticator(realm string, store CredentialStore) *Authenticator {
+	return &Authenticator{
+		Realm:      realm,
+		Algorithms: []string{AlgorithmSHA256, AlgorithmMD5},
+		NonceTTL:   DefaultNonceTTL,
+		Now:        time.Now,
+		store:      store,
+		nonces:     make(map[string]*nonceState),
+	}
+}
+
+// headerNames 返回挑战与凭据头域名：注册服务器 / UAS 用 WWW-Authenticate，代理用 Proxy-Authenticate。
+func headerNames(proxy bool) (challenge, credentials string) {
+	if proxy {
+		return message.HeaderProxyAuth, message.HeaderProxyAuthz
+	}
+	return message.HeaderWWWAuth, message.HeaderAuthorize
+}
+
+// Verify 校验请求携带的本 realm 凭据，成功返回用户名。
+//
+// 没有凭据返回 ErrNoCredentials；调用方对任何错误都应以 Challenge 重新挑战，
+// 其中 ErrStaleNonce 需要带 stale=true。
+func (a *Authenticator) Verify(req *message.Request, proxy bool) (string, error) {
+	_, hdr := headerNames(proxy)
+	var creds *Credentials
+	for _, v := range req.Headers.GetAll(hdr) {
+		c, err := ParseCredentials(v)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrBadResponse, err)
+		}
+		if c.Realm == a.Realm {
+			creds = c
+			break
+		}
+	}
+	if creds == nil {
+		return "", ErrNoCredentials
+	}
+	if !supportedAlgorithm(creds.Algorithm) || (creds.QOP != "" && creds.QOP != qopAuth) {
+		return "", ErrUnsupported
+	}
+	if creds.QOP == "" {
+		// 只接受 qop=auth，拒绝不带 nc 防重放的 RFC 2069 应答
+		return "", fmt.Errorf("%w: qop=auth required", ErrUnsupported)
+	}
+	// digest-uri 必须与 Request-URI 一致（RFC 3261 §22.4），否则截获的凭据可用于别的目标；
+	// 两边都经同一解析与序列化后比较，容忍 scheme 大小写等写法差异
+	if uri, err := message.ParseURI(creds.URI); err != nil || uri.String() != req.RequestURI.String() {
+		return "", fmt.Errorf("%w: digest uri %q does not match Request-URI %q", ErrBadResponse, creds.URI, req.RequestURI)
+	}
+
+	password, err := a.store.Password(a.Realm, creds.Username)
+	if err != nil {
+		return "", err
+	}
+	expected := digestResponse(creds, password, string(req.Method))
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(creds.Response)), []byte(expected)) != 1 {
+		return "", ErrBadResponse
+	}
+
+	// 应答本身正确，再检查 nonce 的新鲜度与 nc
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.nonces[creds.Nonce]
+	if !ok || a.Now().Sub(st.issued) > a.NonceTTL {
+		delete(a.nonces, creds.Nonce)
+		return "", ErrStaleNonce
+	}
+	if creds.NC <= st.nc {
+		return "", ErrReplay
+	}
+	st.nc = creds.NC
+	return creds.Username, nil
+}
+
+// Challenge 在响应（401 / 407）中加入挑战，每种算法一个头域，共用同一个新 nonce。
+func (a *Authenticator) Challenge(resp *message.Response, proxy, stale bool) {
+	hdr, _ := headerNames(proxy)
+	nonce := a.newNonce()
+	opaque := randomHex(8)
+	for _, alg := range a.Algorithms {
+		ch := &Challenge{
+			Realm:     a.Realm,
+			Nonce:     nonce,
+			Opaque:    opaque,
+			Algorithm: alg,
+			QOP:       qopAuth,
+			Stale:     stale,
+		}
+		resp.Headers.Add(hdr, ch.String())
+	}
+}
+
+// newNonce 签发 nonce，同时清理过期的 nonce。
+func (a *Authenticator) newNonce() string {
+	nonce := randomHex(16)
+	now := a.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for n, st := range a.nonces {
+		if now.Sub(st.issued) > a.NonceTTL {
+			delete(a.nonces, n)
+		}
+	}
+	a.nonces[nonce] = &nonceState{issued: now}
+	return nonce
+}
+
+// HasUser 判断本 realm 下是否有 username 的凭据。
+func (a *Authenticator) HasUser(username string) bool {
+	_, err := a.store.Password(a.Realm, username)
+	return err == nil
+}
+
+// Strip 删除请求中属于本 realm 的凭据（代理转发前，RFC 3261 §22.3），其他 realm 的凭据保留给下一跳。
+func (a *Authenticator) Strip(req *message.Request, proxy bool) {
+	_, hdr := headerNames(proxy)
+	values := req.Headers.GetAll(hdr)
+	if len(values) == 0 {
+		return
+	}
+	var keep []string
+	for _, v := range values {
+		if c, err := ParseCredentials(v); err == nil && c.Realm == a.Realm {
+			continue
+		}
+		keep = append(keep, v)
+	}
+	req.Headers.Del(hdr)
+	for _, v := range keep {
+		req.Headers.Add(hdr, v)
+	}
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+)
+
+// testAuth 是时钟可手动推进的认证器，bob 的密码为 zanzibar。
+type testAuth struct {
+	*Authenticator
+	now time.Time
+}
+
+func newTestAuth() *testAuth {
+	store := NewMemoryStore()
+	store.Set("biloxi.com", "bob", "zanzibar")
+	ta := &testAuth{
+		Authenticator: NewAuthenticator("biloxi.com", store),
+		now:           time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+	}
+	ta.Now = func() time.Time { return ta.now }
+	return ta
+}
+
+// challenge 签发挑战，返回其中指定算法的那一个。
+func (ta *testAuth) challenge(t *testing.T, proxy bool, algorithm string) *Challenge {
+	t.Helper()
+	resp := message.NewResponse(message.StatusUnauthorized)
+	ta.Challenge(resp, proxy, false)
+	hdr, _ := headerNames(proxy)
+	for _, v := range resp.Headers.GetAll(hdr) {
+		ch, err := ParseChallenge(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.Algorithm == algorithm {
+			return ch
+		}
+	}
+	t.Fatalf("no %s challenge in %q", algorithm, resp.Headers.GetAll(hdr))
+	return nil
+}
+
+// request 返回带有 creds 的 REGISTER。
+func request(t *testing.T, uri string, proxy bool, creds ...*Credentials) *message.Request {
+	t.Helper()
+	u, err := message.ParseURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := message.NewRequest(message.MethodREGISTER, u)
+	_, hdr := headerNames(proxy)
+	for _, c := range creds {
+		req.Headers.Add(hdr, c.String())
+	}
+	return req
+}
+
+// respond 以 password 应答挑战，nc 为 nc。
+func respond(t *testing.T, ch *Challenge, password, uri string, nc uint32) *Credentials {
+	t.Helper()
+	c, err := Respond(ch, "bob", password, string(message.MethodREGISTER), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NC = nc
+	c.Response = digestResponse(c, password, string(message.MethodREGISTER))
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	for _, alg := range []string{AlgorithmSHA256, AlgorithmMD5} {
+		for _, proxy := range []bool{false, true} {
+			ta := newTestAuth()
+			ch := ta.challenge(t, proxy, alg)
+			if ch.Stale || ch.Realm != "biloxi.com" || ch.QOP != "auth" || ch.Opaque == "" {
+				t.Errorf("%s challenge = %+v", alg, ch)
+			}
+			user, err := ta.Verify(request(t, "sip:biloxi.com", proxy, respond(t, ch, "zanzibar", "sip:biloxi.com", 1)), proxy)
+			if err != nil || user != "bob" {
+				t.Errorf("%s proxy=%v: Verify = %q, %v", alg, proxy, user, err)
+			}
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	ta := newTestAuth()
+	ch := ta.challenge(t, false, AlgorithmMD5)
+	ok := respond(t, ch, "zanzibar", "sip:biloxi.com", 1)
+
+	other := *ok
+	other.Realm = "atlanta.com"
+	noQOP := *ok
+	noQOP.QOP, noQOP.NC, noQOP.CNonce = "", 0, ""
+	noQOP.Response = digestResponse(&noQOP, "zanzibar", "REGISTER")
+	badAlg := *ok
+	badAlg.Algorithm = "SHA-512-256"
+	unknown := *ok
+	unknown.Username = "mallory"
+
+	tests := []struct {
+		name string
+		req  *message.Request
+		want error
+	}{
+		{"no credentials", request(t, "sip:biloxi.com", false), ErrNoCredentials},
+		// 代理凭据不能用于 WWW-Authenticate 挑战
+		{"wrong header", request(t, "sip:biloxi.com", true, ok), ErrNoCredentials},
+		{"other realm", request(t, "sip:biloxi.com", false, &other), ErrNoCredentials},
+		{"wrong password", request(t, "sip:biloxi.com", false, respond(t, ch, "wrong", "sip:biloxi.com", 1)), ErrBadResponse},
+		{"rfc 2069", request(t, "sip:biloxi.com", false, &noQOP), ErrUnsupported},
+		{"algorithm", request(t, "sip:biloxi.com", false, &badAlg), ErrUnsupported},
+		{"unknown user", request(t, "sip:biloxi.com", false, &unknown), ErrUnknownUser},
+		// 应答针对 sip:biloxi.com 计算，却用在另一个 Request-URI 上
+		{"uri mismatch", request(t, "sip:bob@biloxi.com", false, ok), ErrBadResponse},
+		{"uri mismatch recomputed", request(t, "sip:bob@biloxi.com", false, respond(t, ch, "zanzibar", "sip:biloxi.com", 1)), ErrBadResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if user, err := ta.Verify(tt.req, false); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %q, %v; want %v", user, err, tt.want)
+			}
+		})
+	}
+	// 上面的失败不消耗 nc，正确的应答仍然通过
+	if _, err := ta.Verify(request(t, "sip:biloxi.com", false, ok), false); err != nil {
+		t.Errorf("valid credentials after failures: %v", err)
+	}
+}
+
+func TestVerifyURIMatch(t *testing.T) {
+	ta := newTestAuth()
+	ch := ta.challenge(t, false, AlgorithmSHA256)
+	// scheme 大小写不同但等价的写法可以通过
+	c := respond(t, ch, "zanzibar", "SIP:biloxi.com;transport=tcp", 1)
+	if _, err := ta.Verify(request(t, "sip:biloxi.com;transport=tcp", false, c), false); err != nil {
+		t.Errorf("equivalent uri rejected: %v", err)
+	}
+	c = respond(t, ch, "zanzibar", "not a uri", 2)
+	_, err := ta.Verify(request(t, "sip:biloxi.com", false, c), false)
+	if !errors.Is(err, ErrBadResponse) || !strings.Contains(err.Error(), "Request-URI") {
+		t.Errorf("unparsable uri: %v", err)
+	}
+}
+
+func TestNonceCount(t *testing.T) {
+	ta := newTestAuth()
+	ch := ta.challenge(t, false, AlgorithmMD5)
+	verify := func(nc uint32) error {
+		_, err := ta.Verify(request(t, "sip:biloxi.com", false, respond(t, ch, "zanzibar", "sip:biloxi.com", nc)), false)
+		return err
+	}
+	steps := []struct {
+		nc   uint32
+		want error
+	}{
+		{1, nil},
+		{1, ErrReplay}, // 同一 nc 重放
+		{3, nil},       // 允许跳号
+		{2, ErrReplay}, // 小于已见过的最大值
+		{4, nil},
+	}
+	for _, s := range steps {
+		if err := verify(s.nc); !errors.Is(err, s.want) || (s.want == nil && err != nil) {
+			t.Errorf("nc=%d: Verify = %v, want %v", s.nc, err, s.want)
+		}
+	}
+}
+
+func TestStaleNonce(t *testing.T) {
+	ta := newTestAuth()
+	ch := ta.challenge(t, false, AlgorithmMD5)
+	verify := func(ch *Challenge, nc uint32) error {
+		_, err := ta.Verify(request(t, "sip:biloxi.com", false, respond(t, ch, "zanzibar", "sip:biloxi.com", nc)), false)
+		return err
+	}
+
+	ta.now = ta.now.Add(DefaultNonceTTL)
+	if err := verify(ch, 1); err != nil {
+		t.Fatalf("nonce at TTL: %v", err)
+	}
+	ta.now = ta.now.Add(time.Second)
+	if err := verify(ch, 2); !errors.Is(err, ErrStaleNonce) {
+		t.Fatalf("expired nonce: %v, want ErrStaleNonce", err)
+	}
+	// 过期后 nonce 被删除，即使时钟回拨也不再接受
+	ta.now = ta.now.Add(-time.Minute)
+	if err := verify(ch, 3); !errors.Is(err, ErrStaleNonce) {
+		t.Errorf("removed nonce: %v, want ErrStaleNonce", err)
+	}
+	// 服务器从未签发过的 nonce 同样按 stale 处理
+	forged := *ch
+	forged.Nonce = "0123456789abcdef"
+	if err := verify(&forged, 1); !errors.Is(err, ErrStaleNonce) {
+		t.Errorf("unknown nonce: %v, want ErrStaleNonce", err)
+	}
+
+	// stale=true 的重新挑战带新 nonce，用它即可通过
+	resp := message.NewResponse(message.StatusUnauthorized)
+	ta.Challenge(resp, false, true)
+	fresh, err := ParseChallenge(resp.Headers.Get(message.HeaderWWWAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh.Stale || fresh.Nonce == ch.Nonce {
+		t.Fatalf("re-challenge = %+v", fresh)
+	}
+	if err := verify(fresh, 1); err != nil {
+		t.Errorf("fresh nonce: %v", err)
+	}
+}
+
+func TestNewNonceReapsExpired(t *testing.T) {
+	ta := newTestAuth()
+	ta.challenge(t, false, AlgorithmMD5)
+	ta.now = ta.now.Add(DefaultNonceTTL + time.Second)
+	ta.challenge(t, false, AlgorithmMD5)
+	if n := len(ta.nonces); n != 1 {
+		t.Errorf("%d nonces kept, want 1", n)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	ta := newTestAuth()
+	mine := &Credentials{Username: "bob", Realm: "biloxi.com", Nonce: "n", Response: "r"}
+	theirs := &Credentials{Username: "bob", Realm: "atlanta.com", Nonce: "n", Response: "r"}
+	req := request(t, "sip:bob@biloxi.com", true, mine, theirs)
+	ta.Strip(req, true)
+	got := req.Headers.GetAll(message.HeaderProxyAuthz)
+	if len(got) != 1 || !strings.Contains(got[0], `realm="atlanta.com"`) {
+		t.Errorf("after Strip: %q", got)
+	}
+}
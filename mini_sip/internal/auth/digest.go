@@ -0,0 +1,281 @@
+// Package auth 实现 SIP 摘要认证（RFC 3261 §22，RFC 2617 / RFC 7616 摘要算法，RFC 8760 SHA-256）。
+//
+// 挑战-应答流程：
+//
+//	UAC                                   Registrar / Proxy
+//	 |--REGISTER (CSeq 1)------------------>|
+//	 |<-401 WWW-Authenticate: Digest -------|  realm, nonce, qop=auth, algorithm
+//	 |--REGISTER (CSeq 2) + Authorization-->|  response = H(HA1:nonce:nc:cnonce:qop:HA2)
+//	 |<-200 OK------------------------------|
+//
+// 代理使用 407 Proxy-Authenticate / Proxy-Authorization，计算方式相同。
+//
+//	HA1      = H(username:realm:password)
+//	HA2      = H(method:digest-uri)
+//	response = H(HA1:nonce:nc:cnonce:qop:HA2)   （qop=auth）
+//
+// H 为 MD5 或 SHA-256，由 algorithm 参数指定。
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// 摘要算法（RFC 8760 §2）
+const (
+	AlgorithmMD5    = "MD5"
+	AlgorithmSHA256 = "SHA-256"
+)
+
+// qopAuth 是唯一支持的保护质量（不支持 auth-int）。
+const qopAuth = "auth"
+
+// 认证错误
+var (
+	ErrNoCredentials = errors.New("no credentials")
+	ErrUnknownUser   = errors.New("unknown user")
+	ErrStaleNonce    = errors.New("stale nonce")
+	ErrBadResponse   = errors.New("digest response mismatch")
+	ErrReplay        = errors.New("nonce count replayed")
+	ErrUnsupported   = errors.New("unsupported digest parameters")
+)
+
+// Challenge 是 WWW-Authenticate / Proxy-Authenticate 中的摘要挑战。
+type Challenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string // 空表示 MD5
+	QOP       string // 逗号分隔的可选项，如 "auth"
+	Stale     bool
+}
+
+// ParseChallenge 解析 `Digest realm="...", nonce="...", ...`。
+func ParseChallenge(v string) (*Challenge, error) {
+	params, err := parseDigest(v)
+	if err != nil {
+		return nil, err
+	}
+	c := &Challenge{
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		Opaque:    params["opaque"],
+		Algorithm: params["algorithm"],
+		QOP:       params["qop"],
+		Stale:     strings.EqualFold(params["stale"], "true"),
+	}
+	if c.Nonce == "" {
+		return nil, fmt.Errorf("digest challenge without nonce: %q", v)
+	}
+	return c, nil
+}
+
+// String 序列化为头域值。
+func (c *Challenge) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Digest realm=%q, nonce=%q", c.Realm, c.Nonce)
+	if c.Opaque != "" {
+		fmt.Fprintf(&sb, ", opaque=%q", c.Opaque)
+	}
+	if c.Algorithm != "" {
+		sb.WriteString(", algorithm=" + c.Algorithm)
+	}
+	if c.QOP != "" {
+		fmt.Fprintf(&sb, ", qop=%q", c.QOP)
+	}
+	if c.Stale {
+		sb.WriteString(", stale=true")
+	}
+	return sb.String()
+}
+
+// Credentials 是 Authorization / Proxy-Authorization 中的摘要应答。
+type Credentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm string
+	CNonce    string
+	NC        uint32
+	QOP       string
+	Opaque    string
+}
+
+// ParseCredentials 解析 `Digest username="...", realm="...", ...`。
+func ParseCredentials(v string) (*Credentials, error) {
+	params, err := parseDigest(v)
+	if err != nil {
+		return nil, err
+	}
+	c := &Credentials{
+		Username:  params["username"],
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		URI:       params["uri"],
+		Response:  params["response"],
+		Algorithm: params["algorithm"],
+		CNonce:    params["cnonce"],
+		QOP:       params["qop"],
+		Opaque:    params["opaque"],
+	}
+	if nc := params["nc"]; nc != "" {
+		n, err := strconv.ParseUint(nc, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nc %q: %w", nc, err)
+		}
+		c.NC = uint32(n)
+	}
+	if c.Username == "" || c.Nonce == "" || c.Response == "" {
+		return nil, fmt.Errorf("incomplete digest credentials: %q", v)
+	}
+	return c, nil
+}
+
+// String 序列化为头域值。
+func (c *Credentials) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q",
+		c.Username, c.Realm, c.Nonce, c.URI, c.Response)
+	if c.Algorithm != "" {
+		sb.WriteString(", algorithm=" + c.Algorithm)
+	}
+	if c.QOP != "" {
+		fmt.Fprintf(&sb, ", qop=%s, nc=%08x, cnonce=%q", c.QOP, c.NC, c.CNonce)
+	}
+	if c.Opaque != "" {
+		fmt.Fprintf(&sb, ", opaque=%q", c.Opaque)
+	}
+	return sb.String()
+}
+
+// Respond 用密码应答挑战，生成 method 请求（Request-URI 为 uri）的凭据。
+func Respond(ch *Challenge, username, password, method, uri string) (*Credentials, error) {
+	if !supportedAlgorithm(ch.Algorithm) {
+		return nil, fmt.Errorf("%w: algorithm %q", ErrUnsupported, ch.Algorithm)
+	}
+	c := &Credentials{
+		Username:  username,
+		Realm:     ch.Realm,
+		Nonce:     ch.Nonce,
+		URI:       uri,
+		Algorithm: ch.Algorithm,
+		Opaque:    ch.Opaque,
+	}
+	if offersAuth(ch.QOP) {
+		c.QOP = qopAuth
+		c.NC = 1
+		c.CNonce = randomHex(8)
+	} else if ch.QOP != "" {
+		return nil, fmt.Errorf("%w: qop %q", ErrUnsupported, ch.QOP)
+	}
+	c.Response = digestResponse(c, password, method)
+	return c, nil
+}
+
+// digestResponse 计算 response 参数（RFC 7616 §3.4.1）。
+func digestResponse(c *Credentials, password, method string) string {
+	h := newHash(c.Algorithm)
+	ha1 := h(c.Username + ":" + c.Realm + ":" + password)
+	ha2 := h(method + ":" + c.URI)
+	if c.QOP == "" {
+		// RFC 2069 兼容模式
+		return h(ha1 + ":" + c.Nonce + ":" + ha2)
+	}
+	return h(fmt.Sprintf("%s:%s:%08x:%s:%s:%s", ha1, c.Nonce, c.NC, c.CNonce, c.QOP, ha2))
+}
+
+func newHash(algorithm string) func(string) string {
+	var f func() hash.Hash
+	switch strings.ToUpper(algorithm) {
+	case AlgorithmSHA256:
+		f = sha256.New
+	default:
+		f = md5.New
+	}
+	return func(s string) string {
+		h := f()
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+func supportedAlgorithm(algorithm string) bool {
+	switch strings.ToUpper(algorithm) {
+	case "", AlgorithmMD5, AlgorithmSHA256:
+		return true
+	}
+	return false
+}
+
+func offersAuth(qop string) bool {
+	for _, q := range strings.Split(qop, ",") {
+		if strings.EqualFold(strings.TrimSpace(q), qopAuth) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDigest 解析 Digest 认证参数列表，值可以是 token 或带引号的字符串（引号内允许逗号）。
+func parseDigest(v string) (map[string]string, error) {
+	v = strings.TrimSpace(v)
+	if len(v) < 7 || !strings.EqualFold(v[:6], "Digest") || (v[6] != ' ' && v[6] != '\t') {
+		return nil, fmt.Errorf("not a Digest header: %q", v)
+	}
+	rest := v[7:]
+	params := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid digest parameter in %q", v)
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			var sb strings.Builder
+			for ; end < len(rest) && rest[end] != '"'; end++ {
+				if rest[end] == '\\' && end+1 < len(rest) {
+					end++
+				}
+				sb.WriteByte(rest[end])
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("unterminated quoted string in %q", v)
+			}
+			val = sb.String()
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			val = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = val
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
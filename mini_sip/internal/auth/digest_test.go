@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Challenge
+		wantErr bool
+	}{
+		{"full", `Digest realm="atlanta.com", nonce="84a4cc6f3082121f32b42a2187831a9e", opaque="5ccc", algorithm=SHA-256, qop="auth,auth-int", stale=TRUE`,
+			Challenge{Realm: "atlanta.com", Nonce: "84a4cc6f3082121f32b42a2187831a9e", Opaque: "5ccc", Algorithm: "SHA-256", QOP: "auth,auth-int", Stale: true}, false},
+		// 方案名与参数名不区分大小写，引号内允许逗号与转义
+		{"case and quoting", `digest  REALM="a, \"b\"",Nonce=abc`,
+			Challenge{Realm: `a, "b"`, Nonce: "abc"}, false},
+		{"no nonce", `Digest realm="atlanta.com"`, Challenge{}, true},
+		{"basic", `Basic realm="atlanta.com"`, Challenge{}, true},
+		{"unterminated", `Digest realm="atlanta.com, nonce=abc`, Challenge{}, true},
+		{"bad parameter", `Digest realm`, Challenge{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChallenge(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseChallenge(%q) = %+v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("ParseChallenge = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChallengeRoundTrip(t *testing.T) {
+	in := &Challenge{Realm: "atlanta.com", Nonce: "abc", Opaque: "xyz", Algorithm: AlgorithmSHA256, QOP: "auth", Stale: true}
+	got, err := ParseChallenge(in.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *in {
+		t.Errorf("round trip = %+v, want %+v", *got, *in)
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Credentials
+		wantErr bool
+	}{
+		{"qop auth", `Digest username="bob", realm="biloxi.com", nonce="dcd98b", uri="sip:bob@biloxi.com", ` +
+			`response="6629fae4", algorithm=MD5, cnonce="0a4f113b", nc=0000000a, qop=auth, opaque="5ccc"`,
+			Credentials{Username: "bob", Realm: "biloxi.com", Nonce: "dcd98b", URI: "sip:bob@biloxi.com",
+				Response: "6629fae4", Algorithm: "MD5", CNonce: "0a4f113b", NC: 10, QOP: "auth", Opaque: "5ccc"}, false},
+		{"rfc 2069", `Digest username="bob", realm="biloxi.com", nonce="dcd98b", uri="sip:biloxi.com", response="42ce3cef"`,
+			Credentials{Username: "bob", Realm: "biloxi.com", Nonce: "dcd98b", URI: "sip:biloxi.com", Response: "42ce3cef"}, false},
+		{"bad nc", `Digest username="bob", nonce="n", response="r", nc=xyz`, Credentials{}, true},
+		{"nc overflow", `Digest username="bob", nonce="n", response="r", nc=100000000`, Credentials{}, true},
+		{"no username", `Digest realm="biloxi.com", nonce="n", response="r"`, Credentials{}, true},
+		{"no response", `Digest username="bob", nonce="n"`, Credentials{}, true},
+		{"not digest", `Digestusername="bob"`, Credentials{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCredentials(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseCredentials(%q) = %+v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("ParseCredentials = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialsRoundTrip(t *testing.T) {
+	in := &Credentials{Username: "bob", Realm: "biloxi.com", Nonce: "n", URI: "sip:bob@biloxi.com;transport=tcp",
+		Response: "r", Algorithm: AlgorithmSHA256, CNonce: "c", NC: 0x1f, QOP: "auth", Opaque: "o"}
+	s := in.String()
+	if !strings.Contains(s, "nc=0000001f") {
+		t.Errorf("nc not written as 8 hex digits: %s", s)
+	}
+	got, err := ParseCredentials(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *in {
+		t.Errorf("round trip = %+v, want %+v", *got, *in)
+	}
+}
+
+func TestDigestResponse(t *testing.T) {
+	// RFC 7616 §3.9.1 的示例（HTTP）
+	c := &Credentials{Username: "Mufasa", Realm: "http-auth@example.org", Nonce: "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		URI: "/dir/index.html", CNonce: "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", NC: 1, QOP: "auth"}
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"", "8ca523f5e9506fed4657c9700eebdbec"},
+		{AlgorithmMD5, "8ca523f5e9506fed4657c9700eebdbec"},
+		{"sha-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		c.Algorithm = tt.algorithm
+		if got := digestResponse(c, "Circle of Life", "GET"); got != tt.want {
+			t.Errorf("algorithm %q: response = %s, want %s", tt.algorithm, got, tt.want)
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	ch := &Challenge{Realm: "biloxi.com", Nonce: "n", Opaque: "o", Algorithm: AlgorithmSHA256, QOP: "auth-int, auth"}
+	c, err := Respond(ch, "bob", "zanzibar", "REGISTER", "sip:biloxi.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.QOP != "auth" || c.NC != 1 || c.CNonce == "" || c.Opaque != "o" || c.URI != "sip:biloxi.com" {
+		t.Errorf("credentials = %+v", c)
+	}
+	if c.Response != digestResponse(c, "zanzibar", "REGISTER") {
+		t.Error("response does not match the digest")
+	}
+	if _, err := Respond(&Challenge{Nonce: "n", Algorithm: "SHA-512-256"}, "bob", "pw", "REGISTER", "sip:biloxi.com"); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+	if _, err := Respond(&Challenge{Nonce: "n", QOP: "auth-int"}, "bob", "pw", "REGISTER", "sip:biloxi.com"); err == nil {
+		t.Error("auth-int only challenge accepted")
+	}
+}
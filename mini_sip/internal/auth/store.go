@@ -0,0 +1,42 @@
+package auth
+
+import "sync"
+
+// CredentialStore 是凭据存储接口，可替换为数据库、LDAP 等实现。
+//
+// 服务端用它校验摘要应答，客户端用它应答挑战。
+type CredentialStore interface {
+	// Password 返回 realm 下 username 的密码，未知用户返回 ErrUnknownUser。
+	Password(realm, username string) (string, error)
+}
+
+// MemoryStore 是进程内的 CredentialStore 实现。
+//
+// realm 为空的条目匹配任意 realm，便于客户端只配置用户名与密码。
+type MemoryStore struct {
+	mu        sync.RWMutex
+	passwords map[string]string // realm + "\x00" + username -> password
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{passwords: make(map[string]string)}
+}
+
+// Set 设置用户密码，realm 为空时对所有 realm 生效。
+func (m *MemoryStore) Set(realm, username, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passwords[realm+"\x00"+username] = password
+}
+
+func (m *MemoryStore) Password(realm, username string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if pw, ok := m.passwords[realm+"\x00"+username]; ok {
+		return pw, nil
+	}
+	if pw, ok := m.passwords["\x00"+username]; ok {
+		return pw, nil
+	}
+	return "", ErrUnknownUser
+}
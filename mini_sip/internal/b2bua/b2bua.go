@@ -0,0 +1,501 @@
+// Package b2bua 实现背靠背用户代理（B2BUA，RFC 3261 §6，RFC 7092）。
+//
+// B2BUA 终结呼入的对话（A 路），再作为 UAC 发起一个独立的对话（B 路），两路的对话各自由协议栈维护：
+//
+//	Alice                    B2BUA                     Bob
+//	 |--INVITE (Call-ID a)--->|                         |
+//	 |<-100 Trying------------|--INVITE (Call-ID b)---->|   新的 Call-ID、From tag、Via 与 Contact
+//	 |<-180 Ringing-----------|<-180 Ringing------------|   To tag 与 Contact 换成 A 路自己的
+//	 |<-200 OK (SDP)----------|<-200 OK (SDP)-----------|   SDP 经 SDPHook 改写后转交
+//	 |--ACK------------------>|--ACK------------------->|
+//	 |--BYE------------------>|--BYE------------------->|
+//	 |<-200 OK----------------|<-200 OK-----------------|
+//
+// 两路之间的映射：
+//   - 拓扑隐藏：两路的 Call-ID、tag、Via、Contact 互不相关，一路的 Via、Record-Route 与 Contact
+//     不会出现在另一路；对话内请求只转交方法与消息体
+//   - CANCEL：A 路取消时取消 B 路的 INVITE；B 路的最终响应（含 487）经正常的响应转交
+//   - BYE：一路挂机时立即以 200 应答并向另一路发送 BYE；一路的会话计时器到期（协议栈发出 BYE）时同样挂断另一路
+//   - re-INVITE、UPDATE、INFO 等对话内请求转为另一路的对话内请求，响应原路转回；
+//     不带 SDP 的 INVITE（迟后 offer）收到 2xx 后推迟 ACK，等发起方的 ACK 带来 answer 再发送
+//
+// 预付费限时、录音等呼叫控制功能建立在 B2BUA 之上：OnAnswer 中启动计时、到期调用 Hangup，
+// SDPHook 把媒体地址改写到媒体中继。
+//
+// B2BUA 依赖协议栈的对话层，不能与 proxy 共用一个协议栈。
+package b2bua
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+// defaultMaxForwards 是 A 路 INVITE 未携带 Max-Forwards 时使用的初值。
+const defaultMaxForwards = 70
+
+// Router 为 A 路的 INVITE 选择 B 路的 Request-URI，code 非 0 时以该状态码拒绝呼叫。
+// B 路 INVITE 的下一跳按 RFC 3263 由 Request-URI 定位。
+type Router func(req *message.Request) (target *message.URI, code int)
+
+// SDPHook 在 from 一路的 SDP（offer 或 answer）转交到另一路之前调用，可以就地修改 sess，
+// 如把媒体地址改写到媒体中继。不是 SDP 的消息体原样转交，不经过它。
+type SDPHook func(c *Call, from *Leg, sess *sdp.Session)
+
+// B2BUA 桥接 A、B 两路对话。
+type B2BUA struct {
+	stack  *stack.Stack
+	route  Router
+	logger *zap.Logger
+
+	// SDP 非 nil 时，两个方向转交的 SDP 都先经它改写
+	SDP SDPHook
+	// OnAnswer 在 B 路接听、2xx 已转交给 A 路后调用
+	OnAnswer func(c *Call)
+	// OnEnd 在呼叫结束（挂机、呼叫失败或被取消）后调用，每个呼叫一次
+	OnEnd func(c *Call)
+
+	mu     sync.Mutex
+	calls  map[string]*Call    // 两路的 Call-ID -> 呼叫
+	relays map[relayKey]*relay // 发往另一路的请求 -> 转交
+}
+
+// Call 是一个桥接的呼叫。
+type Call struct {
+	A       *Leg // 呼入一侧，B2BUA 作为 UAS
+	B       *Leg // 呼出一侧，B2BUA 作为 UAC
+	Created time.Time
+
+	tag string // A 路响应使用的 To tag
+
+	mu         sync.Mutex
+	answered   time.Time
+	ended      time.Time
+	bCancelled bool // B 路 INVITE 已由协议栈取消，与 CANCEL 交叉的 2xx 由协议栈 ACK 并 BYE
+}
+
+// Leg 是呼叫的一路。
+type Leg struct {
+	Name   string // "A" / "B"，用于日志
+	CallID string
+
+	call   *Call
+	invite *message.Request // A 路为收到的 INVITE，B 路为发出的 INVITE（认证等重试后换成重发的请求，受 call.mu 保护）
+	// 以下字段受 call.mu 保护
+	dialog     *dialog.Dialog   // 2xx 之前为 nil
+	ack        *message.Request // 最近一次发往本路的 2xx ACK，2xx 重传时重发
+	pendingACK *message.Request // 迟后 offer：等另一路的 ACK 带来 answer 后才发送的 ACK
+}
+
+// relay 是一个转交到另一路的请求，另一路的响应转回发起方的服务端事务。
+type relay struct {
+	call *Call
+	from *Leg                // 请求的发起方
+	req  *message.Request    // 发起方的请求
+	out  *message.Request    // 发往另一路的请求（认证等重试之前的原始请求）
+	tx   *dialog.Transaction // 发起方的服务端事务；B2BUA 自己发起的请求（挂机的 BYE）为 nil
+}
+
+// relayKey 标识发往另一路的请求。401 / 407 / 422 重试后协议栈以 CSeq 递增的副本回调，
+// 所以按 Call-ID、To tag 与方法匹配，而不是请求本身；To tag 区分分叉后各分支上的 BYE。
+type relayKey struct {
+	callID string
+	toTag  string
+	method message.Method
+}
+
+func keyOf(req *message.Request) relayKey {
+	k := relayKey{callID: req.Headers.Get(message.HeaderCallID), method: req.Method}
+	if to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo)); err == nil {
+		k.toTag = to.Tag
+	}
+	return k
+}
+
+// addRelay 登记发往另一路的请求 out。
+func (b *B2BUA) addRelay(out *message.Request, r *relay) {
+	r.out = out
+	b.mu.Lock()
+	b.relays[keyOf(out)] = r
+	b.mu.Unlock()
+}
+
+// dropRelay 在 out 发送失败时撤销登记。
+func (b *B2BUA) dropRelay(out *message.Request) {
+	b.mu.Lock()
+	delete(b.relays, keyOf(out))
+	b.mu.Unlock()
+}
+
+// New 创建 B2BUA，route 为呼入的 INVITE 选择 B 路目标。
+func New(s *stack.Stack, route Router, logger *zap.Logger) *B2BUA {
+	return &B2BUA{
+		stack:  s,
+		route:  route,
+		logger: logger,
+		calls:  make(map[string]*Call),
+		relays: make(map[relayKey]*relay),
+	}
+}
+
+// Answered 返回 B 路接听的时间，尚未接听时为零值。
+func (c *Call) Answered() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.answered
+}
+
+// Ended 返回呼叫结束的时间，尚未结束时为零值。
+func (c *Call) Ended() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ended
+}
+
+// peer 返回 l 的另一路。
+func (c *Call) peer(l *Leg) *Leg {
+	if l == c.A {
+		return c.B
+	}
+	return c.A
+}
+
+// Dialog 返回本路已建立的对话，2xx 之前为 nil。
+func (l *Leg) Dialog() *dialog.Dialog {
+	l.call.mu.Lock()
+	defer l.call.mu.Unlock()
+	return l.dialog
+}
+
+// HandleRequest 处理请求，tx 为其服务端事务（ACK 为对应的 INVITE 事务或 nil）。
+// 对话外的 INVITE 总是由 B2BUA 处理；返回 false 表示请求不属于任何桥接的呼叫。
+func (b *B2BUA) HandleRequest(req *message.Request, tx *dialog.Transaction) bool {
+	c, leg := b.lookup(req.Headers.Get(message.HeaderCallID))
+	if c == nil {
+		if req.Method != message.MethodINVITE || inDialog(req) || tx == nil {
+			return false
+		}
+		b.newCall(req, tx)
+		return true
+	}
+	switch req.Method {
+	case message.MethodACK:
+		b.forwardACK(c, leg, req)
+	case message.MethodBYE:
+		b.reply(req, tx, message.StatusOK)
+		b.logger.Info("b2bua leg hung up", zap.String("leg", leg.Name), zap.String("callID", leg.CallID))
+		b.terminate(c, leg)
+	default:
+		b.forward(c, leg, req, tx)
+	}
+	return true
+}
+
+// newCall 为呼入的 INVITE 建立呼叫并向 Router 选择的目标发起 B 路 INVITE。
+func (b *B2BUA) newCall(req *message.Request, tx *dialog.Transaction) {
+	b.reply(req, tx, message.StatusTrying)
+
+	maxFwd := defaultMaxForwards
+	if v := req.Headers.Get(message.HeaderMaxForwards); v != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			b.reply(req, tx, message.StatusBadRequest)
+			return
+		}
+		maxFwd = n
+	}
+	if maxFwd == 0 {
+		b.reply(req, tx, message.StatusTooManyHops)
+		return
+	}
+	target, code := b.route(req)
+	if code != 0 {
+		b.reply(req, tx, code)
+		return
+	}
+	invite, err := b.buildInvite(req, target)
+	if err != nil {
+		b.logger.Warn("build b-leg INVITE", zap.Error(err))
+		b.reply(req, tx, message.StatusBadRequest)
+		return
+	}
+	invite.Headers.Set(message.HeaderMaxForwards, strconv.Itoa(maxFwd-1))
+
+	c := &Call{Created: time.Now(), tag: stack.NewTag()}
+	c.A = &Leg{Name: "A", CallID: req.Headers.Get(message.HeaderCallID), call: c, invite: req}
+	c.B = &Leg{Name: "B", CallID: invite.Headers.Get(message.HeaderCallID), call: c, invite: invite}
+	invite.Body = b.relayBody(c, c.A, req.Headers, req.Body, invite.Headers)
+
+	b.mu.Lock()
+	b.calls[c.A.CallID] = c
+	b.calls[c.B.CallID] = c
+	b.mu.Unlock()
+	b.addRelay(invite, &relay{call: c, from: c.A, req: req, tx: tx})
+
+	b.logger.Info("b2bua call started",
+		zap.String("a", c.A.CallID), zap.String("b", c.B.CallID), zap.String("target", target.String()))
+	if err := b.stack.SendRequestURI(invite, nil); err != nil {
+		b.logger.Warn("send b-leg INVITE", zap.Error(err))
+		b.dropRelay(invite)
+		b.reply(req, tx, message.StatusServiceUnavailable)
+		b.terminate(c, c.B)
+		return
+	}
+	go b.watchCancel(c, tx)
+}
+
+// buildInvite 构造 B 路 INVITE：From / To 的 URI 沿用 A 路，其余（Call-ID、tag、Via、Contact）都是新的。
+func (b *B2BUA) buildInvite(req *message.Request, target *message.URI) (*message.Request, error) {
+	from, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
+	if err != nil {
+		return nil, fmt.Errorf("parse From: %w", err)
+	}
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	if err != nil {
+		return nil, fmt.Errorf("parse To: %w", err)
+	}
+	invite, err := b.stack.BuildInviteRequest(from.URI.String(), to.URI.String())
+	if err != nil {
+		return nil, err
+	}
+	invite.RequestURI = target.Clone()
+	return invite, nil
+}
+
+// watchCancel 在 A 路取消 INVITE 时结束呼叫（协议栈已以 487 应答 A 路）。
+func (b *B2BUA) watchCancel(c *Call, tx *dialog.Transaction) {
+	select {
+	case <-tx.Cancelled():
+		b.logger.Info("b2bua call cancelled by caller", zap.String("callID", c.A.CallID))
+		b.terminate(c, c.A)
+	case <-tx.Done():
+	}
+}
+
+// HandleResponse 把 B2BUA 发出的请求的响应转回发起方，返回 false 表示响应不属于任何桥接的呼叫。
+func (b *B2BUA) HandleResponse(resp *message.Response, req *message.Request) bool {
+	if req == nil {
+		return false
+	}
+	key := keyOf(req)
+	b.mu.Lock()
+	r := b.relays[key]
+	if r != nil && resp.StatusCode >= 200 {
+		delete(b.relays, key)
+	}
+	b.mu.Unlock()
+	if r != nil && req != r.out {
+		b.retried(r, req)
+	}
+
+	if r == nil {
+		c, leg := b.lookup(req.Headers.Get(message.HeaderCallID))
+		if c == nil {
+			return false
+		}
+		switch {
+		case req.Method == message.MethodINVITE && isSuccess(resp.StatusCode):
+			b.resendACK(c, leg, resp)
+		case req.Method == message.MethodBYE:
+			// 协议栈在会话到期时发出的 BYE
+			b.terminate(c, leg)
+		}
+		return true
+	}
+	if resp.StatusCode == message.StatusTrying {
+		return true
+	}
+	b.relayResponse(r, resp)
+	return true
+}
+
+// retried 记录协议栈以 req 重发了 r.out（401 / 407 / 422）：B 路的 INVITE 之后按 req 取消。
+func (b *B2BUA) retried(r *relay, req *message.Request) {
+	c := r.call
+	c.mu.Lock()
+	if r.out == c.B.invite {
+		c.B.invite = req
+	}
+	r.out = req
+	c.mu.Unlock()
+}
+
+// HandleError 处理 B2BUA 发出的请求失败：超时视为收到 408，传输错误视为 503。
+// A 路的 INVITE 等不到 ACK（或 PRACK）时挂断整个呼叫。返回 false 表示请求不属于任何桥接的呼叫。
+func (b *B2BUA) HandleError(req *message.Request, err error) bool {
+	key := keyOf(req)
+	b.mu.Lock()
+	r := b.relays[key]
+	delete(b.relays, key)
+	b.mu.Unlock()
+
+	if r == nil {
+		c, leg := b.lookup(req.Headers.Get(message.HeaderCallID))
+		if c == nil {
+			return false
+		}
+		b.logger.Warn("b2bua leg failed", zap.String("leg", leg.Name),
+			zap.String("method", string(req.Method)), zap.Error(err))
+		if req.Method == message.MethodINVITE || req.Method == message.MethodBYE {
+			b.terminate(c, nil)
+		}
+		return true
+	}
+	code := message.StatusServiceUnavailable
+	if errors.Is(err, dialog.ErrTimeout) {
+		code = message.StatusRequestTimeout
+	}
+	b.logger.Info("b2bua request failed",
+		zap.String("method", string(req.Method)), zap.Int("code", code), zap.Error(err))
+	b.relayResponse(r, stack.BuildResponse(req, code, ""))
+	return true
+}
+
+// Hangup 挂断呼叫：已接听时向两路发送 BYE，否则取消 B 路的 INVITE（A 路随后收到 487）。
+func (b *B2BUA) Hangup(c *Call) {
+	b.logger.Info("b2bua hangup", zap.String("callID", c.A.CallID))
+	b.terminate(c, nil)
+}
+
+// answer 在 B 路 INVITE 收到 2xx 时记录 B 路对话，返回 false 表示呼叫已结束、2xx 不再转交。
+func (b *B2BUA) answer(c *Call, resp *message.Response) bool {
+	d := b.stack.ResponseDialog(resp)
+	c.mu.Lock()
+	switch {
+	case !c.ended.IsZero():
+		// 呼叫已结束（A 路取消或 Hangup）：协议栈没能取消 B 路时由 B2BUA 挂断这个迟到的接听
+		hangup := !c.bCancelled
+		c.mu.Unlock()
+		if hangup && d != nil {
+			b.ackAndBye(c, d)
+		}
+		return false
+	case c.B.dialog != nil && d != nil && c.B.dialog.ID != d.ID:
+		// B 路分叉后另一个分支也接听了：只保留第一个
+		c.mu.Unlock()
+		b.logger.Info("b2bua dropping extra answer", zap.String("id", d.ID.String()))
+		b.ackAndBye(c, d)
+		return false
+	case c.B.dialog != nil:
+		c.mu.Unlock()
+		return false
+	}
+	c.B.dialog = d
+	c.mu.Unlock()
+	return d != nil
+}
+
+// answered 在 2xx 转交给 A 路后记录 A 路对话并通知 OnAnswer。
+func (b *B2BUA) answered(c *Call) {
+	from, err := message.ParseAddress(c.A.invite.Headers.Get(message.HeaderFrom))
+	if err != nil {
+		return
+	}
+	d := b.stack.Dialog(dialog.DialogID{CallID: c.A.CallID, LocalTag: c.tag, RemoteTag: from.Tag})
+	c.mu.Lock()
+	c.A.dialog = d
+	c.answered = time.Now()
+	c.mu.Unlock()
+	b.logger.Info("b2bua call answered", zap.String("a", c.A.CallID), zap.String("b", c.B.CallID))
+	if b.OnAnswer != nil {
+		b.OnAnswer(c)
+	}
+}
+
+// ackAndBye 确认并立即挂断一个不再需要的 2xx（RFC 3261 §13.2.2.4）。
+func (b *B2BUA) ackAndBye(c *Call, d *dialog.Dialog) {
+	if err := b.stack.SendInDialog(d.NewRequest(message.MethodACK)); err != nil {
+		b.logger.Warn("send ACK", zap.Error(err))
+	}
+	b.sendBye(c, d)
+}
+
+// terminate 结束呼叫：向 by 以外已接听的一路发送 BYE，B 路尚未接听时取消其 INVITE。
+// by 为主动挂机的一路，Hangup 与失败时为 nil。重复调用无副作用。
+func (b *B2BUA) terminate(c *Call, by *Leg) {
+	c.mu.Lock()
+	if !c.ended.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	c.ended = time.Now()
+	var byes []*dialog.Dialog
+	for _, l := range []*Leg{c.A, c.B} {
+		if l != by && l.dialog != nil && l.dialog.GetState() != dialog.DialogStateTerminated {
+			byes = append(byes, l.dialog)
+		}
+	}
+	if c.B.dialog == nil && by != c.B {
+		// 在 c.mu 内取消，与 answer 中对交叉 2xx 的判断保持一致
+		if tx := b.stack.ClientTransaction(c.B.invite); tx != nil {
+			c.bCancelled = b.stack.Cancel(tx) == nil
+		}
+	}
+	c.mu.Unlock()
+
+	b.mu.Lock()
+	delete(b.calls, c.A.CallID)
+	delete(b.calls, c.B.CallID)
+	b.mu.Unlock()
+
+	for _, d := range byes {
+		b.sendBye(c, d)
+	}
+	b.logger.Info("b2bua call ended", zap.String("a", c.A.CallID), zap.String("b", c.B.CallID))
+	if b.OnEnd != nil {
+		b.OnEnd(c)
+	}
+}
+
+// sendBye 在对话 d 上发送 BYE，其响应由 B2BUA 吸收。
+func (b *B2BUA) sendBye(c *Call, d *dialog.Dialog) {
+	bye := d.NewRequest(message.MethodBYE)
+	b.addRelay(bye, &relay{call: c})
+	if err := b.stack.SendInDialog(bye); err != nil {
+		b.logger.Warn("send BYE", zap.String("id", d.ID.String()), zap.Error(err))
+		b.dropRelay(bye)
+	}
+}
+
+// lookup 按 Call-ID 查找呼叫及其所在的一路。
+func (b *B2BUA) lookup(callID string) (*Call, *Leg) {
+	b.mu.Lock()
+	c := b.calls[callID]
+	b.mu.Unlock()
+	if c == nil {
+		return nil, nil
+	}
+	if callID == c.A.CallID {
+		return c, c.A
+	}
+	return c, c.B
+}
+
+// reply 以 code 应答 tx（ACK 没有响应）。
+func (b *B2BUA) reply(req *message.Request, tx *dialog.Transaction, code int) {
+	if req.Method == message.MethodACK || tx == nil {
+		return
+	}
+	if err := tx.Respond(stack.BuildResponse(req, code, "")); err != nil {
+		b.logger.Warn("send response", zap.Int("code", code), zap.Error(err))
+	}
+}
+
+// inDialog 判断请求是否属于已有对话（To 带 tag）。
+func inDialog(req *message.Request) bool {
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	return err == nil && to.Tag != ""
+}
+
+func isSuccess(code int) bool {
+	return code >= 200 && code < 300
+}
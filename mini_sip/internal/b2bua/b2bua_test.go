@@ -0,0 +1,444 @@
+package b2bua
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+const (
+	aliceSDP = "v=0\r\no=alice 1 1 IN IP4 192.0.2.1\r\ns=-\r\nc=IN IP4 192.0.2.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n"
+	bobSDP   = "v=0\r\no=bob 1 1 IN IP4 192.0.2.2\r\ns=-\r\nc=IN IP4 192.0.2.2\r\nt=0 0\r\nm=audio 5000 RTP/AVP 0\r\n"
+	// relayAddr 是 SDPHook 改写后的媒体地址
+	relayAddr = "198.51.100.1"
+)
+
+// freeAddr 返回 127.0.0.1 上一个 UDP 与 TCP 当前都空闲的端口。
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		if pc, err := net.ListenPacket("udp", addr); err == nil {
+			pc.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+// ua 是回环测试中的用户代理：INVITE 默认以带 SDP 的 200 接听（ring 为 true 时只回 180），
+// 其他请求回 200；收到 INVITE 的 2xx 后发送 ACK。
+type ua struct {
+	s    *stack.Stack
+	addr string
+	sdp  string
+	ring bool
+	// 非 nil 时对 INVITE 要求摘要认证
+	auth *auth.Authenticator
+
+	requests  chan *message.Request
+	responses chan *message.Response
+	invites   chan *dialog.Transaction // 收到的 INVITE 的服务端事务
+	ready     chan struct{}            // 构造完成后关闭，回调在此之前等待
+}
+
+// newUA 启动用户代理，setup 非 nil 时在回调开始之前调整其行为。
+func newUA(t *testing.T, body string, setup func(u *ua), opts ...stack.Option) *ua {
+	t.Helper()
+	u := &ua{
+		sdp:       body,
+		requests:  make(chan *message.Request, 64),
+		responses: make(chan *message.Response, 64),
+		invites:   make(chan *dialog.Transaction, 8),
+		ready:     make(chan struct{}),
+	}
+	s, err := stack.NewStack(freeAddr(t), u, zap.NewNop(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	u.s = s
+	u.addr = s.LocalAddr()
+	if setup != nil {
+		setup(u)
+	}
+	close(u.ready)
+	return u
+}
+
+func (u *ua) OnRequest(req *message.Request, tx *dialog.Transaction) {
+	<-u.ready
+	u.requests <- req
+	switch req.Method {
+	case message.MethodACK:
+	case message.MethodINVITE:
+		if u.auth != nil {
+			if _, err := u.auth.Verify(req, false); err != nil {
+				resp := stack.BuildResponse(req, message.StatusUnauthorized, stack.NewTag())
+				u.auth.Challenge(resp, false, errors.Is(err, auth.ErrStaleNonce))
+				tx.Respond(resp)
+				return
+			}
+		}
+		u.invites <- tx
+		tag := stack.NewTag()
+		if !inDialog(req) && u.ring {
+			tx.Respond(stack.BuildResponse(req, message.StatusRinging, tag))
+			return
+		}
+		resp := stack.BuildResponse(req, message.StatusOK, tag)
+		resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", u.s.ContactURI("sip")))
+		resp.Headers.Set(message.HeaderContentType, "application/sdp")
+		resp.Body = []byte(u.sdp)
+		tx.Respond(resp)
+	default:
+		if tx != nil {
+			tx.Respond(stack.BuildResponse(req, message.StatusOK, ""))
+		}
+	}
+}
+
+func (u *ua) OnResponse(resp *message.Response, req *message.Request) {
+	<-u.ready
+	u.responses <- resp
+	if req == nil || req.Method != message.MethodINVITE || !isSuccess(resp.StatusCode) {
+		return
+	}
+	if d := u.s.ResponseDialog(resp); d != nil {
+		u.s.SendInDialog(d.NewRequest(message.MethodACK))
+	}
+}
+
+func (u *ua) OnError(*message.Request, error) {}
+
+// nextRequest 等待下一个 method 请求，其间收到的其他请求被跳过。
+func (u *ua) nextRequest(t *testing.T, method message.Method) *message.Request {
+	t.Helper()
+	for {
+		select {
+		case req := <-u.requests:
+			if req.Method == method {
+				return req
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", method)
+		}
+	}
+}
+
+// nextResponse 等待下一个 CSeq 方法为 method、状态码不小于 min 的响应。
+func (u *ua) nextResponse(t *testing.T, method message.Method, min int) *message.Response {
+	t.Helper()
+	for {
+		select {
+		case resp := <-u.responses:
+			cseq, err := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq))
+			if err == nil && cseq.Method == string(method) && resp.StatusCode >= min {
+				return resp
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a %s response", method)
+		}
+	}
+}
+
+// bridge 把协议栈回调交给 B2BUA，不属于任何呼叫的请求回 481。
+type bridge struct {
+	b     *B2BUA
+	ready chan struct{}
+}
+
+func (h *bridge) OnRequest(req *message.Request, tx *dialog.Transaction) {
+	<-h.ready
+	if !h.b.HandleRequest(req, tx) && tx != nil && req.Method != message.MethodACK {
+		tx.Respond(stack.BuildResponse(req, message.StatusCallDoesNotExist, ""))
+	}
+}
+
+func (h *bridge) OnResponse(resp *message.Response, req *message.Request) {
+	<-h.ready
+	h.b.HandleResponse(resp, req)
+}
+
+func (h *bridge) OnError(req *message.Request, err error) {
+	<-h.ready
+	h.b.HandleError(req, err)
+}
+
+// testCall 是一个经 B2BUA 桥接的 alice -> bob 呼叫。
+type testCall struct {
+	alice, bob *ua
+	b          *B2BUA
+	addr       string // B2BUA 的地址
+
+	mu    sync.Mutex
+	hooks []string // SDPHook 被调用时的来源一路
+	ended chan *Call
+}
+
+func newTestCall(t *testing.T, bob *ua, opts ...stack.Option) *testCall {
+	t.Helper()
+	tc := &testCall{alice: newUA(t, aliceSDP, nil), bob: bob, ended: make(chan *Call, 1)}
+	h := &bridge{ready: make(chan struct{})}
+	s, err := stack.NewStack(freeAddr(t), h, zap.NewNop(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	tc.addr = s.LocalAddr()
+	target, err := message.ParseURI("sip:bob@" + bob.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.b = New(s, func(*message.Request) (*message.URI, int) { return target, 0 }, zap.NewNop())
+	tc.b.SDP = func(_ *Call, from *Leg, sess *sdp.Session) {
+		tc.mu.Lock()
+		tc.hooks = append(tc.hooks, from.Name)
+		tc.mu.Unlock()
+		sess.Connection = sdp.NewConnection(relayAddr)
+	}
+	tc.b.OnEnd = func(c *Call) { tc.ended <- c }
+	h.b = tc.b
+	close(h.ready)
+	return tc
+}
+
+// invite 由 alice 经 B2BUA 呼叫 bob，返回 alice 发出的 INVITE。
+func (tc *testCall) invite(t *testing.T) *message.Request {
+	t.Helper()
+	req, err := tc.alice.s.BuildInviteRequest("sip:alice@"+tc.alice.addr, "sip:bob@"+tc.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Headers.Set(message.HeaderContentType, "application/sdp")
+	req.Body = []byte(aliceSDP)
+	if err := tc.alice.s.SendRequest(req, tc.addr); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// answered 呼叫建立并双方 ACK 后返回 alice 与 bob 各自的对话。
+func (tc *testCall) answered(t *testing.T) (alice, bob *dialog.Dialog) {
+	t.Helper()
+	tc.invite(t)
+	resp := tc.alice.nextResponse(t, message.MethodINVITE, 200)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", resp.StatusCode)
+	}
+	ack := tc.bob.nextRequest(t, message.MethodACK)
+	if alice = tc.alice.s.ResponseDialog(resp); alice == nil {
+		t.Fatal("alice has no dialog")
+	}
+	if bob = tc.bob.s.RequestDialog(ack); bob == nil {
+		t.Fatal("bob has no dialog")
+	}
+	return alice, bob
+}
+
+func (tc *testCall) waitEnd(t *testing.T) *Call {
+	t.Helper()
+	select {
+	case c := <-tc.ended:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEnd not called")
+		return nil
+	}
+}
+
+func TestBridgedCall(t *testing.T) {
+	tc := newTestCall(t, newUA(t, bobSDP, nil))
+	answered := make(chan *Call, 1)
+	tc.b.OnAnswer = func(c *Call) { answered <- c }
+	invite := tc.invite(t)
+
+	// B 路是独立的对话：新的 Call-ID，A 路的 Via 与 Contact 不会出现
+	out := tc.bob.nextRequest(t, message.MethodINVITE)
+	if out.Headers.Get(message.HeaderCallID) == invite.Headers.Get(message.HeaderCallID) {
+		t.Fatal("B leg reuses the A leg Call-ID")
+	}
+	for _, name := range []string{message.HeaderVia, message.HeaderContact} {
+		if v := out.Headers.Get(name); strings.Contains(v, tc.alice.addr) {
+			t.Fatalf("B leg %s %q exposes alice", name, v)
+		}
+	}
+	if !strings.Contains(string(out.Body), "c=IN IP4 "+relayAddr) {
+		t.Fatalf("B leg offer not rewritten by SDPHook:\n%s", out.Body)
+	}
+
+	resp := tc.alice.nextResponse(t, message.MethodINVITE, 200)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", resp.StatusCode)
+	}
+	if contact := resp.Headers.Get(message.HeaderContact); strings.Contains(contact, tc.bob.addr) {
+		t.Fatalf("2xx Contact %q exposes bob", contact)
+	}
+	if !strings.Contains(string(resp.Body), "c=IN IP4 "+relayAddr) {
+		t.Fatalf("answer not rewritten by SDPHook:\n%s", resp.Body)
+	}
+	tc.bob.nextRequest(t, message.MethodACK)
+	select {
+	case c := <-answered:
+		if c.Answered().IsZero() || c.A.Dialog() == nil || c.B.Dialog() == nil {
+			t.Fatal("answered call without both dialogs")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnAnswer not called")
+	}
+	tc.mu.Lock()
+	hooks := strings.Join(tc.hooks, ",")
+	tc.mu.Unlock()
+	if hooks != "A,B" {
+		t.Fatalf("SDPHook called for %s, want A,B", hooks)
+	}
+}
+
+func TestHangup(t *testing.T) {
+	tests := []struct {
+		name string
+		// byBob 为 true 时由 bob 挂机
+		byBob bool
+	}{
+		{"caller hangs up", false},
+		{"callee hangs up", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := newTestCall(t, newUA(t, bobSDP, nil))
+			alice, bob := tc.answered(t)
+			from, to := tc.alice, tc.bob
+			d := alice
+			if tt.byBob {
+				from, to, d = tc.bob, tc.alice, bob
+			}
+			if err := from.s.SendInDialog(d.NewRequest(message.MethodBYE)); err != nil {
+				t.Fatal(err)
+			}
+			if resp := from.nextResponse(t, message.MethodBYE, 200); resp.StatusCode != message.StatusOK {
+				t.Fatalf("BYE answered with %d", resp.StatusCode)
+			}
+			to.nextRequest(t, message.MethodBYE)
+			if c := tc.waitEnd(t); c.Ended().IsZero() {
+				t.Fatal("ended call without end time")
+			}
+		})
+	}
+}
+
+func TestCancelFromCaller(t *testing.T) {
+	tests := []struct {
+		name string
+		// auth 为 true 时 bob 先以 401 挑战，B 路的 INVITE 由协议栈带凭据重发
+		auth bool
+	}{
+		{"ringing", false},
+		{"ringing after auth retry", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := auth.NewMemoryStore()
+			store.Set("example.com", "alice", "secret")
+			bob := newUA(t, bobSDP, func(u *ua) {
+				u.ring = true
+				if tt.auth {
+					u.auth = auth.NewAuthenticator("example.com", store)
+				}
+			})
+			tc := newTestCall(t, bob, stack.WithCredentials("alice", store))
+			invite := tc.invite(t)
+			var bobTx *dialog.Transaction
+			select {
+			case bobTx = <-bob.invites:
+			case <-time.After(5 * time.Second):
+				t.Fatal("bob did not receive the INVITE")
+			}
+			if resp := tc.alice.nextResponse(t, message.MethodINVITE, 101); resp.StatusCode != message.StatusRinging {
+				t.Fatalf("alice received %d, want 180", resp.StatusCode)
+			}
+
+			tx := tc.alice.s.ClientTransaction(invite)
+			if tx == nil {
+				t.Fatal("no client transaction for the INVITE")
+			}
+			if err := tc.alice.s.Cancel(tx); err != nil {
+				t.Fatal(err)
+			}
+			// A 路取消后 B 路（重试时为重发的 INVITE）也被取消，两路都以 487 结束
+			select {
+			case <-bobTx.Cancelled():
+			case <-time.After(5 * time.Second):
+				t.Fatal("B leg INVITE not cancelled")
+			}
+			if resp := tc.alice.nextResponse(t, message.MethodINVITE, 200); resp.StatusCode != message.StatusRequestTerminated {
+				t.Fatalf("alice's INVITE ended with %d, want 487", resp.StatusCode)
+			}
+			if c := tc.waitEnd(t); !c.Answered().IsZero() {
+				t.Fatal("cancelled call marked answered")
+			}
+		})
+	}
+}
+
+func TestReInviteRelay(t *testing.T) {
+	tc := newTestCall(t, newUA(t, bobSDP, nil))
+	alice, _ := tc.answered(t)
+
+	reinvite := alice.NewRequest(message.MethodINVITE)
+	reinvite.Headers.Set(message.HeaderContentType, "application/sdp")
+	reinvite.Body = []byte(strings.Replace(aliceSDP, "4000", "4002", 1))
+	if err := tc.alice.s.SendInDialog(reinvite); err != nil {
+		t.Fatal(err)
+	}
+	out := tc.bob.nextRequest(t, message.MethodINVITE)
+	if !strings.Contains(string(out.Body), "m=audio 4002") || !strings.Contains(string(out.Body), relayAddr) {
+		t.Fatalf("re-INVITE offer not relayed:\n%s", out.Body)
+	}
+	if resp := tc.alice.nextResponse(t, message.MethodINVITE, 200); resp.StatusCode != message.StatusOK {
+		t.Fatalf("re-INVITE answered with %d", resp.StatusCode)
+	}
+	// B2BUA 以 re-INVITE 的 CSeq 确认 bob 的 2xx
+	ack := tc.bob.nextRequest(t, message.MethodACK)
+	want, _ := message.ParseCSeq(out.Headers.Get(message.HeaderCSeq))
+	if got, err := message.ParseCSeq(ack.Headers.Get(message.HeaderCSeq)); err != nil || got.Seq != want.Seq {
+		t.Fatalf("ACK CSeq = %q, want %d ACK", ack.Headers.Get(message.HeaderCSeq), want.Seq)
+	}
+}
+
+func TestAnswerAfterAuthRetry(t *testing.T) {
+	store := auth.NewMemoryStore()
+	store.Set("example.com", "alice", "secret")
+	bob := newUA(t, bobSDP, func(u *ua) { u.auth = auth.NewAuthenticator("example.com", store) })
+	tc := newTestCall(t, bob, stack.WithCredentials("alice", store))
+	answered := make(chan *Call, 1)
+	tc.b.OnAnswer = func(c *Call) { answered <- c }
+	tc.invite(t)
+
+	// 协议栈带凭据重发 B 路 INVITE，2xx 以重发的请求回调，仍要转交给 A 路
+	if resp := tc.alice.nextResponse(t, message.MethodINVITE, 200); resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", resp.StatusCode)
+	}
+	tc.bob.nextRequest(t, message.MethodACK)
+	select {
+	case <-answered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnAnswer not called")
+	}
+}
@@ -0,0 +1,175 @@
+package b2bua
+
+import (
+	"fmt"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+// 两路之间的转交：
+//
+//   - 请求：在另一路的对话上以 Dialog.NewRequest 构造同方法的请求，只带上消息体
+//   - 响应：以发起方的请求构造响应，沿用状态码、原因短语与消息体；
+//     INVITE 的 1xx / 2xx 换上 B2BUA 自己的 Contact，初始 INVITE 的响应使用 A 路固定的 To tag
+//   - INVITE 的 2xx 由 B2BUA 向应答方 ACK：请求带 offer 时立即发送，
+//     否则（迟后 offer）等发起方的 ACK 带来 answer 后再发送
+
+// forward 把对话内请求转交到另一路。
+func (b *B2BUA) forward(c *Call, from *Leg, req *message.Request, tx *dialog.Transaction) {
+	peer := c.peer(from)
+	d := peer.Dialog()
+	if d == nil {
+		// 另一路的对话尚未建立（如早期对话中的 UPDATE / INFO），无处转交
+		b.reply(req, tx, message.StatusServiceUnavailable)
+		return
+	}
+	if req.Method == message.MethodINVITE {
+		b.reply(req, tx, message.StatusTrying)
+	}
+	out := d.NewRequest(req.Method)
+	out.Body = b.relayBody(c, from, req.Headers, req.Body, out.Headers)
+
+	b.addRelay(out, &relay{call: c, from: from, req: req, tx: tx})
+	if err := b.stack.SendInDialog(out); err != nil {
+		b.logger.Warn("forward in-dialog request",
+			zap.String("method", string(req.Method)), zap.String("to", peer.Name), zap.Error(err))
+		b.dropRelay(out)
+		b.reply(req, tx, message.StatusServiceUnavailable)
+		return
+	}
+	b.logger.Info("b2bua forwarded request",
+		zap.String("method", string(req.Method)), zap.String("from", from.Name), zap.String("to", peer.Name))
+}
+
+// relayResponse 把 r.out（发往另一路的请求）的响应转回发起方。
+func (b *B2BUA) relayResponse(r *relay, resp *message.Response) {
+	if r.tx == nil {
+		return
+	}
+	c := r.call
+	out := r.out
+	peer := c.peer(r.from)
+	initial := r.req == c.A.invite
+	code := resp.StatusCode
+	if out.Method == message.MethodINVITE && isSuccess(code) {
+		if initial && !b.answer(c, resp) {
+			return
+		}
+		b.ackPeer(c, peer, out, resp)
+	}
+
+	tag := ""
+	if initial {
+		tag = c.tag
+	}
+	fwd := stack.BuildResponse(r.req, code, tag)
+	fwd.Reason = resp.Reason
+	if r.req.Method == message.MethodINVITE && code < 300 {
+		fwd.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", b.stack.ContactURI(r.req.RequestURI.Scheme)))
+		if isSuccess(code) {
+			fwd.Headers.Set(message.HeaderAllow, stack.AllowedMethods)
+		}
+	}
+	fwd.Body = b.relayBody(c, peer, resp.Headers, resp.Body, fwd.Headers)
+	if err := r.tx.Respond(fwd); err != nil {
+		// 发起方的事务已结束，如 A 路的 CANCEL 与 B 路的 2xx 交叉
+		b.logger.Info("b2bua response not relayed", zap.Int("code", code), zap.Error(err))
+		if initial && isSuccess(code) {
+			b.terminate(c, r.from)
+		}
+		return
+	}
+	if initial {
+		switch {
+		case code >= 300:
+			b.logger.Info("b2bua call failed", zap.String("callID", c.A.CallID), zap.Int("code", code))
+			b.terminate(c, c.B)
+		case code >= 200:
+			b.answered(c)
+		}
+	}
+}
+
+// ackPeer 确认 leg 对 out（INVITE）的 2xx。out 不带 offer 时 2xx 带的是 offer，
+// ACK 要等发起方的 ACK 带来 answer（见 forwardACK）。
+func (b *B2BUA) ackPeer(c *Call, leg *Leg, out *message.Request, resp *message.Response) {
+	d := b.stack.ResponseDialog(resp)
+	if d == nil {
+		b.logger.Warn("no dialog for 2xx, ACK not sent", zap.String("leg", leg.Name))
+		return
+	}
+	ack := d.NewRequest(message.MethodACK)
+	c.mu.Lock()
+	if len(out.Body) == 0 {
+		leg.pendingACK = ack
+		c.mu.Unlock()
+		return
+	}
+	leg.ack = ack
+	c.mu.Unlock()
+	if err := b.stack.SendInDialog(ack); err != nil {
+		b.logger.Warn("send ACK", zap.String("leg", leg.Name), zap.Error(err))
+	}
+}
+
+// forwardACK 处理 from 一路对 2xx 的 ACK：另一路有推迟的 ACK 时带上其中的 answer 发送，否则吸收。
+func (b *B2BUA) forwardACK(c *Call, from *Leg, ack *message.Request) {
+	peer := c.peer(from)
+	c.mu.Lock()
+	pending := peer.pendingACK
+	peer.pendingACK = nil
+	if pending != nil {
+		peer.ack = pending
+	}
+	c.mu.Unlock()
+	if pending == nil {
+		return
+	}
+	pending.Body = b.relayBody(c, from, ack.Headers, ack.Body, pending.Headers)
+	if err := b.stack.SendInDialog(pending); err != nil {
+		b.logger.Warn("send ACK", zap.String("leg", peer.Name), zap.Error(err))
+	}
+}
+
+// resendACK 处理 leg 的 2xx 重传：重发最近的 ACK；分叉后另一个分支的 2xx 确认后立即挂断。
+func (b *B2BUA) resendACK(c *Call, leg *Leg, resp *message.Response) {
+	d := b.stack.ResponseDialog(resp)
+	c.mu.Lock()
+	ack, cur := leg.ack, leg.dialog
+	c.mu.Unlock()
+	if d != nil && cur != nil && d.ID != cur.ID {
+		b.logger.Info("b2bua dropping extra answer", zap.String("id", d.ID.String()))
+		b.ackAndBye(c, d)
+		return
+	}
+	if ack == nil {
+		return
+	}
+	if err := b.stack.SendInDialog(ack); err != nil {
+		b.logger.Warn("resend ACK", zap.String("leg", leg.Name), zap.Error(err))
+	}
+}
+
+// relayBody 返回从 from 一路转交的消息体并在 dst 中设置 Content-Type。
+// SDP 先经 SDPHook 改写；其他类型的消息体（以及无法解析的 SDP）原样转交。
+func (b *B2BUA) relayBody(c *Call, from *Leg, h *message.Headers, body []byte, dst *message.Headers) []byte {
+	dst.Del(message.HeaderContentType)
+	if len(body) == 0 {
+		return nil
+	}
+	if ct := h.Get(message.HeaderContentType); ct != "" {
+		dst.Set(message.HeaderContentType, ct)
+	}
+	if b.SDP == nil {
+		return body
+	}
+	sess, err := stack.ParseSDP(h, body)
+	if err != nil || sess == nil {
+		return body
+	}
+	b.SDP(c, from, sess)
+	return sess.Marshal()
+}
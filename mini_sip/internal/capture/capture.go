@@ -0,0 +1,164 @@
+// Package capture 把传输层收发的 SIP 消息输出为 pcap 文件或 HEPv3 报文，替代在旁边运行 sngrep。
+//
+//	传输层 ──Capturer──> Capture ──过滤──> PcapWriter（Wireshark 直接打开）
+//	                                   └──> HEPSender（Homer 等 HEPv3 采集端）
+//
+// Capture 实现 transport.Capturer，由 stack.WithCapture 挂到协议栈的全部传输上：
+//
+//   - SetEnabled 在运行中开关抓包，关闭时不解析也不输出
+//   - SetFilter 按方法（响应按 CSeq 的方法）与 Call-ID 过滤，空条件不过滤
+//   - 输出失败只记录日志，不影响收发
+package capture
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+	"go.uber.org/zap"
+)
+
+// Packet 是一条待输出的 SIP 消息，附带解析出的 Call-ID 与方法（无法解析时为空）。
+type Packet struct {
+	*transport.Packet
+	CallID string
+	Method message.Method
+}
+
+// Sink 输出抓到的消息，可能被并发调用。
+type Sink interface {
+	WritePacket(p *Packet) error
+}
+
+// Filter 是抓包的过滤条件。
+type Filter struct {
+	Methods []message.Method // 只抓这些方法的请求及其响应，空为全部
+	CallID  string           // 只抓该 Call-ID 的消息，空为全部
+}
+
+// ParseMethods 解析逗号分隔的方法列表（如 "INVITE,BYE"），大小写不敏感。
+func ParseMethods(s string) []message.Method {
+	var methods []message.Method
+	for _, m := range strings.Split(s, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			methods = append(methods, message.Method(strings.ToUpper(m)))
+		}
+	}
+	return methods
+}
+
+// Capture 按开关与过滤条件把消息交给各个 Sink。
+type Capture struct {
+	logger  *zap.Logger
+	sinks   []Sink
+	enabled atomic.Bool
+
+	mu     sync.RWMutex
+	filter Filter
+}
+
+// New 创建抓包器，初始为开启状态。
+func New(logger *zap.Logger, sinks ...Sink) *Capture {
+	c := &Capture{logger: logger, sinks: sinks}
+	c.enabled.Store(true)
+	return c
+}
+
+// SetEnabled 开启或关闭抓包。
+func (c *Capture) SetEnabled(on bool) {
+	c.enabled.Store(on)
+	c.logger.Info("SIP capture switched", zap.Bool("enabled", on))
+}
+
+// Enabled 返回抓包是否开启。
+func (c *Capture) Enabled() bool {
+	return c.enabled.Load()
+}
+
+// SetFilter 替换过滤条件。
+func (c *Capture) SetFilter(f Filter) {
+	c.mu.Lock()
+	c.filter = f
+	c.mu.Unlock()
+}
+
+// Capture 实现 transport.Capturer。
+func (c *Capture) Capture(tp *transport.Packet) {
+	if !c.enabled.Load() {
+		return
+	}
+	p := &Packet{Packet: tp}
+	switch msg, _ := message.Parse(tp.Data); m := msg.(type) {
+	case *message.Request:
+		p.CallID = m.Headers.Get(message.HeaderCallID)
+		p.Method = m.Method
+	case *message.Response:
+		p.CallID = m.Headers.Get(message.HeaderCallID)
+		if cseq, err := message.ParseCSeq(m.Headers.Get(message.HeaderCSeq)); err == nil {
+			p.Method = message.Method(cseq.Method)
+		}
+	}
+	c.mu.RLock()
+	f := c.filter
+	c.mu.RUnlock()
+	if !f.match(p) {
+		return
+	}
+	for _, sink := range c.sinks {
+		if err := sink.WritePacket(p); err != nil {
+			c.logger.Warn("write captured SIP message", zap.Error(err))
+		}
+	}
+}
+
+func (f *Filter) match(p *Packet) bool {
+	if f.CallID != "" && p.CallID != f.CallID {
+		return false
+	}
+	if len(f.Methods) == 0 {
+		return true
+	}
+	for _, m := range f.Methods {
+		if m == p.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// ipPort 取出地址的 IP 与端口；无法识别的部分为未指定地址与端口 0。
+func ipPort(a net.Addr) (net.IP, uint16) {
+	var (
+		ip   net.IP
+		port uint16
+	)
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, uint16(a.Port)
+	case *net.TCPAddr:
+		ip, port = a.IP, uint16(a.Port)
+	case nil:
+	default:
+		if host, p, err := net.SplitHostPort(a.String()); err == nil {
+			ip = net.ParseIP(host)
+			n, _ := strconv.ParseUint(p, 10, 16)
+			port = uint16(n)
+		}
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	return ip, port
+}
+
+// ipFamily 返回一对地址共同使用的形式：都是 IPv4 时为 4 字节，否则都转换为 16 字节（IPv4 映射地址）。
+func ipFamily(src, dst net.IP) (net.IP, net.IP, bool) {
+	if s4, d4 := src.To4(), dst.To4(); s4 != nil && d4 != nil {
+		return s4, d4, true
+	}
+	return src.To16(), dst.To16(), false
+}
@@ -0,0 +1,190 @@
+package capture
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+	"go.uber.org/zap"
+)
+
+// sipRequest 返回 Call-ID 为 callID 的请求报文。
+func sipRequest(method, callID string) []byte {
+	return []byte(method + " sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:bob@example.com>\r\n" +
+		"Call-ID: " + callID + "\r\n" +
+		"CSeq: 1 " + method + "\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Content-Length: 0\r\n\r\n")
+}
+
+// sipResponse 返回对 method 请求的响应报文。
+func sipResponse(code, method, callID string) []byte {
+	return []byte("SIP/2.0 " + code + " OK\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:bob@example.com>;tag=2\r\n" +
+		"Call-ID: " + callID + "\r\n" +
+		"CSeq: 1 " + method + "\r\n" +
+		"Content-Length: 0\r\n\r\n")
+}
+
+func udpPkt(data []byte) *transport.Packet {
+	return &transport.Packet{
+		Time:    time.Unix(1714557600, 123456789),
+		Network: transport.NetworkUDP,
+		Src:     &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060},
+		Dst:     &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5070},
+		Data:    data,
+	}
+}
+
+// memSink 记录收到的消息。
+type memSink struct {
+	mu      sync.Mutex
+	packets []*Packet
+}
+
+func (s *memSink) WritePacket(p *Packet) error {
+	s.mu.Lock()
+	s.packets = append(s.packets, p)
+	s.mu.Unlock()
+	return nil
+}
+
+// take 返回并清空已记录的消息。
+func (s *memSink) take() []*Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.packets
+	s.packets = nil
+	return out
+}
+
+func TestCaptureParsesPacket(t *testing.T) {
+	sink := &memSink{}
+	c := New(zap.NewNop(), sink)
+	c.Capture(udpPkt(sipRequest("INVITE", "c1")))
+	c.Capture(udpPkt(sipResponse("200", "BYE", "c2")))
+	c.Capture(udpPkt([]byte("\r\n\r\n"))) // keepalive 无法解析，照样输出
+
+	got := sink.take()
+	if len(got) != 3 {
+		t.Fatalf("captured %d packets, want 3", len(got))
+	}
+	want := []struct {
+		callID string
+		method message.Method
+	}{{"c1", message.MethodINVITE}, {"c2", message.MethodBYE}, {"", ""}}
+	for i, w := range want {
+		if got[i].CallID != w.callID || got[i].Method != w.method {
+			t.Errorf("packet %d: Call-ID %q method %q, want %q %q", i, got[i].CallID, got[i].Method, w.callID, w.method)
+		}
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	sink := &memSink{}
+	c := New(zap.NewNop(), sink)
+	if !c.Enabled() {
+		t.Fatal("new capture is disabled")
+	}
+	c.SetEnabled(false)
+	if c.Enabled() {
+		t.Fatal("SetEnabled(false) ignored")
+	}
+	c.Capture(udpPkt(sipRequest("INVITE", "c1")))
+	if n := len(sink.take()); n != 0 {
+		t.Fatalf("disabled capture wrote %d packets", n)
+	}
+	c.SetEnabled(true)
+	c.Capture(udpPkt(sipRequest("INVITE", "c1")))
+	if n := len(sink.take()); n != 1 {
+		t.Fatalf("re-enabled capture wrote %d packets, want 1", n)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	packets := []struct {
+		name string
+		data []byte
+	}{
+		{"INVITE c1", sipRequest("INVITE", "c1")},
+		{"200 INVITE c1", sipResponse("200", "INVITE", "c1")},
+		{"BYE c1", sipRequest("BYE", "c1")},
+		{"200 BYE c1", sipResponse("200", "BYE", "c1")},
+		{"OPTIONS c2", sipRequest("OPTIONS", "c2")},
+		{"200 OPTIONS c2", sipResponse("200", "OPTIONS", "c2")},
+		{"keepalive", []byte("\r\n\r\n")},
+	}
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"none", Filter{}, []string{"INVITE c1", "200 INVITE c1", "BYE c1", "200 BYE c1", "OPTIONS c2", "200 OPTIONS c2", "keepalive"}},
+		// 响应按 CSeq 的方法匹配
+		{"method", Filter{Methods: []message.Method{message.MethodINVITE}}, []string{"INVITE c1", "200 INVITE c1"}},
+		{"methods", Filter{Methods: ParseMethods("invite, options")},
+			[]string{"INVITE c1", "200 INVITE c1", "OPTIONS c2", "200 OPTIONS c2"}},
+		{"call-id", Filter{CallID: "c2"}, []string{"OPTIONS c2", "200 OPTIONS c2"}},
+		{"both", Filter{Methods: []message.Method{message.MethodBYE}, CallID: "c1"}, []string{"BYE c1", "200 BYE c1"}},
+		{"no match", Filter{Methods: []message.Method{message.MethodBYE}, CallID: "c2"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memSink{}
+			c := New(zap.NewNop(), sink)
+			c.SetFilter(tt.filter)
+			names := make(map[string]string) // 报文内容 -> 名称
+			for _, p := range packets {
+				names[string(p.data)] = p.name
+				c.Capture(udpPkt(p.data))
+			}
+			var got []string
+			for _, p := range sink.take() {
+				got = append(got, names[string(p.Data)])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("captured %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMethods(t *testing.T) {
+	got := ParseMethods(" invite,BYE,, Message ")
+	want := []message.Method{message.MethodINVITE, message.MethodBYE, message.MethodMESSAGE}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseMethods = %q, want %q", got, want)
+	}
+	if got := ParseMethods(""); got != nil {
+		t.Errorf("ParseMethods(\"\") = %q", got)
+	}
+}
+
+func TestIPPort(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		ip   string
+		port uint16
+	}{
+		{"udp", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060}, "192.0.2.1", 5060},
+		{"tcp v6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5061}, "2001:db8::1", 5061},
+		{"other", &net.IPAddr{IP: net.ParseIP("192.0.2.9")}, "0.0.0.0", 0},
+		{"nil", nil, "0.0.0.0", 0},
+	}
+	for _, tt := range tests {
+		ip, port := ipPort(tt.addr)
+		if !ip.Equal(net.ParseIP(tt.ip)) || port != tt.port {
+			t.Errorf("%s: ipPort = %s %d, want %s %d", tt.name, ip, port, tt.ip, tt.port)
+		}
+	}
+}
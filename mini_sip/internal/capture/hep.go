@@ -0,0 +1,123 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// HEPv3（Homer Encapsulation Protocol）：报文以 "HEP3" 与总长度开头，之后是一串 chunk，
+// 每个 chunk 为 vendor ID、类型、长度（含 6 字节头部）与值，整数均为大端序。
+// 每条 SIP 消息封装为一个 HEP 报文，经 UDP 发往采集端，Call-ID 作为关联 ID。
+
+// HEP chunk 类型（vendor 0，通用 chunk）
+const (
+	hepIPFamily      = 0x0001
+	hepIPProto       = 0x0002
+	hepIPv4Src       = 0x0003
+	hepIPv4Dst       = 0x0004
+	hepIPv6Src       = 0x0005
+	hepIPv6Dst       = 0x0006
+	hepSrcPort       = 0x0007
+	hepDstPort       = 0x0008
+	hepTimeSec       = 0x0009
+	hepTimeUsec      = 0x000a
+	hepProtoType     = 0x000b
+	hepCaptureID     = 0x000c
+	hepAuthKey       = 0x000e
+	hepPayload       = 0x000f
+	hepCorrelationID = 0x0011
+
+	hepProtoSIP = 1
+	afInet      = 2
+	afInet6     = 10
+	protocolTCP = 6
+
+	hepHeaderLen = 6
+	maxHEPPacket = 65507 // 单个 UDP 报文上限
+)
+
+// HEPSender 把消息封装为 HEPv3 报文发往采集端（如 Homer / heplify-server）。
+type HEPSender struct {
+	conn net.Conn
+
+	// AgentID 是 capture agent ID，采集端据此区分抓包节点
+	AgentID uint32
+	// Password 非空时作为 auth key chunk 发送
+	Password string
+}
+
+// NewHEPSender 创建发往 addr（host:port）的 HEPv3 发送器。
+func NewHEPSender(addr string) (*HEPSender, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial HEP collector %q: %w", addr, err)
+	}
+	return &HEPSender{conn: conn}, nil
+}
+
+func (h *HEPSender) WritePacket(p *Packet) error {
+	pkt := h.encode(p)
+	if len(pkt) > maxHEPPacket {
+		return fmt.Errorf("HEP packet too large: %d bytes", len(pkt))
+	}
+	_, err := h.conn.Write(pkt)
+	return err
+}
+
+// Close 关闭到采集端的套接字。
+func (h *HEPSender) Close() error {
+	return h.conn.Close()
+}
+
+// encode 把消息编码为一个 HEPv3 报文。
+func (h *HEPSender) encode(p *Packet) []byte {
+	srcIP, srcPort := ipPort(p.Src)
+	dstIP, dstPort := ipPort(p.Dst)
+	src, dst, v4 := ipFamily(srcIP, dstIP)
+
+	buf := make([]byte, hepHeaderLen, 128+len(p.Data))
+	copy(buf, "HEP3")
+	if v4 {
+		buf = hepChunk(buf, hepIPFamily, []byte{afInet})
+	} else {
+		buf = hepChunk(buf, hepIPFamily, []byte{afInet6})
+	}
+	proto := byte(protocolTCP) // TCP / TLS / WS 都承载在 TCP 上
+	if p.Network == transport.NetworkUDP {
+		proto = protocolUDP
+	}
+	buf = hepChunk(buf, hepIPProto, []byte{proto})
+	if v4 {
+		buf = hepChunk(buf, hepIPv4Src, src)
+		buf = hepChunk(buf, hepIPv4Dst, dst)
+	} else {
+		buf = hepChunk(buf, hepIPv6Src, src)
+		buf = hepChunk(buf, hepIPv6Dst, dst)
+	}
+	buf = hepChunk(buf, hepSrcPort, binary.BigEndian.AppendUint16(nil, srcPort))
+	buf = hepChunk(buf, hepDstPort, binary.BigEndian.AppendUint16(nil, dstPort))
+	buf = hepChunk(buf, hepTimeSec, binary.BigEndian.AppendUint32(nil, uint32(p.Time.Unix())))
+	buf = hepChunk(buf, hepTimeUsec, binary.BigEndian.AppendUint32(nil, uint32(p.Time.Nanosecond()/1000)))
+	buf = hepChunk(buf, hepProtoType, []byte{hepProtoSIP})
+	buf = hepChunk(buf, hepCaptureID, binary.BigEndian.AppendUint32(nil, h.AgentID))
+	if h.Password != "" {
+		buf = hepChunk(buf, hepAuthKey, []byte(h.Password))
+	}
+	if p.CallID != "" {
+		buf = hepChunk(buf, hepCorrelationID, []byte(p.CallID))
+	}
+	buf = hepChunk(buf, hepPayload, p.Data)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(buf)))
+	return buf
+}
+
+// hepChunk 在 buf 后追加一个 vendor 0 的 chunk。
+func hepChunk(buf []byte, typ uint16, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, typ)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(hepHeaderLen+len(value)))
+	return append(buf, value...)
+}
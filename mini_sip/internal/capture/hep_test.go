@@ -0,0 +1,196 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+	"go.uber.org/zap"
+)
+
+// hepChunkOf 是从 HEP 报文中解析出的一个 chunk。
+type hepChunkOf struct {
+	typ   uint16
+	value []byte
+}
+
+// parseHEP 校验 HEPv3 报文头与每个 chunk 的 vendor、长度，返回全部 chunk。
+func parseHEP(t *testing.T, b []byte) []hepChunkOf {
+	t.Helper()
+	be := binary.BigEndian
+	if len(b) < hepHeaderLen || string(b[:4]) != "HEP3" {
+		t.Fatalf("not a HEPv3 packet: % x", b)
+	}
+	if n := int(be.Uint16(b[4:])); n != len(b) {
+		t.Fatalf("total length %d, packet has %d bytes", n, len(b))
+	}
+	var out []hepChunkOf
+	for b = b[hepHeaderLen:]; len(b) > 0; {
+		if len(b) < hepHeaderLen {
+			t.Fatalf("truncated chunk header: % x", b)
+		}
+		vendor, typ, n := be.Uint16(b[0:]), be.Uint16(b[2:]), int(be.Uint16(b[4:]))
+		if vendor != 0 || n < hepHeaderLen || n > len(b) {
+			t.Fatalf("chunk vendor %d type %d length %d, %d bytes left", vendor, typ, n, len(b))
+		}
+		out = append(out, hepChunkOf{typ: typ, value: b[hepHeaderLen:n]})
+		b = b[n:]
+	}
+	return out
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func TestHEPEncode(t *testing.T) {
+	data := sipRequest("INVITE", "c1")
+	v4src, v4dst := net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()
+	v6src, v6dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	tests := []struct {
+		name     string
+		sender   HEPSender
+		network  string
+		src, dst net.Addr
+		callID   string
+		want     []hepChunkOf
+	}{
+		{"IPv4 UDP", HEPSender{AgentID: 2001}, transport.NetworkUDP,
+			&net.UDPAddr{IP: v4src, Port: 5060}, &net.UDPAddr{IP: v4dst, Port: 5070}, "c1",
+			[]hepChunkOf{
+				{hepIPFamily, []byte{afInet}},
+				{hepIPProto, []byte{protocolUDP}},
+				{hepIPv4Src, v4src},
+				{hepIPv4Dst, v4dst},
+				{hepSrcPort, u16(5060)},
+				{hepDstPort, u16(5070)},
+				{hepTimeSec, u32(1714557600)},
+				{hepTimeUsec, u32(123456)},
+				{hepProtoType, []byte{hepProtoSIP}},
+				{hepCaptureID, u32(2001)},
+				{hepCorrelationID, []byte("c1")},
+				{hepPayload, data},
+			}},
+		// 密码作为 auth key；没有 Call-ID 时不带关联 ID
+		{"IPv6 TCP with password", HEPSender{AgentID: 7, Password: "secret"}, transport.NetworkTCP,
+			&net.TCPAddr{IP: v6src, Port: 40000}, &net.TCPAddr{IP: v6dst, Port: 5060}, "",
+			[]hepChunkOf{
+				{hepIPFamily, []byte{afInet6}},
+				{hepIPProto, []byte{protocolTCP}},
+				{hepIPv6Src, v6src},
+				{hepIPv6Dst, v6dst},
+				{hepSrcPort, u16(40000)},
+				{hepDstPort, u16(5060)},
+				{hepTimeSec, u32(1714557600)},
+				{hepTimeUsec, u32(123456)},
+				{hepProtoType, []byte{hepProtoSIP}},
+				{hepCaptureID, u32(7)},
+				{hepAuthKey, []byte("secret")},
+				{hepPayload, data},
+			}},
+		// 一端为 IPv6 时按 IPv6 编码，IPv4 地址转换为映射地址
+		{"mixed", HEPSender{}, transport.NetworkUDP,
+			&net.UDPAddr{IP: v4src, Port: 5060}, &net.UDPAddr{IP: v6dst, Port: 5070}, "c1",
+			[]hepChunkOf{
+				{hepIPFamily, []byte{afInet6}},
+				{hepIPProto, []byte{protocolUDP}},
+				{hepIPv6Src, net.ParseIP("::ffff:192.0.2.1")},
+				{hepIPv6Dst, v6dst},
+				{hepSrcPort, u16(5060)},
+				{hepDstPort, u16(5070)},
+				{hepTimeSec, u32(1714557600)},
+				{hepTimeUsec, u32(123456)},
+				{hepProtoType, []byte{hepProtoSIP}},
+				{hepCaptureID, u32(0)},
+				{hepCorrelationID, []byte("c1")},
+				{hepPayload, data},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Packet{
+				Packet: &transport.Packet{
+					Time:    time.Unix(1714557600, 123456789),
+					Network: tt.network,
+					Src:     tt.src,
+					Dst:     tt.dst,
+					Data:    data,
+				},
+				CallID: tt.callID,
+			}
+			got := parseHEP(t, tt.sender.encode(p))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d chunks, want %d", len(got), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if got[i].typ != w.typ || !bytes.Equal(got[i].value, w.value) {
+					t.Errorf("chunk %d = type %d % x, want type %d % x", i, got[i].typ, got[i].value, w.typ, w.value)
+				}
+			}
+		})
+	}
+}
+
+func TestHEPSender(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	h, err := NewHEPSender(collector.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.AgentID = 2001
+
+	c := New(zap.NewNop(), h)
+	c.Capture(udpPkt(sipRequest("OPTIONS", "c9")))
+
+	buf := make([]byte, maxHEPPacket)
+	collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := parseHEP(t, buf[:n])
+	var types []uint16
+	values := make(map[uint16][]byte)
+	for _, ch := range chunks {
+		types = append(types, ch.typ)
+		values[ch.typ] = ch.value
+	}
+	// Capture 解析出的 Call-ID 作为关联 ID 发出
+	if string(values[hepCorrelationID]) != "c9" || !bytes.Equal(values[hepPayload], sipRequest("OPTIONS", "c9")) {
+		t.Errorf("correlation %q payload %q", values[hepCorrelationID], values[hepPayload])
+	}
+	if !bytes.Equal(values[hepCaptureID], u32(2001)) {
+		t.Errorf("capture ID % x", values[hepCaptureID])
+	}
+	if !slices.Contains(types, hepIPv4Src) || slices.Contains(types, hepAuthKey) {
+		t.Errorf("chunk types %v", types)
+	}
+
+	if _, err := NewHEPSender("no-port"); err == nil {
+		t.Error("NewHEPSender without a port succeeded")
+	}
+}
+
+func TestHEPPacketTooLarge(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	h, err := NewHEPSender(collector.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.WritePacket(&Packet{Packet: udpPkt(make([]byte, maxHEPPacket))}); err == nil {
+		t.Error("oversized HEP packet was sent")
+	}
+}
@@ -0,0 +1,149 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// pcap 文件（libpcap 格式，微秒时间戳）：链路类型为 LINKTYPE_RAW，每条 SIP 消息前合成
+// IPv4 / IPv6 与 UDP 头部，Wireshark 按端口识别为 SIP。TCP / TLS / WS 上的消息同样写成 UDP 报文，
+// 每条消息一个报文，无需重组；超过 UDP 上限的消息被截断。
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapSnapLen    = 65535
+	linkTypeRaw    = 101
+	ipv4HeaderLen  = 20
+	ipv6HeaderLen  = 40
+	udpHeaderLen   = 8
+	maxUDPPayload  = 65535 - ipv4HeaderLen - udpHeaderLen
+	protocolUDP    = 17
+	defaultHopTTL  = 64
+	pcapRecordSize = 16
+)
+
+// PcapWriter 把消息写成 pcap 文件，可以安全地并发调用。
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// NewPcapWriter 写出 pcap 文件头并返回写入 w 的 PcapWriter。
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // 版本 2.4
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, fmt.Errorf("write pcap header: %w", err)
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// CreatePcap 创建（已存在时清空）pcap 文件。
+func CreatePcap(path string) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create pcap file: %w", err)
+	}
+	pw, err := NewPcapWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pw.c = f
+	return pw, nil
+}
+
+func (pw *PcapWriter) WritePacket(p *Packet) error {
+	pkt := udpPacket(p)
+	rec := make([]byte, pcapRecordSize, pcapRecordSize+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(p.Time.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(p.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	_, err := pw.w.Write(rec)
+	return err
+}
+
+// Close 关闭 CreatePcap 创建的文件，NewPcapWriter 创建的输出不做任何事。
+func (pw *PcapWriter) Close() error {
+	if pw.c == nil {
+		return nil
+	}
+	return pw.c.Close()
+}
+
+// udpPacket 为消息合成 IP 与 UDP 头部，返回完整的 IP 报文。
+func udpPacket(p *Packet) []byte {
+	data := p.Data
+	if len(data) > maxUDPPayload {
+		data = data[:maxUDPPayload]
+	}
+	srcIP, srcPort := ipPort(p.Src)
+	dstIP, dstPort := ipPort(p.Dst)
+	src, dst, v4 := ipFamily(srcIP, dstIP)
+
+	udpLen := udpHeaderLen + len(data)
+	udp := make([]byte, udpLen)
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHeaderLen:], data)
+
+	if v4 {
+		// IPv4 的 UDP 校验和可以为 0（不校验）
+		ip := make([]byte, ipv4HeaderLen, ipv4HeaderLen+udpLen)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HeaderLen+udpLen))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF
+		ip[8] = defaultHopTTL
+		ip[9] = protocolUDP
+		copy(ip[12:], src)
+		copy(ip[16:], dst)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+		return append(ip, udp...)
+	}
+
+	// IPv6 的 UDP 校验和是必需的，按伪首部计算（RFC 8200 §8.1）
+	ip := make([]byte, ipv6HeaderLen, ipv6HeaderLen+udpLen)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+	ip[6] = protocolUDP
+	ip[7] = defaultHopTTL
+	copy(ip[8:], src)
+	copy(ip[24:], dst)
+	var pseudo [8]byte
+	binary.BigEndian.PutUint32(pseudo[0:], uint32(udpLen))
+	pseudo[7] = protocolUDP
+	sum := checksum(checksum(checksum(0, ip[8:40]), pseudo[:]), udp)
+	if sum = ^sum; sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(ip, udp...)
+}
+
+// checksum 在 sum 上累加 b 的 16 位反码和（RFC 1071），返回折叠后的结果。
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
@@ -0,0 +1,235 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+	"go.uber.org/zap"
+)
+
+func TestPcapHeader(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewPcapWriter(&buf); err != nil {
+		t.Fatal(err)
+	}
+	hdr := buf.Bytes()
+	if len(hdr) != 24 {
+		t.Fatalf("global header is %d bytes, want 24", len(hdr))
+	}
+	le := binary.LittleEndian
+	if le.Uint32(hdr[0:]) != 0xa1b2c3d4 || le.Uint16(hdr[4:]) != 2 || le.Uint16(hdr[6:]) != 4 {
+		t.Errorf("magic / version = %x %d.%d", le.Uint32(hdr[0:]), le.Uint16(hdr[4:]), le.Uint16(hdr[6:]))
+	}
+	if le.Uint32(hdr[8:]) != 0 || le.Uint32(hdr[12:]) != 0 {
+		t.Error("thiszone / sigfigs not zero")
+	}
+	if le.Uint32(hdr[16:]) != 65535 || le.Uint32(hdr[20:]) != 101 {
+		t.Errorf("snaplen %d linktype %d, want 65535 101 (RAW)", le.Uint32(hdr[16:]), le.Uint32(hdr[20:]))
+	}
+}
+
+// pcapRecord 是从 pcap 数据中读出的一条记录。
+type pcapRecord struct {
+	sec, usec uint32
+	data      []byte
+}
+
+// readPcap 解析 pcap 文件头之后的全部记录，并检查每条记录的长度字段。
+func readPcap(t *testing.T, b []byte) []pcapRecord {
+	t.Helper()
+	b = b[24:]
+	var out []pcapRecord
+	for len(b) > 0 {
+		if len(b) < 16 {
+			t.Fatalf("truncated record header: %d bytes", len(b))
+		}
+		le := binary.LittleEndian
+		incl, orig := le.Uint32(b[8:]), le.Uint32(b[12:])
+		if incl != orig || int(incl) > len(b)-16 {
+			t.Fatalf("record length incl %d orig %d, %d bytes left", incl, orig, len(b)-16)
+		}
+		out = append(out, pcapRecord{sec: le.Uint32(b[0:]), usec: le.Uint32(b[4:]), data: b[16 : 16+incl]})
+		b = b[16+incl:]
+	}
+	return out
+}
+
+// verify 判断以 sum 为初值累加 b 后的反码和是否为全 1（校验和正确）。
+func verify(sum uint16, b []byte) bool {
+	return checksum(sum, b) == 0xffff
+}
+
+// decodeUDP 解析合成的 IP / UDP 报文，校验 IP 头与 UDP 校验和，返回地址、端口与载荷。
+func decodeUDP(t *testing.T, pkt []byte) (src, dst net.IP, sport, dport uint16, payload []byte) {
+	t.Helper()
+	be := binary.BigEndian
+	var udp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl != 20 || int(be.Uint16(pkt[2:])) != len(pkt) || pkt[9] != 17 || pkt[8] == 0 {
+			t.Fatalf("IPv4 header % x", pkt[:20])
+		}
+		if !verify(0, pkt[:ihl]) {
+			t.Errorf("IPv4 header checksum %04x does not verify", be.Uint16(pkt[10:]))
+		}
+		src, dst, udp = net.IP(pkt[12:16]), net.IP(pkt[16:20]), pkt[ihl:]
+		// IPv4 允许 UDP 校验和为 0（未计算），非 0 时必须正确
+		if sum := be.Uint16(udp[6:]); sum != 0 {
+			var pseudo [12]byte
+			copy(pseudo[0:], src)
+			copy(pseudo[4:], dst)
+			pseudo[9] = 17
+			be.PutUint16(pseudo[10:], uint16(len(udp)))
+			if !verify(checksum(0, pseudo[:]), udp) {
+				t.Errorf("IPv4 UDP checksum %04x does not verify", sum)
+			}
+		}
+	case 6:
+		if int(be.Uint16(pkt[4:])) != len(pkt)-40 || pkt[6] != 17 || pkt[7] == 0 {
+			t.Fatalf("IPv6 header % x", pkt[:40])
+		}
+		src, dst, udp = net.IP(pkt[8:24]), net.IP(pkt[24:40]), pkt[40:]
+		// IPv6 的 UDP 校验和必需：伪首部为源、目的地址、UDP 长度与下一首部
+		var pseudo [8]byte
+		be.PutUint32(pseudo[0:], uint32(len(udp)))
+		pseudo[7] = 17
+		if be.Uint16(udp[6:]) == 0 || !verify(checksum(checksum(0, pkt[8:40]), pseudo[:]), udp) {
+			t.Errorf("IPv6 UDP checksum %04x does not verify", be.Uint16(udp[6:]))
+		}
+	default:
+		t.Fatalf("IP version %d", pkt[0]>>4)
+	}
+	if int(be.Uint16(udp[4:])) != len(udp) {
+		t.Errorf("UDP length %d, packet has %d", be.Uint16(udp[4:]), len(udp))
+	}
+	return src, dst, be.Uint16(udp[0:]), be.Uint16(udp[2:]), udp[8:]
+}
+
+func TestPcapRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  string
+		src, dst net.Addr
+		wantSrc  string
+		wantDst  string
+		ipv4     bool
+	}{
+		{"IPv4 UDP", transport.NetworkUDP, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060},
+			&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5070}, "192.0.2.1", "192.0.2.2", true},
+		{"IPv4 TCP written as UDP", transport.NetworkTCP, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5060}, "10.0.0.1", "10.0.0.2", true},
+		{"IPv6", transport.NetworkUDP, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5060},
+			&net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5070}, "2001:db8::1", "2001:db8::2", false},
+		// 一端为 IPv6 时 IPv4 地址转换为映射地址
+		{"mixed", transport.NetworkUDP, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060},
+			&net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5070}, "::ffff:192.0.2.1", "2001:db8::2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			pw, err := NewPcapWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 奇数长度的载荷覆盖校验和的末字节补零
+			data := append(sipRequest("INVITE", "c1"), 'x')
+			p := &Packet{Packet: &transport.Packet{
+				Time:    time.Unix(1714557600, 123456789),
+				Network: tt.network,
+				Src:     tt.src,
+				Dst:     tt.dst,
+				Data:    data,
+			}}
+			if err := pw.WritePacket(p); err != nil {
+				t.Fatal(err)
+			}
+			recs := readPcap(t, buf.Bytes())
+			if len(recs) != 1 {
+				t.Fatalf("got %d records", len(recs))
+			}
+			if recs[0].sec != 1714557600 || recs[0].usec != 123456 {
+				t.Errorf("timestamp %d.%06d", recs[0].sec, recs[0].usec)
+			}
+			if v4 := recs[0].data[0]>>4 == 4; v4 != tt.ipv4 {
+				t.Fatalf("IP version %d", recs[0].data[0]>>4)
+			}
+			src, dst, sport, dport, payload := decodeUDP(t, recs[0].data)
+			if !src.Equal(net.ParseIP(tt.wantSrc)) || !dst.Equal(net.ParseIP(tt.wantDst)) {
+				t.Errorf("addresses %s -> %s, want %s -> %s", src, dst, tt.wantSrc, tt.wantDst)
+			}
+			_, wantSport := ipPort(tt.src)
+			_, wantDport := ipPort(tt.dst)
+			if sport != wantSport || dport != wantDport {
+				t.Errorf("ports %d -> %d, want %d -> %d", sport, dport, wantSport, wantDport)
+			}
+			if !bytes.Equal(payload, data) {
+				t.Errorf("payload = %q", payload)
+			}
+		})
+	}
+}
+
+func TestPcapTruncatesLargeMessage(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Packet{Packet: udpPkt(bytes.Repeat([]byte("a"), 70000))}
+	if err := pw.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	recs := readPcap(t, buf.Bytes())
+	if len(recs) != 1 || len(recs[0].data) != 65535 {
+		t.Fatalf("record of %d bytes, want 65535", len(recs[0].data))
+	}
+	if _, _, _, _, payload := decodeUDP(t, recs[0].data); len(payload) != maxUDPPayload {
+		t.Errorf("payload %d bytes, want %d", len(payload), maxUDPPayload)
+	}
+}
+
+func TestCreatePcap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sip.pcap")
+	pw, err := CreatePcap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(zap.NewNop(), pw)
+	c.Capture(udpPkt(sipRequest("OPTIONS", "c1")))
+	c.Capture(udpPkt(sipResponse("200", "OPTIONS", "c1")))
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recs := readPcap(t, data); len(recs) != 2 {
+		t.Errorf("file has %d records, want 2", len(recs))
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// RFC 1071 §3 的示例数据，奇数长度时末字节按高位补零
+	tests := []struct {
+		data []byte
+		want uint16
+	}{
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0xddf2},
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7, 0x01}, 0xdef2},
+		{[]byte{0xff, 0xff, 0x00, 0x01}, 0x0001},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		if got := checksum(0, tt.data); got != tt.want {
+			t.Errorf("checksum(% x) = %04x, want %04x", tt.data, got, tt.want)
+		}
+	}
+}
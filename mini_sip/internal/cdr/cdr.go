@@ -0,0 +1,81 @@
+// Package cdr 定义呼叫详细记录（CDR，Call Detail Record）及其输出。
+//
+// 协议栈为每个 INVITE 对话（本端发起或收到的初始 INVITE）生成一条记录，
+// 呼叫结束（BYE、失败的最终响应、超时）时交给 stack.CDRSink：
+//
+//	INVITE ──> 1xx ──> 2xx ──────────> BYE
+//	  │         │       │                │
+//	InviteTime RingTime AnswerTime     EndTime     Duration = EndTime - AnswerTime
+//
+// 失败的呼叫同样有记录：Status 为最终错误码，AnswerTime 为零值、Duration 为 0。
+// JSONLSink 与 CSVSink 把记录写成 JSON Lines 与 CSV 文件。
+package cdr
+
+import (
+	"strconv"
+	"time"
+)
+
+// 挂机方（Record.Disconnect）
+const (
+	PartyCaller = "caller" // 主叫挂机或取消
+	PartyCallee = "callee" // 被叫挂机或拒绝
+	PartySystem = "system" // 协议栈结束呼叫：超时、会话到期、协议栈停止
+)
+
+// 呼叫方向（Record.Direction）
+const (
+	DirectionOutbound = "outbound" // 本端发起（UAC）
+	DirectionInbound  = "inbound"  // 对端发起（UAS）
+)
+
+// timeLayout 是记录中时间的格式（RFC 3339，毫秒精度）。
+const timeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Record 是一条呼叫详细记录。
+type Record struct {
+	CallID     string
+	Direction  string
+	From       string // 主叫 URI
+	To         string // 被叫 URI
+	InviteTime time.Time
+	RingTime   time.Time // 第一个 1xx（100 Trying 除外），没有振铃时为零值
+	AnswerTime time.Time // 2xx，未接通时为零值
+	EndTime    time.Time
+	// Status 是 INVITE 的最终状态码：接通为 2xx，失败为最终错误码（超时 408，传输错误 503）
+	Status     int
+	Reason     string
+	Disconnect string        // 挂机方
+	Duration   time.Duration // 通话时长，未接通时为 0
+}
+
+// Answered 判断呼叫是否接通。
+func (r *Record) Answered() bool {
+	return !r.AnswerTime.IsZero()
+}
+
+// columns 是 CSV 的列名，与 fields 的顺序一致。
+var columns = []string{
+	"call_id", "direction", "from", "to", "invite_time", "ring_time", "answer_time", "end_time",
+	"status", "reason", "disconnect", "duration",
+}
+
+// fields 把记录格式化为 CSV 的一行：时间为 RFC 3339（零值为空），时长为秒。
+func (r *Record) fields() []string {
+	return []string{
+		r.CallID, r.Direction, r.From, r.To,
+		formatTime(r.InviteTime), formatTime(r.RingTime), formatTime(r.AnswerTime), formatTime(r.EndTime),
+		strconv.Itoa(r.Status), r.Reason, r.Disconnect, formatDuration(r.Duration),
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(timeLayout)
+}
+
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
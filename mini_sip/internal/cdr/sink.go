@@ -0,0 +1,141 @@
+package cdr
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonRecord 是 Record 的 JSON 形式：零值时间省略，时长为秒。
+type jsonRecord struct {
+	CallID     string  `json:"call_id"`
+	Direction  string  `json:"direction"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	InviteTime string  `json:"invite_time"`
+	RingTime   string  `json:"ring_time,omitempty"`
+	AnswerTime string  `json:"answer_time,omitempty"`
+	EndTime    string  `json:"end_time"`
+	Status     int     `json:"status"`
+	Reason     string  `json:"reason,omitempty"`
+	Disconnect string  `json:"disconnect"`
+	Duration   float64 `json:"duration"`
+}
+
+// JSONLSink 把每条记录写成一行 JSON（JSON Lines），可以安全地并发调用。
+type JSONLSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	c   io.Closer
+}
+
+// NewJSONLSink 创建写入 w 的 JSON Lines 输出。
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	s := &JSONLSink{enc: json.NewEncoder(w)}
+	s.enc.SetEscapeHTML(false)
+	return s
+}
+
+// OpenJSONL 以追加方式打开（不存在时创建）JSON Lines 文件。
+func OpenJSONL(path string) (*JSONLSink, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	s := NewJSONLSink(f)
+	s.c = f
+	return s, nil
+}
+
+func (s *JSONLSink) WriteCDR(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(jsonRecord{
+		CallID:     r.CallID,
+		Direction:  r.Direction,
+		From:       r.From,
+		To:         r.To,
+		InviteTime: formatTime(r.InviteTime),
+		RingTime:   formatTime(r.RingTime),
+		AnswerTime: formatTime(r.AnswerTime),
+		EndTime:    formatTime(r.EndTime),
+		Status:     r.Status,
+		Reason:     r.Reason,
+		Disconnect: r.Disconnect,
+		Duration:   float64(r.Duration.Round(time.Millisecond)) / float64(time.Second),
+	})
+}
+
+// Close 关闭 OpenJSONL 打开的文件，NewJSONLSink 创建的输出不做任何事。
+func (s *JSONLSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+// CSVSink 把记录写成 CSV，第一行为列名，可以安全地并发调用。
+type CSVSink struct {
+	mu     sync.Mutex
+	w      *csv.Writer
+	c      io.Closer
+	header bool // 列名已写出
+}
+
+// NewCSVSink 创建写入 w 的 CSV 输出，列名在第一条记录之前写出。
+func NewCSVSink(w io.Writer) *CSVSink {
+	return &CSVSink{w: csv.NewWriter(w)}
+}
+
+// OpenCSV 以追加方式打开（不存在时创建）CSV 文件，文件非空时不再重复写列名。
+func OpenCSV(path string) (*CSVSink, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat %s: %w", path, err)
+	}
+	s := NewCSVSink(f)
+	s.c = f
+	s.header = info.Size() > 0
+	return s, nil
+}
+
+func (s *CSVSink) WriteCDR(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.header {
+		if err := s.w.Write(columns); err != nil {
+			return err
+		}
+		s.header = true
+	}
+	if err := s.w.Write(r.fields()); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// Close 关闭 OpenCSV 打开的文件，NewCSVSink 创建的输出不做任何事。
+func (s *CSVSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+func openAppend(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open CDR file: %w", err)
+	}
+	return f, nil
+}
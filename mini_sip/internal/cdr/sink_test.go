@@ -0,0 +1,163 @@
+package cdr
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answered 是一条接通后由主叫挂机的记录。
+func answered() *Record {
+	invite := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	return &Record{
+		CallID:     "a84b4c76e66710@pc33",
+		Direction:  DirectionOutbound,
+		From:       "sip:alice@example.com",
+		To:         "sip:bob@example.com",
+		InviteTime: invite,
+		RingTime:   invite.Add(500 * time.Millisecond),
+		AnswerTime: invite.Add(3 * time.Second),
+		EndTime:    invite.Add(65*time.Second + 250*time.Millisecond),
+		Status:     200,
+		Reason:     "OK",
+		Disconnect: PartyCaller,
+		Duration:   62*time.Second + 250*time.Millisecond,
+	}
+}
+
+// rejected 是一条被叫忙的记录：没有振铃与接通时间。
+func rejected() *Record {
+	invite := time.Date(2024, 5, 1, 10, 5, 0, 0, time.FixedZone("CST", 8*3600))
+	return &Record{
+		CallID:     "b1@pc33",
+		Direction:  DirectionInbound,
+		From:       "sip:carol@example.com",
+		To:         "sip:alice@example.com",
+		InviteTime: invite,
+		EndTime:    invite.Add(time.Second),
+		Status:     486,
+		Reason:     "Busy Here",
+		Disconnect: PartyCallee,
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewJSONLSink(&buf)
+	for _, r := range []*Record{answered(), rejected()} {
+		if err := s.WriteCDR(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `{"call_id":"a84b4c76e66710@pc33","direction":"outbound","from":"sip:alice@example.com","to":"sip:bob@example.com",` +
+		`"invite_time":"2024-05-01T10:00:00.000Z","ring_time":"2024-05-01T10:00:00.500Z","answer_time":"2024-05-01T10:00:03.000Z",` +
+		`"end_time":"2024-05-01T10:01:05.250Z","status":200,"reason":"OK","disconnect":"caller","duration":62.25}` + "\n" +
+		// 零值的振铃、接通时间省略
+		`{"call_id":"b1@pc33","direction":"inbound","from":"sip:carol@example.com","to":"sip:alice@example.com",` +
+		`"invite_time":"2024-05-01T10:05:00.000+08:00","end_time":"2024-05-01T10:05:01.000+08:00",` +
+		`"status":486,"reason":"Busy Here","disconnect":"callee","duration":0}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("JSON Lines =\n%s\nwant\n%s", got, want)
+	}
+	for i, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("line %d is not valid JSON: %s", i+1, line)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close of a writer sink = %v", err)
+	}
+}
+
+func TestCSVSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewCSVSink(&buf)
+	r := answered()
+	r.Reason = `Call "completed", elsewhere` // 需要引号转义
+	for _, rec := range []*Record{r, rejected()} {
+		if err := s.WriteCDR(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		columns,
+		{"a84b4c76e66710@pc33", "outbound", "sip:alice@example.com", "sip:bob@example.com",
+			"2024-05-01T10:00:00.000Z", "2024-05-01T10:00:00.500Z", "2024-05-01T10:00:03.000Z", "2024-05-01T10:01:05.250Z",
+			"200", `Call "completed", elsewhere`, "caller", "62.250"},
+		{"b1@pc33", "inbound", "sip:carol@example.com", "sip:alice@example.com",
+			"2024-05-01T10:05:00.000+08:00", "", "", "2024-05-01T10:05:01.000+08:00",
+			"486", "Busy Here", "callee", "0.000"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d:\n%q", len(rows), len(want), rows)
+	}
+	for i := range want {
+		if !slices.Equal(rows[i], want[i]) {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestOpenAppends(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "cdr.csv")
+	jsonPath := filepath.Join(dir, "cdr.jsonl")
+
+	// 两次打开同一文件：记录追加在后，CSV 列名只写一次
+	for i := 0; i < 2; i++ {
+		c, err := OpenCSV(csvPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := OpenJSONL(jsonPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteCDR(answered()); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.WriteCDR(answered()); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || !slices.Equal(rows[0], columns) || rows[1][0] != rows[2][0] || rows[2][0] == columns[0] {
+		t.Errorf("appended CSV = %q", rows)
+	}
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("appended JSON Lines has %d lines, want 2", len(lines))
+	}
+
+	if _, err := OpenCSV(filepath.Join(dir, "missing", "cdr.csv")); err == nil {
+		t.Error("OpenCSV in a missing directory succeeded")
+	}
+}
@@ -0,0 +1,245 @@
+package dialog
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// NewClientTransaction 创建客户端事务（RFC 3261 §17.1），调用 Start 后开始发送。
+//
+// opts.Send 必须非空：首次发送、Timer A/E 重传以及非 2xx 的 ACK 都通过它交给传输层。
+func NewClientTransaction(req *message.Request, opts TxOptions, logger *zap.Logger) (*Transaction, error) {
+	if req.Method == message.MethodACK {
+		return nil, fmt.Errorf("ACK does not create a client transaction")
+	}
+	if opts.Send == nil {
+		return nil, fmt.Errorf("client transaction requires a Send function")
+	}
+	tx, err := newTransaction(req, opts, logger)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != message.MethodINVITE {
+		tx.State = TxStateTrying
+	}
+	return tx, nil
+}
+
+// Start 发送请求并启动超时 / 重传计时器。
+//
+//   - INVITE：Timer A（仅 UDP）从 T1 开始每次翻倍；Timer B = 64*T1
+//   - 非 INVITE：Timer E（仅 UDP）从 T1 开始翻倍直到 T2；Timer F = 64*T1
+//
+// 首次发送失败时事务直接终止并返回错误（不会再回调 OnTimeout）。
+func (tx *Transaction) Start() error {
+	tx.mu.Lock()
+	data := []byte(tx.Request.String())
+	if err := tx.opts.Send(data); err != nil {
+		tx.terminateLocked()
+		tx.mu.Unlock()
+		tx.notifyTerminated(nil)
+		return fmt.Errorf("%w: %v", ErrTransport, err)
+	}
+
+	t1 := tx.opts.Timers.t1()
+	tx.interval = t1
+	if tx.Method == message.MethodINVITE {
+		if !tx.opts.Reliable {
+			tx.startTimerLocked(timerA, t1, tx.onTimerA)
+		}
+		tx.startTimerLocked(timerB, 64*t1, tx.onTimerB)
+	} else {
+		if !tx.opts.Reliable {
+			tx.startTimerLocked(timerE, t1, tx.onTimerE)
+		}
+		tx.startTimerLocked(timerF, 64*t1, tx.onTimerF)
+	}
+	tx.mu.Unlock()
+	return nil
+}
+
+// HandleResponse 将响应送入客户端事务状态机。
+// 返回 true 表示应将响应交给 TU；false 表示被事务层吸收（重传的最终响应等）。
+func (tx *Transaction) HandleResponse(resp *message.Response) bool {
+	if tx.Method == message.MethodINVITE {
+		return tx.handleInviteResponse(resp)
+	}
+	return tx.handleNonInviteResponse(resp)
+}
+
+// handleInviteResponse 客户端 INVITE 事务（RFC 3261 §17.1.1.2，RFC 6026 §7.2）。
+func (tx *Transaction) handleInviteResponse(resp *message.Response) bool {
+	tx.mu.Lock()
+	code := resp.StatusCode
+	var terminated bool
+
+	switch tx.State {
+	case TxStateCalling, TxStateProceeding:
+		tx.Responses = append(tx.Responses, resp)
+		tx.stopTimerLocked(timerA)
+		switch {
+		case code < 200:
+			// 收到临时响应后不再重传，Timer B 仅在 Calling 状态生效
+			tx.stopTimerLocked(timerB)
+			tx.State = TxStateProceeding
+			tx.logger.Info("tx provisional response",
+				zap.String("id", tx.ID), zap.Int("code", code))
+		case code < 300:
+			tx.stopTimerLocked(timerB)
+			tx.State = TxStateAccepted
+			tx.startTimerLocked(timerM, 64*tx.opts.Timers.t1(), tx.onTimerM)
+			tx.logger.Info("tx final response",
+				zap.String("id", tx.ID), zap.Int("code", code))
+		default:
+			tx.stopTimerLocked(timerB)
+			tx.State = TxStateCompleted
+			tx.ack = []byte(buildNon2xxACK(tx.Request, resp).String())
+			if err := tx.opts.Send(tx.ack); err != nil {
+				tx.logger.Warn("send ACK failed", zap.String("id", tx.ID), zap.Error(err))
+			}
+			tx.logger.Info("tx final response",
+				zap.String("id", tx.ID), zap.Int("code", code))
+			d := tx.opts.Timers.timerD(tx.opts.Reliable)
+			if d == 0 {
+				terminated = tx.terminateLocked()
+			} else {
+				tx.startTimerLocked(timerD, d, tx.onTimerD)
+			}
+		}
+		tx.mu.Unlock()
+		if terminated {
+			tx.notifyTerminated(nil)
+		}
+		return true
+
+	case TxStateAccepted:
+		// 2xx 重传直接交给 TU（由 TU 重发 ACK）
+		tx.mu.Unlock()
+		return code >= 200 && code < 300
+
+	case TxStateCompleted:
+		// 非 2xx 最终响应重传：事务层重发 ACK，不上交
+		if code >= 300 && tx.ack != nil {
+			if err := tx.opts.Send(tx.ack); err != nil {
+				tx.logger.Warn("resend ACK failed", zap.String("id", tx.ID), zap.Error(err))
+			}
+		}
+		tx.mu.Unlock()
+		return false
+	}
+	tx.mu.Unlock()
+	return false
+}
+
+// handleNonInviteResponse 客户端非 INVITE 事务（RFC 3261 §17.1.2.2）。
+func (tx *Transaction) handleNonInviteResponse(resp *message.Response) bool {
+	tx.mu.Lock()
+	code := resp.StatusCode
+	var terminated bool
+
+	switch tx.State {
+	case TxStateTrying, TxStateProceeding:
+		tx.Responses = append(tx.Responses, resp)
+		if code < 200 {
+			tx.State = TxStateProceeding
+			tx.logger.Info("tx provisional response",
+				zap.String("id", tx.ID), zap.Int("code", code))
+			tx.mu.Unlock()
+			return true
+		}
+		tx.stopTimerLocked(timerE)
+		tx.stopTimerLocked(timerF)
+		tx.State = TxStateCompleted
+		tx.logger.Info("tx final response",
+			zap.String("id", tx.ID), zap.Int("code", code))
+		d := tx.opts.Timers.timerK(tx.opts.Reliable)
+		if d == 0 {
+			terminated = tx.terminateLocked()
+		} else {
+			tx.startTimerLocked(timerK, d, tx.onTimerK)
+		}
+		tx.mu.Unlock()
+		if terminated {
+			tx.notifyTerminated(nil)
+		}
+		return true
+	}
+	// Completed：吸收最终响应重传
+	tx.mu.Unlock()
+	return false
+}
+
+// ---- 计时器回调 ----
+
+func (tx *Transaction) onTimerA() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.State != TxStateCalling {
+		return
+	}
+	tx.retransmitLocked()
+	tx.interval *= 2
+	tx.startTimerLocked(timerA, tx.interval, tx.onTimerA)
+}
+
+func (tx *Transaction) onTimerE() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.State != TxStateTrying && tx.State != TxStateProceeding {
+		return
+	}
+	tx.retransmitLocked()
+	// Trying：min(2*interval, T2)；Proceeding：固定 T2
+	t2 := tx.opts.Timers.t2()
+	if tx.State == TxStateProceeding {
+		tx.interval = t2
+	} else if tx.interval *= 2; tx.interval > t2 {
+		tx.interval = t2
+	}
+	tx.startTimerLocked(timerE, tx.interval, tx.onTimerE)
+}
+
+func (tx *Transaction) onTimerB() { tx.timeout(timerB, TxStateCalling) }
+
+func (tx *Transaction) onTimerF() { tx.timeout(timerF, TxStateTrying, TxStateProceeding) }
+
+func (tx *Transaction) onTimerD() { tx.expire(timerD, TxStateCompleted) }
+
+func (tx *Transaction) onTimerK() { tx.expire(timerK, TxStateCompleted) }
+
+func (tx *Transaction) onTimerM() { tx.expire(timerM, TxStateAccepted) }
+
+// retransmitLocked 重传原始请求，传输错误时交由超时计时器兜底。
+func (tx *Transaction) retransmitLocked() {
+	if err := tx.opts.Send([]byte(tx.Request.String())); err != nil {
+		tx.logger.Warn("retransmit failed", zap.String("id", tx.ID), zap.Error(err))
+		return
+	}
+	tx.logger.Debug("tx retransmit", zap.String("id", tx.ID), zap.Duration("interval", tx.interval))
+}
+
+// buildNon2xxACK 为非 2xx 最终响应构造 ACK（RFC 3261 §17.1.1.3）。
+//
+// 该 ACK 属于 INVITE 事务本身：
+//   - Request-URI、Call-ID、From、Route 与原 INVITE 相同
+//   - Via 只保留原 INVITE 的顶层 Via（branch 相同）
+//   - To 取自响应（带 tag）
+//   - CSeq 序号与 INVITE 相同，方法为 ACK
+func buildNon2xxACK(invite *message.Request, resp *message.Response) *message.Request {
+	ack := message.NewRequest(message.MethodACK, invite.RequestURI)
+	ack.Headers.Set(message.HeaderVia, invite.Headers.Get(message.HeaderVia))
+	ack.Headers.Set(message.HeaderMaxForwards, "70")
+	ack.Headers.Set(message.HeaderFrom, invite.Headers.Get(message.HeaderFrom))
+	ack.Headers.Set(message.HeaderTo, resp.Headers.Get(message.HeaderTo))
+	ack.Headers.Set(message.HeaderCallID, invite.Headers.Get(message.HeaderCallID))
+	if cseq, err := message.ParseCSeq(invite.Headers.Get(message.HeaderCSeq)); err == nil {
+		ack.Headers.Set(message.HeaderCSeq, strconv.FormatUint(uint64(cseq.Seq), 10)+" ACK")
+	}
+	for _, r := range invite.Headers.GetAll("Route") {
+		ack.Headers.Add("Route", r)
+	}
+	return ack
+}
@@ -0,0 +1,345 @@
+package dialog
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// wire 记录事务交给传输层的消息及其发送时刻（相对 epoch）。
+type wire struct {
+	mu    sync.Mutex
+	clock *ManualClock
+	at    []time.Duration
+	sent  []string
+}
+
+func (w *wire) send(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.at = append(w.at, w.clock.Now().Sub(epoch))
+	w.sent = append(w.sent, string(data))
+	return nil
+}
+
+func (w *wire) times() []time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]time.Duration(nil), w.at...)
+}
+
+func (w *wire) last() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.sent) == 0 {
+		return ""
+	}
+	return w.sent[len(w.sent)-1]
+}
+
+func (w *wire) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.sent)
+}
+
+// outcome 记录 OnTimeout / OnTerminate 回调。
+type outcome struct {
+	mu         sync.Mutex
+	err        error
+	terminated int
+}
+
+func (o *outcome) onTimeout(_ *Transaction, err error) {
+	o.mu.Lock()
+	o.err = err
+	o.mu.Unlock()
+}
+
+func (o *outcome) onTerminate(*Transaction) {
+	o.mu.Lock()
+	o.terminated++
+	o.mu.Unlock()
+}
+
+func (o *outcome) get() (error, int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err, o.terminated
+}
+
+// txHarness 用 ManualClock 驱动的事务测试环境。
+type txHarness struct {
+	clock *ManualClock
+	wire  *wire
+	out   *outcome
+}
+
+func newHarness() *txHarness {
+	clock := NewManualClock(epoch)
+	return &txHarness{clock: clock, wire: &wire{clock: clock}, out: &outcome{}}
+}
+
+func (h *txHarness) options(reliable bool) TxOptions {
+	return TxOptions{
+		Reliable:    reliable,
+		Clock:       h.clock,
+		Send:        h.wire.send,
+		OnTimeout:   h.out.onTimeout,
+		OnTerminate: h.out.onTerminate,
+	}
+}
+
+func newTestRequest(t *testing.T, method message.Method) *message.Request {
+	t.Helper()
+	req := message.NewRequest(method, &message.URI{Scheme: "sip", User: "bob", Host: "example.com"})
+	req.Headers.Set(message.HeaderVia, "SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bKtx1")
+	req.Headers.Set(message.HeaderMaxForwards, "70")
+	req.Headers.Set(message.HeaderFrom, "<sip:alice@example.com>;tag=a1")
+	req.Headers.Set(message.HeaderTo, "<sip:bob@example.com>")
+	req.Headers.Set(message.HeaderCallID, "tx-test@192.0.2.1")
+	req.Headers.Set(message.HeaderCSeq, "1 "+string(method))
+	return req
+}
+
+func newTestResponse(req *message.Request, code int) *message.Response {
+	resp := message.NewResponse(code)
+	for _, name := range []string{message.HeaderVia, message.HeaderFrom, message.HeaderCallID, message.HeaderCSeq} {
+		resp.Headers.Set(name, req.Headers.Get(name))
+	}
+	to := req.Headers.Get(message.HeaderTo)
+	if code > 100 {
+		to += ";tag=b1"
+	}
+	resp.Headers.Set(message.HeaderTo, to)
+	return resp
+}
+
+func seconds(v ...float64) []time.Duration {
+	out := make([]time.Duration, len(v))
+	for i, s := range v {
+		out[i] = time.Duration(s * float64(time.Second))
+	}
+	return out
+}
+
+func equalTimes(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func startClient(t *testing.T, h *txHarness, method message.Method, reliable bool) *Transaction {
+	t.Helper()
+	tx, err := NewClientTransaction(newTestRequest(t, method), h.options(reliable), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestClientInviteTimerAB(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodINVITE, false)
+
+	// Timer A 从 T1 起每次翻倍且不受 T2 限制，Timer B 在 64*T1 = 32s 时结束事务
+	h.clock.Advance(31 * time.Second)
+	if want := seconds(0, 0.5, 1.5, 3.5, 7.5, 15.5); !equalTimes(h.wire.times(), want) {
+		t.Fatalf("sends at %v, want %v", h.wire.times(), want)
+	}
+	if tx.GetState() != TxStateCalling {
+		t.Fatalf("state = %s, want Calling", tx.GetState())
+	}
+
+	h.clock.Advance(time.Second)
+	if want := seconds(0, 0.5, 1.5, 3.5, 7.5, 15.5, 31.5); !equalTimes(h.wire.times(), want) {
+		t.Fatalf("sends at %v, want %v", h.wire.times(), want)
+	}
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer B", tx.GetState())
+	}
+	err, terminated := h.out.get()
+	if !errors.Is(err, ErrTimeout) || terminated != 1 {
+		t.Fatalf("OnTimeout err = %v, OnTerminate calls = %d", err, terminated)
+	}
+	if h.clock.Pending() != 0 {
+		t.Errorf("%d timers still pending", h.clock.Pending())
+	}
+}
+
+func TestClientInviteProvisionalStopsRetransmission(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodINVITE, false)
+	h.clock.Advance(time.Second)
+	if !tx.HandleResponse(newTestResponse(tx.Request, 180)) {
+		t.Fatal("180 not passed to TU")
+	}
+	h.clock.Advance(5 * time.Minute)
+	if n := h.wire.count(); n != 2 {
+		t.Errorf("sent %d messages, want 2 (INVITE and one Timer A retransmission)", n)
+	}
+	if tx.GetState() != TxStateProceeding {
+		t.Errorf("state = %s, want Proceeding (Timer B only runs in Calling)", tx.GetState())
+	}
+}
+
+func TestClientInviteTimerD(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodINVITE, false)
+	resp := newTestResponse(tx.Request, 486)
+	if !tx.HandleResponse(resp) {
+		t.Fatal("486 not passed to TU")
+	}
+	if tx.GetState() != TxStateCompleted {
+		t.Fatalf("state = %s, want Completed", tx.GetState())
+	}
+	ack := h.wire.last()
+	if !strings.HasPrefix(ack, "ACK ") || !strings.Contains(ack, "branch=z9hG4bKtx1") {
+		t.Fatalf("ACK not sent in the INVITE transaction: %q", ack)
+	}
+
+	// Timer D 期间吸收 486 重传，每次重发 ACK 且不上交 TU
+	h.clock.Advance(10 * time.Second)
+	if tx.HandleResponse(resp) {
+		t.Fatal("retransmitted 486 passed to TU")
+	}
+	if n := h.wire.count(); n != 3 || h.wire.last() != ack {
+		t.Fatalf("sent %d messages, last %q; want ACK resent", n, h.wire.last())
+	}
+
+	h.clock.Advance(22*time.Second - time.Millisecond)
+	if tx.GetState() != TxStateCompleted {
+		t.Fatalf("state = %s before Timer D", tx.GetState())
+	}
+	h.clock.Advance(time.Millisecond)
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer D (32s)", tx.GetState())
+	}
+	if err, terminated := h.out.get(); err != nil || terminated != 1 {
+		t.Fatalf("OnTimeout err = %v, OnTerminate calls = %d", err, terminated)
+	}
+}
+
+func TestClientInviteReliable(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodINVITE, true)
+	h.clock.Advance(10 * time.Second)
+	if n := h.wire.count(); n != 1 {
+		t.Fatalf("sent %d messages over a reliable transport, want 1", n)
+	}
+	tx.HandleResponse(newTestResponse(tx.Request, 603))
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated (Timer D is 0 over TCP)", tx.GetState())
+	}
+}
+
+func TestClientNonInviteTimerEF(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodOPTIONS, false)
+
+	// Timer E 从 T1 起翻倍，达到 T2 = 4s 后保持不变；Timer F 在 32s 时结束事务
+	h.clock.Advance(32 * time.Second)
+	want := seconds(0, 0.5, 1.5, 3.5, 7.5, 11.5, 15.5, 19.5, 23.5, 27.5, 31.5)
+	if !equalTimes(h.wire.times(), want) {
+		t.Fatalf("sends at %v, want %v", h.wire.times(), want)
+	}
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer F", tx.GetState())
+	}
+	if err, _ := h.out.get(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("OnTimeout err = %v, want ErrTimeout", err)
+	}
+}
+
+func TestClientNonInviteProceedingUsesT2(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodOPTIONS, false)
+	h.clock.Advance(600 * time.Millisecond) // 0.5s 时第一次重传，下一次在 1.5s
+	tx.HandleResponse(newTestResponse(tx.Request, 100))
+
+	// Proceeding 状态下每次重传后间隔固定为 T2
+	h.clock.Advance(10*time.Second - 600*time.Millisecond)
+	if want := seconds(0, 0.5, 1.5, 5.5, 9.5); !equalTimes(h.wire.times(), want) {
+		t.Fatalf("sends at %v, want %v", h.wire.times(), want)
+	}
+}
+
+func TestClientNonInviteTimerK(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodOPTIONS, false)
+	resp := newTestResponse(tx.Request, 200)
+	if !tx.HandleResponse(resp) {
+		t.Fatal("200 not passed to TU")
+	}
+	if tx.GetState() != TxStateCompleted {
+		t.Fatalf("state = %s, want Completed", tx.GetState())
+	}
+	h.clock.Advance(time.Second)
+	if tx.HandleResponse(resp) {
+		t.Fatal("retransmitted 200 passed to TU")
+	}
+	if n := h.wire.count(); n != 1 {
+		t.Fatalf("sent %d messages, want only the request", n)
+	}
+
+	h.clock.Advance(DefaultT4 - time.Second)
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer K (T4)", tx.GetState())
+	}
+	if err, terminated := h.out.get(); err != nil || terminated != 1 {
+		t.Fatalf("OnTimeout err = %v, OnTerminate calls = %d", err, terminated)
+	}
+}
+
+func TestClientNonInviteReliable(t *testing.T) {
+	h := newHarness()
+	tx := startClient(t, h, message.MethodOPTIONS, true)
+	tx.HandleResponse(newTestResponse(tx.Request, 200))
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated (Timer K is 0 over TCP)", tx.GetState())
+	}
+	if h.clock.Pending() != 0 {
+		t.Errorf("%d timers still pending", h.clock.Pending())
+	}
+}
+
+func TestClientTimersFollowT1(t *testing.T) {
+	h := newHarness()
+	opts := h.options(false)
+	opts.Timers = TimerConfig{T1: 100 * time.Millisecond, T2: 400 * time.Millisecond}
+	tx, err := NewClientTransaction(newTestRequest(t, message.MethodOPTIONS), opts, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	h.clock.Advance(6400*time.Millisecond - time.Millisecond)
+	if tx.GetState() != TxStateTrying {
+		t.Fatalf("state = %s before 64*T1", tx.GetState())
+	}
+	want := seconds(0, 0.1, 0.3, 0.7, 1.1, 1.5, 1.9, 2.3, 2.7, 3.1, 3.5, 3.9, 4.3, 4.7, 5.1, 5.5, 5.9, 6.3)
+	if !equalTimes(h.wire.times(), want) {
+		t.Fatalf("sends at %v, want %v", h.wire.times(), want)
+	}
+	h.clock.Advance(time.Millisecond)
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated at 64*T1", tx.GetState())
+	}
+}
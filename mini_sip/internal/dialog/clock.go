@@ -0,0 +1,133 @@
+package dialog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock 抽象事务层使用的时钟。
+//
+// 事务的所有计时器（A/B/D/E/F/K ...）都通过 Clock 创建，
+// 生产环境使用 SystemClock，测试中可注入 ManualClock 手动推进时间，
+// 从而不依赖真实 sleep 即可确定性地驱动状态机。
+type Clock interface {
+	Now() time.Time
+	// AfterFunc 在 d 之后于独立 goroutine（或由时钟决定的上下文）中调用 f。
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer 是可取消的计时器。
+type Timer interface {
+	// Stop 取消计时器，返回 false 表示计时器已触发或已被取消。
+	Stop() bool
+}
+
+// SystemClock 基于 time 包的真实时钟。
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// ManualClock 是手动推进的时钟，Advance 时在调用方 goroutine 中同步触发到期的计时器。
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*manualTimer
+}
+
+// NewManualClock 创建起始时间为 start 的手动时钟。
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+type manualTimer struct {
+	clock   *ManualClock
+	at      time.Time
+	seq     int // 同一时刻到期时按创建顺序触发
+	f       func()
+	stopped bool
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &manualTimer{clock: c, at: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance 将时间推进 d，并按到期顺序触发期间到期的计时器。
+// 计时器回调中新建的计时器若也在窗口内到期，同样会被触发。
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		next := c.nextDueLocked(target)
+		if next == nil {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		c.now = next.at
+		next.stopped = true
+		c.removeLocked(next)
+		c.mu.Unlock()
+		// 释放锁后回调，回调中可以再次调用 AfterFunc / Stop
+		next.f()
+	}
+}
+
+// Pending 返回尚未触发的计时器数量。
+func (c *ManualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (c *ManualClock) nextDueLocked(target time.Time) *manualTimer {
+	sort.Slice(c.timers, func(i, j int) bool {
+		if c.timers[i].at.Equal(c.timers[j].at) {
+			return c.timers[i].seq < c.timers[j].seq
+		}
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+	if len(c.timers) == 0 || c.timers[0].at.After(target) {
+		return nil
+	}
+	return c.timers[0]
+}
+
+func (c *ManualClock) removeLocked(t *manualTimer) {
+	for i, x := range c.timers {
+		if x == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	t.clock.removeLocked(t)
+	return true
+}
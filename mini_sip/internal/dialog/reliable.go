@@ -0,0 +1,178 @@
+package dialog
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// 可靠临时响应（RFC 3262）：
+//
+//   - 开启 TxOptions.ReliableProvisional 的服务端 INVITE 事务发出带 Require: 100rel 的 1xx（100 除外）时
+//     分配 RSeq（首个随机，之后逐个加一），从 T1 起按翻倍间隔重传，直到 PRACK 确认或 64*T1 后以 ErrNoPRACK 通知 TU
+//   - 前一个可靠 1xx 未被确认时，后续可靠 1xx 排队，确认后依次发送
+//   - 未确认的可靠 1xx 带 SDP 时，2xx 推迟到 PRACK 之后发送（RFC 3262 §3）；其他最终响应直接发送并停止重传
+//   - 客户端按 Dialog.AcceptRSeq 过滤可靠 1xx 的重传与乱序
+
+const maxRSeq = 1<<31 - 1
+
+// IsReliableProvisional 判断响应是否为可靠临时响应（101-199 且 Require 含 100rel）。
+func IsReliableProvisional(resp *message.Response) bool {
+	return resp.StatusCode > 100 && resp.StatusCode < 200 &&
+		resp.Headers.HasToken(message.HeaderRequire, "100rel")
+}
+
+// ParseRSeq 返回响应的 RSeq，没有或格式错误时 ok 为 false。
+func ParseRSeq(resp *message.Response) (rseq uint32, ok bool) {
+	n, err := strconv.ParseUint(resp.Headers.Get(message.HeaderRSeq), 10, 32)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// reliableLocked 判断 resp 是否应作为本事务的可靠 1xx 发送，调用方须持有 tx.mu。
+func (tx *Transaction) reliableLocked(resp *message.Response) bool {
+	return tx.opts.ReliableProvisional && tx.Method == message.MethodINVITE && IsReliableProvisional(resp)
+}
+
+// holdLocked 在前一个可靠 1xx 尚未确认时暂存 resp 并返回 true，调用方须持有 tx.mu。
+func (tx *Transaction) holdLocked(resp *message.Response, reliable bool) bool {
+	if tx.relResp == nil {
+		return false
+	}
+	code := resp.StatusCode
+	switch {
+	case reliable:
+		tx.relQueue = append(tx.relQueue, resp)
+		tx.logger.Info("reliable provisional response queued until PRACK",
+			zap.String("id", tx.ID), zap.Int("code", code))
+		return true
+	case code >= 200 && code < 300 && len(tx.relResp.Body) > 0:
+		tx.relFinal = resp
+		tx.logger.Info("2xx deferred until PRACK", zap.String("id", tx.ID), zap.Int("code", code))
+		return true
+	}
+	return false
+}
+
+// assignRSeqLocked 为可靠 1xx 分配 RSeq，调用方须持有 tx.mu。
+func (tx *Transaction) assignRSeqLocked(resp *message.Response) {
+	if tx.rseq == 0 {
+		// 初始值随机且不超过 2^31-1，为后续递增留出空间（RFC 3262 §3）
+		tx.rseq = uint32(rand.Int31n(maxRSeq/2)) + 1
+	} else {
+		tx.rseq++
+	}
+	resp.Headers.Set(message.HeaderRSeq, strconv.FormatUint(uint64(tx.rseq), 10))
+}
+
+// startReliableLocked 在可靠 1xx 发出后启动重传与等待 PRACK 的计时器，调用方须持有 tx.mu。
+func (tx *Transaction) startReliableLocked(resp *message.Response) {
+	t1 := tx.opts.Timers.t1()
+	tx.relResp = resp
+	tx.relInterval = t1
+	tx.startTimerLocked(timerRel, t1, tx.onTimerRel)
+	tx.startTimerLocked(timerRelTimeout, 64*t1, tx.onTimerRelTimeout)
+}
+
+// clearReliableLocked 发送最终响应时停止可靠 1xx 的重传并丢弃排队的 1xx，调用方须持有 tx.mu。
+func (tx *Transaction) clearReliableLocked() {
+	tx.stopTimerLocked(timerRel)
+	tx.stopTimerLocked(timerRelTimeout)
+	tx.relResp = nil
+	tx.relQueue = nil
+	tx.relFinal = nil
+}
+
+// Prack 处理匹配到本事务的 PRACK（RFC 3262 §3），返回 false 表示 RAck 不对应等待确认的可靠 1xx，
+// 调用方应以 481 应答 PRACK。确认后发送排队的下一个可靠 1xx 或推迟的 2xx。
+func (tx *Transaction) Prack(rack *message.RAck) bool {
+	cseq, err := message.ParseCSeq(tx.Request.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return false
+	}
+	tx.mu.Lock()
+	if tx.relResp == nil || tx.State != TxStateProceeding || message.Method(rack.Method) != tx.Method ||
+		rack.Seq != cseq.Seq || rack.RSeq != tx.rseq {
+		tx.mu.Unlock()
+		return false
+	}
+	tx.stopTimerLocked(timerRel)
+	tx.stopTimerLocked(timerRelTimeout)
+	tx.relResp = nil
+	tx.logger.Info("reliable provisional response acknowledged",
+		zap.String("id", tx.ID), zap.Uint32("rseq", rack.RSeq))
+
+	final := tx.relFinal
+	var next *message.Response
+	if final != nil {
+		tx.relQueue = nil
+		tx.relFinal = nil
+	} else if len(tx.relQueue) > 0 {
+		next = tx.relQueue[0]
+		tx.relQueue = tx.relQueue[1:]
+	}
+	tx.mu.Unlock()
+
+	switch {
+	case final != nil:
+		if err := tx.Respond(final); err != nil {
+			tx.logger.Warn("send deferred 2xx", zap.String("id", tx.ID), zap.Error(err))
+		}
+	case next != nil:
+		if err := tx.Respond(next); err != nil {
+			tx.logger.Warn("send queued reliable provisional response", zap.String("id", tx.ID), zap.Error(err))
+		}
+	}
+	return true
+}
+
+// onTimerRel 重传等待 PRACK 的可靠 1xx，间隔每次翻倍。
+func (tx *Transaction) onTimerRel() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.relResp == nil || tx.State != TxStateProceeding {
+		return
+	}
+	if err := tx.opts.Send([]byte(tx.relResp.String())); err != nil {
+		tx.logger.Warn("retransmit reliable provisional response failed", zap.String("id", tx.ID), zap.Error(err))
+	} else {
+		tx.logger.Debug("tx retransmit reliable provisional response", zap.String("id", tx.ID),
+			zap.Int("code", tx.relResp.StatusCode), zap.Duration("interval", tx.relInterval))
+	}
+	tx.relInterval *= 2
+	tx.startTimerLocked(timerRel, tx.relInterval, tx.onTimerRel)
+}
+
+// onTimerRelTimeout 可靠 1xx 在 64*T1 内没有等到 PRACK：停止重传并通知 TU，事务保持 Proceeding。
+func (tx *Transaction) onTimerRelTimeout() {
+	tx.mu.Lock()
+	if tx.relResp == nil || tx.State != TxStateProceeding {
+		tx.mu.Unlock()
+		return
+	}
+	code := tx.relResp.StatusCode
+	tx.clearReliableLocked()
+	tx.mu.Unlock()
+	tx.logger.Warn("no PRACK for reliable provisional response", zap.String("id", tx.ID), zap.Int("code", code))
+	if tx.opts.OnTimeout != nil {
+		tx.opts.OnTimeout(tx, fmt.Errorf("%w: %d to %s", ErrNoPRACK, code, tx.Method))
+	}
+}
+
+// AcceptRSeq 在 UAC 收到对话的可靠 1xx 时调用（RFC 3262 §4）：
+// 第一个可靠 1xx 的 RSeq 任意，之后只接受比上一个大一的 RSeq。
+// 返回 false 表示是重传或乱序，不应发送 PRACK，也不应再处理该响应。
+func (d *Dialog) AcceptRSeq(rseq uint32) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.RemoteRSeq != 0 && rseq != d.RemoteRSeq+1 {
+		return false
+	}
+	d.RemoteRSeq = rseq
+	return true
+}
@@ -0,0 +1,162 @@
+package dialog
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// ErrOutOfOrderCSeq 表示对话内请求的 CSeq 小于已见过的远端 CSeq，应回复 500（RFC 3261 §12.2.2）。
+var ErrOutOfOrderCSeq = errors.New("out of order CSeq")
+
+// IDFromRequest 返回收到的请求所属对话的 ID（UAS 视角：本端 tag 在 To 中）。
+func IDFromRequest(req *message.Request) (DialogID, error) {
+	from, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
+	if err != nil {
+		return DialogID{}, fmt.Errorf("parse From: %w", err)
+	}
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	if err != nil {
+		return DialogID{}, fmt.Errorf("parse To: %w", err)
+	}
+	return DialogID{CallID: req.Headers.Get(message.HeaderCallID), LocalTag: to.Tag, RemoteTag: from.Tag}, nil
+}
+
+// IDFromResponse 返回收到的响应所属对话的 ID（UAC 视角：本端 tag 在 From 中）。
+func IDFromResponse(resp *message.Response) (DialogID, error) {
+	from, err := message.ParseAddress(resp.Headers.Get(message.HeaderFrom))
+	if err != nil {
+		return DialogID{}, fmt.Errorf("parse From: %w", err)
+	}
+	to, err := message.ParseAddress(resp.Headers.Get(message.HeaderTo))
+	if err != nil {
+		return DialogID{}, fmt.Errorf("parse To: %w", err)
+	}
+	return DialogID{CallID: resp.Headers.Get(message.HeaderCallID), LocalTag: from.Tag, RemoteTag: to.Tag}, nil
+}
+
+// isTargetRefresh 判断方法是否为目标刷新请求（携带 Contact，可更新 Remote-Target）。
+func isTargetRefresh(method message.Method) bool {
+	switch method {
+	case message.MethodINVITE, message.MethodUPDATE, message.MethodSUBSCRIBE,
+		message.MethodNOTIFY, message.MethodREFER:
+		return true
+	}
+	return false
+}
+
+// NewRequest 构造对话内请求（RFC 3261 §12.2.1.1），Via 由发送方（Stack）添加。
+//
+//   - Request-URI 为 Remote-Target，Route 为路由集
+//   - 路由集第一项是严格路由（没有 ;lr）时，Request-URI 改为该项，Remote-Target 追加到 Route 末尾
+//   - From / To 带各自的 tag；CSeq 取递增后的 LocalCSeq；ACK 与 CANCEL 沿用 InviteCSeq，
+//     早期对话中的 PRACK / UPDATE 已推进了 LocalCSeq
+//   - 目标刷新请求携带本端 Contact
+func (d *Dialog) NewRequest(method message.Method) *message.Request {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seq := d.InviteCSeq
+	if method != message.MethodACK && method != message.MethodCANCEL {
+		d.LocalCSeq++
+		seq = d.LocalCSeq
+		if method == message.MethodINVITE {
+			d.InviteCSeq = seq
+		}
+	} else if seq == 0 {
+		seq = d.LocalCSeq
+	}
+	target := d.RemoteTarget
+	if target == nil {
+		target = d.RemoteURI
+	}
+	reqURI := target.Clone()
+	routes := append([]string(nil), d.RouteSet...)
+	if len(routes) > 0 {
+		if first, err := message.ParseAddress(routes[0]); err == nil && first.URI != nil {
+			if _, lr := first.URI.Params.Lookup("lr"); !lr {
+				reqURI = first.URI.Clone()
+				routes = append(routes[1:], fmt.Sprintf("<%s>", target))
+			}
+		}
+	}
+
+	req := message.NewRequest(method, reqURI)
+	for _, r := range routes {
+		req.Headers.Add(message.HeaderRoute, r)
+	}
+	req.Headers.Set(message.HeaderMaxForwards, "70")
+	req.Headers.Set(message.HeaderFrom, fmt.Sprintf("<%s>;tag=%s", d.LocalURI, d.ID.LocalTag))
+	to := fmt.Sprintf("<%s>", d.RemoteURI)
+	if d.ID.RemoteTag != "" {
+		to += ";tag=" + d.ID.RemoteTag
+	}
+	req.Headers.Set(message.HeaderTo, to)
+	req.Headers.Set(message.HeaderCallID, d.ID.CallID)
+	req.Headers.Set(message.HeaderCSeq, fmt.Sprintf("%d %s", seq, method))
+	if d.LocalTarget != nil && isTargetRefresh(method) {
+		req.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", d.LocalTarget))
+	}
+	req.Headers.Set(message.HeaderContentLen, "0")
+	return req
+}
+
+// HandleRequest 按 RFC 3261 §12.2.2 处理收到的对话内请求：
+//   - CSeq 小于远端 CSeq 返回 ErrOutOfOrderCSeq（ACK 与 CANCEL 不检查）
+//   - 否则记录远端 CSeq，目标刷新请求用其 Contact 更新 Remote-Target
+func (d *Dialog) HandleRequest(req *message.Request) error {
+	if req.Method == message.MethodACK || req.Method == message.MethodCANCEL {
+		return nil
+	}
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return fmt.Errorf("parse CSeq: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.RemoteCSeq != 0 && cseq.Seq < d.RemoteCSeq {
+		d.logger.Warn("out of order CSeq",
+			zap.String("id", d.ID.String()), zap.Uint32("cseq", cseq.Seq), zap.Uint32("remote", d.RemoteCSeq))
+		return ErrOutOfOrderCSeq
+	}
+	d.RemoteCSeq = cseq.Seq
+	if isTargetRefresh(req.Method) {
+		if addr, err := message.ParseAddress(req.Headers.Get(message.HeaderContact)); err == nil && addr.URI != nil {
+			d.RemoteTarget = addr.URI.Clone()
+		}
+	}
+	return nil
+}
+
+// MarkConfirmed 把早期对话标记为已确认（UAS 发出 2xx 时调用）。
+// 与 Confirm 不同，不从响应中更新 Remote-Target：UAS 的 Remote-Target 来自请求的 Contact。
+func (d *Dialog) MarkConfirmed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.State == DialogStateEarly {
+		d.State = DialogStateConfirmed
+		d.logger.Info("dialog confirmed", zap.String("id", d.ID.String()))
+	}
+}
+
+// InheritEarly 在 2xx 重建早期对话时沿用早期对话已消耗的本地 CSeq（如 PRACK），
+// 保证之后的对话内请求 CSeq 继续递增。
+func (d *Dialog) InheritEarly(early *Dialog) {
+	early.mu.RLock()
+	seq := early.LocalCSeq
+	early.mu.RUnlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if seq > d.LocalCSeq {
+		d.LocalCSeq = seq
+	}
+}
+
+// GetState 返回对话状态。
+func (d *Dialog) GetState() DialogState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.State
+}
@@ -0,0 +1,261 @@
+package dialog
+
+import (
+	"fmt"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// NewServerTransaction 为收到的请求创建服务端事务（RFC 3261 §17.2）。
+//
+// 事务 ID 由 ServerTransactionID 计算；opts.Send 负责把响应发回请求来源。
+// INVITE 事务初始状态为 Proceeding，非 INVITE 事务为 Trying。
+func NewServerTransaction(req *message.Request, opts TxOptions, logger *zap.Logger) (*Transaction, error) {
+	if req.Method == message.MethodACK {
+		return nil, fmt.Errorf("ACK does not create a server transaction")
+	}
+	if opts.Send == nil {
+		return nil, fmt.Errorf("server transaction requires a Send function")
+	}
+	id, err := ServerTransactionID(req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := newTransaction(req, opts, logger)
+	if err != nil {
+		return nil, err
+	}
+	tx.ID = id
+	if req.Method == message.MethodINVITE {
+		tx.State = TxStateProceeding
+	} else {
+		tx.State = TxStateTrying
+	}
+	return tx, nil
+}
+
+// Respond 通过事务发送响应，并驱动服务端状态机。
+//
+// INVITE 事务：
+//   - 1xx：保持 Proceeding，请求重传时重发最近的 1xx；带 Require: 100rel 的 1xx 按 RFC 3262 可靠发送（见 reliable.go）
+//   - 2xx：进入 Accepted，按 Timer G 重传 2xx 直到收到 ACK，Timer L 到期后结束
+//   - 3xx-6xx：进入 Completed，UDP 下按 Timer G 重传，Timer H 等待 ACK
+//
+// 非 INVITE 事务：
+//   - 1xx：进入 Proceeding
+//   - 最终响应：进入 Completed，Timer J 吸收请求重传
+func (tx *Transaction) Respond(resp *message.Response) error {
+	tx.mu.Lock()
+	if !tx.canRespondLocked(resp.StatusCode) {
+		state := tx.State
+		tx.mu.Unlock()
+		return fmt.Errorf("transaction %s cannot send %d in state %s", tx.ID, resp.StatusCode, state)
+	}
+	if tx.opts.PrepareResponse != nil {
+		tx.opts.PrepareResponse(tx, resp)
+	}
+	reliable := tx.reliableLocked(resp)
+	if tx.holdLocked(resp, reliable) {
+		tx.mu.Unlock()
+		return nil
+	}
+	if reliable {
+		tx.assignRSeqLocked(resp)
+	}
+	if err := tx.opts.Send([]byte(resp.String())); err != nil {
+		tx.terminateLocked()
+		tx.mu.Unlock()
+		err = fmt.Errorf("%w: %v", ErrTransport, err)
+		tx.notifyTerminated(err)
+		return err
+	}
+	tx.Responses = append(tx.Responses, resp)
+	tx.lastResp = resp
+
+	code := resp.StatusCode
+	t1 := tx.opts.Timers.t1()
+	var terminated bool
+	if code >= 200 {
+		tx.clearReliableLocked()
+	}
+	switch {
+	case code < 200:
+		if tx.Method != message.MethodINVITE {
+			tx.State = TxStateProceeding
+		}
+		if reliable {
+			tx.startReliableLocked(resp)
+		}
+	case tx.Method == message.MethodINVITE && code < 300:
+		// 2xx 需要端到端重传（RFC 3261 §13.3.1.4），与传输是否可靠无关
+		tx.State = TxStateAccepted
+		tx.interval = t1
+		tx.startTimerLocked(timerG, t1, tx.onTimerG)
+		tx.startTimerLocked(timerL, 64*t1, tx.onTimerL)
+	case tx.Method == message.MethodINVITE:
+		tx.State = TxStateCompleted
+		tx.interval = t1
+		if !tx.opts.Reliable {
+			tx.startTimerLocked(timerG, t1, tx.onTimerG)
+		}
+		tx.startTimerLocked(timerH, 64*t1, tx.onTimerH)
+	default:
+		tx.State = TxStateCompleted
+		if d := tx.opts.Timers.timerJ(tx.opts.Reliable); d == 0 {
+			terminated = tx.terminateLocked()
+		} else {
+			tx.startTimerLocked(timerJ, d, tx.onTimerJ)
+		}
+	}
+	tx.logger.Info("tx sent response",
+		zap.String("id", tx.ID), zap.Int("code", code), zap.String("state", tx.State.String()))
+	tx.mu.Unlock()
+	if tx.opts.OnRespond != nil {
+		tx.opts.OnRespond(tx, resp)
+	}
+	if terminated {
+		tx.notifyTerminated(nil)
+	}
+	return nil
+}
+
+// canRespondLocked 判断当前状态下 TU 是否还能发送 code 响应。
+func (tx *Transaction) canRespondLocked(code int) bool {
+	switch tx.State {
+	case TxStateProceeding:
+		return true
+	case TxStateTrying:
+		return tx.Method != message.MethodINVITE
+	case TxStateAccepted:
+		// 2xx 之后 TU 仍可能再发一次 2xx（如 fork 后另一个分支应答），交给事务重传
+		return code >= 200 && code < 300
+	}
+	return false
+}
+
+// Cancel 处理匹配到本 INVITE 服务端事务的 CANCEL（RFC 3261 §9.2）。
+//
+// 尚未发送最终响应时关闭 Cancelled 通道并返回 true，调用方随后以 487 结束 INVITE；
+// 已发送最终响应时 CANCEL 不起作用，返回 false。
+func (tx *Transaction) Cancel() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.Method != message.MethodINVITE || tx.State != TxStateProceeding {
+		return false
+	}
+	if !tx.cancelled {
+		tx.cancelled = true
+		close(tx.cancelCh)
+		tx.logger.Info("tx cancelled", zap.String("id", tx.ID))
+	}
+	return true
+}
+
+// Cancelled 返回 INVITE 被 CANCEL 时关闭的通道，TU 在振铃等待中监听它以停止振铃。
+func (tx *Transaction) Cancelled() <-chan struct{} {
+	return tx.cancelCh
+}
+
+// LastResponse 返回服务端事务最近发送的响应，尚未响应时为 nil。
+func (tx *Transaction) LastResponse() *message.Response {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+	return tx.lastResp
+}
+
+// HandleRetransmission 处理匹配到本事务的请求重传（RFC 3261 §17.2.1 / §17.2.2）。
+// 已发送过响应时重发最近一次响应，否则静默吸收；重传永远不会交给 TU。
+func (tx *Transaction) HandleRetransmission(req *message.Request) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.State {
+	case TxStateProceeding, TxStateCompleted, TxStateAccepted:
+		if tx.lastResp == nil {
+			return
+		}
+		if err := tx.opts.Send([]byte(tx.lastResp.String())); err != nil {
+			tx.logger.Warn("resend response failed", zap.String("id", tx.ID), zap.Error(err))
+			return
+		}
+		tx.logger.Debug("request retransmission absorbed, last response resent",
+			zap.String("id", tx.ID), zap.Int("code", tx.lastResp.StatusCode))
+	}
+}
+
+// HandleACK 服务端 INVITE 事务收到 ACK 后调用。
+//
+// 返回 true 表示该 ACK 确认的是 2xx，应交给 TU；
+// 非 2xx 的 ACK 属于事务本身，被事务层吸收。
+func (tx *Transaction) HandleACK() bool {
+	tx.mu.Lock()
+	switch tx.State {
+	case TxStateCompleted:
+		tx.stopTimerLocked(timerG)
+		tx.stopTimerLocked(timerH)
+		tx.State = TxStateConfirmed
+		tx.logger.Info("tx confirmed (ACK received)", zap.String("id", tx.ID))
+		// Timer I: UDP 下等待重传的 ACK
+		var terminated bool
+		if d := tx.opts.Timers.timerK(tx.opts.Reliable); d == 0 {
+			terminated = tx.terminateLocked()
+		} else {
+			tx.startTimerLocked(timerI, d, tx.onTimerI)
+		}
+		tx.mu.Unlock()
+		if terminated {
+			tx.notifyTerminated(nil)
+		}
+		return false
+	case TxStateAccepted:
+		first := !tx.acked
+		tx.acked = true
+		tx.stopTimerLocked(timerG)
+		tx.mu.Unlock()
+		if first {
+			tx.logger.Info("tx 2xx acknowledged", zap.String("id", tx.ID))
+		}
+		return first
+	}
+	tx.mu.Unlock()
+	return false
+}
+
+// ---- 计时器回调 ----
+
+// onTimerG 重传 INVITE 的最终响应，间隔 min(2*G, T2)。
+func (tx *Transaction) onTimerG() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.State != TxStateCompleted && !(tx.State == TxStateAccepted && !tx.acked) {
+		return
+	}
+	if err := tx.opts.Send([]byte(tx.lastResp.String())); err != nil {
+		tx.logger.Warn("retransmit response failed", zap.String("id", tx.ID), zap.Error(err))
+	} else {
+		tx.logger.Debug("tx retransmit response", zap.String("id", tx.ID),
+			zap.Int("code", tx.lastResp.StatusCode), zap.Duration("interval", tx.interval))
+	}
+	if tx.interval *= 2; tx.interval > tx.opts.Timers.t2() {
+		tx.interval = tx.opts.Timers.t2()
+	}
+	tx.startTimerLocked(timerG, tx.interval, tx.onTimerG)
+}
+
+func (tx *Transaction) onTimerH() { tx.timeout(timerH, TxStateCompleted) }
+
+func (tx *Transaction) onTimerI() { tx.expire(timerI, TxStateConfirmed) }
+
+func (tx *Transaction) onTimerJ() { tx.expire(timerJ, TxStateCompleted) }
+
+// onTimerL Accepted 状态结束：若 2xx 始终没有等到 ACK，按超时通知 TU（RFC 3261 §13.3.1.4）。
+func (tx *Transaction) onTimerL() {
+	tx.mu.RLock()
+	acked := tx.acked
+	tx.mu.RUnlock()
+	if acked {
+		tx.expire(timerL, TxStateAccepted)
+		return
+	}
+	tx.timeout(timerL, TxStateAccepted)
+}
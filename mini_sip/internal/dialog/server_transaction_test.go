@@ -0,0 +1,205 @@
+package dialog
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+func newServer(t *testing.T, h *txHarness, method message.Method, reliable bool) *Transaction {
+	t.Helper()
+	tx, err := NewServerTransaction(newTestRequest(t, method), h.options(reliable), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestServerInviteTimerGH(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodINVITE, false)
+	if err := tx.Respond(newTestResponse(tx.Request, 486)); err != nil {
+		t.Fatal(err)
+	}
+	if tx.GetState() != TxStateCompleted {
+		t.Fatalf("state = %s, want Completed", tx.GetState())
+	}
+
+	// Timer G 从 T1 起翻倍，上限 T2；Timer H 在 64*T1 = 32s 时超时
+	h.clock.Advance(32 * time.Second)
+	want := seconds(0, 0.5, 1.5, 3.5, 7.5, 11.5, 15.5, 19.5, 23.5, 27.5, 31.5)
+	if !equalTimes(h.wire.times(), want) {
+		t.Fatalf("sends at %v, want %v", h.wire.times(), want)
+	}
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer H", tx.GetState())
+	}
+	err, terminated := h.out.get()
+	if !errors.Is(err, ErrTimeout) || terminated != 1 {
+		t.Fatalf("OnTimeout err = %v, OnTerminate calls = %d", err, terminated)
+	}
+}
+
+func TestServerInviteACKTimerI(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodINVITE, false)
+	if err := tx.Respond(newTestResponse(tx.Request, 404)); err != nil {
+		t.Fatal(err)
+	}
+	h.clock.Advance(time.Second) // 0.5s 时重传一次
+	if tx.HandleACK() {
+		t.Fatal("ACK for a non-2xx passed to TU")
+	}
+	if tx.GetState() != TxStateConfirmed {
+		t.Fatalf("state = %s, want Confirmed", tx.GetState())
+	}
+
+	// Confirmed 状态吸收 ACK 重传，不再重传响应；Timer I (T4) 后结束
+	h.clock.Advance(DefaultT4 - time.Millisecond)
+	if tx.HandleACK() {
+		t.Fatal("retransmitted ACK passed to TU")
+	}
+	if n := h.wire.count(); n != 2 {
+		t.Fatalf("sent %d messages, want 2 (response and one Timer G retransmission)", n)
+	}
+	h.clock.Advance(time.Millisecond)
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer I", tx.GetState())
+	}
+	if err, terminated := h.out.get(); err != nil || terminated != 1 {
+		t.Fatalf("OnTimeout err = %v, OnTerminate calls = %d", err, terminated)
+	}
+}
+
+func TestServerInviteReliable(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodINVITE, true)
+	if err := tx.Respond(newTestResponse(tx.Request, 480)); err != nil {
+		t.Fatal(err)
+	}
+	h.clock.Advance(10 * time.Second)
+	if n := h.wire.count(); n != 1 {
+		t.Fatalf("sent %d messages over a reliable transport, want 1", n)
+	}
+	tx.HandleACK()
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated (Timer I is 0 over TCP)", tx.GetState())
+	}
+}
+
+func TestServerInvite2xxRetransmission(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodINVITE, true)
+	if err := tx.Respond(newTestResponse(tx.Request, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if tx.GetState() != TxStateAccepted {
+		t.Fatalf("state = %s, want Accepted", tx.GetState())
+	}
+
+	// 2xx 即使在可靠传输上也按 Timer G 重传，直到收到 ACK
+	h.clock.Advance(2 * time.Second)
+	if want := seconds(0, 0.5, 1.5); !equalTimes(h.wire.times(), want) {
+		t.Fatalf("sends at %v, want %v", h.wire.times(), want)
+	}
+	if !tx.HandleACK() {
+		t.Fatal("first ACK for 2xx not passed to TU")
+	}
+	if tx.HandleACK() {
+		t.Fatal("retransmitted ACK for 2xx passed to TU")
+	}
+	h.clock.Advance(10 * time.Second)
+	if n := h.wire.count(); n != 3 {
+		t.Fatalf("sent %d messages, want no retransmission after ACK", n)
+	}
+
+	// Timer L (64*T1) 到期后正常结束
+	h.clock.Advance(20 * time.Second)
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer L", tx.GetState())
+	}
+	if err, _ := h.out.get(); err != nil {
+		t.Fatalf("OnTimeout err = %v, want nil for an acknowledged 2xx", err)
+	}
+}
+
+func TestServerInvite2xxWithoutACK(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodINVITE, false)
+	if err := tx.Respond(newTestResponse(tx.Request, 200)); err != nil {
+		t.Fatal(err)
+	}
+	h.clock.Advance(32 * time.Second)
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer L", tx.GetState())
+	}
+	if err, _ := h.out.get(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("OnTimeout err = %v, want ErrTimeout when the 2xx is never acknowledged", err)
+	}
+}
+
+func TestServerInviteRetransmissionResendsResponse(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodINVITE, false)
+	tx.HandleRetransmission(tx.Request)
+	if n := h.wire.count(); n != 0 {
+		t.Fatalf("sent %d messages before any response", n)
+	}
+	if err := tx.Respond(newTestResponse(tx.Request, 180)); err != nil {
+		t.Fatal(err)
+	}
+	tx.HandleRetransmission(tx.Request)
+	if n := h.wire.count(); n != 2 || !strings.HasPrefix(h.wire.last(), "SIP/2.0 180 ") {
+		t.Fatalf("sent %d messages, last %q; want 180 resent", n, h.wire.last())
+	}
+}
+
+func TestServerNonInviteTimerJ(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodOPTIONS, false)
+	if tx.GetState() != TxStateTrying {
+		t.Fatalf("state = %s, want Trying", tx.GetState())
+	}
+	if err := tx.Respond(newTestResponse(tx.Request, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if tx.GetState() != TxStateCompleted {
+		t.Fatalf("state = %s, want Completed", tx.GetState())
+	}
+
+	// Completed 状态吸收请求重传并重发最终响应，不自行重传；Timer J (64*T1) 后结束
+	h.clock.Advance(10 * time.Second)
+	tx.HandleRetransmission(tx.Request)
+	if n := h.wire.count(); n != 2 || !strings.HasPrefix(h.wire.last(), "SIP/2.0 200 ") {
+		t.Fatalf("sent %d messages, last %q; want 200 resent once", n, h.wire.last())
+	}
+	h.clock.Advance(22*time.Second - time.Millisecond)
+	if tx.GetState() != TxStateCompleted {
+		t.Fatalf("state = %s before Timer J", tx.GetState())
+	}
+	h.clock.Advance(time.Millisecond)
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated after Timer J", tx.GetState())
+	}
+	if err := tx.Respond(newTestResponse(tx.Request, 500)); err == nil {
+		t.Fatal("Respond succeeded on a terminated transaction")
+	}
+}
+
+func TestServerNonInviteReliable(t *testing.T) {
+	h := newHarness()
+	tx := newServer(t, h, message.MethodOPTIONS, true)
+	if err := tx.Respond(newTestResponse(tx.Request, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if tx.GetState() != TxStateTerminated {
+		t.Fatalf("state = %s, want Terminated (Timer J is 0 over TCP)", tx.GetState())
+	}
+	if _, terminated := h.out.get(); terminated != 1 {
+		t.Fatalf("OnTerminate calls = %d, want 1", terminated)
+	}
+}
@@ -0,0 +1,87 @@
+package dialog
+
+import "time"
+
+// RFC 3261 §17 / 附录 A 定义的计时器基准值。
+const (
+	DefaultT1 = 500 * time.Millisecond // RTT 估计值
+	DefaultT2 = 4 * time.Second        // 非 INVITE 请求 / INVITE 响应的最大重传间隔
+	DefaultT4 = 5 * time.Second        // 消息在网络中的最长存活时间
+)
+
+// 计时器名称（RFC 3261 附录 A）
+const (
+	timerA = "A" // INVITE 请求重传（仅 UDP），初始 T1，指数增长
+	timerB = "B" // INVITE 事务超时，64*T1
+	timerD = "D" // 等待响应重传，UDP >32s，可靠传输 0
+	timerE = "E" // 非 INVITE 请求重传（仅 UDP），初始 T1，上限 T2
+	timerF = "F" // 非 INVITE 事务超时，64*T1
+	timerK = "K" // 等待响应重传，UDP T4，可靠传输 0
+	timerM = "M" // RFC 6026：Accepted 状态吸收 2xx 重传，64*T1
+	timerG = "G" // INVITE 最终响应重传，初始 T1，上限 T2
+	timerH = "H" // 等待 ACK 超时，64*T1
+	timerI = "I" // 等待 ACK 重传，UDP T4，可靠传输 0
+	timerJ = "J" // 非 INVITE 服务端吸收请求重传，UDP 64*T1，可靠传输 0
+	timerL = "L" // RFC 6026：服务端 Accepted 状态等待 2xx 的 ACK，64*T1
+)
+
+// 可靠临时响应的计时器（RFC 3262 §3），名称不与附录 A 冲突
+const (
+	timerRel        = "Rel"         // 可靠 1xx 重传，初始 T1，每次翻倍
+	timerRelTimeout = "Rel-Timeout" // 等待 PRACK 超时，64*T1
+)
+
+// TimerConfig 配置事务计时器，零值字段使用 RFC 默认值。
+type TimerConfig struct {
+	T1 time.Duration
+	T2 time.Duration
+	T4 time.Duration
+}
+
+func (c TimerConfig) t1() time.Duration {
+	if c.T1 > 0 {
+		return c.T1
+	}
+	return DefaultT1
+}
+
+func (c TimerConfig) t2() time.Duration {
+	if c.T2 > 0 {
+		return c.T2
+	}
+	return DefaultT2
+}
+
+func (c TimerConfig) t4() time.Duration {
+	if c.T4 > 0 {
+		return c.T4
+	}
+	return DefaultT4
+}
+
+// timerD 返回 Timer D 时长：UDP 至少 32s，可靠传输为 0。
+func (c TimerConfig) timerD(reliable bool) time.Duration {
+	if reliable {
+		return 0
+	}
+	if d := 64 * c.t1(); d > 32*time.Second {
+		return d
+	}
+	return 32 * time.Second
+}
+
+// timerJ 返回 Timer J 时长：UDP 为 64*T1，可靠传输为 0。
+func (c TimerConfig) timerJ(reliable bool) time.Duration {
+	if reliable {
+		return 0
+	}
+	return 64 * c.t1()
+}
+
+// timerK 返回 Timer K / Timer I 时长：UDP 为 T4，可靠传输为 0。
+func (c TimerConfig) timerK(reliable bool) time.Duration {
+	if reliable {
+		return 0
+	}
+	return c.t4()
+}
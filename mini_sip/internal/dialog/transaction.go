@@ -9,22 +9,44 @@
 //
 // 客户端 INVITE 事务：
 //
-//	         INVITE sent
-//	            │
-//	        [Calling]
-//	            │ 1xx
-//	        [Proceeding]
-//	            │ 2xx (交给 TU 直接处理，不经过事务层)
-//	            │ 3xx-6xx
-//	        [Completed]──ACK sent──>[Terminated]
+//	 INVITE sent ── Timer A 重传（UDP，T1 起指数退避）
+//	    │
+//	[Calling] ── Timer B (64*T1) 超时 ──> [Terminated]
+//	    │ 1xx
+//	[Proceeding]
+//	    │ 2xx (交给 TU 直接处理，不经过事务层)
+//	    │        └──> [Accepted] ── Timer M ──> [Terminated]  (RFC 6026)
+//	    │ 3xx-6xx
+//	[Completed]──ACK sent── Timer D ──>[Terminated]
+//
+// 客户端非 INVITE 事务：
+//
+//	 Request sent ── Timer E 重传（UDP，T1 起翻倍，上限 T2）
+//	    │
+//	[Trying] ── Timer F (64*T1) 超时 ──> [Terminated]
+//	    │ 1xx
+//	[Proceeding]
+//	    │ 200-699
+//	[Completed] ── Timer K ──> [Terminated]
 //
 // 服务端 INVITE 事务：
 //
-//	         INVITE rcvd
-//	            │
-//	        [Proceeding] ──1xx sent──>
-//	            │ 2xx / 3xx-6xx sent
-//	        [Completed] ──ACK rcvd──>[Confirmed]──>[Terminated]
+//	 INVITE rcvd（重传的 INVITE 由事务重发最近的响应，不再交给 TU）
+//	    │
+//	[Proceeding] ──1xx sent──>
+//	    │ 2xx sent ──> [Accepted] ── Timer G 重传 2xx 直到 ACK，Timer L ──> [Terminated]
+//	    │ 3xx-6xx sent ── Timer G 重传（UDP），Timer H 等待 ACK
+//	[Completed] ──ACK rcvd──>[Confirmed]── Timer I ──>[Terminated]
+//
+// 服务端非 INVITE 事务：
+//
+//	[Trying] ──1xx sent──> [Proceeding] ──200-699 sent──> [Completed] ── Timer J ──> [Terminated]
+//
+// 服务端事务按顶层 Via 的 branch + sent-by + method 匹配（RFC 3261 §17.2.3），
+// TU 通过 Transaction.Respond 发送响应。
+//
+// 所有计时器都通过可注入的 Clock 创建，可被取消；
+// 超时与传输错误通过 TxOptions.OnTimeout 回调交给 TU。
 //
 // # 对话 (Dialog)
 //
@@ -37,7 +59,9 @@
 package dialog
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,25 +69,38 @@ import (
 	"go.uber.org/zap"
 )
 
+// 事务层错误，通过 TxOptions.OnTimeout 交给 TU。
+var (
+	ErrTimeout   = errors.New("transaction timeout")
+	ErrTransport = errors.New("transport error")
+	ErrNoPRACK   = errors.New("reliable provisional response not acknowledged")
+)
+
 // TxState 事务状态
 type TxState int
 
 const (
-	TxStateCalling     TxState = iota // 客户端：已发送请求，等待响应
-	TxStateProceeding                 // 收到 1xx
-	TxStateCompleted                  // 收到最终响应（3xx-6xx），等待 ACK / Timer D
-	TxStateConfirmed                  // INVITE 服务端：已收到 ACK
-	TxStateTerminated                 // 事务结束
+	TxStateCalling    TxState = iota // 客户端 INVITE：已发送请求，等待响应
+	TxStateTrying                    // 客户端非 INVITE：已发送请求，等待响应
+	TxStateProceeding                // 收到 1xx
+	TxStateCompleted                 // 收到最终响应（3xx-6xx），等待 ACK / Timer D
+	TxStateAccepted                  // 客户端 INVITE 收到 2xx，吸收 2xx 重传（RFC 6026）
+	TxStateConfirmed                 // INVITE 服务端：已收到 ACK
+	TxStateTerminated                // 事务结束
 )
 
 func (s TxState) String() string {
 	switch s {
 	case TxStateCalling:
 		return "Calling"
+	case TxStateTrying:
+		return "Trying"
 	case TxStateProceeding:
 		return "Proceeding"
 	case TxStateCompleted:
 		return "Completed"
+	case TxStateAccepted:
+		return "Accepted"
 	case TxStateConfirmed:
 		return "Confirmed"
 	case TxStateTerminated:
@@ -72,109 +109,241 @@ func (s TxState) String() string {
 	return "Unknown"
 }
 
+// TxOptions 事务运行参数。
+type TxOptions struct {
+	// Reliable 表示底层为可靠传输（TCP/TLS），此时不做重传，Timer D/K 为 0。
+	Reliable bool
+	// Clock 计时器时钟，nil 使用 SystemClock。
+	Clock Clock
+	// Timers 计时器基准值，零值使用 RFC 默认。
+	Timers TimerConfig
+	// Send 将序列化后的消息交给传输层（首次发送与重传都走这里）。
+	Send func(data []byte) error
+	// OnTimeout 在 Timer B/F/H 超时或传输错误时调用，err 包裹 ErrTimeout / ErrTransport；
+	// 可靠 1xx 等不到 PRACK 时以 ErrNoPRACK 调用，此时事务仍未结束，TU 应以 5xx 拒绝请求。
+	OnTimeout func(tx *Transaction, err error)
+	// OnTerminate 在事务进入 Terminated 后调用，用于从事务表中移除。
+	OnTerminate func(tx *Transaction)
+	// ReliableProvisional 表示服务端 INVITE 事务按 RFC 3262 可靠发送带 Require: 100rel 的 1xx；
+	// 代理转发的响应由下游 UA 负责可靠性，不应开启。
+	ReliableProvisional bool
+	// PrepareResponse 在服务端事务发出响应前调用（不含重传），用于补充扩展头域（如 Session-Expires）；
+	// 调用时持有事务锁，回调中不能再调用该事务的方法。
+	PrepareResponse func(tx *Transaction, resp *message.Response)
+	// OnRespond 在服务端事务成功发出响应后调用（不含重传），用于建立 UAS 对话。
+	OnRespond func(tx *Transaction, resp *message.Response)
+}
+
 // Transaction 表示一个 SIP 事务。
 type Transaction struct {
 	mu        sync.RWMutex
-	ID        string          // branch 参数作为事务 ID
-	Method    message.Method  // 原始请求方法
+	ID        string         // branch 参数作为事务 ID
+	Method    message.Method // 原始请求方法
 	State     TxState
 	Request   *message.Request
 	Responses []*message.Response
 	logger    *zap.Logger
 	done      chan struct{}
+
+	opts     TxOptions
+	clock    Clock
+	timers   map[string]*txTimer // 运行中的计时器：名称 -> 计时器
+	interval time.Duration       // 当前重传间隔（Timer A / E / G）
+	ack      []byte              // 客户端 INVITE 事务为非 2xx 最终响应生成的 ACK
+	lastResp *message.Response   // 服务端事务最近发送的响应，用于应答请求重传
+	acked    bool                // 服务端 INVITE 事务是否已收到 2xx 的 ACK
+
+	cancelCh  chan struct{} // 服务端 INVITE 事务被 CANCEL 时关闭（见 Cancel）
+	cancelled bool
+
+	// 可靠临时响应（见 reliable.go），仅服务端 INVITE 事务使用
+	rseq        uint32              // 最近发出的可靠 1xx 的 RSeq
+	relResp     *message.Response   // 等待 PRACK 的可靠 1xx
+	relQueue    []*message.Response // 前一个可靠 1xx 确认后才能发送的可靠 1xx
+	relFinal    *message.Response   // 等待 PRACK 后再发送的 2xx
+	relInterval time.Duration       // 可靠 1xx 当前重传间隔
+}
+
+// TransactionID 计算请求对应的事务 ID：branch + method。
+// ACK 与 CANCEL 使用与 INVITE 相同的 branch，method 区分不同事务。
+func TransactionID(branch string, method message.Method) string {
+	return branch + ":" + string(method)
+}
+
+// ServerTransactionID 按 RFC 3261 §17.2.3 计算收到请求所属的服务端事务 ID：
+// 顶层 Via 的 branch + sent-by + method，其中 ACK 匹配 INVITE 事务。
+func ServerTransactionID(req *message.Request) (string, error) {
+	via, branch, err := topVia(req)
+	if err != nil {
+		return "", err
+	}
+	method := req.Method
+	if method == message.MethodACK {
+		method = message.MethodINVITE
+	}
+	return TransactionID(branch+"|"+strings.ToLower(via.SentBy), method), nil
+}
+
+// CancelTargetID 返回 CANCEL 所取消的 INVITE 服务端事务 ID（RFC 3261 §9.2）：
+// 除 method 外与 CANCEL 自身的事务 ID 相同。
+func CancelTargetID(cancel *message.Request) (string, error) {
+	via, branch, err := topVia(cancel)
+	if err != nil {
+		return "", err
+	}
+	return TransactionID(branch+"|"+strings.ToLower(via.SentBy), message.MethodINVITE), nil
 }
 
-// NewTransaction 创建新事务。
-func NewTransaction(req *message.Request, logger *zap.Logger) (*Transaction, error) {
-	via := req.Headers.Get(message.HeaderVia)
-	if via == "" {
-		return nil, fmt.Errorf("request missing Via header")
+// topVia 解析请求的顶层 Via 并返回其 branch 参数。
+func topVia(req *message.Request) (*message.Via, string, error) {
+	raw := req.Headers.Get(message.HeaderVia)
+	if raw == "" {
+		return nil, "", fmt.Errorf("request missing Via header")
 	}
-	parsed, err := message.ParseVia(via)
+	via, err := message.ParseVia(raw)
 	if err != nil {
-		return nil, fmt.Errorf("parse Via: %w", err)
+		return nil, "", fmt.Errorf("parse Via: %w", err)
 	}
-	branch, ok := parsed.Params["branch"]
+	branch, ok := via.Params.Lookup("branch")
 	if !ok || branch == "" {
-		return nil, fmt.Errorf("Via missing branch parameter")
+		return nil, "", fmt.Errorf("Via missing branch parameter")
+	}
+	return via, branch, nil
+}
+
+func newTransaction(req *message.Request, opts TxOptions, logger *zap.Logger) (*Transaction, error) {
+	_, branch, err := topVia(req)
+	if err != nil {
+		return nil, err
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = SystemClock{}
 	}
-	// 事务 ID = branch + method（非 INVITE 的 ACK 使用 INVITE 的 branch）
-	txID := branch + ":" + string(req.Method)
 
 	return &Transaction{
-		ID:      txID,
-		Method:  req.Method,
-		State:   TxStateCalling,
-		Request: req,
-		logger:  logger,
-		done:    make(chan struct{}),
+		ID:       TransactionID(branch, req.Method),
+		Method:   req.Method,
+		State:    TxStateCalling,
+		Request:  req,
+		logger:   logger,
+		done:     make(chan struct{}),
+		cancelCh: make(chan struct{}),
+		opts:     opts,
+		clock:    clock,
+		timers:   make(map[string]*txTimer),
 	}, nil
 }
 
-// HandleResponse 将响应送入事务状态机。
-func (tx *Transaction) HandleResponse(resp *message.Response) {
-	tx.mu.Lock()
-	defer tx.mu.Unlock()
-
-	tx.Responses = append(tx.Responses, resp)
-	code := resp.StatusCode
-
-	switch tx.State {
-	case TxStateCalling, TxStateProceeding:
-		if code >= 100 && code < 200 {
-			tx.State = TxStateProceeding
-			tx.logger.Info("tx provisional response",
-				zap.String("id", tx.ID), zap.Int("code", code))
-		} else if code >= 200 {
-			tx.State = TxStateCompleted
-			tx.logger.Info("tx final response",
-				zap.String("id", tx.ID), zap.Int("code", code))
-			// Timer D: 32s (UDP) 后进入 Terminated
-			go tx.timerD(32 * time.Second)
+// Done 返回事务结束信号通道。
+func (tx *Transaction) Done() <-chan struct{} {
+	return tx.done
+}
+
+// GetState 并发安全地读取当前状态。
+func (tx *Transaction) GetState() TxState {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+	return tx.State
+}
+
+// ---- 计时器与终止 ----
+
+// txTimer 包装 Clock 返回的计时器，用于识别已被替换或取消的旧回调。
+type txTimer struct {
+	t Timer
+}
+
+// startTimerLocked 启动（或重启）名为 name 的计时器，调用方须持有 tx.mu。
+// 若回调触发时该计时器已被取消或被同名新计时器替换，则忽略本次触发。
+func (tx *Transaction) startTimerLocked(name string, d time.Duration, f func()) {
+	tx.stopTimerLocked(name)
+	entry := &txTimer{}
+	entry.t = tx.clock.AfterFunc(d, func() {
+		tx.mu.RLock()
+		current := tx.timers[name] == entry
+		tx.mu.RUnlock()
+		if current {
+			f()
 		}
-	}
+	})
+	tx.timers[name] = entry
 }
 
-// HandleACK 服务端 INVITE 事务收到 ACK 后调用。
-func (tx *Transaction) HandleACK() {
-	tx.mu.Lock()
-	defer tx.mu.Unlock()
-	if tx.State == TxStateCompleted {
-		tx.State = TxStateConfirmed
-		tx.logger.Info("tx confirmed (ACK received)", zap.String("id", tx.ID))
-		go tx.timerI(0) // Timer I: UDP 下等待重传的 ACK
+// stopTimerLocked 取消名为 name 的计时器，调用方须持有 tx.mu。
+func (tx *Transaction) stopTimerLocked(name string) {
+	if entry, ok := tx.timers[name]; ok {
+		entry.t.Stop()
+		delete(tx.timers, name)
 	}
 }
 
-// Done 返回事务结束信号通道。
-func (tx *Transaction) Done() <-chan struct{} {
-	return tx.done
+// terminateLocked 进入 Terminated 并取消全部计时器，返回 false 表示事务早已结束。
+func (tx *Transaction) terminateLocked() bool {
+	if tx.State == TxStateTerminated {
+		return false
+	}
+	tx.State = TxStateTerminated
+	for name := range tx.timers {
+		tx.stopTimerLocked(name)
+	}
+	close(tx.done)
+	return true
 }
 
-func (tx *Transaction) timerD(d time.Duration) {
-	time.Sleep(d)
+// Terminate 立即结束事务（如 TU 放弃请求或协议栈关闭）。
+func (tx *Transaction) Terminate() {
 	tx.mu.Lock()
-	tx.State = TxStateTerminated
+	ok := tx.terminateLocked()
 	tx.mu.Unlock()
-	select {
-	case <-tx.done:
-	default:
-		close(tx.done)
+	if ok {
+		tx.notifyTerminated(nil)
 	}
-	tx.logger.Info("tx terminated (Timer D)", zap.String("id", tx.ID))
 }
 
-func (tx *Transaction) timerI(d time.Duration) {
-	time.Sleep(d)
+// timeout 处理 Timer B / F / H：事务在 states 之一时超时终止并通知 TU。
+func (tx *Transaction) timeout(name string, states ...TxState) {
 	tx.mu.Lock()
-	tx.State = TxStateTerminated
+	if !inStates(tx.State, states) {
+		tx.mu.Unlock()
+		return
+	}
+	tx.terminateLocked()
+	tx.mu.Unlock()
+	tx.logger.Warn("tx timeout", zap.String("id", tx.ID), zap.String("timer", name))
+	tx.notifyTerminated(fmt.Errorf("%w: Timer %s fired for %s", ErrTimeout, name, tx.Method))
+}
+
+// expire 处理 Timer D / K / M / I / J：吸收重传的等待期结束，事务正常终止。
+func (tx *Transaction) expire(name string, states ...TxState) {
+	tx.mu.Lock()
+	if !inStates(tx.State, states) {
+		tx.mu.Unlock()
+		return
+	}
+	tx.terminateLocked()
 	tx.mu.Unlock()
-	select {
-	case <-tx.done:
-	default:
-		close(tx.done)
+	tx.logger.Info("tx terminated", zap.String("id", tx.ID), zap.String("timer", name))
+	tx.notifyTerminated(nil)
+}
+
+func inStates(s TxState, states []TxState) bool {
+	for _, x := range states {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyTerminated 在释放锁后通知 TU：err 非空时先回调 OnTimeout，再回调 OnTerminate。
+func (tx *Transaction) notifyTerminated(err error) {
+	if err != nil && tx.opts.OnTimeout != nil {
+		tx.opts.OnTimeout(tx, err)
+	}
+	if tx.opts.OnTerminate != nil {
+		tx.opts.OnTerminate(tx)
 	}
-	tx.logger.Info("tx terminated (Timer I)", zap.String("id", tx.ID))
 }
 
 // ---- Dialog ----
@@ -202,8 +371,8 @@ func (s DialogState) String() string {
 
 // DialogID 对话标识三元组
 type DialogID struct {
-	CallID   string
-	LocalTag string
+	CallID    string
+	LocalTag  string
 	RemoteTag string
 }
 
@@ -213,19 +382,25 @@ func (d DialogID) String() string {
 
 // Dialog 表示一个 SIP 对话（两个 UA 之间的逻辑关系）。
 type Dialog struct {
-	mu         sync.RWMutex
-	ID         DialogID
-	State      DialogState
-	LocalURI   *message.URI
-	RemoteURI  *message.URI
+	mu           sync.RWMutex
+	ID           DialogID
+	State        DialogState
+	LocalURI     *message.URI
+	RemoteURI    *message.URI
 	RemoteTarget *message.URI // Contact 中的 URI，下一跳目标
-	RouteSet   []string      // Record-Route 构建的路由集
-	LocalCSeq  uint32
-	RemoteCSeq uint32
-	logger     *zap.Logger
+	LocalTarget  *message.URI // 本端 Contact，目标刷新请求（如 re-INVITE）中携带
+	RouteSet     []string     // Record-Route 构建的路由集
+	LocalCSeq    uint32
+	InviteCSeq   uint32 // 本端最近一个 INVITE 的 CSeq 序号，ACK 与 CANCEL 沿用（PRACK、UPDATE 会推进 LocalCSeq）
+	RemoteCSeq   uint32
+	RemoteRSeq   uint32 // 最近确认的可靠 1xx 的 RSeq（UAC，RFC 3262）
+	logger       *zap.Logger
 }
 
-// NewDialogFromRequest 从收到的 INVITE 创建对话（服务端视角）。
+// NewDialogFromRequest 从收到的 INVITE / SUBSCRIBE 创建对话（服务端视角，RFC 3261 §12.1.1）。
+// 订阅方在 2xx 之前收到 NOTIFY 时也以该 NOTIFY 创建订阅对话（RFC 6665 §4.1.2.4）。
+//
+// 路由集取请求 Record-Route 的原有顺序，Remote-Target 取请求的 Contact。
 func NewDialogFromRequest(req *message.Request, localTag string, logger *zap.Logger) (*Dialog, error) {
 	callID := req.Headers.Get(message.HeaderCallID)
 	fromAddr, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
@@ -247,12 +422,73 @@ func NewDialogFromRequest(req *message.Request, localTag string, logger *zap.Log
 		RemoteCSeq: cseq.Seq,
 		logger:     logger,
 	}
-	if req.RequestURI != nil {
+	// 本端 URI 取 To（§12.1.1），To 解析失败时退回 Request-URI
+	if toAddr, err := message.ParseAddress(req.Headers.Get(message.HeaderTo)); err == nil && toAddr.URI != nil {
+		d.LocalURI = toAddr.URI.Clone()
+	} else if req.RequestURI != nil {
 		d.LocalURI = req.RequestURI.Clone()
 	}
 	if fromAddr.URI != nil {
 		d.RemoteURI = fromAddr.URI.Clone()
 	}
+	if contact := req.Headers.Get(message.HeaderContact); contact != "" {
+		if addr, err := message.ParseAddress(contact); err == nil && addr.URI != nil {
+			d.RemoteTarget = addr.URI.Clone()
+		}
+	}
+	d.RouteSet = append(d.RouteSet, req.Headers.GetAll(message.HeaderRecordRoute)...)
+	return d, nil
+}
+
+// NewDialogFromResponse 从 INVITE / SUBSCRIBE 的响应创建对话（客户端视角，RFC 3261 §12.1.2）。
+//
+// 带 To tag 的 1xx 创建早期对话，2xx 直接创建已确认对话；
+// 路由集取 Record-Route 的逆序，Remote-Target 取响应的 Contact。
+// 同一 INVITE 被分叉后，不同分支的响应 To tag 不同，各自对应一个独立的对话。
+func NewDialogFromResponse(req *message.Request, resp *message.Response, logger *zap.Logger) (*Dialog, error) {
+	fromAddr, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
+	if err != nil {
+		return nil, fmt.Errorf("parse From: %w", err)
+	}
+	toAddr, err := message.ParseAddress(resp.Headers.Get(message.HeaderTo))
+	if err != nil {
+		return nil, fmt.Errorf("parse To: %w", err)
+	}
+	if toAddr.Tag == "" {
+		return nil, fmt.Errorf("response without To tag cannot create a dialog")
+	}
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return nil, fmt.Errorf("parse CSeq: %w", err)
+	}
+
+	d := &Dialog{
+		ID: DialogID{
+			CallID:    req.Headers.Get(message.HeaderCallID),
+			LocalTag:  fromAddr.Tag,
+			RemoteTag: toAddr.Tag,
+		},
+		State:     DialogStateEarly,
+		LocalURI:  fromAddr.URI.Clone(),
+		RemoteURI: toAddr.URI.Clone(),
+		LocalCSeq: cseq.Seq,
+		logger:    logger,
+	}
+	if message.Method(cseq.Method) == message.MethodINVITE {
+		d.InviteCSeq = cseq.Seq
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		d.State = DialogStateConfirmed
+	}
+	if contact := resp.Headers.Get(message.HeaderContact); contact != "" {
+		if addr, err := message.ParseAddress(contact); err == nil {
+			d.RemoteTarget = addr.URI.Clone()
+		}
+	}
+	rr := resp.Headers.GetAll(message.HeaderRecordRoute)
+	for i := len(rr) - 1; i >= 0; i-- {
+		d.RouteSet = append(d.RouteSet, rr[i])
+	}
 	return d, nil
 }
 
@@ -268,6 +504,10 @@ func (d *Dialog) Confirm(resp *message.Response) error {
 	if d.ID.RemoteTag == "" {
 		d.ID.RemoteTag = toAddr.Tag
 	}
+	// re-INVITE 的 2xx：之后的 ACK 沿用其 CSeq（认证重试后与最初发出的序号不同）
+	if cseq, err := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq)); err == nil && message.Method(cseq.Method) == message.MethodINVITE {
+		d.InviteCSeq = cseq.Seq
+	}
 	// 更新 Remote-Target 为 Contact URI
 	if contact := resp.Headers.Get(message.HeaderContact); contact != "" {
 		addr, err := message.ParseAddress(contact)
@@ -0,0 +1,165 @@
+// Package event 定义 SIP 事件通知框架（RFC 6665）中的事件包与 Subscription-State 头域，
+// 并内置 presence（RFC 3856，PIDF 消息体）与 message-summary（RFC 3842，语音信箱 MWI）两个事件包。
+//
+// 订阅流程（订阅方 / 通知方）：
+//
+//	Subscriber                   Notifier
+//	 |--SUBSCRIBE (Event, Expires)->|
+//	 |<-200 OK----------------------|   建立订阅对话
+//	 |<-NOTIFY (Subscription-State)-|   立即通知当前状态
+//	 |--200 OK--------------------->|
+//	 |        ...状态变化...         |
+//	 |<-NOTIFY----------------------|
+//	 |--SUBSCRIBE (Expires: 0)----->|   退订（或带 Expires 刷新）
+//	 |<-NOTIFY (terminated)---------|
+//
+// 订阅对话、Expires 刷新与 NOTIFY 的收发由协议栈完成（见 stack/subscribe.go），
+// 事件包只负责资源状态与 NOTIFY 消息体。
+package event
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+)
+
+// Package 是一个事件包（RFC 6665 §7）。
+//
+// 资源以 Resource 规范化后的 URI 标识，状态变化时事件包调用 OnChange 登记的回调，
+// 协议栈据此向该资源的全部订阅者发送 NOTIFY。
+type Package interface {
+	// Name 是 Event 头域中的事件包名，如 "presence"。
+	Name() string
+	// ContentType 是 NOTIFY 消息体的 MIME 类型。
+	ContentType() string
+	// Body 返回资源当前状态的 NOTIFY 消息体。
+	Body(resource string) []byte
+	// OnChange 登记资源状态变化的回调。
+	OnChange(fn func(resource string))
+}
+
+// Resource 将 URI 规范化为资源键：scheme:user@host（主机名小写，去掉端口与参数），
+// 与 registrar.AOR 的规则一致，注册服务器的 AOR 可直接作为资源使用。
+func Resource(uri *message.URI) string {
+	if uri == nil {
+		return ""
+	}
+	res := strings.ToLower(uri.Scheme) + ":"
+	if uri.User != "" {
+		res += uri.User + "@"
+	}
+	return res + strings.ToLower(uri.Host)
+}
+
+// Name 返回 Event 头域值中的事件包名（去掉 id 等参数，小写）。
+func Name(event string) string {
+	name, _, _ := strings.Cut(event, ";")
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Key 返回标识一个订阅的事件键：事件包名加 id 参数（RFC 6665 §8.2.1），
+// 同一对话内同名事件的不同 id 是不同的订阅。
+func Key(event string) string {
+	parts := strings.Split(event, ";")
+	key := Name(parts[0])
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(strings.TrimSpace(k), "id") {
+			key += ";id=" + strings.TrimSpace(v)
+		}
+	}
+	return key
+}
+
+// 订阅状态（RFC 6665 §8.2.3）
+const (
+	StateActive     = "active"
+	StatePending    = "pending"
+	StateTerminated = "terminated"
+)
+
+// 订阅终止原因（RFC 6665 §4.1.3）
+const (
+	ReasonDeactivated = "deactivated"
+	ReasonProbation   = "probation"
+	ReasonRejected    = "rejected"
+	ReasonTimeout     = "timeout"
+	ReasonGiveUp      = "giveup"
+	ReasonNoResource  = "noresource"
+	ReasonInvariant   = "invariant"
+)
+
+// SubscriptionState 是 Subscription-State 头域：
+// active;expires=3600 / pending;expires=600 / terminated;reason=timeout;retry-after=30。
+type SubscriptionState struct {
+	State      string
+	Expires    int // active / pending 时订阅的剩余秒数，未携带时为 -1
+	Reason     string
+	RetryAfter int // 未携带时为 -1
+}
+
+// ParseSubscriptionState 解析 Subscription-State 头域。
+func ParseSubscriptionState(s string) (*SubscriptionState, error) {
+	parts := strings.Split(s, ";")
+	st := &SubscriptionState{State: strings.ToLower(strings.TrimSpace(parts[0])), Expires: -1, RetryAfter: -1}
+	if st.State == "" {
+		return nil, fmt.Errorf("invalid Subscription-State: %q", s)
+	}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		switch k {
+		case "expires", "retry-after":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid Subscription-State %s: %q", k, v)
+			}
+			if k == "expires" {
+				st.Expires = n
+			} else {
+				st.RetryAfter = n
+			}
+		case "reason":
+			st.Reason = strings.ToLower(v)
+		}
+	}
+	return st, nil
+}
+
+func (st *SubscriptionState) String() string {
+	s := st.State
+	if st.Reason != "" {
+		s += ";reason=" + st.Reason
+	}
+	if st.Expires >= 0 && st.State != StateTerminated {
+		s += ";expires=" + strconv.Itoa(st.Expires)
+	}
+	if st.RetryAfter >= 0 {
+		s += ";retry-after=" + strconv.Itoa(st.RetryAfter)
+	}
+	return s
+}
+
+// listeners 保存事件包的状态变化回调，供内置事件包复用。
+type listeners struct {
+	mu  sync.Mutex
+	fns []func(resource string)
+}
+
+func (l *listeners) OnChange(fn func(resource string)) {
+	l.mu.Lock()
+	l.fns = append(l.fns, fn)
+	l.mu.Unlock()
+}
+
+func (l *listeners) changed(resource string) {
+	l.mu.Lock()
+	fns := append(([]func(string))(nil), l.fns...)
+	l.mu.Unlock()
+	for _, fn := range fns {
+		fn(resource)
+	}
+}
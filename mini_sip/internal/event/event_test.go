@@ -0,0 +1,184 @@
+package event
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+)
+
+func TestResource(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"sip:bob@Example.COM:5070;transport=tcp", "sip:bob@example.com"},
+		{"SIPS:bob@example.com", "sips:bob@example.com"},
+		{"sip:example.com", "sip:example.com"},
+	}
+	for _, tt := range tests {
+		u, err := message.ParseURI(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Resource(u); got != tt.want {
+			t.Errorf("Resource(%s) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+	if got := Resource(nil); got != "" {
+		t.Errorf("Resource(nil) = %q", got)
+	}
+}
+
+func TestNameAndKey(t *testing.T) {
+	tests := []struct {
+		event string
+		name  string
+		key   string
+	}{
+		{"presence", "presence", "presence"},
+		{" Presence ;foo=bar", "presence", "presence"},
+		{"refer;id=93809824", "refer", "refer;id=93809824"},
+		{"refer; ID = 7 ;x=1", "refer", "refer;id=7"},
+	}
+	for _, tt := range tests {
+		if got := Name(tt.event); got != tt.name {
+			t.Errorf("Name(%q) = %q, want %q", tt.event, got, tt.name)
+		}
+		if got := Key(tt.event); got != tt.key {
+			t.Errorf("Key(%q) = %q, want %q", tt.event, got, tt.key)
+		}
+	}
+}
+
+func TestSubscriptionState(t *testing.T) {
+	tests := []struct {
+		in   string
+		want SubscriptionState
+		out  string
+	}{
+		{"active;expires=3600", SubscriptionState{StateActive, 3600, "", -1}, "active;expires=3600"},
+		{"Pending ; Expires=600", SubscriptionState{StatePending, 600, "", -1}, "pending;expires=600"},
+		{"active", SubscriptionState{StateActive, -1, "", -1}, "active"},
+		{"terminated;reason=Timeout", SubscriptionState{StateTerminated, -1, ReasonTimeout, -1}, "terminated;reason=timeout"},
+		{"terminated;reason=probation;retry-after=30", SubscriptionState{StateTerminated, -1, ReasonProbation, 30}, "terminated;reason=probation;retry-after=30"},
+		// terminated 时不再带 expires
+		{"terminated;expires=10", SubscriptionState{StateTerminated, 10, "", -1}, "terminated"},
+	}
+	for _, tt := range tests {
+		st, err := ParseSubscriptionState(tt.in)
+		if err != nil {
+			t.Fatalf("ParseSubscriptionState(%q): %v", tt.in, err)
+		}
+		if *st != tt.want {
+			t.Errorf("ParseSubscriptionState(%q) = %+v, want %+v", tt.in, *st, tt.want)
+		}
+		if got := st.String(); got != tt.out {
+			t.Errorf("%q String() = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+
+	for _, in := range []string{"", ";expires=10", "active;expires=soon", "active;expires=-1", "terminated;retry-after=x"} {
+		if _, err := ParseSubscriptionState(in); err == nil {
+			t.Errorf("ParseSubscriptionState(%q) accepted", in)
+		}
+	}
+}
+
+func TestPIDF(t *testing.T) {
+	tests := []struct {
+		name     string
+		st       PresenceStatus
+		basic    string
+		contacts []string
+	}{
+		{"closed without contacts", PresenceStatus{}, "closed", []string{""}},
+		{"open with contacts", PresenceStatus{Open: true, Contacts: []string{"sip:bob@192.0.2.8", "sip:bob@192.0.2.9"}, Note: "Online"},
+			"open", []string{"sip:bob@192.0.2.8", "sip:bob@192.0.2.9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParsePIDF(MarshalPIDF("sip:bob@example.com", tt.st))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.Entity != "sip:bob@example.com" || doc.Note != tt.st.Note || doc.Open() != tt.st.Open {
+				t.Errorf("PIDF = %+v", doc)
+			}
+			var contacts []string
+			for _, tuple := range doc.Tuples {
+				if tuple.Basic != tt.basic {
+					t.Errorf("tuple %s basic = %q, want %q", tuple.ID, tuple.Basic, tt.basic)
+				}
+				contacts = append(contacts, tuple.Contact)
+			}
+			if !slices.Equal(contacts, tt.contacts) {
+				t.Errorf("tuple contacts = %q, want %q", contacts, tt.contacts)
+			}
+		})
+	}
+
+	if _, err := ParsePIDF([]byte("<presence")); err == nil {
+		t.Error("ParsePIDF accepted truncated XML")
+	}
+}
+
+func TestPresenceChanges(t *testing.T) {
+	p := NewPresence()
+	var changed []string
+	p.OnChange(func(resource string) { changed = append(changed, resource) })
+
+	const bob = "sip:bob@example.com"
+	if p.Status(bob).Open {
+		t.Fatal("unknown resource reported open")
+	}
+	online := PresenceStatus{Open: true, Contacts: []string{"sip:bob@192.0.2.8"}}
+	p.Set(bob, online)
+	// 注册刷新等不改变状态的更新不通知
+	p.Set(bob, PresenceStatus{Open: true, Contacts: []string{"sip:bob@192.0.2.8"}})
+	p.Set(bob, PresenceStatus{Open: true, Contacts: []string{"sip:bob@192.0.2.9"}})
+	p.Set(bob, PresenceStatus{})
+	if want := []string{bob, bob, bob}; !slices.Equal(changed, want) {
+		t.Errorf("changes = %q, want %q", changed, want)
+	}
+	if p.Status(bob).Open {
+		t.Error("status still open after going offline")
+	}
+	// 第一次设置即使是 closed 也通知
+	p.Set("sip:carol@example.com", PresenceStatus{})
+	if len(changed) != 4 {
+		t.Errorf("first closed status not notified: %q", changed)
+	}
+}
+
+func TestMessageSummary(t *testing.T) {
+	m := Mailbox{Account: "sip:alice@example.com", New: 2, Old: 8, OldUrgent: 2}
+	body := MarshalMessageSummary(m)
+	want := "Messages-Waiting: yes\r\nMessage-Account: sip:alice@example.com\r\nVoice-Message: 2/8 (0/2)\r\n"
+	if string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	got, err := ParseMessageSummary(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != m {
+		t.Errorf("parsed %+v, want %+v", got, m)
+	}
+
+	for _, body := range []string{"Voice-Message: 1/0\r\n", "Messages-Waiting: yes\r\nVoice-Message: x/0\r\n", "Messages-Waiting: yes\r\nVoice-Message: 1/0 (a)\r\n"} {
+		if _, err := ParseMessageSummary([]byte(body)); err == nil {
+			t.Errorf("ParseMessageSummary(%q) accepted", body)
+		}
+	}
+
+	// 未设置过的信箱没有消息，Message-Account 为资源本身
+	s := NewMessageSummary()
+	got, err = ParseMessageSummary(s.Body("sip:bob@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Waiting() || got.Account != "sip:bob@example.com" {
+		t.Errorf("empty mailbox = %+v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package event
+
+import (
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// PresenceContentType 是 PIDF 消息体的 MIME 类型（RFC 3863）。
+const PresenceContentType = "application/pidf+xml"
+
+const pidfNamespace = "urn:ietf:params:xml:ns:pidf"
+
+// PresenceStatus 是一个资源的在线状态。
+type PresenceStatus struct {
+	Open     bool
+	Contacts []string // 资源当前可达的 Contact URI（如注册绑定）
+	Note     string
+}
+
+// PIDF 是 presence 文档（RFC 3863 §4）：
+//
+//	<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="sip:bob@example.com">
+//	  <tuple id="t1"><status><basic>open</basic></status><contact>sip:bob@10.0.0.8</contact></tuple>
+//	  <note>Online</note>
+//	</presence>
+type PIDF struct {
+	XMLName xml.Name    `xml:"urn:ietf:params:xml:ns:pidf presence"`
+	Entity  string      `xml:"entity,attr"`
+	Tuples  []PIDFTuple `xml:"tuple"`
+	Note    string      `xml:"note,omitempty"`
+}
+
+// PIDFTuple 是 PIDF 中的一个 tuple，对应资源的一个联系方式。
+type PIDFTuple struct {
+	ID      string `xml:"id,attr"`
+	Basic   string `xml:"status>basic"` // open / closed
+	Contact string `xml:"contact,omitempty"`
+}
+
+// Open 判断文档中是否有 tuple 处于 open 状态。
+func (p *PIDF) Open() bool {
+	for _, t := range p.Tuples {
+		if t.Basic == "open" {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePIDF 解析 PIDF 消息体。
+func ParsePIDF(body []byte) (*PIDF, error) {
+	var doc PIDF
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("parse PIDF: %w", err)
+	}
+	return &doc, nil
+}
+
+// MarshalPIDF 生成资源状态的 PIDF 文档：每个 Contact 一个 tuple，没有 Contact 时只有一个不带 contact 的 tuple。
+func MarshalPIDF(resource string, st PresenceStatus) []byte {
+	basic := "closed"
+	if st.Open {
+		basic = "open"
+	}
+	doc := PIDF{Entity: resource, Note: st.Note}
+	for i, c := range st.Contacts {
+		doc.Tuples = append(doc.Tuples, PIDFTuple{ID: fmt.Sprintf("t%d", i+1), Basic: basic, Contact: c})
+	}
+	if len(doc.Tuples) == 0 {
+		doc.Tuples = append(doc.Tuples, PIDFTuple{ID: "t1", Basic: basic})
+	}
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil
+	}
+	return append([]byte(xml.Header), append(out, '\n')...)
+}
+
+// Presence 是 presence 事件包（RFC 3856），保存各资源的在线状态。
+// 未设置过状态的资源视为 closed。
+type Presence struct {
+	listeners
+	mu     sync.RWMutex
+	states map[string]PresenceStatus
+}
+
+// NewPresence 创建 presence 事件包。
+func NewPresence() *Presence {
+	return &Presence{states: make(map[string]PresenceStatus)}
+}
+
+func (p *Presence) Name() string        { return "presence" }
+func (p *Presence) ContentType() string { return PresenceContentType }
+
+// Body 返回资源当前状态的 PIDF 文档。
+func (p *Presence) Body(resource string) []byte {
+	return MarshalPIDF(resource, p.Status(resource))
+}
+
+// Status 返回资源当前的在线状态。
+func (p *Presence) Status(resource string) PresenceStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.states[resource]
+}
+
+// Set 更新资源的在线状态，状态有变化时通知订阅者（注册刷新等不改变状态的更新不触发 NOTIFY）。
+func (p *Presence) Set(resource string, st PresenceStatus) {
+	p.mu.Lock()
+	old, ok := p.states[resource]
+	p.states[resource] = st
+	p.mu.Unlock()
+	if !ok || !old.equal(st) {
+		p.changed(resource)
+	}
+}
+
+func (st PresenceStatus) equal(o PresenceStatus) bool {
+	return st.Open == o.Open && st.Note == o.Note && slices.Equal(st.Contacts, o.Contacts)
+}
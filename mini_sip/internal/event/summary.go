@@ -0,0 +1,118 @@
+package event
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MessageSummaryContentType 是 message-summary 消息体的 MIME 类型（RFC 3842 §5）。
+const MessageSummaryContentType = "application/simple-message-summary"
+
+// Mailbox 是一个语音信箱的消息计数。
+type Mailbox struct {
+	Account   string // Message-Account，通常是信箱的 SIP URI
+	New       int
+	Old       int
+	NewUrgent int
+	OldUrgent int
+}
+
+// Waiting 表示是否有新消息（Messages-Waiting: yes）。
+func (m Mailbox) Waiting() bool {
+	return m.New > 0
+}
+
+// MarshalMessageSummary 生成 message-summary 消息体：
+//
+//	Messages-Waiting: yes
+//	Message-Account: sip:alice@example.com
+//	Voice-Message: 2/8 (0/2)
+func MarshalMessageSummary(m Mailbox) []byte {
+	var b bytes.Buffer
+	waiting := "no"
+	if m.Waiting() {
+		waiting = "yes"
+	}
+	fmt.Fprintf(&b, "Messages-Waiting: %s\r\n", waiting)
+	if m.Account != "" {
+		fmt.Fprintf(&b, "Message-Account: %s\r\n", m.Account)
+	}
+	fmt.Fprintf(&b, "Voice-Message: %d/%d (%d/%d)\r\n", m.New, m.Old, m.NewUrgent, m.OldUrgent)
+	return b.Bytes()
+}
+
+// ParseMessageSummary 解析 message-summary 消息体中的信箱与语音消息计数，忽略其他消息类别。
+func ParseMessageSummary(body []byte) (Mailbox, error) {
+	var m Mailbox
+	found := false
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		name, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "messages-waiting":
+			found = true
+		case "message-account":
+			m.Account = value
+		case "voice-message":
+			counts, urgent, _ := strings.Cut(value, "(")
+			if _, err := fmt.Sscanf(strings.TrimSpace(counts), "%d/%d", &m.New, &m.Old); err != nil {
+				return Mailbox{}, fmt.Errorf("invalid Voice-Message: %q", value)
+			}
+			if urgent = strings.TrimSuffix(strings.TrimSpace(urgent), ")"); urgent != "" {
+				if _, err := fmt.Sscanf(urgent, "%d/%d", &m.NewUrgent, &m.OldUrgent); err != nil {
+					return Mailbox{}, fmt.Errorf("invalid Voice-Message: %q", value)
+				}
+			}
+		}
+	}
+	if !found {
+		return Mailbox{}, fmt.Errorf("message-summary without Messages-Waiting")
+	}
+	return m, nil
+}
+
+// MessageSummary 是 message-summary 事件包（RFC 3842），保存各资源的语音信箱状态。
+type MessageSummary struct {
+	listeners
+	mu    sync.RWMutex
+	boxes map[string]Mailbox
+}
+
+// NewMessageSummary 创建 message-summary 事件包。
+func NewMessageSummary() *MessageSummary {
+	return &MessageSummary{boxes: make(map[string]Mailbox)}
+}
+
+func (s *MessageSummary) Name() string        { return "message-summary" }
+func (s *MessageSummary) ContentType() string { return MessageSummaryContentType }
+
+// Body 返回资源当前信箱状态的消息体，未设置过的信箱没有消息，Message-Account 为资源本身。
+func (s *MessageSummary) Body(resource string) []byte {
+	m := s.Mailbox(resource)
+	if m.Account == "" {
+		m.Account = resource
+	}
+	return MarshalMessageSummary(m)
+}
+
+// Mailbox 返回资源当前的信箱状态。
+func (s *MessageSummary) Mailbox(resource string) Mailbox {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.boxes[resource]
+}
+
+// Set 更新资源的信箱状态并通知订阅者。
+func (s *MessageSummary) Set(resource string, m Mailbox) {
+	s.mu.Lock()
+	s.boxes[resource] = m
+	s.mu.Unlock()
+	s.changed(resource)
+}
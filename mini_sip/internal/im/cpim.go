@@ -0,0 +1,152 @@
+// Package im 实现 SIP 即时消息（RFC 3428 MESSAGE，page-mode）的中继与离线存储转发。
+//
+// 服务器作为消息中继，按注册服务器的位置服务把 MESSAGE 投递到接收方的全部 Contact；
+// 接收方不在线时消息进入离线队列，在其下次 REGISTER 时投递：
+//
+//	Alice                    Relay                     Bob
+//	 |--MESSAGE bob@relay---->|                         |
+//	 |<-202 Accepted----------|   Bob 未注册：进入队列    |
+//	 |                        |<-REGISTER---------------|
+//	 |                        |--200 OK---------------->|
+//	 |                        |--MESSAGE (Date)-------->|   注册后投递排队的消息
+//	 |                        |<-200 OK-----------------|
+//
+// 消息体支持 text/plain 与 message/cpim（RFC 3862），其他类型回 415。
+package im
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 支持的消息体类型
+const (
+	ContentTypeText = "text/plain"
+	ContentTypeCPIM = "message/cpim"
+)
+
+// Accept 是 415 响应中声明的可接受类型。
+const Accept = ContentTypeText + ", " + ContentTypeCPIM
+
+// MediaType 返回 Content-Type 的媒体类型（去掉 charset 等参数，小写）。
+func MediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// Acceptable 判断 Content-Type 是否为支持的消息体类型。
+func Acceptable(contentType string) bool {
+	switch MediaType(contentType) {
+	case ContentTypeText, ContentTypeCPIM:
+		return true
+	}
+	return false
+}
+
+// CPIM 是 message/cpim 消息（RFC 3862）：消息头、内容的 MIME 头与内容。
+//
+//	From: Alice <sip:alice@example.com>
+//	To: <sip:bob@example.com>
+//	DateTime: 2024-05-01T10:00:00Z
+//
+//	Content-Type: text/plain
+//
+//	Hello Bob
+type CPIM struct {
+	From        string
+	To          string
+	DateTime    time.Time // 未携带时为零值
+	Subject     string
+	ContentType string
+	Body        []byte
+}
+
+// ParseCPIM 解析 message/cpim 消息体，要求包含 From 与内容的 Content-Type。
+func ParseCPIM(body []byte) (*CPIM, error) {
+	msgHeaders, rest, ok := cutSection(body)
+	if !ok {
+		return nil, fmt.Errorf("CPIM without message headers")
+	}
+	mimeHeaders, content, ok := cutSection(rest)
+	if !ok {
+		return nil, fmt.Errorf("CPIM without content headers")
+	}
+	c := &CPIM{Body: content}
+	for _, h := range msgHeaders {
+		name, value, _ := strings.Cut(h, ":")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "from":
+			c.From = value
+		case "to":
+			c.To = value
+		case "subject":
+			c.Subject = value
+		case "datetime":
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CPIM DateTime %q: %w", value, err)
+			}
+			c.DateTime = t
+		}
+	}
+	for _, h := range mimeHeaders {
+		name, value, _ := strings.Cut(h, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "content-type") {
+			c.ContentType = strings.TrimSpace(value)
+		}
+	}
+	if c.From == "" || c.ContentType == "" {
+		return nil, fmt.Errorf("CPIM without From or Content-Type")
+	}
+	return c, nil
+}
+
+// cutSection 读取到第一个空行为止的头域行，返回头域与其后的剩余部分。
+func cutSection(b []byte) (headers []string, rest []byte, ok bool) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	n := 0
+	for {
+		line, err := r.ReadString('\n')
+		n += len(line)
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" && (err == nil || len(line) > 0) {
+			return headers, b[n:], len(headers) > 0
+		}
+		if err != nil {
+			return nil, nil, false
+		}
+		headers = append(headers, trimmed)
+	}
+}
+
+// Marshal 序列化为 message/cpim 消息体。
+func (c *CPIM) Marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", c.From)
+	if c.To != "" {
+		fmt.Fprintf(&b, "To: %s\r\n", c.To)
+	}
+	if !c.DateTime.IsZero() {
+		fmt.Fprintf(&b, "DateTime: %s\r\n", c.DateTime.Format(time.RFC3339))
+	}
+	if c.Subject != "" {
+		fmt.Fprintf(&b, "Subject: %s\r\n", c.Subject)
+	}
+	fmt.Fprintf(&b, "\r\nContent-Type: %s\r\n\r\n", c.ContentType)
+	b.Write(c.Body)
+	return b.Bytes()
+}
+
+// Text 返回消息的文本内容：message/cpim 取其中的内容，解析失败时返回原始消息体。
+func Text(contentType string, body []byte) string {
+	if MediaType(contentType) == ContentTypeCPIM {
+		if c, err := ParseCPIM(body); err == nil {
+			return string(c.Body)
+		}
+	}
+	return string(body)
+}
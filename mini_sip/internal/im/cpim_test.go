@@ -0,0 +1,96 @@
+package im
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptable(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain", true},
+		{"Text/Plain; charset=UTF-8", true},
+		{"message/cpim", true},
+		{"Message/CPIM ;foo=bar", true},
+		{"text/html", false},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := Acceptable(tt.contentType); got != tt.want {
+			t.Errorf("Acceptable(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestParseCPIM(t *testing.T) {
+	crlf := func(s string) []byte { return []byte(strings.ReplaceAll(s, "\n", "\r\n")) }
+	tests := []struct {
+		name string
+		body []byte
+		want *CPIM // nil 表示应解析失败
+	}{
+		{"full", crlf("From: Alice <sip:alice@example.com>\nTo: <sip:bob@example.com>\nDateTime: 2024-05-01T10:00:00Z\nSubject: hi\n\nContent-Type: text/plain\n\nHello Bob"),
+			&CPIM{From: "Alice <sip:alice@example.com>", To: "<sip:bob@example.com>", DateTime: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+				Subject: "hi", ContentType: "text/plain", Body: []byte("Hello Bob")}},
+		{"bare LF", []byte("from: <sip:alice@example.com>\n\ncontent-type: text/plain; charset=UTF-8\n\nline 1\nline 2\n"),
+			&CPIM{From: "<sip:alice@example.com>", ContentType: "text/plain; charset=UTF-8", Body: []byte("line 1\nline 2\n")}},
+		{"empty content", crlf("From: <sip:alice@example.com>\n\nContent-Type: text/plain\n\n"),
+			&CPIM{From: "<sip:alice@example.com>", ContentType: "text/plain", Body: []byte{}}},
+		{"no From", crlf("To: <sip:bob@example.com>\n\nContent-Type: text/plain\n\nHi"), nil},
+		{"no Content-Type", crlf("From: <sip:alice@example.com>\n\nContent-Length: 2\n\nHi"), nil},
+		{"no content headers", crlf("From: <sip:alice@example.com>\n\nHi"), nil},
+		{"no message headers", crlf("\nContent-Type: text/plain\n\nHi"), nil},
+		{"bad DateTime", crlf("From: <sip:alice@example.com>\nDateTime: yesterday\n\nContent-Type: text/plain\n\nHi"), nil},
+		{"plain text", []byte("Hello Bob"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCPIM(tt.body)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("ParseCPIM accepted %q: %+v", tt.body, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.From != tt.want.From || got.To != tt.want.To || !got.DateTime.Equal(tt.want.DateTime) ||
+				got.Subject != tt.want.Subject || got.ContentType != tt.want.ContentType || string(got.Body) != string(tt.want.Body) {
+				t.Errorf("ParseCPIM = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPIMRoundTrip(t *testing.T) {
+	c := &CPIM{
+		From:        "<sip:alice@example.com>",
+		To:          "<sip:bob@example.com>",
+		DateTime:    time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		ContentType: "text/plain",
+		Body:        []byte("Hello\r\n\r\nBob"),
+	}
+	body := c.Marshal()
+	got, err := ParseCPIM(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.From != c.From || got.To != c.To || !got.DateTime.Equal(c.DateTime) || string(got.Body) != string(c.Body) {
+		t.Errorf("round trip = %+v, want %+v", got, c)
+	}
+	if got := Text("message/cpim", body); got != "Hello\r\n\r\nBob" {
+		t.Errorf("Text(cpim) = %q", got)
+	}
+	// 非 CPIM 或解析失败时返回原始消息体
+	if got := Text("message/cpim", []byte("not cpim")); got != "not cpim" {
+		t.Errorf("Text(invalid cpim) = %q", got)
+	}
+	if got := Text("text/plain", body); got != string(body) {
+		t.Errorf("Text(text/plain) = %q", got)
+	}
+}
@@ -0,0 +1,269 @@
+package im
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/registrar"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxAge 是离线消息的默认保存时长，超过后在投递前丢弃。
+const DefaultMaxAge = 7 * 24 * time.Hour
+
+// dateLayout 是 Date 头域的格式（RFC 3261 §20.17，RFC 1123 且固定为 GMT）。
+const dateLayout = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Relay 是 MESSAGE 中继：接受对话外的 MESSAGE 并以 202 应答，
+// 再由中继自己作为 UAC 把消息投递到接收方的每个 Contact。
+//
+// 一条消息只要有一个 Contact 以 2xx 接收即视为送达；全部 Contact 失败且其中有
+// 临时性失败（408 / 480 / 5xx / 超时 / 传输错误）时消息重新排队，等待接收方下次注册。
+type Relay struct {
+	stack     *stack.Stack
+	registrar *registrar.Registrar
+	store     Store
+	logger    *zap.Logger
+
+	// Auth 非 nil 时 MESSAGE 必须通过代理认证（407 Proxy-Authenticate）
+	Auth *auth.Authenticator
+	// MaxAge 是离线消息的保存时长，0 表示不过期
+	MaxAge time.Duration
+	// Now 是时钟，测试中可替换
+	Now func() time.Time
+
+	mu         sync.Mutex
+	deliveries map[*message.Request]*delivery // 投递出去的 MESSAGE -> 投递
+}
+
+// delivery 是一条消息对接收方全部 Contact 的一次投递。
+type delivery struct {
+	msg       *Message
+	pending   int  // 尚未得到最终结果的 Contact 数
+	delivered bool // 已有 Contact 以 2xx 接收
+	temporary bool // 有 Contact 临时性失败，全部失败时重新排队
+}
+
+// NewRelay 创建消息中继，reg 提供接收方的 Contact，store 为 nil 时使用 MemoryStore。
+func NewRelay(s *stack.Stack, reg *registrar.Registrar, store Store, logger *zap.Logger) *Relay {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Relay{
+		stack:      s,
+		registrar:  reg,
+		store:      store,
+		logger:     logger,
+		MaxAge:     DefaultMaxAge,
+		Now:        time.Now,
+		deliveries: make(map[*message.Request]*delivery),
+	}
+}
+
+// HandleRequest 处理对话外的 MESSAGE（RFC 3428 §7）：
+//
+//   - 没有消息体回 400，消息体类型不支持回 415（带 Accept），CPIM 格式错误回 400
+//   - 接收方有注册绑定时立即投递，否则进入离线队列（队列已满回 480）
+//   - 接受的消息回 202 Accepted：中继只保证转发，不代表接收方已读到
+func (r *Relay) HandleRequest(req *message.Request, tx *dialog.Transaction) {
+	if r.Auth != nil {
+		user, err := r.Auth.Verify(req, true)
+		if err != nil {
+			resp := stack.BuildResponse(req, message.StatusProxyAuthRequired, "")
+			r.Auth.Challenge(resp, true, errors.Is(err, auth.ErrStaleNonce))
+			r.respond(tx, resp)
+			return
+		}
+		r.logger.Info("message sender authenticated", zap.String("user", user))
+	}
+
+	contentType := req.Headers.Get(message.HeaderContentType)
+	switch {
+	case len(req.Body) == 0:
+		r.reply(req, tx, message.StatusBadRequest, "Empty Message")
+		return
+	case !Acceptable(contentType):
+		resp := stack.BuildResponse(req, message.StatusUnsupportedMediaType, "")
+		resp.Headers.Set(message.HeaderAccept, Accept)
+		r.respond(tx, resp)
+		return
+	case MediaType(contentType) == ContentTypeCPIM:
+		if _, err := ParseCPIM(req.Body); err != nil {
+			r.logger.Info("invalid CPIM message", zap.Error(err))
+			r.reply(req, tx, message.StatusBadRequest, "Invalid CPIM")
+			return
+		}
+	}
+	from, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
+	if err != nil || from.URI == nil {
+		r.reply(req, tx, message.StatusBadRequest, "Invalid From")
+		return
+	}
+
+	aor := registrar.AOR(req.RequestURI)
+	msg := &Message{
+		From:        from.URI.String(),
+		To:          aor,
+		ContentType: contentType,
+		Body:        req.Body,
+		Received:    r.Now(),
+	}
+	bindings, err := r.registrar.Lookup(aor)
+	if err != nil {
+		r.logger.Warn("location lookup failed", zap.Error(err))
+		r.reply(req, tx, message.StatusServerError, "")
+		return
+	}
+	if len(bindings) == 0 {
+		if err := r.store.Push(aor, msg); err != nil {
+			r.logger.Warn("queue message failed", zap.String("to", aor), zap.Error(err))
+			r.reply(req, tx, message.StatusTemporarilyUnavailable, "")
+			return
+		}
+		r.reply(req, tx, message.StatusAccepted, "")
+		r.logger.Info("message queued for offline recipient", zap.String("from", msg.From), zap.String("to", aor))
+		return
+	}
+	r.reply(req, tx, message.StatusAccepted, "")
+	contacts := make([]string, 0, len(bindings))
+	for _, b := range bindings {
+		contacts = append(contacts, b.Contact)
+	}
+	r.deliver(msg, contacts, false)
+}
+
+// Flush 把 aor 排队的消息投递到 contacts，在接收方注册后调用。
+func (r *Relay) Flush(aor string, contacts []string) {
+	if len(contacts) == 0 {
+		return
+	}
+	msgs, err := r.store.Take(aor)
+	if err != nil {
+		r.logger.Warn("load queued messages", zap.String("aor", aor), zap.Error(err))
+		return
+	}
+	now := r.Now()
+	for _, msg := range msgs {
+		if r.MaxAge > 0 && now.Sub(msg.Received) > r.MaxAge {
+			r.logger.Info("dropping expired message", zap.String("from", msg.From), zap.String("to", aor))
+			continue
+		}
+		r.deliver(msg, contacts, true)
+	}
+	if len(msgs) > 0 {
+		r.logger.Info("queued messages delivered", zap.String("aor", aor), zap.Int("count", len(msgs)))
+	}
+}
+
+// deliver 向每个 Contact 发送一个 MESSAGE；delayed 为 true 时带上中继收到消息的时间（Date）。
+func (r *Relay) deliver(msg *Message, contacts []string, delayed bool) {
+	d := &delivery{msg: msg, pending: len(contacts)}
+	for _, contact := range contacts {
+		uri, err := message.ParseURI(contact)
+		if err != nil {
+			r.logger.Warn("skip invalid contact", zap.String("contact", contact), zap.Error(err))
+			r.finish(d, nil, false, false)
+			continue
+		}
+		req, err := r.stack.BuildMessageRequest(msg.From, msg.To, msg.ContentType, msg.Body)
+		if err != nil {
+			r.logger.Warn("build MESSAGE", zap.Error(err))
+			r.finish(d, nil, false, false)
+			continue
+		}
+		req.RequestURI = uri
+		if delayed {
+			req.Headers.Set(message.HeaderDate, msg.Received.UTC().Format(dateLayout))
+		}
+		r.mu.Lock()
+		r.deliveries[req] = d
+		r.mu.Unlock()
+		if err := r.stack.SendRequest(req, stack.TargetAddr(uri)); err != nil {
+			r.logger.Warn("send MESSAGE", zap.String("contact", contact), zap.Error(err))
+			r.finish(d, req, false, true)
+		}
+	}
+}
+
+// finish 记录一个 Contact 的投递结果，全部 Contact 都失败且有临时性失败时消息重新排队。
+func (r *Relay) finish(d *delivery, req *message.Request, ok, temporary bool) {
+	r.mu.Lock()
+	if req != nil {
+		delete(r.deliveries, req)
+	}
+	d.pending--
+	d.delivered = d.delivered || ok
+	d.temporary = d.temporary || temporary
+	requeue := d.pending == 0 && !d.delivered && d.temporary
+	failed := d.pending == 0 && !d.delivered
+	r.mu.Unlock()
+
+	switch {
+	case requeue:
+		if err := r.store.Push(d.msg.To, d.msg); err != nil {
+			r.logger.Warn("requeue message failed", zap.String("to", d.msg.To), zap.Error(err))
+			return
+		}
+		r.logger.Info("message requeued until next registration", zap.String("to", d.msg.To))
+	case failed:
+		r.logger.Warn("message rejected by recipient", zap.String("from", d.msg.From), zap.String("to", d.msg.To))
+	case ok:
+		r.logger.Info("message delivered", zap.String("from", d.msg.From), zap.String("to", d.msg.To))
+	}
+}
+
+// lookup 返回中继投递出去的 MESSAGE 所属的投递。
+func (r *Relay) lookup(req *message.Request) *delivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deliveries[req]
+}
+
+// HandleResponse 处理投递的 MESSAGE 收到的响应，返回 false 表示不是中继发出的请求。
+func (r *Relay) HandleResponse(resp *message.Response, req *message.Request) bool {
+	d := r.lookup(req)
+	if d == nil {
+		return false
+	}
+	code := resp.StatusCode
+	if code >= 200 {
+		r.finish(d, req, code < 300, temporaryFailure(code))
+	}
+	return true
+}
+
+// HandleError 处理投递的 MESSAGE 事务失败（超时或传输错误），返回 false 表示不是中继发出的请求。
+func (r *Relay) HandleError(req *message.Request, err error) bool {
+	d := r.lookup(req)
+	if d == nil {
+		return false
+	}
+	r.logger.Info("message delivery failed", zap.String("to", d.msg.To), zap.Error(err))
+	r.finish(d, req, false, true)
+	return true
+}
+
+// temporaryFailure 判断投递失败是否值得在接收方下次注册时重试。
+func temporaryFailure(code int) bool {
+	return code == message.StatusRequestTimeout || code == message.StatusTemporarilyUnavailable ||
+		(code >= 500 && code < 600)
+}
+
+func (r *Relay) reply(req *message.Request, tx *dialog.Transaction, code int, reason string) {
+	resp := stack.BuildResponse(req, code, "")
+	if reason != "" {
+		resp.Reason = reason
+	}
+	r.respond(tx, resp)
+}
+
+func (r *Relay) respond(tx *dialog.Transaction, resp *message.Response) {
+	if err := tx.Respond(resp); err != nil {
+		r.logger.Warn("send MESSAGE response", zap.Int("code", resp.StatusCode), zap.Error(err))
+	}
+}
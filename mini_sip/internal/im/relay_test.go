@@ -0,0 +1,428 @@
+package im
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/registrar"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+// freeAddr 返回 127.0.0.1 上一个 UDP 与 TCP 当前都空闲的端口。
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		if pc, err := net.ListenPacket("udp", addr); err == nil {
+			pc.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+const bobAOR = "sip:bob@127.0.0.1"
+
+// peer 是回环测试中的用户代理：以 code（默认 200）应答 MESSAGE，记录收到的请求与响应。
+type peer struct {
+	s         *stack.Stack
+	addr      string
+	code      int
+	requests  chan *message.Request
+	responses chan *message.Response
+	ready     chan struct{}
+}
+
+func newPeer(t *testing.T, code int) *peer {
+	t.Helper()
+	p := &peer{
+		code:      code,
+		requests:  make(chan *message.Request, 16),
+		responses: make(chan *message.Response, 16),
+		ready:     make(chan struct{}),
+	}
+	s, err := stack.NewStack(freeAddr(t), p, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	p.s = s
+	p.addr = s.LocalAddr()
+	close(p.ready)
+	return p
+}
+
+func (p *peer) OnRequest(req *message.Request, tx *dialog.Transaction) {
+	<-p.ready
+	p.requests <- req
+	if tx != nil {
+		tx.Respond(stack.BuildResponse(req, p.code, ""))
+	}
+}
+
+func (p *peer) OnResponse(resp *message.Response, _ *message.Request) {
+	<-p.ready
+	p.responses <- resp
+}
+
+func (p *peer) OnError(*message.Request, error) {}
+
+// nextMessage 等待 peer 收到下一个 MESSAGE。
+func (p *peer) nextMessage(t *testing.T) *message.Request {
+	t.Helper()
+	for {
+		select {
+		case req := <-p.requests:
+			if req.Method == message.MethodMESSAGE {
+				return req
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for MESSAGE")
+		}
+	}
+}
+
+// noMessage 断言 wait 时间内 peer 没有收到 MESSAGE。
+func (p *peer) noMessage(t *testing.T, wait time.Duration) {
+	t.Helper()
+	deadline := time.After(wait)
+	for {
+		select {
+		case req := <-p.requests:
+			if req.Method == message.MethodMESSAGE {
+				t.Fatalf("unexpected MESSAGE %q", req.Body)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// send 由 p 经中继向 bob 发送 MESSAGE，返回最终响应。
+func (p *peer) send(t *testing.T, relayAddr, contentType, body string) *message.Response {
+	t.Helper()
+	req, err := p.s.BuildMessageRequest("sip:alice@"+p.addr, "sip:bob@"+relayAddr, contentType, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.s.SendRequest(req, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case resp := <-p.responses:
+			if resp.StatusCode >= 200 {
+				return resp
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the MESSAGE response")
+		}
+	}
+}
+
+// testRelay 是运行消息中继的服务器，与 cmd/server 一样在绑定变化时投递排队的消息。
+type testRelay struct {
+	r     *Relay
+	reg   *registrar.Registrar
+	store *MemoryStore
+	clock *dialog.ManualClock // 中继的时钟，决定离线消息的到达时间与是否过期
+	addr  string
+	ready chan struct{}
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	t.Helper()
+	tr := &testRelay{
+		reg:   registrar.New(registrar.NewMemoryStore(), zap.NewNop()),
+		store: NewMemoryStore(),
+		clock: dialog.NewManualClock(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)),
+		ready: make(chan struct{}),
+	}
+	s, err := stack.NewStack(freeAddr(t), tr, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	tr.addr = s.LocalAddr()
+	tr.r = NewRelay(s, tr.reg, tr.store, zap.NewNop())
+	tr.r.Now = tr.clock.Now
+	tr.reg.OnChange = func(aor string, bindings []*registrar.Binding) {
+		var contacts []string
+		for _, b := range bindings {
+			contacts = append(contacts, b.Contact)
+		}
+		if len(contacts) > 0 {
+			go tr.r.Flush(aor, contacts)
+		}
+	}
+	close(tr.ready)
+	return tr
+}
+
+func (tr *testRelay) OnRequest(req *message.Request, tx *dialog.Transaction) {
+	<-tr.ready
+	if req.Method == message.MethodMESSAGE {
+		tr.r.HandleRequest(req, tx)
+		return
+	}
+	if tx != nil {
+		tx.Respond(stack.BuildResponse(req, message.StatusOK, ""))
+	}
+}
+
+func (tr *testRelay) OnResponse(resp *message.Response, req *message.Request) {
+	<-tr.ready
+	tr.r.HandleResponse(resp, req)
+}
+
+func (tr *testRelay) OnError(req *message.Request, err error) {
+	<-tr.ready
+	tr.r.HandleError(req, err)
+}
+
+// register 为 bob 注册 phones 的地址，触发排队消息的投递。
+func (tr *testRelay) register(t *testing.T, phones ...*peer) {
+	t.Helper()
+	req := message.NewRequest(message.MethodREGISTER, &message.URI{Scheme: "sip", Host: "127.0.0.1"})
+	req.Headers.Set(message.HeaderVia, "SIP/2.0/UDP 127.0.0.1:5060;branch="+stack.NewBranch())
+	req.Headers.Set(message.HeaderFrom, "<"+bobAOR+">;tag=1")
+	req.Headers.Set(message.HeaderTo, "<"+bobAOR+">")
+	req.Headers.Set(message.HeaderCallID, stack.NewCallID("127.0.0.1"))
+	req.Headers.Set(message.HeaderCSeq, "1 REGISTER")
+	for _, p := range phones {
+		req.Headers.Add(message.HeaderContact, fmt.Sprintf("<sip:bob@%s>", p.addr))
+	}
+	if _, err := tr.reg.Register(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queued 返回 bob 当前排队的消息。
+func (tr *testRelay) queued() []*Message {
+	tr.store.mu.Lock()
+	defer tr.store.mu.Unlock()
+	return append([]*Message(nil), tr.store.queues[bobAOR]...)
+}
+
+// waitQueued 等待 bob 的队列中有 n 条消息。
+func (tr *testRelay) waitQueued(t *testing.T, n int) []*Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msgs := tr.queued()
+		if len(msgs) == n {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bob has %d queued messages, want %d", len(msgs), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMessageAccepted(t *testing.T) {
+	tests := []struct {
+		name   string
+		online bool
+	}{
+		{"online recipient", true},
+		{"offline recipient", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTestRelay(t)
+			alice := newPeer(t, message.StatusOK)
+			bob := newPeer(t, message.StatusOK)
+			if tt.online {
+				tr.register(t, bob)
+			}
+
+			// 中继只保证转发，两种情况都回 202
+			if resp := alice.send(t, tr.addr, "text/plain", "hello"); resp.StatusCode != message.StatusAccepted {
+				t.Fatalf("MESSAGE answered with %d, want 202", resp.StatusCode)
+			}
+			if !tt.online {
+				msgs := tr.waitQueued(t, 1)
+				if m := msgs[0]; m.From != "sip:alice@"+alice.addr || m.To != bobAOR || string(m.Body) != "hello" {
+					t.Errorf("queued %+v", m)
+				}
+				bob.noMessage(t, 100*time.Millisecond)
+				return
+			}
+			req := bob.nextMessage(t)
+			if string(req.Body) != "hello" || req.Headers.Get(message.HeaderContentType) != "text/plain" {
+				t.Errorf("delivered %q (%s)", req.Body, req.Headers.Get(message.HeaderContentType))
+			}
+			if got := req.RequestURI.String(); got != "sip:bob@"+bob.addr {
+				t.Errorf("Request-URI = %s, want the registered Contact", got)
+			}
+			// 立即投递不带 Date
+			if date := req.Headers.Get(message.HeaderDate); date != "" {
+				t.Errorf("immediate delivery carries Date %q", date)
+			}
+			if len(tr.waitQueued(t, 0)) != 0 {
+				t.Error("delivered message left in the queue")
+			}
+		})
+	}
+}
+
+func TestMessageRejected(t *testing.T) {
+	cpim := "From: <sip:alice@example.com>\r\n\r\nContent-Type: text/plain\r\n\r\nHi"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"unsupported type", "text/html", "<p>hi</p>", message.StatusUnsupportedMediaType},
+		{"empty body", "text/plain", "", message.StatusBadRequest},
+		{"invalid CPIM", "message/cpim", "Content-Type: text/plain\r\n\r\nHi", message.StatusBadRequest},
+		{"valid CPIM", "message/cpim", cpim, message.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTestRelay(t)
+			alice := newPeer(t, message.StatusOK)
+			resp := alice.send(t, tr.addr, tt.contentType, tt.body)
+			if resp.StatusCode != tt.code {
+				t.Fatalf("MESSAGE answered with %d, want %d", resp.StatusCode, tt.code)
+			}
+			accept := resp.Headers.Get(message.HeaderAccept)
+			if tt.code == message.StatusUnsupportedMediaType && accept != Accept {
+				t.Errorf("415 Accept = %q, want %q", accept, Accept)
+			}
+			want := 0
+			if tt.code == message.StatusAccepted {
+				want = 1
+			}
+			tr.waitQueued(t, want)
+		})
+	}
+}
+
+func TestDeliveryFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		codes   []int // bob 各个 Contact 的应答
+		requeue bool
+	}{
+		{"temporarily unavailable", []int{message.StatusTemporarilyUnavailable}, true},
+		{"server error", []int{message.StatusServiceUnavailable}, true},
+		{"request timeout", []int{message.StatusRequestTimeout}, true},
+		{"permanent failure", []int{message.StatusBusyHere}, false},
+		{"permanent and temporary", []int{message.StatusForbidden, message.StatusServiceUnavailable}, true},
+		{"one contact accepts", []int{message.StatusTemporarilyUnavailable, message.StatusOK}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTestRelay(t)
+			alice := newPeer(t, message.StatusOK)
+			var phones []*peer
+			for _, code := range tt.codes {
+				phones = append(phones, newPeer(t, code))
+			}
+			tr.register(t, phones...)
+
+			if resp := alice.send(t, tr.addr, "text/plain", "hello"); resp.StatusCode != message.StatusAccepted {
+				t.Fatalf("MESSAGE answered with %d, want 202", resp.StatusCode)
+			}
+			for _, p := range phones {
+				p.nextMessage(t)
+			}
+			if !tt.requeue {
+				// 等中继处理完全部响应后再确认没有重新排队
+				deadline := time.Now().Add(5 * time.Second)
+				for tr.pending() != 0 && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+				if msgs := tr.queued(); len(msgs) != 0 {
+					t.Fatalf("message requeued after %v", tt.codes)
+				}
+				return
+			}
+			if m := tr.waitQueued(t, 1)[0]; string(m.Body) != "hello" {
+				t.Errorf("requeued %+v", m)
+			}
+		})
+	}
+}
+
+// pending 返回中继尚未得到最终响应的投递数。
+func (tr *testRelay) pending() int {
+	tr.r.mu.Lock()
+	defer tr.r.mu.Unlock()
+	return len(tr.r.deliveries)
+}
+
+func TestFlushOnRegister(t *testing.T) {
+	tr := newTestRelay(t)
+	alice := newPeer(t, message.StatusOK)
+	bob := newPeer(t, message.StatusOK)
+
+	for i, body := range []string{"first", "second"} {
+		if i > 0 {
+			tr.clock.Advance(time.Minute)
+		}
+		if resp := alice.send(t, tr.addr, "text/plain", body); resp.StatusCode != message.StatusAccepted {
+			t.Fatalf("MESSAGE answered with %d", resp.StatusCode)
+		}
+		tr.waitQueued(t, i+1)
+	}
+	received := tr.clock.Now()
+
+	// bob 注册后投递全部排队消息（两端的协议栈并发处理，到达顺序不定），Date 为中继收到消息的时间
+	tr.clock.Advance(time.Hour)
+	tr.register(t, bob)
+	want := map[string]string{
+		"first":  received.Add(-time.Minute).Format(dateLayout),
+		"second": received.Format(dateLayout),
+	}
+	for range want {
+		req := bob.nextMessage(t)
+		date, ok := want[string(req.Body)]
+		if !ok {
+			t.Fatalf("delivered %q", req.Body)
+		}
+		if got := req.Headers.Get(message.HeaderDate); got != date {
+			t.Errorf("%s Date = %q, want %q", req.Body, got, date)
+		}
+	}
+	tr.waitQueued(t, 0)
+}
+
+func TestFlushDropsExpired(t *testing.T) {
+	tr := newTestRelay(t)
+	alice := newPeer(t, message.StatusOK)
+	bob := newPeer(t, message.StatusOK)
+
+	if resp := alice.send(t, tr.addr, "text/plain", "stale"); resp.StatusCode != message.StatusAccepted {
+		t.Fatalf("MESSAGE answered with %d", resp.StatusCode)
+	}
+	tr.waitQueued(t, 1)
+	tr.clock.Advance(tr.r.MaxAge)
+	if resp := alice.send(t, tr.addr, "text/plain", "fresh"); resp.StatusCode != message.StatusAccepted {
+		t.Fatalf("MESSAGE answered with %d", resp.StatusCode)
+	}
+	tr.waitQueued(t, 2)
+
+	// 超过 MaxAge 的消息在投递前丢弃，未超过的照常投递
+	tr.clock.Advance(time.Second)
+	tr.register(t, bob)
+	if req := bob.nextMessage(t); string(req.Body) != "fresh" {
+		t.Fatalf("delivered %q, want only the fresh message", req.Body)
+	}
+	bob.noMessage(t, 100*time.Millisecond)
+	tr.waitQueued(t, 0)
+}
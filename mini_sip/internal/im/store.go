@@ -0,0 +1,63 @@
+package im
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultQueueLimit 是每个接收方离线队列的默认容量。
+const DefaultQueueLimit = 100
+
+// ErrQueueFull 表示接收方的离线队列已满。
+var ErrQueueFull = errors.New("offline message queue full")
+
+// Message 是一条待投递的消息。
+//
+// 字段均为可序列化的基础类型，便于 Store 实现落盘。
+type Message struct {
+	From        string    `json:"from"`         // 发送方 URI
+	To          string    `json:"to"`           // 接收方 AOR
+	ContentType string    `json:"content_type"` // 原始 Content-Type（含参数）
+	Body        []byte    `json:"body"`
+	Received    time.Time `json:"received"` // 中继收到消息的时间，延迟投递时作为 Date 头域
+}
+
+// Store 是离线消息的存储接口，可替换为持久化实现。
+type Store interface {
+	// Push 把消息追加到接收方 aor 的队列末尾。
+	Push(aor string, m *Message) error
+	// Take 取出并删除 aor 的全部排队消息（按到达顺序）。
+	Take(aor string) ([]*Message, error)
+}
+
+// MemoryStore 是基于内存的 Store 实现，每个接收方最多保存 Limit 条消息。
+type MemoryStore struct {
+	Limit int
+
+	mu     sync.Mutex
+	queues map[string][]*Message
+}
+
+// NewMemoryStore 创建内存存储，容量为 DefaultQueueLimit。
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Limit: DefaultQueueLimit, queues: make(map[string][]*Message)}
+}
+
+func (m *MemoryStore) Push(aor string, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Limit > 0 && len(m.queues[aor]) >= m.Limit {
+		return ErrQueueFull
+	}
+	m.queues[aor] = append(m.queues[aor], msg)
+	return nil
+}
+
+func (m *MemoryStore) Take(aor string) ([]*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.queues[aor]
+	delete(m.queues, aor)
+	return list, nil
+}
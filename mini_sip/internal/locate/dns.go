@@ -0,0 +1,200 @@
+package locate
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	typeNAPTR      = dnsmessage.Type(35) // RFC 3403
+	dnsTimeout     = 3 * time.Second
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+// DNSResolver 是基于 DNS 的 Resolver：SRV 与 A / AAAA 使用 net.Resolver，
+// 标准库不支持的 NAPTR 直接以 UDP 向名称服务器查询。
+type DNSResolver struct {
+	// Server 是名称服务器地址（host:port）。为空时 NAPTR 查询使用 /etc/resolv.conf 的第一个 nameserver，
+	// SRV 与 A / AAAA 使用系统解析器；非空时所有查询都发往该服务器（如测试中的进程内 DNS 服务器）
+	Server string
+
+	resolver *net.Resolver
+}
+
+// NewDNSResolver 创建 DNS 解析器，server 为空时使用系统配置。
+func NewDNSResolver(server string) *DNSResolver {
+	r := &DNSResolver{Server: server, resolver: net.DefaultResolver}
+	if server != "" {
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r
+}
+
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, records, err := r.resolver.LookupSRV(ctx, "", "", name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return records, err
+}
+
+func (r *DNSResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := r.resolver.LookupHost(ctx, host)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return addrs, err
+}
+
+// LookupNAPTR 查询 name 的 NAPTR 记录。
+func (r *DNSResolver) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	server := r.Server
+	if server == "" {
+		var err error
+		if server, err = systemNameserver(); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("NAPTR %s: %w", name, err)
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: typeNAPTR, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("NAPTR %s: %w", name, err)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("NAPTR %s: %w", name, err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(dnsTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(packed); err != nil {
+		return nil, fmt.Errorf("NAPTR %s: %w", name, err)
+	}
+	buf := make([]byte, 4096)
+	var resp dnsmessage.Message
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("NAPTR %s: %w", name, err)
+		}
+		// 忽略不是本次查询的应答
+		if resp.Unpack(buf[:n]) == nil && resp.Response && resp.ID == query.ID {
+			break
+		}
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("NAPTR %s: %s", name, resp.RCode)
+	}
+
+	var records []NAPTR
+	for _, a := range resp.Answers {
+		body, ok := a.Body.(*dnsmessage.UnknownResource)
+		if a.Header.Type != typeNAPTR || !ok {
+			continue
+		}
+		rec, err := parseNAPTR(body.Data)
+		if err != nil {
+			return nil, fmt.Errorf("NAPTR %s: %w", name, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// parseNAPTR 解析 NAPTR 的 RDATA：ORDER、PREFERENCE、三个 character-string 与
+// 不压缩的 REPLACEMENT 域名（RFC 3403 §4.1）。
+func parseNAPTR(data []byte) (NAPTR, error) {
+	errShort := errors.New("short NAPTR record")
+	var rec NAPTR
+	if len(data) < 4 {
+		return rec, errShort
+	}
+	rec.Order = binary.BigEndian.Uint16(data[0:2])
+	rec.Preference = binary.BigEndian.Uint16(data[2:4])
+	data = data[4:]
+	for _, field := range []*string{&rec.Flags, &rec.Service, &rec.Regexp} {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return rec, errShort
+		}
+		*field = string(data[1 : 1+data[0]])
+		data = data[1+data[0]:]
+	}
+	var labels []string
+	for {
+		if len(data) < 1 {
+			return rec, errShort
+		}
+		n := int(data[0])
+		if n == 0 {
+			break
+		}
+		if n&0xC0 != 0 {
+			return rec, errors.New("compressed NAPTR replacement")
+		}
+		if len(data) < 1+n {
+			return rec, errShort
+		}
+		labels = append(labels, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	rec.Replacement = strings.Join(labels, ".")
+	return rec, nil
+}
+
+// isNotFound 判断查询错误是否表示名称或记录不存在。
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// systemNameserver 返回 /etc/resolv.conf 中的第一个 nameserver。
+func systemNameserver() (string, error) {
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		return "", fmt.Errorf("read nameserver: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", fmt.Errorf("no nameserver in %s", resolvConfPath)
+}
@@ -0,0 +1,268 @@
+// Package locate 实现 SIP 服务器定位（RFC 3263）。
+//
+// 给定下一跳 URI（Request-URI、Route 或出站代理），按以下顺序确定传输、端口与地址：
+//   - URI 显式指定 ;transport=、主机是 IP 地址或带端口时直接使用，不查询 NAPTR
+//   - 否则查询 NAPTR：按 order / preference 选择本端支持的服务（SIP+D2U / SIP+D2T / SIPS+D2T ...），
+//     替换域名即为 SRV 名称
+//   - 没有可用的 NAPTR 时按本端传输的优先顺序查询 SRV（_sip._udp / _sip._tcp / _sips._tcp）
+//   - SRV 目标按 priority 排序、同 priority 内按 weight 随机（RFC 2782），
+//     再经 A / AAAA 查询得到地址；都没有时对主机名查询 A / AAAA，使用默认端口
+//
+// 返回的目标按尝试顺序排列，调用方在超时或传输错误时依次改发下一个（RFC 3263 §4.3）。
+// DNS 查询经由 Resolver 接口完成，测试中可替换为进程内的假实现。
+package locate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// ErrNoTargets 表示 URI 没有解析出任何可用的目标。
+var ErrNoTargets = errors.New("no reachable targets")
+
+// Target 是一个下一跳：传输标识与 IP:port。
+type Target struct {
+	Network string // Via 传输标识（UDP / TCP / TLS ...）
+	Addr    string // IP:port
+}
+
+func (t Target) String() string {
+	return t.Network + " " + t.Addr
+}
+
+// NAPTR 是一条 NAPTR 记录（RFC 3403）。
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// Resolver 是定位所需的 DNS 查询。
+//
+// 查询不到记录时应返回空结果而不是错误；错误只表示查询本身失败（超时、服务器错误等）。
+type Resolver interface {
+	LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error)
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// naptrServices 把 NAPTR 服务字段映射到传输（RFC 3263 §4.1，RFC 7118 §7）。
+var naptrServices = map[string]string{
+	"SIP+D2U":  transport.NetworkUDP,
+	"SIP+D2T":  transport.NetworkTCP,
+	"SIPS+D2T": transport.NetworkTLS,
+	"SIP+D2W":  transport.NetworkWS,
+	"SIPS+D2W": transport.NetworkWSS,
+}
+
+// srvPrefixes 是没有 NAPTR 时各传输的 SRV 名称前缀（RFC 3263 §4.1）。
+var srvPrefixes = map[string]string{
+	transport.NetworkUDP: "_sip._udp.",
+	transport.NetworkTCP: "_sip._tcp.",
+	transport.NetworkTLS: "_sips._tcp.",
+}
+
+// Locator 按 RFC 3263 把 URI 解析为有序的目标列表。
+type Locator struct {
+	Resolver Resolver
+	// Networks 是本端启用的传输，顺序即没有 NAPTR 时查询 SRV 的优先顺序
+	Networks []string
+}
+
+// Locate 解析 u 指向的下一跳，maddr 参数优先于主机部分。
+func (l *Locator) Locate(ctx context.Context, u *message.URI) ([]Target, error) {
+	if !u.IsSIP() {
+		return nil, fmt.Errorf("locate %s: %w", u, ErrNoTargets)
+	}
+	host := u.Host
+	if maddr := u.Params.Get("maddr"); maddr != "" {
+		host = maddr
+	}
+	secure := u.Scheme == "sips"
+	network := strings.ToUpper(u.Params.Get("transport"))
+	if secure && (network == "" || network == transport.NetworkTCP) {
+		// sips: 默认且只能经由 TLS；;transport=tcp 在 sips 中表示 TLS over TCP（RFC 3263 §4.1）
+		network = transport.NetworkTLS
+	}
+	if network != "" && !l.supports(network) {
+		return nil, fmt.Errorf("locate %s: transport %s not enabled", u, network)
+	}
+	if secure && !transport.IsSecure(network) {
+		return nil, fmt.Errorf("locate %s: sips requires a secure transport, not %s", u, network)
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	switch {
+	case ip != nil:
+		if network == "" {
+			network = transport.NetworkUDP
+		}
+		return []Target{{Network: network, Addr: net.JoinHostPort(ip.String(), port(u.Port, network))}}, nil
+	case u.Port != 0:
+		if network == "" {
+			network = transport.NetworkUDP
+		}
+		return l.hostTargets(ctx, host, network, u.Port)
+	}
+
+	if network == "" {
+		targets, err := l.naptrTargets(ctx, host, secure)
+		if len(targets) > 0 || err != nil {
+			return targets, err
+		}
+		for _, n := range l.Networks {
+			if secure && !transport.IsSecure(n) {
+				continue
+			}
+			if targets, err := l.srvTargets(ctx, srvPrefixes[n], host, n); len(targets) > 0 || err != nil {
+				return targets, err
+			}
+		}
+		network = transport.NetworkUDP
+		if secure {
+			network = transport.NetworkTLS
+		}
+	} else if targets, err := l.srvTargets(ctx, srvPrefixes[network], host, network); len(targets) > 0 || err != nil {
+		return targets, err
+	}
+	return l.hostTargets(ctx, host, network, 0)
+}
+
+func (l *Locator) supports(network string) bool {
+	return slices.Contains(l.Networks, network)
+}
+
+// naptrTargets 按 NAPTR 选择传输（RFC 3263 §4.1）：只考虑 "s" 标志且本端支持的服务，
+// sips 只考虑 SIPS 服务；依次查询各记录的 SRV，第一个有结果的记录决定传输。
+// 某条记录的 SRV 目标都无法解析时继续尝试下一条，全部失败才返回错误。
+func (l *Locator) naptrTargets(ctx context.Context, host string, secure bool) ([]Target, error) {
+	records, err := l.Resolver.LookupNAPTR(ctx, host)
+	if err != nil || len(records) == 0 {
+		// NAPTR 查询失败不妨碍回退到 SRV / A 查询
+		return nil, nil
+	}
+	slices.SortStableFunc(records, func(a, b NAPTR) int {
+		if a.Order != b.Order {
+			return int(a.Order) - int(b.Order)
+		}
+		return int(a.Preference) - int(b.Preference)
+	})
+	var lastErr error
+	for _, r := range records {
+		network, ok := naptrServices[strings.ToUpper(r.Service)]
+		if !ok || !strings.EqualFold(r.Flags, "s") || !l.supports(network) {
+			continue
+		}
+		if secure && !transport.IsSecure(network) {
+			continue
+		}
+		targets, err := l.srvTargets(ctx, "", r.Replacement, network)
+		if errors.Is(err, ErrNoTargets) {
+			lastErr = err
+			continue
+		}
+		if len(targets) > 0 || err != nil {
+			return targets, err
+		}
+	}
+	return nil, lastErr
+}
+
+// srvTargets 查询 prefix+name 的 SRV 记录，按 RFC 2782 排序后解析各目标的地址；
+// 没有记录时返回空。
+func (l *Locator) srvTargets(ctx context.Context, prefix, name, network string) ([]Target, error) {
+	if prefix == "" && name == "" {
+		return nil, nil
+	}
+	records, err := l.Resolver.LookupSRV(ctx, prefix+name)
+	if err != nil || len(records) == 0 {
+		return nil, nil
+	}
+	var targets []Target
+	for _, srv := range orderSRV(records) {
+		if srv.Target == "." || srv.Target == "" {
+			// "." 表示该服务在此域名下不可用（RFC 2782）
+			continue
+		}
+		addrs, err := l.Resolver.LookupHost(ctx, strings.TrimSuffix(srv.Target, "."))
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			targets = append(targets, Target{Network: network, Addr: net.JoinHostPort(a, strconv.Itoa(int(srv.Port)))})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%w: SRV %s%s has no resolvable targets", ErrNoTargets, prefix, name)
+	}
+	return targets, nil
+}
+
+// hostTargets 对主机名查询 A / AAAA，port 为 0 时使用传输的默认端口。
+func (l *Locator) hostTargets(ctx context.Context, host, network string, p int) ([]Target, error) {
+	addrs, err := l.Resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("locate %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: %s has no addresses", ErrNoTargets, host)
+	}
+	targets := make([]Target, 0, len(addrs))
+	for _, a := range addrs {
+		targets = append(targets, Target{Network: network, Addr: net.JoinHostPort(a, port(p, network))})
+	}
+	return targets, nil
+}
+
+// port 返回 p，为 0 时返回传输的默认端口（TLS / WSS 为 5061，其余为 5060）。
+func port(p int, network string) string {
+	if p == 0 {
+		p = 5060
+		if transport.IsSecure(network) {
+			p = 5061
+		}
+	}
+	return strconv.Itoa(p)
+}
+
+// orderSRV 按 RFC 2782 排列 SRV 记录：priority 小的在前，
+// 同一 priority 内按 weight 加权随机抽取（weight 为 0 的记录被选中的机会很小但不为零）。
+func orderSRV(records []*net.SRV) []*net.SRV {
+	rest := slices.Clone(records)
+	slices.SortStableFunc(rest, func(a, b *net.SRV) int { return int(a.Priority) - int(b.Priority) })
+	out := make([]*net.SRV, 0, len(rest))
+	for len(rest) > 0 {
+		n := 1
+		for n < len(rest) && rest[n].Priority == rest[0].Priority {
+			n++
+		}
+		group := rest[:n]
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += int(r.Weight) + 1
+			}
+			pick := rand.Intn(total)
+			i := 0
+			for ; pick >= int(group[i].Weight)+1; i++ {
+				pick -= int(group[i].Weight) + 1
+			}
+			out = append(out, group[i])
+			group = slices.Delete(group, i, i+1)
+		}
+		rest = rest[n:]
+	}
+	return out
+}
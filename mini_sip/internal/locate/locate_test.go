@@ -0,0 +1,258 @@
+package locate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// fakeResolver 是按名称查表的 Resolver，记录查询过的名称。
+type fakeResolver struct {
+	naptr   map[string][]NAPTR
+	srv     map[string][]*net.SRV
+	hosts   map[string][]string
+	queries []string
+}
+
+func (r *fakeResolver) LookupNAPTR(_ context.Context, name string) ([]NAPTR, error) {
+	r.queries = append(r.queries, "NAPTR "+name)
+	return r.naptr[name], nil
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, name string) ([]*net.SRV, error) {
+	r.queries = append(r.queries, "SRV "+name)
+	return r.srv[name], nil
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.queries = append(r.queries, "A "+host)
+	return r.hosts[host], nil
+}
+
+var allNetworks = []string{transport.NetworkUDP, transport.NetworkTCP, transport.NetworkTLS}
+
+func locateURI(t *testing.T, r *fakeResolver, networks []string, uri string) ([]Target, error) {
+	t.Helper()
+	u, err := message.ParseURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Locator{Resolver: r, Networks: networks}
+	return l.Locate(context.Background(), u)
+}
+
+func TestLocateNAPTR(t *testing.T) {
+	r := &fakeResolver{
+		naptr: map[string][]NAPTR{"example.com": {
+			{Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"},
+			{Order: 10, Preference: 20, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com"},
+			{Order: 10, Preference: 10, Flags: "s", Service: "SIPS+D2T", Replacement: "_sips._tcp.example.com"},
+			{Order: 5, Preference: 10, Flags: "u", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"},
+		}},
+		srv: map[string][]*net.SRV{
+			"_sip._udp.example.com":  {{Target: "udp.example.com.", Port: 5060}},
+			"_sip._tcp.example.com":  {{Target: "tcp.example.com.", Port: 5070}},
+			"_sips._tcp.example.com": {{Target: "tls.example.com.", Port: 5071}},
+		},
+		hosts: map[string][]string{
+			"udp.example.com": {"192.0.2.1"},
+			"tcp.example.com": {"192.0.2.2"},
+			"tls.example.com": {"192.0.2.3"},
+		},
+	}
+	tests := []struct {
+		name     string
+		networks []string
+		want     Target
+	}{
+		// order 5 的记录不是 "s" 标志，跳过；order 10 中 preference 小的 SIPS+D2T 优先
+		{"lowest order and preference", allNetworks, Target{transport.NetworkTLS, "192.0.2.3:5071"}},
+		{"unsupported service skipped", []string{transport.NetworkUDP, transport.NetworkTCP}, Target{transport.NetworkTCP, "192.0.2.2:5070"}},
+		{"only UDP enabled", []string{transport.NetworkUDP}, Target{transport.NetworkUDP, "192.0.2.1:5060"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := locateURI(t, r, tt.networks, "sip:bob@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, []Target{tt.want}) {
+				t.Fatalf("targets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocateNAPTRSkipsUnresolvableRecord(t *testing.T) {
+	r := &fakeResolver{
+		naptr: map[string][]NAPTR{"example.com": {
+			{Order: 10, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com"},
+			{Order: 20, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"},
+		}},
+		srv: map[string][]*net.SRV{
+			"_sip._tcp.example.com": {{Target: "gone.example.com.", Port: 5060}},
+			"_sip._udp.example.com": {{Target: "udp.example.com.", Port: 5060}},
+		},
+		hosts: map[string][]string{"udp.example.com": {"192.0.2.1"}},
+	}
+	got, err := locateURI(t, r, allNetworks, "sip:bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Target{{transport.NetworkUDP, "192.0.2.1:5060"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("targets = %v, want %v", got, want)
+	}
+
+	// 所有 NAPTR 记录都无法解析时报错，不回退到 SRV / A 查询（RFC 3263 §4.1）
+	delete(r.hosts, "udp.example.com")
+	r.hosts["example.com"] = []string{"192.0.2.9"}
+	if got, err := locateURI(t, r, allNetworks, "sip:bob@example.com"); !errors.Is(err, ErrNoTargets) {
+		t.Fatalf("targets = %v, err = %v; want ErrNoTargets", got, err)
+	}
+}
+
+func TestLocateSips(t *testing.T) {
+	r := &fakeResolver{
+		naptr: map[string][]NAPTR{"example.com": {
+			{Order: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"},
+			{Order: 20, Flags: "s", Service: "SIPS+D2T", Replacement: "_sips._tcp.example.com"},
+		}},
+		srv: map[string][]*net.SRV{
+			"_sip._udp.example.com":  {{Target: "udp.example.com.", Port: 5060}},
+			"_sips._tcp.example.com": {{Target: "tls.example.com.", Port: 5061}},
+			"_sip._udp.example.net":  {{Target: "udp.example.com.", Port: 5060}},
+		},
+		hosts: map[string][]string{
+			"udp.example.com": {"192.0.2.1"},
+			"tls.example.com": {"192.0.2.3"},
+			"example.net":     {"192.0.2.4"},
+		},
+	}
+	tests := []struct {
+		name     string
+		uri      string
+		networks []string
+		want     []Target // 为空表示应当报错
+	}{
+		{"NAPTR", "sips:bob@example.com", allNetworks, []Target{{transport.NetworkTLS, "192.0.2.3:5061"}}},
+		{"no NAPTR", "sips:bob@example.net", allNetworks, []Target{{transport.NetworkTLS, "192.0.2.4:5061"}}},
+		{"transport=tcp means TLS", "sips:bob@example.net;transport=tcp", allNetworks, []Target{{transport.NetworkTLS, "192.0.2.4:5061"}}},
+		{"IP address", "sips:bob@192.0.2.5", allNetworks, []Target{{transport.NetworkTLS, "192.0.2.5:5061"}}},
+		{"transport=udp", "sips:bob@example.com;transport=udp", allNetworks, nil},
+		{"TLS not enabled", "sips:bob@example.com", []string{transport.NetworkUDP, transport.NetworkTCP}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := locateURI(t, r, tt.networks, tt.uri)
+			switch {
+			case tt.want == nil && err == nil:
+				t.Fatalf("targets = %v, want an error", got)
+			case tt.want != nil && err != nil:
+				t.Fatal(err)
+			case !reflect.DeepEqual(got, tt.want):
+				t.Fatalf("targets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocateFallback(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_sip._tcp.srv.example.com": {
+				{Target: "b.example.com.", Port: 5080, Priority: 20},
+				{Target: ".", Port: 5060, Priority: 5},
+				{Target: "a.example.com.", Port: 5070, Priority: 10},
+			},
+		},
+		hosts: map[string][]string{
+			"a.example.com":   {"192.0.2.1", "2001:db8::1"},
+			"b.example.com":   {"192.0.2.2"},
+			"srv.example.com": {"192.0.2.3"},
+			"a.example.net":   {"192.0.2.4"},
+		},
+	}
+	tests := []struct {
+		name    string
+		uri     string
+		want    []Target
+		queries []string
+	}{
+		{
+			"SRV in priority order", "sip:bob@srv.example.com",
+			[]Target{{transport.NetworkTCP, "192.0.2.1:5070"}, {transport.NetworkTCP, "[2001:db8::1]:5070"}, {transport.NetworkTCP, "192.0.2.2:5080"}},
+			[]string{"NAPTR srv.example.com", "SRV _sip._udp.srv.example.com", "SRV _sip._tcp.srv.example.com", "A a.example.com", "A b.example.com"},
+		},
+		{
+			"A record with default port", "sip:bob@a.example.net",
+			[]Target{{transport.NetworkUDP, "192.0.2.4:5060"}},
+			[]string{"NAPTR a.example.net", "SRV _sip._udp.a.example.net", "SRV _sip._tcp.a.example.net", "SRV _sips._tcp.a.example.net", "A a.example.net"},
+		},
+		{
+			"explicit port", "sip:bob@srv.example.com:5090",
+			[]Target{{transport.NetworkUDP, "192.0.2.3:5090"}},
+			[]string{"A srv.example.com"},
+		},
+		{
+			"explicit transport", "sip:bob@a.example.net;transport=tcp",
+			[]Target{{transport.NetworkTCP, "192.0.2.4:5060"}},
+			[]string{"SRV _sip._tcp.a.example.net", "A a.example.net"},
+		},
+		{
+			"maddr", "sip:bob@srv.example.com;maddr=192.0.2.7",
+			[]Target{{transport.NetworkUDP, "192.0.2.7:5060"}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.queries = nil
+			got, err := locateURI(t, r, allNetworks, tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("targets = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(r.queries, tt.queries) {
+				t.Fatalf("queries = %q, want %q", r.queries, tt.queries)
+			}
+		})
+	}
+
+	if _, err := locateURI(t, r, allNetworks, "sip:bob@missing.example.com"); !errors.Is(err, ErrNoTargets) {
+		t.Fatalf("err = %v, want ErrNoTargets for a name without records", err)
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	heavy := &net.SRV{Target: "heavy.", Priority: 10, Weight: 100}
+	light := &net.SRV{Target: "light.", Priority: 10, Weight: 0}
+	backup := &net.SRV{Target: "backup.", Priority: 20, Weight: 50}
+	first := &net.SRV{Target: "first.", Priority: 1, Weight: 0}
+	records := []*net.SRV{backup, light, heavy, first}
+
+	heavyFirst := 0
+	const rounds = 1000
+	for i := 0; i < rounds; i++ {
+		got := orderSRV(records)
+		if len(got) != 4 || got[0] != first || got[3] != backup {
+			t.Fatalf("order = %v, want priority 1, the priority 10 group, then priority 20", got)
+		}
+		if got[1] == heavy {
+			heavyFirst++
+		}
+	}
+	// weight 100 对 0 时 heavy 排在前面的概率为 101/102
+	if heavyFirst < rounds*9/10 {
+		t.Fatalf("heavy record first in %d of %d rounds", heavyFirst, rounds)
+	}
+	if !reflect.DeepEqual(records, []*net.SRV{backup, light, heavy, first}) {
+		t.Fatal("orderSRV modified its input")
+	}
+}
@@ -10,6 +10,7 @@ package message
 
 import (
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -28,10 +29,44 @@ const (
 	HeaderMaxForwards = "Max-Forwards"
 	HeaderUserAgent   = "User-Agent"
 	HeaderExpires     = "Expires"
+	HeaderMinExpires  = "Min-Expires"
+	HeaderRoute       = "Route"
+	HeaderRecordRoute = "Record-Route"
 	HeaderAllow       = "Allow"
 	HeaderAccept      = "Accept"
+	HeaderDate        = "Date"
 	HeaderWWWAuth     = "WWW-Authenticate"
 	HeaderAuthorize   = "Authorization"
+	HeaderProxyAuth   = "Proxy-Authenticate"
+	HeaderProxyAuthz  = "Proxy-Authorization"
+)
+
+// 扩展协商与会话计时器（RFC 3261 §20.32 / §20.37，RFC 4028）
+const (
+	HeaderSupported      = "Supported"
+	HeaderRequire        = "Require"
+	HeaderSessionExpires = "Session-Expires"
+	HeaderMinSE          = "Min-SE"
+)
+
+// 可靠临时响应（RFC 3262）
+const (
+	HeaderRSeq = "RSeq"
+	HeaderRAck = "RAck"
+)
+
+// 事件通知（RFC 6665）
+const (
+	HeaderEvent             = "Event"
+	HeaderAllowEvents       = "Allow-Events"
+	HeaderSubscriptionState = "Subscription-State"
+)
+
+// 呼叫转移（RFC 3515 REFER，RFC 3892 Referred-By，RFC 3891 Replaces）
+const (
+	HeaderReferTo    = "Refer-To"
+	HeaderReferredBy = "Referred-By"
+	HeaderReplaces   = "Replaces"
 )
 
 // shortForms 将紧凑头域名映射到完整名称（RFC 3261 §20）
@@ -43,35 +78,57 @@ var shortForms = map[string]string{
 	"m": HeaderContact,
 	"c": HeaderContentType,
 	"l": HeaderContentLen,
+	"e": "Content-Encoding",
+	"s": "Subject",
+	"k": HeaderSupported,
+	"x": HeaderSessionExpires,
+	"o": HeaderEvent,
+	"u": HeaderAllowEvents,
+	"r": HeaderReferTo,
+	"b": HeaderReferredBy,
 }
 
-// Header 表示单个 SIP 头域，允许同名多值（如多个 Via）。
+// Header 表示一个头域行，值按 listHeaders 拆分（如一行中逗号分隔的多个 Via）。
+//
+// 解析得到的头域保留原始行（名称写法、空白、折行与行结束符），值未被修改时
+// 序列化原样输出原始行，保证 Parse 之后 String 与线上字节一致。
 type Header struct {
-	Name   string
+	Name   string // 规范名
 	Values []string
+
+	raw       string   // 原始行，协议栈构造的头域为空
+	rawValues []string // 解析时的值，与 Values 不同表示已被修改
 }
 
 func (h Header) String() string {
 	return fmt.Sprintf("%s: %s", h.Name, strings.Join(h.Values, ", "))
 }
 
-// Headers 是有序头域集合，保留插入顺序（SIP 对部分头域顺序有要求）。
+// unmodified 判断头域是否保持解析时的值，可以原样输出原始行。
+func (h *Header) unmodified() bool {
+	return h.raw != "" && slices.Equal(h.Values, h.rawValues)
+}
+
+// Headers 是有序头域集合，按行保留线上顺序（同名头域可以不相邻，如分开的两行 Route）。
+// 按名称查找时忽略大小写并识别紧凑形式，同名多行的值按出现顺序合并。
 type Headers struct {
-	list  []*Header       // 保留顺序
-	index map[string]int  // 名称 -> list 下标（忽略大小写后的规范名）
+	list []*Header
 }
 
 func NewHeaders() *Headers {
-	return &Headers{index: make(map[string]int)}
+	return &Headers{}
 }
 
-// normalizeName 将紧凑形式转换为规范名，并统一大小写。
+// normalizeName 将紧凑形式转换为完整名称，并按 canonicalNames 统一写法。
 func normalizeName(name string) string {
 	lower := strings.ToLower(strings.TrimSpace(name))
 	if full, ok := shortForms[lower]; ok {
 		return full
 	}
-	// 首字母大写规范化（如 "call-id" -> "Call-Id"，保持 RFC 风格）
+	if canon, ok := canonicalNames[lower]; ok {
+		return canon
+	}
+	// 表外的扩展头域：各段首字母大写（如 "x-custom-id" -> "X-Custom-Id"）
 	parts := strings.Split(lower, "-")
 	for i, p := range parts {
 		if len(p) > 0 {
@@ -81,57 +138,194 @@ func normalizeName(name string) string {
 	return strings.Join(parts, "-")
 }
 
-// Add 追加一个头域值（同名时允许多值，符合 Via 等头域的规范）。
+// find 返回名称为 canon 的各行下标。
+func (h *Headers) find(canon string) []int {
+	var idx []int
+	for i, hd := range h.list {
+		if hd.Name == canon {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// addLine 追加解析得到的一行头域，raw 为包含行结束符的原始行。
+func (h *Headers) addLine(name, value, raw string) {
+	canon := normalizeName(name)
+	values := []string{value}
+	if listHeaders[canon] {
+		if split := SplitValues(value); len(split) > 0 {
+			values = split
+		}
+	}
+	h.list = append(h.list, &Header{Name: canon, Values: values, raw: raw, rawValues: slices.Clone(values)})
+}
+
+// Add 追加一个头域值（同名时追加到最后一行，符合 Via 等头域的规范）。
 func (h *Headers) Add(name, value string) {
 	canon := normalizeName(name)
-	if idx, ok := h.index[canon]; ok {
-		h.list[idx].Values = append(h.list[idx].Values, value)
-	} else {
-		h.index[canon] = len(h.list)
-		h.list = append(h.list, &Header{Name: canon, Values: []string{value}})
+	if idx := h.find(canon); len(idx) > 0 {
+		last := h.list[idx[len(idx)-1]]
+		last.Values = append(last.Values, value)
+		return
 	}
+	h.list = append(h.list, &Header{Name: canon, Values: []string{value}})
 }
 
-// Set 覆盖头域值（只保留最后设置的值）。
+// Set 覆盖头域值（只保留最后设置的值，位置为该头域第一次出现的位置）。
 func (h *Headers) Set(name, value string) {
 	canon := normalizeName(name)
-	if idx, ok := h.index[canon]; ok {
-		h.list[idx].Values = []string{value}
-	} else {
-		h.index[canon] = len(h.list)
+	idx := h.find(canon)
+	if len(idx) == 0 {
 		h.list = append(h.list, &Header{Name: canon, Values: []string{value}})
+		return
 	}
+	h.list[idx[0]].Values = []string{value}
+	h.removeLines(idx[1:])
+}
+
+// Insert 在同名头域的最前面插入一个值（代理压入 Via / Record-Route 时使用）。
+func (h *Headers) Insert(name, value string) {
+	canon := normalizeName(name)
+	if idx := h.find(canon); len(idx) > 0 {
+		first := h.list[idx[0]]
+		first.Values = append([]string{value}, first.Values...)
+		return
+	}
+	h.list = append(h.list, &Header{Name: canon, Values: []string{value}})
+}
+
+// RemoveFirst 删除并返回头域的第一个值（响应逐跳弹出 Via、代理弹出 Route）；
+// 所在行删除后没有值时整行被移除。
+func (h *Headers) RemoveFirst(name string) string {
+	for i, hd := range h.list {
+		if hd.Name != normalizeName(name) || len(hd.Values) == 0 {
+			continue
+		}
+		first := hd.Values[0]
+		hd.Values = hd.Values[1:]
+		if len(hd.Values) == 0 {
+			h.removeLines([]int{i})
+		}
+		return first
+	}
+	return ""
+}
+
+// Del 删除头域的所有值。
+func (h *Headers) Del(name string) {
+	h.removeLines(h.find(normalizeName(name)))
+}
+
+// removeLines 删除下标为 idx（升序）的各行。
+func (h *Headers) removeLines(idx []int) {
+	for i := len(idx) - 1; i >= 0; i-- {
+		h.list = slices.Delete(h.list, idx[i], idx[i]+1)
+	}
+}
+
+// Clone 深拷贝头域集合。
+func (h *Headers) Clone() *Headers {
+	n := &Headers{list: make([]*Header, len(h.list))}
+	for i, hd := range h.list {
+		n.list[i] = &Header{Name: hd.Name, Values: slices.Clone(hd.Values), raw: hd.raw, rawValues: hd.rawValues}
+	}
+	return n
 }
 
 // Get 返回头域的第一个值；未找到返回 ""。
 func (h *Headers) Get(name string) string {
-	canon := normalizeName(name)
-	if idx, ok := h.index[canon]; ok && len(h.list[idx].Values) > 0 {
-		return h.list[idx].Values[0]
+	for _, i := range h.find(normalizeName(name)) {
+		if len(h.list[i].Values) > 0 {
+			return h.list[i].Values[0]
+		}
 	}
 	return ""
 }
 
-// GetAll 返回头域的所有值。
+// GetAll 按出现顺序返回头域的所有值（同名多行合并）。
 func (h *Headers) GetAll(name string) []string {
-	canon := normalizeName(name)
-	if idx, ok := h.index[canon]; ok {
-		return h.list[idx].Values
+	var all []string
+	for _, i := range h.find(normalizeName(name)) {
+		all = append(all, h.list[i].Values...)
 	}
-	return nil
+	return all
 }
 
 // Exists 判断头域是否存在。
 func (h *Headers) Exists(name string) bool {
-	_, ok := h.index[normalizeName(name)]
-	return ok
+	return len(h.find(normalizeName(name))) > 0
+}
+
+// HasToken 判断逗号分隔的头域（如 Supported / Require / Allow）是否包含 token，忽略大小写。
+func (h *Headers) HasToken(name, token string) bool {
+	for _, v := range h.GetAll(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// List 按插入顺序返回所有头域（只读）。
+// AddToken 在逗号分隔的头域末尾追加 token，已包含时不做修改。
+func (h *Headers) AddToken(name, token string) {
+	if h.HasToken(name, token) {
+		return
+	}
+	if v := h.Get(name); v != "" {
+		h.Set(name, v+", "+token)
+		return
+	}
+	h.Set(name, token)
+}
+
+// List 按线上顺序返回所有头域行（只读）。
 func (h *Headers) List() []*Header {
 	return h.list
 }
 
+// writeTo 序列化头域：未修改的行输出原始行，其余每个值一行。
+//
+// Content-Length 按实际消息体长度 bodyLen 输出，只写一次；没有该头域时，
+// 消息体非空或 always 为 true（协议栈构造的消息）才补上。不修改 h，可与其他读者并发调用。
+func (h *Headers) writeTo(sb *strings.Builder, bodyLen int, always bool) {
+	length := strconv.Itoa(bodyLen)
+	seen := false
+	for _, hd := range h.list {
+		if hd.Name == HeaderContentLen {
+			if seen {
+				continue
+			}
+			seen = true
+			if hd.unmodified() && len(hd.Values) == 1 && hd.Values[0] == length {
+				sb.WriteString(hd.raw)
+			} else {
+				writeHeaderLine(sb, HeaderContentLen, length)
+			}
+			continue
+		}
+		if hd.unmodified() {
+			sb.WriteString(hd.raw)
+			continue
+		}
+		for _, v := range hd.Values {
+			writeHeaderLine(sb, hd.Name, v)
+		}
+	}
+	if !seen && (bodyLen > 0 || always) {
+		writeHeaderLine(sb, HeaderContentLen, length)
+	}
+}
+
+func writeHeaderLine(sb *strings.Builder, name, value string) {
+	sb.WriteString(name)
+	sb.WriteString(": ")
+	sb.WriteString(value)
+	sb.WriteString("\r\n")
+}
+
 // ---- Via 头域解析 ----
 // Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds
 // 说明：
@@ -143,51 +337,48 @@ func (h *Headers) List() []*Header {
 type Via struct {
 	Transport string
 	SentBy    string
-	Params    map[string]string // branch, rport, received 等
+	Params    Params // branch, rport, received 等，保留原顺序
 }
 
+// ParseVia 解析单个 Via 值（一行中的多个 Via 由 Headers 拆分），
+// sent-protocol 的 "/" 两侧、sent-by 的冒号两侧与参数分号两侧允许空白（LWS）。
 func ParseVia(v string) (*Via, error) {
-	// SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds
-	parts := strings.SplitN(v, " ", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid Via: %q", v)
-	}
-	proto := strings.Split(parts[0], "/")
-	if len(proto) != 3 {
-		return nil, fmt.Errorf("invalid Via protocol: %q", parts[0])
-	}
-	transport := strings.ToUpper(proto[2])
-
-	segments := strings.Split(parts[1], ";")
-	sentBy := strings.TrimSpace(segments[0])
-	params := make(map[string]string)
-	for _, seg := range segments[1:] {
-		seg = strings.TrimSpace(seg)
-		kv := strings.SplitN(seg, "=", 2)
-		if len(kv) == 2 {
-			params[strings.ToLower(kv[0])] = kv[1]
-		} else {
-			params[strings.ToLower(kv[0])] = ""
+	rest := strings.TrimSpace(v)
+	var proto [3]string
+	for i := range proto {
+		rest = strings.TrimLeft(rest, " \t")
+		n := 0
+		for n < len(rest) && tokenChar(rest[n]) {
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("invalid Via protocol: %q", v)
 		}
+		proto[i] = rest[:n]
+		rest = strings.TrimLeft(rest[n:], " \t")
+		if i < 2 {
+			if !strings.HasPrefix(rest, "/") {
+				return nil, fmt.Errorf("invalid Via protocol: %q", v)
+			}
+			rest = rest[1:]
+		}
+	}
+	if !strings.EqualFold(proto[0], "SIP") || proto[1] != "2.0" {
+		return nil, fmt.Errorf("unsupported Via protocol %s/%s: %q", proto[0], proto[1], v)
 	}
-	return &Via{Transport: transport, SentBy: sentBy, Params: params}, nil
+	sentBy, params, _ := strings.Cut(rest, ";")
+	sentBy = strings.Join(strings.Fields(sentBy), "")
+	if sentBy == "" {
+		return nil, fmt.Errorf("Via without sent-by: %q", v)
+	}
+	if _, _, err := parseHostPort(sentBy); err != nil {
+		return nil, fmt.Errorf("invalid Via sent-by: %w", err)
+	}
+	return &Via{Transport: strings.ToUpper(proto[2]), SentBy: sentBy, Params: parseParams(params)}, nil
 }
 
 func (v *Via) String() string {
-	var sb strings.Builder
-	sb.WriteString("SIP/2.0/")
-	sb.WriteString(v.Transport)
-	sb.WriteString(" ")
-	sb.WriteString(v.SentBy)
-	for k, val := range v.Params {
-		sb.WriteString(";")
-		sb.WriteString(k)
-		if val != "" {
-			sb.WriteString("=")
-			sb.WriteString(val)
-		}
-	}
-	return sb.String()
+	return "SIP/2.0/" + v.Transport + " " + v.SentBy + v.Params.String()
 }
 
 // ---- Address (From / To / Contact) 解析 ----
@@ -195,37 +386,62 @@ func (v *Via) String() string {
 // 或：sip:user@host（无尖括号形式）
 
 type Address struct {
-	DisplayName string
+	DisplayName string // 已去掉引号与转义
 	URI         *URI
-	Tag         string   // From/To 的 tag 参数
-	Params      map[string]string
+	Tag         string // From/To 的 tag 参数
+	Params      Params // tag 以外的头域参数，保留原顺序
 }
 
+// ParseAddress 解析 name-addr（[display-name] <URI>）或 addr-spec（URI）形式的地址与其参数。
+// display-name 可以是 token 序列或 quoted-string（其中可含 "<"、逗号与转义的引号）；
+// addr-spec 形式中第一个分号之后都是头域参数（RFC 3261 §20.10）。
 func ParseAddress(s string) (*Address, error) {
-	s = strings.TrimSpace(s)
-	addr := &Address{Params: make(map[string]string)}
+	rest := strings.TrimSpace(s)
+	addr := &Address{}
 
-	var uriStr string
-	var paramStr string
-
-	ltIdx := strings.Index(s, "<")
-	gtIdx := strings.Index(s, ">")
+	if strings.HasPrefix(rest, "\"") {
+		end := closingQuote(rest)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated display name: %q", s)
+		}
+		addr.DisplayName = Unquote(rest[:end+1])
+		rest = strings.TrimLeft(rest[end+1:], " \t")
+		if !strings.HasPrefix(rest, "<") {
+			return nil, fmt.Errorf("missing <URI> after display name: %q", s)
+		}
+	}
 
-	if ltIdx >= 0 && gtIdx > ltIdx {
-		addr.DisplayName = strings.TrimSpace(s[:ltIdx])
-		// 去掉引号
-		addr.DisplayName = strings.Trim(addr.DisplayName, "\"")
-		uriStr = s[ltIdx+1 : gtIdx]
-		paramStr = s[gtIdx+1:]
+	var uriStr, paramStr string
+	if lt := strings.IndexByte(rest, '<'); lt >= 0 {
+		gt := strings.IndexByte(rest[lt:], '>')
+		if gt < 0 {
+			return nil, fmt.Errorf("unterminated <URI>: %q", s)
+		}
+		if lt > 0 {
+			// 未加引号的显示名只能由 token 组成（RFC 4475 baddn）
+			words := strings.Fields(rest[:lt])
+			for _, w := range words {
+				if !isToken(w) {
+					return nil, fmt.Errorf("display name must be quoted: %q", s)
+				}
+			}
+			addr.DisplayName = strings.Join(words, " ")
+		}
+		uriStr = rest[lt+1 : lt+gt]
+		paramStr = strings.TrimLeft(rest[lt+gt+1:], " \t")
+		if uriStr != strings.TrimSpace(uriStr) {
+			return nil, fmt.Errorf("whitespace inside <URI>: %q", s)
+		}
+		if paramStr != "" && paramStr[0] != ';' {
+			return nil, fmt.Errorf("unexpected text after <URI>: %q", s)
+		}
 	} else {
-		// 无尖括号：sip:user@host;tag=xxx
-		// URI 到第一个 ; 为止
-		semiIdx := strings.Index(s, ";")
-		if semiIdx >= 0 {
-			uriStr = s[:semiIdx]
-			paramStr = s[semiIdx:]
-		} else {
-			uriStr = s
+		// 无尖括号：sip:user@host;tag=xxx，URI 到第一个 ; 为止；
+		// 含逗号、问号的 URI 必须放在尖括号内（RFC 3261 §20，RFC 4475 regbadct）
+		uriStr, paramStr, _ = strings.Cut(rest, ";")
+		uriStr = strings.TrimRight(uriStr, " \t")
+		if strings.ContainsAny(uriStr, ",?") {
+			return nil, fmt.Errorf("URI with ',' or '?' must be enclosed in <>: %q", s)
 		}
 	}
 
@@ -236,32 +452,34 @@ func ParseAddress(s string) (*Address, error) {
 	addr.URI = uri
 
 	// 解析地址级参数（;tag=xxx）
-	for _, seg := range strings.Split(strings.TrimPrefix(paramStr, ";"), ";") {
-		seg = strings.TrimSpace(seg)
-		if seg == "" {
+	for _, p := range parseParams(paramStr) {
+		if strings.EqualFold(p.Name, "tag") {
+			addr.Tag = p.Value
 			continue
 		}
-		kv := strings.SplitN(seg, "=", 2)
-		key := strings.ToLower(kv[0])
-		val := ""
-		if len(kv) == 2 {
-			val = kv[1]
-		}
-		if key == "tag" {
-			addr.Tag = val
-		} else {
-			addr.Params[key] = val
-		}
+		addr.Params = append(addr.Params, p)
 	}
 	return addr, nil
 }
 
+// closingQuote 返回以引号开头的 s 中与之配对的结束引号位置（跳过 quoted-pair），没有时为 -1。
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
 func (a *Address) String() string {
 	var sb strings.Builder
 	if a.DisplayName != "" {
-		sb.WriteString("\"")
-		sb.WriteString(a.DisplayName)
-		sb.WriteString("\" ")
+		sb.WriteString(Quote(a.DisplayName))
+		sb.WriteString(" ")
 	}
 	sb.WriteString("<")
 	sb.WriteString(a.URI.String())
@@ -270,14 +488,7 @@ func (a *Address) String() string {
 		sb.WriteString(";tag=")
 		sb.WriteString(a.Tag)
 	}
-	for k, v := range a.Params {
-		sb.WriteString(";")
-		sb.WriteString(k)
-		if v != "" {
-			sb.WriteString("=")
-			sb.WriteString(v)
-		}
-	}
+	sb.WriteString(a.Params.String())
 	return sb.String()
 }
 
@@ -295,8 +506,11 @@ func ParseCSeq(s string) (*CSeq, error) {
 		return nil, fmt.Errorf("invalid CSeq: %q", s)
 	}
 	n, err := strconv.ParseUint(parts[0], 10, 32)
-	if err != nil {
-		return nil, fmt.Errorf("invalid CSeq number: %w", err)
+	if err != nil || !isDigits(parts[0]) {
+		return nil, fmt.Errorf("invalid CSeq number: %q", parts[0])
+	}
+	if !isToken(parts[1]) {
+		return nil, fmt.Errorf("invalid CSeq method: %q", parts[1])
 	}
 	return &CSeq{Seq: uint32(n), Method: strings.ToUpper(parts[1])}, nil
 }
@@ -304,3 +518,71 @@ func ParseCSeq(s string) (*CSeq, error) {
 func (c *CSeq) String() string {
 	return fmt.Sprintf("%d %s", c.Seq, c.Method)
 }
+
+// ---- RAck 解析 ----
+// RAck: 776656 1 INVITE（RFC 3262 §7.2：所确认响应的 RSeq、CSeq 序号与方法）
+
+type RAck struct {
+	RSeq   uint32
+	Seq    uint32
+	Method string
+}
+
+func ParseRAck(s string) (*RAck, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid RAck: %q", s)
+	}
+	rseq, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RAck response number: %w", err)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RAck CSeq number: %w", err)
+	}
+	return &RAck{RSeq: uint32(rseq), Seq: uint32(seq), Method: strings.ToUpper(parts[2])}, nil
+}
+
+func (r *RAck) String() string {
+	return fmt.Sprintf("%d %d %s", r.RSeq, r.Seq, r.Method)
+}
+
+// ---- Replaces 解析 ----
+// Replaces: 98732@sip.example.com;to-tag=ff87ff;from-tag=r33th4x0r[;early-only]（RFC 3891 §6.1）
+// to-tag / from-tag 以收到 INVITE 的一方为视角：to-tag 是其本端 tag，from-tag 是对端 tag。
+
+type Replaces struct {
+	CallID    string
+	ToTag     string
+	FromTag   string
+	EarlyOnly bool
+}
+
+func ParseReplaces(s string) (*Replaces, error) {
+	parts := strings.Split(s, ";")
+	r := &Replaces{CallID: strings.TrimSpace(parts[0])}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "to-tag":
+			r.ToTag = strings.TrimSpace(v)
+		case "from-tag":
+			r.FromTag = strings.TrimSpace(v)
+		case "early-only":
+			r.EarlyOnly = true
+		}
+	}
+	if r.CallID == "" || r.ToTag == "" || r.FromTag == "" {
+		return nil, fmt.Errorf("invalid Replaces: %q", s)
+	}
+	return r, nil
+}
+
+func (r *Replaces) String() string {
+	s := fmt.Sprintf("%s;to-tag=%s;from-tag=%s", r.CallID, r.ToTag, r.FromTag)
+	if r.EarlyOnly {
+		s += ";early-only"
+	}
+	return s
+}
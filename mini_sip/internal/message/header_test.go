@@ -0,0 +1,167 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+// serialize 把 Parse 的结果重新序列化。
+func serialize(t *testing.T, m interface{}) string {
+	t.Helper()
+	switch msg := m.(type) {
+	case *Request:
+		return msg.String()
+	case *Response:
+		return msg.String()
+	}
+	t.Fatalf("Parse returned %T", m)
+	return ""
+}
+
+func TestRoundTripRFC4475(t *testing.T) {
+	// dblreq 的第二条消息在 Content-Length 之后，按规定被丢弃，不参与往返比较
+	for _, name := range []string{
+		"wsinv", "intmeth", "esc01", "escnull", "esc02", "lwsdisp", "longreq",
+		"semiuri", "transports", "mpart01", "unreason", "noreason",
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := readCorpus(t, "valid", name)
+			m, err := Parse(data)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := serialize(t, m); got != string(data) {
+				t.Errorf("round trip differs:\n got %q\nwant %q", got, data)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{"compact forms", "INVITE sip:bob@example.com SIP/2.0\n" +
+			"v: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1\n" +
+			"f: <sip:alice@example.com>;tag=1\n" +
+			"t: sip:bob@example.com\n" +
+			"i: rt1@192.0.2.1\n" +
+			"CSeq: 1 INVITE\n" +
+			"m: <sip:alice@192.0.2.1>\n" +
+			"k: 100rel\n" +
+			"l: 0\n"},
+		{"folded lines", "OPTIONS sip:bob@example.com SIP/2.0\n" +
+			"Via: SIP/2.0/UDP 192.0.2.1\n" +
+			"  ;branch=z9hG4bK2\n" +
+			"From: <sip:alice@example.com>\n" +
+			"\t;tag=2\n" +
+			"To: sip:bob@example.com\n" +
+			"Call-ID: rt2@192.0.2.1\n" +
+			"CSeq: 2\n" +
+			"   OPTIONS\n" +
+			"Accept: application/sdp,\n" +
+			"        message/sipfrag\n" +
+			"Content-Length: 0\n"},
+		{"odd spacing", "REGISTER sip:example.com SIP/2.0\n" +
+			"Via  :   SIP / 2.0 / TCP   192.0.2.1 ; branch = z9hG4bK3\n" +
+			"From:<sip:alice@example.com>  ;  tag=3\n" +
+			"To :sip:alice@example.com\n" +
+			"Call-ID:rt3@192.0.2.1\n" +
+			"CSeq:   3    REGISTER\n" +
+			"Max-Forwards:70\n" +
+			"Contact: <sip:alice@192.0.2.1>;expires=60 , <sip:alice@198.51.100.1>\n" +
+			"Content-Length :0\n"},
+		{"params with and without values", "SIP/2.0 200 OK\n" +
+			"Via: SIP/2.0/UDP 192.0.2.1;rport;received=192.0.2.9;branch=z9hG4bK4\n" +
+			"From: <sip:alice@example.com;lr;transport=tcp>;tag=4;flag\n" +
+			"To: \"Bob \\\"B\\\"\" <sip:bob@example.com>;tag=b;x=\"quoted;value\"\n" +
+			"Call-ID: rt4@192.0.2.1\n" +
+			"CSeq: 4 INVITE\n" +
+			"Record-Route: <sip:p1.example.com;lr>,<sip:p2.example.com;lr;ftag=4>\n" +
+			"X-Unknown: ;;,,;;,;\n" +
+			"Content-Length: 0\n"},
+		// UDP 上 Content-Length 可以省略，序列化时不补上
+		{"request without Content-Length", "BYE sip:bob@192.0.2.2 SIP/2.0\n" +
+			"Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK5\n" +
+			"From: <sip:alice@example.com>;tag=5\n" +
+			"To: <sip:bob@example.com>;tag=b\n" +
+			"Call-ID: rt5@192.0.2.1\n" +
+			"CSeq: 5 BYE\n" +
+			"Max-Forwards: 70\n"},
+		{"response without Content-Length", "SIP/2.0 180 Ringing\n" +
+			"Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK6\n" +
+			"From: <sip:alice@example.com>;tag=6\n" +
+			"To: <sip:bob@example.com>;tag=b\n" +
+			"Call-ID: rt6@192.0.2.1\n" +
+			"CSeq: 6 INVITE\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := strings.ReplaceAll(tt.msg, "\n", "\r\n") + "\r\n"
+			m, err := Parse([]byte(data))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := serialize(t, m); got != data {
+				t.Errorf("round trip differs:\n got %q\nwant %q", got, data)
+			}
+		})
+	}
+}
+
+func TestStringContentLength(t *testing.T) {
+	const parsed = "MESSAGE sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK7\r\n" +
+		"From: <sip:alice@example.com>;tag=7\r\n" +
+		"To: <sip:bob@example.com>\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Call-ID: cl@192.0.2.1\r\n" +
+		"CSeq: 7 MESSAGE\r\n"
+	build := func() *Request {
+		return NewRequest(MethodMESSAGE, &URI{Scheme: "sip", User: "bob", Host: "example.com"})
+	}
+	parse := func(raw string) *Request {
+		m, err := Parse([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.(*Request)
+	}
+	tests := []struct {
+		name string
+		req  *Request
+		body string
+		want string // 期望的 Content-Length 行，为空表示不应出现
+	}{
+		{"built without body", build(), "", "Content-Length: 0\r\n"},
+		{"built with body", build(), "hello", "Content-Length: 5\r\n"},
+		{"parsed without header or body", parse(parsed + "\r\n"), "", ""},
+		{"parsed without header, body added", parse(parsed + "\r\n"), "hi", "Content-Length: 2\r\n"},
+		{"parsed, body changed", parse(parsed + "l: 5\r\n\r\nhello"), "hi", "Content-Length: 2\r\n"},
+		{"parsed, body unchanged", parse(parsed + "l: 5\r\n\r\nhello"), "hello", "l: 5\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Body = []byte(tt.body)
+			before := tt.req.Headers.GetAll(HeaderContentLen)
+			got := tt.req.String()
+			head := got[:strings.Index(got, "\r\n\r\n")+2]
+			switch {
+			case tt.want == "" && (strings.Contains(head, "Content-Length") || strings.Contains(head, "\nl:")):
+				t.Errorf("unexpected Content-Length in\n%s", got)
+			case tt.want != "" && !strings.Contains(head, "\n"+tt.want):
+				t.Errorf("missing %q in\n%s", tt.want, got)
+			case strings.Count(head, "Content-Length")+strings.Count(head, "\nl:") > 1:
+				t.Errorf("Content-Length written twice in\n%s", got)
+			}
+			if !strings.HasSuffix(got, "\r\n\r\n"+tt.body) {
+				t.Errorf("body not at the end of\n%s", got)
+			}
+			// String 不修改头域
+			if after := tt.req.Headers.GetAll(HeaderContentLen); strings.Join(after, ",") != strings.Join(before, ",") {
+				t.Errorf("String changed Content-Length from %q to %q", before, after)
+			}
+		})
+	}
+}
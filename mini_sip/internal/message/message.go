@@ -1,8 +1,6 @@
 package message
 
 import (
-	"bytes"
-	"fmt"
 	"strconv"
 	"strings"
 )
@@ -45,6 +43,8 @@ type Request struct {
 	RequestURI *URI
 	Headers    *Headers
 	Body       []byte
+
+	wire wire // 解析得到的原始起始行与结束空行
 }
 
 // NewRequest 创建一条带基础头域的请求。
@@ -61,34 +61,32 @@ func NewRequest(method Method, requestURI *URI) *Request {
 func (r *Request) String() string {
 	var sb strings.Builder
 	// 请求行
-	sb.WriteString(string(r.Method))
-	sb.WriteString(" ")
-	sb.WriteString(r.RequestURI.String())
-	sb.WriteString(" ")
-	sb.WriteString(SIPVersion)
-	sb.WriteString("\r\n")
-	// 确保 Content-Length 正确
-	if len(r.Body) > 0 {
-		r.Headers.Set(HeaderContentLen, strconv.Itoa(len(r.Body)))
-	} else {
-		r.Headers.Set(HeaderContentLen, "0")
-	}
-	// 头域
-	for _, h := range r.Headers.List() {
-		for _, v := range h.Values {
-			sb.WriteString(h.Name)
-			sb.WriteString(": ")
-			sb.WriteString(v)
-			sb.WriteString("\r\n")
-		}
-	}
-	sb.WriteString("\r\n")
+	r.wire.writeStart(&sb, r.startLine())
+	// 头域；Content-Length 按消息体长度输出，不修改 r.Headers（重传计时器会并发调用 String）
+	r.Headers.writeTo(&sb, len(r.Body), !r.wire.parsed())
+	r.wire.writeEnd(&sb)
 	if len(r.Body) > 0 {
 		sb.Write(r.Body)
 	}
 	return sb.String()
 }
 
+// startLine 按字段序列化请求行（不含行结束符）。
+func (r *Request) startLine() string {
+	return string(r.Method) + " " + r.RequestURI.String() + " " + SIPVersion
+}
+
+// Clone 深拷贝请求（代理转发、分叉时每个分支需要独立的副本）。
+func (r *Request) Clone() *Request {
+	return &Request{
+		Method:     r.Method,
+		RequestURI: r.RequestURI.Clone(),
+		Headers:    r.Headers.Clone(),
+		Body:       append([]byte(nil), r.Body...),
+		wire:       r.wire,
+	}
+}
+
 // ---- Response ----
 
 // Response 表示一条 SIP 响应消息。
@@ -105,25 +103,39 @@ type Response struct {
 	Reason     string
 	Headers    *Headers
 	Body       []byte
+
+	wire wire // 解析得到的原始起始行与结束空行
 }
 
 // 常见状态码
 const (
-	StatusTrying           = 100
-	StatusRinging          = 180
-	StatusSessionProgress  = 183
-	StatusOK               = 200
-	StatusAccepted         = 202
-	StatusMultipleChoices  = 300
-	StatusBadRequest       = 400
-	StatusUnauthorized     = 401
-	StatusForbidden        = 403
-	StatusNotFound         = 404
-	StatusMethodNotAllowed = 405
-	StatusRequestTimeout   = 408
-	StatusBusyHere         = 486
-	StatusServerError      = 500
-	StatusDecline          = 603
+	StatusTrying                 = 100
+	StatusRinging                = 180
+	StatusSessionProgress        = 183
+	StatusOK                     = 200
+	StatusAccepted               = 202
+	StatusMultipleChoices        = 300
+	StatusBadRequest             = 400
+	StatusUnauthorized           = 401
+	StatusForbidden              = 403
+	StatusNotFound               = 404
+	StatusMethodNotAllowed       = 405
+	StatusProxyAuthRequired      = 407
+	StatusRequestTimeout         = 408
+	StatusUnsupportedMediaType   = 415
+	StatusUnsupportedURIScheme   = 416
+	StatusIntervalTooSmall       = 422
+	StatusIntervalTooBrief       = 423
+	StatusTemporarilyUnavailable = 480
+	StatusCallDoesNotExist       = 481
+	StatusTooManyHops            = 483
+	StatusBusyHere               = 486
+	StatusRequestTerminated      = 487
+	StatusNotAcceptableHere      = 488
+	StatusBadEvent               = 489
+	StatusServerError            = 500
+	StatusServiceUnavailable     = 503
+	StatusDecline                = 603
 )
 
 var statusReasons = map[int]string{
@@ -140,11 +152,19 @@ var statusReasons = map[int]string{
 	403: "Forbidden",
 	404: "Not Found",
 	405: "Method Not Allowed",
+	407: "Proxy Authentication Required",
 	408: "Request Timeout",
+	415: "Unsupported Media Type",
+	416: "Unsupported URI Scheme",
+	422: "Session Interval Too Small",
+	423: "Interval Too Brief",
+	480: "Temporarily Unavailable",
 	481: "Call/Transaction Does Not Exist",
+	483: "Too Many Hops",
 	486: "Busy Here",
 	487: "Request Terminated",
 	488: "Not Acceptable Here",
+	489: "Bad Event",
 	500: "Server Internal Error",
 	503: "Service Unavailable",
 	603: "Decline",
@@ -158,6 +178,11 @@ func ReasonPhrase(code int) string {
 	return "Unknown"
 }
 
+// startLine 按字段序列化状态行（不含行结束符）。
+func (r *Response) startLine() string {
+	return SIPVersion + " " + strconv.Itoa(r.StatusCode) + " " + r.Reason
+}
+
 // NewResponse 创建一条响应（自动填充原因短语）。
 func NewResponse(code int) *Response {
 	return &Response{
@@ -171,27 +196,10 @@ func NewResponse(code int) *Response {
 func (r *Response) String() string {
 	var sb strings.Builder
 	// 状态行
-	sb.WriteString(SIPVersion)
-	sb.WriteString(" ")
-	sb.WriteString(strconv.Itoa(r.StatusCode))
-	sb.WriteString(" ")
-	sb.WriteString(r.Reason)
-	sb.WriteString("\r\n")
-	// Content-Length
-	if len(r.Body) > 0 {
-		r.Headers.Set(HeaderContentLen, strconv.Itoa(len(r.Body)))
-	} else {
-		r.Headers.Set(HeaderContentLen, "0")
-	}
-	for _, h := range r.Headers.List() {
-		for _, v := range h.Values {
-			sb.WriteString(h.Name)
-			sb.WriteString(": ")
-			sb.WriteString(v)
-			sb.WriteString("\r\n")
-		}
-	}
-	sb.WriteString("\r\n")
+	r.wire.writeStart(&sb, r.startLine())
+	// 头域；Content-Length 按消息体长度输出，不修改 r.Headers
+	r.Headers.writeTo(&sb, len(r.Body), !r.wire.parsed())
+	r.wire.writeEnd(&sb)
 	if len(r.Body) > 0 {
 		sb.Write(r.Body)
 	}
@@ -200,123 +208,33 @@ func (r *Response) String() string {
 
 // ---- Parser ----
 
-// Parse 将原始字节解析为 Request 或 Response。
-// 返回值类型可断言为 *Request 或 *Response。
-func Parse(data []byte) (interface{}, error) {
-	// 分离 header 部分和 body 部分（\r\n\r\n 或 \n\n）
-	var headerBytes, body []byte
-	if idx := bytes.Index(data, []byte("\r\n\r\n")); idx >= 0 {
-		headerBytes = data[:idx]
-		body = data[idx+4:]
-	} else if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
-		headerBytes = data[:idx]
-		body = data[idx+2:]
-	} else {
-		headerBytes = data
-	}
-
-	lines := splitLines(string(headerBytes))
-	if len(lines) == 0 {
-		return nil, fmt.Errorf("empty SIP message")
-	}
-
-	startLine := lines[0]
-	headers, err := parseHeaders(lines[1:])
-	if err != nil {
-		return nil, err
-	}
-
-	// 根据 Content-Length 截断 body
-	if cl := headers.Get(HeaderContentLen); cl != "" {
-		n, err := strconv.Atoi(strings.TrimSpace(cl))
-		if err == nil && n >= 0 && n <= len(body) {
-			body = body[:n]
-		}
-	}
-
-	if strings.HasPrefix(startLine, "SIP/") {
-		// 响应
-		resp, err := parseResponseLine(startLine)
-		if err != nil {
-			return nil, err
-		}
-		resp.Headers = headers
-		resp.Body = body
-		return resp, nil
-	}
-	// 请求
-	req, err := parseRequestLine(startLine)
-	if err != nil {
-		return nil, err
-	}
-	req.Headers = headers
-	req.Body = body
-	return req, nil
+// wire 保存解析得到的起始行与头域结束空行的原始形式：起始行的字段未被修改时原样输出，
+// 与 Headers 保留的原始行一起保证 Parse 之后 String 与线上字节一致。
+type wire struct {
+	start     string // 原始起始行（含行结束符）
+	startLine string // 解析时按字段序列化的起始行，与当前不同表示已被修改
+	end       string // 头域结束的空行（"\r\n" 或 "\n"）
 }
 
-func splitLines(s string) []string {
-	// 统一换行符
-	s = strings.ReplaceAll(s, "\r\n", "\n")
-	raw := strings.Split(s, "\n")
-	var out []string
-	for i := 0; i < len(raw); i++ {
-		line := raw[i]
-		// 处理头域折叠（continuation lines）
-		for i+1 < len(raw) && len(raw[i+1]) > 0 && (raw[i+1][0] == ' ' || raw[i+1][0] == '\t') {
-			i++
-			line += " " + strings.TrimSpace(raw[i])
-		}
-		out = append(out, line)
-	}
-	return out
+// parsed 判断消息是否由 Parse 得到。解析得到的消息没有 Content-Length 时（UDP 允许省略）
+// 序列化也不补上，保证原样输出；协议栈构造的消息总是带上。
+func (w *wire) parsed() bool {
+	return w.end != ""
 }
 
-func parseHeaders(lines []string) (*Headers, error) {
-	h := NewHeaders()
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
-		colonIdx := strings.Index(line, ":")
-		if colonIdx < 0 {
-			return nil, fmt.Errorf("invalid header line: %q", line)
-		}
-		name := strings.TrimSpace(line[:colonIdx])
-		value := strings.TrimSpace(line[colonIdx+1:])
-		h.Add(name, value)
+func (w *wire) writeStart(sb *strings.Builder, line string) {
+	if w.start != "" && line == w.startLine {
+		sb.WriteString(w.start)
+		return
 	}
-	return h, nil
-}
-
-func parseRequestLine(line string) (*Request, error) {
-	// METHOD Request-URI SIP/2.0
-	parts := strings.Fields(line)
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("invalid request line: %q", line)
-	}
-	if parts[2] != SIPVersion {
-		return nil, fmt.Errorf("unsupported SIP version: %q", parts[2])
-	}
-	uri, err := ParseURI(parts[1])
-	if err != nil {
-		return nil, fmt.Errorf("invalid Request-URI: %w", err)
-	}
-	return &Request{Method: Method(parts[0]), RequestURI: uri}, nil
+	sb.WriteString(line)
+	sb.WriteString("\r\n")
 }
 
-func parseResponseLine(line string) (*Response, error) {
-	// SIP/2.0 200 OK
-	parts := strings.SplitN(line, " ", 3)
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid response line: %q", line)
-	}
-	code, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return nil, fmt.Errorf("invalid status code: %w", err)
+func (w *wire) writeEnd(sb *strings.Builder) {
+	if w.end != "" {
+		sb.WriteString(w.end)
+		return
 	}
-	reason := ""
-	if len(parts) == 3 {
-		reason = parts[2]
-	}
-	return &Response{StatusCode: code, Reason: reason}, nil
+	sb.WriteString("\r\n")
 }
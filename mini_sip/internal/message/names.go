@@ -0,0 +1,42 @@
+package message
+
+import "strings"
+
+// canonicalNames 将头域名（小写）映射到规范写法：RFC 3261 §20 的全部头域与本库用到的扩展头域。
+// 大小写不规则的名称（Call-ID、CSeq、WWW-Authenticate、MIME-Version 等）必须在表中，
+// 不在表中的头域按 "-" 分段首字母大写（见 normalizeName）。
+var canonicalNames = func() map[string]string {
+	names := []string{
+		// RFC 3261 §20
+		"Accept", "Accept-Encoding", "Accept-Language", "Alert-Info", "Allow",
+		"Authentication-Info", "Authorization", "Call-ID", "Call-Info", "Contact",
+		"Content-Disposition", "Content-Encoding", "Content-Language", "Content-Length",
+		"Content-Type", "CSeq", "Date", "Error-Info", "Expires", "From", "In-Reply-To",
+		"Max-Forwards", "MIME-Version", "Min-Expires", "Organization", "Priority",
+		"Proxy-Authenticate", "Proxy-Authorization", "Proxy-Require", "Record-Route",
+		"Reply-To", "Require", "Retry-After", "Route", "Server", "Subject", "Supported",
+		"Timestamp", "To", "Unsupported", "User-Agent", "Via", "Warning", "WWW-Authenticate",
+		// 扩展（RFC 3262 / 3515 / 3891 / 3892 / 4028 / 6665）
+		HeaderRSeq, HeaderRAck, HeaderSessionExpires, HeaderMinSE, HeaderEvent,
+		HeaderAllowEvents, HeaderSubscriptionState, HeaderReferTo, HeaderReferredBy, HeaderReplaces,
+	}
+	m := make(map[string]string, len(names))
+	for _, n := range names {
+		m[strings.ToLower(n)] = n
+	}
+	return m
+}()
+
+// listHeaders 是值为逗号分隔列表、解析时按 SplitValues 拆成多个值的头域（RFC 3261 §7.3.1）。
+//
+// Allow / Supported 这类 token 列表保持原样，用 Headers.HasToken 判断；
+// WWW-Authenticate、Date 等值中本身含逗号的头域不拆分。
+var listHeaders = map[string]bool{
+	HeaderVia:         true,
+	HeaderContact:     true,
+	HeaderRoute:       true,
+	HeaderRecordRoute: true,
+	"Alert-Info":      true,
+	"Call-Info":       true,
+	"Error-Info":      true,
+}
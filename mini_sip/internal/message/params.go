@@ -0,0 +1,215 @@
+package message
+
+import (
+	"strings"
+)
+
+// Param 是一个参数（;name=value），Value 为线上形式（quoted-string 保留引号）。
+type Param struct {
+	Name  string
+	Value string // 空表示没有 "=value" 部分（如 ;lr、;rport）
+}
+
+// Params 是有序参数列表，保留线上的顺序与名称大小写，按名称查找时不区分大小写。
+//
+// 用于 Via / Contact / From / To 的头域参数与 URI 参数，序列化时按原顺序输出。
+type Params []Param
+
+// Lookup 返回参数值（quoted-string 已去掉引号与转义）及参数是否存在。
+func (p Params) Lookup(name string) (string, bool) {
+	for _, kv := range p {
+		if strings.EqualFold(kv.Name, name) {
+			return Unquote(kv.Value), true
+		}
+	}
+	return "", false
+}
+
+// Get 返回参数值，不存在时为空。
+func (p Params) Get(name string) string {
+	v, _ := p.Lookup(name)
+	return v
+}
+
+// Has 判断参数是否存在。
+func (p Params) Has(name string) bool {
+	_, ok := p.Lookup(name)
+	return ok
+}
+
+// Set 设置参数值，已存在时原位替换，否则追加到末尾；
+// value 不能作为 token 出现时按 quoted-string 转义。
+func (p *Params) Set(name, value string) {
+	if value != "" && !isParamValue(value) {
+		value = Quote(value)
+	}
+	for i, kv := range *p {
+		if strings.EqualFold(kv.Name, name) {
+			(*p)[i].Value = value
+			return
+		}
+	}
+	*p = append(*p, Param{Name: name, Value: value})
+}
+
+// Del 删除参数。
+func (p *Params) Del(name string) {
+	out := (*p)[:0]
+	for _, kv := range *p {
+		if !strings.EqualFold(kv.Name, name) {
+			out = append(out, kv)
+		}
+	}
+	*p = out
+}
+
+// Clone 复制参数列表。
+func (p Params) Clone() Params {
+	if p == nil {
+		return nil
+	}
+	return append(Params(nil), p...)
+}
+
+// String 按原顺序序列化为 ";name=value;flag"。
+func (p Params) String() string {
+	var sb strings.Builder
+	for _, kv := range p {
+		sb.WriteString(";")
+		sb.WriteString(kv.Name)
+		if kv.Value != "" {
+			sb.WriteString("=")
+			sb.WriteString(kv.Value)
+		}
+	}
+	return sb.String()
+}
+
+// parseParams 解析 ";name=value" 序列（首个分号前的空白与分号可省略），
+// 允许分号与等号两侧的空白（LWS），参数值可以是 quoted-string。
+func parseParams(s string) Params {
+	var p Params
+	for s != "" {
+		s = strings.TrimLeft(s, " \t;")
+		if s == "" {
+			break
+		}
+		end := indexUnquoted(s, ';')
+		seg := s[:end]
+		if end < len(s) {
+			s = s[end:]
+		} else {
+			s = ""
+		}
+		name, value, _ := strings.Cut(seg, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p = append(p, Param{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return p
+}
+
+// ---- quoted-string（RFC 3261 §25.1）----
+
+// Quote 把 s 编码为 quoted-string：两侧加双引号，双引号与反斜杠以反斜杠转义。
+func Quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// Unquote 还原 quoted-string（去掉两侧引号并处理 quoted-pair），不是 quoted-string 时原样返回。
+func Unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// isToken 判断 s 是否为 token（RFC 3261 §25.1）。
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !tokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func tokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("-.!%*_+`'~", c) >= 0
+}
+
+// isParamValue 判断 s 能否不加引号作为参数值（gen-value：token / host，含 IPv6 引用）。
+func isParamValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !tokenChar(s[i]) && strings.IndexByte("[]:", s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// indexUnquoted 返回 c 在 s 中第一次出现在引号与尖括号之外的位置，没有时为 len(s)。
+func indexUnquoted(s string, c byte) int {
+	quoted, angle := false, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case quoted:
+		case s[i] == '<':
+			angle = true
+		case s[i] == '>':
+			angle = false
+		case !angle && s[i] == c:
+			return i
+		}
+	}
+	return len(s)
+}
+
+// SplitValues 按逗号拆分多值头域（如 Via / Contact / Route），
+// 引号与尖括号内的逗号不作分隔，各值去掉两侧空白，空值被忽略。
+func SplitValues(v string) []string {
+	var out []string
+	for {
+		i := indexUnquoted(v, ',')
+		if part := strings.TrimSpace(v[:i]); part != "" {
+			out = append(out, part)
+		}
+		if i == len(v) {
+			return out
+		}
+		v = v[i+1:]
+	}
+}
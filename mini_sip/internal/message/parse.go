@@ -0,0 +1,388 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 解析上限，防止畸形或恶意消息耗尽内存（与流式传输的分帧上限一致）。
+const (
+	maxHeadBytes    = 64 * 1024       // 起始行与头域部分的字节上限
+	maxHeaderFields = 256             // 头域行（折行合并后）的数量上限
+	maxBodyBytes    = 4 * 1024 * 1024 // 消息体上限
+	maxMaxForwards  = 255             // Max-Forwards 的取值上限（RFC 4475 §3.1.2.4）
+)
+
+// 解析错误的类别，Parse 返回的 *ParseError 可用 errors.Is 与之比较。
+var (
+	ErrEmptyMessage         = errors.New("empty SIP message")
+	ErrMessageTooLarge      = errors.New("SIP message too large")
+	ErrIncompleteMessage    = errors.New("incomplete SIP message")
+	ErrInvalidStartLine     = errors.New("invalid start line")
+	ErrUnsupportedVersion   = errors.New("unsupported SIP version")
+	ErrInvalidRequestURI    = errors.New("invalid Request-URI")
+	ErrInvalidHeader        = errors.New("invalid header")
+	ErrMissingHeader        = errors.New("missing mandatory header")
+	ErrInvalidContentLength = errors.New("invalid Content-Length")
+	ErrCSeqMismatch         = errors.New("CSeq method does not match request method")
+)
+
+// ParseError 是 Parse 拒绝一条消息的原因。
+//
+// Err 是上面的错误类别之一；Line 是出错的物理行号（从 1 开始，0 表示与具体行无关），
+// Header 是出错的头域名称，便于 UAS 在 400 的原因短语中指出问题所在。
+type ParseError struct {
+	Err    error
+	Line   int
+	Header string
+	Detail string
+}
+
+func (e *ParseError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Err.Error())
+	if e.Line > 0 {
+		fmt.Fprintf(&sb, " at line %d", e.Line)
+	}
+	if e.Header != "" {
+		sb.WriteString(" (")
+		sb.WriteString(e.Header)
+		sb.WriteString(")")
+	}
+	if e.Detail != "" {
+		sb.WriteString(": ")
+		sb.WriteString(e.Detail)
+	}
+	return sb.String()
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// parseState 是 Parse 逐行扫描时所处的状态。
+type parseState int
+
+const (
+	stateStart  parseState = iota // 跳过起始行前的空行，读取起始行
+	stateHeader                   // 读取头域行，直到空行
+	stateBody                     // 空行之后全部是消息体
+)
+
+// scanner 按物理行读取消息，行保留结束符（CRLF 或 LF）。
+type scanner struct {
+	data []byte
+	pos  int
+	line int // 已读取的行数
+}
+
+// next 返回下一行；数据末尾没有换行符时返回 false（头域部分不完整）。
+func (s *scanner) next() (string, bool) {
+	n := bytes.IndexByte(s.data[s.pos:], '\n')
+	if n < 0 {
+		return "", false
+	}
+	line := string(s.data[s.pos : s.pos+n+1])
+	s.pos += n + 1
+	s.line++
+	return line, true
+}
+
+// Parse 将原始字节解析为 Request 或 Response。
+// 返回值类型可断言为 *Request 或 *Response；消息不合法时返回 *ParseError。
+//
+// 解析是严格的（RFC 3261 §25 与 RFC 4475 的畸形消息用例）：
+//   - 起始行元素之间只能有一个空格，SIP 版本必须是 SIP/2.0（不区分大小写）
+//   - 头域名必须是 token，值中不能有控制字符；Via / From / To / Call-ID / CSeq 必须出现且可解析
+//   - 请求的 CSeq 方法必须与请求方法一致
+//   - 消息体按 Content-Length 截取，数据不足 Content-Length 时拒绝而不是静默丢弃消息体
+//
+// 起始行前的空行被忽略（RFC 3261 §7.5）；行结束符接受 CRLF 与 LF，
+// 以空白开头的行是上一行的折行。头域保留原始行，未修改的消息序列化后与输入逐字节一致。
+func Parse(data []byte) (interface{}, error) {
+	sc := &scanner{data: data}
+	state := stateStart
+	var (
+		start   string   // 原始起始行（含行结束符）
+		startNo int      // 起始行的行号
+		lines   []string // 头域物理行
+		end     string   // 头域结束的空行
+	)
+	for state != stateBody {
+		raw, ok := sc.next()
+		if sc.pos > maxHeadBytes {
+			return nil, &ParseError{Err: ErrMessageTooLarge, Detail: fmt.Sprintf("header section exceeds %d bytes", maxHeadBytes)}
+		}
+		if !ok {
+			if state == stateStart && len(bytes.TrimSpace(data)) == 0 {
+				return nil, &ParseError{Err: ErrEmptyMessage}
+			}
+			return nil, &ParseError{Err: ErrIncompleteMessage, Line: sc.line + 1, Detail: "missing empty line after headers"}
+		}
+		blank := raw == "\r\n" || raw == "\n"
+		switch state {
+		case stateStart:
+			if !blank {
+				start, startNo = raw, sc.line
+				state = stateHeader
+			}
+		case stateHeader:
+			if blank {
+				end = raw
+				state = stateBody
+				continue
+			}
+			lines = append(lines, raw)
+		}
+	}
+	if start == "" {
+		return nil, &ParseError{Err: ErrEmptyMessage}
+	}
+
+	startLine := trimEOL(start)
+	isResponse := len(startLine) >= 4 && strings.EqualFold(startLine[:4], "SIP/")
+	var (
+		req  *Request
+		resp *Response
+		err  error
+	)
+	if isResponse {
+		resp, err = parseResponseLine(startLine)
+	} else {
+		req, err = parseRequestLine(startLine)
+	}
+	if err != nil {
+		err.(*ParseError).Line = startNo
+		return nil, err
+	}
+
+	headers, err := parseHeaders(lines, startNo+1)
+	if err != nil {
+		return nil, err
+	}
+	var method Method
+	if req != nil {
+		method = req.Method
+	}
+	if err := checkHeaders(headers, method); err != nil {
+		return nil, err
+	}
+	body, err := frameBody(headers, data[sc.pos:])
+	if err != nil {
+		return nil, err
+	}
+
+	if resp != nil {
+		resp.Headers = headers
+		resp.Body = body
+		resp.wire = wire{start: start, startLine: resp.startLine(), end: end}
+		return resp, nil
+	}
+	req.Headers = headers
+	req.Body = body
+	req.wire = wire{start: start, startLine: req.startLine(), end: end}
+	return req, nil
+}
+
+func trimEOL(line string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+}
+
+// parseRequestLine 解析 Request-Line = Method SP Request-URI SP SIP-Version。
+//
+// 多余的空格（RFC 4475 lwsstart / trws）与 Request-URI 中的空白（lwsruri）都会被拒绝，
+// Request-URI 不允许带 URI 头部（escruri，RFC 3261 §19.1.1）。
+func parseRequestLine(line string) (*Request, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return nil, &ParseError{Err: ErrInvalidStartLine, Detail: strconv.Quote(line)}
+	}
+	if !isToken(parts[0]) {
+		return nil, &ParseError{Err: ErrInvalidStartLine, Detail: "invalid method " + strconv.Quote(parts[0])}
+	}
+	if !strings.EqualFold(parts[2], SIPVersion) {
+		return nil, &ParseError{Err: ErrUnsupportedVersion, Detail: strconv.Quote(parts[2])}
+	}
+	uri, err := ParseURI(parts[1])
+	if err != nil {
+		return nil, &ParseError{Err: ErrInvalidRequestURI, Detail: err.Error()}
+	}
+	if len(uri.Headers) > 0 {
+		return nil, &ParseError{Err: ErrInvalidRequestURI, Detail: "headers are not allowed in Request-URI"}
+	}
+	return &Request{Method: Method(parts[0]), RequestURI: uri}, nil
+}
+
+// parseResponseLine 解析 Status-Line = SIP-Version SP Status-Code SP Reason-Phrase，
+// 状态码必须是 100-699 的三位数字，原因短语可以为空（RFC 4475 noreason）。
+func parseResponseLine(line string) (*Response, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return nil, &ParseError{Err: ErrInvalidStartLine, Detail: strconv.Quote(line)}
+	}
+	if !strings.EqualFold(parts[0], SIPVersion) {
+		return nil, &ParseError{Err: ErrUnsupportedVersion, Detail: strconv.Quote(parts[0])}
+	}
+	code, err := strconv.Atoi(parts[1])
+	if len(parts[1]) != 3 || !isDigits(parts[1]) || err != nil || code < 100 {
+		return nil, &ParseError{Err: ErrInvalidStartLine, Detail: "invalid status code " + strconv.Quote(parts[1])}
+	}
+	reason := ""
+	if len(parts) == 3 {
+		reason = parts[2]
+	}
+	return &Response{StatusCode: code, Reason: reason}, nil
+}
+
+// parseHeaders 解析头域行，折行并入上一行（值中的折行视为一个空格），每行保留原始文本。
+// first 是 lines[0] 的行号，用于错误定位。
+func parseHeaders(lines []string, first int) (*Headers, error) {
+	h := NewHeaders()
+	fields := 0
+	for i := 0; i < len(lines); i++ {
+		lineNo := first + i
+		raw := lines[i]
+		value := trimEOL(raw)
+		if value[0] == ' ' || value[0] == '\t' {
+			return nil, &ParseError{Err: ErrInvalidHeader, Line: lineNo, Detail: "continuation line without header"}
+		}
+		for i+1 < len(lines) && (lines[i+1][0] == ' ' || lines[i+1][0] == '\t') {
+			i++
+			raw += lines[i]
+			value += " " + strings.TrimSpace(lines[i])
+		}
+		if fields++; fields > maxHeaderFields {
+			return nil, &ParseError{Err: ErrMessageTooLarge, Line: lineNo, Detail: fmt.Sprintf("more than %d header fields", maxHeaderFields)}
+		}
+		name, v, ok := strings.Cut(value, ":")
+		name = strings.TrimRight(name, " \t")
+		if !ok || !isToken(name) {
+			return nil, &ParseError{Err: ErrInvalidHeader, Line: lineNo, Detail: strconv.Quote(value)}
+		}
+		if i := ctlIndex(v); i >= 0 {
+			return nil, &ParseError{Err: ErrInvalidHeader, Line: lineNo, Header: normalizeName(name),
+				Detail: fmt.Sprintf("control character %#02x in value", v[i])}
+		}
+		h.addLine(name, strings.TrimSpace(v), raw)
+	}
+	return h, nil
+}
+
+// ctlIndex 返回头域值中第一个不允许出现的控制字符的位置，没有时为 -1。
+// quoted-string 内的 quoted-pair（反斜杠加 CR、LF 以外的字符，RFC 3261 §25.1）可以转义控制字符
+// （RFC 4475 intmeth 的 To 显示名含转义的 BEL / NUL / DEL），其余位置的控制字符一律拒绝。
+func ctlIndex(v string) int {
+	quoted := false
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(v) && v[i+1] != '\r' && v[i+1] != '\n':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case isCtl(c):
+			return i
+		}
+	}
+	return -1
+}
+
+// isCtl 判断 c 是否是头域值中不允许出现的控制字符（HTAB 除外）。
+func isCtl(c byte) bool {
+	return c < 0x20 && c != '\t' || c == 0x7f
+}
+
+// checkHeaders 校验每条消息必备的头域（RFC 3261 §8.1.1）及其取值；
+// method 非空时是请求，CSeq 方法必须与之一致（RFC 4475 mismatch01 / mismatch02）。
+func checkHeaders(h *Headers, method Method) error {
+	for _, name := range []string{HeaderVia, HeaderFrom, HeaderTo, HeaderCallID, HeaderCSeq} {
+		if !h.Exists(name) {
+			return &ParseError{Err: ErrMissingHeader, Header: name}
+		}
+	}
+	for _, name := range []string{HeaderFrom, HeaderTo, HeaderCallID, HeaderCSeq, HeaderMaxForwards, HeaderContentType} {
+		if len(h.GetAll(name)) > 1 {
+			return &ParseError{Err: ErrInvalidHeader, Header: name, Detail: "header appears more than once"}
+		}
+	}
+	for _, v := range h.GetAll(HeaderVia) {
+		if _, err := ParseVia(v); err != nil {
+			return &ParseError{Err: ErrInvalidHeader, Header: HeaderVia, Detail: err.Error()}
+		}
+	}
+	for _, name := range []string{HeaderFrom, HeaderTo} {
+		if _, err := ParseAddress(h.Get(name)); err != nil {
+			return &ParseError{Err: ErrInvalidHeader, Header: name, Detail: err.Error()}
+		}
+	}
+	// Contact 除 REGISTER 的 "*" 外都是 name-addr / addr-spec（RFC 4475 regbadct）
+	for _, v := range h.GetAll(HeaderContact) {
+		if strings.TrimSpace(v) == "*" {
+			continue
+		}
+		if _, err := ParseAddress(v); err != nil {
+			return &ParseError{Err: ErrInvalidHeader, Header: HeaderContact, Detail: err.Error()}
+		}
+	}
+	if id := h.Get(HeaderCallID); id == "" || strings.ContainsAny(id, " \t") {
+		return &ParseError{Err: ErrInvalidHeader, Header: HeaderCallID, Detail: strconv.Quote(id)}
+	}
+	cseq, err := ParseCSeq(h.Get(HeaderCSeq))
+	if err != nil {
+		return &ParseError{Err: ErrInvalidHeader, Header: HeaderCSeq, Detail: err.Error()}
+	}
+	if method != "" && cseq.Method != strings.ToUpper(string(method)) {
+		return &ParseError{Err: ErrCSeqMismatch, Header: HeaderCSeq, Detail: fmt.Sprintf("%s in %s request", cseq.Method, method)}
+	}
+	if v := h.Get(HeaderMaxForwards); h.Exists(HeaderMaxForwards) {
+		if n, err := strconv.Atoi(v); !isDigits(v) || err != nil || n > maxMaxForwards {
+			return &ParseError{Err: ErrInvalidHeader, Header: HeaderMaxForwards, Detail: strconv.Quote(v)}
+		}
+	}
+	return nil
+}
+
+// frameBody 按 Content-Length 截取消息体（RFC 3261 §18.3）：数据报中多出的字节被丢弃，
+// 数据不足 Content-Length 时消息不完整（RFC 4475 clerr）；没有 Content-Length 时消息体到数据末尾为止。
+func frameBody(h *Headers, body []byte) ([]byte, error) {
+	values := h.GetAll(HeaderContentLen)
+	if len(values) == 0 {
+		if len(body) > maxBodyBytes {
+			return nil, &ParseError{Err: ErrMessageTooLarge, Detail: fmt.Sprintf("body exceeds %d bytes", maxBodyBytes)}
+		}
+		return body, nil
+	}
+	n := -1
+	for _, v := range values {
+		m, err := strconv.Atoi(v)
+		if !isDigits(v) || err != nil {
+			return nil, &ParseError{Err: ErrInvalidContentLength, Header: HeaderContentLen, Detail: strconv.Quote(v)}
+		}
+		if n >= 0 && m != n {
+			return nil, &ParseError{Err: ErrInvalidContentLength, Header: HeaderContentLen, Detail: "conflicting values"}
+		}
+		n = m
+	}
+	switch {
+	case n > maxBodyBytes:
+		return nil, &ParseError{Err: ErrMessageTooLarge, Header: HeaderContentLen, Detail: fmt.Sprintf("body %d exceeds %d bytes", n, maxBodyBytes)}
+	case n > len(body):
+		return nil, &ParseError{Err: ErrIncompleteMessage, Header: HeaderContentLen,
+			Detail: fmt.Sprintf("body has %d bytes, Content-Length is %d", len(body), n)}
+	}
+	return body[:n], nil
+}
+
+// isDigits 判断 s 是否为非空的纯数字串。
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
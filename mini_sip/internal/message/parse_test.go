@@ -0,0 +1,320 @@
+package message
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// RFC 4475 的 torture 消息放在 testdata/rfc4475 下，valid 目录是必须接受的，invalid 目录是必须拒绝的。
+const corpusDir = "testdata/rfc4475"
+
+func readCorpus(t testing.TB, kind, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(corpusDir, kind, name+".dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseRFC4475Valid(t *testing.T) {
+	tests := []struct {
+		name   string
+		method Method // 请求的方法，响应为空
+		status int    // 响应的状态码，请求为 0
+	}{
+		{"wsinv", MethodINVITE, 0},
+		{"intmeth", "!interesting-Method0123456789_*+`.%indeed'~", 0},
+		{"esc01", MethodINVITE, 0},
+		{"escnull", MethodREGISTER, 0},
+		{"esc02", "RE%47IST%45R", 0},
+		{"lwsdisp", MethodOPTIONS, 0},
+		{"longreq", MethodINVITE, 0},
+		{"dblreq", MethodREGISTER, 0},
+		{"semiuri", MethodOPTIONS, 0},
+		{"transports", MethodOPTIONS, 0},
+		{"mpart01", MethodMESSAGE, 0},
+		{"unreason", "", 200},
+		{"noreason", "", 100},
+		{"baddate", MethodINVITE, 0},
+		{"badbranch", MethodOPTIONS, 0},
+		{"unkscm", MethodOPTIONS, 0},
+		{"novelsc", MethodOPTIONS, 0},
+		{"unksm2", MethodREGISTER, 0},
+		{"bext01", MethodOPTIONS, 0},
+		{"invut", MethodINVITE, 0},
+		{"regaut01", MethodREGISTER, 0},
+		{"bcast", "", 200},
+		{"zeromf", MethodOPTIONS, 0},
+		{"cparam01", MethodREGISTER, 0},
+		{"cparam02", MethodREGISTER, 0},
+		{"regescrt", MethodREGISTER, 0},
+		{"sdp01", MethodINVITE, 0},
+		{"inv2543", MethodINVITE, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse(readCorpus(t, "valid", tt.name))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			switch msg := m.(type) {
+			case *Request:
+				if msg.Method != tt.method {
+					t.Errorf("method = %q, want %q", msg.Method, tt.method)
+				}
+			case *Response:
+				if msg.StatusCode != tt.status {
+					t.Errorf("status = %d, want %d", msg.StatusCode, tt.status)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRFC4475Details(t *testing.T) {
+	m, err := Parse(readCorpus(t, "valid", "intmeth"))
+	if err != nil {
+		t.Fatalf("intmeth: %v", err)
+	}
+	to, err := ParseAddress(m.(*Request).Headers.Get(HeaderTo))
+	if err != nil {
+		t.Fatalf("intmeth To: %v", err)
+	}
+	if want := "BEL:\x07 NUL:\x00 DEL:\x7f"; to.DisplayName != want {
+		t.Errorf("intmeth To display name = %q, want %q", to.DisplayName, want)
+	}
+
+	m, err = Parse(readCorpus(t, "valid", "wsinv"))
+	if err != nil {
+		t.Fatalf("wsinv: %v", err)
+	}
+	req := m.(*Request)
+	if n := len(req.Headers.GetAll(HeaderVia)); n != 3 {
+		t.Errorf("wsinv Via count = %d, want 3", n)
+	}
+	cseq, err := ParseCSeq(req.Headers.Get(HeaderCSeq))
+	if err != nil || cseq.Seq != 9 || cseq.Method != "INVITE" {
+		t.Errorf("wsinv CSeq = %+v, %v", cseq, err)
+	}
+
+	// dblreq 的数据报中 Content-Length 之后的第二条消息被丢弃
+	m, err = Parse(readCorpus(t, "valid", "dblreq"))
+	if err != nil {
+		t.Fatalf("dblreq: %v", err)
+	}
+	if body := m.(*Request).Body; len(body) != 0 {
+		t.Errorf("dblreq body = %q, want empty", body)
+	}
+
+	// 未知 scheme 的 Request-URI 可以解析，由上层按 416 处理
+	m, err = Parse(readCorpus(t, "valid", "unkscm"))
+	if err != nil {
+		t.Fatalf("unkscm: %v", err)
+	}
+	ruri := m.(*Request).RequestURI
+	if ruri.IsSIP() || ruri.Scheme != "nobodyknowsthisscheme" || ruri.Opaque != "totallyopaquecontent" {
+		t.Errorf("unkscm Request-URI = %+v", ruri)
+	}
+
+	// cparam01 的 addr-spec 形式中 unknownparam 属于头域，cparam02 的 name-addr 中属于 URI
+	for _, tc := range []struct {
+		name             string
+		header, uriParam bool
+	}{
+		{"cparam01", true, false},
+		{"cparam02", false, true},
+	} {
+		m, err = Parse(readCorpus(t, "valid", tc.name))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		contact, err := ParseAddress(m.(*Request).Headers.Get(HeaderContact))
+		if err != nil {
+			t.Fatalf("%s Contact: %v", tc.name, err)
+		}
+		if contact.Params.Has("unknownparam") != tc.header || contact.URI.Params.Has("unknownparam") != tc.uriParam {
+			t.Errorf("%s unknownparam: header %v, uri %v", tc.name, contact.Params, contact.URI.Params)
+		}
+	}
+
+	// regescrt 的 Contact URI 带转义的 Route 头部
+	m, err = Parse(readCorpus(t, "valid", "regescrt"))
+	if err != nil {
+		t.Fatalf("regescrt: %v", err)
+	}
+	contact, err := ParseAddress(m.(*Request).Headers.Get(HeaderContact))
+	if err != nil {
+		t.Fatalf("regescrt Contact: %v", err)
+	}
+	if got := contact.URI.Headers.Get("Route"); got != "%3Csip:sip.example.com%3E" {
+		t.Errorf("regescrt Route header = %q", got)
+	}
+
+	// inv2543 是 RFC 2543 风格的请求：无 Max-Forwards、To tag、branch 与 Content-Length
+	m, err = Parse(readCorpus(t, "valid", "inv2543"))
+	if err != nil {
+		t.Fatalf("inv2543: %v", err)
+	}
+	req = m.(*Request)
+	if req.Headers.Exists(HeaderMaxForwards) || req.Headers.Exists(HeaderContentLen) {
+		t.Errorf("inv2543 unexpected headers: %v", req.Headers)
+	}
+	via, err := ParseVia(req.Headers.Get(HeaderVia))
+	if err != nil || via.Params.Has("branch") {
+		t.Errorf("inv2543 Via = %+v, %v", via, err)
+	}
+	if len(req.Body) == 0 {
+		t.Error("inv2543 body is empty, want the SDP up to the end of the datagram")
+	}
+}
+
+func TestParseRFC4475Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"badinv01", ErrInvalidHeader},
+		{"clerr", ErrIncompleteMessage},
+		{"ncl", ErrInvalidContentLength},
+		{"scalar02", ErrInvalidHeader},
+		{"scalarlg", ErrInvalidHeader},
+		{"quotbal", ErrInvalidHeader},
+		{"ltgtruri", ErrInvalidRequestURI},
+		{"lwsruri", ErrInvalidStartLine},
+		{"lwsstart", ErrInvalidStartLine},
+		{"trws", ErrInvalidStartLine},
+		{"escruri", ErrInvalidRequestURI},
+		{"regbadct", ErrInvalidHeader},
+		{"badaspec", ErrInvalidHeader},
+		{"baddn", ErrInvalidHeader},
+		{"badvers", ErrUnsupportedVersion},
+		{"mismatch01", ErrCSeqMismatch},
+		{"mismatch02", ErrCSeqMismatch},
+		{"bigcode", ErrInvalidStartLine},
+		{"insuf", ErrMissingHeader},
+		{"multi01", ErrInvalidHeader},
+		{"mcl01", ErrInvalidHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(readCorpus(t, "invalid", tt.name))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Parse error = %v, want %v", err, tt.want)
+			}
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Errorf("error %T is not *ParseError", err)
+			}
+		})
+	}
+}
+
+func TestCtlIndex(t *testing.T) {
+	tests := []struct {
+		v    string
+		want int
+	}{
+		{"plain value", -1},
+		{"tab\tis allowed", -1},
+		{"bell\x07", 4},
+		{"del\x7f", 3},
+		{`"escaped \` + "\x07" + `" <sip:a@b>`, -1},
+		{`"raw ` + "\x07" + `" <sip:a@b>`, 5},
+		{`\` + "\x07" + ` outside quotes`, 1},
+		{`"escaped quote \" then ` + "\x00" + `"`, 23},
+	}
+	for _, tt := range tests {
+		if got := ctlIndex(tt.v); got != tt.want {
+			t.Errorf("ctlIndex(%q) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+// addCorpusSeeds 把整个 RFC 4475 语料加入模糊测试的种子。
+func addCorpusSeeds(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join(corpusDir, "*", "*.dat"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	addCorpusSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Parse(data)
+		if err != nil {
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("error %T is not *ParseError: %v", err, err)
+			}
+			return
+		}
+		// 接受的消息序列化后必须仍能被解析
+		var out string
+		switch msg := m.(type) {
+		case *Request:
+			out = msg.String()
+		case *Response:
+			out = msg.String()
+		default:
+			t.Fatalf("Parse returned %T", m)
+		}
+		if _, err := Parse([]byte(out)); err != nil {
+			t.Fatalf("re-parse of %q: %v", out, err)
+		}
+	})
+}
+
+func FuzzParseURI(f *testing.F) {
+	for _, s := range []string{
+		"sip:alice@example.com",
+		"sips:bob:secret@[2001:db8::1]:5061;transport=tls",
+		"sip:user;par=u%40example.net@example.com",
+		"sip:1_unusual.URI~(to-be!sure)&isn't+it$/crazy?,/;;*:&it+has=1,weird!*pas$wo~d_too.(doesn't-it)@example.com",
+		"sip:alice@example.com;lr;maddr=192.0.2.1?subject=hi&priority=urgent",
+		"tel:+1-201-555-0123",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		u, err := ParseURI(s)
+		if err != nil {
+			return
+		}
+		if _, err := ParseURI(u.String()); err != nil {
+			t.Fatalf("re-parse of %q (from %q): %v", u.String(), s, err)
+		}
+	})
+}
+
+func FuzzParseAddress(f *testing.F) {
+	for _, s := range []string{
+		`"Alice" <sip:alice@example.com>;tag=1928301774`,
+		`sip:bob@example.com;tag=a6c85cf`,
+		`caller<sip:caller@example.com>;tag=323`,
+		`token1~` + "`" + ` token2'+_ <sip:mundane@example.com>;fromParam''~+*_!.-%="x"`,
+		`"BEL:\` + "\x07" + `" <sip:a@example.com>`,
+		`"Quoted string \"\"" <sip:jdrosen@example.com> ; newparam = newvalue ; secondparam ; q = 0.33`,
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		a, err := ParseAddress(s)
+		if err != nil {
+			return
+		}
+		if _, err := ParseAddress(a.String()); err != nil {
+			t.Fatalf("re-parse of %q (from %q): %v", a.String(), s, err)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package message
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -15,20 +16,23 @@ import (
 //	sip:alice@atlanta.com
 //	sip:alice:secretword@atlanta.com;transport=tcp
 //	sips:alice@atlanta.com?subject=project%20x&priority=urgent
+//
+// 其他 scheme 的 URI（absoluteURI，如 tel:、http:）只保留 scheme 之后的原文，见 Opaque。
 type URI struct {
-	Scheme   string            // "sip" 或 "sips"
-	User     string            // 用户名
-	Password string            // 密码（一般不用）
-	Host     string            // 主机名或 IP
-	Port     int               // 端口，0 表示使用协议默认值
-	Params   map[string]string // URI 参数（transport, lr, maddr 等）
-	Headers  map[string]string // URI 头部（?subject=xxx）
+	Scheme   string // "sip"、"sips" 或其他 scheme（小写）
+	Opaque   string // 非 SIP URI 中 scheme 之后的部分，SIP URI 为空
+	User     string // 用户名
+	Password string // 密码（一般不用）
+	Host     string // 主机名或 IP
+	Port     int    // 端口，0 表示使用协议默认值
+	Params   Params // URI 参数（transport, lr, maddr 等），保留原顺序
+	Headers  Params // URI 头部（?subject=xxx），值为转义后的形式
 }
 
 // ParseURI 将字符串解析为 URI。
 func ParseURI(s string) (*URI, error) {
 	s = strings.TrimSpace(s)
-	uri := &URI{Params: make(map[string]string), Headers: make(map[string]string)}
+	uri := &URI{}
 
 	// 提取 Scheme
 	schemeEnd := strings.Index(s, ":")
@@ -36,46 +40,26 @@ func ParseURI(s string) (*URI, error) {
 		return nil, fmt.Errorf("missing scheme in URI: %q", s)
 	}
 	uri.Scheme = strings.ToLower(s[:schemeEnd])
-	if uri.Scheme != "sip" && uri.Scheme != "sips" {
-		return nil, fmt.Errorf("unsupported URI scheme: %q", uri.Scheme)
+	if !isScheme(uri.Scheme) {
+		return nil, fmt.Errorf("invalid URI scheme: %q", s[:schemeEnd])
 	}
 	rest := s[schemeEnd+1:]
 
-	// 分离 headers（?...）
-	if qIdx := strings.Index(rest, "?"); qIdx >= 0 {
-		for _, kv := range strings.Split(rest[qIdx+1:], "&") {
-			kv = strings.TrimSpace(kv)
-			if kv == "" {
-				continue
-			}
-			parts := strings.SplitN(kv, "=", 2)
-			if len(parts) == 2 {
-				uri.Headers[parts[0]] = parts[1]
-			}
-		}
-		rest = rest[:qIdx]
+	if i := strings.IndexFunc(rest, func(r rune) bool { return r <= ' ' || r == 0x7f }); i >= 0 {
+		return nil, fmt.Errorf("invalid character %q in URI: %q", rest[i], s)
 	}
-
-	// 分离 URI params（;...）
-	paramParts := strings.Split(rest, ";")
-	rest = paramParts[0]
-	for _, seg := range paramParts[1:] {
-		seg = strings.TrimSpace(seg)
-		if seg == "" {
-			continue
-		}
-		kv := strings.SplitN(seg, "=", 2)
-		key := strings.ToLower(kv[0])
-		val := ""
-		if len(kv) == 2 {
-			val = kv[1]
+	// 其他 scheme 语法上合法（RFC 4475 unkscm / novelsc / unksm2），是否支持由使用方决定
+	if !uri.IsSIP() {
+		if rest == "" {
+			return nil, fmt.Errorf("empty %s URI: %q", uri.Scheme, s)
 		}
-		uri.Params[key] = val
+		uri.Opaque = rest
+		return uri, nil
 	}
 
-	// 分离 userinfo(@host)
-	atIdx := strings.LastIndex(rest, "@")
-	if atIdx >= 0 {
+	// 分离 userinfo(@host)：user 部分允许 ; ? / 等字符（RFC 3261 §25.1 user-unreserved），
+	// 而参数与头部中的 @ 必须转义，因此以最后一个 @ 为界
+	if atIdx := strings.LastIndex(rest, "@"); atIdx >= 0 {
 		userInfo := rest[:atIdx]
 		rest = rest[atIdx+1:]
 		// user[:password]
@@ -85,43 +69,110 @@ func ParseURI(s string) (*URI, error) {
 		} else {
 			uri.User = userInfo
 		}
+		if uri.User == "" {
+			return nil, fmt.Errorf("empty user in URI: %q", s)
+		}
+	}
+
+	// 分离 headers（?hname=hvalue&...）
+	if qIdx := strings.Index(rest, "?"); qIdx >= 0 {
+		for _, kv := range strings.Split(rest[qIdx+1:], "&") {
+			name, value, ok := strings.Cut(kv, "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("invalid URI header %q: %q", kv, s)
+			}
+			uri.Headers = append(uri.Headers, Param{Name: name, Value: value})
+		}
+		rest = rest[:qIdx]
+	}
+
+	// 分离 URI params（;...）
+	rest, params, _ := strings.Cut(rest, ";")
+	uri.Params = parseParams(params)
+
+	host, port, err := parseHostPort(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w in URI: %q", err, s)
 	}
+	uri.Host, uri.Port = host, port
+	return uri, nil
+}
+
+// isScheme 判断 s 是否符合 scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )（RFC 3986 §3.1）。
+func isScheme(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// IsSIP 判断是否为 sip: / sips: URI。
+func (u *URI) IsSIP() bool {
+	return u.Scheme == "sip" || u.Scheme == "sips"
+}
 
-	// host[:port]
-	// 处理 IPv6 地址 [::1]:5060
-	if strings.HasPrefix(rest, "[") {
-		end := strings.Index(rest, "]")
+// parseHostPort 解析 hostport = host [":" port]（RFC 3261 §25.1），
+// host 是主机名、IPv4 地址或方括号括起的 IPv6 引用，port 省略时为 0。
+func parseHostPort(s string) (string, int, error) {
+	host, portStr := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
 		if end < 0 {
-			return nil, fmt.Errorf("invalid IPv6 in URI: %q", rest)
+			return "", 0, fmt.Errorf("unterminated IPv6 reference")
 		}
-		uri.Host = rest[:end+1]
-		rest = rest[end+1:]
-		if strings.HasPrefix(rest, ":") {
-			port, err := strconv.Atoi(rest[1:])
-			if err != nil {
-				return nil, fmt.Errorf("invalid port in URI: %w", err)
+		host = s[:end+1]
+		if rest := s[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return "", 0, fmt.Errorf("invalid characters after IPv6 reference")
+			}
+			portStr = rest[1:]
+		}
+		for i := 1; i < len(host)-1; i++ {
+			c := host[i]
+			if !isHex(c) && c != ':' && c != '.' {
+				return "", 0, fmt.Errorf("invalid IPv6 reference %q", host)
 			}
-			uri.Port = port
 		}
 	} else {
-		colonIdx := strings.LastIndex(rest, ":")
-		if colonIdx >= 0 {
-			port, err := strconv.Atoi(rest[colonIdx+1:])
-			if err == nil {
-				uri.Port = port
-				uri.Host = rest[:colonIdx]
-			} else {
-				uri.Host = rest
+		if i := strings.IndexByte(s, ':'); i >= 0 {
+			host, portStr = s[:i], s[i+1:]
+		}
+		for i := 0; i < len(host); i++ {
+			if !hostChar(host[i]) {
+				return "", 0, fmt.Errorf("invalid host %q", host)
 			}
-		} else {
-			uri.Host = rest
 		}
 	}
+	if host == "" || host == "[]" {
+		return "", 0, fmt.Errorf("missing host")
+	}
+	if portStr == "" && !strings.HasSuffix(s, ":") {
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if !isDigits(portStr) || err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, port, nil
+}
 
-	if uri.Host == "" {
-		return nil, fmt.Errorf("missing host in URI: %q", s)
+// hostChar 判断 c 能否出现在主机名或 IPv4 地址中（下划线为兼容常见实现而放行）。
+func hostChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
 	}
-	return uri, nil
+	return c == '-' || c == '.' || c == '_'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c|0x20 && c|0x20 <= 'f'
 }
 
 // String 将 URI 序列化为字符串。
@@ -129,6 +180,10 @@ func (u *URI) String() string {
 	var sb strings.Builder
 	sb.WriteString(u.Scheme)
 	sb.WriteString(":")
+	if !u.IsSIP() {
+		sb.WriteString(u.Opaque)
+		return sb.String()
+	}
 	if u.User != "" {
 		sb.WriteString(u.User)
 		if u.Password != "" {
@@ -142,25 +197,17 @@ func (u *URI) String() string {
 		sb.WriteString(":")
 		sb.WriteString(strconv.Itoa(u.Port))
 	}
-	for k, v := range u.Params {
-		sb.WriteString(";")
-		sb.WriteString(k)
-		if v != "" {
-			sb.WriteString("=")
-			sb.WriteString(v)
-		}
-	}
-	first := true
-	for k, v := range u.Headers {
-		if first {
+	sb.WriteString(u.Params.String())
+	// URI 头部总是 hname "=" hvalue，hvalue 为空时等号也不能省略（RFC 3261 §25.1）
+	for i, h := range u.Headers {
+		if i == 0 {
 			sb.WriteString("?")
-			first = false
 		} else {
 			sb.WriteString("&")
 		}
-		sb.WriteString(k)
+		sb.WriteString(h.Name)
 		sb.WriteString("=")
-		sb.WriteString(v)
+		sb.WriteString(h.Value)
 	}
 	return sb.String()
 }
@@ -169,18 +216,51 @@ func (u *URI) String() string {
 func (u *URI) Clone() *URI {
 	n := &URI{
 		Scheme:   u.Scheme,
+		Opaque:   u.Opaque,
 		User:     u.User,
 		Password: u.Password,
 		Host:     u.Host,
 		Port:     u.Port,
-		Params:   make(map[string]string, len(u.Params)),
-		Headers:  make(map[string]string, len(u.Headers)),
+		Params:   u.Params.Clone(),
+		Headers:  u.Headers.Clone(),
 	}
-	for k, v := range u.Params {
-		n.Params[k] = v
+	return n
+}
+
+// Header 返回 URI 头部 name 的值（名称不区分大小写），%XX 转义已还原。
+func (u *URI) Header(name string) (string, bool) {
+	for _, h := range u.Headers {
+		if strings.EqualFold(h.Name, name) {
+			v := h.Value
+			if unescaped, err := url.PathUnescape(v); err == nil {
+				v = unescaped
+			}
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// EscapeHeaderValue 按 URI 头部的 hvalue 规则（RFC 3261 §25.1）转义 v，
+// 用于把头域值放进 URI，如 Refer-To 中的 ?Replaces=。
+func EscapeHeaderValue(v string) string {
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if hvalueChar(c) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
 	}
-	for k, v := range u.Headers {
-		n.Headers[k] = v
+	return sb.String()
+}
+
+// hvalueChar 判断 c 是否可以不经转义出现在 URI 头部的值中（unreserved / hnv-unreserved）。
+func hvalueChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
 	}
-	return n
+	return strings.IndexByte("-_.!~*'()[]/?:+$", c) >= 0
 }
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+// forkContext 是一次转发的响应上下文（RFC 3261 §16.7 "response context"）。
+//
+// 目标按 q 值分组：组内并行（parallel forking），组间串行（sequential forking）。
+// 一组的所有分支都以非 2xx 结束（或串行超时被取消）后才尝试下一组：
+//
+//	q=1.0: [phone, softphone] ──全部失败──> q=0.5: [voicemail]
+//
+// 响应汇聚规则：
+//   - 1xx（100 除外）立即转发，每个分支带 To tag 的 1xx 各自形成一个早期对话
+//   - 2xx 立即转发，并 CANCEL 其余未完成的分支
+//   - 6xx 取消其余分支，不再尝试后续分组
+//   - 所有分支结束且未转发 2xx 时，从收集的最终响应中选出最佳者转发
+type forkContext struct {
+	proxy  *Proxy
+	server *dialog.Transaction // 上游服务端事务
+	req    *message.Request    // 上游原始请求
+	fwd    *message.Request    // 转发模板（已减 Max-Forwards、加 Record-Route）
+
+	mu        sync.Mutex
+	groups    [][]target
+	next      int // 下一个待启动的分组
+	branches  []*branch
+	best      *message.Response // 目前最佳的非 2xx 最终响应
+	finalSent bool              // 已向上游发送最终响应
+	cancelled bool              // 上游 CANCEL 或收到 6xx，不再启动新分组
+	timer     dialog.Timer      // 串行分叉的分组超时
+}
+
+// branch 是响应上下文中的一个分支：一个目标、一个下游客户端事务。
+type branch struct {
+	ctx *forkContext
+	req *message.Request // 转发出去的请求
+	dst string
+	// group 是分支所属分组的下标
+	group int
+
+	done          bool // 已收到最终响应
+	provisional   bool // 已收到临时响应，之后才能发送 CANCEL（RFC 3261 §9.1）
+	cancelled     bool // 已发送 CANCEL
+	cancelPending bool // 需要 CANCEL 但尚未收到临时响应
+
+	// 该分支上的早期对话，按 To tag 索引（下游再次分叉时一个分支可有多个）
+	dialogs map[string]*dialog.Dialog
+}
+
+func newForkContext(p *Proxy, tx *dialog.Transaction, req, fwd *message.Request, groups [][]target) *forkContext {
+	return &forkContext{proxy: p, server: tx, req: req, fwd: fwd, groups: groups}
+}
+
+// start 启动第一个分组。
+func (c *forkContext) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.startNextGroupLocked()
+}
+
+// startNextGroupLocked 启动下一个分组，组内所有目标并行转发；
+// 若整组都发送失败则继续下一组，没有分组可用时发送最终响应。
+func (c *forkContext) startNextGroupLocked() {
+	p := c.proxy
+	for c.next < len(c.groups) && !c.cancelled {
+		group := c.next
+		c.next++
+		started := 0
+		for _, t := range c.groups[group] {
+			fwd := c.fwd.Clone()
+			if t.uri != nil {
+				fwd.RequestURI = t.uri.Clone()
+			}
+			b := &branch{ctx: c, req: fwd, dst: t.dst, group: group, dialogs: make(map[string]*dialog.Dialog)}
+			c.branches = append(c.branches, b)
+			p.mu.Lock()
+			p.branches[fwd] = b
+			p.mu.Unlock()
+
+			if err := p.stack.ForwardRequest(fwd, t.dst); err != nil {
+				p.logger.Warn("forward request failed",
+					zap.String("method", string(fwd.Method)), zap.String("dst", t.dst), zap.Error(err))
+				c.finishBranchLocked(b)
+				c.collectLocked(stack.BuildResponse(c.req, message.StatusServiceUnavailable, ""))
+				continue
+			}
+			started++
+			p.logger.Info("request proxied",
+				zap.String("method", string(fwd.Method)),
+				zap.String("target", fwd.RequestURI.String()),
+				zap.String("dst", t.dst),
+				zap.Int("group", group),
+			)
+		}
+		if started > 0 {
+			// 还有后续分组时为本组设置振铃时限
+			if c.next < len(c.groups) && p.SerialTimeout > 0 && c.fwd.Method == message.MethodINVITE {
+				c.timer = p.stack.Clock().AfterFunc(p.SerialTimeout, func() { c.onSerialTimeout(group) })
+			}
+			return
+		}
+	}
+	c.sendBestLocked()
+}
+
+// onResponse 处理某个分支的响应（已弹出本端 Via）。
+func (c *forkContext) onResponse(b *branch, resp *message.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.proxy
+	code := resp.StatusCode
+
+	switch {
+	case code < 200:
+		b.provisional = true
+		c.trackDialogLocked(b, resp)
+		if b.cancelPending {
+			c.cancelBranchLocked(b)
+		}
+		if !c.finalSent {
+			c.forwardLocked(resp)
+		}
+
+	case isSuccess(code):
+		c.finishBranchLocked(b)
+		c.trackDialogLocked(b, resp)
+		c.finalSent = true
+		c.stopTimerLocked()
+		c.forwardLocked(resp)
+		p.logger.Info("branch answered", zap.String("dst", b.dst), zap.Int("code", code))
+		// 已有分支应答：取消其余分支，不再尝试后续分组
+		if c.req.Method == message.MethodINVITE {
+			c.cancelled = true
+			for _, other := range c.branches {
+				if !other.done {
+					c.cancelBranchLocked(other)
+				}
+			}
+		}
+
+	default:
+		c.finishBranchLocked(b)
+		for _, d := range b.dialogs {
+			d.Terminate()
+		}
+		c.collectLocked(resp)
+		if code >= 600 && c.req.Method == message.MethodINVITE {
+			c.cancelled = true
+			for _, other := range c.branches {
+				if !other.done {
+					c.cancelBranchLocked(other)
+				}
+			}
+		}
+		c.checkCompleteLocked()
+	}
+}
+
+// cancel 取消所有未完成的分支，不再启动新分组（上游 CANCEL）。
+func (c *forkContext) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = true
+	c.stopTimerLocked()
+	for _, b := range c.branches {
+		if !b.done {
+			c.cancelBranchLocked(b)
+		}
+	}
+}
+
+// onSerialTimeout 串行分叉中一组振铃超时：取消该组，分支以 487 结束后尝试下一组。
+func (c *forkContext) onSerialTimeout(group int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finalSent || c.cancelled {
+		return
+	}
+	c.proxy.logger.Info("fork group timed out, trying next group", zap.Int("group", group))
+	for _, b := range c.branches {
+		if b.group == group && !b.done {
+			c.cancelBranchLocked(b)
+		}
+	}
+}
+
+// checkCompleteLocked 在分支结束后检查：已启动的分支全部结束则启动下一组，
+// 所有分组都用尽（或已取消）时发送最佳响应。
+func (c *forkContext) checkCompleteLocked() {
+	for _, b := range c.branches {
+		if !b.done {
+			return
+		}
+	}
+	if c.finalSent {
+		return
+	}
+	c.stopTimerLocked()
+	c.startNextGroupLocked()
+}
+
+// collectLocked 记录一个非 2xx 最终响应，保留最佳者（RFC 3261 §16.7 步骤 6）：
+// 6xx 优先于一切，否则取最低的响应类别（3xx < 4xx < 5xx），同类保留先到者。
+func (c *forkContext) collectLocked(resp *message.Response) {
+	if c.best == nil || better(resp.StatusCode, c.best.StatusCode) {
+		c.best = resp
+	}
+}
+
+func better(code, than int) bool {
+	if than >= 600 {
+		return false
+	}
+	if code >= 600 {
+		return true
+	}
+	return code/100 < than/100
+}
+
+// sendBestLocked 向上游转发选出的最终响应，没有任何响应时回 408。
+func (c *forkContext) sendBestLocked() {
+	if c.finalSent {
+		return
+	}
+	c.finalSent = true
+	resp := c.best
+	if resp == nil {
+		resp = stack.BuildResponse(c.req, message.StatusRequestTimeout, "")
+	}
+	// 503 表示下游不可用，不能让上游误以为是本代理不可用（RFC 3261 §16.7 步骤 6）
+	if resp.StatusCode == message.StatusServiceUnavailable {
+		resp.StatusCode = message.StatusServerError
+		resp.Reason = message.ReasonPhrase(message.StatusServerError)
+	}
+	c.proxy.logger.Info("fork completed", zap.Int("code", resp.StatusCode), zap.Int("branches", len(c.branches)))
+	c.forwardLocked(resp)
+}
+
+func (c *forkContext) forwardLocked(resp *message.Response) {
+	if err := c.server.Respond(resp); err != nil {
+		c.proxy.logger.Warn("relay response failed", zap.Int("code", resp.StatusCode), zap.Error(err))
+	}
+}
+
+// trackDialogLocked 为带 To tag 的 1xx / 2xx 创建或确认该分支上的对话。
+func (c *forkContext) trackDialogLocked(b *branch, resp *message.Response) {
+	if c.req.Method != message.MethodINVITE {
+		return
+	}
+	toAddr, err := message.ParseAddress(resp.Headers.Get(message.HeaderTo))
+	if err != nil || toAddr.Tag == "" {
+		return
+	}
+	if d, ok := b.dialogs[toAddr.Tag]; ok {
+		if isSuccess(resp.StatusCode) {
+			d.Confirm(resp)
+		}
+		return
+	}
+	d, err := dialog.NewDialogFromResponse(b.req, resp, c.proxy.logger)
+	if err != nil {
+		return
+	}
+	b.dialogs[toAddr.Tag] = d
+	c.proxy.logger.Info("dialog created on branch",
+		zap.String("dialog", d.ID.String()), zap.String("state", d.State.String()), zap.String("dst", b.dst))
+}
+
+// cancelBranchLocked 向分支发送 CANCEL；尚未收到临时响应时推迟到收到后再发（RFC 3261 §9.1）。
+func (c *forkContext) cancelBranchLocked(b *branch) {
+	if b.cancelled || b.done || b.req.Method != message.MethodINVITE {
+		return
+	}
+	if !b.provisional {
+		b.cancelPending = true
+		return
+	}
+	b.cancelled = true
+	b.cancelPending = false
+	if err := c.proxy.stack.SendRequest(stack.BuildCancel(b.req), b.dst); err != nil {
+		c.proxy.logger.Warn("send CANCEL failed", zap.String("dst", b.dst), zap.Error(err))
+	}
+}
+
+// finishBranchLocked 标记分支结束并解除请求到分支的映射；
+// 之后经由该分支到达的 2xx 重传由 Proxy.HandleResponse 无状态转发（RFC 3261 §16.7 步骤 5）。
+func (c *forkContext) finishBranchLocked(b *branch) {
+	b.done = true
+	p := c.proxy
+	p.mu.Lock()
+	delete(p.branches, b.req)
+	p.mu.Unlock()
+}
+
+func (c *forkContext) stopTimerLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func isSuccess(code int) bool {
+	return code >= 200 && code < 300
+}
@@ -0,0 +1,480 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/registrar"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+// freeAddr 返回 127.0.0.1 上一个 UDP 与 TCP 当前都空闲的端口。
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		if pc, err := net.ListenPacket("udp", addr); err == nil {
+			pc.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+// incoming 是话机收到的一个 INVITE 及其服务端事务，由测试决定最终响应。
+type incoming struct {
+	req *message.Request
+	tx  *dialog.Transaction
+	tag string // 180 使用的 To tag，最终响应沿用
+}
+
+// answer 以 code 结束 INVITE，2xx 带 Contact。
+func (in *incoming) answer(p *phone, code int) {
+	resp := stack.BuildResponse(in.req, code, in.tag)
+	if code/100 == 2 {
+		resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", p.s.ContactURI("sip")))
+	}
+	in.tx.Respond(resp)
+}
+
+// phone 是回环测试中的用户代理：对 INVITE 立即回 180，最终响应由测试通过 answer 发送；
+// 其他请求回 200；收到 INVITE 的 2xx 后发送 ACK。
+type phone struct {
+	s    *stack.Stack
+	addr string
+
+	requests  chan *message.Request
+	responses chan *message.Response
+	invites   chan *incoming
+	// answerNow 非 0 时直接以该状态码应答 INVITE，不回 180
+	answerNow int
+	ready     chan struct{}
+}
+
+func newPhone(t *testing.T, setup func(p *phone)) *phone {
+	t.Helper()
+	p := &phone{
+		requests:  make(chan *message.Request, 64),
+		responses: make(chan *message.Response, 64),
+		invites:   make(chan *incoming, 8),
+		ready:     make(chan struct{}),
+	}
+	s, err := stack.NewStack(freeAddr(t), p, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	p.s = s
+	p.addr = s.LocalAddr()
+	if setup != nil {
+		setup(p)
+	}
+	close(p.ready)
+	return p
+}
+
+func (p *phone) OnRequest(req *message.Request, tx *dialog.Transaction) {
+	<-p.ready
+	p.requests <- req
+	switch req.Method {
+	case message.MethodACK:
+	case message.MethodINVITE:
+		in := &incoming{req: req, tx: tx, tag: stack.NewTag()}
+		if p.answerNow != 0 {
+			in.answer(p, p.answerNow)
+			return
+		}
+		tx.Respond(stack.BuildResponse(req, message.StatusRinging, in.tag))
+		p.invites <- in
+	default:
+		if tx != nil {
+			tx.Respond(stack.BuildResponse(req, message.StatusOK, ""))
+		}
+	}
+}
+
+func (p *phone) OnResponse(resp *message.Response, req *message.Request) {
+	<-p.ready
+	p.responses <- resp
+	if req == nil || req.Method != message.MethodINVITE || !isSuccess(resp.StatusCode) {
+		return
+	}
+	if d := p.s.ResponseDialog(resp); d != nil {
+		p.s.SendInDialog(d.NewRequest(message.MethodACK))
+	}
+}
+
+func (p *phone) OnError(*message.Request, error) {}
+
+// nextInvite 等待话机收到下一个 INVITE。
+func (p *phone) nextInvite(t *testing.T) *incoming {
+	t.Helper()
+	select {
+	case in := <-p.invites:
+		return in
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for INVITE")
+		return nil
+	}
+}
+
+// nextRequest 等待下一个 method 请求，其间收到的其他请求被跳过。
+func (p *phone) nextRequest(t *testing.T, method message.Method) *message.Request {
+	t.Helper()
+	for {
+		select {
+		case req := <-p.requests:
+			if req.Method == method {
+				return req
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", method)
+		}
+	}
+}
+
+// nextResponse 等待下一个 CSeq 方法为 method、状态码不小于 min 的响应。
+func (p *phone) nextResponse(t *testing.T, method message.Method, min int) *message.Response {
+	t.Helper()
+	for {
+		select {
+		case resp := <-p.responses:
+			cseq, err := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq))
+			if err == nil && cseq.Method == string(method) && resp.StatusCode >= min {
+				return resp
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a %s response", method)
+		}
+	}
+}
+
+// noResponse 断言 wait 时间内没有收到 min 及以上的响应。
+func (p *phone) noResponse(t *testing.T, min int, wait time.Duration) {
+	t.Helper()
+	deadline := time.After(wait)
+	for {
+		select {
+		case resp := <-p.responses:
+			if resp.StatusCode >= min {
+				t.Fatalf("unexpected %d %s", resp.StatusCode, resp.Headers.Get(message.HeaderCSeq))
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// server 把代理协议栈的回调交给 Proxy。
+type server struct {
+	p     *Proxy
+	ready chan struct{}
+}
+
+func (h *server) OnRequest(req *message.Request, tx *dialog.Transaction) {
+	<-h.ready
+	h.p.HandleRequest(req, tx)
+}
+
+func (h *server) OnResponse(resp *message.Response, req *message.Request) {
+	<-h.ready
+	h.p.HandleResponse(resp, req)
+}
+
+func (h *server) OnError(req *message.Request, err error) {
+	<-h.ready
+	h.p.HandleError(req, err)
+}
+
+// testProxy 是运行在回环地址上的代理，协议栈使用手动时钟。
+type testProxy struct {
+	p     *Proxy
+	s     *stack.Stack
+	store *registrar.MemoryStore
+	clock *dialog.ManualClock
+	addr  string
+}
+
+// newTestProxy 启动代理，setup 非 nil 时在回调开始之前调整其配置。
+func newTestProxy(t *testing.T, setup func(tp *testProxy)) *testProxy {
+	t.Helper()
+	tp := &testProxy{store: registrar.NewMemoryStore(), clock: dialog.NewManualClock(time.Now())}
+	h := &server{ready: make(chan struct{})}
+	s, err := stack.NewStack(freeAddr(t), h, zap.NewNop(), stack.WithClock(tp.clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	reg := registrar.New(tp.store, zap.NewNop())
+	reg.Now = tp.clock.Now
+	tp.s = s
+	tp.addr = s.LocalAddr()
+	tp.p = New(s, reg, zap.NewNop())
+	h.p = tp.p
+	if setup != nil {
+		setup(tp)
+	}
+	close(h.ready)
+	return tp
+}
+
+// bind 为 bob 注册 q 值为 q 的话机。
+func (tp *testProxy) bind(t *testing.T, q float64, phones ...*phone) {
+	t.Helper()
+	aor := "sip:bob@127.0.0.1"
+	bindings, _ := tp.store.Get(aor)
+	for _, p := range phones {
+		bindings = append(bindings, &registrar.Binding{
+			Contact: "sip:bob@" + p.addr,
+			Expires: tp.clock.Now().Add(time.Hour),
+			Q:       q,
+			CallID:  stack.NewCallID("127.0.0.1"),
+			CSeq:    1,
+		})
+	}
+	if err := tp.store.Put(aor, bindings); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// call 由 alice 经代理呼叫 bob。
+// 测试中的 INVITE 不声明 100rel，分支的 180 不需要 PRACK。
+func (tp *testProxy) call(t *testing.T, alice *phone) *message.Request {
+	t.Helper()
+	invite, err := alice.s.BuildInviteRequest("sip:alice@"+alice.addr, "sip:bob@"+tp.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite.Headers.Del(message.HeaderSupported)
+	if err := alice.s.SendRequest(invite, tp.addr); err != nil {
+		t.Fatal(err)
+	}
+	return invite
+}
+
+// ringing 等待 alice 收到 n 个 180，返回其中的 To tag。
+func ringing(t *testing.T, alice *phone, n int) []string {
+	t.Helper()
+	var tags []string
+	for len(tags) < n {
+		resp := alice.nextResponse(t, message.MethodINVITE, message.StatusRinging)
+		if resp.StatusCode != message.StatusRinging {
+			t.Fatalf("got %d while ringing", resp.StatusCode)
+		}
+		to, err := message.ParseAddress(resp.Headers.Get(message.HeaderTo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, to.Tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// cancelled 断言分支的 INVITE 被 CANCEL（话机协议栈以 487 结束它）。
+func cancelled(t *testing.T, in *incoming) {
+	t.Helper()
+	select {
+	case <-in.tx.Cancelled():
+	case <-time.After(5 * time.Second):
+		t.Fatal("branch was not cancelled")
+	}
+}
+
+// branchDialogs 返回代理上仍在进行的分支的早期对话 To tag。
+func (tp *testProxy) branchDialogs() []string {
+	tp.p.mu.Lock()
+	var branches []*branch
+	for _, b := range tp.p.branches {
+		branches = append(branches, b)
+	}
+	tp.p.mu.Unlock()
+
+	var tags []string
+	for _, b := range branches {
+		b.ctx.mu.Lock()
+		for tag, d := range b.dialogs {
+			if d.GetState() == dialog.DialogStateEarly {
+				tags = append(tags, tag)
+			}
+		}
+		b.ctx.mu.Unlock()
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// waitBranches 等待代理上未结束的分支数降到 n 及以下。
+func (tp *testProxy) waitBranches(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tp.p.mu.Lock()
+		left := len(tp.p.branches)
+		tp.p.mu.Unlock()
+		if left <= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d branches still pending, want %d", left, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParallelForkAnswered(t *testing.T) {
+	tp := newTestProxy(t, nil)
+	alice := newPhone(t, nil)
+	desk, mobile := newPhone(t, nil), newPhone(t, nil)
+	tp.bind(t, 1.0, desk, mobile)
+
+	tp.call(t, alice)
+	first, second := desk.nextInvite(t), mobile.nextInvite(t)
+	tags := ringing(t, alice, 2)
+	if tags[0] == tags[1] {
+		t.Fatalf("both branches rang with To tag %q", tags[0])
+	}
+	// 每个分支的 180 在代理上各自形成一个早期对话
+	if got := tp.branchDialogs(); fmt.Sprint(got) != fmt.Sprint(tags) {
+		t.Fatalf("early dialogs on branches = %v, want %v", got, tags)
+	}
+
+	first.answer(desk, message.StatusOK)
+	resp := alice.nextResponse(t, message.MethodINVITE, 200)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("alice got %d, want 200", resp.StatusCode)
+	}
+	if to, _ := message.ParseAddress(resp.Headers.Get(message.HeaderTo)); to.Tag != first.tag {
+		t.Errorf("200 To tag = %q, want the answering branch's %q", to.Tag, first.tag)
+	}
+	// 2xx 之后其余分支被 CANCEL，其 487 不再转发给上游
+	cancelled(t, second)
+	desk.nextRequest(t, message.MethodACK)
+	alice.noResponse(t, 200, 200*time.Millisecond)
+}
+
+func TestSerialForkTimeout(t *testing.T) {
+	tp := newTestProxy(t, func(tp *testProxy) { tp.p.SerialTimeout = 10 * time.Second })
+	alice := newPhone(t, nil)
+	desk, voicemail := newPhone(t, nil), newPhone(t, nil)
+	tp.bind(t, 1.0, desk)
+	tp.bind(t, 0.5, voicemail)
+
+	tp.call(t, alice)
+	first := desk.nextInvite(t)
+	// alice 收到 180 时第一组的振铃时限已经设置
+	ringing(t, alice, 1)
+	select {
+	case <-voicemail.invites:
+		t.Fatal("q=0.5 group tried before the q=1.0 group timed out")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	tp.clock.Advance(tp.p.SerialTimeout)
+	cancelled(t, first)
+	second := voicemail.nextInvite(t)
+	ringing(t, alice, 1)
+	second.answer(voicemail, message.StatusOK)
+
+	resp := alice.nextResponse(t, message.MethodINVITE, 200)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("alice got %d, want 200 from the second group", resp.StatusCode)
+	}
+	voicemail.nextRequest(t, message.MethodACK)
+}
+
+func TestSerialForkAfterFailure(t *testing.T) {
+	tp := newTestProxy(t, nil)
+	alice := newPhone(t, nil)
+	desk := newPhone(t, func(p *phone) { p.answerNow = message.StatusBusyHere })
+	voicemail := newPhone(t, func(p *phone) { p.answerNow = message.StatusOK })
+	tp.bind(t, 1.0, desk)
+	tp.bind(t, 0.5, voicemail)
+
+	// 第一组以 486 结束后不必等待振铃时限，直接尝试下一组
+	tp.call(t, alice)
+	resp := alice.nextResponse(t, message.MethodINVITE, 200)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("alice got %d, want 200 from the second group", resp.StatusCode)
+	}
+	desk.nextRequest(t, message.MethodINVITE)
+	voicemail.nextRequest(t, message.MethodACK)
+}
+
+func TestForkBestResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes []int // 各分支依次发送的最终响应，0 表示等待被 CANCEL
+		want  int
+	}{
+		{"lowest class wins", []int{500, 486, 302}, 302},
+		{"first of a class is kept", []int{486, 404}, 486},
+		{"6xx wins and cancels the rest", []int{486, 603, 0}, 603},
+		{"503 becomes 500", []int{503}, 500},
+		{"503 with a 4xx", []int{503, 480}, 480},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t, nil)
+			alice := newPhone(t, nil)
+			phones := make([]*phone, len(tt.codes))
+			for i := range phones {
+				phones[i] = newPhone(t, nil)
+			}
+			tp.bind(t, 1.0, phones...)
+
+			tp.call(t, alice)
+			ins := make([]*incoming, len(phones))
+			for i, p := range phones {
+				ins[i] = p.nextInvite(t)
+			}
+			ringing(t, alice, len(phones))
+			for i, code := range tt.codes {
+				if code == 0 {
+					cancelled(t, ins[i])
+					continue
+				}
+				ins[i].answer(phones[i], code)
+				// 等代理收到后再发下一个，同类响应保留先到者
+				tp.waitBranches(t, len(phones)-i-1)
+			}
+
+			resp := alice.nextResponse(t, message.MethodINVITE, 200)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("alice got %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestBetter(t *testing.T) {
+	tests := []struct {
+		code, than int
+		want       bool
+	}{
+		{404, 500, true},
+		{500, 404, false},
+		{486, 404, false},
+		{302, 486, true},
+		{603, 302, true},
+		{302, 603, false},
+		{600, 603, false},
+	}
+	for _, tt := range tests {
+		if got := better(tt.code, tt.than); got != tt.want {
+			t.Errorf("better(%d, %d) = %v, want %v", tt.code, tt.than, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// Package proxy 实现有状态代理服务器（RFC 3261 §16）。
+//
+// 代理按注册服务器的位置服务把发往 AOR 的请求路由到用户实际的 Contact：
+//
+//	Alice                    Proxy                     Bob
+//	 |--INVITE bob@proxy----->|                         |
+//	 |<-100 Trying------------|--INVITE bob@10.0.0.8--->|   Request-URI 改写为 Contact
+//	 |                        |   Via: proxy, alice     |   压入本端 Via
+//	 |                        |   Record-Route: proxy   |   后续对话内请求也经过代理
+//	 |<-180 Ringing-----------|<-180 Ringing------------|   弹出本端 Via 后转发
+//	 |<-200 OK----------------|<-200 OK-----------------|
+//	 |--ACK------------------>|--ACK------------------->|
+//
+// AOR 有多个绑定时请求被分叉（fork.go）：q 值相同的 Contact 并行振铃，
+// 不同 q 值的分组按从高到低串行尝试。每个分支一个下游客户端事务，
+// 所有分支的响应汇聚到同一个响应上下文，由它选择转发给上游的最终响应。
+package proxy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/registrar"
+	"github.com/lccxxo/go_/mini_sip/internal/stack"
+	"go.uber.org/zap"
+)
+
+// defaultMaxForwards 是请求未携带 Max-Forwards 时补上的初值（RFC 3261 §16.6 步骤 3）。
+const defaultMaxForwards = 70
+
+// defaultSerialTimeout 是串行分叉时每个分组的振铃时长，超时后取消该组并尝试下一组。
+const defaultSerialTimeout = 20 * time.Second
+
+// Proxy 是有状态代理。
+type Proxy struct {
+	stack     *stack.Stack
+	registrar *registrar.Registrar
+	logger    *zap.Logger
+
+	// SerialTimeout 是串行分叉中一个分组无人应答时等待的时长，0 表示一直等到最终响应
+	SerialTimeout time.Duration
+	// Auth 非 nil 时，对话外的 INVITE 必须通过代理认证（407 Proxy-Authenticate）
+	Auth *auth.Authenticator
+
+	mu       sync.Mutex
+	branches map[*message.Request]*branch // 转发出去的请求 -> 分支
+}
+
+// New 创建代理，reg 提供 AOR -> Contact 的位置服务。
+// 经过代理的对话属于两端 UA，协议栈随之切换为代理模式，不再维护对话表。
+func New(s *stack.Stack, reg *registrar.Registrar, logger *zap.Logger) *Proxy {
+	s.SetProxyMode()
+	return &Proxy{
+		stack:         s,
+		registrar:     reg,
+		logger:        logger,
+		SerialTimeout: defaultSerialTimeout,
+		branches:      make(map[*message.Request]*branch),
+	}
+}
+
+// HandleRequest 代理一个请求，tx 为其上游服务端事务（ACK 为对应的 INVITE 事务或 nil）。
+func (p *Proxy) HandleRequest(req *message.Request, tx *dialog.Transaction) {
+	if req.Method == message.MethodCANCEL {
+		p.handleCancel(req, tx)
+		return
+	}
+
+	// §16.3 请求校验：Max-Forwards
+	maxFwd := defaultMaxForwards
+	if v := req.Headers.Get(message.HeaderMaxForwards); v != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			p.reply(req, tx, message.StatusBadRequest, "Invalid Max-Forwards")
+			return
+		}
+		maxFwd = n
+	}
+	if maxFwd == 0 {
+		p.reply(req, tx, message.StatusTooManyHops, "")
+		return
+	}
+
+	// §22.3 代理认证：只挑战发起新对话的 INVITE，对话内请求与 ACK 直接放行
+	if p.Auth != nil && req.Method == message.MethodINVITE && !inDialog(req) {
+		user, err := p.Auth.Verify(req, true)
+		if err != nil {
+			p.challenge(req, tx, err)
+			return
+		}
+		p.logger.Info("proxy authentication passed", zap.String("user", user))
+	}
+
+	fwd := req.Clone()
+	fwd.Headers.Set(message.HeaderMaxForwards, strconv.Itoa(maxFwd-1))
+	if p.Auth != nil {
+		p.Auth.Strip(fwd, true)
+	}
+
+	// §16.4 路由预处理：顶层 Route 指向本代理时移除（松散路由）
+	if top := fwd.Headers.Get(message.HeaderRoute); top != "" {
+		if addr, err := message.ParseAddress(top); err == nil && p.stack.IsLocalURI(addr.URI) {
+			fwd.Headers.RemoveFirst(message.HeaderRoute)
+		}
+	}
+
+	// §16.5 确定目标集
+	groups, code := p.resolveTargets(fwd)
+	if code != 0 {
+		p.reply(req, tx, code, "")
+		return
+	}
+
+	// ACK 没有事务，无状态地发往唯一（或第一个）目标
+	if req.Method == message.MethodACK || tx == nil {
+		t := groups[0][0]
+		if t.uri != nil {
+			fwd.RequestURI = t.uri
+		}
+		if err := p.stack.ForwardRequest(fwd, t.dst); err != nil {
+			p.logger.Warn("forward request failed",
+				zap.String("method", string(req.Method)), zap.String("dst", t.dst), zap.Error(err))
+		}
+		return
+	}
+
+	// §16.6 转发：INVITE 记录路由，并立即回 100 Trying 抑制上游重传
+	if req.Method == message.MethodINVITE {
+		fwd.Headers.Insert(message.HeaderRecordRoute, p.stack.RecordRoute())
+		if err := tx.Respond(stack.BuildResponse(req, message.StatusTrying, "")); err != nil {
+			p.logger.Warn("send 100 Trying", zap.Error(err))
+		}
+	}
+	newForkContext(p, tx, req, fwd, groups).start()
+}
+
+// target 是一个转发目标：uri 非 nil 时改写 Request-URI，dst 为下一跳地址。
+type target struct {
+	uri *message.URI
+	dst string
+}
+
+// resolveTargets 计算目标集（RFC 3261 §16.5），按 q 值分组；失败时返回应答状态码。
+//
+//   - 仍有 Route：发往顶层 Route，Request-URI 不变
+//   - Request-URI 的 AOR 有注册绑定：每个 Contact 一个目标，q 值相同的归入同一组
+//   - Request-URI 指向本机但没有有效绑定：已知用户 480，未知用户 404
+//   - 其他：直接发往 Request-URI 的主机（如对话内请求的对端 Contact）
+func (p *Proxy) resolveTargets(req *message.Request) ([][]target, int) {
+	if top := req.Headers.Get(message.HeaderRoute); top != "" {
+		addr, err := message.ParseAddress(top)
+		if err != nil {
+			return nil, message.StatusBadRequest
+		}
+		return [][]target{{{dst: stack.TargetAddr(addr.URI)}}}, 0
+	}
+
+	bindings, err := p.registrar.Lookup(registrar.AOR(req.RequestURI))
+	if err != nil {
+		p.logger.Warn("location lookup failed", zap.Error(err))
+		return nil, message.StatusServerError
+	}
+	if len(bindings) > 0 {
+		// Lookup 已按 q 值降序排列
+		var groups [][]target
+		for i, b := range bindings {
+			uri, err := message.ParseURI(b.Contact)
+			if err != nil {
+				p.logger.Warn("skip invalid contact", zap.String("contact", b.Contact), zap.Error(err))
+				continue
+			}
+			t := target{uri: uri, dst: stack.TargetAddr(uri)}
+			if len(groups) == 0 || b.Q != bindings[i-1].Q {
+				groups = append(groups, nil)
+			}
+			groups[len(groups)-1] = append(groups[len(groups)-1], t)
+		}
+		if len(groups) == 0 {
+			return nil, message.StatusServerError
+		}
+		return groups, 0
+	}
+	if p.stack.IsLocalURI(req.RequestURI) {
+		if p.knownUser(req.RequestURI) {
+			return nil, message.StatusTemporarilyUnavailable
+		}
+		return nil, message.StatusNotFound
+	}
+	return [][]target{{{dst: stack.TargetAddr(req.RequestURI)}}}, 0
+}
+
+// knownUser 判断本机 URI 是否对应已知用户：存储中仍有（已过期的）绑定，或认证器中有其凭据。
+func (p *Proxy) knownUser(u *message.URI) bool {
+	if p.registrar.Registered(registrar.AOR(u)) {
+		return true
+	}
+	return p.Auth != nil && u.User != "" && p.Auth.HasUser(u.User)
+}
+
+// HandleResponse 把下游响应交给所属分支的响应上下文，
+// 返回 false 表示该响应不属于代理转发的请求。
+//
+// 客户端事务已结束后到达的响应（如 2xx 重传）无状态转发。
+func (p *Proxy) HandleResponse(resp *message.Response, req *message.Request) bool {
+	p.mu.Lock()
+	b := p.branches[req]
+	p.mu.Unlock()
+
+	if b == nil {
+		if !p.isForwarded(resp) {
+			return false
+		}
+		if err := p.stack.ForwardResponse(resp); err != nil {
+			p.logger.Warn("forward stray response", zap.Error(err))
+		}
+		return true
+	}
+	// 100 Trying 只在逐跳之间有效，不再向上游转发（RFC 3261 §16.7 步骤 3）
+	if resp.StatusCode == message.StatusTrying {
+		return true
+	}
+	resp.Headers.RemoveFirst(message.HeaderVia)
+	b.ctx.onResponse(b, resp)
+	return true
+}
+
+// HandleError 处理下游客户端事务失败：超时视为该分支收到 408，传输错误视为 503。
+// 返回 false 表示 req 不是代理转发的请求。
+func (p *Proxy) HandleError(req *message.Request, err error) bool {
+	p.mu.Lock()
+	b := p.branches[req]
+	p.mu.Unlock()
+	if b == nil {
+		return false
+	}
+	code := message.StatusServiceUnavailable
+	if errors.Is(err, dialog.ErrTimeout) {
+		code = message.StatusRequestTimeout
+	}
+	p.logger.Info("downstream transaction failed",
+		zap.String("method", string(req.Method)), zap.String("dst", b.dst), zap.Error(err))
+	b.ctx.onResponse(b, stack.BuildResponse(b.ctx.req, code, ""))
+	return true
+}
+
+// handleCancel 逐跳处理 CANCEL（RFC 3261 §16.10）：
+// 立即以 200 应答上游的 CANCEL，再取消匹配的 INVITE 的所有未完成分支；
+// 下游随后对 INVITE 回 487，经由正常的响应汇聚到达上游。
+func (p *Proxy) handleCancel(req *message.Request, tx *dialog.Transaction) {
+	var ctx *forkContext
+	p.mu.Lock()
+	for fwd, b := range p.branches {
+		if fwd.Method == message.MethodINVITE && sameTransaction(b.ctx.req, req) {
+			ctx = b.ctx
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if ctx == nil {
+		p.reply(req, tx, message.StatusCallDoesNotExist, "")
+		return
+	}
+	p.reply(req, tx, message.StatusOK, "")
+	ctx.cancel()
+}
+
+// challenge 以 407 挑战上游，nonce 过期时带 stale=true。
+func (p *Proxy) challenge(req *message.Request, tx *dialog.Transaction, err error) {
+	p.logger.Info("proxy authentication required",
+		zap.String("from", req.Headers.Get(message.HeaderFrom)), zap.Error(err))
+	resp := stack.BuildResponse(req, message.StatusProxyAuthRequired, "")
+	p.Auth.Challenge(resp, true, errors.Is(err, auth.ErrStaleNonce))
+	if err := tx.Respond(resp); err != nil {
+		p.logger.Warn("send 407", zap.Error(err))
+	}
+}
+
+// inDialog 判断请求是否属于已有对话（To 带 tag）。
+func inDialog(req *message.Request) bool {
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	return err == nil && to.Tag != ""
+}
+
+// reply 以 code 应答上游（ACK 没有响应，直接丢弃）。
+func (p *Proxy) reply(req *message.Request, tx *dialog.Transaction, code int, reason string) {
+	if req.Method == message.MethodACK || tx == nil {
+		p.logger.Info("dropping request", zap.String("method", string(req.Method)), zap.Int("code", code))
+		return
+	}
+	resp := stack.BuildResponse(req, code, "")
+	if reason != "" {
+		resp.Reason = reason
+	}
+	if err := tx.Respond(resp); err != nil {
+		p.logger.Warn("send response", zap.Int("code", code), zap.Error(err))
+	}
+}
+
+// isForwarded 判断响应是否经由本代理转发：顶层 Via 指向本机且其下还有 Via。
+func (p *Proxy) isForwarded(resp *message.Response) bool {
+	vias := resp.Headers.GetAll(message.HeaderVia)
+	if len(vias) < 2 {
+		return false
+	}
+	via, err := message.ParseVia(vias[0])
+	if err != nil {
+		return false
+	}
+	uri, err := message.ParseURI("sip:" + via.SentBy)
+	if err != nil {
+		return false
+	}
+	return p.stack.IsLocalURI(uri)
+}
+
+// sameTransaction 判断 CANCEL 与 INVITE 是否属于同一事务（顶层 Via branch 相同）。
+func sameTransaction(invite, cancel *message.Request) bool {
+	a, err1 := message.ParseVia(invite.Headers.Get(message.HeaderVia))
+	b, err2 := message.ParseVia(cancel.Headers.Get(message.HeaderVia))
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return a.Params.Get("branch") != "" && a.Params.Get("branch") == b.Params.Get("branch")
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/registrar"
+)
+
+func TestMaxForwards(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string // 空表示不带 Max-Forwards
+		status int    // 代理直接应答的状态码，0 表示转发
+		want   string // 转发后的 Max-Forwards
+	}{
+		{"decremented", "5", 0, "4"},
+		{"last hop", "1", 0, "0"},
+		{"missing", "", 0, "69"},
+		{"exhausted", "0", message.StatusTooManyHops, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t, nil)
+			alice := newPhone(t, nil)
+			bob := newPhone(t, func(p *phone) { p.answerNow = message.StatusOK })
+			tp.bind(t, 1.0, bob)
+
+			invite, err := alice.s.BuildInviteRequest("sip:alice@"+alice.addr, "sip:bob@"+tp.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			invite.Headers.Del(message.HeaderSupported)
+			invite.Headers.Del(message.HeaderMaxForwards)
+			if tt.value != "" {
+				invite.Headers.Set(message.HeaderMaxForwards, tt.value)
+			}
+			if err := alice.s.SendRequest(invite, tp.addr); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := alice.nextResponse(t, message.MethodINVITE, 200)
+			if tt.status != 0 {
+				if resp.StatusCode != tt.status {
+					t.Fatalf("alice got %d, want %d", resp.StatusCode, tt.status)
+				}
+				return
+			}
+			got := bob.nextRequest(t, message.MethodINVITE).Headers.Get(message.HeaderMaxForwards)
+			if got != tt.want {
+				t.Errorf("forwarded Max-Forwards = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestViaAndRecordRoute(t *testing.T) {
+	tp := newTestProxy(t, nil)
+	alice := newPhone(t, nil)
+	bob := newPhone(t, func(p *phone) { p.answerNow = message.StatusOK })
+	tp.bind(t, 1.0, bob)
+
+	invite := tp.call(t, alice)
+	fwd := bob.nextRequest(t, message.MethodINVITE)
+
+	// Request-URI 改写为注册的 Contact
+	if got, want := fwd.RequestURI.String(), "sip:bob@"+bob.addr; got != want {
+		t.Errorf("Request-URI = %s, want %s", got, want)
+	}
+	// 顶层压入代理的 Via（新 branch），原 Via 保持在其下
+	vias := fwd.Headers.GetAll(message.HeaderVia)
+	if len(vias) != 2 {
+		t.Fatalf("forwarded Via = %q, want 2 values", vias)
+	}
+	top, err := message.ParseVia(vias[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top.SentBy != tp.addr {
+		t.Errorf("top Via sent-by = %s, want %s", top.SentBy, tp.addr)
+	}
+	own, err := message.ParseVia(invite.Headers.Get(message.HeaderVia))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameBranch(vias[1], own) {
+		t.Errorf("second Via = %q, want the caller's", vias[1])
+	}
+	if b := top.Params.Get("branch"); !strings.HasPrefix(b, "z9hG4bK") || b == own.Params.Get("branch") {
+		t.Errorf("proxy branch = %q", b)
+	}
+	if got := fwd.Headers.Get(message.HeaderRecordRoute); got != tp.s.RecordRoute() {
+		t.Errorf("Record-Route = %q, want %q", got, tp.s.RecordRoute())
+	}
+
+	// 响应弹出代理的 Via，Record-Route 原样带回
+	resp := alice.nextResponse(t, message.MethodINVITE, 200)
+	if vias := resp.Headers.GetAll(message.HeaderVia); len(vias) != 1 || !sameBranch(vias[0], own) {
+		t.Errorf("response Via = %q, want only the caller's", vias)
+	}
+	if got := resp.Headers.Get(message.HeaderRecordRoute); got != tp.s.RecordRoute() {
+		t.Errorf("response Record-Route = %q", got)
+	}
+}
+
+// sameBranch 判断 Via 值与 via 是否为同一跳（branch 相同，received / rport 可能已被补上）。
+func sameBranch(value string, via *message.Via) bool {
+	v, err := message.ParseVia(value)
+	return err == nil && v.SentBy == via.SentBy && v.Params.Get("branch") == via.Params.Get("branch")
+}
+
+func TestNoBinding(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(tp *testProxy)
+		want  int
+	}{
+		{"unknown user", nil, message.StatusNotFound},
+		{"binding expired", func(tp *testProxy) {
+			tp.store.Put("sip:bob@127.0.0.1", []*registrar.Binding{{
+				Contact: "sip:bob@192.0.2.8", Expires: tp.clock.Now().Add(-time.Second), Q: 1,
+			}})
+		}, message.StatusTemporarilyUnavailable},
+		{"user with credentials", func(tp *testProxy) {
+			creds := auth.NewMemoryStore()
+			creds.Set("", "bob", "secret")
+			tp.p.Auth = auth.NewAuthenticator("example.com", creds)
+		}, message.StatusTemporarilyUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t, tt.setup)
+			alice := newPhone(t, nil)
+			// 代理只对 INVITE 要求认证，MESSAGE 直接进入路由
+			req, err := alice.s.BuildMessageRequest("sip:alice@"+alice.addr, "sip:bob@"+tp.addr, "text/plain", []byte("hi"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := alice.s.SendRequest(req, tp.addr); err != nil {
+				t.Fatal(err)
+			}
+			if resp := alice.nextResponse(t, message.MethodMESSAGE, 200); resp.StatusCode != tt.want {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxiedCall(t *testing.T) {
+	tp := newTestProxy(t, nil)
+	alice := newPhone(t, nil)
+	bob := newPhone(t, func(p *phone) { p.answerNow = message.StatusOK })
+	tp.bind(t, 1.0, bob)
+
+	tp.call(t, alice)
+	resp := alice.nextResponse(t, message.MethodINVITE, 200)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", resp.StatusCode)
+	}
+	// 2xx 的 ACK 按 Record-Route 经过代理到达 bob
+	ack := bob.nextRequest(t, message.MethodACK)
+	if n := len(ack.Headers.GetAll(message.HeaderVia)); n != 2 {
+		t.Errorf("ACK reached bob with %d Via, want 2 (via the proxy)", n)
+	}
+
+	d := alice.s.ResponseDialog(resp)
+	if d == nil {
+		t.Fatal("no dialog for the 200")
+	}
+	if err := alice.s.SendInDialog(d.NewRequest(message.MethodBYE)); err != nil {
+		t.Fatal(err)
+	}
+	bye := bob.nextRequest(t, message.MethodBYE)
+	if n := len(bye.Headers.GetAll(message.HeaderVia)); n != 2 {
+		t.Errorf("BYE reached bob with %d Via, want 2 (via the proxy)", n)
+	}
+	if resp := alice.nextResponse(t, message.MethodBYE, 200); resp.StatusCode != message.StatusOK {
+		t.Fatalf("BYE answered with %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,358 @@
+// Package registrar 实现 SIP 注册服务器与位置服务（RFC 3261 §10）。
+//
+// 注册服务器维护 AOR（Address of Record，如 sip:alice@example.com）
+// 到一组 Contact 绑定（UA 实际可达地址）的映射：
+//
+//	sip:alice@example.com ──> sip:alice@192.168.1.5:5060   q=1.0 expires=3600
+//	                      └─> sip:alice@10.0.0.8:5070      q=0.5 expires=600
+//
+// REGISTER 处理规则（RFC 3261 §10.3）：
+//   - Contact: * 且 Expires: 0 删除 AOR 的全部绑定
+//   - 同一 Call-ID 的刷新必须携带更大的 CSeq，否则整个请求被拒绝
+//   - expires 过短返回 423 Interval Too Brief 并携带 Min-Expires
+//   - 更新是原子的：任一 Contact 处理失败则不修改任何绑定
+//   - 200 OK 列出 AOR 当前全部绑定（各自带剩余 expires）
+//
+// 过期绑定由后台 reaper 定期清理，存储通过 Store 接口可替换；
+// 绑定变化（注册、注销、过期清理）通过 OnChange 通知上层，如向 presence 事件包提供在线状态。
+package registrar
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// 默认注册时长参数（秒）
+const (
+	DefaultExpires = 3600
+	MinExpires     = 60
+	MaxExpires     = 86400
+	reapInterval   = 10 * time.Second
+)
+
+// Error 是 REGISTER 处理失败的结果，携带应答的状态码。
+type Error struct {
+	Code       int
+	Reason     string
+	MinExpires int // 423 时需要在响应中携带 Min-Expires
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("register failed: %d %s", e.Code, e.Reason)
+}
+
+// Registrar 是注册服务器与位置服务。
+type Registrar struct {
+	mu     sync.Mutex // 串行化"读-改-写"
+	store  Store
+	logger *zap.Logger
+
+	// 可调参数，New 填充默认值
+	DefaultExpires int
+	MinExpires     int
+	MaxExpires     int
+	ReapInterval   time.Duration
+	Now            func() time.Time // 时钟，测试中可替换
+
+	// OnChange 在 AOR 的绑定发生变化后调用，bindings 为变化后的全部有效绑定（为空表示已全部注销或过期）。
+	// 调用时持有注册服务器的锁，回调中不能再调用 Register / Reap。
+	OnChange func(aor string, bindings []*Binding)
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// New 创建注册服务器，store 为 nil 时使用 MemoryStore。
+func New(store Store, logger *zap.Logger) *Registrar {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Registrar{
+		store:          store,
+		logger:         logger,
+		DefaultExpires: DefaultExpires,
+		MinExpires:     MinExpires,
+		MaxExpires:     MaxExpires,
+		ReapInterval:   reapInterval,
+		Now:            time.Now,
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// Start 启动后台 reaper，定期清理过期绑定。
+func (r *Registrar) Start() {
+	go r.reapLoop()
+}
+
+// Stop 停止后台 reaper。
+func (r *Registrar) Stop() {
+	r.stopOnce.Do(func() { close(r.stopCh) })
+}
+
+// AOR 将 URI 规范化为 AOR 键：scheme:user@host（主机名小写，去掉端口与参数）。
+func AOR(uri *message.URI) string {
+	if uri == nil {
+		return ""
+	}
+	aor := strings.ToLower(uri.Scheme) + ":"
+	if uri.User != "" {
+		aor += uri.User + "@"
+	}
+	return aor + strings.ToLower(uri.Host)
+}
+
+// Register 处理 REGISTER 请求，返回处理后 AOR 的全部有效绑定。
+//
+// 失败时返回 *Error，调用方据此构造对应状态码的响应。
+func (r *Registrar) Register(req *message.Request) ([]*Binding, error) {
+	toAddr, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	if err != nil {
+		return nil, &Error{Code: message.StatusBadRequest, Reason: "Invalid To"}
+	}
+	// AOR 只能是 SIP URI（RFC 4475 unksm2 的 To 为 isbn: URI）
+	if !toAddr.URI.IsSIP() {
+		return nil, &Error{Code: message.StatusUnsupportedURIScheme, Reason: "Unsupported URI Scheme"}
+	}
+	aor := AOR(toAddr.URI)
+	callID := req.Headers.Get(message.HeaderCallID)
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if callID == "" || err != nil {
+		return nil, &Error{Code: message.StatusBadRequest, Reason: "Invalid Call-ID or CSeq"}
+	}
+
+	// 请求级 Expires，Contact 未携带 expires 参数时使用
+	reqExpires := -1
+	if v := req.Headers.Get(message.HeaderExpires); v != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			return nil, &Error{Code: message.StatusBadRequest, Reason: "Invalid Expires"}
+		}
+		reqExpires = n
+	}
+
+	// 解析时列表头域已按逗号拆成各个值
+	contacts := req.Headers.GetAll(message.HeaderContact)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.Now()
+	current, err := r.store.Get(aor)
+	if err != nil {
+		return nil, &Error{Code: message.StatusServerError, Reason: "Location Service Unavailable"}
+	}
+	current = unexpired(current, now)
+
+	// 无 Contact：仅查询当前绑定
+	if len(contacts) == 0 {
+		return sortByQ(current), nil
+	}
+
+	// Contact: * —— 必须是唯一的 Contact 且 Expires 为 0
+	if len(contacts) == 1 && strings.TrimSpace(contacts[0]) == "*" {
+		if reqExpires != 0 {
+			return nil, &Error{Code: message.StatusBadRequest, Reason: "Wildcard Contact Requires Expires 0"}
+		}
+		for _, b := range current {
+			if b.CallID == callID && cseq.Seq <= b.CSeq {
+				return nil, &Error{Code: message.StatusServerError, Reason: "Out of Order CSeq"}
+			}
+		}
+		if err := r.store.Delete(aor); err != nil {
+			return nil, &Error{Code: message.StatusServerError, Reason: "Location Service Unavailable"}
+		}
+		r.logger.Info("all bindings removed", zap.String("aor", aor))
+		r.changed(aor, nil)
+		return nil, nil
+	}
+
+	updated := current
+	for _, raw := range contacts {
+		if strings.TrimSpace(raw) == "*" {
+			return nil, &Error{Code: message.StatusBadRequest, Reason: "Wildcard Contact Must Be Alone"}
+		}
+		addr, err := message.ParseAddress(raw)
+		if err != nil {
+			return nil, &Error{Code: message.StatusBadRequest, Reason: "Invalid Contact"}
+		}
+
+		expires := r.DefaultExpires
+		if v, ok := addr.Params.Lookup("expires"); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, &Error{Code: message.StatusBadRequest, Reason: "Invalid Contact Expires"}
+			}
+			expires = n
+		} else if reqExpires >= 0 {
+			expires = reqExpires
+		}
+		if expires > 0 && expires < r.MinExpires {
+			return nil, &Error{Code: message.StatusIntervalTooBrief, Reason: "Interval Too Brief", MinExpires: r.MinExpires}
+		}
+		if expires > r.MaxExpires {
+			expires = r.MaxExpires
+		}
+
+		q := 1.0
+		if v, ok := addr.Params.Lookup("q"); ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil || q < 0 || q > 1 {
+				return nil, &Error{Code: message.StatusBadRequest, Reason: "Invalid Contact q-value"}
+			}
+		}
+
+		key := uriKey(addr.URI)
+		idx := -1
+		for i, b := range updated {
+			if u, err := message.ParseURI(b.Contact); err == nil && uriKey(u) == key {
+				idx = i
+				break
+			}
+		}
+		if idx >= 0 {
+			existing := updated[idx]
+			if existing.CallID == callID && cseq.Seq <= existing.CSeq {
+				return nil, &Error{Code: message.StatusServerError, Reason: "Out of Order CSeq"}
+			}
+			if expires == 0 {
+				updated = append(updated[:idx:idx], updated[idx+1:]...)
+				continue
+			}
+			updated[idx] = &Binding{
+				AOR: aor, Contact: addr.URI.String(), Expires: now.Add(time.Duration(expires) * time.Second),
+				Q: q, CallID: callID, CSeq: cseq.Seq, UpdatedAt: now,
+			}
+			continue
+		}
+		if expires == 0 {
+			continue
+		}
+		updated = append(updated, &Binding{
+			AOR: aor, Contact: addr.URI.String(), Expires: now.Add(time.Duration(expires) * time.Second),
+			Q: q, CallID: callID, CSeq: cseq.Seq, UpdatedAt: now,
+		})
+	}
+
+	if err := r.store.Put(aor, updated); err != nil {
+		return nil, &Error{Code: message.StatusServerError, Reason: "Location Service Unavailable"}
+	}
+	r.logger.Info("bindings updated", zap.String("aor", aor), zap.Int("count", len(updated)))
+	updated = sortByQ(updated)
+	r.changed(aor, updated)
+	return updated, nil
+}
+
+// changed 调用 OnChange，调用方须持有 r.mu。
+func (r *Registrar) changed(aor string, bindings []*Binding) {
+	if r.OnChange != nil {
+		r.OnChange(aor, bindings)
+	}
+}
+
+// Lookup 返回 AOR 当前有效的绑定，按 q 值从高到低排序。
+func (r *Registrar) Lookup(aor string) ([]*Binding, error) {
+	list, err := r.store.Get(aor)
+	if err != nil {
+		return nil, err
+	}
+	return sortByQ(unexpired(list, r.Now())), nil
+}
+
+// Registered 判断 AOR 在存储中是否仍有绑定记录（包括已过期、尚未被 reaper 清理的）。
+func (r *Registrar) Registered(aor string) bool {
+	list, err := r.store.Get(aor)
+	return err == nil && len(list) > 0
+}
+
+// Reap 清理所有已过期的绑定，返回清理的数量。
+func (r *Registrar) Reap() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	aors, err := r.store.AORs()
+	if err != nil {
+		r.logger.Warn("list AORs", zap.Error(err))
+		return 0
+	}
+	now := r.Now()
+	removed := 0
+	for _, aor := range aors {
+		list, err := r.store.Get(aor)
+		if err != nil {
+			continue
+		}
+		alive := unexpired(list, now)
+		if len(alive) == len(list) {
+			continue
+		}
+		removed += len(list) - len(alive)
+		if err := r.store.Put(aor, alive); err != nil {
+			r.logger.Warn("reap bindings", zap.String("aor", aor), zap.Error(err))
+			continue
+		}
+		r.changed(aor, sortByQ(alive))
+	}
+	if removed > 0 {
+		r.logger.Info("expired bindings reaped", zap.Int("count", removed))
+	}
+	return removed
+}
+
+func (r *Registrar) reapLoop() {
+	ticker := time.NewTicker(r.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			r.Reap()
+		}
+	}
+}
+
+// ContactValue 将绑定格式化为 200 OK 中的 Contact 头域值（带剩余 expires 与 q）。
+func ContactValue(b *Binding, now time.Time) string {
+	v := fmt.Sprintf("<%s>;expires=%d", b.Contact, b.ExpiresIn(now))
+	if b.Q != 1 {
+		v += ";q=" + strconv.FormatFloat(b.Q, 'f', -1, 64)
+	}
+	return v
+}
+
+// IsError 判断 err 是否为注册失败结果并返回之。
+func IsError(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
+// uriKey 是 Contact URI 比较键（RFC 3261 §19.1.4 的简化：忽略参数，主机名不区分大小写）。
+func uriKey(u *message.URI) string {
+	return fmt.Sprintf("%s:%s@%s:%d", strings.ToLower(u.Scheme), u.User, strings.ToLower(u.Host), u.Port)
+}
+
+func unexpired(list []*Binding, now time.Time) []*Binding {
+	out := make([]*Binding, 0, len(list))
+	for _, b := range list {
+		if b.Expires.After(now) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func sortByQ(list []*Binding) []*Binding {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Q > list[j].Q
+	})
+	return list
+}
@@ -0,0 +1,255 @@
+package registrar
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+const aor = "sip:alice@example.com"
+
+// newTestRegistrar 返回时钟由 now 控制的注册服务器。
+func newTestRegistrar(now *time.Time) *Registrar {
+	r := New(nil, zap.NewNop())
+	r.Now = func() time.Time { return *now }
+	return r
+}
+
+// register 构造 REGISTER，expires 为空时不带 Expires 头域。
+func register(callID string, seq uint32, expires string, contacts ...string) *message.Request {
+	req := message.NewRequest(message.MethodREGISTER, &message.URI{Scheme: "sip", Host: "example.com"})
+	req.Headers.Set(message.HeaderVia, "SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK"+callID)
+	req.Headers.Set(message.HeaderFrom, "<"+aor+">;tag=1")
+	req.Headers.Set(message.HeaderTo, "<"+aor+">")
+	req.Headers.Set(message.HeaderCallID, callID)
+	req.Headers.Set(message.HeaderCSeq, fmt.Sprintf("%d REGISTER", seq))
+	if expires != "" {
+		req.Headers.Set(message.HeaderExpires, expires)
+	}
+	for _, c := range contacts {
+		req.Headers.Add(message.HeaderContact, c)
+	}
+	return req
+}
+
+func contactsOf(bindings []*Binding) []string {
+	var out []string
+	for _, b := range bindings {
+		out = append(out, b.Contact)
+	}
+	return out
+}
+
+// wantCode 断言 err 是状态码为 code 的 *Error。
+func wantCode(t *testing.T, err error, code int) {
+	t.Helper()
+	rerr, ok := IsError(err)
+	if !ok || rerr.Code != code {
+		t.Fatalf("error = %v, want %d", err, code)
+	}
+}
+
+func TestRegisterListsAllBindings(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := newTestRegistrar(&now)
+
+	if _, err := r.Register(register("desk", 1, "", "<sip:alice@192.0.2.1>;q=0.5")); err != nil {
+		t.Fatal(err)
+	}
+	// 另一台设备（不同 Call-ID）的注册不影响已有绑定，200 列出 AOR 的全部绑定
+	got, err := r.Register(register("mobile", 1, "600", "<sip:alice@192.0.2.2:5070>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"sip:alice@192.0.2.2:5070", "sip:alice@192.0.2.1"}
+	if !reflect.DeepEqual(contactsOf(got), want) {
+		t.Fatalf("bindings = %v, want %v (q descending)", contactsOf(got), want)
+	}
+	if v := ContactValue(got[0], now); v != "<sip:alice@192.0.2.2:5070>;expires=600" {
+		t.Errorf("Contact = %q", v)
+	}
+	if v := ContactValue(got[1], now); v != "<sip:alice@192.0.2.1>;expires=3600;q=0.5" {
+		t.Errorf("Contact = %q", v)
+	}
+
+	// 无 Contact 的 REGISTER 只查询
+	got, err = r.Register(register("query", 1, ""))
+	if err != nil || len(got) != 2 {
+		t.Fatalf("query = %v, %v", contactsOf(got), err)
+	}
+}
+
+func TestRegisterExpiresAndQ(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires string // Expires 头域
+		contact string
+		code    int // 失败时的状态码
+		want    int // 绑定的剩余秒数
+		q       float64
+	}{
+		{"default", "", "<sip:alice@192.0.2.1>", 0, DefaultExpires, 1},
+		{"request Expires", "120", "<sip:alice@192.0.2.1>", 0, 120, 1},
+		{"contact expires wins", "120", "<sip:alice@192.0.2.1>;expires=300", 0, 300, 1},
+		{"capped at MaxExpires", "", "<sip:alice@192.0.2.1>;expires=999999", 0, MaxExpires, 1},
+		{"q-value", "", "<sip:alice@192.0.2.1>;q=0.7", 0, DefaultExpires, 0.7},
+		{"too brief", "30", "<sip:alice@192.0.2.1>", message.StatusIntervalTooBrief, 0, 0},
+		{"invalid Expires", "soon", "<sip:alice@192.0.2.1>", message.StatusBadRequest, 0, 0},
+		{"invalid contact expires", "", "<sip:alice@192.0.2.1>;expires=-1", message.StatusBadRequest, 0, 0},
+		{"q out of range", "", "<sip:alice@192.0.2.1>;q=1.5", message.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			r := newTestRegistrar(&now)
+			got, err := r.Register(register("a", 1, tt.expires, tt.contact))
+			if tt.code != 0 {
+				wantCode(t, err, tt.code)
+				if tt.code == message.StatusIntervalTooBrief {
+					if rerr, _ := IsError(err); rerr.MinExpires != MinExpires {
+						t.Errorf("Min-Expires = %d, want %d", rerr.MinExpires, MinExpires)
+					}
+				}
+				if list, _ := r.Lookup(aor); len(list) != 0 {
+					t.Errorf("failed REGISTER left bindings %v", contactsOf(list))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].ExpiresIn(now) != tt.want || got[0].Q != tt.q {
+				t.Fatalf("binding = %+v, want expires %d q %v", got[0], tt.want, tt.q)
+			}
+		})
+	}
+}
+
+func TestRegisterRefreshAndRemove(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := newTestRegistrar(&now)
+	if _, err := r.Register(register("a", 5, "", "<sip:alice@192.0.2.1>")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一 Call-ID 的 CSeq 不大于已记录的值：乱序或重放的刷新被拒绝
+	for _, seq := range []uint32{5, 4} {
+		_, err := r.Register(register("a", seq, "60", "<sip:alice@192.0.2.1>"))
+		wantCode(t, err, message.StatusServerError)
+	}
+	// 不同 Call-ID 不受 CSeq 约束
+	if _, err := r.Register(register("b", 1, "120", "<sip:alice@192.0.2.1>")); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := r.Lookup(aor)
+	if len(list) != 1 || list[0].ExpiresIn(now) != 120 || list[0].CallID != "b" {
+		t.Fatalf("after refresh = %+v", list)
+	}
+
+	// expires=0 删除单个绑定
+	got, err := r.Register(register("b", 2, "", "<sip:alice@192.0.2.1>;expires=0"))
+	if err != nil || len(got) != 0 {
+		t.Fatalf("remove = %v, %v", contactsOf(got), err)
+	}
+}
+
+func TestRegisterWildcard(t *testing.T) {
+	tests := []struct {
+		name     string
+		callID   string
+		seq      uint32
+		expires  string
+		contacts []string
+		code     int // 0 表示成功并删除全部绑定
+	}{
+		{"remove all", "a", 2, "0", []string{"*"}, 0},
+		{"from another Call-ID", "other", 1, "0", []string{"*"}, 0},
+		{"without Expires 0", "a", 2, "60", []string{"*"}, message.StatusBadRequest},
+		{"without Expires", "a", 2, "", []string{"*"}, message.StatusBadRequest},
+		{"with other contacts", "a", 2, "0", []string{"*", "<sip:alice@192.0.2.3>"}, message.StatusBadRequest},
+		{"stale CSeq", "a", 1, "0", []string{"*"}, message.StatusServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			r := newTestRegistrar(&now)
+			if _, err := r.Register(register("a", 1, "", "<sip:alice@192.0.2.1>", "<sip:alice@192.0.2.2>")); err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.Register(register(tt.callID, tt.seq, tt.expires, tt.contacts...))
+			list, _ := r.Lookup(aor)
+			if tt.code != 0 {
+				wantCode(t, err, tt.code)
+				if len(list) != 2 {
+					t.Errorf("rejected REGISTER changed bindings to %v", contactsOf(list))
+				}
+				return
+			}
+			if err != nil || len(got) != 0 || len(list) != 0 {
+				t.Fatalf("Contact: * left %v, %v", contactsOf(list), err)
+			}
+		})
+	}
+}
+
+func TestRegisterUnsupportedScheme(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := newTestRegistrar(&now)
+	req := register("a", 1, "", "<name:John_Smith>")
+	req.Headers.Set(message.HeaderTo, "isbn:2983792873")
+	_, err := r.Register(req)
+	wantCode(t, err, message.StatusUnsupportedURIScheme)
+}
+
+func TestReapNotifiesChanges(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := newTestRegistrar(&now)
+	type change struct {
+		aor      string
+		contacts []string
+	}
+	var changes []change
+	r.OnChange = func(aor string, bindings []*Binding) {
+		changes = append(changes, change{aor, contactsOf(bindings)})
+	}
+
+	if _, err := r.Register(register("a", 1, "", "<sip:alice@192.0.2.1>;expires=60", "<sip:alice@192.0.2.2>;expires=600")); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || len(changes[0].contacts) != 2 {
+		t.Fatalf("changes after REGISTER = %v", changes)
+	}
+
+	// 过期前 reaper 不做任何事
+	now = now.Add(59 * time.Second)
+	if n := r.Reap(); n != 0 || len(changes) != 1 {
+		t.Fatalf("Reap before expiry removed %d, changes %v", n, changes)
+	}
+
+	// 过期的绑定在 Lookup 中立即消失，由 Reap 从存储中清理并通知
+	now = now.Add(time.Second)
+	if list, _ := r.Lookup(aor); !reflect.DeepEqual(contactsOf(list), []string{"sip:alice@192.0.2.2"}) {
+		t.Errorf("Lookup after expiry = %v", contactsOf(list))
+	}
+	if n := r.Reap(); n != 1 {
+		t.Fatalf("Reap removed %d, want 1", n)
+	}
+	if want := (change{aor, []string{"sip:alice@192.0.2.2"}}); !reflect.DeepEqual(changes[1], want) {
+		t.Errorf("change = %v, want %v", changes[1], want)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if n := r.Reap(); n != 1 {
+		t.Fatalf("Reap removed %d, want 1", n)
+	}
+	if last := changes[len(changes)-1]; len(last.contacts) != 0 {
+		t.Errorf("last change = %v, want no bindings", last)
+	}
+	if r.Registered(aor) {
+		t.Error("AOR still stored after all bindings were reaped")
+	}
+}
@@ -0,0 +1,97 @@
+package registrar
+
+import (
+	"sync"
+	"time"
+)
+
+// Binding 是一条 AOR -> Contact 绑定（RFC 3261 §10.3）。
+//
+// 字段均为可序列化的基础类型，便于 Store 实现落盘。
+type Binding struct {
+	AOR       string    `json:"aor"`
+	Contact   string    `json:"contact"` // Contact URI（不含尖括号与头域参数）
+	Expires   time.Time `json:"expires"` // 绝对过期时间
+	Q         float64   `json:"q"`       // 优先级 0~1，越大越优先
+	CallID    string    `json:"call_id"` // 注册请求的 Call-ID，用于识别同一 UA 的刷新
+	CSeq      uint32    `json:"cseq"`    // 注册请求的 CSeq，拒绝乱序 / 过期的刷新
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ExpiresIn 返回距离过期的剩余秒数（已过期为 0）。
+func (b *Binding) ExpiresIn(now time.Time) int {
+	d := b.Expires.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// Store 是位置服务的存储接口，可替换为持久化实现（文件、Redis、SQL ...）。
+//
+// Registrar 在自身锁内完成"读-改-写"，Store 只需保证单次调用的原子性。
+type Store interface {
+	// Get 返回 AOR 的全部绑定（可能包含已过期但尚未清理的绑定）。
+	Get(aor string) ([]*Binding, error)
+	// Put 用 bindings 整体替换 AOR 的绑定；bindings 为空时等价于 Delete。
+	Put(aor string, bindings []*Binding) error
+	// Delete 删除 AOR 的全部绑定。
+	Delete(aor string) error
+	// AORs 返回当前存储的所有 AOR。
+	AORs() ([]string, error)
+}
+
+// MemoryStore 是进程内的 Store 实现。
+type MemoryStore struct {
+	mu       sync.RWMutex
+	bindings map[string][]*Binding
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{bindings: make(map[string][]*Binding)}
+}
+
+func (m *MemoryStore) Get(aor string) ([]*Binding, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := m.bindings[aor]
+	out := make([]*Binding, len(list))
+	for i, b := range list {
+		cp := *b
+		out[i] = &cp
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) Put(aor string, bindings []*Binding) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(bindings) == 0 {
+		delete(m.bindings, aor)
+		return nil
+	}
+	list := make([]*Binding, len(bindings))
+	for i, b := range bindings {
+		cp := *b
+		list[i] = &cp
+	}
+	m.bindings[aor] = list
+	return nil
+}
+
+func (m *MemoryStore) Delete(aor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bindings, aor)
+	return nil
+}
+
+func (m *MemoryStore) AORs() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]string, 0, len(m.bindings))
+	for aor := range m.bindings {
+		out = append(out, aor)
+	}
+	return out, nil
+}
@@ -0,0 +1,143 @@
+package rtp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+)
+
+// Encoder 把 16 位线性 PCM 编码为 payload，Decoder 反之。G.711 每个采样一个字节。
+type (
+	Encoder func(pcm []int16) []byte
+	Decoder func(payload []byte) []int16
+)
+
+// CodecFor 返回 sdp 编码对应的编解码器，目前支持 PCMU / PCMA（8000 Hz）。
+func CodecFor(c sdp.Codec) (Encoder, Decoder, error) {
+	if c.ClockRate != 8000 {
+		return nil, nil, fmt.Errorf("unsupported codec %s", c)
+	}
+	switch strings.ToUpper(c.Name) {
+	case "PCMU":
+		return EncodeULaw, DecodeULaw, nil
+	case "PCMA":
+		return EncodeALaw, DecodeALaw, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported codec %s", c)
+}
+
+// EncodeULaw 按 G.711 μ-law 编码。
+func EncodeULaw(pcm []int16) []byte {
+	out := make([]byte, len(pcm))
+	for i, s := range pcm {
+		out[i] = linearToULaw(s)
+	}
+	return out
+}
+
+// DecodeULaw 解码 G.711 μ-law。
+func DecodeULaw(payload []byte) []int16 {
+	out := make([]int16, len(payload))
+	for i, u := range payload {
+		out[i] = ulawToLinear(u)
+	}
+	return out
+}
+
+// EncodeALaw 按 G.711 A-law 编码。
+func EncodeALaw(pcm []int16) []byte {
+	out := make([]byte, len(pcm))
+	for i, s := range pcm {
+		out[i] = linearToALaw(s)
+	}
+	return out
+}
+
+// DecodeALaw 解码 G.711 A-law。
+func DecodeALaw(payload []byte) []int16 {
+	out := make([]int16, len(payload))
+	for i, a := range payload {
+		out[i] = alawToLinear(a)
+	}
+	return out
+}
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+func linearToULaw(s int16) byte {
+	v := int(s)
+	var sign int
+	if v < 0 {
+		v = -v
+		sign = 0x80
+	}
+	if v > ulawClip {
+		v = ulawClip
+	}
+	v += ulawBias
+	exp := 7
+	for mask := 0x4000; v&mask == 0 && exp > 0; mask >>= 1 {
+		exp--
+	}
+	mant := (v >> (exp + 3)) & 0x0F
+	return ^byte(sign | exp<<4 | mant)
+}
+
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	exp := int(u>>4) & 0x07
+	v := ((int(u&0x0F) << 3) + ulawBias) << exp
+	v -= ulawBias
+	if u&0x80 != 0 {
+		v = -v
+	}
+	return int16(v)
+}
+
+// alawSegEnd 是 A-law 各段的上界（13 位线性值）。
+var alawSegEnd = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+
+func linearToALaw(s int16) byte {
+	v := int(s) >> 3
+	mask := 0xD5
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+	seg := 0
+	for seg < 8 && v > alawSegEnd[seg] {
+		seg++
+	}
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	a := seg << 4
+	if seg < 2 {
+		a |= (v >> 1) & 0x0F
+	} else {
+		a |= (v >> seg) & 0x0F
+	}
+	return byte(a ^ mask)
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch seg := int(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
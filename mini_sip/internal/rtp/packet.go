@@ -0,0 +1,116 @@
+// Package rtp 实现一个最小的 RTP/RTCP 媒体引擎（RFC 3550），用于承载 SDP 协商出的音频流。
+//
+// RTP 固定头（12 字节）：
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|V=2|P|X|  CC   |M|     PT      |       sequence number         |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                           timestamp                           |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|           synchronization source (SSRC) identifier            |
+//	+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+
+//	|            contributing source (CSRC) identifiers             |
+//	|                             ....                              |
+//
+// 每个媒体流使用一对 UDP 端口：偶数端口收发 RTP，下一个端口收发 RTCP（RFC 3550 §11）。
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version 是 RTP / RTCP 协议版本。
+const Version = 2
+
+const headerLen = 12
+
+// ErrInvalidPacket 表示收到的数据不是合法的 RTP / RTCP 包。
+var ErrInvalidPacket = errors.New("invalid RTP packet")
+
+// Header 是 RTP 固定头。
+type Header struct {
+	Marker         bool
+	PayloadType    uint8
+	SequenceNumber uint16
+	Timestamp      uint32 // 采样时钟，单位为 1/ClockRate 秒
+	SSRC           uint32 // 同步源标识，会话内随机选取
+	CSRC           []uint32
+}
+
+// Packet 是一个 RTP 包。
+type Packet struct {
+	Header
+	Payload []byte
+}
+
+// Marshal 序列化 RTP 包（不使用填充与扩展头）。
+func (p *Packet) Marshal() []byte {
+	buf := make([]byte, headerLen+4*len(p.CSRC)+len(p.Payload))
+	buf[0] = Version<<6 | uint8(len(p.CSRC)&0x0F)
+	buf[1] = p.PayloadType & 0x7F
+	if p.Marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:], p.SequenceNumber)
+	binary.BigEndian.PutUint32(buf[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:], p.SSRC)
+	off := headerLen
+	for _, c := range p.CSRC {
+		binary.BigEndian.PutUint32(buf[off:], c)
+		off += 4
+	}
+	copy(buf[off:], p.Payload)
+	return buf
+}
+
+// Unmarshal 解析 RTP 包，跳过扩展头并去除填充。Payload 引用 data 的内存。
+func (p *Packet) Unmarshal(data []byte) error {
+	if len(data) < headerLen {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidPacket, len(data))
+	}
+	if data[0]>>6 != Version {
+		return fmt.Errorf("%w: version %d", ErrInvalidPacket, data[0]>>6)
+	}
+	padding := data[0]&0x20 != 0
+	extension := data[0]&0x10 != 0
+	cc := int(data[0] & 0x0F)
+
+	p.Marker = data[1]&0x80 != 0
+	p.PayloadType = data[1] & 0x7F
+	p.SequenceNumber = binary.BigEndian.Uint16(data[2:])
+	p.Timestamp = binary.BigEndian.Uint32(data[4:])
+	p.SSRC = binary.BigEndian.Uint32(data[8:])
+
+	off := headerLen
+	if len(data) < off+4*cc {
+		return fmt.Errorf("%w: truncated CSRC list", ErrInvalidPacket)
+	}
+	p.CSRC = nil
+	for i := 0; i < cc; i++ {
+		p.CSRC = append(p.CSRC, binary.BigEndian.Uint32(data[off:]))
+		off += 4
+	}
+	if extension {
+		if len(data) < off+4 {
+			return fmt.Errorf("%w: truncated extension", ErrInvalidPacket)
+		}
+		off += 4 + 4*int(binary.BigEndian.Uint16(data[off+2:]))
+		if len(data) < off {
+			return fmt.Errorf("%w: truncated extension", ErrInvalidPacket)
+		}
+	}
+	end := len(data)
+	if padding {
+		n := int(data[end-1])
+		if n == 0 || end-n < off {
+			return fmt.Errorf("%w: bad padding", ErrInvalidPacket)
+		}
+		end -= n
+	}
+	p.Payload = data[off:end]
+	return nil
+}
@@ -0,0 +1,235 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// RTCP 包类型（RFC 3550 §12.1）。
+const (
+	TypeSR   = 200
+	TypeRR   = 201
+	TypeSDES = 202
+	TypeBYE  = 203
+)
+
+const sdesCNAME = 1
+
+// ReportBlock 是 SR / RR 中对一个同步源的接收统计（RFC 3550 §6.4.1）。
+type ReportBlock struct {
+	SSRC         uint32 // 被统计的同步源
+	FractionLost uint8  // 上次报告以来的丢包率，定点数 x/256
+	TotalLost    int32  // 累计丢包数（24 位有符号）
+	HighestSeq   uint32 // 扩展后的最大序号（高 16 位为回绕次数）
+	Jitter       uint32 // 到达间隔抖动，单位为时间戳单位
+	LastSR       uint32 // 最近一次收到的 SR 中 NTP 时间戳的中间 32 位
+	DelaySinceSR uint32 // 收到该 SR 至今的延迟，单位 1/65536 秒
+}
+
+// SenderReport 是 SR 包：发送方统计加若干接收报告块。
+type SenderReport struct {
+	SSRC        uint32
+	NTPTime     uint64 // NTP 格式的墙钟时间
+	RTPTime     uint32 // 与 NTPTime 对应的 RTP 时间戳
+	PacketCount uint32
+	OctetCount  uint32
+	Reports     []ReportBlock
+}
+
+// ReceiverReport 是 RR 包：只接收不发送的参与者使用。
+type ReceiverReport struct {
+	SSRC    uint32
+	Reports []ReportBlock
+}
+
+// SourceDescription 是只含 CNAME 的 SDES 包（CNAME 是复合包中必需的条目，RFC 3550 §6.5.1）。
+type SourceDescription struct {
+	SSRC  uint32
+	CNAME string
+}
+
+// Goodbye 是 BYE 包，表示同步源离开会话。
+type Goodbye struct {
+	Sources []uint32
+}
+
+// RTCPPacket 是可序列化的 RTCP 包，为 *SenderReport、*ReceiverReport、*SourceDescription 或 *Goodbye。
+type RTCPPacket interface {
+	marshal() []byte
+}
+
+// MarshalCompound 把多个 RTCP 包串接成一个复合包（第一个应为 SR 或 RR）。
+func MarshalCompound(pkts ...RTCPPacket) []byte {
+	var buf []byte
+	for _, p := range pkts {
+		buf = append(buf, p.marshal()...)
+	}
+	return buf
+}
+
+// rtcpHeader 构造 4 字节公共头，length 为包总长度（字节，必须是 4 的倍数）。
+func rtcpHeader(count int, pt uint8, length int) []byte {
+	h := make([]byte, 4, length)
+	h[0] = Version<<6 | uint8(count&0x1F)
+	h[1] = pt
+	binary.BigEndian.PutUint16(h[2:], uint16(length/4-1))
+	return h
+}
+
+func (r ReportBlock) marshal() []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint32(b[0:], r.SSRC)
+	binary.BigEndian.PutUint32(b[4:], uint32(r.FractionLost)<<24|uint32(r.TotalLost)&0xFFFFFF)
+	binary.BigEndian.PutUint32(b[8:], r.HighestSeq)
+	binary.BigEndian.PutUint32(b[12:], r.Jitter)
+	binary.BigEndian.PutUint32(b[16:], r.LastSR)
+	binary.BigEndian.PutUint32(b[20:], r.DelaySinceSR)
+	return b
+}
+
+func (sr *SenderReport) marshal() []byte {
+	b := rtcpHeader(len(sr.Reports), TypeSR, 28+24*len(sr.Reports))
+	b = binary.BigEndian.AppendUint32(b, sr.SSRC)
+	b = binary.BigEndian.AppendUint64(b, sr.NTPTime)
+	b = binary.BigEndian.AppendUint32(b, sr.RTPTime)
+	b = binary.BigEndian.AppendUint32(b, sr.PacketCount)
+	b = binary.BigEndian.AppendUint32(b, sr.OctetCount)
+	for _, r := range sr.Reports {
+		b = append(b, r.marshal()...)
+	}
+	return b
+}
+
+func (rr *ReceiverReport) marshal() []byte {
+	b := rtcpHeader(len(rr.Reports), TypeRR, 8+24*len(rr.Reports))
+	b = binary.BigEndian.AppendUint32(b, rr.SSRC)
+	for _, r := range rr.Reports {
+		b = append(b, r.marshal()...)
+	}
+	return b
+}
+
+func (sd *SourceDescription) marshal() []byte {
+	cname := sd.CNAME
+	if len(cname) > 255 {
+		cname = cname[:255]
+	}
+	// SSRC + CNAME 条目（类型、长度、文本）+ 结束符，补齐到 4 字节
+	n := 4 + 2 + len(cname) + 1
+	n = (n + 3) &^ 3
+	b := rtcpHeader(1, TypeSDES, 4+n)
+	b = binary.BigEndian.AppendUint32(b, sd.SSRC)
+	b = append(b, sdesCNAME, uint8(len(cname)))
+	b = append(b, cname...)
+	return append(b, make([]byte, 4+n-len(b))...)
+}
+
+func (g *Goodbye) marshal() []byte {
+	b := rtcpHeader(len(g.Sources), TypeBYE, 4+4*len(g.Sources))
+	for _, s := range g.Sources {
+		b = binary.BigEndian.AppendUint32(b, s)
+	}
+	return b
+}
+
+// UnmarshalCompound 解析复合 RTCP 包，未知类型的包被跳过。
+func UnmarshalCompound(data []byte) ([]RTCPPacket, error) {
+	var pkts []RTCPPacket
+	for len(data) > 0 {
+		if len(data) < 4 || data[0]>>6 != Version {
+			return pkts, fmt.Errorf("%w: bad RTCP header", ErrInvalidPacket)
+		}
+		count := int(data[0] & 0x1F)
+		length := (int(binary.BigEndian.Uint16(data[2:])) + 1) * 4
+		if length > len(data) {
+			return pkts, fmt.Errorf("%w: RTCP length %d exceeds %d", ErrInvalidPacket, length, len(data))
+		}
+		body := data[4:length]
+		switch data[1] {
+		case TypeSR:
+			if len(body) < 24+24*count {
+				return pkts, fmt.Errorf("%w: truncated SR", ErrInvalidPacket)
+			}
+			pkts = append(pkts, &SenderReport{
+				SSRC:        binary.BigEndian.Uint32(body[0:]),
+				NTPTime:     binary.BigEndian.Uint64(body[4:]),
+				RTPTime:     binary.BigEndian.Uint32(body[12:]),
+				PacketCount: binary.BigEndian.Uint32(body[16:]),
+				OctetCount:  binary.BigEndian.Uint32(body[20:]),
+				Reports:     parseReportBlocks(body[24:], count),
+			})
+		case TypeRR:
+			if len(body) < 4+24*count {
+				return pkts, fmt.Errorf("%w: truncated RR", ErrInvalidPacket)
+			}
+			pkts = append(pkts, &ReceiverReport{
+				SSRC:    binary.BigEndian.Uint32(body[0:]),
+				Reports: parseReportBlocks(body[4:], count),
+			})
+		case TypeSDES:
+			if sd := parseSDES(body, count); sd != nil {
+				pkts = append(pkts, sd)
+			}
+		case TypeBYE:
+			g := &Goodbye{}
+			for i := 0; i < count && 4*i+4 <= len(body); i++ {
+				g.Sources = append(g.Sources, binary.BigEndian.Uint32(body[4*i:]))
+			}
+			pkts = append(pkts, g)
+		}
+		data = data[length:]
+	}
+	return pkts, nil
+}
+
+func parseReportBlocks(b []byte, count int) []ReportBlock {
+	blocks := make([]ReportBlock, 0, count)
+	for i := 0; i < count; i++ {
+		r := b[24*i:]
+		lost := binary.BigEndian.Uint32(r[4:])
+		total := int32(lost & 0xFFFFFF)
+		if total&0x800000 != 0 {
+			total -= 1 << 24 // 符号扩展
+		}
+		blocks = append(blocks, ReportBlock{
+			SSRC:         binary.BigEndian.Uint32(r[0:]),
+			FractionLost: uint8(lost >> 24),
+			TotalLost:    total,
+			HighestSeq:   binary.BigEndian.Uint32(r[8:]),
+			Jitter:       binary.BigEndian.Uint32(r[12:]),
+			LastSR:       binary.BigEndian.Uint32(r[16:]),
+			DelaySinceSR: binary.BigEndian.Uint32(r[20:]),
+		})
+	}
+	return blocks
+}
+
+// parseSDES 只取第一个 chunk 的 CNAME。
+func parseSDES(b []byte, count int) *SourceDescription {
+	if count == 0 || len(b) < 4 {
+		return nil
+	}
+	sd := &SourceDescription{SSRC: binary.BigEndian.Uint32(b)}
+	for items := b[4:]; len(items) >= 2 && items[0] != 0; {
+		n := int(items[1])
+		if len(items) < 2+n {
+			break
+		}
+		if items[0] == sdesCNAME {
+			sd.CNAME = string(items[2 : 2+n])
+		}
+		items = items[2+n:]
+	}
+	return sd
+}
+
+// ntpEpochOffset 是 1900-01-01 到 1970-01-01 的秒数。
+const ntpEpochOffset = 2208988800
+
+// NTPTime 把时间转换为 64 位 NTP 时间戳（高 32 位为秒，低 32 位为秒的小数部分）。
+func NTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
@@ -0,0 +1,378 @@
+package rtp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultPtime 是每个 RTP 包承载的音频时长（RFC 3551 §4.5 对 G.711 的默认值）。
+	DefaultPtime = 20 * time.Millisecond
+	// DefaultRTCPInterval 是 RTCP 报告的平均发送间隔（RFC 3550 §6.2 建议的最小值）。
+	DefaultRTCPInterval = 5 * time.Second
+)
+
+// Config 描述一个媒体流的两端与编码。
+type Config struct {
+	LocalAddr    string // 绑定的本地地址，空表示所有地址
+	LocalPort    int    // 本地 RTP 端口，RTCP 使用 LocalPort+1
+	RemoteAddr   string
+	RemotePort   int // 对端 RTP 端口，RTCP 使用 RemotePort+1
+	Codec        sdp.Codec
+	CNAME        string        // RTCP SDES 中的规范名，空时为 "mini_sip@<本地地址>"
+	Ptime        time.Duration // 0 时为 DefaultPtime
+	RTCPInterval time.Duration // 0 时为 DefaultRTCPInterval
+
+	// OnAudio 非 nil 时，收到的 payload 解码为 PCM 后回调（在接收协程中调用）
+	OnAudio func(pcm []int16)
+}
+
+// ConfigFromStream 由 SDP 协商结果构造配置，选择第一个支持的编码（跳过 telephone-event 等）。
+func ConfigFromStream(st sdp.Stream) (Config, error) {
+	for _, c := range st.Codecs {
+		if _, _, err := CodecFor(c); err == nil {
+			return Config{
+				LocalPort:  st.LocalPort,
+				RemoteAddr: st.RemoteAddr,
+				RemotePort: st.RemotePort,
+				Codec:      c,
+			}, nil
+		}
+	}
+	return Config{}, fmt.Errorf("no supported codec in %v", st.Codecs)
+}
+
+// Stats 是会话的收发统计快照。
+type Stats struct {
+	SSRC        uint32
+	PacketsSent uint32
+	OctetsSent  uint32
+
+	RemoteSSRC      uint32
+	PacketsReceived uint32
+	OctetsReceived  uint64
+	PacketsLost     int32         // 按序号推算的累计丢包
+	Jitter          time.Duration // 到达间隔抖动
+
+	// 对端 RTCP 报告中关于本端发送流的统计，HaveRemoteReport 为 false 时无效
+	HaveRemoteReport   bool
+	RemoteFractionLost float64
+	RemoteTotalLost    int32
+	RemoteJitter       time.Duration
+
+	RTCPSent     int
+	RTCPReceived int
+}
+
+// Session 是一个 RTP 会话：一对 UDP 端口，收发 RTP 并周期性交换 RTCP 报告。
+type Session struct {
+	cfg    Config
+	logger *zap.Logger
+
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+	remoteRTP  *net.UDPAddr
+	remoteRTCP *net.UDPAddr
+	enc        Encoder
+	dec        Decoder
+	ssrc       uint32
+	start      time.Time
+
+	mu          sync.Mutex
+	seq         uint16
+	tsBase      uint32 // start 时刻对应的 RTP 时间戳（随机初值，RFC 3550 §5.1）
+	packetsSent uint32
+	octetsSent  uint32
+	recv        receiverStats
+	lastSR      uint32    // 最近收到的对端 SR 的 NTP 中间 32 位
+	lastSRAt    time.Time // 收到该 SR 的时刻
+	remote      ReportBlock
+	haveRemote  bool
+	rtcpSent    int
+	rtcpRecv    int
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewSession 绑定 RTP / RTCP 端口并开始接收与 RTCP 报告，发送需调用 Send。
+func NewSession(cfg Config, logger *zap.Logger) (*Session, error) {
+	enc, dec, err := CodecFor(cfg.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Ptime == 0 {
+		cfg.Ptime = DefaultPtime
+	}
+	if cfg.RTCPInterval == 0 {
+		cfg.RTCPInterval = DefaultRTCPInterval
+	}
+	remoteRTP, err := net.ResolveUDPAddr("udp", net.JoinHostPort(cfg.RemoteAddr, strconv.Itoa(cfg.RemotePort)))
+	if err != nil {
+		return nil, fmt.Errorf("resolve remote RTP address: %w", err)
+	}
+	remoteRTCP := &net.UDPAddr{IP: remoteRTP.IP, Port: remoteRTP.Port + 1, Zone: remoteRTP.Zone}
+
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(cfg.LocalAddr), Port: cfg.LocalPort})
+	if err != nil {
+		return nil, fmt.Errorf("listen RTP: %w", err)
+	}
+	rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(cfg.LocalAddr), Port: cfg.LocalPort + 1})
+	if err != nil {
+		rtpConn.Close()
+		return nil, fmt.Errorf("listen RTCP: %w", err)
+	}
+	if cfg.CNAME == "" {
+		cfg.CNAME = "mini_sip@" + rtpConn.LocalAddr().String()
+	}
+
+	s := &Session{
+		cfg:        cfg,
+		logger:     logger,
+		rtpConn:    rtpConn,
+		rtcpConn:   rtcpConn,
+		remoteRTP:  remoteRTP,
+		remoteRTCP: remoteRTCP,
+		enc:        enc,
+		dec:        dec,
+		ssrc:       rand.Uint32(),
+		start:      time.Now(),
+		seq:        uint16(rand.Uint32()),
+		tsBase:     rand.Uint32(),
+		done:       make(chan struct{}),
+	}
+	s.wg.Add(3)
+	go s.readRTP()
+	go s.readRTCP()
+	go s.reportLoop()
+	logger.Info("RTP session started",
+		zap.String("local", rtpConn.LocalAddr().String()),
+		zap.String("remote", remoteRTP.String()),
+		zap.Stringer("codec", cfg.Codec),
+		zap.Uint32("ssrc", s.ssrc),
+	)
+	return s, nil
+}
+
+// rtpNow 返回当前时刻对应的 RTP 时间戳。
+func (s *Session) rtpNow() uint32 {
+	return s.tsBase + uint32(time.Since(s.start).Nanoseconds()*int64(s.cfg.Codec.ClockRate)/int64(time.Second))
+}
+
+// Send 在后台按 ptime 节奏发送 src 的音频，直到 src 结束或会话关闭。
+func (s *Session) Send(src Source) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		samples := int(int64(s.cfg.Codec.ClockRate) * int64(s.cfg.Ptime) / int64(time.Second))
+		buf := make([]int16, samples)
+		ts := s.rtpNow()
+		ticker := time.NewTicker(s.cfg.Ptime)
+		defer ticker.Stop()
+		for first := true; ; first = false {
+			n, err := src.ReadSamples(buf)
+			if n > 0 {
+				s.sendPacket(s.enc(buf[:n]), ts, first)
+				ts += uint32(n)
+			}
+			if err != nil {
+				s.logger.Info("RTP source finished", zap.Error(err))
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// sendPacket 发送一个 RTP 包，marker 标记话音突发的第一个包。
+func (s *Session) sendPacket(payload []byte, ts uint32, marker bool) {
+	s.mu.Lock()
+	p := &Packet{
+		Header: Header{
+			Marker:         marker,
+			PayloadType:    s.cfg.Codec.PayloadType,
+			SequenceNumber: s.seq,
+			Timestamp:      ts,
+			SSRC:           s.ssrc,
+		},
+		Payload: payload,
+	}
+	s.seq++
+	s.packetsSent++
+	s.octetsSent += uint32(len(payload))
+	s.mu.Unlock()
+	if _, err := s.rtpConn.WriteToUDP(p.Marshal(), s.remoteRTP); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Warn("send RTP", zap.Error(err))
+	}
+}
+
+func (s *Session) readRTP() {
+	defer s.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.rtpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var p Packet
+		if err := p.Unmarshal(buf[:n]); err != nil {
+			s.logger.Debug("drop invalid RTP packet", zap.Error(err))
+			continue
+		}
+		s.mu.Lock()
+		if s.recv.started && p.SSRC != s.recv.ssrc {
+			s.logger.Info("RTP source changed", zap.Uint32("old", s.recv.ssrc), zap.Uint32("new", p.SSRC))
+			s.recv = receiverStats{}
+		}
+		arrival := uint32(time.Since(s.start).Nanoseconds() * int64(s.cfg.Codec.ClockRate) / int64(time.Second))
+		s.recv.update(&p, arrival)
+		s.mu.Unlock()
+		if s.cfg.OnAudio != nil && p.PayloadType == s.cfg.Codec.PayloadType {
+			s.cfg.OnAudio(s.dec(p.Payload))
+		}
+	}
+}
+
+func (s *Session) readRTCP() {
+	defer s.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.rtcpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkts, err := UnmarshalCompound(buf[:n])
+		if err != nil {
+			s.logger.Debug("invalid RTCP packet", zap.Error(err))
+		}
+		now := time.Now()
+		s.mu.Lock()
+		s.rtcpRecv++
+		for _, p := range pkts {
+			var blocks []ReportBlock
+			switch p := p.(type) {
+			case *SenderReport:
+				s.lastSR = uint32(p.NTPTime >> 16)
+				s.lastSRAt = now
+				blocks = p.Reports
+			case *ReceiverReport:
+				blocks = p.Reports
+			case *Goodbye:
+				s.logger.Info("RTCP BYE received", zap.Any("ssrc", p.Sources))
+			}
+			for _, b := range blocks {
+				if b.SSRC == s.ssrc {
+					s.remote = b
+					s.haveRemote = true
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// reportLoop 周期性发送 RTCP 报告，间隔在 [0.5, 1.5] 倍之间随机化以避免同步（RFC 3550 §6.3.1），
+// 第一个报告的间隔减半（§6.3.6）。
+func (s *Session) reportLoop() {
+	defer s.wg.Done()
+	for interval := s.cfg.RTCPInterval / 2; ; interval = s.cfg.RTCPInterval {
+		d := time.Duration(float64(interval) * (0.5 + rand.Float64()))
+		select {
+		case <-time.After(d):
+			s.sendReport(false)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sendReport 发送复合 RTCP 包：发送过 RTP 时为 SR，否则为 RR，后接 SDES（及 BYE）。
+func (s *Session) sendReport(bye bool) {
+	now := time.Now()
+	s.mu.Lock()
+	var blocks []ReportBlock
+	if s.recv.started {
+		b := s.recv.reportBlock()
+		if !s.lastSRAt.IsZero() {
+			b.LastSR = s.lastSR
+			b.DelaySinceSR = uint32(now.Sub(s.lastSRAt) * 65536 / time.Second)
+		}
+		blocks = append(blocks, b)
+	}
+	var report RTCPPacket
+	if s.packetsSent > 0 {
+		report = &SenderReport{
+			SSRC:        s.ssrc,
+			NTPTime:     NTPTime(now),
+			RTPTime:     s.rtpNow(),
+			PacketCount: s.packetsSent,
+			OctetCount:  s.octetsSent,
+			Reports:     blocks,
+		}
+	} else {
+		report = &ReceiverReport{SSRC: s.ssrc, Reports: blocks}
+	}
+	pkts := []RTCPPacket{report, &SourceDescription{SSRC: s.ssrc, CNAME: s.cfg.CNAME}}
+	if bye {
+		pkts = append(pkts, &Goodbye{Sources: []uint32{s.ssrc}})
+	}
+	s.rtcpSent++
+	s.mu.Unlock()
+	if _, err := s.rtcpConn.WriteToUDP(MarshalCompound(pkts...), s.remoteRTCP); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Warn("send RTCP", zap.Error(err))
+	}
+}
+
+// Stats 返回当前统计。
+func (s *Session) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clock := float64(s.cfg.Codec.ClockRate)
+	st := Stats{
+		SSRC:         s.ssrc,
+		PacketsSent:  s.packetsSent,
+		OctetsSent:   s.octetsSent,
+		RTCPSent:     s.rtcpSent,
+		RTCPReceived: s.rtcpRecv,
+	}
+	if s.recv.started {
+		st.RemoteSSRC = s.recv.ssrc
+		st.PacketsReceived = s.recv.received
+		st.OctetsReceived = s.recv.octets
+		st.PacketsLost = s.recv.lost()
+		st.Jitter = time.Duration(s.recv.jitter / clock * float64(time.Second))
+	}
+	if s.haveRemote {
+		st.HaveRemoteReport = true
+		st.RemoteFractionLost = float64(s.remote.FractionLost) / 256
+		st.RemoteTotalLost = s.remote.TotalLost
+		st.RemoteJitter = time.Duration(float64(s.remote.Jitter) / clock * float64(time.Second))
+	}
+	return st
+}
+
+// Close 停止发送，发送带 BYE 的最终 RTCP 报告后关闭端口。
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.sendReport(true)
+		s.rtpConn.Close()
+		s.rtcpConn.Close()
+		s.wg.Wait()
+		s.logger.Info("RTP session closed", zap.Uint32("ssrc", s.ssrc))
+	})
+	return nil
+}
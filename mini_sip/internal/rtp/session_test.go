@@ -0,0 +1,153 @@
+package rtp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+	"go.uber.org/zap"
+)
+
+// limited 只提供前 n 个采样的信号源。
+type limited struct {
+	src Source
+	n   int
+}
+
+func (l *limited) ReadSamples(buf []int16) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	if len(buf) > l.n {
+		buf = buf[:l.n]
+	}
+	n, err := l.src.ReadSamples(buf)
+	l.n -= n
+	return n, err
+}
+
+// freePortPair 返回 127.0.0.1 上一个偶数端口 p，p 与 p+1 当前都空闲（RTP / RTCP）。
+func freePortPair(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := c.LocalAddr().(*net.UDPAddr).Port &^ 1
+		c.Close()
+		a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p})
+		if err != nil {
+			continue
+		}
+		b, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p + 1})
+		a.Close()
+		if err != nil {
+			continue
+		}
+		b.Close()
+		return p
+	}
+	t.Fatal("no free RTP port pair")
+	return 0
+}
+
+// waitFor 轮询 cond 直到为真或超时。
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionLoopback(t *testing.T) {
+	alicePort, bobPort := freePortPair(t), freePortPair(t)
+	for bobPort == alicePort {
+		bobPort = freePortPair(t)
+	}
+	var mu sync.Mutex
+	var frames, samples int
+	base := Config{
+		LocalAddr:    "127.0.0.1",
+		RemoteAddr:   "127.0.0.1",
+		Codec:        sdp.PCMU,
+		Ptime:        5 * time.Millisecond,
+		RTCPInterval: 100 * time.Millisecond,
+	}
+	aliceCfg := base
+	aliceCfg.LocalPort, aliceCfg.RemotePort = alicePort, bobPort
+	bobCfg := base
+	bobCfg.LocalPort, bobCfg.RemotePort = bobPort, alicePort
+	bobCfg.OnAudio = func(pcm []int16) {
+		mu.Lock()
+		frames++
+		samples += len(pcm)
+		mu.Unlock()
+	}
+
+	alice, err := NewSession(aliceCfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := NewSession(bobCfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// 5ms 的 PCMU 帧为 40 个采样，共发送 20 帧
+	const packets = 20
+	alice.Send(&limited{src: NewTone(440), n: packets * 40})
+
+	waitFor(t, "RTP packets at bob", func() bool { return bob.Stats().PacketsReceived == packets })
+	st := bob.Stats()
+	if st.RemoteSSRC != alice.Stats().SSRC || st.OctetsReceived != packets*40 || st.PacketsLost != 0 {
+		t.Errorf("bob stats = %+v", st)
+	}
+	mu.Lock()
+	if frames != packets || samples != packets*40 {
+		t.Errorf("bob decoded %d frames / %d samples, want %d / %d", frames, samples, packets, packets*40)
+	}
+	mu.Unlock()
+	if st := alice.Stats(); st.PacketsSent != packets || st.OctetsSent != packets*40 {
+		t.Errorf("alice stats = %+v", st)
+	}
+
+	// bob 的 RTCP 接收报告把 alice 的发送流报告回 alice
+	waitFor(t, "RTCP report at alice", func() bool {
+		st := alice.Stats()
+		return st.HaveRemoteReport && st.RTCPReceived > 0
+	})
+	if st := alice.Stats(); st.RemoteTotalLost != 0 || st.RemoteFractionLost != 0 {
+		t.Errorf("alice remote report = %+v", st)
+	}
+	waitFor(t, "RTCP at bob", func() bool { return bob.Stats().RTCPReceived > 0 })
+}
+
+func TestConfigFromStream(t *testing.T) {
+	st := sdp.Stream{
+		LocalPort:  40000,
+		RemoteAddr: "192.0.2.20",
+		RemotePort: 30000,
+		Codecs:     []sdp.Codec{sdp.TelephoneEvent, sdp.G729, sdp.PCMA, sdp.PCMU},
+	}
+	cfg, err := ConfigFromStream(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Codec != sdp.PCMA || cfg.LocalPort != 40000 || cfg.RemoteAddr != "192.0.2.20" || cfg.RemotePort != 30000 {
+		t.Errorf("config = %+v", cfg)
+	}
+	st.Codecs = []sdp.Codec{sdp.G729}
+	if _, err := ConfigFromStream(st); err == nil {
+		t.Error("ConfigFromStream accepted a stream without a G.711 codec")
+	}
+}
@@ -0,0 +1,123 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Source 提供待发送的 16 位线性 PCM 采样（单声道，采样率与编码时钟频率一致）。
+type Source interface {
+	// ReadSamples 填充 buf，返回写入的采样数；数据结束时返回 io.EOF。
+	ReadSamples(buf []int16) (int, error)
+}
+
+// Tone 是正弦波信号源，永不结束。
+type Tone struct {
+	Frequency  float64
+	SampleRate int
+	Amplitude  float64 // 0..1，0 时为 0.3
+
+	n int
+}
+
+// NewTone 创建 8000 Hz 采样率的正弦波信号源。
+func NewTone(frequency float64) *Tone {
+	return &Tone{Frequency: frequency, SampleRate: 8000}
+}
+
+func (t *Tone) ReadSamples(buf []int16) (int, error) {
+	amp := t.Amplitude
+	if amp == 0 {
+		amp = 0.3
+	}
+	for i := range buf {
+		v := amp * math.Sin(2*math.Pi*t.Frequency*float64(t.n)/float64(t.SampleRate))
+		buf[i] = int16(v * math.MaxInt16)
+		t.n++
+	}
+	return len(buf), nil
+}
+
+// WAV 是从 WAV 文件读取的信号源，只支持 16 位 PCM；多声道取平均混为单声道。
+type WAV struct {
+	SampleRate int
+
+	data     []byte // data 块内容
+	channels int
+	off      int
+}
+
+// OpenWAV 读取整个 WAV 文件。
+func OpenWAV(path string) (*WAV, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWAV(raw)
+}
+
+// ParseWAV 解析 RIFF/WAVE 数据，按块遍历，忽略 fmt 与 data 以外的块（如 LIST）。
+func ParseWAV(raw []byte) (*WAV, error) {
+	if len(raw) < 12 || string(raw[0:4]) != "RIFF" || string(raw[8:12]) != "WAVE" {
+		return nil, errors.New("wav: not a RIFF/WAVE file")
+	}
+	w := &WAV{}
+	var gotFmt bool
+	for chunks := raw[12:]; len(chunks) >= 8; {
+		id := string(chunks[0:4])
+		size := int(binary.LittleEndian.Uint32(chunks[4:8]))
+		body := chunks[8:]
+		if size > len(body) {
+			size = len(body) // 截断的文件：读取现有部分
+		}
+		body = body[:size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("wav: short fmt chunk")
+			}
+			format := binary.LittleEndian.Uint16(body[0:])
+			w.channels = int(binary.LittleEndian.Uint16(body[2:]))
+			w.SampleRate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits := binary.LittleEndian.Uint16(body[14:])
+			if format != 1 || bits != 16 || w.channels == 0 {
+				return nil, fmt.Errorf("wav: unsupported format %d, %d bits, %d channels (need 16-bit PCM)", format, bits, w.channels)
+			}
+			gotFmt = true
+		case "data":
+			w.data = body
+		}
+		// 块按 2 字节对齐
+		next := 8 + size + size&1
+		if next > len(chunks) {
+			break
+		}
+		chunks = chunks[next:]
+	}
+	if !gotFmt || w.data == nil {
+		return nil, errors.New("wav: missing fmt or data chunk")
+	}
+	return w, nil
+}
+
+func (w *WAV) ReadSamples(buf []int16) (int, error) {
+	frame := 2 * w.channels
+	n := 0
+	for n < len(buf) && w.off+frame <= len(w.data) {
+		sum := 0
+		for c := 0; c < w.channels; c++ {
+			sum += int(int16(binary.LittleEndian.Uint16(w.data[w.off+2*c:])))
+		}
+		buf[n] = int16(sum / w.channels)
+		w.off += frame
+		n++
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
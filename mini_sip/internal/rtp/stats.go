@@ -0,0 +1,87 @@
+package rtp
+
+// receiverStats 按 RFC 3550 附录 A.1 / A.8 维护一个同步源的接收统计。
+type receiverStats struct {
+	ssrc     uint32
+	started  bool
+	baseSeq  uint16
+	maxSeq   uint16
+	cycles   uint32 // 序号回绕次数 << 16
+	received uint32
+	octets   uint64
+
+	// 上次生成报告块时的值，用于计算区间丢包率
+	expectedPrior uint32
+	receivedPrior uint32
+
+	transit int32   // 上一个包的相对传输时间（时间戳单位）
+	jitter  float64 // 到达间隔抖动估计（时间戳单位）
+}
+
+// update 记录一个收到的包，arrival 为到达时刻换算成的时间戳单位。
+func (r *receiverStats) update(p *Packet, arrival uint32) {
+	seq := p.SequenceNumber
+	if !r.started {
+		*r = receiverStats{ssrc: p.SSRC, started: true, baseSeq: seq, maxSeq: seq}
+	} else if delta := seq - r.maxSeq; delta != 0 && delta < 0x8000 {
+		// 正常前进（允许中间有丢包），序号变小说明发生了回绕；更旧的序号为乱序或重复包
+		if seq < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = seq
+	}
+	r.received++
+	r.octets += uint64(len(p.Payload))
+
+	// J(i) = J(i-1) + (|D(i-1,i)| - J(i-1)) / 16
+	transit := int32(arrival - p.Timestamp)
+	if r.received > 1 {
+		d := float64(transit - r.transit)
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (d - r.jitter) / 16
+	}
+	r.transit = transit
+}
+
+func (r *receiverStats) extendedMax() uint32 {
+	return r.cycles + uint32(r.maxSeq)
+}
+
+func (r *receiverStats) expected() uint32 {
+	return r.extendedMax() - uint32(r.baseSeq) + 1
+}
+
+// lost 返回累计丢包数，重复包可能使其为负。
+func (r *receiverStats) lost() int32 {
+	return int32(r.expected() - r.received)
+}
+
+// reportBlock 生成报告块并开始新的统计区间。
+func (r *receiverStats) reportBlock() ReportBlock {
+	expected := r.expected()
+	expectedInterval := expected - r.expectedPrior
+	receivedInterval := r.received - r.receivedPrior
+	r.expectedPrior = expected
+	r.receivedPrior = r.received
+
+	var fraction uint8
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint8(lostInterval << 8 / int64(expectedInterval))
+	}
+	total := r.lost()
+	// 累计丢包数限制在 24 位有符号范围内
+	if total > 0x7FFFFF {
+		total = 0x7FFFFF
+	} else if total < -0x800000 {
+		total = -0x800000
+	}
+	return ReportBlock{
+		SSRC:         r.ssrc,
+		FractionLost: fraction,
+		TotalLost:    total,
+		HighestSeq:   r.extendedMax(),
+		Jitter:       uint32(r.jitter),
+	}
+}
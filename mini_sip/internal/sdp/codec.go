@@ -0,0 +1,174 @@
+package sdp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Codec 描述一个 RTP payload 格式，对应 m= 行中的一个 format 及其 rtpmap / fmtp 属性。
+type Codec struct {
+	PayloadType uint8
+	Name        string // 编码名，如 PCMU、telephone-event
+	ClockRate   int
+	Channels    int    // 0 表示缺省（单声道）
+	Fmtp        string // a=fmtp 参数，空表示无
+}
+
+// RTPMap 返回 a=rtpmap 的值部分，如 "0 PCMU/8000"。
+func (c Codec) RTPMap() string {
+	v := fmt.Sprintf("%d %s/%d", c.PayloadType, c.Name, c.ClockRate)
+	if c.Channels > 1 {
+		v += "/" + strconv.Itoa(c.Channels)
+	}
+	return v
+}
+
+func (c Codec) String() string {
+	return c.RTPMap()
+}
+
+// sameFormat 判断两个编码是否为同一格式（编码名不区分大小写，RFC 4855 §3）。
+func (c Codec) sameFormat(o Codec) bool {
+	return strings.EqualFold(c.Name, o.Name) && c.ClockRate == o.ClockRate && c.channels() == o.channels()
+}
+
+func (c Codec) channels() int {
+	if c.Channels == 0 {
+		return 1
+	}
+	return c.Channels
+}
+
+// 常用编码（RFC 3551 静态 payload 类型，telephone-event 使用惯例的动态类型 101）。
+var (
+	PCMU           = Codec{PayloadType: 0, Name: "PCMU", ClockRate: 8000}
+	PCMA           = Codec{PayloadType: 8, Name: "PCMA", ClockRate: 8000}
+	G722           = Codec{PayloadType: 9, Name: "G722", ClockRate: 8000}
+	G729           = Codec{PayloadType: 18, Name: "G729", ClockRate: 8000}
+	TelephoneEvent = Codec{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Fmtp: "0-16"}
+)
+
+// staticCodecs 是 RFC 3551 表 4 中的音频静态 payload 类型，m= 行未给出 rtpmap 时使用。
+var staticCodecs = map[uint8]Codec{
+	0:  PCMU,
+	3:  {PayloadType: 3, Name: "GSM", ClockRate: 8000},
+	4:  {PayloadType: 4, Name: "G723", ClockRate: 8000},
+	8:  PCMA,
+	9:  G722,
+	18: G729,
+}
+
+// Codecs 按 m= 行中的顺序（即偏好顺序）返回媒体的编码列表。
+// 非 RTP 的 format 与缺少 rtpmap 的动态 payload 类型被跳过。
+func (m *Media) Codecs() []Codec {
+	rtpmaps := make(map[uint8]Codec)
+	fmtps := make(map[uint8]string)
+	for _, a := range m.Attributes {
+		switch a.Key {
+		case "rtpmap":
+			if c, err := parseRTPMap(a.Value); err == nil {
+				rtpmaps[c.PayloadType] = c
+			}
+		case "fmtp":
+			pt, params, ok := strings.Cut(a.Value, " ")
+			if n, err := strconv.ParseUint(pt, 10, 8); ok && err == nil {
+				fmtps[uint8(n)] = strings.TrimSpace(params)
+			}
+		}
+	}
+	var codecs []Codec
+	for _, f := range m.Formats {
+		n, err := strconv.ParseUint(f, 10, 8)
+		if err != nil || n > 127 {
+			continue
+		}
+		pt := uint8(n)
+		c, ok := rtpmaps[pt]
+		if !ok {
+			if c, ok = staticCodecs[pt]; !ok {
+				continue
+			}
+		}
+		c.Fmtp = fmtps[pt]
+		codecs = append(codecs, c)
+	}
+	return codecs
+}
+
+// SetCodecs 用 codecs 替换媒体的 format 列表与 rtpmap / fmtp 属性，其他属性保持不变。
+func (m *Media) SetCodecs(codecs []Codec) {
+	attrs := make([]Attribute, 0, len(m.Attributes)+2*len(codecs))
+	for _, a := range m.Attributes {
+		if a.Key != "rtpmap" && a.Key != "fmtp" {
+			attrs = append(attrs, a)
+		}
+	}
+	var codecAttrs []Attribute
+	m.Formats = m.Formats[:0]
+	for _, c := range codecs {
+		m.Formats = append(m.Formats, strconv.Itoa(int(c.PayloadType)))
+		codecAttrs = append(codecAttrs, Attribute{Key: "rtpmap", Value: c.RTPMap()})
+		if c.Fmtp != "" {
+			codecAttrs = append(codecAttrs, Attribute{Key: "fmtp", Value: fmt.Sprintf("%d %s", c.PayloadType, c.Fmtp)})
+		}
+	}
+	// rtpmap / fmtp 放在其他属性（如方向）之前，与常见实现的输出一致
+	m.Attributes = append(codecAttrs, attrs...)
+}
+
+// parseRTPMap 解析 "<pt> <name>/<clock>[/<channels>]"。
+func parseRTPMap(v string) (Codec, error) {
+	pt, enc, ok := strings.Cut(v, " ")
+	if !ok {
+		return Codec{}, fmt.Errorf("rtpmap: %q", v)
+	}
+	n, err := strconv.ParseUint(pt, 10, 8)
+	if err != nil {
+		return Codec{}, fmt.Errorf("rtpmap payload type: %w", err)
+	}
+	parts := strings.Split(strings.TrimSpace(enc), "/")
+	if len(parts) < 2 {
+		return Codec{}, fmt.Errorf("rtpmap encoding: %q", enc)
+	}
+	c := Codec{PayloadType: uint8(n), Name: parts[0]}
+	if c.ClockRate, err = strconv.Atoi(parts[1]); err != nil {
+		return Codec{}, fmt.Errorf("rtpmap clock rate: %w", err)
+	}
+	if len(parts) > 2 {
+		if c.Channels, err = strconv.Atoi(parts[2]); err != nil {
+			return Codec{}, fmt.Errorf("rtpmap channels: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// knownCodecs 是 LookupCodec 可识别的编码。
+var knownCodecs = []Codec{PCMU, PCMA, G722, G729, TelephoneEvent}
+
+// LookupCodec 按编码名（不区分大小写）查找常用编码，用于从配置构造 Config.Codecs。
+func LookupCodec(name string) (Codec, bool) {
+	for _, c := range knownCodecs {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+// ParseCodecList 解析逗号分隔的编码名列表，如 "PCMU,PCMA,telephone-event"。
+func ParseCodecList(list string) ([]Codec, error) {
+	var codecs []Codec
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		c, ok := LookupCodec(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown codec %q", name)
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
+}
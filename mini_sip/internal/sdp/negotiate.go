@@ -0,0 +1,183 @@
+package sdp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNoCommonMedia 表示 offer 中没有任何可接受的媒体流，UAS 应回复 488 Not Acceptable Here。
+var ErrNoCommonMedia = errors.New("no acceptable media")
+
+// Config 是本端的媒体能力，用于生成 offer 与 answer。
+type Config struct {
+	Username  string    // o= 行用户名，空时为 "-"
+	Address   string    // c= 行地址，即本端接收 RTP 的地址
+	Port      int       // 本端接收音频 RTP 的端口
+	Codecs    []Codec   // 支持的编码，按偏好顺序
+	Direction Direction // 本端方向，空时为 sendrecv
+}
+
+func (c Config) direction() Direction {
+	if c.Direction == "" {
+		return SendRecv
+	}
+	return c.Direction
+}
+
+func (c Config) newSession() *Session {
+	id := uint64(time.Now().Unix())
+	conn := NewConnection(c.Address)
+	return &Session{
+		Origin: Origin{
+			Username:       c.Username,
+			SessionID:      id,
+			SessionVersion: id,
+			NetType:        conn.NetType,
+			AddrType:       conn.AddrType,
+			Address:        c.Address,
+		},
+		Name:       "-",
+		Connection: conn,
+	}
+}
+
+// NewOffer 生成只含一个音频流的 offer。
+func NewOffer(cfg Config) *Session {
+	s := cfg.newSession()
+	m := &Media{Type: "audio", Port: cfg.Port, Proto: "RTP/AVP"}
+	m.SetCodecs(cfg.Codecs)
+	m.SetDirection(cfg.direction())
+	s.Media = []*Media{m}
+	return s
+}
+
+// Answer 按 RFC 3264 §6 为 offer 生成 answer。
+//
+// answer 与 offer 的 m= 行一一对应。本端只支持一个 RTP/AVP 音频流，对每个 m= 行：
+//   - 第一个可接受的音频流：取双方共同支持的编码（沿用 offer 的顺序与 payload 类型，§6.1），
+//     方向取 offer 方向的反向与本端方向的交集
+//   - 其他流（视频、SRTP、端口为 0、没有共同编码等）：端口置 0 表示拒绝
+//
+// 所有流都被拒绝时返回 ErrNoCommonMedia。
+func Answer(offer *Session, cfg Config) (*Session, error) {
+	ans := cfg.newSession()
+	accepted := false
+	for _, om := range offer.Media {
+		var codecs []Codec
+		if !accepted && om.Type == "audio" && om.Proto == "RTP/AVP" && om.Port != 0 {
+			codecs = intersect(om.Codecs(), cfg.Codecs)
+		}
+		if !hasMediaCodec(codecs) {
+			// 拒绝：端口为 0，format 列表照抄 offer（m= 行至少要有一个 format）
+			ans.Media = append(ans.Media, &Media{
+				Type:    om.Type,
+				Proto:   om.Proto,
+				Formats: append([]string(nil), om.Formats...),
+			})
+			continue
+		}
+		accepted = true
+		m := &Media{Type: om.Type, Port: cfg.Port, Proto: om.Proto}
+		m.SetCodecs(codecs)
+		m.SetDirection(combine(offer.Direction(om).Reverse(), cfg.direction()))
+		ans.Media = append(ans.Media, m)
+	}
+	if !accepted {
+		return nil, ErrNoCommonMedia
+	}
+	return ans, nil
+}
+
+// intersect 返回 offered 中本端也支持的编码，保留 offered 的顺序、payload 类型与 fmtp。
+func intersect(offered, local []Codec) []Codec {
+	var out []Codec
+	for _, oc := range offered {
+		for _, lc := range local {
+			if oc.sameFormat(lc) {
+				out = append(out, oc)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// hasMediaCodec 判断编码列表中是否有真正的媒体编码（只有 telephone-event 无法建立通话）。
+func hasMediaCodec(codecs []Codec) bool {
+	for _, c := range codecs {
+		if !strings.EqualFold(c.Name, TelephoneEvent.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// combine 求两个方向的交集：双方都允许发送才发送，都允许接收才接收。
+func combine(a, b Direction) Direction {
+	send := canSend(a) && canSend(b)
+	recv := canRecv(a) && canRecv(b)
+	switch {
+	case send && recv:
+		return SendRecv
+	case send:
+		return SendOnly
+	case recv:
+		return RecvOnly
+	}
+	return Inactive
+}
+
+func canSend(d Direction) bool { return d == SendRecv || d == SendOnly }
+func canRecv(d Direction) bool { return d == SendRecv || d == RecvOnly }
+
+// Stream 是一个协商完成的媒体流，从本端视角描述。
+type Stream struct {
+	Type       string
+	LocalPort  int
+	RemoteAddr string
+	RemotePort int
+	Codecs     []Codec   // 双方共同支持的编码，使用对端的 payload 类型（发送时使用）
+	Direction  Direction // 本端方向
+}
+
+// Negotiate 比较 offer/answer 交换完成后的本端与对端描述，返回所有被接受的媒体流。
+//
+// 双方均可调用：offerer 传入 (offer, answer)，answerer 传入 (answer, offer)。
+// 两者的 m= 行数不一致（RFC 3264 §6）或没有被接受的流时返回错误。
+func Negotiate(local, remote *Session) ([]Stream, error) {
+	if len(local.Media) != len(remote.Media) {
+		return nil, fmt.Errorf("%w: %d local media vs %d remote", ErrInvalid, len(local.Media), len(remote.Media))
+	}
+	var streams []Stream
+	for i, lm := range local.Media {
+		rm := remote.Media[i]
+		if lm.Port == 0 || rm.Port == 0 {
+			continue
+		}
+		if lm.Type != rm.Type {
+			return nil, fmt.Errorf("%w: media %d type %s vs %s", ErrInvalid, i, lm.Type, rm.Type)
+		}
+		conn := remote.ConnectionFor(rm)
+		if conn == nil {
+			return nil, fmt.Errorf("%w: media %d has no connection address", ErrInvalid, i)
+		}
+		codecs := intersect(rm.Codecs(), lm.Codecs())
+		if !hasMediaCodec(codecs) {
+			continue
+		}
+		streams = append(streams, Stream{
+			Type:       lm.Type,
+			LocalPort:  lm.Port,
+			RemoteAddr: conn.Address,
+			RemotePort: rm.Port,
+			Codecs:     codecs,
+			Direction:  combine(local.Direction(lm), remote.Direction(rm).Reverse()),
+		})
+	}
+	if len(streams) == 0 {
+		return nil, ErrNoCommonMedia
+	}
+	return streams, nil
+}
@@ -0,0 +1,165 @@
+package sdp
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseOffer 解析以 \n 分行的 SDP 文本。
+func parseOffer(t *testing.T, text string) *Session {
+	t.Helper()
+	s, err := Parse([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+const offerText = `v=0
+o=alice 2890844526 2890844526 IN IP4 192.0.2.10
+s=-
+c=IN IP4 192.0.2.10
+t=0 0
+m=audio 49170 RTP/AVP 8 0 96 97
+a=rtpmap:96 opus/48000/2
+a=rtpmap:97 telephone-event/8000
+a=fmtp:97 0-15
+a=sendrecv
+m=video 51372 RTP/AVP 31
+a=rtpmap:31 H261/90000
+`
+
+var bob = Config{Address: "192.0.2.20", Port: 30000, Codecs: []Codec{PCMU, PCMA, TelephoneEvent}}
+
+func TestAnswerSelectsCommonCodecs(t *testing.T) {
+	offer := parseOffer(t, offerText)
+	ans, err := Answer(offer, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ans.Media) != len(offer.Media) {
+		t.Fatalf("answer has %d m= lines, offer has %d", len(ans.Media), len(offer.Media))
+	}
+
+	// 沿用 offer 的顺序与 payload 类型（telephone-event 是 97 而不是本端的 101）
+	audio := ans.Media[0]
+	want := []Codec{PCMA, PCMU, {PayloadType: 97, Name: "telephone-event", ClockRate: 8000, Fmtp: "0-15"}}
+	if got := audio.Codecs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("answer codecs = %v, want %v", got, want)
+	}
+	if audio.Port != bob.Port || ans.Direction(audio) != SendRecv {
+		t.Errorf("audio port %d direction %s", audio.Port, ans.Direction(audio))
+	}
+
+	// 视频流被拒绝：端口为 0，format 照抄 offer
+	video := ans.Media[1]
+	if video.Type != "video" || video.Port != 0 || !reflect.DeepEqual(video.Formats, []string{"31"}) {
+		t.Errorf("video answer = %+v, want a rejected m=video line", video)
+	}
+}
+
+func TestAnswerDirection(t *testing.T) {
+	tests := []struct {
+		offered Direction
+		local   Direction
+		want    Direction
+	}{
+		{SendRecv, "", SendRecv},
+		{SendOnly, "", RecvOnly},
+		{RecvOnly, "", SendOnly},
+		{Inactive, "", Inactive},
+		{SendRecv, SendOnly, SendOnly},
+		{RecvOnly, RecvOnly, Inactive},
+	}
+	for _, tt := range tests {
+		offer := parseOffer(t, strings.Replace(offerText, "a=sendrecv", "a="+string(tt.offered), 1))
+		cfg := bob
+		cfg.Direction = tt.local
+		ans, err := Answer(offer, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ans.Direction(ans.Media[0]); got != tt.want {
+			t.Errorf("offer %s, local %q: answer direction = %s, want %s", tt.offered, tt.local, got, tt.want)
+		}
+	}
+}
+
+func TestAnswerNoCommonMedia(t *testing.T) {
+	tests := []struct {
+		name  string
+		offer string
+	}{
+		{"no common codec", strings.Replace(offerText, "RTP/AVP 8 0 96 97", "RTP/AVP 96", 1)},
+		{"only telephone-event", strings.Replace(offerText, "RTP/AVP 8 0 96 97", "RTP/AVP 97", 1)},
+		{"secure profile", strings.Replace(offerText, "49170 RTP/AVP", "49170 RTP/SAVP", 1)},
+		{"audio disabled", strings.Replace(offerText, "m=audio 49170", "m=audio 0", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Answer(parseOffer(t, tt.offer), bob); !errors.Is(err, ErrNoCommonMedia) {
+				t.Fatalf("Answer error = %v, want ErrNoCommonMedia", err)
+			}
+		})
+	}
+}
+
+func TestOfferAnswerNegotiate(t *testing.T) {
+	alice := Config{Address: "192.0.2.10", Port: 40000, Codecs: []Codec{PCMA, PCMU, TelephoneEvent}, Direction: SendOnly}
+	offer := NewOffer(alice)
+	// offer 经过序列化再解析，与线路上的交换一致
+	wireOffer, err := Parse(offer.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := Answer(wireOffer, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wireAnswer, err := Parse(answer.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offerer, err := Negotiate(offer, wireAnswer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answerer, err := Negotiate(answer, wireOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCodecs := []Codec{PCMA, PCMU, TelephoneEvent}
+	wantOfferer := []Stream{{Type: "audio", LocalPort: 40000, RemoteAddr: "192.0.2.20", RemotePort: 30000, Codecs: wantCodecs, Direction: SendOnly}}
+	wantAnswerer := []Stream{{Type: "audio", LocalPort: 30000, RemoteAddr: "192.0.2.10", RemotePort: 40000, Codecs: wantCodecs, Direction: RecvOnly}}
+	if !reflect.DeepEqual(offerer, wantOfferer) {
+		t.Errorf("offerer streams = %+v, want %+v", offerer, wantOfferer)
+	}
+	if !reflect.DeepEqual(answerer, wantAnswerer) {
+		t.Errorf("answerer streams = %+v, want %+v", answerer, wantAnswerer)
+	}
+}
+
+func TestNegotiateMediaCountMismatch(t *testing.T) {
+	offer := parseOffer(t, offerText)
+	answer := NewOffer(bob) // 只有一个 m= 行
+	if _, err := Negotiate(answer, offer); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Negotiate error = %v, want ErrInvalid", err)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	offer := parseOffer(t, offerText)
+	again, err := Parse(offer.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(offer, again) {
+		t.Errorf("round trip differs:\n got %+v\nwant %+v", again, offer)
+	}
+	if got, want := string(offer.Marshal()), strings.ReplaceAll(offerText, "\n", "\r\n"); got != want {
+		t.Errorf("Marshal = %q, want %q", got, want)
+	}
+}
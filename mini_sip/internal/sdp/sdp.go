@@ -0,0 +1,379 @@
+// Package sdp 实现 SDP 会话描述的解析与序列化（RFC 8866）以及 offer/answer 协商（RFC 3264）。
+//
+// SDP 是 SIP 消息体中描述媒体会话的文本格式，每行 <type>=<value>：
+//
+//	v=0                                         版本
+//	o=alice 2890844526 2890844526 IN IP4 10.0.0.1  发起者与会话标识
+//	s=-                                         会话名
+//	c=IN IP4 10.0.0.1                           连接地址（RTP 目标地址）
+//	t=0 0                                       时间（0 0 表示永久）
+//	m=audio 49170 RTP/AVP 0 8 101               媒体：类型 端口 协议 payload 类型列表
+//	a=rtpmap:0 PCMU/8000                        payload 类型 -> 编码名/时钟频率
+//	a=rtpmap:101 telephone-event/8000
+//	a=fmtp:101 0-16                             编码参数
+//	a=sendrecv                                  方向
+//
+// 会话级（第一个 m= 之前）的 c= 与方向属性是各媒体的默认值。
+package sdp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ContentType 是 SDP 消息体的 MIME 类型。
+const ContentType = "application/sdp"
+
+// ErrInvalid 表示 SDP 格式错误。
+var ErrInvalid = errors.New("invalid SDP")
+
+// Direction 是媒体方向属性（RFC 8866 §6.7）。
+type Direction string
+
+const (
+	SendRecv Direction = "sendrecv"
+	SendOnly Direction = "sendonly"
+	RecvOnly Direction = "recvonly"
+	Inactive Direction = "inactive"
+)
+
+// Reverse 返回对端视角的方向：sendonly <-> recvonly。
+func (d Direction) Reverse() Direction {
+	switch d {
+	case SendOnly:
+		return RecvOnly
+	case RecvOnly:
+		return SendOnly
+	}
+	return d
+}
+
+func isDirection(s string) bool {
+	switch Direction(s) {
+	case SendRecv, SendOnly, RecvOnly, Inactive:
+		return true
+	}
+	return false
+}
+
+// Origin 是 o= 行：会话发起者与会话标识。
+type Origin struct {
+	Username       string
+	SessionID      uint64
+	SessionVersion uint64 // 每次修改会话描述（如 re-INVITE）加一
+	NetType        string // IN
+	AddrType       string // IP4 / IP6
+	Address        string
+}
+
+func (o Origin) String() string {
+	user := o.Username
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Sprintf("%s %d %d %s %s %s", user, o.SessionID, o.SessionVersion, o.NetType, o.AddrType, o.Address)
+}
+
+// Connection 是 c= 行。
+type Connection struct {
+	NetType  string
+	AddrType string
+	Address  string
+}
+
+func (c Connection) String() string {
+	return fmt.Sprintf("%s %s %s", c.NetType, c.AddrType, c.Address)
+}
+
+// NewConnection 根据地址构造 IN IP4 / IN IP6 连接信息。
+func NewConnection(addr string) *Connection {
+	addrType := "IP4"
+	if strings.Contains(addr, ":") {
+		addrType = "IP6"
+	}
+	return &Connection{NetType: "IN", AddrType: addrType, Address: addr}
+}
+
+// Attribute 是 a= 行，Value 为空表示属性标志（如 a=sendrecv）。
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+func (a Attribute) String() string {
+	if a.Value == "" {
+		return a.Key
+	}
+	return a.Key + ":" + a.Value
+}
+
+// Session 是一个完整的会话描述。
+type Session struct {
+	Version    int
+	Origin     Origin
+	Name       string
+	Info       string
+	Connection *Connection
+	Bandwidths []string // b= 行原样保留
+	Timing     [2]uint64
+	Attributes []Attribute
+	Media      []*Media
+}
+
+// Media 是一个 m= 段。
+type Media struct {
+	Type       string // audio / video / application ...
+	Port       int    // 0 表示拒绝该媒体流
+	NumPorts   int    // m=audio 49170/2 中的端口数，0 表示未指定
+	Proto      string // RTP/AVP / RTP/SAVP ...
+	Formats    []string
+	Info       string
+	Connection *Connection
+	Bandwidths []string
+	Attributes []Attribute
+}
+
+// Parse 解析 SDP 文本，兼容 CRLF 与 LF 换行。
+func Parse(data []byte) (*Session, error) {
+	s := &Session{}
+	var media *Media
+	seenVersion := false
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, fmt.Errorf("%w: line %d: %q", ErrInvalid, i+1, line)
+		}
+		typ, val := line[0], line[2:]
+		if !seenVersion && typ != 'v' {
+			return nil, fmt.Errorf("%w: first line must be v=", ErrInvalid)
+		}
+		var err error
+		switch typ {
+		case 'v':
+			if seenVersion {
+				return nil, fmt.Errorf("%w: duplicate v= line", ErrInvalid)
+			}
+			seenVersion = true
+			s.Version, err = strconv.Atoi(val)
+		case 'o':
+			s.Origin, err = parseOrigin(val)
+		case 's':
+			s.Name = val
+		case 'i':
+			if media != nil {
+				media.Info = val
+			} else {
+				s.Info = val
+			}
+		case 'c':
+			var c *Connection
+			c, err = parseConnection(val)
+			if media != nil {
+				media.Connection = c
+			} else {
+				s.Connection = c
+			}
+		case 'b':
+			if media != nil {
+				media.Bandwidths = append(media.Bandwidths, val)
+			} else {
+				s.Bandwidths = append(s.Bandwidths, val)
+			}
+		case 't':
+			s.Timing, err = parseTiming(val)
+		case 'a':
+			a := parseAttribute(val)
+			if media != nil {
+				media.Attributes = append(media.Attributes, a)
+			} else {
+				s.Attributes = append(s.Attributes, a)
+			}
+		case 'm':
+			media, err = parseMedia(val)
+			if err == nil {
+				s.Media = append(s.Media, media)
+			}
+		default:
+			// u= e= p= r= z= k= 等行对媒体协商无影响，忽略
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalid, i+1, err)
+		}
+	}
+	if !seenVersion {
+		return nil, fmt.Errorf("%w: empty description", ErrInvalid)
+	}
+	return s, nil
+}
+
+func parseOrigin(v string) (Origin, error) {
+	f := strings.Fields(v)
+	if len(f) != 6 {
+		return Origin{}, fmt.Errorf("o= needs 6 fields: %q", v)
+	}
+	id, err := strconv.ParseUint(f[1], 10, 64)
+	if err != nil {
+		return Origin{}, fmt.Errorf("o= session id: %w", err)
+	}
+	ver, err := strconv.ParseUint(f[2], 10, 64)
+	if err != nil {
+		return Origin{}, fmt.Errorf("o= session version: %w", err)
+	}
+	return Origin{Username: f[0], SessionID: id, SessionVersion: ver, NetType: f[3], AddrType: f[4], Address: f[5]}, nil
+}
+
+func parseConnection(v string) (*Connection, error) {
+	f := strings.Fields(v)
+	if len(f) != 3 {
+		return nil, fmt.Errorf("c= needs 3 fields: %q", v)
+	}
+	return &Connection{NetType: f[0], AddrType: f[1], Address: f[2]}, nil
+}
+
+func parseTiming(v string) ([2]uint64, error) {
+	f := strings.Fields(v)
+	if len(f) != 2 {
+		return [2]uint64{}, fmt.Errorf("t= needs 2 fields: %q", v)
+	}
+	start, err1 := strconv.ParseUint(f[0], 10, 64)
+	stop, err2 := strconv.ParseUint(f[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return [2]uint64{}, fmt.Errorf("t= invalid times: %q", v)
+	}
+	return [2]uint64{start, stop}, nil
+}
+
+func parseAttribute(v string) Attribute {
+	if k, val, ok := strings.Cut(v, ":"); ok {
+		return Attribute{Key: k, Value: val}
+	}
+	return Attribute{Key: v}
+}
+
+func parseMedia(v string) (*Media, error) {
+	f := strings.Fields(v)
+	if len(f) < 4 {
+		return nil, fmt.Errorf("m= needs at least 4 fields: %q", v)
+	}
+	m := &Media{Type: f[0], Proto: f[2], Formats: f[3:]}
+	port := f[1]
+	if p, n, ok := strings.Cut(port, "/"); ok {
+		port = p
+		num, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, fmt.Errorf("m= port count: %w", err)
+		}
+		m.NumPorts = num
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("m= invalid port %q", f[1])
+	}
+	m.Port = p
+	return m, nil
+}
+
+// Marshal 按 RFC 8866 §5 规定的行顺序序列化，换行使用 CRLF。
+func (s *Session) Marshal() []byte {
+	var sb strings.Builder
+	line := func(typ byte, v string) {
+		sb.WriteByte(typ)
+		sb.WriteByte('=')
+		sb.WriteString(v)
+		sb.WriteString("\r\n")
+	}
+	line('v', strconv.Itoa(s.Version))
+	line('o', s.Origin.String())
+	name := s.Name
+	if name == "" {
+		name = "-"
+	}
+	line('s', name)
+	if s.Info != "" {
+		line('i', s.Info)
+	}
+	if s.Connection != nil {
+		line('c', s.Connection.String())
+	}
+	for _, b := range s.Bandwidths {
+		line('b', b)
+	}
+	line('t', fmt.Sprintf("%d %d", s.Timing[0], s.Timing[1]))
+	for _, a := range s.Attributes {
+		line('a', a.String())
+	}
+	for _, m := range s.Media {
+		port := strconv.Itoa(m.Port)
+		if m.NumPorts > 0 {
+			port += "/" + strconv.Itoa(m.NumPorts)
+		}
+		line('m', strings.Join(append([]string{m.Type, port, m.Proto}, m.Formats...), " "))
+		if m.Info != "" {
+			line('i', m.Info)
+		}
+		if m.Connection != nil {
+			line('c', m.Connection.String())
+		}
+		for _, b := range m.Bandwidths {
+			line('b', b)
+		}
+		for _, a := range m.Attributes {
+			line('a', a.String())
+		}
+	}
+	return []byte(sb.String())
+}
+
+// String 返回序列化后的文本。
+func (s *Session) String() string {
+	return string(s.Marshal())
+}
+
+// Attribute 返回第一个名为 key 的属性值。
+func (m *Media) Attribute(key string) (string, bool) {
+	for _, a := range m.Attributes {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Direction 返回媒体方向：媒体级属性优先，其次会话级，缺省为 sendrecv。
+func (s *Session) Direction(m *Media) Direction {
+	for _, a := range m.Attributes {
+		if isDirection(a.Key) {
+			return Direction(a.Key)
+		}
+	}
+	for _, a := range s.Attributes {
+		if isDirection(a.Key) {
+			return Direction(a.Key)
+		}
+	}
+	return SendRecv
+}
+
+// SetDirection 替换媒体级方向属性。
+func (m *Media) SetDirection(d Direction) {
+	attrs := m.Attributes[:0]
+	for _, a := range m.Attributes {
+		if !isDirection(a.Key) {
+			attrs = append(attrs, a)
+		}
+	}
+	m.Attributes = append(attrs, Attribute{Key: string(d)})
+}
+
+// ConnectionFor 返回媒体的连接地址：媒体级 c= 优先，其次会话级。
+func (s *Session) ConnectionFor(m *Media) *Connection {
+	if m.Connection != nil {
+		return m.Connection
+	}
+	return s.Connection
+}
@@ -0,0 +1,122 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// retryWithAuth 在收到 401 / 407 时带凭据重发请求（RFC 3261 §22.2 / §22.3），返回是否已重发。
+//
+// 新请求与原请求相同，但：
+//   - 顶层 Via 使用新 branch（新事务）
+//   - CSeq 序号加一
+//   - 对每个 realm 的挑战添加一个 Authorization / Proxy-Authorization
+//
+// 原请求已带有同一 realm 的凭据且挑战不是 stale 时说明密码错误，不再重试，401 / 407 交给 TU。
+// 同一 realm 提供多个算法时优先 SHA-256（RFC 8760 §2.4）。
+func (s *Stack) retryWithAuth(req *message.Request, resp *message.Response, dst string) bool {
+	if s.authStore == nil || dst == "" ||
+		req.Method == message.MethodACK || req.Method == message.MethodCANCEL {
+		return false
+	}
+	var challengeHdr, credsHdr string
+	switch resp.StatusCode {
+	case message.StatusUnauthorized:
+		challengeHdr, credsHdr = message.HeaderWWWAuth, message.HeaderAuthorize
+	case message.StatusProxyAuthRequired:
+		challengeHdr, credsHdr = message.HeaderProxyAuth, message.HeaderProxyAuthz
+	default:
+		return false
+	}
+
+	// 每个 realm 选一个挑战
+	chosen := make(map[string]*auth.Challenge)
+	var realms []string
+	for _, v := range resp.Headers.GetAll(challengeHdr) {
+		ch, err := auth.ParseChallenge(v)
+		if err != nil {
+			s.logger.Warn("ignore invalid challenge", zap.Error(err))
+			continue
+		}
+		prev, ok := chosen[ch.Realm]
+		if !ok {
+			realms = append(realms, ch.Realm)
+		}
+		if !ok || (strings.EqualFold(ch.Algorithm, auth.AlgorithmSHA256) && !strings.EqualFold(prev.Algorithm, auth.AlgorithmSHA256)) {
+			chosen[ch.Realm] = ch
+		}
+	}
+	if len(realms) == 0 {
+		return false
+	}
+
+	retry := req.Clone()
+	retry.Headers.Del(credsHdr)
+	for _, realm := range realms {
+		ch := chosen[realm]
+		if !ch.Stale && hasCredentials(req, credsHdr, realm) {
+			s.logger.Warn("credentials rejected", zap.String("realm", realm), zap.String("user", s.authUser))
+			return false
+		}
+		password, err := s.authStore.Password(realm, s.authUser)
+		if err != nil {
+			s.logger.Warn("no credentials for realm", zap.String("realm", realm), zap.Error(err))
+			return false
+		}
+		creds, err := auth.Respond(ch, s.authUser, password, string(req.Method), req.RequestURI.String())
+		if err != nil {
+			s.logger.Warn("answer challenge", zap.String("realm", realm), zap.Error(err))
+			return false
+		}
+		retry.Headers.Add(credsHdr, creds.String())
+	}
+	// 保留其他 realm（如另一跳代理）已有的凭据
+	for _, v := range req.Headers.GetAll(credsHdr) {
+		if c, err := auth.ParseCredentials(v); err == nil && chosen[c.Realm] == nil {
+			retry.Headers.Add(credsHdr, v)
+		}
+	}
+
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return false
+	}
+	retry.Headers.Set(message.HeaderCSeq, fmt.Sprintf("%d %s", cseq.Seq+1, cseq.Method))
+	setTopBranch(retry, NewBranch())
+
+	if err := s.SendRequest(retry, dst); err != nil {
+		s.logger.Warn("resend with credentials failed", zap.Error(err))
+		return false
+	}
+	s.logger.Info("resent request with credentials",
+		zap.String("method", string(req.Method)),
+		zap.Int("challenge", resp.StatusCode),
+		zap.Uint32("cseq", cseq.Seq+1),
+	)
+	return true
+}
+
+// hasCredentials 判断请求是否已带有 realm 的凭据。
+func hasCredentials(req *message.Request, hdr, realm string) bool {
+	for _, v := range req.Headers.GetAll(hdr) {
+		if c, err := auth.ParseCredentials(v); err == nil && c.Realm == realm {
+			return true
+		}
+	}
+	return false
+}
+
+// setTopBranch 替换顶层 Via 的 branch 参数：解析后弹出原值，再压入改写后的值。
+func setTopBranch(req *message.Request, branch string) {
+	via, err := message.ParseVia(req.Headers.Get(message.HeaderVia))
+	if err != nil {
+		return
+	}
+	via.Params.Set("branch", branch)
+	req.Headers.RemoveFirst(message.HeaderVia)
+	req.Headers.Insert(message.HeaderVia, via.String())
+}
@@ -0,0 +1,165 @@
+package stack
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+)
+
+func TestSetTopBranch(t *testing.T) {
+	raw := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bKold;rport\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKlower\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:bob@example.com>\r\n" +
+		"Call-ID: c1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	msg, err := message.Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := msg.(*message.Request)
+	setTopBranch(req, "z9hG4bKnew")
+
+	vias := req.Headers.GetAll(message.HeaderVia)
+	if len(vias) != 2 {
+		t.Fatalf("got %d Via values, want 2: %q", len(vias), vias)
+	}
+	top, err := message.ParseVia(vias[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := top.Params.Get("branch"); got != "z9hG4bKnew" {
+		t.Errorf("top branch = %q, want z9hG4bKnew", got)
+	}
+	if !top.Params.Has("rport") || top.SentBy != "10.0.0.1:5060" {
+		t.Errorf("top Via lost its other fields: %q", vias[0])
+	}
+	if vias[1] != "SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKlower" {
+		t.Errorf("second Via changed: %q", vias[1])
+	}
+	wire := req.String()
+	if strings.Contains(wire, "z9hG4bKold") || !strings.Contains(wire, "branch=z9hG4bKnew") {
+		t.Errorf("serialized request still carries the old branch:\n%s", wire)
+	}
+}
+
+// newAuthServer 启动要求摘要认证的协议栈：proxy 为 true 时以 407 挑战，否则以 401。
+func newAuthServer(t *testing.T, proxy bool) (*Stack, *testHandler) {
+	t.Helper()
+	store := auth.NewMemoryStore()
+	store.Set("example.com", "alice", "secret")
+	a := auth.NewAuthenticator("example.com", store)
+	h := newTestHandler()
+	h.onRequest = func(req *message.Request, tx *dialog.Transaction) {
+		if req.Method == message.MethodACK {
+			return
+		}
+		if _, err := a.Verify(req, proxy); err != nil {
+			code := message.StatusUnauthorized
+			if proxy {
+				code = message.StatusProxyAuthRequired
+			}
+			resp := BuildResponse(req, code, NewTag())
+			a.Challenge(resp, proxy, errors.Is(err, auth.ErrStaleNonce))
+			tx.Respond(resp)
+			return
+		}
+		tx.Respond(BuildResponse(req, message.StatusOK, NewTag()))
+	}
+	return newTestStack(t, h), h
+}
+
+func sendMessage(t *testing.T, s *Stack, dst string) {
+	t.Helper()
+	req, err := s.BuildMessageRequest("sip:alice@example.com", "sip:bob@"+dst, "text/plain", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendRequest(req, dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthChallengeRetry(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy bool
+		creds string
+	}{
+		{"401", false, message.HeaderAuthorize},
+		{"407", true, message.HeaderProxyAuthz},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, serverH := newAuthServer(t, tt.proxy)
+			store := auth.NewMemoryStore()
+			store.Set("example.com", "alice", "secret")
+			clientH := newTestHandler()
+			client := newTestStack(t, clientH, WithCredentials("alice", store))
+
+			sendMessage(t, client, server.LocalAddr())
+			first := serverH.nextRequest(t, message.MethodMESSAGE)
+			retry := serverH.nextRequest(t, message.MethodMESSAGE)
+
+			// 挑战不交给 TU，TU 只看到重发请求的 200
+			if resp := clientH.nextResponse(t, message.MethodMESSAGE); resp.StatusCode != message.StatusOK {
+				t.Fatalf("client received %d", resp.StatusCode)
+			}
+			if first.Headers.Exists(tt.creds) {
+				t.Fatalf("first request already carries %s", tt.creds)
+			}
+			c, err := auth.ParseCredentials(retry.Headers.Get(tt.creds))
+			if err != nil {
+				t.Fatalf("retry %s: %v", tt.creds, err)
+			}
+			if c.Username != "alice" || c.Realm != "example.com" || c.Algorithm != auth.AlgorithmSHA256 {
+				t.Fatalf("credentials = %+v, want alice@example.com with SHA-256", c)
+			}
+
+			// 新事务：新 branch、CSeq 加一，对话标识不变
+			firstVia, _ := message.ParseVia(first.Headers.Get(message.HeaderVia))
+			retryVia, _ := message.ParseVia(retry.Headers.Get(message.HeaderVia))
+			if firstVia.Params.Get("branch") == retryVia.Params.Get("branch") {
+				t.Fatalf("retry reuses branch %s", retryVia.Params.Get("branch"))
+			}
+			if got := retry.Headers.Get(message.HeaderCSeq); got != "2 MESSAGE" {
+				t.Fatalf("retry CSeq = %q, want 2 MESSAGE", got)
+			}
+			for _, hdr := range []string{message.HeaderCallID, message.HeaderFrom, message.HeaderTo} {
+				if first.Headers.Get(hdr) != retry.Headers.Get(hdr) {
+					t.Fatalf("retry changed %s: %q -> %q", hdr, first.Headers.Get(hdr), retry.Headers.Get(hdr))
+				}
+			}
+		})
+	}
+}
+
+func TestAuthWrongPassword(t *testing.T) {
+	server, serverH := newAuthServer(t, false)
+	store := auth.NewMemoryStore()
+	store.Set("example.com", "alice", "wrong")
+	clientH := newTestHandler()
+	client := newTestStack(t, clientH, WithCredentials("alice", store))
+
+	sendMessage(t, client, server.LocalAddr())
+	// 带凭据的重发仍被拒绝时不再重试，401 交给 TU
+	if resp := clientH.nextResponse(t, message.MethodMESSAGE); resp.StatusCode != message.StatusUnauthorized {
+		t.Fatalf("client received %d, want 401", resp.StatusCode)
+	}
+	serverH.nextRequest(t, message.MethodMESSAGE)
+	if retry := serverH.nextRequest(t, message.MethodMESSAGE); !retry.Headers.Exists(message.HeaderAuthorize) {
+		t.Fatal("second request carries no Authorization")
+	}
+	select {
+	case req := <-serverH.requests:
+		t.Fatalf("client sent a third %s", req.Method)
+	default:
+	}
+}
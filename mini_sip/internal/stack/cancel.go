@@ -0,0 +1,187 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// CANCEL（RFC 3261 §9）：
+//
+//   - UAS：CANCEL 按 branch 匹配 INVITE 服务端事务，先以 200 应答 CANCEL，
+//     INVITE 尚未最终响应时关闭其 Cancelled 通道（TU 停止振铃）并以 487 结束；
+//     匹配不到回 481。代理模式下 CANCEL 照常交给 TU（由代理逐跳处理）
+//   - UAC：Stack.Cancel 为 INVITE 客户端事务构造并发送 CANCEL，收到临时响应前推迟发送；
+//     CANCEL 与 2xx 交叉时（INVITE 已被接听）协议栈对 2xx 回 ACK 后立即 BYE
+
+// ErrNotCancellable 表示 INVITE 已收到最终响应或事务已结束，CANCEL 不再起作用。
+var ErrNotCancellable = errors.New("INVITE is no longer pending")
+
+// cancelState 记录本端对一个 INVITE 客户端事务发起的 CANCEL。
+type cancelState struct {
+	cancel *message.Request
+	dst    string
+	sent   bool                     // false 表示等待临时响应后再发送
+	hungUp map[dialog.DialogID]bool // CANCEL 之后仍被接听、已发送 BYE 的对话
+}
+
+// BuildCancel 为已发送的 INVITE 构造 CANCEL（RFC 3261 §9.1）：
+// Request-URI、Call-ID、From、To、Route 与 INVITE 相同，只有一个 Via 且与 INVITE 的顶层 Via 相同，
+// CSeq 序号相同、方法为 CANCEL。
+func BuildCancel(invite *message.Request) *message.Request {
+	cancel := message.NewRequest(message.MethodCANCEL, invite.RequestURI.Clone())
+	cancel.Headers.Set(message.HeaderVia, invite.Headers.Get(message.HeaderVia))
+	for _, r := range invite.Headers.GetAll(message.HeaderRoute) {
+		cancel.Headers.Add(message.HeaderRoute, r)
+	}
+	cancel.Headers.Set(message.HeaderMaxForwards, "70")
+	cancel.Headers.Set(message.HeaderFrom, invite.Headers.Get(message.HeaderFrom))
+	cancel.Headers.Set(message.HeaderTo, invite.Headers.Get(message.HeaderTo))
+	cancel.Headers.Set(message.HeaderCallID, invite.Headers.Get(message.HeaderCallID))
+	if cseq, err := message.ParseCSeq(invite.Headers.Get(message.HeaderCSeq)); err == nil {
+		cancel.Headers.Set(message.HeaderCSeq, fmt.Sprintf("%d CANCEL", cseq.Seq))
+	}
+	cancel.Headers.Set(message.HeaderContentLen, "0")
+	return cancel
+}
+
+// ClientTransaction 按顶层 Via 的 branch 与方法查找本端发出的请求所属的客户端事务，
+// 事务已结束时返回 nil。
+func (s *Stack) ClientTransaction(req *message.Request) *dialog.Transaction {
+	via, err := message.ParseVia(req.Headers.Get(message.HeaderVia))
+	if err != nil {
+		return nil
+	}
+	s.txMu.RLock()
+	defer s.txMu.RUnlock()
+	return s.txs[dialog.TransactionID(via.Params.Get("branch"), req.Method)]
+}
+
+// Cancel 取消尚未最终响应的 INVITE 客户端事务（RFC 3261 §9.1）。
+//
+// CANCEL 发往 INVITE 的目标地址；还没收到临时响应时先记录下来，收到 1xx 后再发送。
+// INVITE 随后应以 487 结束，最终响应照常交给 Handler.OnResponse。
+// 若对端在 CANCEL 生效前已接听，协议栈对 2xx 回 ACK 并发送 BYE，2xx 仍会交给 TU，TU 不应再 ACK。
+// 对同一事务重复调用无副作用。
+func (s *Stack) Cancel(inviteTx *dialog.Transaction) error {
+	if inviteTx == nil {
+		return ErrNotCancellable
+	}
+	if inviteTx.Method != message.MethodINVITE {
+		return fmt.Errorf("cannot cancel %s request", inviteTx.Method)
+	}
+
+	s.txMu.Lock()
+	if s.txs[inviteTx.ID] != inviteTx {
+		s.txMu.Unlock()
+		return ErrNotCancellable
+	}
+	if _, ok := s.cancels[inviteTx.ID]; ok {
+		s.txMu.Unlock()
+		return nil
+	}
+	st := &cancelState{cancel: BuildCancel(inviteTx.Request), dst: s.txDst[inviteTx.ID]}
+	switch inviteTx.GetState() {
+	case dialog.TxStateCalling:
+		s.cancels[inviteTx.ID] = st
+		s.txMu.Unlock()
+		s.logger.Info("CANCEL deferred until provisional response", zap.String("txID", inviteTx.ID))
+		return nil
+	case dialog.TxStateProceeding:
+		st.sent = true
+		s.cancels[inviteTx.ID] = st
+		s.txMu.Unlock()
+		return s.SendRequest(st.cancel, st.dst)
+	}
+	s.txMu.Unlock()
+	return ErrNotCancellable
+}
+
+// onCancelledInviteResponse 处理已发起 CANCEL 的 INVITE 收到的响应：
+// 1xx 时发送推迟的 CANCEL，2xx 时 ACK 并 BYE 该对话。
+func (s *Stack) onCancelledInviteResponse(tx *dialog.Transaction, resp *message.Response) {
+	s.txMu.Lock()
+	st := s.cancels[tx.ID]
+	if st == nil {
+		s.txMu.Unlock()
+		return
+	}
+	code := resp.StatusCode
+	switch {
+	case code < 200:
+		if st.sent {
+			s.txMu.Unlock()
+			return
+		}
+		st.sent = true
+		s.txMu.Unlock()
+		if err := s.SendRequest(st.cancel, st.dst); err != nil {
+			s.logger.Warn("send deferred CANCEL", zap.Error(err))
+		}
+
+	case code < 300:
+		id, err := dialog.IDFromResponse(resp)
+		if err != nil || st.hungUp[id] {
+			s.txMu.Unlock()
+			return
+		}
+		if st.hungUp == nil {
+			st.hungUp = make(map[dialog.DialogID]bool)
+		}
+		st.hungUp[id] = true
+		s.txMu.Unlock()
+		d := s.Dialog(id)
+		if d == nil {
+			return
+		}
+		s.logger.Info("INVITE answered after CANCEL, hanging up", zap.String("dialog", id.String()))
+		if err := s.SendInDialog(d.NewRequest(message.MethodACK)); err != nil {
+			s.logger.Warn("send ACK", zap.Error(err))
+		}
+		if err := s.SendInDialog(d.NewRequest(message.MethodBYE)); err != nil {
+			s.logger.Warn("send BYE", zap.Error(err))
+		}
+
+	default:
+		s.txMu.Unlock()
+	}
+}
+
+// handleCancel 按 RFC 3261 §9.2 处理收到的 CANCEL。
+func (s *Stack) handleCancel(req *message.Request, tx *dialog.Transaction) {
+	var invite *dialog.Transaction
+	if id, err := dialog.CancelTargetID(req); err == nil {
+		s.stxMu.Lock()
+		invite = s.stxs[id]
+		s.stxMu.Unlock()
+	}
+	if invite == nil {
+		if err := tx.Respond(BuildResponse(req, message.StatusCallDoesNotExist, "")); err != nil {
+			s.logger.Warn("send 481 for CANCEL", zap.Error(err))
+		}
+		s.logger.Info("CANCEL matches no transaction")
+		return
+	}
+
+	// CANCEL 的 200 与 INVITE 的响应使用相同的 To tag
+	tag := responseTag(invite)
+	if err := tx.Respond(BuildResponse(req, message.StatusOK, tag)); err != nil {
+		s.logger.Warn("send 200 for CANCEL", zap.Error(err))
+	}
+	if !invite.Cancel() {
+		s.logger.Info("CANCEL after final response, ignored", zap.String("txID", invite.ID))
+		return
+	}
+	if tag == "" {
+		tag = NewTag()
+	}
+	if err := invite.Respond(BuildResponse(invite.Request, message.StatusRequestTerminated, tag)); err != nil {
+		// TU 与 CANCEL 同时发出了最终响应
+		s.logger.Info("INVITE already answered, 487 not sent", zap.Error(err))
+		return
+	}
+	s.logger.Info("INVITE cancelled: 487 Request Terminated", zap.String("txID", invite.ID))
+}
@@ -0,0 +1,238 @@
+package stack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// pendingInvite 是被叫收到、尚未最终响应的 INVITE，响应由测试 goroutine 发送。
+type pendingInvite struct {
+	req *message.Request
+	tx  *dialog.Transaction
+}
+
+// cancelPair 启动 alice 与 bob；bob 收到的 INVITE 交给测试处理，其他请求回 200。
+func cancelPair(t *testing.T) (alice, bob *Stack, aliceH, bobH *testHandler, invites chan pendingInvite) {
+	t.Helper()
+	invites = make(chan pendingInvite, 4)
+	bobH = newTestHandler()
+	bobH.onRequest = func(req *message.Request, tx *dialog.Transaction) {
+		switch req.Method {
+		case message.MethodINVITE:
+			invites <- pendingInvite{req, tx}
+		case message.MethodACK:
+		default:
+			tx.Respond(BuildResponse(req, message.StatusOK, ""))
+		}
+	}
+	aliceH = newTestHandler()
+	bob = newTestStack(t, bobH)
+	alice = newTestStack(t, aliceH)
+	return alice, bob, aliceH, bobH, invites
+}
+
+// sendInvite 由 alice 向 bob 发送不带 100rel 的 INVITE，返回其客户端事务。
+func sendInvite(t *testing.T, alice, bob *Stack) (*message.Request, *dialog.Transaction) {
+	t.Helper()
+	bobAddr := bob.transports[transport.NetworkUDP].LocalAddr().String()
+	invite, err := alice.BuildInviteRequest("sip:alice@"+alice.LocalAddr(), "sip:bob@"+bobAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite.Headers.Del(message.HeaderSupported)
+	if err := alice.SendRequest(invite, bobAddr); err != nil {
+		t.Fatal(err)
+	}
+	tx := alice.ClientTransaction(invite)
+	if tx == nil {
+		t.Fatal("no client transaction for the INVITE")
+	}
+	return invite, tx
+}
+
+func nextInvite(t *testing.T, invites chan pendingInvite) pendingInvite {
+	t.Helper()
+	select {
+	case in := <-invites:
+		return in
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for INVITE")
+		return pendingInvite{}
+	}
+}
+
+// waitProceeding 等待客户端事务收到临时响应。
+func waitProceeding(t *testing.T, tx *dialog.Transaction) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for tx.GetState() == dialog.TxStateCalling {
+		if time.Now().After(deadline) {
+			t.Fatal("INVITE got no provisional response")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// finals 收集对 methods 各一个的最终响应，到达顺序不限，其他方法的响应被跳过。
+func finals(t *testing.T, h *testHandler, methods ...message.Method) map[message.Method]*message.Response {
+	t.Helper()
+	got := make(map[message.Method]*message.Response)
+	for len(got) < len(methods) {
+		select {
+		case resp := <-h.responses:
+			cseq, err := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq))
+			if err != nil || resp.StatusCode < 200 {
+				continue
+			}
+			for _, m := range methods {
+				if string(m) == cseq.Method {
+					got[m] = resp
+				}
+			}
+		case <-time.After(5 * time.Second):
+			var have []message.Method
+			for m := range got {
+				have = append(have, m)
+			}
+			t.Fatalf("timed out waiting for responses to %v, got %v", methods, have)
+		}
+	}
+	return got
+}
+
+// received 收集 methods 各一个的请求，到达顺序不限，其他请求被跳过。
+func received(t *testing.T, h *testHandler, methods ...message.Method) map[message.Method]*message.Request {
+	t.Helper()
+	got := make(map[message.Method]*message.Request)
+	for len(got) < len(methods) {
+		select {
+		case req := <-h.requests:
+			for _, m := range methods {
+				if m == req.Method {
+					got[m] = req
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %v, got %d", methods, len(got))
+		}
+	}
+	return got
+}
+
+func waitCancelled(t *testing.T, tx *dialog.Transaction) {
+	t.Helper()
+	select {
+	case <-tx.Cancelled():
+	case <-time.After(5 * time.Second):
+		t.Fatal("INVITE server transaction was not cancelled")
+	}
+}
+
+func TestCancelRinging(t *testing.T) {
+	alice, bob, aliceH, _, invites := cancelPair(t)
+	_, tx := sendInvite(t, alice, bob)
+	in := nextInvite(t, invites)
+	tag := NewTag()
+	in.tx.Respond(BuildResponse(in.req, message.StatusRinging, tag))
+	waitProceeding(t, tx)
+
+	if err := alice.Cancel(tx); err != nil {
+		t.Fatal(err)
+	}
+	waitCancelled(t, in.tx)
+	// CANCEL 得到 200，INVITE 以 487 结束，两者的 To tag 与 180 相同
+	got := finals(t, aliceH, message.MethodCANCEL, message.MethodINVITE)
+	for _, method := range []message.Method{message.MethodCANCEL, message.MethodINVITE} {
+		resp := got[method]
+		want := message.StatusOK
+		if method == message.MethodINVITE {
+			want = message.StatusRequestTerminated
+		}
+		if resp.StatusCode != want {
+			t.Fatalf("%s answered with %d, want %d", method, resp.StatusCode, want)
+		}
+		if to, _ := message.ParseAddress(resp.Headers.Get(message.HeaderTo)); to.Tag != tag {
+			t.Errorf("%d To tag = %q, want %q", resp.StatusCode, to.Tag, tag)
+		}
+	}
+	// 重复取消没有副作用，事务已结束后返回 ErrNotCancellable
+	if err := alice.Cancel(tx); err != nil && err != ErrNotCancellable {
+		t.Errorf("second Cancel = %v", err)
+	}
+}
+
+func TestCancelDeferredUntilProvisional(t *testing.T) {
+	alice, bob, aliceH, _, invites := cancelPair(t)
+	_, tx := sendInvite(t, alice, bob)
+	in := nextInvite(t, invites)
+
+	// 还没有临时响应：CANCEL 先记录下来，不发送（RFC 3261 §9.1）
+	if err := alice.Cancel(tx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-in.tx.Cancelled():
+		t.Fatal("CANCEL sent before any provisional response")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	in.tx.Respond(BuildResponse(in.req, message.StatusRinging, NewTag()))
+	waitCancelled(t, in.tx)
+	if resp := aliceH.nextResponse(t, message.MethodINVITE); resp.StatusCode != message.StatusRequestTerminated {
+		t.Fatalf("INVITE answered with %d, want 487", resp.StatusCode)
+	}
+}
+
+func TestCancelUnmatched(t *testing.T) {
+	alice, bob, aliceH, _, _ := cancelPair(t)
+	bobAddr := bob.transports[transport.NetworkUDP].LocalAddr().String()
+	invite, err := alice.BuildInviteRequest("sip:alice@"+alice.LocalAddr(), "sip:bob@"+bobAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 从未发出的 INVITE 的 CANCEL 匹配不到服务端事务
+	if err := alice.SendRequest(BuildCancel(invite), bobAddr); err != nil {
+		t.Fatal(err)
+	}
+	if resp := aliceH.nextResponse(t, message.MethodCANCEL); resp.StatusCode != message.StatusCallDoesNotExist {
+		t.Fatalf("CANCEL answered with %d, want 481", resp.StatusCode)
+	}
+}
+
+func TestCancelCrossesAnswer(t *testing.T) {
+	alice, bob, aliceH, bobH, invites := cancelPair(t)
+	invite, tx := sendInvite(t, alice, bob)
+	in := nextInvite(t, invites)
+	if err := alice.Cancel(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob 在收到 CANCEL 之前已经接听：180 触发推迟的 CANCEL，紧随其后的 200 与之交叉
+	tag := NewTag()
+	in.tx.Respond(BuildResponse(in.req, message.StatusRinging, tag))
+	ok := BuildResponse(in.req, message.StatusOK, tag)
+	ok.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", bob.ContactURI("sip")))
+	in.tx.Respond(ok)
+
+	// alice 的协议栈对 2xx 回 ACK 并立即 BYE，2xx 仍交给 TU。
+	// 180 先被处理时 CANCEL 已发出，bob 对它照样回 200；200 先被处理时 CANCEL 不再发送
+	got := finals(t, aliceH, message.MethodINVITE, message.MethodBYE)
+	for method, resp := range got {
+		if resp.StatusCode != message.StatusOK {
+			t.Errorf("%s answered with %d, want 200", method, resp.StatusCode)
+		}
+	}
+	reqs := received(t, bobH, message.MethodACK, message.MethodBYE)
+	want, _ := message.ParseCSeq(invite.Headers.Get(message.HeaderCSeq))
+	if cseq, _ := message.ParseCSeq(reqs[message.MethodACK].Headers.Get(message.HeaderCSeq)); cseq.Seq != want.Seq {
+		t.Errorf("ACK CSeq = %d, want %d", cseq.Seq, want.Seq)
+	}
+	if cseq, _ := message.ParseCSeq(reqs[message.MethodBYE].Headers.Get(message.HeaderCSeq)); cseq.Seq <= want.Seq {
+		t.Errorf("BYE CSeq = %d, want above %d", cseq.Seq, want.Seq)
+	}
+}
@@ -0,0 +1,244 @@
+package stack
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/cdr"
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// 呼叫详细记录（CDR），由 WithCDRSink 启用：
+//
+//   - 本端发出的初始 INVITE（To 不带 tag）开始一条 outbound 记录，收到的初始 INVITE 开始一条 inbound 记录；
+//     认证重试、422 重发与 RFC 3263 改发沿用同一条记录（Call-ID 与 From tag 不变）
+//   - INVITE 的 1xx（100 除外）记下振铃时间，2xx 记下接通时间与状态码
+//   - 失败的最终响应结束记录：487 为主叫取消，其余为被叫拒绝；
+//     事务超时（408）、传输错误或发送失败（503）同样结束记录，挂机方为 system
+//   - 接通的呼叫在 BYE 时结束：本端发出 BYE 为本端挂机，收到 BYE 为对端挂机，
+//     会话计时器到期（endSession）为 system；Stop 时仍未结束的记录以 system 结束
+//
+// 记录以 Call-ID + 主叫的 From tag 标识：outbound 为本端 tag，inbound 为对端 tag。
+// 代理模式下经过的 INVITE 属于下游 UA，不生成记录；B2BUA 的一次呼叫生成两条记录（每路一条）。
+
+// CDRSink 接收结束的呼叫详细记录，WriteCDR 可能被并发调用。
+type CDRSink interface {
+	WriteCDR(r *cdr.Record) error
+}
+
+// cdrKey 标识一条进行中的记录。
+type cdrKey struct {
+	callID string
+	tag    string // 主叫的 From tag
+	uac    bool   // outbound
+}
+
+// cdrEnder 是结束记录的一方（相对本端）。
+type cdrEnder int
+
+const (
+	endLocal cdrEnder = iota
+	endRemote
+	endSystem
+)
+
+func (s *Stack) cdrEnabled() bool {
+	return len(s.cdrSinks) > 0 && !s.isProxy()
+}
+
+// cdrStart 为初始 INVITE 开始一条记录，记录已存在时（重发）不做任何事。
+func (s *Stack) cdrStart(req *message.Request, uac bool) {
+	if req.Method != message.MethodINVITE || !s.cdrEnabled() {
+		return
+	}
+	key, ok := inviteCDRKey(req, uac)
+	if !ok {
+		return
+	}
+	s.cdrMu.Lock()
+	defer s.cdrMu.Unlock()
+	if _, exists := s.cdrs[key]; exists {
+		return
+	}
+	r := &cdr.Record{
+		CallID:     key.callID,
+		Direction:  cdr.DirectionInbound,
+		InviteTime: s.Clock().Now(),
+	}
+	if uac {
+		r.Direction = cdr.DirectionOutbound
+	}
+	if from, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom)); err == nil && from.URI != nil {
+		r.From = from.URI.String()
+	}
+	if to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo)); err == nil && to.URI != nil {
+		r.To = to.URI.String()
+	}
+	s.cdrs[key] = r
+}
+
+// cdrResponse 按初始 INVITE 的响应更新记录，失败的最终响应结束记录。
+func (s *Stack) cdrResponse(req *message.Request, resp *message.Response, uac bool) {
+	if req.Method != message.MethodINVITE || !s.cdrEnabled() {
+		return
+	}
+	key, ok := inviteCDRKey(req, uac)
+	if !ok {
+		return
+	}
+	code := resp.StatusCode
+	now := s.Clock().Now()
+	s.cdrMu.Lock()
+	r := s.cdrs[key]
+	if r == nil || r.Answered() {
+		// 分叉后其他分支的 2xx 不改变记录
+		s.cdrMu.Unlock()
+		return
+	}
+	switch {
+	case code >= 300:
+		r.Status, r.Reason = code, resp.Reason
+		r.Disconnect = cdr.PartyCallee
+		if code == message.StatusRequestTerminated {
+			r.Disconnect = cdr.PartyCaller
+		}
+		delete(s.cdrs, key)
+		s.cdrMu.Unlock()
+		s.writeCDR(r, now)
+		return
+	case code >= 200:
+		r.Status, r.Reason = code, resp.Reason
+		r.AnswerTime = now
+	case code > 100:
+		if r.RingTime.IsZero() {
+			r.RingTime = now
+		}
+	}
+	s.cdrMu.Unlock()
+}
+
+// cdrTimedOut 以 408（超时）或 503（传输错误、发送失败）结束初始 INVITE 的记录。
+func (s *Stack) cdrTimedOut(req *message.Request, err error) {
+	if req.Method != message.MethodINVITE || !s.cdrEnabled() {
+		return
+	}
+	key, ok := inviteCDRKey(req, true)
+	if !ok {
+		return
+	}
+	s.cdrMu.Lock()
+	r := s.cdrs[key]
+	delete(s.cdrs, key)
+	s.cdrMu.Unlock()
+	if r == nil {
+		return
+	}
+	if !r.Answered() {
+		r.Status, r.Reason = message.StatusServiceUnavailable, err.Error()
+		if errors.Is(err, dialog.ErrTimeout) {
+			r.Status = message.StatusRequestTimeout
+		}
+	}
+	r.Disconnect = cdr.PartySystem
+	s.writeCDR(r, s.Clock().Now())
+}
+
+// cdrBye 结束对话 id（本端视角）所属呼叫的记录。
+func (s *Stack) cdrBye(id dialog.DialogID, by cdrEnder) {
+	if !s.cdrEnabled() {
+		return
+	}
+	s.cdrMu.Lock()
+	key := cdrKey{callID: id.CallID, tag: id.LocalTag, uac: true}
+	r := s.cdrs[key]
+	if r == nil {
+		key = cdrKey{callID: id.CallID, tag: id.RemoteTag}
+		r = s.cdrs[key]
+	}
+	if r == nil {
+		s.cdrMu.Unlock()
+		return
+	}
+	delete(s.cdrs, key)
+	s.cdrMu.Unlock()
+	switch {
+	case by == endSystem:
+		r.Disconnect = cdr.PartySystem
+	case (by == endLocal) == key.uac:
+		r.Disconnect = cdr.PartyCaller
+	default:
+		r.Disconnect = cdr.PartyCallee
+	}
+	s.writeCDR(r, s.Clock().Now())
+}
+
+// cdrSentBye 处理本端发出的 BYE（From tag 为本端 tag）。
+func (s *Stack) cdrSentBye(req *message.Request) {
+	if req.Method != message.MethodBYE || !s.cdrEnabled() {
+		return
+	}
+	from, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
+	if err != nil {
+		return
+	}
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	if err != nil {
+		return
+	}
+	s.cdrBye(dialog.DialogID{
+		CallID:    req.Headers.Get(message.HeaderCallID),
+		LocalTag:  from.Tag,
+		RemoteTag: to.Tag,
+	}, endLocal)
+}
+
+// flushCDRs 以 system 结束全部进行中的记录，由 Stop 调用。
+func (s *Stack) flushCDRs() {
+	s.cdrMu.Lock()
+	records := make([]*cdr.Record, 0, len(s.cdrs))
+	for key, r := range s.cdrs {
+		records = append(records, r)
+		delete(s.cdrs, key)
+	}
+	s.cdrMu.Unlock()
+	now := s.Clock().Now()
+	for _, r := range records {
+		r.Disconnect = cdr.PartySystem
+		s.writeCDR(r, now)
+	}
+}
+
+// writeCDR 补上结束时间与通话时长并交给全部 CDRSink。
+func (s *Stack) writeCDR(r *cdr.Record, end time.Time) {
+	r.EndTime = end
+	if r.Answered() {
+		r.Duration = end.Sub(r.AnswerTime)
+	}
+	for _, sink := range s.cdrSinks {
+		if err := sink.WriteCDR(r); err != nil {
+			s.logger.Warn("write CDR", zap.String("callID", r.CallID), zap.Error(err))
+		}
+	}
+	s.logger.Info("call detail record",
+		zap.String("callID", r.CallID),
+		zap.String("direction", r.Direction),
+		zap.Int("status", r.Status),
+		zap.String("disconnect", r.Disconnect),
+		zap.Duration("duration", r.Duration),
+	)
+}
+
+// inviteCDRKey 返回初始 INVITE 的记录标识；re-INVITE（To 带 tag）返回 false。
+func inviteCDRKey(req *message.Request, uac bool) (cdrKey, bool) {
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	if err != nil || to.Tag != "" {
+		return cdrKey{}, false
+	}
+	from, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
+	if err != nil {
+		return cdrKey{}, false
+	}
+	return cdrKey{callID: req.Headers.Get(message.HeaderCallID), tag: from.Tag, uac: uac}, true
+}
@@ -0,0 +1,324 @@
+package stack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/cdr"
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+)
+
+// cdrSink 收集协议栈写出的记录。
+type cdrSink struct {
+	records chan *cdr.Record
+}
+
+func newCDRSink() *cdrSink {
+	return &cdrSink{records: make(chan *cdr.Record, 16)}
+}
+
+func (s *cdrSink) WriteCDR(r *cdr.Record) error {
+	s.records <- r
+	return nil
+}
+
+func (s *cdrSink) next(t *testing.T) *cdr.Record {
+	t.Helper()
+	select {
+	case r := <-s.records:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a call detail record")
+		return nil
+	}
+}
+
+// none 断言 wait 时间内没有新的记录。
+func (s *cdrSink) none(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case r := <-s.records:
+		t.Fatalf("unexpected record %+v", r)
+	case <-time.After(wait):
+	}
+}
+
+// cdrCall 是开启 CDR 的主叫 alice（手动时钟）与被叫 bob，bob 收到的 INVITE 由测试应答。
+type cdrCall struct {
+	alice, bob       *Stack
+	aliceH, bobH     *testHandler
+	aliceCDR, bobCDR *cdrSink
+	clock            *dialog.ManualClock
+	invites          chan pendingInvite
+}
+
+func newCDRCall(t *testing.T, aliceOpts ...Option) *cdrCall {
+	t.Helper()
+	c := &cdrCall{
+		aliceH:   newTestHandler(),
+		bobH:     newTestHandler(),
+		aliceCDR: newCDRSink(),
+		bobCDR:   newCDRSink(),
+		clock:    dialog.NewManualClock(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)),
+		invites:  make(chan pendingInvite, 4),
+	}
+	c.bobH.onRequest = func(req *message.Request, tx *dialog.Transaction) {
+		switch req.Method {
+		case message.MethodINVITE:
+			c.invites <- pendingInvite{req, tx}
+		case message.MethodACK:
+		default:
+			tx.Respond(BuildResponse(req, message.StatusOK, ""))
+		}
+	}
+	c.aliceH.onResponse = func(resp *message.Response, req *message.Request) {
+		if req == nil || req.Method != message.MethodINVITE || resp.StatusCode/100 != 2 {
+			return
+		}
+		if d := c.alice.ResponseDialog(resp); d != nil {
+			c.alice.SendInDialog(d.NewRequest(message.MethodACK))
+		}
+	}
+	c.bob = newTestStack(t, c.bobH, WithCDRSink(c.bobCDR))
+	c.alice = newTestStack(t, c.aliceH, append([]Option{WithClock(c.clock), WithCDRSink(c.aliceCDR)}, aliceOpts...)...)
+	return c
+}
+
+// answer 以 code 应答 bob 收到的 INVITE，2xx 带 Contact；edit 可再调整响应。
+func (c *cdrCall) answer(in pendingInvite, code int, tag string, edit func(resp *message.Response)) {
+	resp := BuildResponse(in.req, code, tag)
+	if code/100 == 2 {
+		resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", c.bob.ContactURI("sip")))
+	}
+	if edit != nil {
+		edit(resp)
+	}
+	in.tx.Respond(resp)
+}
+
+// waitRinging 等待 alice 的 TU 收到 180（记录的振铃时间此时已写入）。
+func waitRinging(t *testing.T, h *testHandler) {
+	t.Helper()
+	for {
+		select {
+		case resp := <-h.responses:
+			if resp.StatusCode == message.StatusRinging {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for 180")
+		}
+	}
+}
+
+// connect 建立振铃后接通的呼叫，返回 alice 的 INVITE 与双方的对话。
+func (c *cdrCall) connect(t *testing.T, edit func(resp *message.Response)) (invite *message.Request, aliceDialog, bobDialog *dialog.Dialog) {
+	t.Helper()
+	invite, _ = sendInvite(t, c.alice, c.bob)
+	in := nextInvite(t, c.invites)
+	tag := NewTag()
+	c.answer(in, message.StatusRinging, tag, nil)
+	waitRinging(t, c.aliceH)
+	c.clock.Advance(2 * time.Second)
+	c.answer(in, message.StatusOK, tag, edit)
+	resp := c.aliceH.nextResponse(t, message.MethodINVITE)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", resp.StatusCode)
+	}
+	aliceDialog = c.alice.ResponseDialog(resp)
+	if aliceDialog == nil {
+		t.Fatal("no dialog for the 200")
+	}
+	c.bobH.nextRequest(t, message.MethodACK)
+	bobDialog = c.bob.Dialog(dialog.DialogID{CallID: aliceDialog.ID.CallID, LocalTag: tag, RemoteTag: aliceDialog.ID.LocalTag})
+	if bobDialog == nil {
+		t.Fatal("bob has no dialog")
+	}
+	return invite, aliceDialog, bobDialog
+}
+
+func TestCDRAnsweredCall(t *testing.T) {
+	tests := []struct {
+		name      string
+		talk      time.Duration
+		hangup    func(c *cdrCall, alice, bob *dialog.Dialog) error
+		aliceEnd  string // alice（主叫）记录的挂机方
+		bobEnd    string
+		sessionSE bool // bob 的 200 带 Session-Expires，由 bob 刷新
+	}{
+		{"local hangup", 20 * time.Second, func(c *cdrCall, d, _ *dialog.Dialog) error {
+			return c.alice.SendInDialog(d.NewRequest(message.MethodBYE))
+		}, cdr.PartyCaller, cdr.PartyCaller, false},
+		{"remote hangup", 20 * time.Second, func(c *cdrCall, _, d *dialog.Dialog) error {
+			return c.bob.SendInDialog(d.NewRequest(message.MethodBYE))
+		}, cdr.PartyCallee, cdr.PartyCallee, false},
+		// bob 不刷新：alice 在 120s 会话到期前 32s 发出 BYE
+		{"session expired", 88 * time.Second, nil, cdr.PartySystem, cdr.PartyCaller, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCDRCall(t, WithSessionTimer(120, MinSessionExpires))
+			start := c.clock.Now()
+			invite, aliceDialog, bobDialog := c.connect(t, func(resp *message.Response) {
+				if tt.sessionSE {
+					resp.Headers.Set(message.HeaderSessionExpires, "120;refresher=uas")
+				}
+			})
+			answered := c.clock.Now()
+			c.clock.Advance(tt.talk)
+			if tt.hangup != nil {
+				if err := tt.hangup(c, aliceDialog, bobDialog); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := c.aliceCDR.next(t)
+			if r.CallID != invite.Headers.Get(message.HeaderCallID) || r.Direction != cdr.DirectionOutbound {
+				t.Errorf("record %s %s, want outbound %s", r.CallID, r.Direction, invite.Headers.Get(message.HeaderCallID))
+			}
+			if r.From != "sip:alice@"+c.alice.LocalAddr() || r.To != invite.RequestURI.String() {
+				t.Errorf("record From %s To %s", r.From, r.To)
+			}
+			if !r.InviteTime.Equal(start) || !r.RingTime.Equal(start) || !r.AnswerTime.Equal(answered) {
+				t.Errorf("times invite %v ring %v answer %v, want %v %v %v", r.InviteTime, r.RingTime, r.AnswerTime, start, start, answered)
+			}
+			if !r.EndTime.Equal(answered.Add(tt.talk)) || r.Duration != tt.talk {
+				t.Errorf("end %v duration %v, want %v after answer", r.EndTime, r.Duration, tt.talk)
+			}
+			if r.Status != message.StatusOK || r.Disconnect != tt.aliceEnd {
+				t.Errorf("status %d disconnect %s, want 200 %s", r.Status, r.Disconnect, tt.aliceEnd)
+			}
+
+			r = c.bobCDR.next(t)
+			if r.Direction != cdr.DirectionInbound || r.Status != message.StatusOK || r.Disconnect != tt.bobEnd || !r.Answered() {
+				t.Errorf("bob's record %s status %d disconnect %s, want inbound 200 %s", r.Direction, r.Status, r.Disconnect, tt.bobEnd)
+			}
+			c.aliceCDR.none(t, 100*time.Millisecond)
+		})
+	}
+}
+
+func TestCDRFailedCall(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		disconnect string
+		// fail 让呼叫失败，返回 bob 侧是否也有记录
+		fail func(t *testing.T, c *cdrCall) bool
+	}{
+		{"busy", message.StatusBusyHere, cdr.PartyCallee, func(t *testing.T, c *cdrCall) bool {
+			sendInvite(t, c.alice, c.bob)
+			c.answer(nextInvite(t, c.invites), message.StatusBusyHere, NewTag(), nil)
+			return true
+		}},
+		{"cancelled", message.StatusRequestTerminated, cdr.PartyCaller, func(t *testing.T, c *cdrCall) bool {
+			_, tx := sendInvite(t, c.alice, c.bob)
+			c.answer(nextInvite(t, c.invites), message.StatusRinging, NewTag(), nil)
+			waitProceeding(t, tx)
+			if err := c.alice.Cancel(tx); err != nil {
+				t.Fatal(err)
+			}
+			return true
+		}},
+		{"timeout", message.StatusRequestTimeout, cdr.PartySystem, func(t *testing.T, c *cdrCall) bool {
+			// 没有人应答的 UDP 目标：Timer B（64*T1 = 32s）到期
+			dead := freeAddr(t)
+			invite, err := c.alice.BuildInviteRequest("sip:alice@"+c.alice.LocalAddr(), "sip:bob@"+dead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.alice.SendRequest(invite, dead); err != nil {
+				t.Fatal(err)
+			}
+			c.clock.Advance(32 * time.Second)
+			return false
+		}},
+		{"transport error", message.StatusServiceUnavailable, cdr.PartySystem, func(t *testing.T, c *cdrCall) bool {
+			// TCP 连接被拒绝，发送失败
+			dead := freeAddr(t)
+			invite, err := c.alice.BuildInviteRequest("sip:alice@"+c.alice.LocalAddr(), "sip:bob@"+dead+";transport=tcp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.alice.SendRequest(invite, dead); err == nil {
+				t.Fatal("INVITE to a closed TCP port sent")
+			}
+			return false
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCDRCall(t)
+			start := c.clock.Now()
+			inbound := tt.fail(t, c)
+
+			r := c.aliceCDR.next(t)
+			if r.Status != tt.status || r.Disconnect != tt.disconnect {
+				t.Errorf("status %d disconnect %s, want %d %s", r.Status, r.Disconnect, tt.status, tt.disconnect)
+			}
+			if r.Answered() || r.Duration != 0 || !r.InviteTime.Equal(start) || r.EndTime.Before(start) {
+				t.Errorf("failed call record %+v", r)
+			}
+			if inbound {
+				if r := c.bobCDR.next(t); r.Status != tt.status || r.Disconnect != tt.disconnect || r.Direction != cdr.DirectionInbound {
+					t.Errorf("bob's record status %d disconnect %s %s, want inbound %d %s",
+						r.Status, r.Disconnect, r.Direction, tt.status, tt.disconnect)
+				}
+			}
+			c.aliceCDR.none(t, 100*time.Millisecond)
+		})
+	}
+}
+
+func TestCDRRetriesKeepOneRecord(t *testing.T) {
+	store := auth.NewMemoryStore()
+	store.Set("example.com", "alice", "secret")
+	a := auth.NewAuthenticator("example.com", store)
+	tests := []struct {
+		name   string
+		opts   []Option
+		reject func(resp *message.Response)
+		code   int
+	}{
+		{"digest challenge", []Option{WithCredentials("alice", store)}, func(resp *message.Response) {
+			a.Challenge(resp, false, false)
+		}, message.StatusUnauthorized},
+		{"interval too small", []Option{WithSessionTimer(120, MinSessionExpires)}, func(resp *message.Response) {
+			resp.Headers.Set(message.HeaderMinSE, "300")
+		}, message.StatusIntervalTooSmall},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCDRCall(t, tt.opts...)
+			invite, _ := sendInvite(t, c.alice, c.bob)
+			c.answer(nextInvite(t, c.invites), tt.code, NewTag(), tt.reject)
+
+			// 重发的 INVITE 沿用 Call-ID 与 From tag，接通后挂机只有一条记录
+			retry := nextInvite(t, c.invites)
+			if retry.req.Headers.Get(message.HeaderCallID) != invite.Headers.Get(message.HeaderCallID) {
+				t.Fatal("retry in a different Call-ID")
+			}
+			c.answer(retry, message.StatusOK, NewTag(), nil)
+			resp := c.aliceH.nextResponse(t, message.MethodINVITE)
+			if resp.StatusCode != message.StatusOK {
+				t.Fatalf("INVITE answered with %d after the retry", resp.StatusCode)
+			}
+			c.aliceCDR.none(t, 100*time.Millisecond)
+			d := c.alice.ResponseDialog(resp)
+			if d == nil {
+				t.Fatal("no dialog for the 200")
+			}
+			if err := c.alice.SendInDialog(d.NewRequest(message.MethodBYE)); err != nil {
+				t.Fatal(err)
+			}
+			r := c.aliceCDR.next(t)
+			if r.Status != message.StatusOK || r.Disconnect != cdr.PartyCaller || r.CallID != invite.Headers.Get(message.HeaderCallID) {
+				t.Errorf("record status %d disconnect %s", r.Status, r.Disconnect)
+			}
+			c.aliceCDR.none(t, 100*time.Millisecond)
+		})
+	}
+}
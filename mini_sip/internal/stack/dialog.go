@@ -0,0 +1,287 @@
+package stack
+
+import (
+	"fmt"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// 对话层（RFC 3261 §12）：
+//
+//   - UAC：本端发出的 INVITE 收到带 To tag 的 1xx 建立早期对话，2xx 建立 / 确认对话；
+//     非 2xx 最终响应删除该 INVITE 的早期对话，BYE 的最终响应删除对话
+//   - UAS：经服务端事务发出带 To tag 的 1xx / 2xx 时建立对话，非 2xx 最终响应删除早期对话，
+//     收到 BYE 时删除对话
+//   - SUBSCRIBE 的 2xx 建立订阅对话（两种角色），先于 2xx 到达的 NOTIFY 也建立对话（见 subscribe.go）
+//   - 收到带 To tag 的请求时按对话表匹配：找不到回 481，CSeq 乱序回 500
+//   - 带 Replaces 的 INVITE 按 Call-ID 与 tag 查找被替换的对话（FindDialog，见 refer.go）
+//
+// 代理模式（SetProxyMode）下经过的请求与响应属于下游 UA 的对话，协议栈不建立也不校验对话。
+
+// SetProxyMode 声明协议栈作为代理使用（由 proxy.New 调用），关闭对话层。
+func (s *Stack) SetProxyMode() {
+	s.dialogMu.Lock()
+	s.proxyMode = true
+	s.dialogMu.Unlock()
+}
+
+func (s *Stack) isProxy() bool {
+	s.dialogMu.Lock()
+	defer s.dialogMu.Unlock()
+	return s.proxyMode
+}
+
+// Dialog 按 ID 查找对话。
+func (s *Stack) Dialog(id dialog.DialogID) *dialog.Dialog {
+	s.dialogMu.Lock()
+	defer s.dialogMu.Unlock()
+	return s.dialogs[id]
+}
+
+// ResponseDialog 返回本端发出的请求的响应所属的对话（UAC 视角）。
+func (s *Stack) ResponseDialog(resp *message.Response) *dialog.Dialog {
+	id, err := dialog.IDFromResponse(resp)
+	if err != nil {
+		return nil
+	}
+	return s.Dialog(id)
+}
+
+// RequestDialog 返回收到的请求所属的对话（UAS 视角）。
+func (s *Stack) RequestDialog(req *message.Request) *dialog.Dialog {
+	id, err := dialog.IDFromRequest(req)
+	if err != nil {
+		return nil
+	}
+	return s.Dialog(id)
+}
+
+// SendInDialog 发送 Dialog.NewRequest 构造的对话内请求，目标为 NextHop。
+func (s *Stack) SendInDialog(req *message.Request) error {
+	dst, err := NextHop(req)
+	if err != nil {
+		return err
+	}
+	return s.SendRequest(req, dst)
+}
+
+// NextHop 返回请求的下一跳地址：有 Route 时为第一个 Route，否则为 Request-URI（RFC 3261 §8.1.2）。
+func NextHop(req *message.Request) (string, error) {
+	if route := req.Headers.Get(message.HeaderRoute); route != "" {
+		addr, err := message.ParseAddress(route)
+		if err != nil || addr.URI == nil {
+			return "", fmt.Errorf("parse Route %q: %v", route, err)
+		}
+		return TargetAddr(addr.URI), nil
+	}
+	if req.RequestURI == nil {
+		return "", fmt.Errorf("request without Request-URI")
+	}
+	return TargetAddr(req.RequestURI), nil
+}
+
+// addDialog 登记对话，已存在相同 ID 时保留原对话并返回它。
+func (s *Stack) addDialog(d *dialog.Dialog) *dialog.Dialog {
+	s.dialogMu.Lock()
+	defer s.dialogMu.Unlock()
+	if old, ok := s.dialogs[d.ID]; ok {
+		return old
+	}
+	s.dialogs[d.ID] = d
+	s.logger.Info("dialog created", zap.String("id", d.ID.String()), zap.String("state", d.State.String()))
+	return d
+}
+
+// removeDialog 终止并删除对话，同时停止其会话计时器并删除对话上的订阅。
+func (s *Stack) removeDialog(id dialog.DialogID) {
+	s.dialogMu.Lock()
+	d, ok := s.dialogs[id]
+	delete(s.dialogs, id)
+	t := s.sessions[id]
+	delete(s.sessions, id)
+	s.dialogMu.Unlock()
+	if t != nil {
+		t.stop()
+	}
+	s.dropSubscriptions(id)
+	if ok {
+		d.Terminate()
+	}
+}
+
+// removeEarlyDialogs 删除 INVITE 失败后残留的早期对话（分叉时可能有多个）。
+func (s *Stack) removeEarlyDialogs(callID, localTag string) {
+	s.dialogMu.Lock()
+	var ids []dialog.DialogID
+	for id, d := range s.dialogs {
+		if id.CallID == callID && id.LocalTag == localTag && d.GetState() == dialog.DialogStateEarly {
+			ids = append(ids, id)
+		}
+	}
+	s.dialogMu.Unlock()
+	for _, id := range ids {
+		s.removeDialog(id)
+	}
+}
+
+// trackClientResponse 按本端请求收到的响应维护 UAC 对话。
+// 只处理本端发起的请求（只有一个 Via），代理转发的请求属于下游 UA。
+func (s *Stack) trackClientResponse(req *message.Request, resp *message.Response) {
+	if s.isProxy() || len(resp.Headers.GetAll(message.HeaderVia)) != 1 {
+		return
+	}
+	id, err := dialog.IDFromResponse(resp)
+	if err != nil {
+		return
+	}
+	code := resp.StatusCode
+	switch req.Method {
+	case message.MethodINVITE:
+		switch {
+		case code >= 300:
+			s.removeEarlyDialogs(id.CallID, id.LocalTag)
+		case code > 100 && id.RemoteTag != "":
+			existing := s.Dialog(id)
+			if existing != nil && existing.GetState() != dialog.DialogStateEarly {
+				// re-INVITE 的 2xx：目标刷新
+				if code >= 200 {
+					existing.Confirm(resp)
+				}
+				return
+			}
+			if existing != nil && code < 200 {
+				return // 同一早期对话的后续 1xx，保留已确认的 RSeq 与 CSeq
+			}
+			// 新建对话；早期对话收到 2xx 时按 2xx 重新计算路由集与 Remote-Target（§13.2.2.4）
+			d, err := dialog.NewDialogFromResponse(req, resp, s.logger)
+			if err != nil {
+				s.logger.Warn("create dialog", zap.Error(err))
+				return
+			}
+			d.LocalTarget = contactURI(req.Headers)
+			if existing != nil {
+				d.InheritEarly(existing)
+			}
+			s.dialogMu.Lock()
+			s.dialogs[id] = d
+			s.dialogMu.Unlock()
+			s.logger.Info("dialog updated", zap.String("id", id.String()), zap.String("state", d.State.String()))
+		}
+	case message.MethodSUBSCRIBE:
+		// 只有对话外 SUBSCRIBE 的 2xx 建立对话；刷新 / 退订的 2xx 可能晚于 terminated 的 NOTIFY 到达，
+		// 此时对话已随订阅删除，不能再建
+		if code >= 200 && code < 300 && id.RemoteTag != "" && dialogIDOf(req).RemoteTag == "" && s.Dialog(id) == nil {
+			d, err := dialog.NewDialogFromResponse(req, resp, s.logger)
+			if err != nil {
+				s.logger.Warn("create dialog", zap.Error(err))
+				return
+			}
+			d.LocalTarget = contactURI(req.Headers)
+			s.addDialog(d)
+		}
+	case message.MethodBYE:
+		if code >= 200 {
+			s.removeDialog(id)
+		}
+	}
+}
+
+// contactURI 返回 Contact 头域中的 URI，没有或解析失败时为 nil。
+func contactURI(h *message.Headers) *message.URI {
+	addr, err := message.ParseAddress(h.Get(message.HeaderContact))
+	if err != nil || addr.URI == nil {
+		return nil
+	}
+	return addr.URI.Clone()
+}
+
+// onServerResponse 是服务端事务的 OnRespond 回调，维护 UAS 对话、会话计时器与呼叫详细记录。
+func (s *Stack) onServerResponse(tx *dialog.Transaction, resp *message.Response) {
+	if s.isProxy() {
+		return
+	}
+	s.trackServerResponse(tx, resp)
+	s.cdrResponse(tx.Request, resp, false)
+	s.onServerSessionResponse(tx, resp)
+	s.onReplacingResponse(tx, resp)
+}
+
+// trackServerResponse 按本端发出的 INVITE / SUBSCRIBE 响应维护 UAS 对话。
+func (s *Stack) trackServerResponse(tx *dialog.Transaction, resp *message.Response) {
+	if tx.Method != message.MethodINVITE && tx.Method != message.MethodSUBSCRIBE {
+		return
+	}
+	req := tx.Request
+	to, err := message.ParseAddress(resp.Headers.Get(message.HeaderTo))
+	if err != nil || to.Tag == "" {
+		return
+	}
+	id, err := dialog.IDFromRequest(req)
+	if err != nil {
+		return
+	}
+	if id.LocalTag != "" {
+		return // re-INVITE：对话已存在，目标刷新在收到请求时处理
+	}
+	id.LocalTag = to.Tag
+	code := resp.StatusCode
+	switch {
+	case code >= 300:
+		if d := s.Dialog(id); d != nil && d.GetState() == dialog.DialogStateEarly {
+			s.removeDialog(id)
+		}
+	case code > 100:
+		d := s.Dialog(id)
+		if d == nil {
+			nd, err := dialog.NewDialogFromRequest(req, to.Tag, s.logger)
+			if err != nil {
+				s.logger.Warn("create dialog", zap.Error(err))
+				return
+			}
+			nd.LocalTarget = contactURI(resp.Headers)
+			d = s.addDialog(nd)
+		}
+		if code >= 200 {
+			d.MarkConfirmed()
+		}
+	}
+}
+
+// matchDialog 校验收到的对话内请求（带 To tag），返回 false 时已回复错误响应。
+func (s *Stack) matchDialog(req *message.Request, tx *dialog.Transaction) bool {
+	if s.isProxy() || req.Method == message.MethodCANCEL {
+		return true
+	}
+	id, err := dialog.IDFromRequest(req)
+	if err != nil || id.LocalTag == "" {
+		return true
+	}
+	d := s.Dialog(id)
+	if d == nil && req.Method == message.MethodNOTIFY {
+		d = s.dialogFromNotify(req, id)
+	}
+	if d == nil {
+		s.respondDialogError(tx, req, message.StatusCallDoesNotExist)
+		return false
+	}
+	if err := d.HandleRequest(req); err != nil {
+		s.respondDialogError(tx, req, message.StatusServerError)
+		return false
+	}
+	if req.Method == message.MethodBYE {
+		s.cdrBye(id, endRemote)
+		s.removeDialog(id)
+	}
+	return true
+}
+
+func (s *Stack) respondDialogError(tx *dialog.Transaction, req *message.Request, code int) {
+	resp := BuildResponse(req, code, "")
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Warn("send dialog error response", zap.Int("code", code), zap.Error(err))
+	}
+	s.logger.Info("rejected in-dialog request",
+		zap.String("method", string(req.Method)), zap.Int("code", code))
+}
@@ -0,0 +1,136 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/locate"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+	"go.uber.org/zap"
+)
+
+// 服务器定位（RFC 3263）：
+//
+//   - Locate 经由 locate.Locator 把 URI 解析为有序的下一跳（只包含本端启用的传输），
+//     DNS 查询使用 WithResolver 注入的解析器，默认为系统 DNS
+//   - SendRequestURI 发往第一个目标并记下其余目标；客户端事务在收到任何响应前
+//     超时或传输错误时，以新的 branch 改发下一个目标（RFC 3263 §4.3），
+//     全部目标都失败后才通过 Handler.OnError 通知上层
+
+// locateTimeout 是一次定位（全部 DNS 查询）的时限。
+const locateTimeout = 5 * time.Second
+
+// Locate 按 RFC 3263 解析 uri 指向的下一跳，按尝试顺序返回。
+func (s *Stack) Locate(uri *message.URI) ([]locate.Target, error) {
+	networks := make([]string, 0, len(s.order))
+	for _, tp := range s.order {
+		networks = append(networks, tp.Network())
+	}
+	l := &locate.Locator{Resolver: s.resolver, Networks: networks}
+	ctx, cancel := context.WithTimeout(context.Background(), locateTimeout)
+	defer cancel()
+	return l.Locate(ctx, uri)
+}
+
+// SendRequestURI 按 RFC 3263 定位 next 并发送请求，next 为 nil 时使用第一个 Route 的 URI（松散路由），
+// 没有 Route 时使用 Request-URI（RFC 3261 §8.1.2）。
+//
+// 与 SendRequest 一样由协议栈补全或改写顶层 Via；定位到多个目标时，
+// 事务在收到响应前失败会自动改发下一个目标。
+func (s *Stack) SendRequestURI(req *message.Request, next *message.URI) error {
+	if next == nil {
+		next = req.RequestURI
+		if route := req.Headers.Get(message.HeaderRoute); route != "" {
+			addr, err := message.ParseAddress(message.SplitValues(route)[0])
+			if err != nil {
+				return fmt.Errorf("parse Route: %w", err)
+			}
+			next = addr.URI
+		}
+	}
+	targets, err := s.Locate(next)
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("located next hop", zap.String("uri", next.String()), zap.Stringers("targets", targets))
+	return s.sendToTargets(req, targets, false)
+}
+
+// sendToTargets 依次尝试 targets，直到有一个目标的事务启动成功，其余目标留作失败后的备选。
+// retry 为 true 表示改发（上一个目标已失败），顶层 Via 换用新的 branch。
+func (s *Stack) sendToTargets(req *message.Request, targets []locate.Target, retry bool) error {
+	var lastErr error
+	for i, t := range targets {
+		tp, ok := s.transports[t.Network]
+		if !ok {
+			lastErr = fmt.Errorf("transport %s not enabled", t.Network)
+			continue
+		}
+		if t.Network == transport.NetworkUDP && len(req.String()) > transport.MTUThreshold {
+			// 超过 MTU 阈值改用 TCP（RFC 3261 §18.1.1）
+			if tcp, ok := s.transports[transport.NetworkTCP]; ok {
+				tp = tcp
+			}
+		}
+		if retry || !req.Headers.Exists(message.HeaderVia) {
+			if retry {
+				req.Headers.RemoveFirst(message.HeaderVia)
+			}
+			req.Headers.Insert(message.HeaderVia, viaValue(tp.Network(), s.sentBy(tp)))
+		} else {
+			setTopVia(req, tp.Network(), s.sentBy(tp))
+		}
+		retry = true
+
+		var id string
+		if rest := targets[i+1:]; len(rest) > 0 && req.Method != message.MethodACK {
+			via, err := message.ParseVia(req.Headers.Get(message.HeaderVia))
+			if err != nil {
+				return err
+			}
+			id = dialog.TransactionID(via.Params.Get("branch"), req.Method)
+			s.txMu.Lock()
+			s.failovers[id] = rest
+			s.txMu.Unlock()
+		}
+		if err := s.send(req, tp, t.Addr); err != nil {
+			s.logger.Warn("send to target failed", zap.Stringer("target", t), zap.Error(err))
+			s.txMu.Lock()
+			delete(s.failovers, id)
+			s.txMu.Unlock()
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = locate.ErrNoTargets
+	}
+	s.cdrTimedOut(req, lastErr)
+	return lastErr
+}
+
+// failover 在客户端事务超时或传输错误时改发下一个目标，返回 true 表示已改发，不通知 TU。
+func (s *Stack) failover(tx *dialog.Transaction, err error) bool {
+	s.txMu.Lock()
+	targets := s.failovers[tx.ID]
+	delete(s.failovers, tx.ID)
+	s.txMu.Unlock()
+	if len(targets) == 0 || !(errors.Is(err, dialog.ErrTimeout) || errors.Is(err, dialog.ErrTransport)) {
+		return false
+	}
+	s.logger.Info("target failed, trying next",
+		zap.String("method", string(tx.Request.Method)), zap.Error(err), zap.Stringer("next", targets[0]))
+	return s.sendToTargets(tx.Request, targets, true) == nil
+}
+
+// responded 在客户端事务收到响应后放弃其备选目标：服务器已经响应，超时不再改发。
+func (s *Stack) responded(txID string) {
+	s.txMu.Lock()
+	delete(s.failovers, txID)
+	s.txMu.Unlock()
+}
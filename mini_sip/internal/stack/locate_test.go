@@ -0,0 +1,157 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/locate"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// srvResolver 只有 SRV 与 A 记录的 locate.Resolver，所有主机都解析为 127.0.0.1。
+type srvResolver map[string][]*net.SRV
+
+func (r srvResolver) LookupNAPTR(context.Context, string) ([]locate.NAPTR, error) { return nil, nil }
+
+func (r srvResolver) LookupSRV(_ context.Context, name string) ([]*net.SRV, error) {
+	return r[name], nil
+}
+
+func (r srvResolver) LookupHost(context.Context, string) ([]string, error) {
+	return []string{"127.0.0.1"}, nil
+}
+
+// blackHole 是只接收不应答的 UDP 目标。
+type blackHole struct {
+	conn *net.UDPConn
+}
+
+func newBlackHole(t *testing.T) *blackHole {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &blackHole{conn: conn}
+}
+
+func (b *blackHole) port() uint16 {
+	return uint16(b.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// branch 读取黑洞收到的第一个请求，返回其顶层 Via 的 branch。
+func (b *blackHole) branch(t *testing.T) string {
+	t.Helper()
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65535)
+	n, err := b.conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topBranch(t, buf[:n])
+}
+
+func topBranch(t *testing.T, data []byte) string {
+	t.Helper()
+	msg, err := message.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, ok := msg.(*message.Request)
+	if !ok {
+		t.Fatalf("received %T, want a request", msg)
+	}
+	via, err := message.ParseVia(req.Headers.Get(message.HeaderVia))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return via.Params.Get("branch")
+}
+
+// sendViaSRV 经由 SRV 定位发送 MESSAGE 到 sip:bob@example.test。
+func sendViaSRV(t *testing.T, s *Stack) {
+	t.Helper()
+	req, err := s.BuildMessageRequest("sip:alice@"+s.LocalAddr(), "sip:bob@example.test", "text/plain", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendRequestURI(req, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailoverToNextTarget(t *testing.T) {
+	hole := newBlackHole(t)
+	bobH := newTestHandler()
+	bob := newTestStack(t, bobH)
+	bobPort := uint16(bob.transports[transport.NetworkUDP].LocalAddr().(*net.UDPAddr).Port)
+
+	clock := dialog.NewManualClock(time.Now())
+	aliceH := newTestHandler()
+	alice := newTestStack(t, aliceH, WithClock(clock), WithResolver(srvResolver{
+		"_sip._udp.example.test": {
+			{Target: "hole.example.test.", Port: hole.port(), Priority: 10},
+			{Target: "bob.example.test.", Port: bobPort, Priority: 20},
+		},
+	}))
+	sendViaSRV(t, alice)
+	first := hole.branch(t)
+
+	// Timer F (64*T1) 到期后以新的 branch 改发下一个目标，TU 不会收到错误
+	clock.Advance(64 * dialog.DefaultT1)
+	got := bobH.nextRequest(t, message.MethodMESSAGE)
+	via, err := message.ParseVia(got.Headers.Get(message.HeaderVia))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch := via.Params.Get("branch"); branch == first {
+		t.Fatalf("retried request reuses branch %s", branch)
+	}
+	if resp := aliceH.nextResponse(t, message.MethodMESSAGE); resp.StatusCode != message.StatusOK {
+		t.Fatalf("alice received %d", resp.StatusCode)
+	}
+	select {
+	case err := <-aliceH.errs:
+		t.Fatalf("OnError(%v) after a successful failover", err)
+	default:
+	}
+}
+
+func TestFailoverExhausted(t *testing.T) {
+	holes := []*blackHole{newBlackHole(t), newBlackHole(t)}
+	clock := dialog.NewManualClock(time.Now())
+	h := newTestHandler()
+	s := newTestStack(t, h, WithClock(clock), WithResolver(srvResolver{
+		"_sip._udp.example.test": {
+			{Target: "a.example.test.", Port: holes[0].port(), Priority: 10},
+			{Target: "b.example.test.", Port: holes[1].port(), Priority: 20},
+		},
+	}))
+	sendViaSRV(t, s)
+	holes[0].branch(t)
+
+	clock.Advance(64 * dialog.DefaultT1)
+	holes[1].branch(t)
+	select {
+	case err := <-h.errs:
+		t.Fatalf("OnError(%v) before the last target failed", err)
+	default:
+	}
+
+	// 最后一个目标也超时后才通知 TU
+	clock.Advance(64 * dialog.DefaultT1)
+	select {
+	case err := <-h.errs:
+		if !errors.Is(err, dialog.ErrTimeout) {
+			t.Fatalf("OnError(%v), want ErrTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnError not called after every target timed out")
+	}
+}
@@ -0,0 +1,194 @@
+package stack
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+	"go.uber.org/zap"
+)
+
+// NAT 穿透（RFC 3581 / RFC 5626）：
+//
+//   - 本端发出的请求在 Via 中带空的 rport 参数，请求对端把响应发回请求实际来自的端口
+//   - 收到请求时按实际来源地址在顶层 Via 上标注 received（与 sent-by 不同或带 rport 时）
+//     并回填 rport，响应与无状态转发都按 received:rport 路由（见 viaTarget）
+//   - StartKeepalive 在一条流上周期性发送 CRLF ping：面向连接的传输上 10 秒内
+//     等不到 pong 即认为流已失效，UDP 上只用于刷新 NAT 映射
+
+const (
+	keepaliveUDP    = 25 * time.Second  // 常见 NAT 的 UDP 映射在 30 秒左右过期
+	keepaliveStream = 120 * time.Second // RFC 5626 §4.4.1 面向连接传输的建议间隔
+	pongTimeout     = 10 * time.Second  // RFC 5626 §4.4.1 等待 pong 的时间
+)
+
+// viaValue 构造本端 Via：带空 rport 参数（RFC 3581 §3），branch 每次新生成。
+func viaValue(network, sentBy string) string {
+	return fmt.Sprintf("SIP/2.0/%s %s;rport;branch=%s", network, sentBy, NewBranch())
+}
+
+// stampVia 按请求的实际来源改写顶层 Via（RFC 3261 §18.2.1，RFC 3581 §4）：
+// sent-by 的主机与来源 IP 不同时加 received；带 rport 时回填来源端口并总是加 received。
+func stampVia(req *message.Request, src net.Addr) {
+	if src == nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(src.String())
+	if err != nil {
+		return
+	}
+	via, err := message.ParseVia(req.Headers.Get(message.HeaderVia))
+	if err != nil {
+		return
+	}
+	sentHost, _, err := net.SplitHostPort(via.SentBy)
+	if err != nil {
+		sentHost = strings.Trim(via.SentBy, "[]")
+	}
+	rport := via.Params.Has("rport")
+	if !rport && sentHost == host {
+		return
+	}
+	via.Params.Set("received", host)
+	if rport {
+		via.Params.Set("rport", port)
+	}
+	req.Headers.RemoveFirst(message.HeaderVia)
+	req.Headers.Insert(message.HeaderVia, via.String())
+}
+
+// keepalive 是本端到 dst 的一条流上的保活。
+type keepalive struct {
+	tp       transport.Transport
+	dst      string
+	interval time.Duration
+	onFail   func()
+
+	timer   dialog.Timer // 下一次 ping
+	waiting dialog.Timer // 等待 pong，nil 表示没有未应答的 ping
+}
+
+// keepaliveKey 以传输标识与远端地址标识一条流，pong 按来源地址匹配。
+func keepaliveKey(network, addr string) string {
+	return network + " " + addr
+}
+
+// StartKeepalive 开始到 dst 的流保活（RFC 5626 §4.4.1），通常在注册成功后调用。
+//
+// network 为 UDP、TCP 或 TLS（WebSocket 使用自己的 ping 帧，不支持 CRLF 保活）；
+// interval 为 0 时 UDP 使用 25 秒、面向连接的传输使用 120 秒，实际间隔在 80%-100% 之间随机，
+// 避免大量 UA 同时发送。面向连接的传输上 ping 发出后 10 秒内没有 pong 时保活停止并调用 onFail，
+// 此时流已失效，UA 应重新注册。同一条流重复调用时替换原有保活。
+func (s *Stack) StartKeepalive(network, dst string, interval time.Duration, onFail func()) error {
+	network = strings.ToUpper(network)
+	tp, ok := s.transports[network]
+	if !ok {
+		return fmt.Errorf("keepalive: transport %s not enabled", network)
+	}
+	if network == transport.NetworkWS || network == transport.NetworkWSS {
+		return fmt.Errorf("keepalive: CRLF keepalive not supported on %s", network)
+	}
+	if interval <= 0 {
+		interval = keepaliveStream
+		if !tp.Reliable() {
+			interval = keepaliveUDP
+		}
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", dst); err == nil {
+		dst = addr.String()
+	}
+	k := &keepalive{tp: tp, dst: dst, interval: interval, onFail: onFail}
+	key := keepaliveKey(network, dst)
+	s.kaMu.Lock()
+	if old := s.keepalives[key]; old != nil {
+		old.stop()
+	}
+	s.keepalives[key] = k
+	k.timer = s.Clock().AfterFunc(k.next(), func() { s.ping(key, k) })
+	s.kaMu.Unlock()
+	s.logger.Info("keepalive started", zap.String("network", network), zap.String("dst", dst),
+		zap.Duration("interval", interval))
+	return nil
+}
+
+// StopKeepalive 停止到 dst 的流保活。
+func (s *Stack) StopKeepalive(network, dst string) {
+	network = strings.ToUpper(network)
+	if addr, err := net.ResolveTCPAddr("tcp", dst); err == nil {
+		dst = addr.String()
+	}
+	key := keepaliveKey(network, dst)
+	s.kaMu.Lock()
+	if k := s.keepalives[key]; k != nil {
+		k.stop()
+		delete(s.keepalives, key)
+	}
+	s.kaMu.Unlock()
+}
+
+// next 返回下一次 ping 的延迟：interval 的 80%-100%。
+func (k *keepalive) next() time.Duration {
+	return k.interval - time.Duration(rand.Int63n(int64(k.interval)/5+1))
+}
+
+func (k *keepalive) stop() {
+	k.timer.Stop()
+	if k.waiting != nil {
+		k.waiting.Stop()
+	}
+}
+
+// ping 发送一次保活，面向连接的传输上开始等待 pong。
+func (s *Stack) ping(key string, k *keepalive) {
+	s.kaMu.Lock()
+	if s.keepalives[key] != k {
+		s.kaMu.Unlock()
+		return
+	}
+	if k.tp.Reliable() && k.waiting == nil {
+		k.waiting = s.Clock().AfterFunc(pongTimeout, func() { s.pongTimedOut(key, k) })
+	}
+	k.timer = s.Clock().AfterFunc(k.next(), func() { s.ping(key, k) })
+	s.kaMu.Unlock()
+
+	if err := k.tp.SendTo([]byte(transport.Ping), k.dst); err != nil {
+		s.logger.Warn("send keepalive", zap.String("network", k.tp.Network()), zap.String("dst", k.dst), zap.Error(err))
+		return
+	}
+	s.logger.Debug("sent keepalive", zap.String("network", k.tp.Network()), zap.String("dst", k.dst))
+}
+
+// onPong 处理面向连接传输上收到的 pong。
+func (s *Stack) onPong(network string, src net.Addr) {
+	s.kaMu.Lock()
+	defer s.kaMu.Unlock()
+	k := s.keepalives[keepaliveKey(network, src.String())]
+	if k == nil || k.waiting == nil {
+		return
+	}
+	k.waiting.Stop()
+	k.waiting = nil
+}
+
+// pongTimedOut 在 ping 之后等不到 pong 时停止保活并通知上层流已失效。
+func (s *Stack) pongTimedOut(key string, k *keepalive) {
+	s.kaMu.Lock()
+	if s.keepalives[key] != k {
+		s.kaMu.Unlock()
+		return
+	}
+	k.stop()
+	delete(s.keepalives, key)
+	s.kaMu.Unlock()
+
+	s.logger.Warn("keepalive pong not received, flow failed",
+		zap.String("network", k.tp.Network()), zap.String("dst", k.dst))
+	if k.onFail != nil {
+		k.onFail()
+	}
+}
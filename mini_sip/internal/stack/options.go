@@ -0,0 +1,107 @@
+package stack
+
+import (
+	"crypto/tls"
+
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/event"
+	"github.com/lccxxo/go_/mini_sip/internal/locate"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// Option 配置 Stack 的可选参数。
+type Option func(*Stack)
+
+// WithClock 注入事务层使用的时钟（测试中可使用 dialog.ManualClock）。
+func WithClock(clock dialog.Clock) Option {
+	return func(s *Stack) {
+		s.txOpts.Clock = clock
+	}
+}
+
+// WithTimers 覆盖事务计时器基准值 T1/T2/T4。
+func WithTimers(timers dialog.TimerConfig) Option {
+	return func(s *Stack) {
+		s.txOpts.Timers = timers
+	}
+}
+
+// WithTLS 在 listenAddr（通常为 5061 端口）上启用 TLS 传输，用于承载 sips: 请求。
+// config 需包含本端证书与校验对端所用的 CA 池，可由 transport.LoadTLSConfig 生成。
+func WithTLS(listenAddr string, config *tls.Config) Option {
+	return func(s *Stack) {
+		s.extraTransports = append(s.extraTransports, func() (transport.Transport, error) {
+			return transport.NewTLSTransport(listenAddr, config, s.logger)
+		})
+	}
+}
+
+// WithWebSocket 在 listenAddr 上启用 SIP over WebSocket（RFC 7118）。
+// config 为 nil 时为 WS，否则为 WSS；与 UDP / TCP 并行工作。
+func WithWebSocket(listenAddr string, config *tls.Config) Option {
+	return func(s *Stack) {
+		s.extraTransports = append(s.extraTransports, func() (transport.Transport, error) {
+			return transport.NewWSTransport(listenAddr, config, s.logger)
+		})
+	}
+}
+
+// WithCapture 为全部传输设置抓包挂钩，收发的 SIP 消息交给 c（如 capture.Capture）。
+func WithCapture(c transport.Capturer) Option {
+	return func(s *Stack) {
+		s.capturer = c
+	}
+}
+
+// WithResolver 替换服务器定位（RFC 3263，见 Locate / SendRequestURI）使用的 DNS 解析器，
+// 如 locate.NewDNSResolver 指向测试用的名称服务器。
+func WithResolver(r locate.Resolver) Option {
+	return func(s *Stack) {
+		s.resolver = r
+	}
+}
+
+// WithCDRSink 为每个 INVITE 对话生成呼叫详细记录（见 cdr.go），结束时写入 sink；
+// 可以多次使用，记录依次写入每个 sink。
+func WithCDRSink(sink CDRSink) Option {
+	return func(s *Stack) {
+		s.cdrSinks = append(s.cdrSinks, sink)
+	}
+}
+
+// WithCredentials 配置客户端凭据：收到 401 / 407 时以 username 和 store 中该 realm 的密码
+// 自动重发请求（见 retryWithAuth）。
+func WithCredentials(username string, store auth.CredentialStore) Option {
+	return func(s *Stack) {
+		s.authUser = username
+		s.authStore = store
+	}
+}
+
+// WithMedia 配置本端媒体能力：BuildInviteRequest 附带 SDP offer，AnswerInvite 据此生成 answer。
+// cfg.Address 为空时使用协议栈的本机地址。
+func WithMedia(cfg sdp.Config) Option {
+	return func(s *Stack) {
+		s.media = &cfg
+	}
+}
+
+// WithSessionTimer 启用会话计时器（RFC 4028，见 session_timer.go），单位为秒：
+// expires 是 INVITE 请求的会话间隔，也是作为 UAS 接受的最大间隔；minSE 是本端可接受的最小间隔，
+// 小于 MinSessionExpires 时取 MinSessionExpires，expires 小于 minSE 时取 minSE。
+func WithSessionTimer(expires, minSE int) Option {
+	return func(s *Stack) {
+		s.minSE = max(minSE, MinSessionExpires)
+		s.sessionExpires = max(expires, s.minSE)
+	}
+}
+
+// WithEventPackage 登记事件包（见 subscribe.go），协议栈据此接受 SUBSCRIBE 并发送 NOTIFY；
+// 同名事件包后登记的生效。
+func WithEventPackage(pkg event.Package) Option {
+	return func(s *Stack) {
+		s.packages[pkg.Name()] = pkg
+	}
+}
@@ -0,0 +1,118 @@
+package stack
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// ForwardRequest 以代理身份将请求转发到 dst（RFC 3261 §16.6）。
+//
+// 与 SendRequest 改写顶层 Via 不同，这里在顶层压入本端 Via（新 branch），
+// 原有 Via 保持不变，下游响应弹出本端 Via 后即可沿原路返回。
+// 非 ACK 请求创建客户端事务，响应与超时照常通过 Handler 回调。
+func (s *Stack) ForwardRequest(req *message.Request, dst string) error {
+	tp, err := s.selectTransport(req)
+	if err != nil {
+		return err
+	}
+	req.Headers.Insert(message.HeaderVia, viaValue(tp.Network(), s.sentBy(tp)))
+	return s.send(req, tp, dst)
+}
+
+// ForwardResponse 无状态地转发响应（RFC 3261 §16.11）：
+// 弹出顶层（本端）Via，按下一个 Via 的传输标识与地址发出。
+// 用于已没有对应事务的响应，例如客户端事务结束后到达的 2xx 重传。
+func (s *Stack) ForwardResponse(resp *message.Response) error {
+	resp.Headers.RemoveFirst(message.HeaderVia)
+	via, err := message.ParseVia(resp.Headers.Get(message.HeaderVia))
+	if err != nil {
+		return fmt.Errorf("forward response: %w", err)
+	}
+	tp, ok := s.transports[via.Transport]
+	if !ok {
+		tp = s.udp
+	}
+	dst := viaTarget(via)
+	if err := tp.SendTo([]byte(resp.String()), dst); err != nil {
+		return err
+	}
+	s.logger.Info("forwarded response",
+		zap.Int("code", resp.StatusCode),
+		zap.String("network", tp.Network()),
+		zap.String("dst", dst),
+	)
+	return nil
+}
+
+// RecordRoute 返回本端 Record-Route 值，使后续对话内请求也经过本代理（RFC 3261 §16.6 步骤 4）。
+// 使用松散路由（;lr，RFC 3261 §16.12）。
+func (s *Stack) RecordRoute() string {
+	return fmt.Sprintf("<sip:%s;lr>", s.LocalAddr())
+}
+
+// IsLocalURI 判断 URI 是否指向本机的某个监听端口（用于识别指向本代理的 Route 与 Request-URI）。
+//
+// 监听通配地址时本机任一接口地址（含回环）都视为本机。
+func (s *Stack) IsLocalURI(u *message.URI) bool {
+	if u == nil {
+		return false
+	}
+	port := u.Port
+	if port == 0 {
+		port = 5060
+		if u.Scheme == "sips" {
+			port = 5061
+		}
+	}
+	portMatch := false
+	for _, tp := range s.order {
+		if _, p, err := net.SplitHostPort(tp.LocalAddr().String()); err == nil && p == strconv.Itoa(port) {
+			portMatch = true
+			break
+		}
+	}
+	if !portMatch {
+		return false
+	}
+	if strings.EqualFold(u.Host, s.localHost) || strings.EqualFold(u.Host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(u.Host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetAddr 返回 URI 对应的传输层地址 host:port（maddr 优先，端口缺省按 scheme 取 5060 / 5061）。
+func TargetAddr(u *message.URI) string {
+	host := u.Host
+	if maddr := u.Params.Get("maddr"); maddr != "" {
+		host = maddr
+	}
+	port := u.Port
+	if port == 0 {
+		port = 5060
+		if u.Scheme == "sips" {
+			port = 5061
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
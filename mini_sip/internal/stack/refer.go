@@ -0,0 +1,408 @@
+package stack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/event"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// 呼叫转移（RFC 3515 REFER，RFC 3891 Replaces，RFC 3892 Referred-By）：
+//
+//   - 转移方：Refer 在对话内发送 REFER，并登记 Event: refer;id=<CSeq> 的隐式订阅；
+//     盲转的 Refer-To 为转移目标，协商转移（attended）用 AttendedReferTo 带上 ?Replaces=。
+//     REFER 的响应与进度 NOTIFY 照常交给 TU，ReferStatus 取出 NOTIFY 中 sipfrag 的状态码，
+//     TU 据此在转移成功后挂断原通话；REFER 被拒绝时删除隐式订阅
+//   - 被转移方：TU 收到 REFER 后调用 AcceptRefer 回 202 并建立隐式订阅（立即 NOTIFY "100 Trying"），
+//     再用 BuildReferredInvite 构造发往 Refer-To 的 INVITE（带 Replaces / Referred-By）；
+//     该 INVITE 的临时与最终响应由协议栈以 message/sipfrag 的 NOTIFY 报告给转移方，最终响应后订阅结束
+//   - 转移目标：收到带 Replaces 的对话外 INVITE 时按 Call-ID 与 tag 查找被替换的对话，
+//     找不到回 481，early-only 而对话已确认回 486；TU 以 2xx 接受后协议栈对已确认的对话发送 BYE，
+//     早期对话（本端尚在振铃）以 487 结束原 INVITE
+//
+// 代理模式下 REFER 与带 Replaces 的 INVITE 照常转发。
+
+const (
+	// ContentTypeSipfrag 是 REFER 进度 NOTIFY 的消息体类型（RFC 3420）。
+	ContentTypeSipfrag = "message/sipfrag;version=2.0"
+
+	// referExpires 是被转移方隐式订阅的有效期，超时未得到最终响应时以 terminated 结束。
+	referExpires = 180 * time.Second
+)
+
+// referral 是被转移方一个 REFER 的隐式订阅的事件包：消息体为转移 INVITE 最近的状态行。
+type referral struct {
+	mu     sync.Mutex
+	status string
+}
+
+func (r *referral) Name() string          { return "refer" }
+func (r *referral) ContentType() string   { return ContentTypeSipfrag }
+func (r *referral) OnChange(func(string)) {}
+func (r *referral) Body(resource string) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return []byte(r.status + "\r\n")
+}
+
+func (r *referral) set(code int, reason string) {
+	r.mu.Lock()
+	r.status = fmt.Sprintf("SIP/2.0 %d %s", code, reason)
+	r.mu.Unlock()
+}
+
+// ---- 转移方 ----
+
+// AttendedReferTo 构造协商转移的 Refer-To：target 为转移目标，replaced 为本端与目标之间的
+// 咨询通话，被转移方的 INVITE 将以 Replaces 替换该通话（to-tag / from-tag 以目标为视角）。
+func AttendedReferTo(target *message.URI, replaced *dialog.Dialog) string {
+	rep := &message.Replaces{CallID: replaced.ID.CallID, ToTag: replaced.ID.RemoteTag, FromTag: replaced.ID.LocalTag}
+	uri := target.Clone()
+	uri.Headers = message.Params{{Name: message.HeaderReplaces, Value: message.EscapeHeaderValue(rep.String())}}
+	return fmt.Sprintf("<%s>", uri)
+}
+
+// Refer 在对话 id 内发送 REFER，referTo 为 Refer-To 头域值（URI 或 name-addr），
+// 并登记 REFER 建立的隐式订阅，进度 NOTIFY 由协议栈应答后交给 TU。
+func (s *Stack) Refer(id dialog.DialogID, referTo string) (*message.Request, error) {
+	d := s.Dialog(id)
+	if d == nil {
+		return nil, fmt.Errorf("dialog %s not found", id)
+	}
+	if !strings.Contains(referTo, "<") {
+		referTo = "<" + referTo + ">"
+	}
+	if addr, err := message.ParseAddress(referTo); err != nil || addr.URI == nil {
+		return nil, fmt.Errorf("invalid Refer-To %q: %v", referTo, err)
+	}
+	req := d.NewRequest(message.MethodREFER)
+	req.Headers.Set(message.HeaderReferTo, referTo)
+	if d.LocalURI != nil {
+		req.Headers.Set(message.HeaderReferredBy, fmt.Sprintf("<%s>", d.LocalURI))
+	}
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return nil, err
+	}
+	eventHdr := "refer;id=" + strconv.FormatUint(uint64(cseq.Seq), 10)
+	key := subKey{id: id, event: event.Key(eventHdr)}
+	sub := &subscription{req: req, event: eventHdr, implicit: true}
+	s.subMu.Lock()
+	s.subscriptions[key] = sub
+	s.subMu.Unlock()
+	if err := s.SendInDialog(req); err != nil {
+		s.endSubscription(key, sub)
+		return nil, err
+	}
+	s.logger.Info("REFER sent", zap.String("dialog", id.String()), zap.String("refer-to", referTo))
+	return req, nil
+}
+
+// onReferResponse 在本端 REFER 被拒绝时删除其隐式订阅，响应照常交给 TU。
+func (s *Stack) onReferResponse(req *message.Request, resp *message.Response) {
+	if req.Method != message.MethodREFER || resp.StatusCode < 300 || s.isProxy() {
+		return
+	}
+	s.endReferSubscription(req)
+}
+
+// referTimedOut 在本端 REFER 超时时删除其隐式订阅，TU 照常收到 OnError。
+func (s *Stack) referTimedOut(tx *dialog.Transaction) {
+	if tx.Method != message.MethodREFER || s.isProxy() {
+		return
+	}
+	s.endReferSubscription(tx.Request)
+}
+
+func (s *Stack) endReferSubscription(req *message.Request) {
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return
+	}
+	key := subKey{id: dialogIDOf(req), event: event.Key("refer;id=" + strconv.FormatUint(uint64(cseq.Seq), 10))}
+	s.subMu.Lock()
+	sub := s.subscriptions[key]
+	s.subMu.Unlock()
+	if sub != nil {
+		s.endSubscription(key, sub)
+	}
+}
+
+// ReferStatus 返回 REFER 进度 NOTIFY 中 sipfrag 状态行的状态码，不是 sipfrag 时 ok 为 false。
+func ReferStatus(notify *message.Request) (code int, ok bool) {
+	if event.Name(notify.Headers.Get(message.HeaderEvent)) != "refer" {
+		return 0, false
+	}
+	line, _, _ := strings.Cut(string(notify.Body), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SIP/") {
+		return 0, false
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// ---- 被转移方 ----
+
+// AcceptRefer 以 202 接受对话内的 REFER 并建立隐式订阅，随即发送 "100 Trying" 的 NOTIFY。
+// 不在对话内或 Refer-To 无效时协议栈已回复错误响应，返回错误。
+func (s *Stack) AcceptRefer(req *message.Request, tx *dialog.Transaction) error {
+	id, err := dialog.IDFromRequest(req)
+	if err != nil || id.LocalTag == "" || s.Dialog(id) == nil {
+		s.respondRefer(tx, BuildResponse(req, message.StatusCallDoesNotExist, ""))
+		return fmt.Errorf("REFER outside of a dialog")
+	}
+	if _, err := referTarget(req); err != nil {
+		resp := BuildResponse(req, message.StatusBadRequest, "")
+		resp.Reason = "Invalid Refer-To"
+		s.respondRefer(tx, resp)
+		return err
+	}
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		s.respondRefer(tx, BuildResponse(req, message.StatusBadRequest, ""))
+		return err
+	}
+	eventHdr := "refer;id=" + strconv.FormatUint(uint64(cseq.Seq), 10)
+	key := subKey{id: id, event: event.Key(eventHdr)}
+	r := &referral{}
+	r.set(message.StatusTrying, message.ReasonPhrase(message.StatusTrying))
+	n := &notification{pkg: r, event: eventHdr, expiresAt: s.Clock().Now().Add(referExpires)}
+
+	s.respondRefer(tx, BuildResponse(req, message.StatusAccepted, ""))
+	s.subMu.Lock()
+	if old := s.notifications[key]; old != nil {
+		old.stop()
+	}
+	n.timer = s.Clock().AfterFunc(referExpires, func() { s.expireNotification(key, n) })
+	s.notifications[key] = n
+	s.subMu.Unlock()
+	s.logger.Info("REFER accepted", zap.String("dialog", id.String()),
+		zap.String("refer-to", req.Headers.Get(message.HeaderReferTo)))
+	s.sendNotify(key, n, nil)
+	return nil
+}
+
+func (s *Stack) respondRefer(tx *dialog.Transaction, resp *message.Response) {
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Warn("send REFER response", zap.Int("code", resp.StatusCode), zap.Error(err))
+	}
+}
+
+// referTarget 解析 REFER 的 Refer-To，只接受 SIP URI。
+func referTarget(req *message.Request) (*message.URI, error) {
+	v := req.Headers.Get(message.HeaderReferTo)
+	if v == "" {
+		return nil, fmt.Errorf("REFER without Refer-To")
+	}
+	addr, err := message.ParseAddress(v)
+	if err != nil || addr.URI == nil {
+		return nil, fmt.Errorf("invalid Refer-To %q: %v", v, err)
+	}
+	return addr.URI, nil
+}
+
+// BuildReferredInvite 按已接受的 REFER 构造发往 Refer-To 的 INVITE（From 为本端在原对话中的 URI）。
+// Refer-To 中的 Replaces 头部放入 INVITE 的 Replaces 头域，REFER 的 Referred-By 原样带上；
+// 该 INVITE 的响应由协议栈以 NOTIFY 报告给转移方。
+func (s *Stack) BuildReferredInvite(refer *message.Request) (*message.Request, error) {
+	target, err := referTarget(refer)
+	if err != nil {
+		return nil, err
+	}
+	id, err := dialog.IDFromRequest(refer)
+	if err != nil {
+		return nil, err
+	}
+	d := s.Dialog(id)
+	if d == nil || d.LocalURI == nil {
+		return nil, fmt.Errorf("dialog %s not found", id)
+	}
+	cseq, err := message.ParseCSeq(refer.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return nil, err
+	}
+	replaces, hasReplaces := target.Header(message.HeaderReplaces)
+	uri := target.Clone()
+	uri.Headers = nil
+
+	req, err := s.BuildInviteRequest(d.LocalURI.String(), uri.String())
+	if err != nil {
+		return nil, err
+	}
+	if hasReplaces {
+		if _, err := message.ParseReplaces(replaces); err != nil {
+			return nil, err
+		}
+		req.Headers.Set(message.HeaderReplaces, replaces)
+	}
+	if by := refer.Headers.Get(message.HeaderReferredBy); by != "" {
+		req.Headers.Set(message.HeaderReferredBy, by)
+	}
+	key := subKey{id: id, event: event.Key("refer;id=" + strconv.FormatUint(uint64(cseq.Seq), 10))}
+	s.subMu.Lock()
+	s.referrals[req.Headers.Get(message.HeaderCallID)] = key
+	s.subMu.Unlock()
+	return req, nil
+}
+
+// onReferredInviteResponse 以 NOTIFY 向转移方报告转移 INVITE 的响应，最终响应后结束隐式订阅。
+func (s *Stack) onReferredInviteResponse(req *message.Request, resp *message.Response) {
+	if req.Method != message.MethodINVITE || resp.StatusCode == message.StatusTrying {
+		return
+	}
+	s.reportReferral(req, resp.StatusCode, resp.Reason)
+}
+
+// referredInviteTimedOut 在转移 INVITE 超时时以 408 报告给转移方，TU 照常收到 OnError。
+func (s *Stack) referredInviteTimedOut(tx *dialog.Transaction) {
+	if tx.Method != message.MethodINVITE {
+		return
+	}
+	s.reportReferral(tx.Request, message.StatusRequestTimeout, message.ReasonPhrase(message.StatusRequestTimeout))
+}
+
+func (s *Stack) reportReferral(invite *message.Request, code int, reason string) {
+	callID := invite.Headers.Get(message.HeaderCallID)
+	final := code >= 200
+	s.subMu.Lock()
+	key, ok := s.referrals[callID]
+	var n *notification
+	if ok {
+		n = s.notifications[key]
+		if final || n == nil {
+			delete(s.referrals, callID)
+		}
+		if final && n != nil {
+			n.stop()
+			delete(s.notifications, key)
+		}
+	}
+	s.subMu.Unlock()
+	if n == nil {
+		return
+	}
+	r, ok := n.pkg.(*referral)
+	if !ok {
+		return
+	}
+	r.set(code, reason)
+	if !final {
+		s.sendNotify(key, n, nil)
+		return
+	}
+	s.logger.Info("referral finished", zap.String("dialog", key.id.String()), zap.Int("code", code))
+	s.sendNotify(key, n, &event.SubscriptionState{State: event.StateTerminated, Reason: event.ReasonNoResource, Expires: -1, RetryAfter: -1})
+}
+
+// ---- 转移目标 ----
+
+// FindDialog 按 Call-ID 与本端 / 对端 tag 查找对话。
+func (s *Stack) FindDialog(callID, localTag, remoteTag string) *dialog.Dialog {
+	return s.Dialog(dialog.DialogID{CallID: callID, LocalTag: localTag, RemoteTag: remoteTag})
+}
+
+// ReplacedDialog 返回带 Replaces 的 INVITE 要替换的本端对话，没有 Replaces 或找不到时为 nil。
+func (s *Stack) ReplacedDialog(invite *message.Request) *dialog.Dialog {
+	v := invite.Headers.Get(message.HeaderReplaces)
+	if v == "" {
+		return nil
+	}
+	rep, err := message.ParseReplaces(v)
+	if err != nil {
+		return nil
+	}
+	return s.FindDialog(rep.CallID, rep.ToTag, rep.FromTag)
+}
+
+// checkReplaces 校验对话外 INVITE 的 Replaces（RFC 3891 §3），返回 false 时已回复错误响应；
+// 通过时记录被替换的对话，待该 INVITE 的 2xx 发出后结束。
+func (s *Stack) checkReplaces(req *message.Request, tx *dialog.Transaction) bool {
+	v := req.Headers.Get(message.HeaderReplaces)
+	if req.Method != message.MethodINVITE || v == "" {
+		return true
+	}
+	if id, err := dialog.IDFromRequest(req); err != nil || id.LocalTag != "" {
+		return true // re-INVITE 中的 Replaces 没有意义，忽略
+	}
+	reject := func(code int, reason string) bool {
+		resp := BuildResponse(req, code, "")
+		if reason != "" {
+			resp.Reason = reason
+		}
+		if err := tx.Respond(resp); err != nil {
+			s.logger.Warn("send INVITE response", zap.Int("code", code), zap.Error(err))
+		}
+		s.logger.Info("rejected INVITE with Replaces", zap.String("replaces", v), zap.Int("code", code))
+		return false
+	}
+	rep, err := message.ParseReplaces(v)
+	if err != nil {
+		return reject(message.StatusBadRequest, "Invalid Replaces")
+	}
+	d := s.FindDialog(rep.CallID, rep.ToTag, rep.FromTag)
+	if d == nil {
+		return reject(message.StatusCallDoesNotExist, "")
+	}
+	if rep.EarlyOnly && d.GetState() != dialog.DialogStateEarly {
+		return reject(message.StatusBusyHere, "")
+	}
+	s.dialogMu.Lock()
+	s.replacing[tx.ID] = d.ID
+	s.dialogMu.Unlock()
+	return true
+}
+
+// onReplacingResponse 在带 Replaces 的 INVITE 得到最终响应时处理被替换的对话：2xx 时结束它。
+func (s *Stack) onReplacingResponse(tx *dialog.Transaction, resp *message.Response) {
+	if tx.Method != message.MethodINVITE || resp.StatusCode < 200 {
+		return
+	}
+	s.dialogMu.Lock()
+	id, ok := s.replacing[tx.ID]
+	delete(s.replacing, tx.ID)
+	s.dialogMu.Unlock()
+	if !ok || resp.StatusCode >= 300 {
+		return
+	}
+	d := s.Dialog(id)
+	if d == nil {
+		return
+	}
+	if d.GetState() != dialog.DialogStateEarly {
+		s.endSession(id, "replaced")
+		return
+	}
+	// 本端仍在振铃的早期对话：以 487 结束原 INVITE，早期对话随之删除
+	if invite := s.pendingInvite(id); invite != nil {
+		s.logger.Info("early dialog replaced", zap.String("dialog", id.String()))
+		if err := invite.Respond(BuildResponse(invite.Request, message.StatusRequestTerminated, id.LocalTag)); err != nil {
+			s.logger.Warn("send 487", zap.Error(err))
+		}
+	}
+}
+
+// pendingInvite 返回早期对话 id 中尚未最终响应的 INVITE 服务端事务（本端为 UAS）。
+func (s *Stack) pendingInvite(id dialog.DialogID) *dialog.Transaction {
+	s.stxMu.Lock()
+	defer s.stxMu.Unlock()
+	for _, tx := range s.inviteTxs {
+		if dialogIDOf(tx.Request).CallID != id.CallID {
+			continue
+		}
+		from, err := message.ParseAddress(tx.Request.Headers.Get(message.HeaderFrom))
+		if err == nil && from.Tag == id.RemoteTag && tx.GetState() == dialog.TxStateProceeding {
+			return tx
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// phone 是回环测试中的一个用户代理：接听 INVITE、应答 BYE、接受 REFER 并呼叫转移目标，
+// 收到 INVITE 的 2xx 后发送 ACK。
+type phone struct {
+	s    *Stack
+	h    *testHandler
+	addr string
+	uri  string
+	// replaced 记录带 Replaces 的 INVITE 在应答前找到的被替换对话
+	replaced chan *dialog.Dialog
+}
+
+func newPhone(t *testing.T, user string) *phone {
+	t.Helper()
+	p := &phone{h: newTestHandler(), replaced: make(chan *dialog.Dialog, 4)}
+	p.h.onRequest = p.onRequest
+	p.h.onResponse = p.onResponse
+	p.s = newTestStack(t, p.h)
+	p.addr = p.s.transports[transport.NetworkUDP].LocalAddr().String()
+	p.uri = "sip:" + user + "@" + p.addr
+	return p
+}
+
+func (p *phone) onRequest(req *message.Request, tx *dialog.Transaction) {
+	switch req.Method {
+	case message.MethodINVITE:
+		if req.Headers.Exists(message.HeaderReplaces) {
+			p.replaced <- p.s.ReplacedDialog(req)
+		}
+		resp := BuildResponse(req, message.StatusOK, NewTag())
+		resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", p.s.ContactURI("sip")))
+		tx.Respond(resp)
+	case message.MethodBYE:
+		tx.Respond(BuildResponse(req, message.StatusOK, ""))
+	case message.MethodREFER:
+		if err := p.s.AcceptRefer(req, tx); err != nil {
+			return
+		}
+		invite, err := p.s.BuildReferredInvite(req)
+		if err != nil {
+			return
+		}
+		p.s.SendRequest(invite, TargetAddr(invite.RequestURI))
+	}
+}
+
+func (p *phone) onResponse(resp *message.Response, req *message.Request) {
+	if req == nil || req.Method != message.MethodINVITE || resp.StatusCode/100 != 2 {
+		return
+	}
+	if d := p.s.ResponseDialog(resp); d != nil {
+		p.s.SendInDialog(d.NewRequest(message.MethodACK))
+	}
+}
+
+// call 由 from 呼叫 to，等到 to 收到 ACK 后返回 from 一侧已确认的对话。
+func call(t *testing.T, from, to *phone) *dialog.Dialog {
+	t.Helper()
+	req, err := from.s.BuildInviteRequest(from.uri, to.uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.s.SendRequest(req, to.addr); err != nil {
+		t.Fatal(err)
+	}
+	resp := from.h.nextResponse(t, message.MethodINVITE)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", resp.StatusCode)
+	}
+	to.h.nextRequest(t, message.MethodACK)
+	d := from.s.ResponseDialog(resp)
+	if d == nil {
+		t.Fatal("no dialog for the 200 OK")
+	}
+	return d
+}
+
+// referProgress 收集转移方收到的 NOTIFY 中的 sipfrag 状态码，直到最终状态；
+// 最后一个 NOTIFY 必须结束隐式订阅。
+func referProgress(t *testing.T, p *phone) []int {
+	t.Helper()
+	var codes []int
+	for {
+		notify := p.h.nextRequest(t, message.MethodNOTIFY)
+		code, ok := ReferStatus(notify)
+		if !ok {
+			t.Fatalf("NOTIFY without sipfrag: Event %q, body %q", notify.Headers.Get(message.HeaderEvent), notify.Body)
+		}
+		codes = append(codes, code)
+		if code >= 200 {
+			if state := notify.Headers.Get(message.HeaderSubscriptionState); !strings.HasPrefix(state, "terminated") {
+				t.Fatalf("final NOTIFY Subscription-State = %q", state)
+			}
+			return codes
+		}
+	}
+}
+
+// eventually 轮询 cond 直到为真或超时。
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (p *phone) subscriptionCount() int {
+	p.s.subMu.Lock()
+	defer p.s.subMu.Unlock()
+	return len(p.s.subscriptions)
+}
+
+func refer(t *testing.T, p *phone, id dialog.DialogID, referTo string) {
+	t.Helper()
+	if _, err := p.s.Refer(id, referTo); err != nil {
+		t.Fatal(err)
+	}
+	if resp := p.h.nextResponse(t, message.MethodREFER); resp.StatusCode != message.StatusAccepted {
+		t.Fatalf("REFER answered with %d", resp.StatusCode)
+	}
+}
+
+func TestBlindTransfer(t *testing.T) {
+	alice, bob, carol := newPhone(t, "alice"), newPhone(t, "bob"), newPhone(t, "carol")
+	ab := call(t, alice, bob)
+
+	refer(t, alice, ab.ID, carol.uri)
+	invite := carol.h.nextRequest(t, message.MethodINVITE)
+	if invite.Headers.Exists(message.HeaderReplaces) {
+		t.Fatalf("blind transfer INVITE carries Replaces %q", invite.Headers.Get(message.HeaderReplaces))
+	}
+	if by := invite.Headers.Get(message.HeaderReferredBy); !strings.Contains(by, alice.uri) {
+		t.Fatalf("Referred-By = %q, want %s", by, alice.uri)
+	}
+	if from, err := message.ParseAddress(invite.Headers.Get(message.HeaderFrom)); err != nil || from.URI.User != "bob" {
+		t.Fatalf("referred INVITE From = %q", invite.Headers.Get(message.HeaderFrom))
+	}
+	carol.h.nextRequest(t, message.MethodACK)
+
+	if codes := referProgress(t, alice); codes[0] != message.StatusTrying || codes[len(codes)-1] != message.StatusOK {
+		t.Fatalf("REFER progress = %v, want 100 ... 200", codes)
+	}
+	eventually(t, "implicit subscription to end", func() bool { return alice.subscriptionCount() == 0 })
+}
+
+func TestAttendedTransfer(t *testing.T) {
+	alice, bob, carol := newPhone(t, "alice"), newPhone(t, "bob"), newPhone(t, "carol")
+	ab := call(t, alice, bob)
+	consult := call(t, alice, carol)
+	// carol 一侧的咨询通话，tag 与 alice 一侧相反
+	carolSide := dialog.DialogID{CallID: consult.ID.CallID, LocalTag: consult.ID.RemoteTag, RemoteTag: consult.ID.LocalTag}
+	if carol.s.Dialog(carolSide) == nil {
+		t.Fatal("carol has no consultation dialog")
+	}
+
+	refer(t, alice, ab.ID, AttendedReferTo(consult.RemoteTarget, consult))
+	invite := carol.h.nextRequest(t, message.MethodINVITE)
+	rep, err := message.ParseReplaces(invite.Headers.Get(message.HeaderReplaces))
+	if err != nil {
+		t.Fatalf("referred INVITE Replaces %q: %v", invite.Headers.Get(message.HeaderReplaces), err)
+	}
+	if rep.CallID != consult.ID.CallID || rep.ToTag != carolSide.LocalTag || rep.FromTag != carolSide.RemoteTag {
+		t.Fatalf("Replaces = %+v, want the consultation dialog %s", rep, carolSide)
+	}
+	select {
+	case d := <-carol.replaced:
+		if d == nil || d.ID != carolSide {
+			t.Fatalf("ReplacedDialog = %v, want %s", d, carolSide)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("carol did not see the Replaces INVITE")
+	}
+	carol.h.nextRequest(t, message.MethodACK)
+
+	// carol 接受替换后挂断咨询通话；BYE 与进度 NOTIFY 的先后不确定，一并收取
+	var codes []int
+	var bye *message.Request
+	for bye == nil || len(codes) == 0 || codes[len(codes)-1] < 200 {
+		select {
+		case req := <-alice.h.requests:
+			switch req.Method {
+			case message.MethodBYE:
+				bye = req
+			case message.MethodNOTIFY:
+				code, ok := ReferStatus(req)
+				if !ok {
+					t.Fatalf("NOTIFY without sipfrag: body %q", req.Body)
+				}
+				codes = append(codes, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out: BYE %v, REFER progress %v", bye != nil, codes)
+		}
+	}
+	if got := bye.Headers.Get(message.HeaderCallID); got != consult.ID.CallID {
+		t.Fatalf("alice received BYE for %s, want the consultation call %s", got, consult.ID.CallID)
+	}
+	if codes[0] != message.StatusTrying || codes[len(codes)-1] != message.StatusOK {
+		t.Fatalf("REFER progress = %v, want 100 ... 200", codes)
+	}
+	eventually(t, "replaced dialog to be removed", func() bool { return carol.s.Dialog(carolSide) == nil })
+	eventually(t, "consultation dialog to end at alice", func() bool { return alice.s.Dialog(consult.ID) == nil })
+}
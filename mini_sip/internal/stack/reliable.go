@@ -0,0 +1,129 @@
+package stack
+
+import (
+	"strconv"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// 可靠临时响应（RFC 3262，100rel）：
+//
+//   - UAC：INVITE 携带 Supported: 100rel；收到可靠 1xx 时协议栈按 RSeq 过滤重传与乱序，
+//     并在早期对话内发送 PRACK（RAck 为 RSeq、INVITE 的 CSeq 与方法），PRACK 的响应不交给 TU
+//   - UAS：INVITE 的 Supported / Require 含 100rel 时，TU 发出的 1xx（100 除外）由协议栈补上
+//     Require: 100rel，服务端事务负责 RSeq、重传与排队（见 dialog/reliable.go）
+//   - 收到的 PRACK 按 RAck 匹配 INVITE 服务端事务：匹配成功回 200，否则回 481；PRACK 不交给 TU
+//   - 可靠 1xx 在 64*T1 内等不到 PRACK 时以 500 拒绝 INVITE，并通过 Handler.OnError 通知 TU
+//
+// 代理模式下 100rel 由两端 UA 协商，协议栈不做处理。
+
+// SupportsReliable 判断 INVITE 是否声明支持（Supported）或要求（Require）可靠临时响应。
+// TU 据此决定是否通过 183 提供早期媒体。
+func SupportsReliable(req *message.Request) bool {
+	return req.Headers.HasToken(message.HeaderSupported, "100rel") ||
+		req.Headers.HasToken(message.HeaderRequire, "100rel")
+}
+
+// requireReliable 为对端支持 100rel 的 INVITE 的 1xx 补上 Require: 100rel。
+func (s *Stack) requireReliable(tx *dialog.Transaction, resp *message.Response) {
+	if tx.Method != message.MethodINVITE || resp.StatusCode <= 100 || resp.StatusCode >= 200 ||
+		!SupportsReliable(tx.Request) {
+		return
+	}
+	resp.Headers.AddToken(message.HeaderRequire, "100rel")
+}
+
+// handlePrack 按 RFC 3262 §3 处理收到的 PRACK。
+func (s *Stack) handlePrack(req *message.Request, tx *dialog.Transaction) {
+	var invite *dialog.Transaction
+	rack, err := message.ParseRAck(req.Headers.Get(message.HeaderRAck))
+	if err == nil {
+		key := req.Headers.Get(message.HeaderCallID) + " " + strconv.FormatUint(uint64(rack.Seq), 10)
+		s.stxMu.Lock()
+		invite = s.inviteTxs[key]
+		s.stxMu.Unlock()
+	}
+	if invite == nil || !invite.Prack(rack) {
+		if err := tx.Respond(BuildResponse(req, message.StatusCallDoesNotExist, "")); err != nil {
+			s.logger.Warn("send 481 for PRACK", zap.Error(err))
+		}
+		s.logger.Info("PRACK matches no reliable provisional response",
+			zap.String("rack", req.Headers.Get(message.HeaderRAck)))
+		return
+	}
+	if err := tx.Respond(BuildResponse(req, message.StatusOK, "")); err != nil {
+		s.logger.Warn("send 200 for PRACK", zap.Error(err))
+	}
+}
+
+// rejectUnacknowledged 在可靠 1xx 等不到 PRACK 时以 500 拒绝 INVITE（RFC 3262 §3）。
+func (s *Stack) rejectUnacknowledged(tx *dialog.Transaction) {
+	resp := BuildResponse(tx.Request, message.StatusServerError, responseTag(tx))
+	resp.Reason = "Reliable Provisional Response Not Acknowledged"
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Info("INVITE already answered, 500 not sent", zap.Error(err))
+	}
+}
+
+// responseTag 返回服务端事务已发出响应的 To tag，尚未响应时为空。
+func responseTag(tx *dialog.Transaction) string {
+	last := tx.LastResponse()
+	if last == nil {
+		return ""
+	}
+	to, err := message.ParseAddress(last.Headers.Get(message.HeaderTo))
+	if err != nil {
+		return ""
+	}
+	return to.Tag
+}
+
+// acknowledgeReliable 为本端 INVITE 收到的可靠 1xx 发送 PRACK（RFC 3262 §4），
+// 返回 false 表示响应是重传或乱序，应丢弃而不交给 TU。
+func (s *Stack) acknowledgeReliable(req *message.Request, resp *message.Response) bool {
+	if req.Method != message.MethodINVITE || s.isProxy() ||
+		len(resp.Headers.GetAll(message.HeaderVia)) != 1 || !dialog.IsReliableProvisional(resp) {
+		return true
+	}
+	rseq, ok := dialog.ParseRSeq(resp)
+	if !ok {
+		s.logger.Warn("reliable provisional response without valid RSeq", zap.Int("code", resp.StatusCode))
+		return true
+	}
+	d := s.ResponseDialog(resp)
+	if d == nil {
+		return true
+	}
+	if !d.AcceptRSeq(rseq) {
+		s.logger.Debug("reliable provisional response retransmitted or out of order, dropped",
+			zap.Int("code", resp.StatusCode), zap.Uint32("rseq", rseq))
+		return false
+	}
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return true
+	}
+	prack := d.NewRequest(message.MethodPRACK)
+	prack.Headers.Set(message.HeaderRAck, (&message.RAck{RSeq: rseq, Seq: cseq.Seq, Method: cseq.Method}).String())
+	if err := s.SendInDialog(prack); err != nil {
+		s.logger.Warn("send PRACK", zap.Error(err))
+		return true
+	}
+	s.logger.Info("PRACK sent", zap.Int("code", resp.StatusCode), zap.Uint32("rseq", rseq))
+	return true
+}
+
+// onPrackResponse 记录协议栈发出的 PRACK 收到的最终响应，返回 true 表示响应已被消费。
+func (s *Stack) onPrackResponse(req *message.Request, resp *message.Response) bool {
+	if req.Method != message.MethodPRACK || s.isProxy() {
+		return false
+	}
+	if code := resp.StatusCode; code >= 300 {
+		s.logger.Warn("PRACK rejected", zap.Int("code", code), zap.String("reason", resp.Reason))
+	} else if code >= 200 {
+		s.logger.Info("PRACK acknowledged", zap.Int("code", code))
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package stack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+func TestReliableProvisionalThenAnswer(t *testing.T) {
+	const sdp = "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n"
+	// acked 收到 ACK 时匹配到的 INVITE 服务端事务，匹配失败为 nil
+	acked := make(chan *dialog.Transaction, 1)
+	// 回调在协议栈启动之前设置，其中用到的 alice / bob 在收到消息之前已赋值
+	var alice, bob *Stack
+	bobH := newTestHandler()
+	bobH.onRequest = func(req *message.Request, tx *dialog.Transaction) {
+		switch req.Method {
+		case message.MethodINVITE:
+			tag := NewTag()
+			contact := fmt.Sprintf("<%s>", bob.ContactURI("sip"))
+			early := BuildResponse(req, message.StatusSessionProgress, tag)
+			early.Headers.Set(message.HeaderContact, contact)
+			early.Headers.Set(message.HeaderContentType, "application/sdp")
+			early.Body = []byte(sdp)
+			tx.Respond(early)
+			// 带 SDP 的可靠 183 未被确认，200 推迟到 PRACK 之后发送
+			ok := BuildResponse(req, message.StatusOK, tag)
+			ok.Headers.Set(message.HeaderContact, contact)
+			tx.Respond(ok)
+		case message.MethodACK:
+			acked <- tx
+		}
+	}
+
+	aliceH := newTestHandler()
+	aliceH.onResponse = func(resp *message.Response, req *message.Request) {
+		if req == nil || req.Method != message.MethodINVITE || resp.StatusCode/100 != 2 {
+			return
+		}
+		if d := alice.ResponseDialog(resp); d != nil {
+			alice.SendInDialog(d.NewRequest(message.MethodACK))
+		}
+	}
+
+	bob = newTestStack(t, bobH)
+	alice = newTestStack(t, aliceH)
+
+	bobAddr := bob.transports[transport.NetworkUDP].LocalAddr().String()
+	invite, err := alice.BuildInviteRequest("sip:alice@"+alice.LocalAddr(), "sip:bob@"+bobAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendRequest(invite, bobAddr); err != nil {
+		t.Fatal(err)
+	}
+	resp := aliceH.nextResponse(t, message.MethodINVITE)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", resp.StatusCode)
+	}
+
+	// PRACK 推进了本地 CSeq，ACK 仍须沿用 INVITE 的 CSeq 才能匹配到服务端事务
+	ack := bobH.nextRequest(t, message.MethodACK)
+	want, _ := message.ParseCSeq(invite.Headers.Get(message.HeaderCSeq))
+	got, err := message.ParseCSeq(ack.Headers.Get(message.HeaderCSeq))
+	if err != nil || got.Seq != want.Seq {
+		t.Fatalf("ACK CSeq = %q, want %d ACK", ack.Headers.Get(message.HeaderCSeq), want.Seq)
+	}
+	select {
+	case tx := <-acked:
+		if tx == nil {
+			t.Fatal("ACK matched no INVITE server transaction")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ACK not delivered")
+	}
+
+	// 之后的对话内请求继续在 PRACK 之后递增
+	d := alice.ResponseDialog(resp)
+	bye := d.NewRequest(message.MethodBYE)
+	if cseq, _ := message.ParseCSeq(bye.Headers.Get(message.HeaderCSeq)); cseq.Seq != want.Seq+2 {
+		t.Fatalf("BYE CSeq = %d, want %d", cseq.Seq, want.Seq+2)
+	}
+}
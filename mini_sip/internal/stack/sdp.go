@@ -0,0 +1,71 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+)
+
+// setSDP 设置 Content-Type 并返回序列化后的消息体（Content-Length 在序列化消息时计算）。
+func setSDP(h *message.Headers, sess *sdp.Session) []byte {
+	h.Set(message.HeaderContentType, sdp.ContentType)
+	return sess.Marshal()
+}
+
+// ParseSDP 解析消息体中的 SDP，没有消息体时返回 nil, nil。
+func ParseSDP(h *message.Headers, body []byte) (*sdp.Session, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	ct, _, _ := strings.Cut(h.Get(message.HeaderContentType), ";")
+	if !strings.EqualFold(strings.TrimSpace(ct), sdp.ContentType) {
+		return nil, fmt.Errorf("%w: unsupported content type %q", sdp.ErrInvalid, ct)
+	}
+	return sdp.Parse(body)
+}
+
+// AnswerInvite 为 INVITE 的 2xx 响应完成 UAS 侧的 offer/answer（RFC 3261 §13.2.1）：
+//   - INVITE 带 offer：生成 answer 放入 resp，返回协商结果
+//   - INVITE 不带 SDP：在 resp 中放入 offer，answer 将由 ACK 携带，返回 nil
+//
+// 未配置 WithMedia 时不做任何处理。返回错误时调用方应回复 488 Not Acceptable Here。
+func (s *Stack) AnswerInvite(req *message.Request, resp *message.Response) ([]sdp.Stream, error) {
+	if s.media == nil {
+		return nil, nil
+	}
+	offer, err := ParseSDP(req.Headers, req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if offer == nil {
+		resp.Body = setSDP(resp.Headers, sdp.NewOffer(*s.media))
+		return nil, nil
+	}
+	answer, err := sdp.Answer(offer, *s.media)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := sdp.Negotiate(answer, offer)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = setSDP(resp.Headers, answer)
+	return streams, nil
+}
+
+// ProcessAnswer 在 UAC 侧用 2xx 中的 answer 完成协商，req 为携带 offer 的 INVITE。
+//
+// INVITE 或响应不带 SDP 时返回 nil, nil。
+func (s *Stack) ProcessAnswer(req *message.Request, resp *message.Response) ([]sdp.Stream, error) {
+	offer, err := ParseSDP(req.Headers, req.Body)
+	if err != nil || offer == nil {
+		return nil, err
+	}
+	answer, err := ParseSDP(resp.Headers, resp.Body)
+	if err != nil || answer == nil {
+		return nil, err
+	}
+	return sdp.Negotiate(offer, answer)
+}
@@ -0,0 +1,394 @@
+package stack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
+	"go.uber.org/zap"
+)
+
+// 会话计时器（RFC 4028），由 WithSessionTimer 启用：
+//
+//   - UAC：INVITE 携带 Supported: timer、Session-Expires 与 Min-SE；
+//     收到 422 时按响应的 Min-SE 加大会话间隔自动重发，422 本身不上交
+//   - UAS：Session-Expires 小于本端 Min-SE 的 INVITE / UPDATE 回 422；
+//     TU 发出的 2xx 由协议栈补上协商后的 Session-Expires（含 refresher）
+//   - INVITE / UPDATE 的 2xx 确定会话间隔与刷新方，刷新方每半个间隔发送一次刷新：
+//     对端 Allow 含 UPDATE 时用 UPDATE，否则用 re-INVITE；刷新的响应由协议栈处理，不交给 TU
+//   - 会话到期前 min(32s, 间隔/3) 仍未刷新，或刷新收到 408 / 481 / 超时，
+//     协议栈发送 BYE 并终止对话，BYE 的响应照常交给 TU
+//   - 收到不带消息体的 UPDATE（纯会话刷新）由协议栈直接以 200 应答
+//
+// 代理模式下不处理会话计时器。
+
+const (
+	// DefaultSessionExpires 是推荐的会话间隔，单位秒（RFC 4028 §4）。
+	DefaultSessionExpires = 1800
+	// MinSessionExpires 是 Min-SE 的下限，单位秒（RFC 4028 §4）。
+	MinSessionExpires = 90
+
+	refresherUAC = "uac"
+	refresherUAS = "uas"
+)
+
+// sessionTimer 是一个对话的会话计时器。
+type sessionTimer struct {
+	interval  int  // 会话间隔（秒）
+	refresher bool // 本端负责刷新
+	useUpdate bool // 对端支持 UPDATE，刷新时优先使用
+	refresh   dialog.Timer
+	expire    dialog.Timer
+}
+
+func (t *sessionTimer) stop() {
+	if t.refresh != nil {
+		t.refresh.Stop()
+	}
+	if t.expire != nil {
+		t.expire.Stop()
+	}
+}
+
+// parseSessionExpires 解析 Session-Expires: delta-seconds [;refresher=uac|uas]，没有该头域或格式错误时 ok 为 false。
+func parseSessionExpires(h *message.Headers) (interval int, refresher string, ok bool) {
+	v := h.Get(message.HeaderSessionExpires)
+	if v == "" {
+		return 0, "", false
+	}
+	parts := strings.Split(v, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n <= 0 {
+		return 0, "", false
+	}
+	for _, p := range parts[1:] {
+		k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(strings.TrimSpace(k), "refresher") {
+			refresher = strings.ToLower(strings.TrimSpace(val))
+		}
+	}
+	return n, refresher, true
+}
+
+// parseMinSE 返回 Min-SE 的值，没有或格式错误时为 0。
+func parseMinSE(h *message.Headers) int {
+	v, _, _ := strings.Cut(h.Get(message.HeaderMinSE), ";")
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// setSessionExpires 在请求中声明会话计时器，refresher 为空时由 UAS 选择刷新方。
+func (s *Stack) setSessionExpires(req *message.Request, interval int, refresher string) {
+	se := strconv.Itoa(interval)
+	if refresher != "" {
+		se += ";refresher=" + refresher
+	}
+	req.Headers.AddToken(message.HeaderSupported, "timer")
+	req.Headers.Set(message.HeaderSessionExpires, se)
+	req.Headers.Set(message.HeaderMinSE, strconv.Itoa(s.minSE))
+}
+
+// checkSessionInterval 校验收到的 INVITE / UPDATE 的会话间隔，过小时回 422 并返回 false（RFC 4028 §8.1）。
+func (s *Stack) checkSessionInterval(req *message.Request, tx *dialog.Transaction) bool {
+	if s.sessionExpires == 0 || s.isProxy() ||
+		(req.Method != message.MethodINVITE && req.Method != message.MethodUPDATE) {
+		return true
+	}
+	interval, _, ok := parseSessionExpires(req.Headers)
+	if !ok || interval >= s.minSE {
+		return true
+	}
+	resp := BuildResponse(req, message.StatusIntervalTooSmall, "")
+	resp.Headers.Set(message.HeaderMinSE, strconv.Itoa(s.minSE))
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Warn("send 422", zap.Error(err))
+	}
+	s.logger.Info("session interval too small",
+		zap.String("method", string(req.Method)), zap.Int("interval", interval), zap.Int("minSE", s.minSE))
+	return false
+}
+
+// prepareSessionExpires 为 INVITE / UPDATE 的 2xx 补上协商后的
+// Session-Expires（RFC 4028 §9）。TU 已自行设置 Session-Expires 时不做修改。
+//
+//   - 会话间隔取请求的 Session-Expires，超过本端配置时缩短到本端配置，但不低于请求的 Min-SE
+//   - 请求指定了 refresher 时沿用，否则 UAC 支持 timer 时由 UAC 刷新，不支持时只能由 UAS 刷新
+//   - UAC 支持 timer 时响应携带 Require: timer
+func (s *Stack) prepareSessionExpires(tx *dialog.Transaction, resp *message.Response) {
+	if s.sessionExpires == 0 ||
+		(tx.Method != message.MethodINVITE && tx.Method != message.MethodUPDATE) ||
+		resp.StatusCode < 200 || resp.StatusCode >= 300 || resp.Headers.Exists(message.HeaderSessionExpires) {
+		return
+	}
+	req := tx.Request
+	interval, refresher, ok := parseSessionExpires(req.Headers)
+	if !ok || interval > s.sessionExpires {
+		interval = max(s.sessionExpires, parseMinSE(req.Headers))
+	}
+	supported := req.Headers.HasToken(message.HeaderSupported, "timer")
+	if !supported {
+		refresher = refresherUAS
+	} else if refresher != refresherUAC && refresher != refresherUAS {
+		refresher = refresherUAC
+	}
+	resp.Headers.Set(message.HeaderSessionExpires, fmt.Sprintf("%d;refresher=%s", interval, refresher))
+	if supported {
+		resp.Headers.AddToken(message.HeaderRequire, "timer")
+	}
+}
+
+// startSessionTimer 按 INVITE / UPDATE 的 2xx 启动或重置对话 id 的会话计时器，
+// uac 表示本端是该事务的 UAC。2xx 不带 Session-Expires 时关闭计时器。
+func (s *Stack) startSessionTimer(id dialog.DialogID, req *message.Request, resp *message.Response, uac bool) {
+	interval, refresher, ok := parseSessionExpires(resp.Headers)
+	// 对端的 Allow：UAC 视角在 2xx 中，UAS 视角在请求中
+	peer := req.Headers
+	if uac {
+		peer = resp.Headers
+	}
+
+	s.dialogMu.Lock()
+	defer s.dialogMu.Unlock()
+	old := s.sessions[id]
+	if old != nil {
+		old.stop()
+		delete(s.sessions, id)
+	}
+	if !ok || s.dialogs[id] == nil {
+		return
+	}
+	if refresher != refresherUAC {
+		refresher = refresherUAS
+	}
+	t := &sessionTimer{
+		interval:  interval,
+		refresher: (refresher == refresherUAC) == uac,
+		useUpdate: peer.HasToken(message.HeaderAllow, string(message.MethodUPDATE)),
+	}
+	if !peer.Exists(message.HeaderAllow) && old != nil {
+		t.useUpdate = old.useUpdate
+	}
+	clock := s.Clock()
+	d := time.Duration(interval) * time.Second
+	if t.refresher {
+		t.refresh = clock.AfterFunc(d/2, func() { s.refreshSession(id, t) })
+	}
+	t.expire = clock.AfterFunc(d-min(32*time.Second, d/3), func() { s.expireSession(id, t) })
+	s.sessions[id] = t
+	s.logger.Info("session timer started",
+		zap.String("dialog", id.String()), zap.Int("interval", interval), zap.Bool("refresher", t.refresher))
+}
+
+// onClientSessionResponse 按本端发出的 INVITE / UPDATE 收到的 2xx 维护会话计时器。
+func (s *Stack) onClientSessionResponse(req *message.Request, resp *message.Response) {
+	if s.sessionExpires == 0 || s.isProxy() || len(resp.Headers.GetAll(message.HeaderVia)) != 1 ||
+		(req.Method != message.MethodINVITE && req.Method != message.MethodUPDATE) ||
+		resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return
+	}
+	if id, err := dialog.IDFromResponse(resp); err == nil {
+		s.startSessionTimer(id, req, resp, true)
+	}
+}
+
+// onServerSessionResponse 按本端发出的 INVITE / UPDATE 的 2xx 维护会话计时器。
+func (s *Stack) onServerSessionResponse(tx *dialog.Transaction, resp *message.Response) {
+	if s.sessionExpires == 0 ||
+		(tx.Method != message.MethodINVITE && tx.Method != message.MethodUPDATE) ||
+		resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return
+	}
+	id, err := dialog.IDFromRequest(tx.Request)
+	if err != nil {
+		return
+	}
+	if id.LocalTag == "" {
+		to, err := message.ParseAddress(resp.Headers.Get(message.HeaderTo))
+		if err != nil {
+			return
+		}
+		id.LocalTag = to.Tag
+	}
+	s.startSessionTimer(id, tx.Request, resp, false)
+}
+
+// refreshSession 由刷新方在半个会话间隔后发送会话刷新（RFC 4028 §10）。
+func (s *Stack) refreshSession(id dialog.DialogID, t *sessionTimer) {
+	s.dialogMu.Lock()
+	d := s.dialogs[id]
+	current := s.sessions[id] == t
+	s.dialogMu.Unlock()
+	if d == nil || !current {
+		return
+	}
+
+	method := message.MethodINVITE
+	if t.useUpdate {
+		method = message.MethodUPDATE
+	}
+	req := d.NewRequest(method)
+	s.setSessionExpires(req, t.interval, refresherUAC)
+	req.Headers.Set(message.HeaderAllow, AllowedMethods)
+	// 先放入带 branch 的 Via，发送前登记事务，保证响应到达时能识别为刷新
+	branch := NewBranch()
+	req.Headers.Insert(message.HeaderVia, fmt.Sprintf("SIP/2.0/UDP %s;branch=%s", s.LocalAddr(), branch))
+	s.txMu.Lock()
+	s.refreshes[dialog.TransactionID(branch, method)] = id
+	s.txMu.Unlock()
+	if err := s.SendInDialog(req); err != nil {
+		s.logger.Warn("send session refresh", zap.String("dialog", id.String()), zap.Error(err))
+		return
+	}
+	s.logger.Info("session refresh sent", zap.String("dialog", id.String()), zap.String("method", string(method)))
+}
+
+// expireSession 在会话到期仍未刷新时结束会话。
+func (s *Stack) expireSession(id dialog.DialogID, t *sessionTimer) {
+	s.dialogMu.Lock()
+	current := s.sessions[id] == t
+	s.dialogMu.Unlock()
+	if current {
+		s.endSession(id, "session expired")
+	}
+}
+
+// endSession 发送 BYE 并终止对话。
+func (s *Stack) endSession(id dialog.DialogID, reason string) {
+	d := s.Dialog(id)
+	if d == nil {
+		return
+	}
+	s.logger.Warn("ending session", zap.String("dialog", id.String()), zap.String("reason", reason))
+	s.cdrBye(id, endSystem)
+	if err := s.SendInDialog(d.NewRequest(message.MethodBYE)); err != nil {
+		s.logger.Warn("send BYE", zap.Error(err))
+	}
+	s.removeDialog(id)
+}
+
+// onRefreshResponse 处理协议栈发出的会话刷新收到的响应，返回 false 表示不是刷新的响应。
+// re-INVITE 刷新的 2xx 由协议栈 ACK（2xx 带 offer 时 ACK 携带 answer）；计时器已由 onClientSessionResponse 重置。
+func (s *Stack) onRefreshResponse(tx *dialog.Transaction, resp *message.Response) bool {
+	s.txMu.RLock()
+	id, ok := s.refreshes[tx.ID]
+	s.txMu.RUnlock()
+	if !ok {
+		return false
+	}
+	code := resp.StatusCode
+	switch {
+	case code < 200:
+	case code < 300:
+		if tx.Method != message.MethodINVITE {
+			break
+		}
+		d := s.Dialog(id)
+		if d == nil {
+			break
+		}
+		ack := d.NewRequest(message.MethodACK)
+		if offer, err := ParseSDP(resp.Headers, resp.Body); err == nil && offer != nil && s.media != nil {
+			if answer, err := sdp.Answer(offer, *s.media); err == nil {
+				ack.Body = setSDP(ack.Headers, answer)
+			}
+		}
+		if err := s.SendInDialog(ack); err != nil {
+			s.logger.Warn("send ACK for session refresh", zap.Error(err))
+		}
+	case code == message.StatusRequestTimeout || code == message.StatusCallDoesNotExist:
+		s.endSession(id, fmt.Sprintf("session refresh failed: %d", code))
+	default:
+		s.logger.Warn("session refresh rejected", zap.String("dialog", id.String()), zap.Int("code", code))
+	}
+	return true
+}
+
+// refreshTimedOut 在刷新事务超时时结束会话，返回 false 表示不是刷新事务。
+func (s *Stack) refreshTimedOut(tx *dialog.Transaction) bool {
+	s.txMu.RLock()
+	id, ok := s.refreshes[tx.ID]
+	s.txMu.RUnlock()
+	if ok {
+		s.endSession(id, "session refresh timed out")
+	}
+	return ok
+}
+
+// retrySessionInterval 在收到 422 时以响应的 Min-SE 作为会话间隔重发请求（RFC 4028 §7.4），返回是否已重发。
+// 新请求使用新 branch，CSeq 加一（对话内请求取对话的下一个 CSeq）。
+func (s *Stack) retrySessionInterval(tx *dialog.Transaction, resp *message.Response, dst string) bool {
+	if resp.StatusCode != message.StatusIntervalTooSmall || dst == "" {
+		return false
+	}
+	req := tx.Request
+	minSE := parseMinSE(resp.Headers)
+	interval, refresher, _ := parseSessionExpires(req.Headers)
+	if minSE <= interval {
+		return false
+	}
+	cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq))
+	if err != nil {
+		return false
+	}
+	seq := cseq.Seq + 1
+	if d := s.Dialog(dialogIDOf(req)); d != nil {
+		seq = d.NextLocalCSeq()
+	}
+
+	retry := req.Clone()
+	se := strconv.Itoa(minSE)
+	if refresher != "" {
+		se += ";refresher=" + refresher
+	}
+	retry.Headers.Set(message.HeaderSessionExpires, se)
+	retry.Headers.Set(message.HeaderMinSE, strconv.Itoa(minSE))
+	retry.Headers.Set(message.HeaderCSeq, fmt.Sprintf("%d %s", seq, cseq.Method))
+	branch := NewBranch()
+	setTopBranch(retry, branch)
+
+	s.txMu.Lock()
+	if id, ok := s.refreshes[tx.ID]; ok {
+		s.refreshes[dialog.TransactionID(branch, req.Method)] = id
+	}
+	s.txMu.Unlock()
+	if err := s.SendRequest(retry, dst); err != nil {
+		s.logger.Warn("resend with larger session interval failed", zap.Error(err))
+		return false
+	}
+	s.logger.Info("resent request with larger session interval",
+		zap.String("method", string(req.Method)), zap.Int("interval", minSE))
+	return true
+}
+
+// dialogIDOf 返回本端发出的请求所属对话的 ID（From tag 为本端 tag），不在对话内时 RemoteTag 为空。
+func dialogIDOf(req *message.Request) dialog.DialogID {
+	id, err := dialog.IDFromRequest(req)
+	if err != nil {
+		return dialog.DialogID{}
+	}
+	return dialog.DialogID{CallID: id.CallID, LocalTag: id.RemoteTag, RemoteTag: id.LocalTag}
+}
+
+// handleUpdate 应答不带消息体的 UPDATE（RFC 3311），会话计时器由 2xx 重置。
+func (s *Stack) handleUpdate(req *message.Request, tx *dialog.Transaction) {
+	d := s.RequestDialog(req)
+	if d == nil {
+		s.respondDialogError(tx, req, message.StatusCallDoesNotExist)
+		return
+	}
+	resp := BuildResponse(req, message.StatusOK, "")
+	if d.LocalTarget != nil {
+		resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", d.LocalTarget))
+	}
+	resp.Headers.Set(message.HeaderAllow, AllowedMethods)
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Warn("send 200 for UPDATE", zap.Error(err))
+	}
+}
@@ -0,0 +1,352 @@
+package stack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+func TestPrepareSessionExpires(t *testing.T) {
+	tests := []struct {
+		name      string
+		supported bool   // 请求带 Supported: timer
+		se        string // 请求的 Session-Expires，空表示没有
+		minSE     string // 请求的 Min-SE
+		set       string // TU 在 2xx 中自行设置的 Session-Expires
+		want      string
+		require   bool // 响应带 Require: timer
+	}{
+		{"uac refreshes by default", true, "1200", "", "", "1200;refresher=uac", true},
+		{"refresher from request", true, "1200;refresher=uas", "", "", "1200;refresher=uas", true},
+		{"uac without timer", false, "1200", "", "", "1200;refresher=uas", false},
+		{"no Session-Expires", true, "", "", "", "1800;refresher=uac", true},
+		{"shortened to local", true, "3600", "", "", "1800;refresher=uac", true},
+		{"not below request Min-SE", true, "3600", "2400", "", "2400;refresher=uac", true},
+		{"set by TU", true, "1200", "", "600;refresher=uas", "600;refresher=uas", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Stack{sessionExpires: DefaultSessionExpires, minSE: MinSessionExpires}
+			req := message.NewRequest(message.MethodINVITE, &message.URI{Scheme: "sip", User: "bob", Host: "192.0.2.2"})
+			if tt.supported {
+				req.Headers.Set(message.HeaderSupported, "timer")
+			}
+			if tt.se != "" {
+				req.Headers.Set(message.HeaderSessionExpires, tt.se)
+			}
+			if tt.minSE != "" {
+				req.Headers.Set(message.HeaderMinSE, tt.minSE)
+			}
+			resp := message.NewResponse(message.StatusOK)
+			if tt.set != "" {
+				resp.Headers.Set(message.HeaderSessionExpires, tt.set)
+			}
+
+			s.prepareSessionExpires(&dialog.Transaction{Method: message.MethodINVITE, Request: req}, resp)
+			if got := resp.Headers.Get(message.HeaderSessionExpires); got != tt.want {
+				t.Errorf("Session-Expires = %q, want %q", got, tt.want)
+			}
+			if got := resp.Headers.HasToken(message.HeaderRequire, "timer"); got != tt.require {
+				t.Errorf("Require: timer = %v, want %v", got, tt.require)
+			}
+		})
+	}
+}
+
+// wiretap 通过 WithCapture 记录经过传输层的请求，用于观察协议栈自行处理、不交给 TU 的请求（如 UPDATE 刷新）。
+// 测试中挂在只应答、不主动发请求的一方，记录到的请求即是它收到的请求。
+type wiretap struct {
+	requests chan *message.Request
+}
+
+func newWiretap() *wiretap {
+	return &wiretap{requests: make(chan *message.Request, 64)}
+}
+
+func (w *wiretap) Capture(p *transport.Packet) {
+	if m, err := message.Parse(p.Data); err == nil {
+		if req, ok := m.(*message.Request); ok {
+			w.requests <- req
+		}
+	}
+}
+
+// next 等待下一个 method 请求，其间的其他请求被跳过。
+func (w *wiretap) next(t *testing.T, method message.Method) *message.Request {
+	t.Helper()
+	for {
+		select {
+		case req := <-w.requests:
+			if req.Method == method {
+				return req
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s on the wire", method)
+		}
+	}
+}
+
+// none 断言 wait 时间内没有 method 请求经过。
+func (w *wiretap) none(t *testing.T, method message.Method, wait time.Duration) {
+	t.Helper()
+	deadline := time.After(wait)
+	for {
+		select {
+		case req := <-w.requests:
+			if req.Method == method {
+				t.Fatalf("unexpected %s (CSeq %s)", method, req.Headers.Get(message.HeaderCSeq))
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// timerCall 是 alice 呼叫 bob 建立的带会话计时器的对话，alice 的协议栈使用手动时钟。
+type timerCall struct {
+	alice, bob     *Stack
+	aliceH, bobH   *testHandler
+	clock          *dialog.ManualClock
+	tap            *wiretap // bob 收到的请求
+	id             dialog.DialogID
+	inviteResponse *message.Response
+}
+
+// newTimerCall 建立呼叫，answer 调整 bob 对 INVITE（含 re-INVITE 刷新）的 200。
+func newTimerCall(t *testing.T, answer func(resp *message.Response)) *timerCall {
+	t.Helper()
+	c := &timerCall{
+		aliceH: newTestHandler(),
+		bobH:   newTestHandler(),
+		clock:  dialog.NewManualClock(time.Now()),
+		tap:    newWiretap(),
+	}
+	c.bobH.onRequest = func(req *message.Request, tx *dialog.Transaction) {
+		switch req.Method {
+		case message.MethodACK:
+		case message.MethodINVITE:
+			tag := ""
+			if !inDialogRequest(req) {
+				tag = NewTag()
+			}
+			resp := BuildResponse(req, message.StatusOK, tag)
+			resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", c.bob.ContactURI("sip")))
+			if answer != nil {
+				answer(resp)
+			}
+			tx.Respond(resp)
+		default:
+			tx.Respond(BuildResponse(req, message.StatusOK, ""))
+		}
+	}
+	c.aliceH.onResponse = func(resp *message.Response, req *message.Request) {
+		if req == nil || req.Method != message.MethodINVITE || resp.StatusCode/100 != 2 {
+			return
+		}
+		if d := c.alice.ResponseDialog(resp); d != nil {
+			c.alice.SendInDialog(d.NewRequest(message.MethodACK))
+		}
+	}
+	c.bob = newTestStack(t, c.bobH, WithSessionTimer(DefaultSessionExpires, MinSessionExpires), WithCapture(c.tap))
+	c.alice = newTestStack(t, c.aliceH, WithSessionTimer(120, MinSessionExpires), WithClock(c.clock))
+
+	bobAddr := c.bob.transports[transport.NetworkUDP].LocalAddr().String()
+	invite, err := c.alice.BuildInviteRequest("sip:alice@"+c.alice.LocalAddr(), "sip:bob@"+bobAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不声明 100rel，200 不必等待 PRACK
+	invite.Headers.Set(message.HeaderSupported, "timer")
+	if err := c.alice.SendRequest(invite, bobAddr); err != nil {
+		t.Fatal(err)
+	}
+	c.inviteResponse = c.aliceH.nextResponse(t, message.MethodINVITE)
+	if c.inviteResponse.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d", c.inviteResponse.StatusCode)
+	}
+	d := c.alice.ResponseDialog(c.inviteResponse)
+	if d == nil {
+		t.Fatal("no dialog for the 200")
+	}
+	c.id = d.ID
+	c.tap.next(t, message.MethodACK)
+	return c
+}
+
+func inDialogRequest(req *message.Request) bool {
+	to, err := message.ParseAddress(req.Headers.Get(message.HeaderTo))
+	return err == nil && to.Tag != ""
+}
+
+// session 返回 alice 上对话当前的会话计时器。
+func (c *timerCall) session() *sessionTimer {
+	c.alice.dialogMu.Lock()
+	defer c.alice.dialogMu.Unlock()
+	return c.alice.sessions[c.id]
+}
+
+// waitRestarted 等待 alice 的会话计时器被替换为新的（刷新的 2xx 已处理）。
+func (c *timerCall) waitRestarted(t *testing.T, old *sessionTimer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.session() == old {
+		if time.Now().After(deadline) {
+			t.Fatal("session timer not restarted after refresh")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  bool // bob 的 2xx 带 Allow（含 UPDATE）
+		method message.Method
+	}{
+		{"UPDATE when allowed", true, message.MethodUPDATE},
+		{"re-INVITE otherwise", false, message.MethodINVITE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTimerCall(t, func(resp *message.Response) {
+				if tt.allow {
+					resp.Headers.Set(message.HeaderAllow, AllowedMethods)
+				} else {
+					resp.Headers.Del(message.HeaderAllow)
+				}
+			})
+			if got := c.inviteResponse.Headers.Get(message.HeaderSessionExpires); got != "120;refresher=uac" {
+				t.Fatalf("2xx Session-Expires = %q", got)
+			}
+			st := c.session()
+			if st == nil || !st.refresher || st.useUpdate != tt.allow {
+				t.Fatalf("session timer = %+v", st)
+			}
+
+			// alice 是刷新方，半个会话间隔（60s）时发送刷新
+			c.clock.Advance(59 * time.Second)
+			c.tap.none(t, tt.method, 100*time.Millisecond)
+			for round := 1; round <= 2; round++ {
+				c.clock.Advance(time.Second)
+				req := c.tap.next(t, tt.method)
+				if got := req.Headers.Get(message.HeaderSessionExpires); got != "120;refresher=uac" {
+					t.Errorf("refresh %d Session-Expires = %q", round, got)
+				}
+				if !inDialogRequest(req) {
+					t.Errorf("refresh %d is outside the dialog", round)
+				}
+				if tt.method == message.MethodINVITE {
+					// re-INVITE 刷新的 2xx 由协议栈 ACK
+					c.tap.next(t, message.MethodACK)
+				}
+				// 刷新的 2xx 重置计时器：原到期时刻（88s）过后会话仍在
+				c.waitRestarted(t, st)
+				st = c.session()
+				c.clock.Advance(59 * time.Second)
+			}
+			c.tap.none(t, message.MethodBYE, 100*time.Millisecond)
+			// 刷新的响应不交给 TU
+			select {
+			case resp := <-c.aliceH.responses:
+				if cseq, _ := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq)); cseq.Method == string(tt.method) {
+					t.Errorf("refresh response %d reached the TU", resp.StatusCode)
+				}
+			default:
+			}
+		})
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	// bob 声明由自己刷新，alice 只负责到期检查
+	c := newTimerCall(t, func(resp *message.Response) {
+		resp.Headers.Set(message.HeaderSessionExpires, "120;refresher=uas")
+	})
+	d := c.alice.Dialog(c.id)
+	if st := c.session(); st == nil || st.refresher {
+		t.Fatalf("session timer = %+v, want alice not refreshing", st)
+	}
+
+	// 到期前 min(32s, 120s/3) = 32s 仍未刷新：88s 时发送 BYE 并终止对话
+	c.clock.Advance(87 * time.Second)
+	c.tap.none(t, message.MethodBYE, 100*time.Millisecond)
+	c.clock.Advance(time.Second)
+	bye := c.tap.next(t, message.MethodBYE)
+	if id := dialogIDOf(bye); id != c.id {
+		t.Errorf("BYE dialog = %v, want %v", id, c.id)
+	}
+	if c.alice.Dialog(c.id) != nil {
+		t.Error("dialog still present after session expiry")
+	}
+	if d.GetState() != dialog.DialogStateTerminated {
+		t.Errorf("dialog state = %v, want terminated", d.GetState())
+	}
+	// BYE 的响应照常交给 TU
+	if resp := c.aliceH.nextResponse(t, message.MethodBYE); resp.StatusCode != message.StatusOK {
+		t.Errorf("BYE answered with %d", resp.StatusCode)
+	}
+}
+
+func TestSessionIntervalTooSmall(t *testing.T) {
+	aliceH, bobH := newTestHandler(), newTestHandler()
+	var alice, bob *Stack
+	bobH.onRequest = func(req *message.Request, tx *dialog.Transaction) {
+		if req.Method != message.MethodINVITE {
+			return
+		}
+		resp := BuildResponse(req, message.StatusOK, NewTag())
+		resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", bob.ContactURI("sip")))
+		tx.Respond(resp)
+	}
+	aliceH.onResponse = func(resp *message.Response, req *message.Request) {
+		if req == nil || req.Method != message.MethodINVITE || resp.StatusCode/100 != 2 {
+			return
+		}
+		if d := alice.ResponseDialog(resp); d != nil {
+			alice.SendInDialog(d.NewRequest(message.MethodACK))
+		}
+	}
+	tap := newWiretap()
+	bob = newTestStack(t, bobH, WithSessionTimer(DefaultSessionExpires, 300), WithCapture(tap))
+	alice = newTestStack(t, aliceH, WithSessionTimer(120, MinSessionExpires))
+
+	bobAddr := bob.transports[transport.NetworkUDP].LocalAddr().String()
+	invite, err := alice.BuildInviteRequest("sip:alice@"+alice.LocalAddr(), "sip:bob@"+bobAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不声明 100rel，200 不必等待 PRACK
+	invite.Headers.Set(message.HeaderSupported, "timer")
+	if err := alice.SendRequest(invite, bobAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次 INVITE 的 120 小于 bob 的 Min-SE，422 不交给 TU，alice 以 Min-SE 重发
+	first := tap.next(t, message.MethodINVITE)
+	if got := first.Headers.Get(message.HeaderSessionExpires); got != "120" {
+		t.Fatalf("first INVITE Session-Expires = %q", got)
+	}
+	resp := aliceH.nextResponse(t, message.MethodINVITE)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("INVITE answered with %d, want 200 after the retry", resp.StatusCode)
+	}
+	retry := bobH.nextRequest(t, message.MethodINVITE)
+	if got := retry.Headers.Get(message.HeaderSessionExpires); got != "300" {
+		t.Errorf("retried Session-Expires = %q, want 300", got)
+	}
+	if got := retry.Headers.Get(message.HeaderMinSE); got != "300" {
+		t.Errorf("retried Min-SE = %q, want 300", got)
+	}
+	c1, _ := message.ParseCSeq(first.Headers.Get(message.HeaderCSeq))
+	c2, _ := message.ParseCSeq(retry.Headers.Get(message.HeaderCSeq))
+	if c2.Seq != c1.Seq+1 {
+		t.Errorf("retry CSeq = %d, want %d", c2.Seq, c1.Seq+1)
+	}
+	if got := resp.Headers.Get(message.HeaderSessionExpires); got != "300;refresher=uac" {
+		t.Errorf("2xx Session-Expires = %q", got)
+	}
+}
@@ -28,6 +28,7 @@
 package stack
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -35,47 +36,131 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lccxxo/go_/mini_sip/internal/auth"
+	"github.com/lccxxo/go_/mini_sip/internal/cdr"
 	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/event"
+	"github.com/lccxxo/go_/mini_sip/internal/locate"
 	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/sdp"
 	"github.com/lccxxo/go_/mini_sip/internal/transport"
 	"go.uber.org/zap"
 )
 
 // Handler 是上层应用处理 SIP 消息的回调接口。
 type Handler interface {
-	// OnRequest 处理收到的请求（UAS 角色）。
+	// OnRequest 处理收到的请求（UAS 角色），通过 tx.Respond 发送响应。
+	//
+	// 请求重传由服务端事务吸收，不会重复回调。
+	// ACK 没有独立事务：对 2xx 的 ACK 以其确认的 INVITE 事务回调（找不到时为 nil），
+	// 对非 2xx 的 ACK 由事务层吸收。
 	OnRequest(req *message.Request, tx *dialog.Transaction)
 	// OnResponse 处理收到的响应（UAC 角色）。
 	OnResponse(resp *message.Response, req *message.Request)
+	// OnError 处理事务失败（Timer B/F 超时、Timer H/L 等待 ACK 超时或传输错误），
+	// err 可用 errors.Is 与 dialog.ErrTimeout / dialog.ErrTransport 比较；
+	// 可靠 1xx 等不到 PRACK 时为 dialog.ErrNoPRACK，此时协议栈已以 500 拒绝该 INVITE。
+	OnError(req *message.Request, err error)
 }
 
 // Stack 是 SIP 协议栈，整合传输层、事务层。
 type Stack struct {
-	mu        sync.Mutex
-	transport *transport.UDPTransport
-	handler   Handler
-	logger    *zap.Logger
+	mu      sync.Mutex
+	handler Handler
+	logger  *zap.Logger
+
+	// 传输层：UDP 与 TCP 默认同时监听同一端口（RFC 3261 §18 要求都实现），
+	// transports 以 Via 传输标识索引，order 记录启动顺序
+	udp        *transport.UDPTransport
+	transports map[string]transport.Transport
+	order      []transport.Transport
+
+	// 额外传输（TLS / WS ...）的构造函数，由 Option 登记，NewStack 中创建
+	extraTransports []func() (transport.Transport, error)
+
+	// 全部传输共用的抓包挂钩，由 WithCapture 配置
+	capturer transport.Capturer
 
 	// 本地信息
 	localHost string
 	localPort int
 
-	// 事务表：txID -> Transaction
-	txMu sync.RWMutex
-	txs  map[string]*dialog.Transaction
-
-	// 待匹配的客户端请求：txID -> 原始请求
-	pendingMu  sync.RWMutex
-	pendingReq map[string]*message.Request
+	// 客户端事务表：txID -> Transaction；txDst 记录事务的目标地址（认证重试时沿用），
+	// cancels 记录本端已发起 CANCEL 的 INVITE 事务（见 cancel.go），
+	// refreshes 记录协议栈发出的会话刷新事务所属的对话（见 session_timer.go），
+	// failovers 记录事务失败后可以改发的 RFC 3263 备选目标（见 locate.go）
+	txMu      sync.RWMutex
+	txs       map[string]*dialog.Transaction
+	txDst     map[string]string
+	cancels   map[string]*cancelState
+	refreshes map[string]dialog.DialogID
+	failovers map[string][]locate.Target
+
+	// 服务端事务表：ServerTransactionID -> Transaction；
+	// inviteTxs 以 Call-ID + CSeq 序号索引 INVITE 事务，用于匹配 2xx 的 ACK（branch 不同）
+	stxMu     sync.Mutex
+	stxs      map[string]*dialog.Transaction
+	inviteTxs map[string]*dialog.Transaction
+
+	// 事务公共参数（时钟、计时器），由 Option 配置
+	txOpts dialog.TxOptions
+
+	// 客户端摘要认证凭据，由 WithCredentials 配置
+	authUser  string
+	authStore auth.CredentialStore
+
+	// 服务器定位（RFC 3263）使用的 DNS 解析器，由 WithResolver 配置
+	resolver locate.Resolver
+
+	// 本端媒体能力，由 WithMedia 配置；nil 时不收发 SDP
+	media *sdp.Config
+
+	// 对话表（见 dialog.go）与对话的会话计时器（见 session_timer.go）；代理模式下不维护
+	dialogMu  sync.Mutex
+	dialogs   map[dialog.DialogID]*dialog.Dialog
+	sessions  map[dialog.DialogID]*sessionTimer
+	proxyMode bool
+
+	// 会话计时器参数（秒），由 WithSessionTimer 配置；sessionExpires 为 0 时不启用
+	sessionExpires int
+	minSE          int
+
+	// 事件订阅（见 subscribe.go）：packages 为 WithEventPackage 登记的事件包，
+	// notifications / subscriptions 为本端作为通知方 / 订阅方的订阅，
+	// pendingSubs 以 Call-ID + From tag 索引尚未建立对话的 SUBSCRIBE
+	subMu         sync.Mutex
+	packages      map[string]event.Package
+	notifications map[subKey]*notification
+	subscriptions map[subKey]*subscription
+	pendingSubs   map[string]*subscription
+
+	// 呼叫转移（见 refer.go）：referrals 以转移 INVITE 的 Call-ID 索引其隐式订阅（受 subMu 保护），
+	// replacing 以服务端事务 ID 索引带 Replaces 的 INVITE 要替换的对话（受 dialogMu 保护）
+	referrals map[string]subKey
+	replacing map[string]dialog.DialogID
+
+	// 流保活（见 nat.go）：以传输标识 + 远端地址索引
+	kaMu       sync.Mutex
+	keepalives map[string]*keepalive
+
+	// 呼叫详细记录（见 cdr.go）：cdrSinks 由 WithCDRSink 配置，cdrs 为进行中的记录
+	cdrSinks []CDRSink
+	cdrMu    sync.Mutex
+	cdrs     map[cdrKey]*cdr.Record
 
 	stopCh chan struct{}
 }
 
 // NewStack 创建并启动协议栈。
-// listenAddr 格式："0.0.0.0:5060"
-func NewStack(listenAddr string, handler Handler, logger *zap.Logger) (*Stack, error) {
-	tp, err := transport.NewUDPTransport(listenAddr, logger)
+// listenAddr 格式："0.0.0.0:5060"，UDP 与 TCP 同时监听该地址。
+func NewStack(listenAddr string, handler Handler, logger *zap.Logger, opts ...Option) (*Stack, error) {
+	udp, err := transport.NewUDPTransport(listenAddr, logger)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := transport.NewTCPTransport(listenAddr, logger)
 	if err != nil {
+		udp.Stop()
 		return nil, err
 	}
 
@@ -87,24 +172,91 @@ func NewStack(listenAddr string, handler Handler, logger *zap.Logger) (*Stack, e
 	}
 
 	s := &Stack{
-		transport:  tp,
 		handler:    handler,
 		logger:     logger,
+		udp:        udp,
+		transports: make(map[string]transport.Transport),
 		localHost:  host,
 		localPort:  port,
 		txs:        make(map[string]*dialog.Transaction),
-		pendingReq: make(map[string]*message.Request),
+		txDst:      make(map[string]string),
+		cancels:    make(map[string]*cancelState),
+		refreshes:  make(map[string]dialog.DialogID),
+		failovers:  make(map[string][]locate.Target),
+		stxs:       make(map[string]*dialog.Transaction),
+		inviteTxs:  make(map[string]*dialog.Transaction),
+		dialogs:    make(map[dialog.DialogID]*dialog.Dialog),
+		sessions:   make(map[dialog.DialogID]*sessionTimer),
+		packages:   make(map[string]event.Package),
 		stopCh:     make(chan struct{}),
+
+		notifications: make(map[subKey]*notification),
+		subscriptions: make(map[subKey]*subscription),
+		pendingSubs:   make(map[string]*subscription),
+		referrals:     make(map[string]subKey),
+		replacing:     make(map[string]dialog.DialogID),
+		keepalives:    make(map[string]*keepalive),
+		cdrs:          make(map[cdrKey]*cdr.Record),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.resolver == nil {
+		s.resolver = locate.NewDNSResolver("")
+	}
+	s.registerPackages()
+	if s.media != nil && s.media.Address == "" {
+		s.media.Address = host
+	}
+	s.addTransport(udp)
+	s.addTransport(tcp)
+	for _, create := range s.extraTransports {
+		tp, err := create()
+		if err != nil {
+			for _, started := range s.order {
+				started.Stop()
+			}
+			return nil, err
+		}
+		s.addTransport(tp)
+	}
+	for _, tp := range s.order {
+		if s.capturer != nil {
+			tp.SetCapturer(s.capturer)
+		}
+		tp.Start()
+		go s.dispatchLoop(tp)
 	}
-	tp.Start()
-	go s.dispatchLoop()
 	return s, nil
 }
 
 // Stop 关闭协议栈。
 func (s *Stack) Stop() {
 	close(s.stopCh)
-	s.transport.Stop()
+	s.kaMu.Lock()
+	for key, k := range s.keepalives {
+		k.stop()
+		delete(s.keepalives, key)
+	}
+	s.kaMu.Unlock()
+	s.txMu.RLock()
+	txs := make([]*dialog.Transaction, 0, len(s.txs))
+	for _, tx := range s.txs {
+		txs = append(txs, tx)
+	}
+	s.txMu.RUnlock()
+	s.stxMu.Lock()
+	for _, tx := range s.stxs {
+		txs = append(txs, tx)
+	}
+	s.stxMu.Unlock()
+	for _, tx := range txs {
+		tx.Terminate()
+	}
+	s.flushCDRs()
+	for _, tp := range s.order {
+		tp.Stop()
+	}
 }
 
 // LocalAddr 返回本地监听地址字符串。
@@ -112,38 +264,113 @@ func (s *Stack) LocalAddr() string {
 	return fmt.Sprintf("%s:%d", s.localHost, s.localPort)
 }
 
+// Clock 返回协议栈使用的时钟，未配置 WithClock 时为系统时钟。
+// 上层（如代理的串行分叉）的计时器也应使用它，以便在测试中统一推进。
+func (s *Stack) Clock() dialog.Clock {
+	if s.txOpts.Clock != nil {
+		return s.txOpts.Clock
+	}
+	return dialog.SystemClock{}
+}
+
 // ---- UAC 方法 ----
 
-// SendRequest 发送请求到目标地址，并注册事务。
+// SendRequest 发送请求到目标地址，并注册客户端事务。
+//
+// 传输按 selectTransport 规则选择（sips: 必须走 TLS，超过 MTU 阈值自动改用 TCP），
+// 顶层 Via 的传输标识与 sent-by 端口随之改写。
+// 事务层负责 UDP 下的重传（Timer A/E）与超时（Timer B/F），
+// 超时或传输错误通过 Handler.OnError 通知上层。
+// ACK 不创建事务（对 2xx 的 ACK 由 TU 直接发送），仅做一次发送。
+// 请求没有 Via 时（如 Dialog.NewRequest 构造的请求）补上本端 Via 与新 branch。
 func (s *Stack) SendRequest(req *message.Request, dst string) error {
-	tx, err := dialog.NewTransaction(req, s.logger)
+	tp, err := s.selectTransport(req)
+	if err != nil {
+		return err
+	}
+	if !req.Headers.Exists(message.HeaderVia) {
+		req.Headers.Insert(message.HeaderVia, viaValue(tp.Network(), s.sentBy(tp)))
+	}
+	setTopVia(req, tp.Network(), s.sentBy(tp))
+	if err := s.send(req, tp, dst); err != nil {
+		s.cdrTimedOut(req, err)
+		return err
+	}
+	return nil
+}
+
+// send 经由 tp 发送请求：ACK 仅发送一次，其余请求创建客户端事务。
+func (s *Stack) send(req *message.Request, tp transport.Transport, dst string) error {
+	if req.Method == message.MethodACK {
+		if err := tp.SendTo([]byte(req.String()), dst); err != nil {
+			return err
+		}
+		s.logger.Info("sent request",
+			zap.String("method", string(req.Method)),
+			zap.String("network", tp.Network()),
+			zap.String("dst", dst),
+		)
+		return nil
+	}
+
+	opts := s.txOpts
+	opts.Reliable = tp.Reliable()
+	opts.Send = func(data []byte) error {
+		return tp.SendTo(data, dst)
+	}
+	opts.OnTimeout = func(tx *dialog.Transaction, err error) {
+		if s.failover(tx, err) || s.refreshTimedOut(tx) || s.notifyTimedOut(tx) || s.subscribeTimedOut(tx) {
+			return
+		}
+		s.cdrTimedOut(tx.Request, err)
+		s.referTimedOut(tx)
+		s.referredInviteTimedOut(tx)
+		if s.handler != nil {
+			s.handler.OnError(tx.Request, err)
+		}
+	}
+	opts.OnTerminate = s.removeTransaction
+	tx, err := dialog.NewClientTransaction(req, opts, s.logger)
 	if err != nil {
 		return fmt.Errorf("create transaction: %w", err)
 	}
 	s.txMu.Lock()
 	s.txs[tx.ID] = tx
+	s.txDst[tx.ID] = dst
 	s.txMu.Unlock()
-	s.pendingMu.Lock()
-	s.pendingReq[tx.ID] = req
-	s.pendingMu.Unlock()
 
-	data := []byte(req.String())
-	if err := s.transport.SendTo(data, dst); err != nil {
+	s.cdrStart(req, true)
+	if err := tx.Start(); err != nil {
 		return err
 	}
+	s.cdrSentBye(req)
 	s.logger.Info("sent request",
 		zap.String("method", string(req.Method)),
+		zap.String("network", tp.Network()),
 		zap.String("dst", dst),
 		zap.String("txID", tx.ID),
 	)
 	return nil
 }
 
-// SendResponse 发送响应到指定来源地址。
-// src 通常是 Via 头域中解析出的地址。
+// removeTransaction 事务终止后从事务表移除。
+func (s *Stack) removeTransaction(tx *dialog.Transaction) {
+	s.txMu.Lock()
+	if s.txs[tx.ID] == tx {
+		delete(s.txs, tx.ID)
+		delete(s.txDst, tx.ID)
+		delete(s.cancels, tx.ID)
+		delete(s.refreshes, tx.ID)
+		delete(s.failovers, tx.ID)
+	}
+	s.txMu.Unlock()
+}
+
+// SendResponse 无状态地发送响应到指定地址（不经过服务端事务）。
+// 事务内的响应应使用 Transaction.Respond，由事务负责重传与重传吸收。
 func (s *Stack) SendResponse(resp *message.Response, dst *net.UDPAddr) error {
 	data := []byte(resp.String())
-	return s.transport.Send(data, dst)
+	return s.udp.Send(data, dst)
 }
 
 // ---- 消息构造工具 ----
@@ -178,8 +405,7 @@ func (s *Stack) BuildRegisterRequest(aor, registrar string, expires int) (*messa
 	}
 	req := message.NewRequest(message.MethodREGISTER, reqURI)
 
-	via := fmt.Sprintf("SIP/2.0/UDP %s;branch=%s", s.LocalAddr(), NewBranch())
-	req.Headers.Set(message.HeaderVia, via)
+	req.Headers.Set(message.HeaderVia, viaValue(transport.NetworkUDP, s.LocalAddr()))
 	req.Headers.Set(message.HeaderMaxForwards, "70")
 
 	fromTag := NewTag()
@@ -187,14 +413,18 @@ func (s *Stack) BuildRegisterRequest(aor, registrar string, expires int) (*messa
 	req.Headers.Set(message.HeaderTo, fmt.Sprintf("<%s>", aor))
 	req.Headers.Set(message.HeaderCallID, NewCallID(s.localHost))
 	req.Headers.Set(message.HeaderCSeq, "1 REGISTER")
-	req.Headers.Set(message.HeaderContact, fmt.Sprintf("<sip:%s>", s.LocalAddr()))
+	req.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", s.ContactURI(reqURI.Scheme)))
 	req.Headers.Set(message.HeaderExpires, strconv.Itoa(expires))
 	req.Headers.Set(message.HeaderUserAgent, "mini_sip/1.0")
 	req.Headers.Set(message.HeaderContentLen, "0")
 	return req, nil
 }
 
-// BuildInviteRequest 构造 INVITE 请求（不含 SDP，仅演示信令）。
+// AllowedMethods 是 UA 在 Allow 头域中声明支持的方法。
+const AllowedMethods = "INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, PRACK, SUBSCRIBE, NOTIFY, MESSAGE, REFER"
+
+// BuildInviteRequest 构造 INVITE 请求，声明支持可靠临时响应（100rel）与 Replaces，
+// 配置了 WithMedia 时附带 SDP offer，配置了 WithSessionTimer 时声明会话计时器。
 //
 // INVITE 用于发起会话邀请：
 //   - Request-URI: 被叫方 URI
@@ -207,8 +437,7 @@ func (s *Stack) BuildInviteRequest(from, to string) (*message.Request, error) {
 	}
 	req := message.NewRequest(message.MethodINVITE, toURI)
 
-	via := fmt.Sprintf("SIP/2.0/UDP %s;branch=%s", s.LocalAddr(), NewBranch())
-	req.Headers.Set(message.HeaderVia, via)
+	req.Headers.Set(message.HeaderVia, viaValue(transport.NetworkUDP, s.LocalAddr()))
 	req.Headers.Set(message.HeaderMaxForwards, "70")
 
 	fromTag := NewTag()
@@ -216,10 +445,39 @@ func (s *Stack) BuildInviteRequest(from, to string) (*message.Request, error) {
 	req.Headers.Set(message.HeaderTo, fmt.Sprintf("<%s>", to))
 	req.Headers.Set(message.HeaderCallID, NewCallID(s.localHost))
 	req.Headers.Set(message.HeaderCSeq, "1 INVITE")
-	req.Headers.Set(message.HeaderContact, fmt.Sprintf("<sip:%s>", s.LocalAddr()))
+	req.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", s.ContactURI(toURI.Scheme)))
 	req.Headers.Set(message.HeaderUserAgent, "mini_sip/1.0")
-	req.Headers.Set(message.HeaderAllow, "INVITE, ACK, BYE, CANCEL, OPTIONS")
+	req.Headers.Set(message.HeaderAllow, AllowedMethods)
+	req.Headers.Set(message.HeaderSupported, "100rel, replaces")
 	req.Headers.Set(message.HeaderContentLen, "0")
+	if s.sessionExpires > 0 {
+		s.setSessionExpires(req, s.sessionExpires, "")
+	}
+	if s.media != nil {
+		req.Body = setSDP(req.Headers, sdp.NewOffer(*s.media))
+	}
+	return req, nil
+}
+
+// BuildMessageRequest 构造对话外的 MESSAGE 请求（RFC 3428），消息体为 body。
+//
+// MESSAGE 不建立对话，因此不携带 Contact；Request-URI 与 To 为接收方 URI。
+func (s *Stack) BuildMessageRequest(from, to, contentType string, body []byte) (*message.Request, error) {
+	toURI, err := message.ParseURI(to)
+	if err != nil {
+		return nil, fmt.Errorf("parse To URI: %w", err)
+	}
+	req := message.NewRequest(message.MethodMESSAGE, toURI)
+
+	req.Headers.Set(message.HeaderVia, viaValue(transport.NetworkUDP, s.LocalAddr()))
+	req.Headers.Set(message.HeaderMaxForwards, "70")
+	req.Headers.Set(message.HeaderFrom, fmt.Sprintf("<%s>;tag=%s", from, NewTag()))
+	req.Headers.Set(message.HeaderTo, fmt.Sprintf("<%s>", to))
+	req.Headers.Set(message.HeaderCallID, NewCallID(s.localHost))
+	req.Headers.Set(message.HeaderCSeq, "1 MESSAGE")
+	req.Headers.Set(message.HeaderUserAgent, "mini_sip/1.0")
+	req.Headers.Set(message.HeaderContentType, contentType)
+	req.Body = body
 	return req, nil
 }
 
@@ -236,74 +494,31 @@ func BuildResponse(req *message.Request, code int, localTag string) *message.Res
 	resp.Headers.Set(message.HeaderFrom, req.Headers.Get(message.HeaderFrom))
 	// To 头域：若是 dialog 建立响应，追加 tag
 	to := req.Headers.Get(message.HeaderTo)
-	if localTag != "" && !containsTag(to) {
-		to = to + ";tag=" + localTag
+	if localTag != "" {
+		if addr, err := message.ParseAddress(to); err != nil || addr.Tag == "" {
+			to += ";tag=" + localTag
+		}
 	}
 	resp.Headers.Set(message.HeaderTo, to)
 	resp.Headers.Set(message.HeaderCallID, req.Headers.Get(message.HeaderCallID))
 	resp.Headers.Set(message.HeaderCSeq, req.Headers.Get(message.HeaderCSeq))
-	return resp
-}
-
-func containsTag(s string) bool {
-	for _, seg := range splitParams(s) {
-		if len(seg) >= 3 && seg[:4] == "tag=" {
-			return true
-		}
-	}
-	return false
-}
-
-func splitParams(s string) []string {
-	var out []string
-	for _, p := range splitAfterSemi(s) {
-		out = append(out, p)
-	}
-	return out
-}
-
-func splitAfterSemi(s string) []string {
-	parts := []string{}
-	for _, p := range s[indexOf(s, ';')+1:] {
-		_ = p
-	}
-	// 简化实现：直接 split
-	for i, p := range (func() []string {
-		result := []string{}
-		start := 0
-		for j := 0; j < len(s); j++ {
-			if s[j] == ';' {
-				result = append(result, s[start:j])
-				start = j + 1
-			}
-		}
-		result = append(result, s[start:])
-		return result
-	})() {
-		if i > 0 {
-			parts = append(parts, p)
+	// 建立对话的响应需原样带回 Record-Route（RFC 3261 §12.1.1）
+	if req.Method == message.MethodINVITE && code > 100 && code < 300 {
+		for _, rr := range req.Headers.GetAll(message.HeaderRecordRoute) {
+			resp.Headers.Add(message.HeaderRecordRoute, rr)
 		}
 	}
-	return parts
-}
-
-func indexOf(s string, c byte) int {
-	for i := 0; i < len(s); i++ {
-		if s[i] == c {
-			return i
-		}
-	}
-	return -1
+	return resp
 }
 
 // ---- 内部分发 ----
 
-func (s *Stack) dispatchLoop() {
+func (s *Stack) dispatchLoop(tp transport.Transport) {
 	for {
 		select {
 		case <-s.stopCh:
 			return
-		case raw, ok := <-s.transport.Recv():
+		case raw, ok := <-tp.Recv():
 			if !ok {
 				return
 			}
@@ -313,7 +528,15 @@ func (s *Stack) dispatchLoop() {
 }
 
 func (s *Stack) handleRaw(raw *transport.Message) {
+	if transport.IsPong(raw.Data) {
+		s.onPong(raw.Network, raw.Source)
+		return
+	}
 	msg, err := message.Parse(raw.Data)
+	if errors.Is(err, message.ErrEmptyMessage) {
+		// 只有空行的数据报是 CRLF 保活（RFC 5626 §4.4.1），不是错误
+		return
+	}
 	if err != nil {
 		s.logger.Warn("failed to parse SIP message", zap.Error(err),
 			zap.String("src", raw.Source.String()))
@@ -322,32 +545,230 @@ func (s *Stack) handleRaw(raw *transport.Message) {
 
 	switch m := msg.(type) {
 	case *message.Request:
-		s.handleRequest(m, raw.Source)
+		s.handleRequest(m, raw)
 	case *message.Response:
 		s.handleResponse(m)
 	}
 }
 
-func (s *Stack) handleRequest(req *message.Request, src *net.UDPAddr) {
+func (s *Stack) handleRequest(req *message.Request, raw *transport.Message) {
 	s.logger.Info("received request",
 		zap.String("method", string(req.Method)),
-		zap.String("src", src.String()),
+		zap.String("network", raw.Network),
+		zap.String("src", raw.Source.String()),
 	)
-	// 创建服务端事务
-	tx, err := dialog.NewTransaction(req, s.logger)
+	stampVia(req, raw.Source)
+	if req.Method == message.MethodACK {
+		s.handleACK(req)
+		return
+	}
+
+	id, err := dialog.ServerTransactionID(req)
 	if err != nil {
+		s.logger.Error("match server transaction", zap.Error(err))
+		return
+	}
+	s.stxMu.Lock()
+	if tx := s.stxs[id]; tx != nil {
+		s.stxMu.Unlock()
+		// 请求重传：由事务重发最近的响应，不交给 TU
+		tx.HandleRetransmission(req)
+		return
+	}
+
+	// 创建服务端事务，响应按 RFC 3261 §18.2.2 发回：
+	// 面向连接的传输沿请求到达的连接写回，UDP 按 Via 规则计算目标
+	tp := s.transports[raw.Network]
+	if tp == nil {
+		s.stxMu.Unlock()
+		s.logger.Error("request from unknown transport", zap.String("network", raw.Network))
+		return
+	}
+	if req.RequestURI != nil && req.RequestURI.Scheme == "sips" && !transport.IsSecure(raw.Network) {
+		// sips: 要求每一跳都经由 TLS，明文到达的请求直接拒绝（RFC 3261 §26.2.2）
+		s.stxMu.Unlock()
+		s.logger.Warn("rejecting sips request over insecure transport",
+			zap.String("network", raw.Network), zap.String("src", raw.Source.String()))
+		resp := BuildResponse(req, message.StatusForbidden, "")
+		resp.Reason = "SIPS Requires TLS"
+		if err := tp.SendTo([]byte(resp.String()), s.responseDst(tp, req, raw.Source)); err != nil {
+			s.logger.Warn("send 403", zap.Error(err))
+		}
+		return
+	}
+	dst := s.responseDst(tp, req, raw.Source)
+	opts := s.txOpts
+	opts.Reliable = tp.Reliable()
+	opts.Send = func(data []byte) error {
+		return tp.SendTo(data, dst)
+	}
+	opts.OnTimeout = func(tx *dialog.Transaction, err error) {
+		if errors.Is(err, dialog.ErrNoPRACK) {
+			s.rejectUnacknowledged(tx)
+		}
+		if s.handler != nil {
+			s.handler.OnError(tx.Request, err)
+		}
+	}
+	opts.OnTerminate = s.removeServerTransaction
+	opts.ReliableProvisional = !s.isProxy()
+	opts.PrepareResponse = s.prepareResponse
+	opts.OnRespond = s.onServerResponse
+	tx, err := dialog.NewServerTransaction(req, opts, s.logger)
+	if err != nil {
+		s.stxMu.Unlock()
 		s.logger.Error("create server transaction", zap.Error(err))
 		return
 	}
-	s.txMu.Lock()
-	s.txs[tx.ID] = tx
-	s.txMu.Unlock()
+	s.stxs[id] = tx
+	if req.Method == message.MethodINVITE {
+		s.inviteTxs[inviteKey(req)] = tx
+	}
+	s.stxMu.Unlock()
+	// Request-URI 不是 sip: / sips:（RFC 3261 §8.2.2.1，RFC 4475 unkscm / novelsc）
+	if !req.RequestURI.IsSIP() {
+		if err := tx.Respond(BuildResponse(req, message.StatusUnsupportedURIScheme, "")); err != nil {
+			s.logger.Warn("send 416", zap.Error(err))
+		}
+		return
+	}
+	s.cdrStart(req, false)
 
+	if !s.matchDialog(req, tx) {
+		return
+	}
+	if !s.checkSessionInterval(req, tx) {
+		return
+	}
+	if !s.isProxy() && !s.checkReplaces(req, tx) {
+		return
+	}
+	if !s.isProxy() {
+		switch {
+		case req.Method == message.MethodCANCEL:
+			s.handleCancel(req, tx)
+			return
+		case req.Method == message.MethodUPDATE && len(req.Body) == 0:
+			s.handleUpdate(req, tx)
+			return
+		case req.Method == message.MethodPRACK:
+			s.handlePrack(req, tx)
+			return
+		case req.Method == message.MethodSUBSCRIBE:
+			s.handleSubscribe(req, tx)
+			return
+		case req.Method == message.MethodNOTIFY:
+			if !s.handleNotify(req, tx) {
+				return
+			}
+		}
+	}
 	if s.handler != nil {
 		s.handler.OnRequest(req, tx)
 	}
 }
 
+// handleACK 将 ACK 匹配到 INVITE 服务端事务。
+//
+//   - 非 2xx 的 ACK 与 INVITE 同 branch，由事务吸收
+//   - 2xx 的 ACK 使用新 branch，按 Call-ID + CSeq 序号匹配，交给 TU
+func (s *Stack) handleACK(ack *message.Request) {
+	var tx *dialog.Transaction
+	if id, err := dialog.ServerTransactionID(ack); err == nil {
+		s.stxMu.Lock()
+		tx = s.stxs[id]
+		s.stxMu.Unlock()
+	}
+	if tx != nil && tx.GetState() != dialog.TxStateAccepted {
+		tx.HandleACK()
+		return
+	}
+	if tx == nil {
+		s.stxMu.Lock()
+		tx = s.inviteTxs[inviteKey(ack)]
+		s.stxMu.Unlock()
+	}
+	// 重复的 2xx ACK 不再上交
+	if tx != nil && !tx.HandleACK() {
+		return
+	}
+	if s.handler != nil {
+		s.handler.OnRequest(ack, tx)
+	}
+}
+
+// removeServerTransaction 服务端事务终止后从事务表移除。
+func (s *Stack) removeServerTransaction(tx *dialog.Transaction) {
+	s.stxMu.Lock()
+	defer s.stxMu.Unlock()
+	if s.stxs[tx.ID] == tx {
+		delete(s.stxs, tx.ID)
+	}
+	if tx.Method == message.MethodINVITE {
+		key := inviteKey(tx.Request)
+		if s.inviteTxs[key] == tx {
+			delete(s.inviteTxs, key)
+		}
+		s.dialogMu.Lock()
+		delete(s.replacing, tx.ID)
+		s.dialogMu.Unlock()
+	}
+}
+
+// prepareResponse 是服务端事务的 PrepareResponse 回调，为 TU 发出的响应补充扩展头域：
+// 可靠临时响应的 Require: 100rel 与会话计时器的 Session-Expires。
+func (s *Stack) prepareResponse(tx *dialog.Transaction, resp *message.Response) {
+	if s.isProxy() {
+		return
+	}
+	s.requireReliable(tx, resp)
+	s.prepareSessionExpires(tx, resp)
+}
+
+// inviteKey 以 Call-ID + CSeq 序号标识 INVITE 及其 ACK（以及 PRACK 的 RAck）。
+func inviteKey(req *message.Request) string {
+	key := req.Headers.Get(message.HeaderCallID)
+	if cseq, err := message.ParseCSeq(req.Headers.Get(message.HeaderCSeq)); err == nil {
+		key += " " + strconv.FormatUint(uint64(cseq.Seq), 10)
+	}
+	return key
+}
+
+// responseAddr 从顶层 Via 计算响应目标地址。
+//
+// RFC 3261 §18.2.2: 响应发送规则：
+//   - 若 Via 含 maddr 参数，发往 maddr
+//   - 若 Via 含 received 参数，发往 received（NAT 穿透），带 rport 值时端口用 rport（RFC 3581 §4）
+//   - 否则发往 sent-by（Via 中的 host:port）
+//
+// 解析失败时退回请求的实际来源地址。
+func (s *Stack) responseAddr(req *message.Request, src net.Addr) string {
+	via, err := message.ParseVia(req.Headers.Get(message.HeaderVia))
+	if err != nil {
+		return src.String()
+	}
+	return viaTarget(via)
+}
+
+// viaTarget 按 maddr > received > sent-by 的顺序计算 Via 指向的地址，
+// 端口为 rport 值（没有 maddr 时）、sent-by 端口或缺省的 5060。
+func viaTarget(via *message.Via) string {
+	host, port, err := net.SplitHostPort(via.SentBy)
+	if err != nil {
+		host, port = via.SentBy, "5060"
+	}
+	if maddr := via.Params.Get("maddr"); maddr != "" {
+		return net.JoinHostPort(maddr, port)
+	}
+	if received := via.Params.Get("received"); received != "" {
+		host = received
+	}
+	if rport := via.Params.Get("rport"); rport != "" {
+		port = rport
+	}
+	return net.JoinHostPort(host, port)
+}
+
 func (s *Stack) handleResponse(resp *message.Response) {
 	s.logger.Info("received response",
 		zap.Int("code", resp.StatusCode),
@@ -364,26 +785,60 @@ func (s *Stack) handleResponse(resp *message.Response) {
 		s.logger.Warn("parse Via in response", zap.Error(err))
 		return
 	}
-	branch := parsed.Params["branch"]
+	branch := parsed.Params.Get("branch")
 	cseq, _ := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq))
 	txID := ""
 	if cseq != nil {
-		txID = branch + ":" + string(cseq.Method)
+		txID = dialog.TransactionID(branch, message.Method(cseq.Method))
 	}
 
 	s.txMu.RLock()
 	tx := s.txs[txID]
+	dst := s.txDst[txID]
 	s.txMu.RUnlock()
 
+	// 通知上层（被事务层吸收的重传不上交）
+	var req *message.Request
 	if tx != nil {
-		tx.HandleResponse(resp)
+		if !tx.HandleResponse(resp) {
+			return
+		}
+		s.responded(txID)
+		req = tx.Request
+		// 401 / 407：带凭据自动重发，挑战本身不上交
+		if s.retryWithAuth(req, resp, dst) {
+			return
+		}
+		// 422：加大会话间隔自动重发
+		if s.retrySessionInterval(tx, resp, dst) {
+			return
+		}
+		s.trackClientResponse(req, resp)
+		s.cdrResponse(req, resp, true)
+		// 可靠 1xx：发送 PRACK，重传与乱序的不上交
+		if !s.acknowledgeReliable(req, resp) {
+			return
+		}
+		if req.Method == message.MethodINVITE {
+			s.onCancelledInviteResponse(tx, resp)
+		}
+		s.onClientSessionResponse(req, resp)
+		s.onReferredInviteResponse(req, resp)
+		s.onReferResponse(req, resp)
+		// 协议栈发出的会话刷新，响应不上交
+		if s.onRefreshResponse(tx, resp) {
+			return
+		}
+		// 协议栈发出的 PRACK，响应不上交
+		if s.onPrackResponse(req, resp) {
+			return
+		}
+		// 协议栈发出的 NOTIFY 与订阅刷新 / 退订，响应不上交
+		if s.onNotifyResponse(req, resp) || s.onSubscribeResponse(req, resp) {
+			return
+		}
 	}
 
-	// 通知上层
-	s.pendingMu.RLock()
-	req := s.pendingReq[txID]
-	s.pendingMu.RUnlock()
-
 	if s.handler != nil {
 		s.handler.OnResponse(resp, req)
 	}
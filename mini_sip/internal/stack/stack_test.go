@@ -0,0 +1,184 @@
+package stack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+func TestBuildResponseToTag(t *testing.T) {
+	tests := []struct {
+		name string
+		to   string
+		want string
+	}{
+		{"no params", "<sip:u@example.com>", "<sip:u@example.com>;tag=local"},
+		{"short param", "<sip:u@example.com>;foo", "<sip:u@example.com>;foo;tag=local"},
+		{"param with value", "<sip:u@example.com>;x=1", "<sip:u@example.com>;x=1;tag=local"},
+		{"existing tag", "<sip:u@example.com>;tag=remote", "<sip:u@example.com>;tag=remote"},
+		{"tag in URI only", "<sip:u@example.com;tag=uri>", "<sip:u@example.com;tag=uri>;tag=local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := message.NewRequest(message.MethodINVITE, &message.URI{Scheme: "sip", User: "u", Host: "example.com"})
+			req.Headers.Set(message.HeaderVia, "SIP/2.0/UDP 10.0.0.1;branch=z9hG4bK1")
+			req.Headers.Set(message.HeaderFrom, "<sip:a@example.com>;tag=a")
+			req.Headers.Set(message.HeaderTo, tt.to)
+			req.Headers.Set(message.HeaderCallID, "c1")
+			req.Headers.Set(message.HeaderCSeq, "1 INVITE")
+			resp := BuildResponse(req, message.StatusOK, "local")
+			if got := resp.Headers.Get(message.HeaderTo); got != tt.want {
+				t.Errorf("To = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// testHandler 记录协议栈回调；onRequest 为空时对请求（ACK 除外）回 200。
+type testHandler struct {
+	onRequest  func(req *message.Request, tx *dialog.Transaction)
+	onResponse func(resp *message.Response, req *message.Request)
+	requests   chan *message.Request
+	responses  chan *message.Response
+	errs       chan error
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{
+		requests:  make(chan *message.Request, 64),
+		responses: make(chan *message.Response, 64),
+		errs:      make(chan error, 64),
+	}
+}
+
+func (h *testHandler) OnRequest(req *message.Request, tx *dialog.Transaction) {
+	h.requests <- req
+	if h.onRequest != nil {
+		h.onRequest(req, tx)
+		return
+	}
+	if tx != nil && req.Method != message.MethodACK {
+		tx.Respond(BuildResponse(req, message.StatusOK, NewTag()))
+	}
+}
+
+func (h *testHandler) OnResponse(resp *message.Response, req *message.Request) {
+	h.responses <- resp
+	if h.onResponse != nil {
+		h.onResponse(resp, req)
+	}
+}
+
+func (h *testHandler) OnError(_ *message.Request, err error) {
+	h.errs <- err
+}
+
+// nextRequest 等待下一个 method 请求，其间收到的其他请求被跳过。
+func (h *testHandler) nextRequest(t *testing.T, method message.Method) *message.Request {
+	t.Helper()
+	for {
+		select {
+		case req := <-h.requests:
+			if req.Method == method {
+				return req
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", method)
+		}
+	}
+}
+
+// nextResponse 等待下一个 CSeq 方法为 method 的最终响应，临时响应与其他方法的响应被跳过。
+func (h *testHandler) nextResponse(t *testing.T, method message.Method) *message.Response {
+	t.Helper()
+	for {
+		select {
+		case resp := <-h.responses:
+			cseq, err := message.ParseCSeq(resp.Headers.Get(message.HeaderCSeq))
+			if err == nil && cseq.Method == string(method) && resp.StatusCode >= 200 {
+				return resp
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a %s response", method)
+		}
+	}
+}
+
+// freeAddr 返回 127.0.0.1 上一个 UDP 与 TCP 当前都空闲的端口。
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		if pc, err := net.ListenPacket("udp", addr); err == nil {
+			pc.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+// newTestStack 在 127.0.0.1 的空闲端口上启动协议栈，测试结束时关闭。
+func newTestStack(t *testing.T, h Handler, opts ...Option) *Stack {
+	t.Helper()
+	s, err := NewStack(freeAddr(t), h, zap.NewNop(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestUnsupportedURIScheme(t *testing.T) {
+	h := newTestHandler()
+	s := newTestStack(t, h)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// RFC 4475 unkscm：Request-URI 可以解析，但 scheme 不受支持
+	raw := "OPTIONS nobodyKnowsThisScheme:totallyopaquecontent SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP " + pc.LocalAddr().String() + ";branch=z9hG4bKunkscm\r\n" +
+		"To: sip:user@example.com\r\n" +
+		"From: sip:caller@example.net;tag=384\r\n" +
+		"Max-Forwards: 3\r\n" +
+		"Call-ID: unkscm.nasdfasser0q239nwsdfasdkl34\r\n" +
+		"CSeq: 3923423 OPTIONS\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	dst, err := net.ResolveUDPAddr("udp", s.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.WriteTo([]byte(raw), dst); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := message.Parse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := m.(*message.Response); !ok || resp.StatusCode != message.StatusUnsupportedURIScheme {
+		t.Fatalf("response = %v, want 416", m)
+	}
+	select {
+	case req := <-h.requests:
+		t.Fatalf("handler got %s with an unsupported Request-URI", req.Method)
+	default:
+	}
+}
@@ -0,0 +1,616 @@
+package stack
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/event"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"go.uber.org/zap"
+)
+
+// 事件订阅（RFC 6665），事件包由 WithEventPackage 登记（见 internal/event）：
+//
+//   - 通知方：收到 SUBSCRIBE 时，Event 不是已登记的事件包回 489（带 Allow-Events），
+//     Expires 过短回 423（带 Min-Expires）；接受时回 200 并建立订阅对话，随即发送带当前状态的 NOTIFY。
+//     资源状态变化时向该资源的全部订阅者发送 NOTIFY；订阅到期或收到 Expires: 0 时
+//     发送 Subscription-State: terminated 的 NOTIFY 并结束订阅。NOTIFY 收到 481 / 408 或超时时删除订阅
+//   - 订阅方：Subscribe 发送 SUBSCRIBE，2xx 或先于 2xx 到达的 NOTIFY 建立订阅对话，
+//     剩余一半有效期时自动刷新；收到的 NOTIFY 由协议栈以 200 应答后交给 TU，
+//     terminated 时结束订阅；Unsubscribe 发送 Expires: 0 的 SUBSCRIBE
+//   - NOTIFY 的响应、协议栈发出的刷新 / 退订 SUBSCRIBE 的响应不交给 TU
+//
+// 代理模式下 SUBSCRIBE / NOTIFY 照常转发，事件包只在 UA 模式下提供。
+
+const (
+	// DefaultSubscriptionExpires 是 SUBSCRIBE 未携带 Expires 时的订阅时长，也是通知方接受的最大时长，单位秒。
+	DefaultSubscriptionExpires = 3600
+	// MinSubscriptionExpires 是通知方接受的最小订阅时长，单位秒。
+	MinSubscriptionExpires = 60
+
+	// unsubscribeWait 是退订后等待 terminated NOTIFY 的时间，超时后直接删除订阅。
+	unsubscribeWait = 32 * time.Second
+)
+
+// subKey 标识一个订阅：对话加事件键（事件包名与 id 参数）。
+type subKey struct {
+	id    dialog.DialogID
+	event string
+}
+
+// notification 是通知方的一个订阅。
+type notification struct {
+	pkg        event.Package
+	event      string // SUBSCRIBE 的 Event 头域原值，NOTIFY 原样带回
+	resource   string
+	ownsDialog bool // 订阅对话由该订阅建立，订阅结束时一并删除
+	expiresAt  time.Time
+	timer      dialog.Timer
+}
+
+// subscription 是订阅方的一个订阅。
+type subscription struct {
+	req        *message.Request // 建立订阅的 SUBSCRIBE
+	event      string
+	expires    int // 请求的订阅时长，刷新时沿用
+	ownsDialog bool
+	implicit   bool // REFER 建立的隐式订阅（见 refer.go），不刷新，到期直接删除
+	timer      dialog.Timer
+}
+
+func (n *notification) stop() {
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+}
+
+func (sub *subscription) stop() {
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+}
+
+// registerPackages 把已登记的事件包的状态变化接到 NOTIFY 发送上，由 NewStack 调用。
+func (s *Stack) registerPackages() {
+	for _, pkg := range s.packages {
+		pkg.OnChange(func(resource string) { s.notifyResource(pkg, resource) })
+	}
+}
+
+// AllowEvents 返回已登记的事件包名（Allow-Events 头域值），没有时为空。
+func (s *Stack) AllowEvents() string {
+	names := make([]string, 0, len(s.packages))
+	for name := range s.packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseExpires 返回 Expires 头域的秒数，没有该头域时为 def，格式错误时 ok 为 false。
+func parseExpires(h *message.Headers, def int) (int, bool) {
+	v := h.Get(message.HeaderExpires)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// ---- 通知方 ----
+
+// handleSubscribe 按已登记的事件包处理收到的 SUBSCRIBE（新订阅、刷新或退订）。
+func (s *Stack) handleSubscribe(req *message.Request, tx *dialog.Transaction) {
+	eventHdr := req.Headers.Get(message.HeaderEvent)
+	pkg := s.packages[event.Name(eventHdr)]
+	if pkg == nil {
+		resp := BuildResponse(req, message.StatusBadEvent, "")
+		if allow := s.AllowEvents(); allow != "" {
+			resp.Headers.Set(message.HeaderAllowEvents, allow)
+		}
+		s.respondSubscribe(tx, resp)
+		return
+	}
+	expires, ok := parseExpires(req.Headers, DefaultSubscriptionExpires)
+	if !ok {
+		resp := BuildResponse(req, message.StatusBadRequest, "")
+		resp.Reason = "Invalid Expires"
+		s.respondSubscribe(tx, resp)
+		return
+	}
+	if expires > 0 && expires < MinSubscriptionExpires {
+		resp := BuildResponse(req, message.StatusIntervalTooBrief, "")
+		resp.Headers.Set(message.HeaderMinExpires, strconv.Itoa(MinSubscriptionExpires))
+		s.respondSubscribe(tx, resp)
+		return
+	}
+	expires = min(expires, DefaultSubscriptionExpires)
+
+	id, err := dialog.IDFromRequest(req)
+	if err != nil {
+		s.respondSubscribe(tx, BuildResponse(req, message.StatusBadRequest, ""))
+		return
+	}
+	initial := id.LocalTag == ""
+	if initial {
+		id.LocalTag = NewTag()
+	}
+	key := subKey{id: id, event: event.Key(eventHdr)}
+
+	resp := BuildResponse(req, message.StatusOK, id.LocalTag)
+	resp.Headers.Set(message.HeaderExpires, strconv.Itoa(expires))
+	if initial {
+		// 订阅对话由 trackServerResponse 在 2xx 发出时建立，Contact 为本端 Remote-Target
+		resp.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", s.ContactURI(req.RequestURI.Scheme)))
+	}
+	s.respondSubscribe(tx, resp)
+
+	s.subMu.Lock()
+	n := s.notifications[key]
+	refreshed := n != nil
+	if n == nil {
+		n = &notification{pkg: pkg, event: eventHdr, resource: event.Resource(req.RequestURI), ownsDialog: initial}
+	}
+	n.stop()
+	if expires > 0 {
+		d := time.Duration(expires) * time.Second
+		n.expiresAt = s.Clock().Now().Add(d)
+		n.timer = s.Clock().AfterFunc(d, func() { s.expireNotification(key, n) })
+		s.notifications[key] = n
+	} else {
+		delete(s.notifications, key)
+	}
+	s.subMu.Unlock()
+
+	if expires == 0 {
+		// 退订（或一次性获取状态）：以 terminated 的 NOTIFY 带回最后的状态
+		s.logger.Info("subscription terminated by subscriber",
+			zap.String("dialog", id.String()), zap.String("event", key.event))
+		s.sendNotify(key, n, &event.SubscriptionState{State: event.StateTerminated, Expires: -1, RetryAfter: -1})
+		s.endNotification(key, n)
+		return
+	}
+	msg := "subscription accepted"
+	if refreshed {
+		msg = "subscription refreshed"
+	}
+	s.logger.Info(msg, zap.String("dialog", id.String()),
+		zap.String("event", key.event), zap.String("resource", n.resource), zap.Int("expires", expires))
+	s.sendNotify(key, n, nil)
+}
+
+func (s *Stack) respondSubscribe(tx *dialog.Transaction, resp *message.Response) {
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Warn("send SUBSCRIBE response", zap.Int("code", resp.StatusCode), zap.Error(err))
+	}
+	if resp.StatusCode >= 300 {
+		s.logger.Info("rejected SUBSCRIBE", zap.Int("code", resp.StatusCode),
+			zap.String("event", tx.Request.Headers.Get(message.HeaderEvent)))
+	}
+}
+
+// sendNotify 在订阅对话内发送 NOTIFY，state 为 nil 时为 active 并带剩余有效期。
+func (s *Stack) sendNotify(key subKey, n *notification, state *event.SubscriptionState) {
+	d := s.Dialog(key.id)
+	if d == nil {
+		s.dropNotification(key, n)
+		return
+	}
+	if state == nil {
+		s.subMu.Lock()
+		remaining := n.expiresAt.Sub(s.Clock().Now())
+		s.subMu.Unlock()
+		state = &event.SubscriptionState{
+			State:      event.StateActive,
+			Expires:    max(int((remaining+time.Second-1)/time.Second), 0),
+			RetryAfter: -1,
+		}
+	}
+	req := d.NewRequest(message.MethodNOTIFY)
+	req.Headers.Set(message.HeaderEvent, n.event)
+	req.Headers.Set(message.HeaderSubscriptionState, state.String())
+	req.Headers.Set(message.HeaderContentType, n.pkg.ContentType())
+	req.Body = n.pkg.Body(n.resource)
+	if err := s.SendInDialog(req); err != nil {
+		s.logger.Warn("send NOTIFY", zap.String("dialog", key.id.String()), zap.Error(err))
+		return
+	}
+	s.logger.Info("NOTIFY sent", zap.String("dialog", key.id.String()),
+		zap.String("event", key.event), zap.String("state", state.String()))
+}
+
+// notifyResource 在资源状态变化时通知该资源的全部订阅者。
+func (s *Stack) notifyResource(pkg event.Package, resource string) {
+	type target struct {
+		key subKey
+		n   *notification
+	}
+	var targets []target
+	s.subMu.Lock()
+	for key, n := range s.notifications {
+		if n.pkg == pkg && n.resource == resource {
+			targets = append(targets, target{key, n})
+		}
+	}
+	s.subMu.Unlock()
+	for _, t := range targets {
+		s.sendNotify(t.key, t.n, nil)
+	}
+}
+
+// expireNotification 在订阅到期未刷新时发送 terminated 的 NOTIFY 并结束订阅。
+func (s *Stack) expireNotification(key subKey, n *notification) {
+	s.subMu.Lock()
+	current := s.notifications[key] == n
+	if current {
+		delete(s.notifications, key)
+	}
+	s.subMu.Unlock()
+	if !current {
+		return
+	}
+	s.logger.Info("subscription expired", zap.String("dialog", key.id.String()), zap.String("event", key.event))
+	s.sendNotify(key, n, &event.SubscriptionState{State: event.StateTerminated, Reason: event.ReasonTimeout, Expires: -1, RetryAfter: -1})
+	s.endNotification(key, n)
+}
+
+// endNotification 结束订阅后删除由订阅建立的对话。
+func (s *Stack) endNotification(key subKey, n *notification) {
+	if n.ownsDialog {
+		s.removeDialog(key.id)
+	}
+}
+
+// dropNotification 删除订阅与其对话，不再发送 NOTIFY。
+func (s *Stack) dropNotification(key subKey, n *notification) {
+	s.subMu.Lock()
+	current := s.notifications[key] == n
+	if current {
+		delete(s.notifications, key)
+		n.stop()
+	}
+	s.subMu.Unlock()
+	if current {
+		s.logger.Info("subscription removed", zap.String("dialog", key.id.String()), zap.String("event", key.event))
+		s.endNotification(key, n)
+	}
+}
+
+// notificationOf 返回本端发出的 NOTIFY 所属的订阅。
+func (s *Stack) notificationOf(req *message.Request) (subKey, *notification) {
+	key := subKey{id: dialogIDOf(req), event: event.Key(req.Headers.Get(message.HeaderEvent))}
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	return key, s.notifications[key]
+}
+
+// onNotifyResponse 处理本端 NOTIFY 收到的响应，返回 false 表示不是 NOTIFY 的响应。
+// 481 或 408 表示订阅方已不存在，删除订阅（RFC 6665 §4.2.2）。
+func (s *Stack) onNotifyResponse(req *message.Request, resp *message.Response) bool {
+	if req.Method != message.MethodNOTIFY || s.isProxy() || len(resp.Headers.GetAll(message.HeaderVia)) != 1 {
+		return false
+	}
+	switch code := resp.StatusCode; {
+	case code < 300:
+	case code == message.StatusCallDoesNotExist || code == message.StatusRequestTimeout:
+		if key, n := s.notificationOf(req); n != nil {
+			s.dropNotification(key, n)
+		}
+	default:
+		s.logger.Warn("NOTIFY rejected", zap.Int("code", code))
+	}
+	return true
+}
+
+// notifyTimedOut 在 NOTIFY 事务超时时删除订阅，返回 false 表示不是 NOTIFY 事务。
+func (s *Stack) notifyTimedOut(tx *dialog.Transaction) bool {
+	if tx.Method != message.MethodNOTIFY || s.isProxy() {
+		return false
+	}
+	if key, n := s.notificationOf(tx.Request); n != nil {
+		s.dropNotification(key, n)
+	}
+	return true
+}
+
+// ---- 订阅方 ----
+
+// BuildSubscribeRequest 构造对话外的 SUBSCRIBE 请求，订阅 to 的 eventName 事件包，有效期 expires 秒。
+func (s *Stack) BuildSubscribeRequest(from, to, eventName string, expires int) (*message.Request, error) {
+	toURI, err := message.ParseURI(to)
+	if err != nil {
+		return nil, fmt.Errorf("parse To URI: %w", err)
+	}
+	req := message.NewRequest(message.MethodSUBSCRIBE, toURI)
+
+	via := fmt.Sprintf("SIP/2.0/UDP %s;branch=%s", s.LocalAddr(), NewBranch())
+	req.Headers.Set(message.HeaderVia, via)
+	req.Headers.Set(message.HeaderMaxForwards, "70")
+	req.Headers.Set(message.HeaderFrom, fmt.Sprintf("<%s>;tag=%s", from, NewTag()))
+	req.Headers.Set(message.HeaderTo, fmt.Sprintf("<%s>", to))
+	req.Headers.Set(message.HeaderCallID, NewCallID(s.localHost))
+	req.Headers.Set(message.HeaderCSeq, "1 SUBSCRIBE")
+	req.Headers.Set(message.HeaderContact, fmt.Sprintf("<%s>", s.ContactURI(toURI.Scheme)))
+	req.Headers.Set(message.HeaderEvent, eventName)
+	req.Headers.Set(message.HeaderExpires, strconv.Itoa(expires))
+	req.Headers.Set(message.HeaderUserAgent, "mini_sip/1.0")
+	req.Headers.Set(message.HeaderAllow, AllowedMethods)
+	req.Headers.Set(message.HeaderContentLen, "0")
+	return req, nil
+}
+
+// Subscribe 发送 BuildSubscribeRequest 构造的 SUBSCRIBE 并登记订阅。
+// 订阅对话由 2xx（或先于 2xx 到达的 NOTIFY）建立，之后协议栈负责刷新，
+// SUBSCRIBE 的最终响应与每个 NOTIFY 照常交给 TU。
+func (s *Stack) Subscribe(req *message.Request, dst string) error {
+	from, err := message.ParseAddress(req.Headers.Get(message.HeaderFrom))
+	if err != nil || from.Tag == "" {
+		return fmt.Errorf("SUBSCRIBE without From tag")
+	}
+	expires, _ := parseExpires(req.Headers, DefaultSubscriptionExpires)
+	pending := req.Headers.Get(message.HeaderCallID) + " " + from.Tag
+	s.subMu.Lock()
+	s.pendingSubs[pending] = &subscription{req: req, event: req.Headers.Get(message.HeaderEvent), expires: expires, ownsDialog: true}
+	s.subMu.Unlock()
+	if err := s.SendRequest(req, dst); err != nil {
+		s.subMu.Lock()
+		delete(s.pendingSubs, pending)
+		s.subMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe 在订阅对话内发送 Expires: 0 的 SUBSCRIBE，订阅在收到 terminated 的 NOTIFY 后结束。
+func (s *Stack) Unsubscribe(id dialog.DialogID, eventHdr string) error {
+	key := subKey{id: id, event: event.Key(eventHdr)}
+	s.subMu.Lock()
+	sub := s.subscriptions[key]
+	if sub != nil {
+		sub.expires = 0
+		s.scheduleRefreshLocked(key, sub, 0)
+	}
+	s.subMu.Unlock()
+	if sub == nil {
+		return fmt.Errorf("no %s subscription in dialog %s", key.event, id)
+	}
+	return s.sendSubscribe(key, sub)
+}
+
+// sendSubscribe 在订阅对话内发送刷新或退订的 SUBSCRIBE，其响应由 onSubscribeResponse 处理。
+func (s *Stack) sendSubscribe(key subKey, sub *subscription) error {
+	d := s.Dialog(key.id)
+	if d == nil {
+		s.endSubscription(key, sub)
+		return fmt.Errorf("subscription dialog %s not found", key.id)
+	}
+	req := d.NewRequest(message.MethodSUBSCRIBE)
+	req.Headers.Set(message.HeaderEvent, sub.event)
+	req.Headers.Set(message.HeaderExpires, strconv.Itoa(sub.expires))
+	return s.SendInDialog(req)
+}
+
+// refreshSubscription 在订阅剩余一半有效期时刷新。
+func (s *Stack) refreshSubscription(key subKey, sub *subscription) {
+	s.subMu.Lock()
+	current := s.subscriptions[key] == sub
+	s.subMu.Unlock()
+	if !current {
+		return
+	}
+	if err := s.sendSubscribe(key, sub); err != nil {
+		s.logger.Warn("send subscription refresh", zap.String("dialog", key.id.String()), zap.Error(err))
+		return
+	}
+	s.logger.Info("subscription refresh sent", zap.String("dialog", key.id.String()), zap.String("event", key.event))
+}
+
+// scheduleRefreshLocked 按通知方给出的有效期重新安排刷新，调用方须持有 s.subMu。
+func (s *Stack) scheduleRefreshLocked(key subKey, sub *subscription, expires int) {
+	sub.stop()
+	if sub.expires == 0 {
+		// 已退订：等待 terminated 的 NOTIFY，超时后直接删除
+		sub.timer = s.Clock().AfterFunc(unsubscribeWait, func() { s.endSubscription(key, sub) })
+		return
+	}
+	if expires <= 0 {
+		return
+	}
+	if sub.implicit {
+		sub.timer = s.Clock().AfterFunc(time.Duration(expires)*time.Second, func() { s.endSubscription(key, sub) })
+		return
+	}
+	sub.timer = s.Clock().AfterFunc(time.Duration(expires)*time.Second/2, func() { s.refreshSubscription(key, sub) })
+}
+
+// endSubscription 删除订阅与其对话。
+func (s *Stack) endSubscription(key subKey, sub *subscription) {
+	s.subMu.Lock()
+	current := s.subscriptions[key] == sub
+	if current {
+		delete(s.subscriptions, key)
+		sub.stop()
+	}
+	s.subMu.Unlock()
+	if !current {
+		return
+	}
+	s.logger.Info("subscription ended", zap.String("dialog", key.id.String()), zap.String("event", key.event))
+	if sub.ownsDialog {
+		s.removeDialog(key.id)
+	}
+}
+
+// adoptPendingLocked 把等待建立对话的订阅登记到对话 id 上，调用方须持有 s.subMu。
+// 分叉时第一个建立对话的分支获得该订阅，之后的分支没有对应订阅。
+func (s *Stack) adoptPendingLocked(id dialog.DialogID, eventKey string) *subscription {
+	pending := id.CallID + " " + id.LocalTag
+	sub := s.pendingSubs[pending]
+	if sub == nil || event.Key(sub.event) != eventKey {
+		return nil
+	}
+	delete(s.pendingSubs, pending)
+	s.subscriptions[subKey{id: id, event: eventKey}] = sub
+	return sub
+}
+
+// onSubscribeResponse 按本端 SUBSCRIBE 收到的响应维护订阅，返回 true 表示是协议栈发出的
+// 刷新 / 退订的响应，不交给 TU。对话由 trackClientResponse 建立。
+func (s *Stack) onSubscribeResponse(req *message.Request, resp *message.Response) bool {
+	if req.Method != message.MethodSUBSCRIBE || s.isProxy() || len(resp.Headers.GetAll(message.HeaderVia)) != 1 {
+		return false
+	}
+	id, err := dialog.IDFromResponse(resp)
+	if err != nil {
+		return false
+	}
+	inDialog := dialogIDOf(req).RemoteTag != ""
+	key := subKey{id: id, event: event.Key(req.Headers.Get(message.HeaderEvent))}
+	code := resp.StatusCode
+	switch {
+	case code < 200:
+	case code < 300:
+		expires, ok := parseExpires(resp.Headers, -1)
+		if !ok || expires < 0 {
+			expires, _ = parseExpires(req.Headers, DefaultSubscriptionExpires)
+		}
+		s.subMu.Lock()
+		sub := s.subscriptions[key]
+		if sub == nil && !inDialog {
+			sub = s.adoptPendingLocked(id, key.event)
+		}
+		if sub != nil {
+			s.scheduleRefreshLocked(key, sub, expires)
+		}
+		s.subMu.Unlock()
+	default:
+		if !inDialog {
+			s.subMu.Lock()
+			delete(s.pendingSubs, id.CallID+" "+id.LocalTag)
+			s.subMu.Unlock()
+			break
+		}
+		s.subMu.Lock()
+		sub := s.subscriptions[key]
+		s.subMu.Unlock()
+		if sub != nil && (code == message.StatusCallDoesNotExist || code == message.StatusRequestTimeout) {
+			s.endSubscription(key, sub)
+		} else {
+			s.logger.Warn("subscription refresh rejected", zap.String("dialog", id.String()), zap.Int("code", code))
+		}
+	}
+	return inDialog
+}
+
+// subscribeTimedOut 处理 SUBSCRIBE 事务超时：对话内的刷新 / 退订超时结束订阅，不通知 TU；
+// 对话外的 SUBSCRIBE 超时丢弃等待中的订阅，返回 false 由 TU 照常收到 OnError。
+func (s *Stack) subscribeTimedOut(tx *dialog.Transaction) bool {
+	if tx.Method != message.MethodSUBSCRIBE || s.isProxy() {
+		return false
+	}
+	id := dialogIDOf(tx.Request)
+	if id.RemoteTag == "" {
+		s.subMu.Lock()
+		delete(s.pendingSubs, id.CallID+" "+id.LocalTag)
+		s.subMu.Unlock()
+		return false
+	}
+	key := subKey{id: id, event: event.Key(tx.Request.Headers.Get(message.HeaderEvent))}
+	s.subMu.Lock()
+	sub := s.subscriptions[key]
+	s.subMu.Unlock()
+	if sub != nil {
+		s.endSubscription(key, sub)
+	}
+	return true
+}
+
+// dialogFromNotify 在订阅的 2xx 之前收到 NOTIFY 时以 NOTIFY 建立订阅对话（RFC 6665 §4.1.2.4），
+// 不对应等待中的订阅时返回 nil。
+func (s *Stack) dialogFromNotify(req *message.Request, id dialog.DialogID) *dialog.Dialog {
+	s.subMu.Lock()
+	sub := s.pendingSubs[id.CallID+" "+id.LocalTag]
+	s.subMu.Unlock()
+	if sub == nil {
+		return nil
+	}
+	d, err := dialog.NewDialogFromRequest(req, id.LocalTag, s.logger)
+	if err != nil {
+		s.logger.Warn("create subscription dialog", zap.Error(err))
+		return nil
+	}
+	if cseq, err := message.ParseCSeq(sub.req.Headers.Get(message.HeaderCSeq)); err == nil {
+		d.LocalCSeq = cseq.Seq
+	}
+	d.LocalTarget = contactURI(sub.req.Headers)
+	d.MarkConfirmed()
+	return s.addDialog(d)
+}
+
+// handleNotify 应答收到的 NOTIFY 并维护订阅，返回 false 时已回复错误响应，不再交给 TU。
+func (s *Stack) handleNotify(req *message.Request, tx *dialog.Transaction) bool {
+	id, err := dialog.IDFromRequest(req)
+	if err != nil {
+		return true
+	}
+	key := subKey{id: id, event: event.Key(req.Headers.Get(message.HeaderEvent))}
+	s.subMu.Lock()
+	sub := s.subscriptions[key]
+	if sub == nil {
+		sub = s.adoptPendingLocked(id, key.event)
+	}
+	s.subMu.Unlock()
+	if sub == nil {
+		s.respondDialogError(tx, req, message.StatusCallDoesNotExist)
+		return false
+	}
+	state, err := event.ParseSubscriptionState(req.Headers.Get(message.HeaderSubscriptionState))
+	if err != nil {
+		resp := BuildResponse(req, message.StatusBadRequest, "")
+		resp.Reason = "Invalid Subscription-State"
+		if err := tx.Respond(resp); err != nil {
+			s.logger.Warn("send 400 for NOTIFY", zap.Error(err))
+		}
+		return false
+	}
+	if err := tx.Respond(BuildResponse(req, message.StatusOK, "")); err != nil {
+		s.logger.Warn("send 200 for NOTIFY", zap.Error(err))
+	}
+	if state.State == event.StateTerminated {
+		s.endSubscription(key, sub)
+		return true
+	}
+	if state.Expires >= 0 {
+		s.subMu.Lock()
+		if s.subscriptions[key] == sub {
+			s.scheduleRefreshLocked(key, sub, state.Expires)
+		}
+		s.subMu.Unlock()
+	}
+	return true
+}
+
+// dropSubscriptions 在对话删除时停止并删除对话上的全部订阅（两种角色），不再发送任何消息。
+func (s *Stack) dropSubscriptions(id dialog.DialogID) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for key, n := range s.notifications {
+		if key.id == id {
+			n.stop()
+			delete(s.notifications, key)
+		}
+	}
+	for key, sub := range s.subscriptions {
+		if key.id == id {
+			sub.stop()
+			delete(s.subscriptions, key)
+		}
+	}
+}
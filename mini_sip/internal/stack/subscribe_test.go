@@ -0,0 +1,346 @@
+package stack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/dialog"
+	"github.com/lccxxo/go_/mini_sip/internal/event"
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/registrar"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+	"go.uber.org/zap"
+)
+
+// subscribePair 是订阅方 alice 与提供 presence 的通知方 bob，两端都使用手动时钟。
+type subscribePair struct {
+	alice, bob           *Stack
+	aliceH               *testHandler
+	aliceClock, bobClock *dialog.ManualClock
+	presence             *event.Presence
+	tap                  *wiretap // bob 收到的请求（SUBSCRIBE 由协议栈处理，不交给 TU）
+	bobAddr              string
+	resource             string
+}
+
+func newSubscribePair(t *testing.T) *subscribePair {
+	t.Helper()
+	p := &subscribePair{
+		aliceH:     newTestHandler(),
+		aliceClock: dialog.NewManualClock(time.Now()),
+		bobClock:   dialog.NewManualClock(time.Now()),
+		presence:   event.NewPresence(),
+		tap:        newWiretap(),
+	}
+	p.bob = newTestStack(t, newTestHandler(), WithClock(p.bobClock), WithCapture(p.tap),
+		WithEventPackage(p.presence), WithEventPackage(event.NewMessageSummary()))
+	p.alice = newTestStack(t, p.aliceH, WithClock(p.aliceClock))
+	p.bobAddr = p.bob.transports[transport.NetworkUDP].LocalAddr().String()
+	p.resource = "sip:bob@127.0.0.1"
+	return p
+}
+
+// subscribe 由 alice 向 bob 发送 SUBSCRIBE，返回最终响应。
+func (p *subscribePair) subscribe(t *testing.T, eventName string, expires int) *message.Response {
+	t.Helper()
+	req, err := p.alice.BuildSubscribeRequest("sip:alice@"+p.alice.LocalAddr(), "sip:bob@"+p.bobAddr, eventName, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.alice.Subscribe(req, p.bobAddr); err != nil {
+		t.Fatal(err)
+	}
+	return p.aliceH.nextResponse(t, message.MethodSUBSCRIBE)
+}
+
+// accepted 建立 expires 秒的 presence 订阅，返回 alice 上的订阅对话。
+func (p *subscribePair) accepted(t *testing.T, expires int) dialog.DialogID {
+	t.Helper()
+	resp := p.subscribe(t, "presence", expires)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("SUBSCRIBE answered with %d", resp.StatusCode)
+	}
+	d := p.alice.ResponseDialog(resp)
+	if d == nil {
+		t.Fatal("no subscription dialog for the 200")
+	}
+	return d.ID
+}
+
+// notify 等待 alice 收到的下一个 NOTIFY，返回其 Subscription-State。
+func (p *subscribePair) notify(t *testing.T) (*message.Request, *event.SubscriptionState) {
+	t.Helper()
+	req := p.aliceH.nextRequest(t, message.MethodNOTIFY)
+	st, err := event.ParseSubscriptionState(req.Headers.Get(message.HeaderSubscriptionState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req, st
+}
+
+// presenceOf 解析 NOTIFY 中的 PIDF 文档。
+func presenceOf(t *testing.T, req *message.Request) *event.PIDF {
+	t.Helper()
+	if ct := req.Headers.Get(message.HeaderContentType); ct != event.PresenceContentType {
+		t.Fatalf("NOTIFY Content-Type = %q", ct)
+	}
+	doc, err := event.ParsePIDF(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// waitGone 等待 cond 不再成立（订阅或对话已被删除）。
+func waitGone(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still present", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// settled 等待 s 的客户端事务都已收到最终响应，之后再拨动手动时钟不会让它们超时（Timer F）。
+func settled(t *testing.T, s *Stack) {
+	t.Helper()
+	waitGone(t, "unanswered client transaction", func() bool {
+		s.txMu.RLock()
+		defer s.txMu.RUnlock()
+		for _, tx := range s.txs {
+			if st := tx.GetState(); st == dialog.TxStateTrying || st == dialog.TxStateProceeding {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (p *subscribePair) notifications() int {
+	p.bob.subMu.Lock()
+	defer p.bob.subMu.Unlock()
+	return len(p.bob.notifications)
+}
+
+func (p *subscribePair) subscriptions() int {
+	p.alice.subMu.Lock()
+	defer p.alice.subMu.Unlock()
+	return len(p.alice.subscriptions)
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		expires int
+		code    int
+		header  string
+		want    string
+	}{
+		{"unknown event", "dialog", 600, message.StatusBadEvent, message.HeaderAllowEvents, "message-summary, presence"},
+		{"interval too brief", "presence", MinSubscriptionExpires - 1, message.StatusIntervalTooBrief, message.HeaderMinExpires, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSubscribePair(t)
+			resp := p.subscribe(t, tt.event, tt.expires)
+			if resp.StatusCode != tt.code {
+				t.Fatalf("SUBSCRIBE answered with %d, want %d", resp.StatusCode, tt.code)
+			}
+			if got := resp.Headers.Get(tt.header); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.header, got, tt.want)
+			}
+			if n := p.notifications(); n != 0 {
+				t.Errorf("rejected SUBSCRIBE left %d subscriptions", n)
+			}
+			p.alice.subMu.Lock()
+			pending := len(p.alice.pendingSubs)
+			p.alice.subMu.Unlock()
+			if pending != 0 {
+				t.Errorf("rejected SUBSCRIBE left %d pending subscriptions", pending)
+			}
+		})
+	}
+}
+
+func TestSubscribeInitialNotify(t *testing.T) {
+	p := newSubscribePair(t)
+	p.presence.Set(p.resource, event.PresenceStatus{Open: true, Contacts: []string{"sip:bob@192.0.2.8"}})
+	resp := p.subscribe(t, "presence", 600)
+	if resp.StatusCode != message.StatusOK {
+		t.Fatalf("SUBSCRIBE answered with %d", resp.StatusCode)
+	}
+	if got := resp.Headers.Get(message.HeaderExpires); got != "600" {
+		t.Errorf("200 Expires = %q, want 600", got)
+	}
+
+	// 接受后立即以 NOTIFY 带回当前状态
+	req, st := p.notify(t)
+	if st.State != event.StateActive || st.Expires != 600 {
+		t.Errorf("Subscription-State = %s, want active;expires=600", st)
+	}
+	if got := req.Headers.Get(message.HeaderEvent); got != "presence" {
+		t.Errorf("NOTIFY Event = %q", got)
+	}
+	doc := presenceOf(t, req)
+	if doc.Entity != p.resource || !doc.Open() || len(doc.Tuples) != 1 || doc.Tuples[0].Contact != "sip:bob@192.0.2.8" {
+		t.Errorf("PIDF = %+v", doc)
+	}
+
+	// 状态变化通知订阅者，状态不变的更新不发 NOTIFY
+	p.presence.Set(p.resource, event.PresenceStatus{})
+	req, _ = p.notify(t)
+	if doc := presenceOf(t, req); doc.Open() {
+		t.Errorf("NOTIFY after going offline = %+v", doc)
+	}
+	p.presence.Set(p.resource, event.PresenceStatus{})
+	p.presence.Set("sip:carol@127.0.0.1", event.PresenceStatus{Open: true})
+	select {
+	case req := <-p.aliceH.requests:
+		t.Fatalf("unexpected %s (Subscription-State %s)", req.Method, req.Headers.Get(message.HeaderSubscriptionState))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSubscribeRefresh(t *testing.T) {
+	p := newSubscribePair(t)
+	p.accepted(t, 600)
+	p.notify(t)
+	first := p.tap.next(t, message.MethodSUBSCRIBE)
+
+	// 订阅方在剩余一半有效期时在对话内刷新，通知方续期并再发一次 NOTIFY
+	settled(t, p.bob)
+	p.bobClock.Advance(300 * time.Second)
+	p.aliceClock.Advance(299 * time.Second)
+	p.tap.none(t, message.MethodSUBSCRIBE, 100*time.Millisecond)
+	p.aliceClock.Advance(time.Second)
+	refresh := p.tap.next(t, message.MethodSUBSCRIBE)
+	if !inDialogRequest(refresh) {
+		t.Fatal("refresh SUBSCRIBE sent outside the dialog")
+	}
+	if got := refresh.Headers.Get(message.HeaderExpires); got != "600" {
+		t.Errorf("refresh Expires = %q, want 600", got)
+	}
+	if refresh.Headers.Get(message.HeaderCallID) != first.Headers.Get(message.HeaderCallID) {
+		t.Error("refresh SUBSCRIBE in a different Call-ID")
+	}
+
+	if _, st := p.notify(t); st.State != event.StateActive || st.Expires != 600 {
+		t.Errorf("Subscription-State after refresh = %s, want active;expires=600", st)
+	}
+	settled(t, p.alice)
+	settled(t, p.bob)
+	p.tap.next(t, message.MethodNOTIFY)
+	// 通知方从刷新时重新计时：原订阅到期的时刻不再终止订阅，刷新后满 600s 才到期
+	p.bobClock.Advance(300 * time.Second)
+	p.tap.none(t, message.MethodNOTIFY, 100*time.Millisecond)
+	if n := p.notifications(); n != 1 {
+		t.Fatalf("bob has %d subscriptions, want 1", n)
+	}
+	p.bobClock.Advance(300 * time.Second)
+	if _, st := p.notify(t); st.State != event.StateTerminated || st.Reason != event.ReasonTimeout {
+		t.Errorf("Subscription-State = %s, want terminated;reason=timeout", st)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	p := newSubscribePair(t)
+	id := p.accepted(t, 600)
+	p.notify(t)
+
+	if err := p.alice.Unsubscribe(id, "presence"); err != nil {
+		t.Fatal(err)
+	}
+	unsub := p.tap.next(t, message.MethodSUBSCRIBE)
+	for unsub.Headers.Get(message.HeaderExpires) != "0" {
+		unsub = p.tap.next(t, message.MethodSUBSCRIBE)
+	}
+	// Expires: 0 的 SUBSCRIBE 以 terminated 的 NOTIFY 结束订阅，两端都删除订阅与对话
+	if _, st := p.notify(t); st.State != event.StateTerminated {
+		t.Fatalf("Subscription-State = %s, want terminated", st)
+	}
+	waitGone(t, "bob's subscription", func() bool { return p.notifications() != 0 })
+	waitGone(t, "alice's subscription", func() bool { return p.subscriptions() != 0 })
+	waitGone(t, "alice's dialog", func() bool { return p.alice.Dialog(id) != nil })
+	bobID := dialog.DialogID{CallID: id.CallID, LocalTag: id.RemoteTag, RemoteTag: id.LocalTag}
+	waitGone(t, "bob's dialog", func() bool { return p.bob.Dialog(bobID) != nil })
+
+	// 之后的状态变化不再通知（先跳过线上已有的 terminated NOTIFY）
+	p.tap.next(t, message.MethodNOTIFY)
+	p.presence.Set(p.resource, event.PresenceStatus{Open: true})
+	p.tap.none(t, message.MethodNOTIFY, 100*time.Millisecond)
+}
+
+func TestSubscriptionExpiry(t *testing.T) {
+	p := newSubscribePair(t)
+	id := p.accepted(t, 600)
+	p.notify(t)
+
+	// alice 不刷新（其时钟不前进），bob 在到期时以 terminated;reason=timeout 结束订阅
+	settled(t, p.bob)
+	p.bobClock.Advance(599 * time.Second)
+	select {
+	case req := <-p.aliceH.requests:
+		t.Fatalf("unexpected %s before expiry", req.Method)
+	case <-time.After(100 * time.Millisecond):
+	}
+	p.bobClock.Advance(time.Second)
+	_, st := p.notify(t)
+	if st.State != event.StateTerminated || st.Reason != event.ReasonTimeout {
+		t.Fatalf("Subscription-State = %s, want terminated;reason=timeout", st)
+	}
+	if n := p.notifications(); n != 0 {
+		t.Errorf("bob has %d subscriptions after expiry", n)
+	}
+	waitGone(t, "alice's subscription", func() bool { return p.subscriptions() != 0 })
+	waitGone(t, "alice's dialog", func() bool { return p.alice.Dialog(id) != nil })
+}
+
+func TestPresenceFollowsRegistrar(t *testing.T) {
+	p := newSubscribePair(t)
+	now := time.Now()
+	reg := registrar.New(registrar.NewMemoryStore(), zap.NewNop())
+	reg.Now = func() time.Time { return now }
+	// 与 cmd/server 相同的接法：有效绑定即为 open，Contact 作为 tuple
+	reg.OnChange = func(aor string, bindings []*registrar.Binding) {
+		st := event.PresenceStatus{Open: len(bindings) > 0}
+		for _, b := range bindings {
+			st.Contacts = append(st.Contacts, b.Contact)
+		}
+		p.presence.Set(aor, st)
+	}
+
+	p.accepted(t, 600)
+	req, _ := p.notify(t)
+	if doc := presenceOf(t, req); doc.Open() {
+		t.Fatalf("unregistered user reported open: %+v", doc)
+	}
+
+	register := message.NewRequest(message.MethodREGISTER, &message.URI{Scheme: "sip", Host: "127.0.0.1"})
+	register.Headers.Set(message.HeaderVia, "SIP/2.0/UDP 192.0.2.8:5060;branch="+NewBranch())
+	register.Headers.Set(message.HeaderFrom, "<sip:bob@127.0.0.1>;tag=1")
+	register.Headers.Set(message.HeaderTo, "<sip:bob@127.0.0.1>")
+	register.Headers.Set(message.HeaderCallID, "reg-1")
+	register.Headers.Set(message.HeaderCSeq, "1 REGISTER")
+	register.Headers.Set(message.HeaderContact, "<sip:bob@192.0.2.8>;expires=120")
+	if _, err := reg.Register(register); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = p.notify(t)
+	doc := presenceOf(t, req)
+	if !doc.Open() || len(doc.Tuples) != 1 || doc.Tuples[0].Contact != "sip:bob@192.0.2.8" {
+		t.Fatalf("PIDF after REGISTER = %+v", doc)
+	}
+
+	// 绑定过期由 reaper 清理后转为 closed
+	now = now.Add(121 * time.Second)
+	if n := reg.Reap(); n != 1 {
+		t.Fatalf("Reap removed %d bindings", n)
+	}
+	req, _ = p.notify(t)
+	if doc := presenceOf(t, req); doc.Open() {
+		t.Errorf("PIDF after expiry = %+v", doc)
+	}
+}
@@ -0,0 +1,108 @@
+package stack
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// addTransport 登记一个传输，同一传输标识只保留第一个。
+func (s *Stack) addTransport(tp transport.Transport) {
+	if _, ok := s.transports[tp.Network()]; ok {
+		return
+	}
+	s.transports[tp.Network()] = tp
+	s.order = append(s.order, tp)
+}
+
+// selectTransport 为出站请求选择传输（RFC 3261 §18.1.1 / §26.2）：
+//  1. sips: Request-URI 必须走 TLS（或显式指定的 WSS），未启用或指定明文传输时返回错误
+//  2. Request-URI 显式指定 ;transport= 且本地支持时使用该传输
+//  3. 请求超过 MTU 阈值（1300 字节）时改用 TCP，避免 UDP 分片
+//  4. 否则使用 UDP
+func (s *Stack) selectTransport(req *message.Request) (transport.Transport, error) {
+	var name string
+	if req.RequestURI != nil {
+		name = strings.ToUpper(req.RequestURI.Params.Get("transport"))
+		if req.RequestURI.Scheme == "sips" {
+			if name == "" {
+				name = transport.NetworkTLS
+			}
+			if !transport.IsSecure(name) {
+				return nil, fmt.Errorf("sips request cannot use %s transport", name)
+			}
+			if tp, ok := s.transports[name]; ok {
+				return tp, nil
+			}
+			return nil, fmt.Errorf("sips request requires %s transport, enable it with WithTLS / WithWebSocket", name)
+		}
+	}
+	if name != "" {
+		if tp, ok := s.transports[name]; ok {
+			return tp, nil
+		}
+	}
+	if len(req.String()) > transport.MTUThreshold {
+		if tp, ok := s.transports[transport.NetworkTCP]; ok {
+			return tp, nil
+		}
+	}
+	return s.udp, nil
+}
+
+// sentBy 返回经由 tp 发送时 Via 中的 sent-by（本机地址 + 该传输的监听端口）。
+func (s *Stack) sentBy(tp transport.Transport) string {
+	_, port, err := net.SplitHostPort(tp.LocalAddr().String())
+	if err != nil {
+		return s.LocalAddr()
+	}
+	return net.JoinHostPort(s.localHost, port)
+}
+
+// responseDst 计算经由 tp 发送响应的目标：
+// 面向连接的传输沿请求到达的连接写回，UDP 按 Via 规则计算。
+func (s *Stack) responseDst(tp transport.Transport, req *message.Request, src net.Addr) string {
+	if tp.Reliable() {
+		return src.String()
+	}
+	return s.responseAddr(req, src)
+}
+
+// setTopVia 将顶层 Via 改写为经由 network 发送：
+// SIP/2.0/UDP host:5060;branch=... -> SIP/2.0/TLS host:5061;branch=...
+func setTopVia(req *message.Request, network, sentBy string) {
+	vias := req.Headers.GetAll(message.HeaderVia)
+	if len(vias) == 0 {
+		return
+	}
+	const prefix = "SIP/2.0/"
+	top := strings.TrimSpace(vias[0])
+	if !strings.HasPrefix(strings.ToUpper(top), prefix) {
+		return
+	}
+	rest := strings.TrimLeft(top[len(prefix):], "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+	params := ""
+	if semi := strings.IndexByte(rest, ';'); semi >= 0 {
+		params = rest[semi:]
+	}
+	rewritten := make([]string, len(vias))
+	copy(rewritten, vias)
+	rewritten[0] = prefix + network + " " + sentBy + params
+	req.Headers.Set(message.HeaderVia, rewritten[0])
+	for _, v := range rewritten[1:] {
+		req.Headers.Add(message.HeaderVia, v)
+	}
+}
+
+// ContactURI 返回本端 Contact URI：sips 请求使用 sips: 与 TLS 端口（RFC 3261 §8.1.1.8）。
+func (s *Stack) ContactURI(scheme string) string {
+	if scheme == "sips" {
+		if tp, ok := s.transports[transport.NetworkTLS]; ok {
+			return "sips:" + s.sentBy(tp)
+		}
+	}
+	return "sip:" + s.LocalAddr()
+}
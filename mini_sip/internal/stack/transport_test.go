@@ -0,0 +1,158 @@
+package stack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lccxxo/go_/mini_sip/internal/message"
+	"github.com/lccxxo/go_/mini_sip/internal/transport"
+)
+
+// selfSignedConfig 生成 127.0.0.1 的自签名证书，返回同时信任该证书的 tls.Config。
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mini_sip test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func TestSelectTransportSips(t *testing.T) {
+	plain := newTestStack(t, newTestHandler())
+	secure := newTestStack(t, newTestHandler(), WithTLS("127.0.0.1:0", selfSignedConfig(t)))
+
+	tests := []struct {
+		name    string
+		s       *Stack
+		uri     string
+		network string // 为空表示应当拒绝
+	}{
+		{"sip over UDP", plain, "sip:bob@127.0.0.1", transport.NetworkUDP},
+		{"sips without TLS", plain, "sips:bob@127.0.0.1", ""},
+		{"sips forced to TCP", secure, "sips:bob@127.0.0.1;transport=tcp", ""},
+		{"sips over TLS", secure, "sips:bob@127.0.0.1", transport.NetworkTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uri, err := message.ParseURI(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tp, err := tt.s.selectTransport(message.NewRequest(message.MethodOPTIONS, uri))
+			switch {
+			case tt.network == "" && err == nil:
+				t.Fatalf("selected %s for %s", tp.Network(), tt.uri)
+			case tt.network != "" && err != nil:
+				t.Fatalf("selectTransport: %v", err)
+			case tt.network != "" && tp.Network() != tt.network:
+				t.Fatalf("selected %s, want %s", tp.Network(), tt.network)
+			}
+		})
+	}
+}
+
+func TestSipsOverPlainTransportRejected(t *testing.T) {
+	h := newTestHandler()
+	s := newTestStack(t, h)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			conn, err := net.Dial(network, s.transports[strings.ToUpper(network)].LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			local := conn.LocalAddr().String()
+			req := "OPTIONS sips:bob@127.0.0.1 SIP/2.0\r\n" +
+				"Via: SIP/2.0/" + strings.ToUpper(network) + " " + local + ";branch=z9hG4bKsips" + network + "\r\n" +
+				"Max-Forwards: 70\r\n" +
+				"From: <sips:alice@127.0.0.1>;tag=a\r\n" +
+				"To: <sips:bob@127.0.0.1>\r\n" +
+				"Call-ID: sips-" + network + "\r\n" +
+				"CSeq: 1 OPTIONS\r\n" +
+				"Content-Length: 0\r\n\r\n"
+			if _, err := conn.Write([]byte(req)); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(buf[:n]), "SIP/2.0 403 SIPS Requires TLS\r\n") {
+				t.Fatalf("response = %q", buf[:n])
+			}
+		})
+	}
+	select {
+	case req := <-h.requests:
+		t.Fatalf("handler received %s sent over a plain transport", req.Method)
+	default:
+	}
+}
+
+func TestSipsTLSLoopback(t *testing.T) {
+	cfg := selfSignedConfig(t)
+	aliceH, bobH := newTestHandler(), newTestHandler()
+	alice := newTestStack(t, aliceH, WithTLS("127.0.0.1:0", cfg))
+	bob := newTestStack(t, bobH, WithTLS("127.0.0.1:0", cfg))
+
+	bobTLS := bob.transports[transport.NetworkTLS].LocalAddr().String()
+	req, err := alice.BuildMessageRequest("sips:alice@127.0.0.1", "sips:bob@"+bobTLS, "text/plain", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendRequest(req, bobTLS); err != nil {
+		t.Fatal(err)
+	}
+
+	got := bobH.nextRequest(t, message.MethodMESSAGE)
+	via, err := message.ParseVia(got.Headers.Get(message.HeaderVia))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if via.Transport != transport.NetworkTLS || string(got.Body) != "hello" {
+		t.Fatalf("bob received Via transport %q, body %q", via.Transport, got.Body)
+	}
+	if resp := aliceH.nextResponse(t, message.MethodMESSAGE); resp.StatusCode != message.StatusOK {
+		t.Fatalf("alice received %d", resp.StatusCode)
+	}
+}
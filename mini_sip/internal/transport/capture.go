@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 抓包挂钩：传输在每条 SIP 消息写出后、以及收到的消息交给协议栈之前调用 Capturer，
+// 只上报完整的 SIP 消息，CRLF 保活（ping / pong）不上报。
+// Capturer 由 SetCapturer 设置，可在运行中替换或以 nil 清除；调用发生在收发协程上，应尽快返回。
+
+// Packet 是一条经过传输层的 SIP 消息。
+type Packet struct {
+	Time    time.Time
+	Network string   // 传输标识（UDP / TCP / TLS / WS / WSS）
+	Src     net.Addr // 发送方地址，本端发出时为本地地址
+	Dst     net.Addr // 接收方地址，本端收到时为本地地址
+	Data    []byte   // 完整的 SIP 消息，Capturer 不得修改
+}
+
+// Capturer 接收传输层收发的 SIP 消息，可能被并发调用。
+type Capturer interface {
+	Capture(p *Packet)
+}
+
+// tap 嵌入各传输实现，保存当前的 Capturer。
+type tap struct {
+	c atomic.Pointer[capturerRef]
+}
+
+// capturerRef 包装接口值，使 atomic.Pointer 能够存放 nil 以外的任意 Capturer。
+type capturerRef struct {
+	Capturer
+}
+
+// SetCapturer 设置抓包挂钩，c 为 nil 时关闭。
+func (t *tap) SetCapturer(c Capturer) {
+	if c == nil {
+		t.c.Store(nil)
+		return
+	}
+	t.c.Store(&capturerRef{c})
+}
+
+// capture 把一条消息交给当前的 Capturer。
+func (t *tap) capture(network string, src, dst net.Addr, data []byte) {
+	ref := t.c.Load()
+	if ref == nil || isKeepalive(data) {
+		return
+	}
+	ref.Capture(&Packet{Time: time.Now(), Network: network, Src: src, Dst: dst, Data: data})
+}
+
+// isKeepalive 判断数据是否只有 CRLF（保活的 ping / pong）。
+func isKeepalive(data []byte) bool {
+	for _, b := range data {
+		if b != '\r' && b != '\n' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,16 @@
+package transport
+
+// CRLF 保活（RFC 5626 §3.5.1 / §4.4.1）：
+//   - UA 周期性地在流上发送双 CRLF（ping），保持 NAT 映射与连接不被回收
+//   - 面向连接的传输上，收到 ping 的一方立即以单个 CRLF（pong）应答，
+//     UA 据此判断流是否仍然可用
+//   - UDP 上只发送 ping 刷新 NAT 映射，不期待 pong（RFC 5626 在 UDP 上使用 STUN，这里不实现）
+const (
+	Ping = "\r\n\r\n"
+	Pong = "\r\n"
+)
+
+// IsPong 判断传输层交给协议栈的数据是否是面向连接传输上收到的 pong。
+func IsPong(data []byte) bool {
+	return string(data) == Pong
+}
@@ -0,0 +1,336 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	writeTimeout   = 10 * time.Second
+	maxStreamHead  = 64 * 1024       // 单条消息头部上限
+	maxStreamBody  = 4 * 1024 * 1024 // 单条消息体上限
+	streamRecvSize = 64
+	// pingGap 是单个 CRLF 之后等待第二个 CRLF 的时间，分段到达的双 CRLF 仍按 ping 处理
+	pingGap = 200 * time.Millisecond
+)
+
+// ErrMissingContentLength 流式传输上的消息缺少 Content-Length，无法分帧。
+var ErrMissingContentLength = errors.New("stream message missing Content-Length")
+
+// StreamTransport 是面向连接的 SIP 传输（TCP）。
+//
+// 连接按远端地址复用：
+//   - 入站连接以对端地址登记，向该地址发送即沿原连接写回（响应路由）
+//   - 出站时若已有到目标的连接则复用，否则新建并同样开始读取
+type StreamTransport struct {
+	network  string
+	listener net.Listener
+	dial     func(addr string) (net.Conn, error)
+	logger   *zap.Logger
+	recvCh   chan *Message
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+	tap
+
+	mu    sync.Mutex
+	conns map[string]*streamConn // 远端地址 -> 连接
+}
+
+// streamConn 包装连接并串行化写操作（一条消息必须连续写入流中）。
+type streamConn struct {
+	net.Conn
+	wmu sync.Mutex
+}
+
+func (c *streamConn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.Write(data)
+	return err
+}
+
+// NewTCPTransport 创建并监听 TCP 传输层。
+// addr 格式："0.0.0.0:5060"（SIP 的 UDP 与 TCP 共用 5060 端口）
+func NewTCPTransport(addr string, logger *zap.Logger) (*StreamTransport, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen TCP %q: %w", addr, err)
+	}
+	logger.Info("TCP transport listening", zap.String("addr", addr))
+	dial := func(a string) (net.Conn, error) {
+		return net.DialTimeout("tcp", a, dialTimeout)
+	}
+	return newStreamTransport(NetworkTCP, ln, dial, logger), nil
+}
+
+func newStreamTransport(network string, ln net.Listener, dial func(string) (net.Conn, error), logger *zap.Logger) *StreamTransport {
+	return &StreamTransport{
+		network:  network,
+		listener: ln,
+		dial:     dial,
+		logger:   logger,
+		recvCh:   make(chan *Message, streamRecvSize),
+		stopCh:   make(chan struct{}),
+		conns:    make(map[string]*streamConn),
+	}
+}
+
+// Network 返回 Via 传输标识。
+func (t *StreamTransport) Network() string { return t.network }
+
+// Reliable 面向连接的传输是可靠的，事务层不做重传。
+func (t *StreamTransport) Reliable() bool { return true }
+
+// Start 开始接受入站连接。
+func (t *StreamTransport) Start() {
+	t.wg.Add(1)
+	go t.acceptLoop()
+}
+
+// Recv 返回接收通道（只读）。
+func (t *StreamTransport) Recv() <-chan *Message {
+	return t.recvCh
+}
+
+// LocalAddr 返回本地监听地址。
+func (t *StreamTransport) LocalAddr() net.Addr {
+	return t.listener.Addr()
+}
+
+// SendTo 将一条完整的 SIP 消息写到 hostPort 对应的连接（不存在时建立）。
+func (t *StreamTransport) SendTo(data []byte, hostPort string) error {
+	conn, err := t.getConn(hostPort)
+	if err != nil {
+		return err
+	}
+	if err := conn.write(data); err != nil {
+		t.closeConn(conn)
+		return fmt.Errorf("send to %s: %w", hostPort, err)
+	}
+	t.capture(t.network, conn.LocalAddr(), conn.RemoteAddr(), data)
+	t.logger.Debug("sent SIP message",
+		zap.String("network", t.network),
+		zap.String("dst", conn.RemoteAddr().String()),
+		zap.Int("bytes", len(data)),
+	)
+	return nil
+}
+
+// Stop 关闭监听与所有连接。
+func (t *StreamTransport) Stop() {
+	close(t.stopCh)
+	t.listener.Close()
+	t.mu.Lock()
+	for _, c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	close(t.recvCh)
+	t.logger.Info("stream transport stopped", zap.String("network", t.network))
+}
+
+// getConn 返回到 hostPort 的连接，优先复用已有连接。
+func (t *StreamTransport) getConn(hostPort string) (*streamConn, error) {
+	key := hostPort
+	if addr, err := net.ResolveTCPAddr("tcp", hostPort); err == nil {
+		key = addr.String()
+	}
+	t.mu.Lock()
+	if c, ok := t.conns[key]; ok {
+		t.mu.Unlock()
+		return c, nil
+	}
+	t.mu.Unlock()
+
+	raw, err := t.dial(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s %s: %w", t.network, hostPort, err)
+	}
+	t.mu.Lock()
+	if c, ok := t.conns[key]; ok {
+		// 并发建连：保留先登记的连接
+		t.mu.Unlock()
+		raw.Close()
+		return c, nil
+	}
+	c := &streamConn{Conn: raw}
+	t.conns[key] = c
+	t.mu.Unlock()
+
+	t.logger.Debug("stream connection opened",
+		zap.String("network", t.network), zap.String("remote", key))
+	t.wg.Add(1)
+	go t.readLoop(c)
+	return c, nil
+}
+
+func (t *StreamTransport) closeConn(c *streamConn) {
+	t.mu.Lock()
+	key := c.RemoteAddr().String()
+	if t.conns[key] == c {
+		delete(t.conns, key)
+	}
+	t.mu.Unlock()
+	c.Close()
+}
+
+func (t *StreamTransport) acceptLoop() {
+	defer t.wg.Done()
+	for {
+		raw, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.stopCh:
+				return
+			default:
+				t.logger.Error("accept error", zap.String("network", t.network), zap.Error(err))
+				continue
+			}
+		}
+		c := &streamConn{Conn: raw}
+		t.mu.Lock()
+		t.conns[raw.RemoteAddr().String()] = c
+		t.mu.Unlock()
+		t.logger.Debug("stream connection accepted",
+			zap.String("network", t.network), zap.String("remote", raw.RemoteAddr().String()))
+		t.wg.Add(1)
+		go t.readLoop(c)
+	}
+}
+
+func (t *StreamTransport) readLoop(c *streamConn) {
+	defer t.wg.Done()
+	defer t.closeConn(c)
+	r := bufio.NewReader(c)
+	for {
+		data, err := readStreamMessage(r, c)
+		if err != nil {
+			select {
+			case <-t.stopCh:
+			default:
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					t.logger.Warn("stream read error",
+						zap.String("network", t.network),
+						zap.String("remote", c.RemoteAddr().String()),
+						zap.Error(err))
+				}
+			}
+			return
+		}
+		if string(data) == Ping {
+			// 对端的保活 ping：沿同一连接回 pong，不交给协议栈
+			if err := c.write([]byte(Pong)); err != nil {
+				t.logger.Warn("send keepalive pong", zap.String("remote", c.RemoteAddr().String()), zap.Error(err))
+				return
+			}
+			continue
+		}
+		t.capture(t.network, c.RemoteAddr(), c.LocalAddr(), data)
+		msg := &Message{Data: data, Source: c.RemoteAddr(), Network: t.network}
+		select {
+		case t.recvCh <- msg:
+		case <-t.stopCh:
+			return
+		}
+		t.logger.Debug("received SIP message",
+			zap.String("network", t.network),
+			zap.String("src", c.RemoteAddr().String()),
+			zap.Int("bytes", len(data)),
+		)
+	}
+}
+
+// readStreamMessage 从字节流中读取一条完整的 SIP 消息（RFC 3261 §18.3）。
+//
+// 流上没有消息边界：先读到空行为止的头部，再按 Content-Length 读取消息体。
+// 消息之前的空行是 CRLF 保活：双 CRLF 作为 Ping 返回，pingGap 内没有后续数据的单个 CRLF 作为 Pong 返回，
+// 紧跟着消息的空行被跳过；缺少 Content-Length 视为致命错误，调用方应关闭连接。
+// conn 是 r 底层的连接，用于设置等待第二个 CRLF 的读超时。
+func readStreamMessage(r *bufio.Reader, conn net.Conn) ([]byte, error) {
+	crlf := 0
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		c := b[0]
+		if c != '\r' && c != '\n' {
+			break
+		}
+		r.ReadByte()
+		if c != '\n' {
+			continue
+		}
+		if crlf++; crlf == 2 {
+			return []byte(Ping), nil
+		}
+		if r.Buffered() > 0 {
+			continue
+		}
+		// 缓冲区已空：双 CRLF 可能被拆成两个分段，稍等后续数据再判断是否为 pong
+		conn.SetReadDeadline(time.Now().Add(pingGap))
+		_, err = r.Peek(1)
+		conn.SetReadDeadline(time.Time{})
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return []byte(Pong), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var head bytes.Buffer
+	contentLen := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		head.WriteString(line)
+		if head.Len() > maxStreamHead {
+			return nil, fmt.Errorf("stream message header exceeds %d bytes", maxStreamHead)
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+		colon := strings.IndexByte(trimmed, ':')
+		if colon < 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(trimmed[:colon]))
+		if name == "content-length" || name == "l" {
+			n, err := strconv.Atoi(strings.TrimSpace(trimmed[colon+1:]))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid Content-Length %q", trimmed[colon+1:])
+			}
+			contentLen = n
+		}
+	}
+	if contentLen < 0 {
+		return nil, ErrMissingContentLength
+	}
+	if contentLen > maxStreamBody {
+		return nil, fmt.Errorf("stream message body %d exceeds %d bytes", contentLen, maxStreamBody)
+	}
+	data := make([]byte, head.Len()+contentLen)
+	copy(data, head.Bytes())
+	if _, err := io.ReadFull(r, data[head.Len():]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
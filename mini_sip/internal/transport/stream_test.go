@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeSegments 在另一个 goroutine 中依次写入各分段，分段之间间隔 gap。
+func writeSegments(conn net.Conn, gap time.Duration, segments ...string) {
+	go func() {
+		for i, seg := range segments {
+			if i > 0 {
+				time.Sleep(gap)
+			}
+			if _, err := conn.Write([]byte(seg)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestReadStreamMessage(t *testing.T) {
+	msg := "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\nl: 5\r\n\r\nhello"
+	tests := []struct {
+		name     string
+		segments []string
+		gap      time.Duration
+		want     []string
+	}{
+		{"ping", []string{"\r\n\r\n"}, 0, []string{Ping}},
+		{"pong", []string{"\r\n"}, 0, []string{Pong}},
+		{"split ping", []string{"\r\n", "\r\n"}, pingGap / 4, []string{Ping}},
+		{"pong then ping", []string{"\r\n", "\r\n\r\n"}, 2 * pingGap, []string{Pong, Ping}},
+		{"CRLF before message", []string{"\r\n", msg}, pingGap / 4, []string{msg}},
+		{"message in pieces", []string{msg[:10], msg[10:40], msg[40:]}, 10 * time.Millisecond, []string{msg}},
+		{"messages back to back", []string{msg + msg}, 0, []string{msg, msg}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			writeSegments(client, tt.gap, tt.segments...)
+
+			r := bufio.NewReader(server)
+			for _, want := range tt.want {
+				got, err := readStreamMessage(r, server)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Fatalf("read %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadStreamMessageMissingContentLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writeSegments(client, 0, "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\nCall-ID: x\r\n\r\n")
+	if _, err := readStreamMessage(bufio.NewReader(server), server); !errors.Is(err, ErrMissingContentLength) {
+		t.Fatalf("err = %v, want ErrMissingContentLength", err)
+	}
+}
+
+func TestTCPSplitPing(t *testing.T) {
+	tp, err := NewTCPTransport("127.0.0.1:0", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.Start()
+	t.Cleanup(tp.Stop)
+
+	conn, err := net.Dial("tcp", tp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeSegments(conn, pingGap/4, "\r\n", "\r\n")
+
+	// 分成两段的双 CRLF 仍是一个 ping：回一个 pong，不交给协议栈
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != Pong {
+		t.Fatalf("received %q, want a pong", buf[:n])
+	}
+	select {
+	case m := <-tp.Recv():
+		t.Fatalf("split ping delivered %q to the stack", m.Data)
+	case <-time.After(2 * pingGap):
+	}
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// NetworkTLS 是 TLS 传输的 Via 标识，sips: URI 必须经由 TLS 承载（RFC 3261 §26.2）。
+const NetworkTLS = "TLS"
+
+// IsSecure 判断传输标识是否为加密传输（TLS / WSS），可用于承载 sips: 请求。
+func IsSecure(network string) bool {
+	return network == NetworkTLS || network == NetworkWSS
+}
+
+// LoadTLSConfig 从 PEM 文件加载证书、私钥与 CA 池。
+//
+// 返回的配置同时用于监听与主动建连：
+//   - Certificates：本端证书（服务端必需，客户端用于双向认证）
+//   - RootCAs：校验对端服务端证书
+//   - ClientCAs：若对端提供客户端证书则用同一 CA 池校验
+//
+// caFile 为空时使用系统根证书池。
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS key pair: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", caFile)
+		}
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+	}
+	return cfg, nil
+}
+
+// NewTLSTransport 创建并监听 TLS 传输层。
+// addr 格式："0.0.0.0:5061"（sips: 默认端口 5061）
+//
+// 主动建连时以目标主机名作为 ServerName 校验证书。
+func NewTLSTransport(addr string, config *tls.Config, logger *zap.Logger) (*StreamTransport, error) {
+	if config == nil {
+		return nil, fmt.Errorf("TLS transport requires a tls.Config")
+	}
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("listen TLS %q: %w", addr, err)
+	}
+	logger.Info("TLS transport listening", zap.String("addr", addr))
+	dial := func(a string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(a)
+		if err != nil {
+			return nil, err
+		}
+		cfg := config.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", a, cfg)
+	}
+	return newStreamTransport(NetworkTLS, ln, dial, logger), nil
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// selfSignedConfig 生成 127.0.0.1 的自签名证书，返回同时信任该证书的 tls.Config。
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mini_sip test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func startTLS(t *testing.T, cfg *tls.Config) *StreamTransport {
+	t.Helper()
+	tp, err := NewTLSTransport("127.0.0.1:0", cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.Start()
+	t.Cleanup(tp.Stop)
+	return tp
+}
+
+func recvMessage(t *testing.T, tp Transport) *Message {
+	t.Helper()
+	select {
+	case m, ok := <-tp.Recv():
+		if !ok {
+			t.Fatal("receive channel closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+const testOptions = "OPTIONS sips:bob@127.0.0.1 SIP/2.0\r\n" +
+	"Via: SIP/2.0/TLS 127.0.0.1;branch=z9hG4bKtls1\r\n" +
+	"From: <sips:alice@127.0.0.1>;tag=a\r\n" +
+	"To: <sips:bob@127.0.0.1>\r\n" +
+	"Call-ID: tls-test\r\n" +
+	"CSeq: 1 OPTIONS\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func TestTLSLoopback(t *testing.T) {
+	cfg := selfSignedConfig(t)
+	alice, bob := startTLS(t, cfg), startTLS(t, cfg)
+	if alice.Network() != NetworkTLS || !IsSecure(alice.Network()) || !alice.Reliable() {
+		t.Fatalf("TLS transport reports network %q, reliable %v", alice.Network(), alice.Reliable())
+	}
+
+	if err := alice.SendTo([]byte(testOptions), bob.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	req := recvMessage(t, bob)
+	if string(req.Data) != testOptions || req.Network != NetworkTLS {
+		t.Fatalf("bob received %q over %s", req.Data, req.Network)
+	}
+
+	// 响应沿入站连接写回（RFC 3261 §18.2.2），alice 不需要为此接受新连接
+	resp := strings.Replace(testOptions, "OPTIONS sips:bob@127.0.0.1 SIP/2.0", "SIP/2.0 200 OK", 1)
+	if err := bob.SendTo([]byte(resp), req.Source.String()); err != nil {
+		t.Fatal(err)
+	}
+	if m := recvMessage(t, alice); string(m.Data) != resp {
+		t.Fatalf("alice received %q", m.Data)
+	}
+}
+
+func TestTLSRejectsUntrustedPeer(t *testing.T) {
+	bob := startTLS(t, selfSignedConfig(t))
+	// alice 的 CA 池里只有自己的证书，无法校验 bob 的自签名证书
+	alice := startTLS(t, selfSignedConfig(t))
+	if err := alice.SendTo([]byte(testOptions), bob.LocalAddr().String()); err == nil {
+		select {
+		case m := <-bob.Recv():
+			t.Fatalf("bob received %q from an untrusted peer", m.Data)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func TestNewTLSTransportRequiresConfig(t *testing.T) {
+	if _, err := NewTLSTransport("127.0.0.1:0", nil, zap.NewNop()); err == nil {
+		t.Fatal("NewTLSTransport accepted a nil tls.Config")
+	}
+}
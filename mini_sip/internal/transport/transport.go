@@ -5,11 +5,24 @@
 //   - TCP（有连接，大消息时使用）
 //   - TLS（加密，对应 sips:）
 //
-// 本实现聚焦 UDP，便于学习 SIP 基础。
+// 所有传输都实现 Transport 接口，协议栈按 Via 传输标识（UDP/TCP ...）选择。
+//
 // UDP 特点：
 //   - 无连接，每条消息独立发送
 //   - SIP 消息必须 < 1300 bytes（避免 IP 分片），超出应切换 TCP
 //   - 需要在应用层处理重传（事务层负责）
+//
+// TCP 特点（见 stream.go）：
+//   - 面向连接，按远端地址复用连接
+//   - 字节流上没有消息边界，依赖 Content-Length 分帧（RFC 3261 §18.3）
+//   - 可靠传输，事务层不做重传
+//
+// TLS（见 tls.go）复用 TCP 的连接管理与分帧，只替换监听与建连方式，
+// 与 WSS 一起是 sips: 请求允许的传输。
+//
+// WS / WSS（见 ws.go）实现 RFC 7118，每个 WebSocket 帧承载一条 SIP 消息。
+//
+// 每种传输都带有抓包挂钩（见 capture.go），收发的 SIP 消息可交给 internal/capture 写成 pcap 或 HEPv3。
 package transport
 
 import (
@@ -25,10 +38,43 @@ const (
 	readTimeout  = 5 * time.Second
 )
 
+// MTU 阈值：请求超过该大小时应改用拥塞控制的传输（RFC 3261 §18.1.1）。
+const MTUThreshold = 1300
+
+// Via 传输标识
+const (
+	NetworkUDP = "UDP"
+	NetworkTCP = "TCP"
+)
+
 // Message 封装从网络收到的原始 SIP 消息。
 type Message struct {
-	Data   []byte      // 原始字节
-	Source *net.UDPAddr // 来源地址（用于发送响应）
+	Data    []byte   // 原始字节
+	Source  net.Addr // 来源地址（用于发送响应）
+	Network string   // 收到该消息的传输标识，如 "UDP" / "TCP"
+}
+
+// Transport 是 SIP 传输层的统一抽象。
+//
+// 面向连接的传输按远端地址复用连接：向某条入站连接的来源地址发送，
+// 即沿该连接写回，满足 RFC 3261 §18.2.2 对响应路由的要求。
+type Transport interface {
+	// Network 返回 Via 中使用的传输标识（UDP / TCP ...）。
+	Network() string
+	// Reliable 表示是否为可靠传输（决定事务层是否重传）。
+	Reliable() bool
+	// Start 开始后台接收，收到的消息可从 Recv() 读取。
+	Start()
+	// Recv 返回接收通道（只读），传输关闭后通道关闭。
+	Recv() <-chan *Message
+	// SendTo 将数据发送到 host:port 指定的目标。
+	SendTo(data []byte, hostPort string) error
+	// LocalAddr 返回本地监听地址。
+	LocalAddr() net.Addr
+	// SetCapturer 设置抓包挂钩（见 capture.go），nil 时关闭。
+	SetCapturer(c Capturer)
+	// Stop 关闭传输层。
+	Stop()
 }
 
 // UDPTransport 监听 UDP 端口并收发 SIP 消息。
@@ -38,6 +84,7 @@ type UDPTransport struct {
 	logger  *zap.Logger
 	recvCh  chan *Message
 	stopCh  chan struct{}
+	tap
 }
 
 // NewUDPTransport 创建并绑定 UDP 传输层。
@@ -61,6 +108,12 @@ func NewUDPTransport(addr string, logger *zap.Logger) (*UDPTransport, error) {
 	}, nil
 }
 
+// Network 返回 "UDP"。
+func (t *UDPTransport) Network() string { return NetworkUDP }
+
+// Reliable UDP 不可靠，由事务层负责重传。
+func (t *UDPTransport) Reliable() bool { return false }
+
 // Start 开始后台接收循环，收到的消息可从 Recv() 读取。
 func (t *UDPTransport) Start() {
 	go t.readLoop()
@@ -80,6 +133,7 @@ func (t *UDPTransport) Send(data []byte, dst *net.UDPAddr) error {
 	if err != nil {
 		return fmt.Errorf("send to %s: %w", dst, err)
 	}
+	t.capture(NetworkUDP, t.addr, dst, data)
 	t.logger.Debug("sent SIP message", zap.String("dst", dst.String()), zap.Int("bytes", len(data)))
 	return nil
 }
@@ -94,7 +148,7 @@ func (t *UDPTransport) SendTo(data []byte, hostPort string) error {
 }
 
 // LocalAddr 返回本地监听地址。
-func (t *UDPTransport) LocalAddr() *net.UDPAddr {
+func (t *UDPTransport) LocalAddr() net.Addr {
 	return t.addr
 }
 
@@ -127,7 +181,8 @@ func (t *UDPTransport) readLoop() {
 		// 拷贝数据（buf 会被下次读取覆盖）
 		data := make([]byte, n)
 		copy(data, buf[:n])
-		msg := &Message{Data: data, Source: src}
+		t.capture(NetworkUDP, src, t.addr, data)
+		msg := &Message{Data: data, Source: src, Network: NetworkUDP}
 		select {
 		case t.recvCh <- msg:
 		default:
@@ -0,0 +1,283 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// WebSocket 传输标识（RFC 7118 §5）
+const (
+	NetworkWS  = "WS"
+	NetworkWSS = "WSS"
+)
+
+// wsSubprotocol 是 SIP over WebSocket 协商的子协议名（RFC 7118 §4.1）。
+const wsSubprotocol = "sip"
+
+// WSTransport 是 SIP over WebSocket 传输（RFC 7118），主要服务浏览器软电话。
+//
+// 与 TCP 相比：
+//   - 握手时必须协商 "sip" 子协议，未携带该子协议的连接被拒绝
+//   - WebSocket 自带消息边界：每个帧承载一条完整的 SIP 消息，无需 Content-Length 分帧
+//   - 浏览器无法监听端口，Via sent-by 往往是随机的 .invalid 域名，
+//     因此响应与后续请求都必须沿原连接发回（按远端地址复用连接）
+type WSTransport struct {
+	network  string
+	scheme   string // ws / wss，主动建连时使用
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+	dialer   *websocket.Dialer
+	logger   *zap.Logger
+	recvCh   chan *Message
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+	tap
+
+	mu    sync.Mutex
+	conns map[string]*wsConn // 远端地址 -> 连接
+}
+
+// wsConn 串行化写操作（gorilla/websocket 不允许并发写）。
+type wsConn struct {
+	*websocket.Conn
+	wmu sync.Mutex
+}
+
+func (c *wsConn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	// SIP 消息是 UTF-8 文本，使用文本帧（RFC 7118 §5.1）
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+// NewWSTransport 创建 WebSocket 传输并监听 addr。
+// tlsConfig 为 nil 时为明文 WS，否则为 WSS（可承载 sips:）。
+func NewWSTransport(addr string, tlsConfig *tls.Config, logger *zap.Logger) (*WSTransport, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen WS %q: %w", addr, err)
+	}
+	network, scheme := NetworkWS, "ws"
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+		network, scheme = NetworkWSS, "wss"
+	}
+	logger.Info("WebSocket transport listening",
+		zap.String("network", network), zap.String("addr", addr))
+
+	t := &WSTransport{
+		network:  network,
+		scheme:   scheme,
+		listener: ln,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			Subprotocols:    []string{wsSubprotocol},
+			// 浏览器跨域访问是常态，来源校验交给上层鉴权
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		dialer: &websocket.Dialer{
+			Subprotocols:     []string{wsSubprotocol},
+			HandshakeTimeout: dialTimeout,
+			TLSClientConfig:  tlsConfig,
+		},
+		logger: logger,
+		recvCh: make(chan *Message, streamRecvSize),
+		stopCh: make(chan struct{}),
+		conns:  make(map[string]*wsConn),
+	}
+	t.server = &http.Server{Handler: http.HandlerFunc(t.serveHTTP)}
+	return t, nil
+}
+
+// Network 返回 "WS" 或 "WSS"。
+func (t *WSTransport) Network() string { return t.network }
+
+// Reliable WebSocket 基于 TCP，是可靠传输。
+func (t *WSTransport) Reliable() bool { return true }
+
+// Start 开始接受 WebSocket 握手。
+func (t *WSTransport) Start() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		if err := t.server.Serve(t.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.logger.Error("WebSocket server error", zap.String("network", t.network), zap.Error(err))
+		}
+	}()
+}
+
+// Recv 返回接收通道（只读）。
+func (t *WSTransport) Recv() <-chan *Message {
+	return t.recvCh
+}
+
+// LocalAddr 返回本地监听地址。
+func (t *WSTransport) LocalAddr() net.Addr {
+	return t.listener.Addr()
+}
+
+// SendTo 以一个文本帧发送一条 SIP 消息；没有到 hostPort 的连接时主动建立。
+func (t *WSTransport) SendTo(data []byte, hostPort string) error {
+	conn, err := t.getConn(hostPort)
+	if err != nil {
+		return err
+	}
+	if err := conn.write(data); err != nil {
+		t.closeConn(conn)
+		return fmt.Errorf("send to %s: %w", hostPort, err)
+	}
+	t.capture(t.network, conn.LocalAddr(), conn.RemoteAddr(), data)
+	t.logger.Debug("sent SIP message",
+		zap.String("network", t.network),
+		zap.String("dst", conn.RemoteAddr().String()),
+		zap.Int("bytes", len(data)),
+	)
+	return nil
+}
+
+// Stop 关闭监听与所有连接。
+func (t *WSTransport) Stop() {
+	close(t.stopCh)
+	t.server.Close()
+	t.mu.Lock()
+	for _, c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	close(t.recvCh)
+	t.logger.Info("WebSocket transport stopped", zap.String("network", t.network))
+}
+
+// serveHTTP 完成 WebSocket 握手：客户端必须在 Sec-WebSocket-Protocol 中提供 "sip"。
+func (t *WSTransport) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasSubprotocol(websocket.Subprotocols(r), wsSubprotocol) {
+		http.Error(w, "Sec-WebSocket-Protocol must include \"sip\"", http.StatusBadRequest)
+		return
+	}
+	raw, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		t.logger.Warn("WebSocket upgrade failed", zap.String("network", t.network), zap.Error(err))
+		return
+	}
+	c := t.register(raw)
+	t.logger.Debug("WebSocket connection accepted",
+		zap.String("network", t.network), zap.String("remote", raw.RemoteAddr().String()))
+	t.wg.Add(1)
+	t.readLoop(c)
+}
+
+// getConn 返回到 hostPort 的连接，优先复用已有连接。
+func (t *WSTransport) getConn(hostPort string) (*wsConn, error) {
+	key := hostPort
+	if addr, err := net.ResolveTCPAddr("tcp", hostPort); err == nil {
+		key = addr.String()
+	}
+	t.mu.Lock()
+	if c, ok := t.conns[key]; ok {
+		t.mu.Unlock()
+		return c, nil
+	}
+	t.mu.Unlock()
+
+	raw, _, err := t.dialer.Dial(t.scheme+"://"+hostPort+"/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s %s: %w", t.network, hostPort, err)
+	}
+	if raw.Subprotocol() != wsSubprotocol {
+		raw.Close()
+		return nil, fmt.Errorf("dial %s %s: server did not accept \"sip\" subprotocol", t.network, hostPort)
+	}
+	t.mu.Lock()
+	if c, ok := t.conns[key]; ok {
+		t.mu.Unlock()
+		raw.Close()
+		return c, nil
+	}
+	c := &wsConn{Conn: raw}
+	t.conns[key] = c
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	go t.readLoop(c)
+	return c, nil
+}
+
+func (t *WSTransport) register(raw *websocket.Conn) *wsConn {
+	c := &wsConn{Conn: raw}
+	t.mu.Lock()
+	t.conns[raw.RemoteAddr().String()] = c
+	t.mu.Unlock()
+	return c
+}
+
+func (t *WSTransport) closeConn(c *wsConn) {
+	t.mu.Lock()
+	key := c.RemoteAddr().String()
+	if t.conns[key] == c {
+		delete(t.conns, key)
+	}
+	t.mu.Unlock()
+	c.Close()
+}
+
+func (t *WSTransport) readLoop(c *wsConn) {
+	defer t.wg.Done()
+	defer t.closeConn(c)
+	c.SetReadLimit(maxStreamHead + maxStreamBody)
+	for {
+		kind, data, err := c.ReadMessage()
+		if err != nil {
+			select {
+			case <-t.stopCh:
+			default:
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) &&
+					!errors.Is(err, net.ErrClosed) {
+					t.logger.Warn("WebSocket read error",
+						zap.String("network", t.network),
+						zap.String("remote", c.RemoteAddr().String()),
+						zap.Error(err))
+				}
+			}
+			return
+		}
+		// 每个文本 / 二进制帧恰好承载一条 SIP 消息
+		if kind != websocket.TextMessage && kind != websocket.BinaryMessage {
+			continue
+		}
+		t.capture(t.network, c.RemoteAddr(), c.LocalAddr(), data)
+		msg := &Message{Data: data, Source: c.RemoteAddr(), Network: t.network}
+		select {
+		case t.recvCh <- msg:
+		case <-t.stopCh:
+			return
+		}
+		t.logger.Debug("received SIP message",
+			zap.String("network", t.network),
+			zap.String("src", c.RemoteAddr().String()),
+			zap.Int("bytes", len(data)),
+		)
+	}
+}
+
+func hasSubprotocol(offered []string, want string) bool {
+	for _, p := range offered {
+		if p == want {
+			return true
+		}
+	}
+	return false
+}